@@ -58,6 +58,9 @@ func main() {
 	flag.BoolVar(&versionDetails, "version", false, "print build information and exit")
 	flag.BoolVar(&versionDetails, "v", false, "print build information and exit")
 
+	var printCapabilities bool
+	flag.BoolVar(&printCapabilities, "capabilities", false, "print supported protocols and features, as JSON, and exit")
+
 	var tunDevice, tunBindInterface, tunPrimaryDNS, tunSecondaryDNS string
 	if tun.IsSupported() {
 
@@ -96,6 +99,9 @@ func main() {
 	var rotatingSyncFrequency int
 	flag.IntVar(&rotatingSyncFrequency, "rotatingSyncFrequency", 100, "rotating notices file sync frequency")
 
+	var probeReachability int
+	flag.IntVar(&probeReachability, "probeReachability", 0, "probe reachability of up to the specified number of servers, print a report, and exit")
+
 	flag.Parse()
 
 	if versionDetails {
@@ -129,6 +135,16 @@ func main() {
 		os.Exit(0)
 	}
 
+	if printCapabilities {
+		capabilities, err := json.MarshalIndent(psiphon.GetCapabilities(), "", "    ")
+		if err != nil {
+			fmt.Printf("error encoding capabilities: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", capabilities)
+		os.Exit(0)
+	}
+
 	// Initialize notice output
 
 	var noticeWriter io.Writer
@@ -265,6 +281,25 @@ func main() {
 		}
 	}
 
+	// When probeReachability is specified, probe tunnel protocol
+	// reachability without tunneling, instead of running Psiphon.
+
+	if probeReachability > 0 {
+		report, err := psiphon.ProbeReachability(
+			context.Background(), config, probeReachability)
+		if err != nil {
+			psiphon.NoticeError("error probing reachability: %s", err)
+			os.Exit(1)
+		}
+		reportJSON, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			psiphon.NoticeError("error marshaling reachability report: %s", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", reportJSON)
+		return
+	}
+
 	// Run Psiphon
 
 	controller, err := psiphon.NewController(config)
@@ -76,6 +76,7 @@ public class PsiphonTunnel extends Psi.PsiphonProvider.Stub {
         public String getPsiphonConfig();
         public void onDiagnosticMessage(String message);
         public void onAvailableEgressRegions(List<String> regions);
+        public void onEgressRegionUnavailable(String region);
         public void onSocksProxyPortInUse(int port);
         public void onHttpProxyPortInUse(int port);
         public void onListeningSocksProxyPort(int port);
@@ -611,6 +612,8 @@ public class PsiphonTunnel extends Psi.PsiphonProvider.Stub {
                     regions.add(egressRegions.getString(i));
                 }
                 mHostService.onAvailableEgressRegions(regions);
+            } else if (noticeType.equals("EgressRegionUnavailable")) {
+                mHostService.onEgressRegionUnavailable(notice.getJSONObject("data").getString("region"));
             } else if (noticeType.equals("SocksProxyPortInUse")) {
                 mHostService.onSocksProxyPortInUse(notice.getJSONObject("data").getInt("port"));
             } else if (noticeType.equals("HttpProxyPortInUse")) {
@@ -212,6 +212,11 @@ public class MainActivity extends AppCompatActivity
         }
     }
 
+    @Override
+    public void onEgressRegionUnavailable(String region) {
+        logMessage("egress region unavailable: " + region);
+    }
+
     @Override
     public void onSocksProxyPortInUse(int port) {
         logMessage("local SOCKS proxy port in use: " + Integer.toString(port));
@@ -214,6 +214,16 @@ Swift: @code func onInternetReachabilityChanged(_ currentReachability: Reachabil
  */
 - (void)onAvailableEgressRegions:(NSArray * _Nonnull)regions;
 
+/*!
+ Called when no known server egresses in the region specified by the
+ EgressRegion config value. No tunnel will be established unless servers in
+ the region are later discovered. This can be used to prompt the user to
+ select another region.
+ @param region  The unavailable egress region country code.
+ Swift: @code func onEgressRegionUnavailable(_ region: String) @endcode
+ */
+- (void)onEgressRegionUnavailable:(NSString * _Nonnull)region;
+
 /*!
  If the tunnel is started with a fixed SOCKS proxy port, and that port is
  already in use, this will be called.
@@ -731,6 +731,19 @@
             });
         }
     }
+    else if ([noticeType isEqualToString:@"EgressRegionUnavailable"]) {
+        id region = [notice valueForKeyPath:@"data.region"];
+        if (![region isKindOfClass:[NSString class]]) {
+            [self logMessage:[NSString stringWithFormat: @"EgressRegionUnavailable notice missing data.region: %@", noticeJSON]];
+            return;
+        }
+
+        if ([self.tunneledAppDelegate respondsToSelector:@selector(onEgressRegionUnavailable:)]) {
+            dispatch_sync(self->callbackQueue, ^{
+                [self.tunneledAppDelegate onEgressRegionUnavailable:region];
+            });
+        }
+    }
     else if ([noticeType isEqualToString:@"SocksProxyPortInUse"]) {
         id port = [notice valueForKeyPath:@"data.port"];
         if (![port isKindOfClass:[NSNumber class]]) {
@@ -65,6 +65,20 @@ func NoticeUserLog(message string) {
 	psiphon.NoticeUserLog(message)
 }
 
+// DetachNotices stops delivering notices to PsiphonProvider.Notice, and
+// retains the most recent and most important notices in a bounded buffer,
+// as when the app UI is backgrounded. maxNotices specifies the buffer size;
+// when <= 0, a default is used. See psiphon.DetachNoticeWriter.
+func DetachNotices(maxNotices int) {
+	psiphon.DetachNoticeWriter(maxNotices)
+}
+
+// AttachNotices delivers the notices buffered since DetachNotices and
+// resumes delivering notices. See psiphon.AttachNoticeWriter.
+func AttachNotices() {
+	psiphon.AttachNoticeWriter()
+}
+
 var controllerMutex sync.Mutex
 var controller *psiphon.Controller
 var controllerCtx context.Context
@@ -195,6 +209,139 @@ func ReconnectTunnel() {
 	}
 }
 
+// ForceReconnect closes all tunnels and immediately establishes a new
+// tunnel, if a tunnel is running. When resetReplay is set, server affinity
+// is ignored and the new tunnel is selected from scratch. See
+// Controller.Reconnect.
+func ForceReconnect(resetReplay bool) {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		controller.Reconnect(resetReplay)
+	}
+}
+
+// Pause suspends tunneling, closing all tunnels, while retaining the state
+// used to reconnect quickly on Resume. See Controller.Pause.
+func Pause() {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		controller.Pause()
+	}
+}
+
+// Resume resumes tunneling after Pause. See Controller.Resume.
+func Resume() {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		controller.Resume()
+	}
+}
+
+// NetworkChanged signals that the host network has changed. The current
+// tunnel is retained while a replacement tunnel is established on the new
+// network.
+func NetworkChanged() {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		controller.NetworkChanged()
+	}
+}
+
+// SetNetworkConditionHint sets an advisory hint describing current network
+// conditions: "normal", "congested", or "poor". The hint has no effect if no
+// Controller is started. See psiphon.Controller.SetNetworkConditionHint.
+func SetNetworkConditionHint(hint string) {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		controller.SetNetworkConditionHint(hint)
+	}
+}
+
+// GetActiveTunnelInfo returns a JSON encoded summary of the selected dial
+// parameters of the current active tunnel, or "" when there is no active
+// tunnel. See psiphon.ActiveTunnelInfo.
+func GetActiveTunnelInfo() string {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return ""
+	}
+
+	info := controller.GetActiveTunnelInfo()
+	if info == nil {
+		return ""
+	}
+
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return ""
+	}
+	return string(infoJSON)
+}
+
+// GetRecentEvents returns a JSON encoded list of the most recent tunnel
+// lifecycle events, oldest first, or "" when no Controller is running. The
+// history is retained while the Controller runs, so a UI which reattaches
+// may display events it missed. See psiphon.Controller.GetRecentEvents.
+func GetRecentEvents() string {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return ""
+	}
+
+	eventsJSON, err := json.Marshal(controller.GetRecentEvents())
+	if err != nil {
+		return ""
+	}
+	return string(eventsJSON)
+}
+
+// GetLastKnownRegion returns a JSON encoded psiphon.LastKnownRegion, the
+// client region most recently reported by a server, or "" when no region
+// is known or no Controller is running. The region is persisted and may be
+// returned while offline; it may be stale, as indicated by its "stale"
+// field. See psiphon.Controller.GetLastKnownRegion.
+func GetLastKnownRegion() string {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller == nil {
+		return ""
+	}
+
+	lastKnownRegion := controller.GetLastKnownRegion()
+	if lastKnownRegion == nil {
+		return ""
+	}
+
+	regionJSON, err := json.Marshal(lastKnownRegion)
+	if err != nil {
+		return ""
+	}
+	return string(regionJSON)
+}
+
 // SetDynamicConfig overrides the sponsor ID and authorizations fields set in
 // the config passed to Start. SetDynamicConfig has no effect if no Controller
 // is started.
@@ -218,6 +365,20 @@ func SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer
 	return psiphon.SendFeedback(configJson, diagnosticsJson, b64EncodedPublicKey, uploadServer, uploadPath, uploadServerHeaders)
 }
 
+// ApplyServerListDiff applies a signed server list diff, downloaded
+// out-of-band, to the embedded server list file, which is replaced with the
+// updated server list. The embedded server list file is left intact when the
+// diff fails verification. See psiphon.ApplyServerListDiff.
+func ApplyServerListDiff(configJson, embeddedServerEntryListFilename string, signedDiff []byte) error {
+
+	config, err := psiphon.LoadConfig([]byte(configJson))
+	if err != nil {
+		return fmt.Errorf("error loading configuration file: %s", err)
+	}
+
+	return psiphon.ApplyServerListDiff(config, embeddedServerEntryListFilename, signedDiff)
+}
+
 // Get build info from tunnel-core
 func GetBuildInfo() string {
 	buildInfo, err := json.Marshal(common.GetBuildInfo())
@@ -227,6 +388,16 @@ func GetBuildInfo() string {
 	return string(buildInfo)
 }
 
+// GetCapabilities returns a JSON-encoded manifest of the protocols and
+// features supported by this tunnel-core build; see psiphon.Capabilities.
+func GetCapabilities() string {
+	capabilities, err := json.Marshal(psiphon.GetCapabilities())
+	if err != nil {
+		return ""
+	}
+	return string(capabilities)
+}
+
 func GetPacketTunnelMTU() int {
 	return tun.DEFAULT_MTU
 }
@@ -28,6 +28,7 @@ import (
 	"net"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
@@ -38,28 +39,37 @@ import (
 // socket, binds it to the device, and makes an explicit DNS request
 // to the specified DNS resolver.
 func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, error) {
+	ips, _, err := lookupIPWithTTL(ctx, host, config)
+	return ips, err
+}
+
+// lookupIPWithTTL is LookupIP, additionally returning the minimum DNS
+// record TTL. The TTL is available only in the BindToDevice case, where the
+// DNS response is processed directly; otherwise the returned TTL is 0.
+func lookupIPWithTTL(
+	ctx context.Context, host string, config *DialConfig) ([]net.IP, time.Duration, error) {
 
 	ip := net.ParseIP(host)
 	if ip != nil {
-		return []net.IP{ip}, nil
+		return []net.IP{ip}, 0, nil
 	}
 
 	if config.DeviceBinder != nil {
 
 		dnsServer := config.DnsServerGetter.GetPrimaryDnsServer()
 
-		ips, err := bindLookupIP(ctx, host, dnsServer, config)
+		ips, ttl, err := bindLookupIP(ctx, host, dnsServer, config)
 		if err == nil {
 			if len(ips) == 0 {
 				err = errors.New("empty address list")
 			} else {
-				return ips, err
+				return ips, ttl, err
 			}
 		}
 
 		dnsServer = config.DnsServerGetter.GetSecondaryDnsServer()
 		if dnsServer == "" {
-			return ips, err
+			return ips, ttl, err
 		}
 
 		NoticeAlert("retry resolve host %s: %s", host, err)
@@ -69,7 +79,7 @@ func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, e
 
 	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, 0, common.ContextError(err)
 	}
 
 	ips := make([]net.IP, len(addrs))
@@ -77,18 +87,18 @@ func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, e
 		ips[i] = addr.IP
 	}
 
-	return ips, nil
+	return ips, 0, nil
 }
 
 // bindLookupIP implements the BindToDevice LookupIP case.
 // To implement socket device binding, the lower-level syscall APIs are used.
 func bindLookupIP(
-	ctx context.Context, host, dnsServer string, config *DialConfig) ([]net.IP, error) {
+	ctx context.Context, host, dnsServer string, config *DialConfig) ([]net.IP, time.Duration, error) {
 
 	// config.DnsServerGetter.GetDnsServers() must return IP addresses
 	ipAddr := net.ParseIP(dnsServer)
 	if ipAddr == nil {
-		return nil, common.ContextError(errors.New("invalid IP address"))
+		return nil, 0, common.ContextError(errors.New("invalid IP address"))
 	}
 
 	// When configured, attempt to synthesize an IPv6 address from
@@ -116,18 +126,18 @@ func bindLookupIP(
 		copy(ipv6[:], ipAddr.To16())
 		domain = syscall.AF_INET6
 	} else {
-		return nil, common.ContextError(fmt.Errorf("invalid IP address for dns server: %s", ipAddr.String()))
+		return nil, 0, common.ContextError(fmt.Errorf("invalid IP address for dns server: %s", ipAddr.String()))
 	}
 
 	socketFd, err := syscall.Socket(domain, syscall.SOCK_DGRAM, 0)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, 0, common.ContextError(err)
 	}
 
 	_, err = config.DeviceBinder.BindToDevice(socketFd)
 	if err != nil {
 		syscall.Close(socketFd)
-		return nil, common.ContextError(fmt.Errorf("BindToDevice failed: %s", err))
+		return nil, 0, common.ContextError(fmt.Errorf("BindToDevice failed: %s", err))
 	}
 
 	// Connect socket to the server's IP address
@@ -141,7 +151,7 @@ func bindLookupIP(
 	}
 	if err != nil {
 		syscall.Close(socketFd)
-		return nil, common.ContextError(err)
+		return nil, 0, common.ContextError(err)
 	}
 
 	// Convert the syscall socket to a net.Conn, for use in the dns package
@@ -152,20 +162,21 @@ func bindLookupIP(
 	netConn, err := net.FileConn(file) // net.FileConn() dups socketFd
 	file.Close()                       // file.Close() closes socketFd
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, 0, common.ContextError(err)
 	}
 
 	type resolveIPResult struct {
-		ips []net.IP
-		err error
+		ips  []net.IP
+		ttls []time.Duration
+		err  error
 	}
 
 	resultChannel := make(chan resolveIPResult)
 
 	go func() {
-		ips, _, err := ResolveIP(host, netConn)
+		ips, ttls, err := ResolveIP(host, netConn)
 		netConn.Close()
-		resultChannel <- resolveIPResult{ips: ips, err: err}
+		resultChannel <- resolveIPResult{ips: ips, ttls: ttls, err: err}
 	}()
 
 	var result resolveIPResult
@@ -180,8 +191,15 @@ func bindLookupIP(
 	}
 
 	if result.err != nil {
-		return nil, common.ContextError(err)
+		return nil, 0, common.ContextError(err)
+	}
+
+	var minTTL time.Duration
+	for i, ttl := range result.ttls {
+		if i == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
 	}
 
-	return result.ips, nil
+	return result.ips, minTTL, nil
 }
@@ -25,20 +25,30 @@ import (
 	"context"
 	"errors"
 	"net"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
 
 // LookupIP resolves a hostname.
 func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, error) {
+	ips, _, err := lookupIPWithTTL(ctx, host, config)
+	return ips, err
+}
+
+// lookupIPWithTTL is LookupIP, additionally returning the minimum DNS
+// record TTL. The TTL is not available on this platform and the returned
+// TTL is always 0.
+func lookupIPWithTTL(
+	ctx context.Context, host string, config *DialConfig) ([]net.IP, time.Duration, error) {
 
 	if config.DeviceBinder != nil {
-		return nil, common.ContextError(errors.New("LookupIP with DeviceBinder not supported on this platform"))
+		return nil, 0, common.ContextError(errors.New("LookupIP with DeviceBinder not supported on this platform"))
 	}
 
 	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, 0, common.ContextError(err)
 	}
 
 	ips := make([]net.IP, len(addrs))
@@ -46,5 +56,5 @@ func LookupIP(ctx context.Context, host string, config *DialConfig) ([]net.IP, e
 		ips[i] = addr.IP
 	}
 
-	return ips, nil
+	return ips, 0, nil
 }
@@ -37,7 +37,9 @@ import (
 // requires syscall-level socket code.
 type TCPConn struct {
 	net.Conn
-	isClosed int32
+	isClosed            int32
+	tcpFastOpenCallback func(bool)
+	checkedTCPFastOpen  int32
 }
 
 // NewTCPDialer creates a TCP Dialer.
@@ -61,6 +63,12 @@ func DialTCP(
 	var conn net.Conn
 	var err error
 
+	if config.TCPConnectTimeout > 0 {
+		var cancelFunc context.CancelFunc
+		ctx, cancelFunc = context.WithTimeout(ctx, config.TCPConnectTimeout)
+		defer cancelFunc()
+	}
+
 	if config.UpstreamProxyURL != "" {
 		conn, err = proxiedTcpDial(ctx, addr, config)
 	} else {
@@ -105,6 +113,9 @@ func proxiedTcpDial(
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
+		if config.tcpConnCallback != nil {
+			config.tcpConnCallback(conn)
+		}
 		return conn, nil
 	}
 
@@ -151,6 +162,20 @@ func proxiedTcpDial(
 	return result.conn, nil
 }
 
+// Read implements the net.Conn interface. When the conn was dialed with TCP
+// Fast Open, the first successful Read reports whether the SYN data was
+// acknowledged, which is known once the server has responded.
+func (conn *TCPConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 &&
+		conn.tcpFastOpenCallback != nil &&
+		atomic.CompareAndSwapInt32(&conn.checkedTCPFastOpen, 0, 1) {
+
+		conn.tcpFastOpenCallback(getTCPFastOpenSYNDataAcked(conn.Conn))
+	}
+	return n, err
+}
+
 // Close terminates a connected TCPConn or interrupts a dialing TCPConn.
 func (conn *TCPConn) Close() (err error) {
 
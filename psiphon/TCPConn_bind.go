@@ -25,7 +25,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
 	"strconv"
@@ -35,6 +34,10 @@ import (
 	"github.com/creack/goselect"
 )
 
+// TCP_SOURCE_PORT_BIND_ATTEMPTS is the number of random source ports tried
+// before falling back to an ephemeral port.
+const TCP_SOURCE_PORT_BIND_ATTEMPTS = 10
+
 // tcpDial is the platform-specific part of DialTCP
 //
 // To implement socket device binding, the lower-level syscall APIs are used.
@@ -52,7 +55,7 @@ func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, er
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
-	ipAddrs, err := LookupIP(ctx, host, config)
+	ipAddrs, err := config.lookupIP(ctx, host)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -77,190 +80,345 @@ func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, er
 		}
 	}
 
-	// Iterate over a pseudorandom permutation of the destination
-	// IPs and attempt connections.
-	//
-	// Only continue retrying as long as the dial context is not
-	// done. Unlike net.Dial, we do not fractionalize the context
-	// deadline, as the dial is generally intended to apply to a
-	// single attempt. So these serial retries are most useful in
-	// cases of immediate failure, such as "no route to host"
-	// errors when a host resolves to both IPv4 and IPv6 but IPv6
-	// addresses are unreachable.
-	//
-	// Retries at higher levels cover other cases: e.g.,
-	// Controller.remoteServerListFetcher will retry its entire
-	// operation and tcpDial will try a new permutation; or similarly,
-	// Controller.establishCandidateGenerator will retry a candidate
-	// tunnel server dials.
-
-	permutedIndexes := rand.Perm(len(ipAddrs))
-
-	lastErr := errors.New("unknown error")
-
-	for _, index := range permutedIndexes {
-
-		// Get address type (IPv4 or IPv6)
-
-		var ipv4 [4]byte
-		var ipv6 [16]byte
-		var domain int
-		var sockAddr syscall.Sockaddr
+	return dialIPAddresses(
+		ctx,
+		ipAddrs,
+		config,
+		func(ctx context.Context, ipAddr net.IP) (net.Conn, error) {
+			return tcpDialIP(ctx, ipAddr, port, config)
+		})
+}
+
+// tcpDialIP creates a socket, applying the DialConfig socket options, and
+// connects to the specified IP address and port.
+func tcpDialIP(
+	ctx context.Context, ipAddr net.IP, port int, config *DialConfig) (net.Conn, error) {
+
+	// Get address type (IPv4 or IPv6)
+
+	var ipv4 [4]byte
+	var ipv6 [16]byte
+	var domain int
+	var sockAddr syscall.Sockaddr
+
+	if ipAddr != nil && ipAddr.To4() != nil {
+		copy(ipv4[:], ipAddr.To4())
+		domain = syscall.AF_INET
+	} else if ipAddr != nil && ipAddr.To16() != nil {
+		copy(ipv6[:], ipAddr.To16())
+		domain = syscall.AF_INET6
+	} else {
+		return nil, common.ContextError(fmt.Errorf("invalid IP address: %s", ipAddr.String()))
+	}
+	if domain == syscall.AF_INET {
+		sockAddr = &syscall.SockaddrInet4{Addr: ipv4, Port: port}
+	} else if domain == syscall.AF_INET6 {
+		sockAddr = &syscall.SockaddrInet6{Addr: ipv6, Port: port}
+	}
+
+	// Create a socket and bind to device, when configured to do so
+
+	socketFD, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	syscall.CloseOnExec(socketFD)
+
+	setAdditionalSocketOptions(socketFD)
+
+	setSocketDSCP(socketFD, domain, config.DSCP)
+
+	// With TCP Fast Open, the connect is deferred until the first write,
+	// which is sent in the SYN when a TCP Fast Open cookie is cached for
+	// the server. Failure is not fatal and the dial proceeds without
+	// TCP Fast Open.
 
-		ipAddr := ipAddrs[index]
-		if ipAddr != nil && ipAddr.To4() != nil {
-			copy(ipv4[:], ipAddr.To4())
-			domain = syscall.AF_INET
-		} else if ipAddr != nil && ipAddr.To16() != nil {
-			copy(ipv6[:], ipAddr.To16())
-			domain = syscall.AF_INET6
+	tcpFastOpen := false
+	if config.TCPFastOpen && config.UpstreamProxyURL == "" {
+		err = setSocketTCPFastOpen(socketFD)
+		if err != nil {
+			NoticeAlert("setSocketTCPFastOpen failed: %s", common.ContextError(err))
 		} else {
-			lastErr = common.ContextError(fmt.Errorf("invalid IP address: %s", ipAddr.String()))
-			continue
+			tcpFastOpen = true
 		}
-		if domain == syscall.AF_INET {
-			sockAddr = &syscall.SockaddrInet4{Addr: ipv4, Port: port}
-		} else if domain == syscall.AF_INET6 {
-			sockAddr = &syscall.SockaddrInet6{Addr: ipv6, Port: port}
-		}
-
-		// Create a socket and bind to device, when configured to do so
+	}
 
-		socketFD, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
+	if config.DeviceBinder != nil {
+		_, err = config.DeviceBinder.BindToDevice(socketFD)
 		if err != nil {
-			lastErr = common.ContextError(err)
-			continue
+			syscall.Close(socketFD)
+			return nil, common.ContextError(fmt.Errorf("BindToDevice failed: %s", err))
 		}
+	}
 
-		syscall.CloseOnExec(socketFD)
+	// Apply any source port reuse policy. A reused port is bound with
+	// SO_REUSEADDR, as the previous connection may be in TIME_WAIT.
 
-		setAdditionalSocketOptions(socketFD)
+	sourcePortHistory := config.sourcePortHistory
+	sourcePortPolicy := config.SourcePortPolicy
+	if sourcePortHistory == nil {
+		sourcePortPolicy = SOURCE_PORT_POLICY_OS_DEFAULT
+	}
+	remoteAddr := net.JoinHostPort(ipAddr.String(), strconv.Itoa(port))
 
-		if config.DeviceBinder != nil {
-			_, err = config.DeviceBinder.BindToDevice(socketFD)
+	reusedSourcePort := false
+	if sourcePortPolicy == SOURCE_PORT_POLICY_REUSE_WITHIN_WINDOW {
+		reusePort, ok := sourcePortHistory.getReusablePort(remoteAddr, config.SourcePortWindow)
+		if ok {
+			err = bindSocketReusedSourcePort(socketFD, domain, reusePort)
 			if err != nil {
-				syscall.Close(socketFD)
-				lastErr = common.ContextError(fmt.Errorf("BindToDevice failed: %s", err))
-				continue
+				NoticeAlert("bindSocketReusedSourcePort failed: %s", common.ContextError(err))
+			} else {
+				reusedSourcePort = true
 			}
 		}
+	}
 
-		// Connect socket to the server's IP address
+	if !reusedSourcePort {
+		sourcePortMin := config.SourcePortMin
+		sourcePortMax := config.SourcePortMax
+		var excludePort func(int) bool
+		if sourcePortPolicy == SOURCE_PORT_POLICY_FRESH {
+			if sourcePortMin <= 0 {
+				sourcePortMin = SOURCE_PORT_FRESH_MIN
+				sourcePortMax = SOURCE_PORT_FRESH_MAX
+			}
+			excludePort = func(port int) bool {
+				return sourcePortHistory.isRecentlyUsed(port, config.SourcePortWindow)
+			}
+		}
+		if sourcePortMin > 0 {
+			err = bindSocketSourcePort(
+				socketFD, domain, sourcePortMin, sourcePortMax, excludePort)
+			if err != nil {
+				NoticeAlert("bindSocketSourcePort failed: %s", common.ContextError(err))
+			}
+		}
+	}
 
-		err = syscall.SetNonblock(socketFD, true)
-		if err != nil {
+	// Connect socket to the server's IP address
+
+	err = syscall.SetNonblock(socketFD, true)
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
+
+	err = syscall.Connect(socketFD, sockAddr)
+	if err != nil {
+		errno, ok := err.(syscall.Errno)
+		if ok && errno == syscall.EADDRNOTAVAIL && reusedSourcePort {
+			// The previous connection to the same destination is still in
+			// TIME_WAIT. Dial again without reusing the source port.
 			syscall.Close(socketFD)
-			lastErr = common.ContextError(err)
-			continue
+			sourcePortHistory.forget(remoteAddr)
+			return tcpDialIP(ctx, ipAddr, port, config)
+		}
+		if !ok || errno != syscall.EINPROGRESS {
+			syscall.Close(socketFD)
+			return nil, common.ContextError(err)
 		}
+	}
+
+	// Use a control pipe to interrupt if the dial context is done (timeout or
+	// interrupted) before the TCP connection is established.
 
-		err = syscall.Connect(socketFD, sockAddr)
+	var controlFDs [2]int
+	err = syscall.Pipe(controlFDs[:])
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+
+	}
+
+	for _, controlFD := range controlFDs {
+		syscall.CloseOnExec(controlFD)
+		err = syscall.SetNonblock(controlFD, true)
 		if err != nil {
-			if errno, ok := err.(syscall.Errno); !ok || errno != syscall.EINPROGRESS {
-				syscall.Close(socketFD)
-				lastErr = common.ContextError(err)
-				continue
-			}
+			break
 		}
+	}
 
-		// Use a control pipe to interrupt if the dial context is done (timeout or
-		// interrupted) before the TCP connection is established.
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
 
-		var controlFDs [2]int
-		err = syscall.Pipe(controlFDs[:])
-		if err != nil {
-			syscall.Close(socketFD)
-			lastErr = common.ContextError(err)
-			continue
+	resultChannel := make(chan error)
 
-		}
+	go func() {
 
-		for _, controlFD := range controlFDs {
-			syscall.CloseOnExec(controlFD)
-			err = syscall.SetNonblock(controlFD, true)
-			if err != nil {
-				break
-			}
+		readSet := goselect.FDSet{}
+		readSet.Set(uintptr(controlFDs[0]))
+		writeSet := goselect.FDSet{}
+		writeSet.Set(uintptr(socketFD))
+
+		max := socketFD
+		if controlFDs[0] > max {
+			max = controlFDs[0]
 		}
 
-		if err != nil {
-			syscall.Close(socketFD)
-			lastErr = common.ContextError(err)
-			continue
+		err := goselect.Select(max+1, &readSet, &writeSet, nil, -1)
+
+		if err == nil && !writeSet.IsSet(uintptr(socketFD)) {
+			err = errors.New("interrupted")
 		}
 
-		resultChannel := make(chan error)
+		resultChannel <- err
+	}()
+
+	select {
+	case err = <-resultChannel:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// Interrupt the goroutine
+		// TODO: if this Write fails, abandon the goroutine instead of hanging?
+		var b [1]byte
+		syscall.Write(controlFDs[1], b[:])
+		<-resultChannel
+	}
 
-		go func() {
+	syscall.Close(controlFDs[0])
+	syscall.Close(controlFDs[1])
 
-			readSet := goselect.FDSet{}
-			readSet.Set(uintptr(controlFDs[0]))
-			writeSet := goselect.FDSet{}
-			writeSet.Set(uintptr(socketFD))
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
 
-			max := socketFD
-			if controlFDs[0] > max {
-				max = controlFDs[0]
+	err = syscall.SetNonblock(socketFD, false)
+	if err != nil {
+		syscall.Close(socketFD)
+		return nil, common.ContextError(err)
+	}
+
+	if sourcePortPolicy != SOURCE_PORT_POLICY_OS_DEFAULT {
+		localSockAddr, err := syscall.Getsockname(socketFD)
+		if err == nil {
+			localPort := 0
+			switch addr := localSockAddr.(type) {
+			case *syscall.SockaddrInet4:
+				localPort = addr.Port
+			case *syscall.SockaddrInet6:
+				localPort = addr.Port
+			}
+			if localPort > 0 {
+				sourcePortHistory.record(remoteAddr, localPort, config.SourcePortWindow)
 			}
+		}
+		if reusedSourcePort && config.SourcePortReusedCallback != nil {
+			config.SourcePortReusedCallback()
+		}
+	}
 
-			err := goselect.Select(max+1, &readSet, &writeSet, nil, -1)
+	// Convert the socket fd to a net.Conn
+	// This code block is from:
+	// https://github.com/golang/go/issues/6966
 
-			if err == nil && !writeSet.IsSet(uintptr(socketFD)) {
-				err = errors.New("interrupted")
-			}
+	file := os.NewFile(uintptr(socketFD), "")
+	conn, err := net.FileConn(file) // net.FileConn() dups socketFD
+	file.Close()                    // file.Close() closes socketFD
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
 
-			resultChannel <- err
-		}()
-
-		done := false
-		select {
-		case err = <-resultChannel:
-		case <-ctx.Done():
-			err = ctx.Err()
-			// Interrupt the goroutine
-			// TODO: if this Write fails, abandon the goroutine instead of hanging?
-			var b [1]byte
-			syscall.Write(controlFDs[1], b[:])
-			<-resultChannel
-			done = true
-		}
+	tcpConn := &TCPConn{Conn: conn}
+	if tcpFastOpen {
+		tcpConn.tcpFastOpenCallback = config.TCPFastOpenCallback
+	}
 
-		syscall.Close(controlFDs[0])
-		syscall.Close(controlFDs[1])
+	return tcpConn, nil
+}
 
-		if err != nil {
-			syscall.Close(socketFD)
+// bindSocketSourcePort binds the socket to a random local port in the
+// range [minPort, maxPort]. When the port is in use, or excluded by the
+// optional excludePort, another port is selected. When no port is bound,
+// the socket remains unbound and connect assigns an ephemeral port.
+func bindSocketSourcePort(
+	socketFD, domain, minPort, maxPort int, excludePort func(int) bool) error {
 
-			if done {
-				// Skip retry as dial context has timed out of been canceled.
-				return nil, common.ContextError(err)
-			}
+	var err error
 
-			lastErr = common.ContextError(err)
-			continue
-		}
+	for i := 0; i < TCP_SOURCE_PORT_BIND_ATTEMPTS; i++ {
 
-		err = syscall.SetNonblock(socketFD, false)
+		var port int
+		port, err = common.MakeSecureRandomRange(minPort, maxPort)
 		if err != nil {
-			syscall.Close(socketFD)
-			lastErr = common.ContextError(err)
+			return common.ContextError(err)
+		}
+
+		if excludePort != nil && excludePort(port) {
+			err = errors.New("recently used source port")
 			continue
 		}
 
-		// Convert the socket fd to a net.Conn
-		// This code block is from:
-		// https://github.com/golang/go/issues/6966
+		var sockAddr syscall.Sockaddr
+		if domain == syscall.AF_INET6 {
+			sockAddr = &syscall.SockaddrInet6{Port: port}
+		} else {
+			sockAddr = &syscall.SockaddrInet4{Port: port}
+		}
 
-		file := os.NewFile(uintptr(socketFD), "")
-		conn, err := net.FileConn(file) // net.FileConn() dups socketFD
-		file.Close()                    // file.Close() closes socketFD
-		if err != nil {
-			lastErr = common.ContextError(err)
-			continue
+		err = syscall.Bind(socketFD, sockAddr)
+		if err == nil {
+			return nil
 		}
 
-		return &TCPConn{Conn: conn}, nil
+		if errno, ok := err.(syscall.Errno); !ok || errno != syscall.EADDRINUSE {
+			return common.ContextError(err)
+		}
 	}
 
-	return nil, lastErr
+	return common.ContextError(err)
+}
+
+// bindSocketReusedSourcePort binds the socket to port, a source port
+// reused from a previous connection, with SO_REUSEADDR set.
+func bindSocketReusedSourcePort(socketFD, domain, port int) error {
+
+	err := syscall.SetsockoptInt(socketFD, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	var sockAddr syscall.Sockaddr
+	if domain == syscall.AF_INET6 {
+		sockAddr = &syscall.SockaddrInet6{Port: port}
+	} else {
+		sockAddr = &syscall.SockaddrInet4{Port: port}
+	}
+
+	err = syscall.Bind(socketFD, sockAddr)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// setSocketDSCP sets the DSCP value of packets sent on the socket. DSCP
+// values outside of 1 to 63 are ignored. Failure is logged and is not
+// fatal, as some platforms and networks don't permit setting DSCP values.
+func setSocketDSCP(socketFD, domain, dscp int) {
+
+	if dscp < 1 || dscp > 63 {
+		return
+	}
+
+	// The DSCP value is the upper 6 bits of the IPv4 TOS and IPv6 traffic
+	// class fields; the lower 2 bits are ECN.
+	trafficClass := dscp << 2
+
+	var err error
+	if domain == syscall.AF_INET6 {
+		err = syscall.SetsockoptInt(
+			socketFD, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, trafficClass)
+	} else {
+		err = syscall.SetsockoptInt(
+			socketFD, syscall.IPPROTO_IP, syscall.IP_TOS, trafficClass)
+	}
+	if err != nil {
+		NoticeAlert("setSocketDSCP failed: %s", common.ContextError(err))
+	}
 }
@@ -0,0 +1,149 @@
+// +build !windows
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPSourcePort(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dial := func(sourcePortMin, sourcePortMax int) int {
+		config := &DialConfig{
+			SourcePortMin: sourcePortMin,
+			SourcePortMax: sourcePortMax,
+		}
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFunc()
+		conn, err := DialTCP(ctx, listener.Addr().String(), config)
+		if err != nil {
+			t.Fatalf("DialTCP failed: %s", err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().(*net.TCPAddr).Port
+	}
+
+	sourcePortMin := 40000
+	sourcePortMax := 40999
+
+	for i := 0; i < 10; i++ {
+		port := dial(sourcePortMin, sourcePortMax)
+		if port < sourcePortMin || port > sourcePortMax {
+			t.Fatalf("unexpected source port: %d", port)
+		}
+	}
+
+	// When the only port in the range is in use, the dial falls back to an
+	// ephemeral port.
+
+	inUseListener, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer inUseListener.Close()
+	inUsePort := inUseListener.Addr().(*net.TCPAddr).Port
+
+	port := dial(inUsePort, inUsePort)
+	if port == inUsePort {
+		t.Fatalf("unexpected source port: %d", port)
+	}
+}
+
+func TestTCPSourcePortPolicy(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	// The server closes each conn first, so the client conns don't enter
+	// TIME_WAIT and their source ports may be reused.
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	history := newSourcePortHistory()
+
+	dial := func(policy string) (int, bool) {
+		reused := false
+		config := &DialConfig{
+			SourcePortPolicy:         policy,
+			SourcePortWindow:         time.Minute,
+			SourcePortReusedCallback: func() { reused = true },
+			sourcePortHistory:        history,
+		}
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFunc()
+		conn, err := DialTCP(ctx, listener.Addr().String(), config)
+		if err != nil {
+			t.Fatalf("DialTCP failed: %s", err)
+		}
+		defer conn.Close()
+		_, _ = conn.Read(make([]byte, 1))
+		return conn.LocalAddr().(*net.TCPAddr).Port, reused
+	}
+
+	usedPorts := make(map[int]bool)
+	for i := 0; i < 10; i++ {
+		port, reused := dial(SOURCE_PORT_POLICY_FRESH)
+		if reused || usedPorts[port] ||
+			port < SOURCE_PORT_FRESH_MIN || port > SOURCE_PORT_FRESH_MAX {
+			t.Fatalf("unexpected fresh source port: %d", port)
+		}
+		usedPorts[port] = true
+	}
+
+	firstPort, _ := dial(SOURCE_PORT_POLICY_REUSE_WITHIN_WINDOW)
+	for i := 0; i < 3; i++ {
+		port, reused := dial(SOURCE_PORT_POLICY_REUSE_WITHIN_WINDOW)
+		if !reused || port != firstPort {
+			t.Fatalf("unexpected reused source port: %d, %d", port, firstPort)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"golang.org/x/sys/unix"
+)
+
+// TCP_FASTOPEN_CONNECT and TCPI_OPT_SYN_DATA, from linux/tcp.h, are not
+// defined for all architectures.
+const (
+	tcpFastOpenConnect = 30
+	tcpiOptSYNData     = 0x20
+)
+
+// setSocketTCPFastOpen enables client TCP Fast Open on a socket that is not
+// yet connected. TCP_FASTOPEN_CONNECT requires Linux 4.11 or later, and
+// client TCP Fast Open must be enabled by the net.ipv4.tcp_fastopen sysctl.
+func setSocketTCPFastOpen(socketFD int) error {
+	err := syscall.SetsockoptInt(
+		socketFD, syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// getTCPFastOpenSYNDataAcked returns whether the server acknowledged the
+// data sent in the SYN.
+func getTCPFastOpenSYNDataAcked(conn net.Conn) bool {
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	acked := false
+	_ = rawConn.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		acked = err == nil && info.Options&tcpiOptSYNData != 0
+	})
+
+	return acked
+}
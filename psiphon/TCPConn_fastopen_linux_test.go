@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPFastOpen(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	// Enable server TCP Fast Open, when permitted by the sysctl. Otherwise,
+	// the client TCP Fast Open dial must still succeed.
+
+	sysctl, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	flags, err := strconv.Atoi(strings.TrimSpace(string(sysctl)))
+	if err != nil {
+		t.Fatalf("Atoi failed: %s", err)
+	}
+	expectAcked := flags&3 == 3
+
+	rawConn, err := listener.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %s", err)
+	}
+	err = rawConn.Control(func(fd uintptr) {
+		err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, 23, 16)
+		if err != nil {
+			expectAcked = false
+		}
+	})
+	if err != nil {
+		t.Fatalf("Control failed: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	// The first dial obtains the TCP Fast Open cookie; the SYN data of the
+	// second dial is then expected to be acknowledged.
+
+	for i := 0; i < 2; i++ {
+
+		var attempted, acked int32
+
+		config := &DialConfig{
+			TCPFastOpen: true,
+			TCPFastOpenCallback: func(synDataAcked bool) {
+				atomic.StoreInt32(&attempted, 1)
+				if synDataAcked {
+					atomic.StoreInt32(&acked, 1)
+				}
+			},
+		}
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := DialTCP(ctx, listener.Addr().String(), config)
+		cancelFunc()
+		if err != nil {
+			t.Fatalf("DialTCP failed: %s", err)
+		}
+
+		message := []byte("message")
+		_, err = conn.Write(message)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		response := make([]byte, len(message))
+		_, err = io.ReadFull(conn, response)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if string(response) != string(message) {
+			t.Fatalf("unexpected response: %s", response)
+		}
+
+		conn.Close()
+
+		if atomic.LoadInt32(&attempted) != 1 {
+			t.Fatalf("TCP Fast Open outcome not reported")
+		}
+
+		if i == 1 && expectAcked && atomic.LoadInt32(&acked) != 1 {
+			t.Fatalf("TCP Fast Open SYN data not acknowledged")
+		}
+
+		t.Logf("dial %d: SYN data acknowledged: %v", i, atomic.LoadInt32(&acked) == 1)
+	}
+}
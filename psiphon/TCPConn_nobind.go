@@ -30,12 +30,49 @@ import (
 )
 
 // tcpDial is the platform-specific part of DialTCP
+//
+// TCP Fast Open and source port selection are not supported, and
+// DialConfig.TCPFastOpen, DialConfig.SourcePortMin/Max, and
+// DialConfig.SourcePortPolicy are ignored.
 func tcpDial(ctx context.Context, addr string, config *DialConfig) (net.Conn, error) {
 
 	if config.DeviceBinder != nil {
 		return nil, common.ContextError(errors.New("psiphon.interruptibleTCPDial with DeviceBinder not supported"))
 	}
 
+	// When a DNS cache is configured, or an IP address family is preferred,
+	// resolve the domain name here so that the IP address families may be
+	// ordered and raced; see dialIPAddresses.
+
+	if config.dnsCache != nil ||
+		config.ipAddressFamilyPreference.getPreferredFamily() != "" {
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		ipAddrs, err := config.lookupIP(ctx, host)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		if len(ipAddrs) < 1 {
+			return nil, common.ContextError(errors.New("no IP address"))
+		}
+
+		return dialIPAddresses(
+			ctx,
+			ipAddrs,
+			config,
+			func(ctx context.Context, ipAddr net.IP) (net.Conn, error) {
+				return tcpDialAddress(ctx, net.JoinHostPort(ipAddr.String(), port))
+			})
+	}
+
+	return tcpDialAddress(ctx, addr)
+}
+
+func tcpDialAddress(ctx context.Context, addr string) (net.Conn, error) {
+
 	dialer := net.Dialer{}
 
 	conn, err := dialer.DialContext(ctx, "tcp", addr)
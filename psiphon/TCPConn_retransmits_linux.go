@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// getTCPRetransmits returns the total number of segments retransmitted on a
+// TCP conn, as reported by TCP_INFO. conn may be a TCPConn or a
+// net.TCPConn. false is returned when the count isn't available.
+func getTCPRetransmits(conn net.Conn) (uint32, bool) {
+
+	if psiphonTCPConn, ok := conn.(*TCPConn); ok {
+		conn = psiphonTCPConn.Conn
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, false
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	var retransmits uint32
+	ok = false
+	_ = rawConn.Control(func(fd uintptr) {
+		info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		if err == nil {
+			retransmits = info.Total_retrans
+			ok = true
+		}
+	})
+
+	return retransmits, ok
+}
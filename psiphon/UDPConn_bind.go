@@ -41,6 +41,8 @@ func newUDPConn(domain int, config *DialConfig) (net.PacketConn, error) {
 
 	setAdditionalSocketOptions(socketFD)
 
+	setSocketDSCP(socketFD, domain, config.DSCP)
+
 	if config.DeviceBinder != nil {
 		err := bindToDeviceCallWrapper(config.DeviceBinder, socketFD)
 		if err != nil {
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ActiveTunnelInfo is a summary of the selected dial parameters of an
+// active tunnel, for display in troubleshooting and advanced user UIs.
+//
+// ActiveTunnelInfo is privacy-safe: it omits the server IP address, meek
+// host header, session ID, and all keys and other secrets. For fronted meek,
+// only the front domain family, the last two labels of the front domain, is
+// reported.
+//
+// QoEScore is the tunnel connection quality score, from 0 (poor) to 100
+// (good), which is periodically updated while the tunnel is active, or nil
+// when there's not yet a score. See tunnelQoE.
+type ActiveTunnelInfo struct {
+	TunnelProtocol    string `json:"tunnelProtocol"`
+	IsFronted         bool   `json:"isFronted"`
+	FrontDomainFamily string `json:"frontDomainFamily,omitempty"`
+	TLSProfile        string `json:"tlsProfile,omitempty"`
+	QUICVersion       string `json:"quicVersion,omitempty"`
+	EgressRegion      string `json:"egressRegion"`
+	QoEScore          *int   `json:"qoeScore,omitempty"`
+}
+
+// GetActiveTunnelInfo returns a summary of the selected dial parameters of
+// the current active tunnel, or nil when there is no active tunnel. As the
+// summary is taken from the current tunnel, each call reflects any reconnect
+// or tunnel migration. When a handoff is in progress, the handoff tunnel,
+// which continues to carry traffic, is reported. A DNS tunnel, used with
+// LocalDNSProxySeparateTunnel, is not reported.
+func (controller *Controller) GetActiveTunnelInfo() *ActiveTunnelInfo {
+
+	controller.tunnelMutex.Lock()
+	var tunnel *Tunnel
+	for _, candidate := range append(controller.tunnels, controller.handoffTunnels...) {
+		if !candidate.isDNSTunnel {
+			tunnel = candidate
+			break
+		}
+	}
+	controller.tunnelMutex.Unlock()
+
+	if tunnel == nil {
+		return nil
+	}
+
+	return tunnel.getActiveTunnelInfo()
+}
+
+func (tunnel *Tunnel) getActiveTunnelInfo() *ActiveTunnelInfo {
+
+	info := &ActiveTunnelInfo{
+		TunnelProtocol: tunnel.protocol,
+		IsFronted:      protocol.TunnelProtocolIsFronted(tunnel.protocol),
+		EgressRegion:   tunnel.serverEntry.Region,
+	}
+
+	if tunnel.qoe != nil {
+		if score, ok := tunnel.qoe.getScore(); ok {
+			info.QoEScore = &score
+		}
+	}
+
+	dialParams := tunnel.dialParams
+	if dialParams == nil {
+		return info
+	}
+
+	if info.IsFronted {
+		frontDomain := dialParams.MeekSNIServerName
+		if frontDomain == "" {
+			frontDomain, _, _ = net.SplitHostPort(dialParams.MeekDialAddress)
+		}
+		info.FrontDomainFamily = getDomainFamily(frontDomain)
+	}
+
+	// TLSProfile and QUICVersion are blank when not used by the protocol.
+	info.TLSProfile = dialParams.TLSProfile
+	info.QUICVersion = dialParams.QUICVersion
+
+	return info
+}
+
+// getDomainFamily returns the last two labels of domain; e.g.,
+// "example.com" for "a.b.example.com". "" is returned for IP addresses.
+func getDomainFamily(domain string) string {
+
+	if domain == "" || net.ParseIP(domain) != nil {
+		return ""
+	}
+
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestGetActiveTunnelInfo(t *testing.T) {
+
+	controller := &Controller{}
+
+	if controller.GetActiveTunnelInfo() != nil {
+		t.Fatalf("unexpected info with no active tunnel")
+	}
+
+	frontedTunnel := &Tunnel{
+		protocol: protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+		serverEntry: &protocol.ServerEntry{
+			IpAddress: "192.168.0.1",
+			Region:    "CA",
+		},
+		dialParams: &DialParameters{
+			TunnelProtocol:    protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+			MeekDialAddress:   "cdn.example.com:443",
+			MeekHostHeader:    "secret.example.org",
+			MeekSNIServerName: "a.cdn.example.com",
+			TLSProfile:        protocol.TLS_PROFILE_CHROME_58,
+		},
+	}
+
+	controller.handoffTunnels = []*Tunnel{frontedTunnel}
+
+	info := controller.GetActiveTunnelInfo()
+	if info == nil ||
+		info.TunnelProtocol != protocol.TUNNEL_PROTOCOL_FRONTED_MEEK ||
+		!info.IsFronted ||
+		info.FrontDomainFamily != "example.com" ||
+		info.TLSProfile != protocol.TLS_PROFILE_CHROME_58 ||
+		info.EgressRegion != "CA" {
+
+		t.Fatalf("unexpected handoff tunnel info: %+v", info)
+	}
+
+	// After a reconnect, the new tunnel is reported.
+
+	quicTunnel := &Tunnel{
+		protocol: protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
+		serverEntry: &protocol.ServerEntry{
+			IpAddress: "192.168.0.2",
+			Region:    "US",
+		},
+		dialParams: &DialParameters{
+			TunnelProtocol: protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
+			QUICVersion:    "gQUICv43",
+		},
+	}
+
+	controller.tunnels = []*Tunnel{quicTunnel}
+
+	info = controller.GetActiveTunnelInfo()
+	if info == nil ||
+		info.TunnelProtocol != protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH ||
+		info.IsFronted ||
+		info.FrontDomainFamily != "" ||
+		info.TLSProfile != "" ||
+		info.QUICVersion != "gQUICv43" ||
+		info.EgressRegion != "US" {
+
+		t.Fatalf("unexpected tunnel info: %+v", info)
+	}
+}
+
+func TestGetDomainFamily(t *testing.T) {
+
+	for _, testCase := range []struct {
+		domain   string
+		expected string
+	}{
+		{"", ""},
+		{"example.com", "example.com"},
+		{"www.example.com", "example.com"},
+		{"a.b.example.com.", "example.com"},
+		{"localhost", "localhost"},
+		{"192.168.0.1", ""},
+		{"::1", ""},
+	} {
+		family := getDomainFamily(testCase.domain)
+		if family != testCase.expected {
+			t.Fatalf("unexpected family for %s: %s", testCase.domain, family)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// BandwidthTestResult is the result of a tunnel bandwidth test.
+type BandwidthTestResult struct {
+	UpstreamBytes           int64
+	DownstreamBytes         int64
+	UpstreamDuration        time.Duration
+	DownstreamDuration      time.Duration
+	UpstreamBitsPerSecond   int64
+	DownstreamBitsPerSecond int64
+}
+
+// RunBandwidthTest measures the upstream and downstream throughput of the
+// active tunnel, by sending and receiving test data over a dedicated
+// bandwidth test channel. The test size and timeout are specified by the
+// BandwidthTestUpstreamBytes, BandwidthTestDownstreamBytes, and
+// BandwidthTestTimeout parameters. The result is also reported in a
+// BandwidthTest notice.
+//
+// Bandwidth tests send and receive a significant amount of data, and should
+// be run only when requested by, or with the consent of, the user. The
+// server limits the size and frequency of tests. Bandwidth test data is not
+// port forward traffic and is not included in transfer stats.
+func (controller *Controller) RunBandwidthTest(
+	ctx context.Context) (*BandwidthTestResult, error) {
+
+	tunnel := controller.getNextActiveTunnel()
+	if tunnel == nil {
+		return nil, common.ContextError(errors.New("no active tunnel"))
+	}
+
+	p := controller.config.GetClientParameters()
+	upstreamBytes := p.Int(parameters.BandwidthTestUpstreamBytes)
+	downstreamBytes := p.Int(parameters.BandwidthTestDownstreamBytes)
+	timeout := p.Duration(parameters.BandwidthTestTimeout)
+	p = nil
+
+	if timeout > 0 {
+		var cancelFunc context.CancelFunc
+		ctx, cancelFunc = context.WithTimeout(ctx, timeout)
+		defer cancelFunc()
+	}
+
+	result, err := tunnel.runBandwidthTest(ctx, upstreamBytes, downstreamBytes)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	NoticeBandwidthTest(result)
+
+	return result, nil
+}
+
+func (tunnel *Tunnel) runBandwidthTest(
+	ctx context.Context,
+	upstreamBytes, downstreamBytes int) (*BandwidthTestResult, error) {
+
+	if !tunnel.IsActivated() || tunnel.serverContext == nil ||
+		!tunnel.serverContext.features.Has(protocol.FEATURE_BANDWIDTH_TEST) {
+
+		return nil, common.ContextError(errors.New("bandwidth test not supported"))
+	}
+
+	request := &protocol.BandwidthTestRequest{
+		UpstreamBytes:   uint64(upstreamBytes),
+		DownstreamBytes: uint64(downstreamBytes),
+	}
+
+	channel, requests, err := tunnel.sshClient.OpenChannel(
+		protocol.BANDWIDTH_TEST_CHANNEL_TYPE, ssh.Marshal(request))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	go ssh.DiscardRequests(requests)
+	defer channel.Close()
+
+	// Close the channel, interrupting any blocking read or write, when ctx
+	// is done.
+	testDone := make(chan struct{})
+	defer close(testDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			channel.Close()
+		case <-testDone:
+		}
+	}()
+
+	startTime := monotime.Now()
+
+	buffer := make([]byte, 32*1024)
+	var sent int64
+	for sent < int64(upstreamBytes) {
+		n := int64(upstreamBytes) - sent
+		if n > int64(len(buffer)) {
+			n = int64(len(buffer))
+		}
+		m, err := channel.Write(buffer[:n])
+		sent += int64(m)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	err = channel.CloseWrite()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// The server sends the downstream bytes once all upstream bytes are
+	// received, so the upstream phase ends when the first downstream byte
+	// arrives.
+
+	var received int64
+	if downstreamBytes > 0 {
+		_, err = io.ReadFull(channel, buffer[:1])
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		received = 1
+	}
+
+	downstreamStartTime := monotime.Now()
+
+	n, err := io.Copy(ioutil.Discard, channel)
+	received += n
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	endTime := monotime.Now()
+
+	if received != int64(downstreamBytes) {
+		return nil, common.ContextError(errors.New("unexpected downstream byte count"))
+	}
+
+	result := &BandwidthTestResult{
+		UpstreamBytes:      sent,
+		DownstreamBytes:    received,
+		UpstreamDuration:   downstreamStartTime.Sub(startTime),
+		DownstreamDuration: endTime.Sub(downstreamStartTime),
+	}
+	result.UpstreamBitsPerSecond = bitsPerSecond(sent, result.UpstreamDuration)
+	result.DownstreamBitsPerSecond = bitsPerSecond(received, result.DownstreamDuration)
+
+	return result, nil
+}
+
+func bitsPerSecond(bytes int64, duration time.Duration) int64 {
+	if duration <= 0 {
+		return 0
+	}
+	return int64(float64(bytes*8) / duration.Seconds())
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+)
+
+const (
+	BOOTSTRAP_PROFILE_FAST         = "fast"
+	BOOTSTRAP_PROFILE_BALANCED     = "balanced"
+	BOOTSTRAP_PROFILE_CONSERVATIVE = "conservative"
+)
+
+// bootstrapProfile specifies the establishment parallelism and per-candidate
+// connect timeout used until the first tunnel is established. Zero values
+// select the steady-state ConnectionWorkerPoolSize and TunnelConnectTimeout.
+//
+// In all profiles, bootstrap connection attempts remain subject to the
+// MaxConcurrentConnectionAttempts limit.
+type bootstrapProfile struct {
+	connectionWorkerPoolSize int
+	tunnelConnectTimeout     time.Duration
+}
+
+var bootstrapProfiles = map[string]bootstrapProfile{
+
+	// The fast profile tries more candidates in parallel and abandons slow
+	// candidates sooner, which suits good, unmetered networks.
+	BOOTSTRAP_PROFILE_FAST: {20, 10 * time.Second},
+
+	// The balanced profile uses the steady-state settings.
+	BOOTSTRAP_PROFILE_BALANCED: {0, 0},
+
+	// The conservative profile limits the data and battery consumed by
+	// bootstrap, which suits metered networks.
+	BOOTSTRAP_PROFILE_CONSERVATIVE: {2, 30 * time.Second},
+}
+
+// isValidBootstrapProfile indicates whether profile is a supported bootstrap
+// profile.
+func isValidBootstrapProfile(profile string) bool {
+	_, ok := bootstrapProfiles[profile]
+	return ok
+}
+
+// setBootstrapping records whether establishment is bootstrapping: whether
+// no tunnel has yet been established by the controller.
+func (config *Config) setBootstrapping(bootstrapping bool) {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	config.bootstrapping = bootstrapping
+}
+
+// isBootstrapping indicates whether the bootstrap connection settings,
+// BootstrapConnectionWorkerPoolSize and BootstrapTunnelConnectTimeout,
+// apply.
+func (config *Config) isBootstrapping() bool {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	return config.bootstrapping
+}
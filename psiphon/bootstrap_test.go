@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestBootstrapProfile(t *testing.T) {
+
+	loadConfig := func(configJSON string) (*Config, error) {
+		config, err := LoadConfig([]byte(configJSON))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		return config, config.Commit()
+	}
+
+	baseConfigJSON := `
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"`
+
+	// By default, the steady-state settings apply during bootstrap.
+
+	config, err := loadConfig("{" + baseConfigJSON + "}")
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	p := config.GetClientParameters()
+	if p.Int(parameters.BootstrapConnectionWorkerPoolSize) != 0 ||
+		p.Duration(parameters.BootstrapTunnelConnectTimeout) != 0 {
+		t.Fatalf("unexpected default bootstrap settings")
+	}
+
+	// Profile settings are applied; explicit settings override the profile.
+
+	config, err = loadConfig("{" + baseConfigJSON + `,
+        "BootstrapProfile" : "fast",
+        "BootstrapTunnelConnectTimeoutSeconds" : 5}`)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	p = config.GetClientParameters()
+	if p.Int(parameters.BootstrapConnectionWorkerPoolSize) != 20 ||
+		p.Duration(parameters.BootstrapTunnelConnectTimeout) != 5*time.Second {
+		t.Fatalf("unexpected fast bootstrap settings")
+	}
+
+	_, err = loadConfig("{" + baseConfigJSON + `,
+        "BootstrapProfile" : "unknown"}`)
+	if err == nil {
+		t.Fatalf("unexpected Commit success with invalid BootstrapProfile")
+	}
+
+	if config.isBootstrapping() {
+		t.Fatalf("unexpected bootstrapping state")
+	}
+	config.setBootstrapping(true)
+	if !config.isBootstrapping() {
+		t.Fatalf("unexpected bootstrapping state")
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"reflect"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
+)
+
+// Capabilities is a manifest of the protocols and features supported by
+// this client build, for embedders and tests which adapt to the build's
+// feature set. Optional components, such as the Marionette and TapDance
+// transports, packet tunnel support, and the datastore implementation,
+// depend on build tags and platform.
+//
+// TunnelProtocols lists the tunnel protocols which may be used by this
+// build; DefaultDisabledTunnelProtocols lists those which are only used
+// when explicitly selected in LimitTunnelProtocols. TLSProfiles lists the
+// TLS ClientHello profiles which may be selected for meek HTTPS; profiles
+// with "TLS-1.3" in the name offer TLS 1.3. ConfigOptions lists the names
+// of the JSON config fields accepted by LoadConfig.
+type Capabilities struct {
+	TunnelProtocols                []string `json:"tunnelProtocols"`
+	DefaultDisabledTunnelProtocols []string `json:"defaultDisabledTunnelProtocols"`
+	TLSProfiles                    []string `json:"tlsProfiles"`
+	QUICVersions                   []string `json:"quicVersions"`
+	MeekALPNProtocols              []string `json:"meekALPNProtocols"`
+	Marionette                     bool     `json:"marionette"`
+	TapDance                       bool     `json:"tapDance"`
+	PacketTunnel                   bool     `json:"packetTunnel"`
+	DataStore                      string   `json:"dataStore"`
+	ConfigOptions                  []string `json:"configOptions"`
+}
+
+// GetCapabilities returns the Capabilities of this client build.
+func GetCapabilities() *Capabilities {
+
+	var tunnelProtocols []string
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+		if (protocol.TunnelProtocolUsesMarionette(tunnelProtocol) && !marionette.Enabled()) ||
+			(protocol.TunnelProtocolUsesTapdance(tunnelProtocol) && !tapdance.Enabled()) {
+			continue
+		}
+		tunnelProtocols = append(tunnelProtocols, tunnelProtocol)
+	}
+
+	var defaultDisabledTunnelProtocols []string
+	for _, tunnelProtocol := range protocol.DefaultDisabledTunnelProtocols {
+		if common.Contains(tunnelProtocols, tunnelProtocol) {
+			defaultDisabledTunnelProtocols = append(
+				defaultDisabledTunnelProtocols, tunnelProtocol)
+		}
+	}
+
+	return &Capabilities{
+		TunnelProtocols:                tunnelProtocols,
+		DefaultDisabledTunnelProtocols: defaultDisabledTunnelProtocols,
+		TLSProfiles:                    append([]string(nil), protocol.SupportedTLSProfiles...),
+		QUICVersions:                   append([]string(nil), protocol.SupportedQUICVersions...),
+		MeekALPNProtocols:              append([]string(nil), protocol.SupportedMeekALPNProtocols...),
+		Marionette:                     marionette.Enabled(),
+		TapDance:                       tapdance.Enabled(),
+		PacketTunnel:                   tun.IsSupported(),
+		DataStore:                      DATA_STORE_IMPLEMENTATION,
+		ConfigOptions:                  getConfigOptions(),
+	}
+}
+
+// getConfigOptions returns the names of the Config fields which may be set
+// in the JSON config. Fields which may only be set programmatically, such as
+// the DeviceBinder interface, are omitted.
+func getConfigOptions() []string {
+
+	var options []string
+
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.PkgPath != "" {
+			// Unexported field.
+			continue
+		}
+		kind := field.Type.Kind()
+		if kind == reflect.Interface || kind == reflect.Func || kind == reflect.Chan {
+			continue
+		}
+		options = append(options, field.Name)
+	}
+
+	return options
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestCapabilities(t *testing.T) {
+
+	capabilities := GetCapabilities()
+
+	if !common.Contains(capabilities.TunnelProtocols, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH) ||
+		!common.Contains(capabilities.TunnelProtocols, protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH) {
+		t.Fatalf("missing tunnel protocols: %+v", capabilities.TunnelProtocols)
+	}
+
+	if common.Contains(
+		capabilities.TunnelProtocols,
+		protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH) != marionette.Enabled() {
+
+		t.Fatalf("unexpected Marionette support: %+v", capabilities.TunnelProtocols)
+	}
+
+	for _, tunnelProtocol := range capabilities.DefaultDisabledTunnelProtocols {
+		if !common.Contains(capabilities.TunnelProtocols, tunnelProtocol) {
+			t.Fatalf("unexpected default disabled tunnel protocol: %s", tunnelProtocol)
+		}
+	}
+
+	if !common.Contains(capabilities.ConfigOptions, "PropagationChannelId") ||
+		common.Contains(capabilities.ConfigOptions, "DeviceBinder") ||
+		common.Contains(capabilities.ConfigOptions, "clientParameters") {
+		t.Fatalf("unexpected config options: %+v", capabilities.ConfigOptions)
+	}
+}
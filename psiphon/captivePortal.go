@@ -0,0 +1,242 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// captivePortal detects networks with captive portals, which intercept all
+// traffic until the user authenticates with the portal. On such networks,
+// every connection attempt fails without indicating why.
+//
+// A captive portal is detected with an untunneled, plaintext HTTP canary
+// request to CaptivePortalCanaryURL, a benign, static resource with a known
+// response. A redirect or any other unexpected response indicates a portal.
+// A failed canary request is inconclusive and doesn't trigger detection, as
+// it's not distinguishable from network loss or a canary site outage.
+//
+// While a portal is detected, establishment rounds are paused, as every
+// connection attempt is expected to fail, and the canary is rechecked each
+// CaptivePortalRecheckPeriod until the expected response is received.
+//
+// As with suspectedBlocking, the parameters are set once per establishment.
+type captivePortal struct {
+	canaryURL          string
+	expectedStatusCode int
+	expectedResponse   string
+	timeout            time.Duration
+	recheckPeriod      time.Duration
+
+	mutex    sync.Mutex
+	detected bool
+}
+
+func newCaptivePortal(config *Config) *captivePortal {
+
+	p := config.clientParameters.Get()
+
+	return &captivePortal{
+		canaryURL:          p.String(parameters.CaptivePortalCanaryURL),
+		expectedStatusCode: p.Int(parameters.CaptivePortalCanaryExpectedStatusCode),
+		expectedResponse:   p.String(parameters.CaptivePortalCanaryExpectedResponse),
+		timeout:            p.Duration(parameters.CaptivePortalCanaryTimeout),
+		recheckPeriod:      p.Duration(parameters.CaptivePortalRecheckPeriod),
+	}
+}
+
+func (portal *captivePortal) isEnabled() bool {
+	return portal != nil && portal.canaryURL != ""
+}
+
+// isDetected indicates whether a captive portal is currently detected.
+func (portal *captivePortal) isDetected() bool {
+
+	if !portal.isEnabled() {
+		return false
+	}
+
+	portal.mutex.Lock()
+	defer portal.mutex.Unlock()
+
+	return portal.detected
+}
+
+// check makes the canary request and records whether a captive portal is
+// detected. check returns the indicators of a captive portal, which are
+// empty when the response is as expected. When the canary request fails,
+// the previous detection state is retained and an error is returned.
+func (portal *captivePortal) check(
+	ctx context.Context,
+	config *Config,
+	untunneledDialConfig *DialConfig) ([]string, error) {
+
+	ctx, cancelFunc := context.WithTimeout(ctx, portal.timeout)
+	defer cancelFunc()
+
+	indicators, err := getCaptivePortalIndicators(
+		ctx,
+		config,
+		untunneledDialConfig,
+		portal.canaryURL,
+		portal.expectedStatusCode,
+		portal.expectedResponse)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	portal.mutex.Lock()
+	portal.detected = len(indicators) > 0
+	portal.mutex.Unlock()
+
+	return indicators, nil
+}
+
+// runCaptivePortalDetection checks for a captive portal at the start of
+// the establishment, concurrently with the establishment workers. When a
+// portal is detected, a CaptivePortalDetected notice is emitted so that the
+// app may prompt the user to authenticate, and establishCandidateGenerator
+// pauses until the portal is cleared; see waitForCaptivePortal.
+func (controller *Controller) runCaptivePortalDetection() {
+
+	defer controller.establishWaitGroup.Done()
+
+	portal := controller.establishCaptivePortal
+
+	if !portal.isEnabled() {
+		return
+	}
+
+	indicators, err := portal.check(
+		controller.establishCtx,
+		controller.config,
+		controller.untunneledDialConfig)
+	if err != nil {
+		NoticeInfo("captive portal detection failed: %s", err)
+		return
+	}
+
+	if len(indicators) == 0 {
+		return
+	}
+
+	NoticeCaptivePortalDetected(indicators)
+	controller.diagnostics.traceEvent("captive portal detected")
+}
+
+// waitForCaptivePortal rechecks the canary each CaptivePortalRecheckPeriod
+// until a detected captive portal is cleared, as when the user has
+// authenticated with the portal. waitForCaptivePortal returns false when
+// the establishment is stopped while waiting.
+func (controller *Controller) waitForCaptivePortal() bool {
+
+	portal := controller.establishCaptivePortal
+
+	for portal.isDetected() {
+
+		timer := time.NewTimer(portal.recheckPeriod)
+		select {
+		case <-timer.C:
+		case <-controller.establishCtx.Done():
+			timer.Stop()
+			return false
+		}
+
+		_, err := portal.check(
+			controller.establishCtx,
+			controller.config,
+			controller.untunneledDialConfig)
+		if err != nil {
+			NoticeInfo("captive portal recheck failed: %s", err)
+		}
+	}
+
+	NoticeCaptivePortalCleared()
+	controller.diagnostics.traceEvent("captive portal cleared")
+
+	return true
+}
+
+// getCaptivePortalIndicators makes the canary request and returns a list of
+// indicators of a captive portal, which is empty when the response is
+// exactly as expected.
+func getCaptivePortalIndicators(
+	ctx context.Context,
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	canaryURL string,
+	expectedStatusCode int,
+	expectedResponse string) ([]string, error) {
+
+	httpClient, err := MakeUntunneledHTTPClient(
+		ctx, config, untunneledDialConfig, nil, false)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Redirects to the portal login page are not followed; a redirect is
+	// an indicator.
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	request, err := http.NewRequest("GET", canaryURL, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	var indicators []string
+
+	if response.StatusCode >= 300 && response.StatusCode < 400 {
+		indicators = append(indicators, "redirect")
+	} else if response.StatusCode != expectedStatusCode {
+		indicators = append(indicators, "status")
+	}
+
+	// As in getTransparentProxyIndicators, read at most one byte more than
+	// the expected response.
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(response.Body, int64(len(expectedResponse)+1)))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if string(body) != expectedResponse {
+		indicators = append(indicators, "body")
+	}
+
+	return indicators, nil
+}
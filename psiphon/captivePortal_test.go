@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestCaptivePortalIndicators(t *testing.T) {
+
+	testCases := []struct {
+		description        string
+		handler            http.HandlerFunc
+		expectedIndicators []string
+	}{
+		{
+			"no portal",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+			nil,
+		},
+		{
+			"redirected",
+			func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "http://portal.example.com/login", http.StatusFound)
+			},
+			[]string{"redirect", "body"},
+		},
+		{
+			"login page",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html>login</html>"))
+			},
+			[]string{"status", "body"},
+		},
+	}
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+	config := &Config{clientParameters: clientParameters}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			server := httptest.NewServer(testCase.handler)
+			defer server.Close()
+
+			applyParameters := map[string]interface{}{
+				parameters.CaptivePortalCanaryURL: server.URL,
+			}
+			_, err := clientParameters.Set("", false, applyParameters)
+			if err != nil {
+				t.Fatalf("Set failed: %s", err)
+			}
+
+			portal := newCaptivePortal(config)
+
+			indicators, err := portal.check(context.Background(), config, &DialConfig{})
+			if err != nil {
+				t.Fatalf("check failed: %s", err)
+			}
+
+			if !reflect.DeepEqual(indicators, testCase.expectedIndicators) {
+				t.Fatalf("unexpected indicators: %v", indicators)
+			}
+
+			if portal.isDetected() != (len(testCase.expectedIndicators) > 0) {
+				t.Fatalf("unexpected detection state")
+			}
+		})
+	}
+
+	// A failed canary request is inconclusive.
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	_, err = getCaptivePortalIndicators(
+		context.Background(), config, &DialConfig{}, server.URL, http.StatusNoContent, "")
+	if err == nil {
+		t.Fatalf("unexpected getCaptivePortalIndicators success")
+	}
+
+	// Detection is disabled by default.
+
+	_, err = clientParameters.Set("", false)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	if newCaptivePortal(config).isEnabled() {
+		t.Fatalf("unexpected captive portal detection enabled")
+	}
+}
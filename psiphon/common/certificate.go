@@ -20,16 +20,69 @@
 package common
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"time"
 )
 
+const (
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_2048   = "RSA-2048"
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_3072   = "RSA-3072"
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P256 = "ECDSA-P256"
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P384 = "ECDSA-P384"
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_ED25519    = "Ed25519"
+
+	WEB_SERVER_CERTIFICATE_MIN_SERIAL_NUMBER_LENGTH = 8
+	WEB_SERVER_CERTIFICATE_MAX_SERIAL_NUMBER_LENGTH = 20
+)
+
+// webServerCertificateRandomKeyTypes are the key types selected by
+// GenerateWebServerCertificate. Ed25519 is excluded as Ed25519 certificates
+// aren't supported by the tls-tris and QUIC servers which use these
+// certificates.
+var webServerCertificateRandomKeyTypes = []string{
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_2048,
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_3072,
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P256,
+	WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P384,
+}
+
+// GenerateWebServerCertificateParams specifies the parameters of a
+// certificate generated by GenerateWebServerCertificateWithParams.
+type GenerateWebServerCertificateParams struct {
+
+	// CommonName is the certificate subject common name. When "", the
+	// certificate has no subject.
+	CommonName string
+
+	// KeyType is one of the WEB_SERVER_CERTIFICATE_KEY_TYPE values.
+	KeyType string
+
+	// SerialNumberLength is the length, in bytes, of the random serial
+	// number, from WEB_SERVER_CERTIFICATE_MIN_SERIAL_NUMBER_LENGTH to
+	// WEB_SERVER_CERTIFICATE_MAX_SERIAL_NUMBER_LENGTH.
+	SerialNumberLength int
+
+	// OmitSubjectKeyID specifies whether to omit the subject key identifier
+	// extension.
+	OmitSubjectKeyID bool
+
+	// IsCA specifies whether the certificate is marked as a CA certificate,
+	// permitted to sign certificates.
+	IsCA bool
+}
+
 // GenerateWebServerCertificate creates a self-signed web server certificate,
 // using the specified host name (commonName).
 // This is primarily intended for use by MeekServer to generate on-the-fly,
@@ -38,7 +91,9 @@ import (
 // front CDN making connections to meek.
 // The same certificates are used for unfronted HTTPS meek. In this case, the
 // certificates may be a fingerprint used to detect Psiphon servers or traffic.
-// TODO: more effort to mitigate fingerprinting these certificates.
+// To mitigate fingerprinting, the key type, serial number length, subject key
+// identifier extension, and CA flag are selected at random for each
+// certificate; see GenerateWebServerCertificateWithParams.
 //
 // In addition, GenerateWebServerCertificate is used by GenerateConfig to create
 // Psiphon web server certificates for test/example configurations. If these Psiphon
@@ -46,42 +101,149 @@ import (
 // fingerprints apply.
 func GenerateWebServerCertificate(commonName string) (string, string, error) {
 
-	// Based on https://golang.org/src/crypto/tls/generate_cert.go
-	// TODO: use other key types: anti-fingerprint by varying params
-
-	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	params, err := makeRandomWebServerCertificateParams(commonName)
 	if err != nil {
 		return "", "", ContextError(err)
 	}
 
-	// Validity period is ~10 years, starting some number of ~months
-	// back in the last year.
+	return GenerateWebServerCertificateWithParams(params)
+}
+
+func makeRandomWebServerCertificateParams(
+	commonName string) (*GenerateWebServerCertificateParams, error) {
 
-	age, err := MakeSecureRandomInt(12)
+	keyTypeIndex, err := MakeSecureRandomInt(len(webServerCertificateRandomKeyTypes))
 	if err != nil {
-		return "", "", ContextError(err)
+		return nil, ContextError(err)
+	}
+
+	serialNumberLength, err := MakeSecureRandomRange(
+		WEB_SERVER_CERTIFICATE_MIN_SERIAL_NUMBER_LENGTH,
+		WEB_SERVER_CERTIFICATE_MAX_SERIAL_NUMBER_LENGTH)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return &GenerateWebServerCertificateParams{
+		CommonName:         commonName,
+		KeyType:            webServerCertificateRandomKeyTypes[keyTypeIndex],
+		SerialNumberLength: serialNumberLength,
+		OmitSubjectKeyID:   FlipCoin(),
+		IsCA:               FlipCoin(),
+	}, nil
+}
+
+// GenerateWebServerCertificateWithParams creates a self-signed web server
+// certificate with the specified parameters. The certificate and private
+// key are returned in PEM format; the private key PEM block type is "RSA
+// PRIVATE KEY" (PKCS #1), "EC PRIVATE KEY" (SEC 1), or "PRIVATE KEY" (PKCS
+// #8), for RSA, ECDSA, and Ed25519 keys respectively.
+func GenerateWebServerCertificateWithParams(
+	params *GenerateWebServerCertificateParams) (string, string, error) {
+
+	// Based on https://golang.org/src/crypto/tls/generate_cert.go
+
+	if params.SerialNumberLength < WEB_SERVER_CERTIFICATE_MIN_SERIAL_NUMBER_LENGTH ||
+		params.SerialNumberLength > WEB_SERVER_CERTIFICATE_MAX_SERIAL_NUMBER_LENGTH {
+		return "", "", ContextError(errors.New("invalid serial number length"))
+	}
+
+	var privateKey crypto.Signer
+	var privateKeyBlock *pem.Block
+	keyUsage := x509.KeyUsageDigitalSignature
+
+	switch params.KeyType {
+
+	case WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_2048,
+		WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_3072:
+
+		bits := 2048
+		if params.KeyType == WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_3072 {
+			bits = 3072
+		}
+		rsaKey, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return "", "", ContextError(err)
+		}
+		privateKey = rsaKey
+		privateKeyBlock = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}
+
+		// Only RSA keys are used for key encipherment.
+		keyUsage |= x509.KeyUsageKeyEncipherment
+
+	case WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P256,
+		WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P384:
+
+		curve := elliptic.P256()
+		if params.KeyType == WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P384 {
+			curve = elliptic.P384()
+		}
+		ecdsaKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return "", "", ContextError(err)
+		}
+		privateKey = ecdsaKey
+		keyBytes, err := x509.MarshalECPrivateKey(ecdsaKey)
+		if err != nil {
+			return "", "", ContextError(err)
+		}
+		privateKeyBlock = &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: keyBytes,
+		}
+
+	case WEB_SERVER_CERTIFICATE_KEY_TYPE_ED25519:
+
+		_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", ContextError(err)
+		}
+		privateKey = ed25519Key
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+		if err != nil {
+			return "", "", ContextError(err)
+		}
+		privateKeyBlock = &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: keyBytes,
+		}
+
+	default:
+		return "", "", ContextError(
+			fmt.Errorf("unsupported key type: %s", params.KeyType))
 	}
-	age += 1
-	validityPeriod := 10 * 365 * 24 * time.Hour
-	notBefore := time.Now().Add(time.Duration(-age) * 30 * 24 * time.Hour).UTC()
-	notAfter := notBefore.Add(validityPeriod).UTC()
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	// Validity period is ~10 years, starting at a random offset in the
+	// last year.
+
+	age, err := MakeSecureRandomPeriod(24*time.Hour, 365*24*time.Hour)
 	if err != nil {
 		return "", "", ContextError(err)
 	}
+	validityPeriod := 10 * 365 * 24 * time.Hour
+	notBefore := time.Now().Add(-age).Truncate(time.Second).UTC()
+	notAfter := notBefore.Add(validityPeriod).UTC()
+
+	// The serial number is a positive integer of exactly SerialNumberLength
+	// bytes: the high bit of the first byte is cleared, so the DER encoding
+	// needs no sign padding, and the first byte is non-zero.
 
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	serialNumberBytes, err := MakeSecureRandomBytes(params.SerialNumberLength)
 	if err != nil {
 		return "", "", ContextError(err)
 	}
-	// as per RFC3280 sec. 4.2.1.2
-	subjectKeyID := sha1.Sum(publicKeyBytes)
+	serialNumberBytes[0] &= 0x7f
+	if serialNumberBytes[0] == 0 {
+		serialNumberBytes[0] = 1
+	}
+	serialNumber := new(big.Int).SetBytes(serialNumberBytes)
 
 	var subject pkix.Name
-	if commonName != "" {
-		subject = pkix.Name{CommonName: commonName}
+	if params.CommonName != "" {
+		subject = pkix.Name{CommonName: params.CommonName}
 	}
 
 	template := x509.Certificate{
@@ -89,21 +251,34 @@ func GenerateWebServerCertificate(commonName string) (string, string, error) {
 		Subject:               subject,
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              keyUsage,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		IsCA:         true,
-		SubjectKeyId: subjectKeyID[:],
-		MaxPathLen:   1,
-		Version:      2,
+		Version:               2,
+	}
+
+	if params.IsCA {
+		template.IsCA = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.MaxPathLen = 1
+	}
+
+	if !params.OmitSubjectKeyID {
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(privateKey.Public())
+		if err != nil {
+			return "", "", ContextError(err)
+		}
+		// as per RFC3280 sec. 4.2.1.2
+		subjectKeyID := sha1.Sum(publicKeyBytes)
+		template.SubjectKeyId = subjectKeyID[:]
 	}
 
 	derCert, err := x509.CreateCertificate(
 		rand.Reader,
 		&template,
 		&template,
-		rsaKey.Public(),
-		rsaKey)
+		privateKey.Public(),
+		privateKey)
 	if err != nil {
 		return "", "", ContextError(err)
 	}
@@ -115,12 +290,7 @@ func GenerateWebServerCertificate(commonName string) (string, string, error) {
 		},
 	)
 
-	webServerPrivateKey := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
-		},
-	)
+	webServerPrivateKey := pem.EncodeToMemory(privateKeyBlock)
 
 	return string(webServerCertificate), string(webServerPrivateKey), nil
 }
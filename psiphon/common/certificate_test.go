@@ -21,6 +21,8 @@ package common
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"testing"
 )
 
@@ -35,4 +37,110 @@ func TestGenerateWebServerCertificate(t *testing.T) {
 	if err != nil {
 		t.Errorf("tls.X509KeyPair failed: %s", err)
 	}
+
+	// Successive certificates for the same common name have distinct
+	// serial numbers and validity periods.
+
+	otherCertificate, _, err := GenerateWebServerCertificate("www.example.com")
+	if err != nil {
+		t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+	}
+
+	cert := parseTestCertificate(t, certificate)
+	otherCert := parseTestCertificate(t, otherCertificate)
+
+	if cert.SerialNumber.Cmp(otherCert.SerialNumber) == 0 {
+		t.Fatalf("unexpected identical serial numbers")
+	}
+
+	if cert.NotBefore.Equal(otherCert.NotBefore) {
+		t.Fatalf("unexpected identical validity periods")
+	}
+}
+
+func TestGenerateWebServerCertificateWithParams(t *testing.T) {
+
+	keyTypes := []struct {
+		keyType            string
+		publicKeyAlgorithm x509.PublicKeyAlgorithm
+		privateKeyType     string
+	}{
+		{WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_2048, x509.RSA, "RSA PRIVATE KEY"},
+		{WEB_SERVER_CERTIFICATE_KEY_TYPE_RSA_3072, x509.RSA, "RSA PRIVATE KEY"},
+		{WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P256, x509.ECDSA, "EC PRIVATE KEY"},
+		{WEB_SERVER_CERTIFICATE_KEY_TYPE_ECDSA_P384, x509.ECDSA, "EC PRIVATE KEY"},
+		{WEB_SERVER_CERTIFICATE_KEY_TYPE_ED25519, x509.Ed25519, "PRIVATE KEY"},
+	}
+
+	for i, keyType := range keyTypes {
+		t.Run(keyType.keyType, func(t *testing.T) {
+
+			params := &GenerateWebServerCertificateParams{
+				CommonName:         "www.example.com",
+				KeyType:            keyType.keyType,
+				SerialNumberLength: WEB_SERVER_CERTIFICATE_MIN_SERIAL_NUMBER_LENGTH + i,
+				OmitSubjectKeyID:   i%2 == 0,
+				IsCA:               i%2 == 1,
+			}
+
+			certificate, privateKey, err := GenerateWebServerCertificateWithParams(params)
+			if err != nil {
+				t.Fatalf("GenerateWebServerCertificateWithParams failed: %s", err)
+			}
+
+			_, err = tls.X509KeyPair([]byte(certificate), []byte(privateKey))
+			if err != nil {
+				t.Fatalf("tls.X509KeyPair failed: %s", err)
+			}
+
+			block, _ := pem.Decode([]byte(privateKey))
+			if block == nil || block.Type != keyType.privateKeyType {
+				t.Fatalf("unexpected private key PEM block")
+			}
+
+			cert := parseTestCertificate(t, certificate)
+
+			if cert.PublicKeyAlgorithm != keyType.publicKeyAlgorithm ||
+				cert.Subject.CommonName != params.CommonName ||
+				len(cert.SerialNumber.Bytes()) != params.SerialNumberLength ||
+				(len(cert.SubjectKeyId) == 0) != params.OmitSubjectKeyID ||
+				cert.IsCA != params.IsCA {
+				t.Fatalf("unexpected certificate parameters")
+			}
+
+			roots := x509.NewCertPool()
+			roots.AddCert(cert)
+			_, err = cert.Verify(x509.VerifyOptions{
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			if err != nil {
+				t.Fatalf("Verify failed: %s", err)
+			}
+		})
+	}
+
+	_, _, err := GenerateWebServerCertificateWithParams(
+		&GenerateWebServerCertificateParams{
+			KeyType:            "DSA",
+			SerialNumberLength: WEB_SERVER_CERTIFICATE_MIN_SERIAL_NUMBER_LENGTH,
+		})
+	if err == nil {
+		t.Fatalf("unexpected success with unsupported key type")
+	}
+}
+
+func parseTestCertificate(t *testing.T, certificate string) *x509.Certificate {
+
+	block, _ := pem.Decode([]byte(certificate))
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("unexpected certificate PEM block")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %s", err)
+	}
+
+	return cert
 }
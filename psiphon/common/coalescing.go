@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+// CoalescingConn wraps a net.Conn and coalesces bursts of small writes into
+// fewer, larger writes to the underlying conn. This reduces the per-write
+// overhead, and the distinctive packet sizes, of chatty, interactive
+// protocols.
+//
+// To avoid adding latency to isolated writes, such as keystrokes, a write
+// is passed through immediately when no write has been made within the
+// coalescing window. Only subsequent writes within the window are buffered,
+// and the buffer is flushed when the window elapses or when the buffer
+// reaches maxBytes. Writes of maxBytes or more are never buffered.
+//
+// As with TCP Nagle buffering, buffered writes return before the data is
+// written to the underlying conn. An error writing buffered data is returned
+// by the next Write, or by Close.
+type CoalescingConn struct {
+	net.Conn
+	window        time.Duration
+	maxBytes      int
+	mutex         sync.Mutex
+	buffer        []byte
+	flushTimer    *time.Timer
+	lastWriteTime monotime.Time
+	err           error
+}
+
+// NewCoalescingConn initializes a new CoalescingConn. window is the
+// coalescing window and maxBytes is the maximum size of a coalesced write.
+func NewCoalescingConn(
+	conn net.Conn, window time.Duration, maxBytes int) *CoalescingConn {
+
+	return &CoalescingConn{
+		Conn:     conn,
+		window:   window,
+		maxBytes: maxBytes,
+	}
+}
+
+func (conn *CoalescingConn) Write(buffer []byte) (int, error) {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.err != nil {
+		return 0, conn.err
+	}
+
+	if len(conn.buffer) == 0 {
+
+		if len(buffer) >= conn.maxBytes ||
+			monotime.Since(conn.lastWriteTime) >= conn.window {
+
+			return conn.write(buffer)
+		}
+
+	} else if len(conn.buffer)+len(buffer) > conn.maxBytes {
+
+		// Flush the pending writes first, preserving the write order.
+		err := conn.flush()
+		if err != nil {
+			return 0, err
+		}
+
+		if len(buffer) >= conn.maxBytes {
+			return conn.write(buffer)
+		}
+	}
+
+	conn.buffer = append(conn.buffer, buffer...)
+
+	if len(conn.buffer) >= conn.maxBytes {
+		err := conn.flush()
+		if err != nil {
+			return 0, err
+		}
+	} else if conn.flushTimer == nil {
+		conn.flushTimer = time.AfterFunc(conn.window, conn.timerFlush)
+	}
+
+	return len(buffer), nil
+}
+
+// Close flushes any buffered writes and closes the underlying conn.
+func (conn *CoalescingConn) Close() error {
+
+	conn.mutex.Lock()
+	err := conn.err
+	if err == nil {
+		err = conn.flush()
+	}
+	conn.err = errors.New("conn closed")
+	conn.mutex.Unlock()
+
+	closeErr := conn.Conn.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (conn *CoalescingConn) timerFlush() {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.flushTimer = nil
+	if conn.err == nil {
+		_ = conn.flush()
+	}
+}
+
+// flush writes any buffered writes to the underlying conn. The caller must
+// lock the mutex.
+func (conn *CoalescingConn) flush() error {
+
+	if conn.flushTimer != nil {
+		conn.flushTimer.Stop()
+		conn.flushTimer = nil
+	}
+
+	if len(conn.buffer) == 0 {
+		return nil
+	}
+
+	_, err := conn.write(conn.buffer)
+	conn.buffer = conn.buffer[:0]
+	return err
+}
+
+// write writes to the underlying conn, recording any error. The caller must
+// lock the mutex.
+func (conn *CoalescingConn) write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	conn.lastWriteTime = monotime.Now()
+	if err != nil {
+		conn.err = ContextError(err)
+		return n, conn.err
+	}
+	return n, nil
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	writes [][]byte
+}
+
+func (conn *recordingConn) Write(buffer []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.writes = append(conn.writes, append([]byte(nil), buffer...))
+	return len(buffer), nil
+}
+
+func (conn *recordingConn) Close() error {
+	return nil
+}
+
+func (conn *recordingConn) getWrites() [][]byte {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return append([][]byte(nil), conn.writes...)
+}
+
+func TestCoalescingConn(t *testing.T) {
+
+	window := 50 * time.Millisecond
+	maxBytes := 10
+
+	underlyingConn := &recordingConn{}
+	conn := NewCoalescingConn(underlyingConn, window, maxBytes)
+
+	checkWrites := func(expected ...string) {
+		writes := underlyingConn.getWrites()
+		if len(writes) != len(expected) {
+			t.Fatalf("unexpected write count: %d", len(writes))
+		}
+		for i, write := range writes {
+			if !bytes.Equal(write, []byte(expected[i])) {
+				t.Fatalf("unexpected write %d: %s", i, string(write))
+			}
+		}
+	}
+
+	write := func(data string) {
+		n, err := conn.Write([]byte(data))
+		if err != nil || n != len(data) {
+			t.Fatalf("Write failed: %d, %v", n, err)
+		}
+	}
+
+	// The first write, after an idle window, is not delayed.
+
+	write("a")
+	checkWrites("a")
+
+	// Subsequent writes within the window are coalesced and flushed when
+	// the window elapses.
+
+	write("b")
+	write("c")
+	checkWrites("a")
+
+	time.Sleep(2 * window)
+	checkWrites("a", "bc")
+
+	// A write after an idle window is again not delayed.
+
+	time.Sleep(2 * window)
+	write("d")
+	checkWrites("a", "bc", "d")
+
+	// Coalesced writes are flushed on reaching maxBytes, and large writes
+	// are written as is, after any buffered data.
+
+	write("0123")
+	write("456789")
+	checkWrites("a", "bc", "d", "0123456789")
+
+	write("e")
+	write("0123456789ab")
+	checkWrites("a", "bc", "d", "0123456789", "e", "0123456789ab")
+
+	// Close flushes buffered writes.
+
+	write("f")
+	err := conn.Close()
+	if err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	checkWrites("a", "bc", "d", "0123456789", "e", "0123456789ab", "f")
+
+	_, err = conn.Write([]byte("g"))
+	if err == nil {
+		t.Fatalf("unexpected Write success after Close")
+	}
+}
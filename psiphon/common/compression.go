@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	COMPRESSED_CONN_MAX_FRAME_SIZE           = 16384
+	COMPRESSED_CONN_MIN_COMPRESS_SIZE        = 128
+	COMPRESSED_CONN_INCOMPRESSIBLE_SKIP      = 16
+	compressedConnFrameHeaderSize            = 3
+	compressedConnFrameTypeRaw          byte = 0
+	compressedConnFrameTypeDeflate      byte = 1
+)
+
+// CompressedConn wraps a net.Conn and compresses the data written to, and
+// decompresses the data read from, the underlying conn. Both peers must wrap
+// their conn in a CompressedConn.
+//
+// Data is sent in frames of up to COMPRESSED_CONN_MAX_FRAME_SIZE bytes and
+// each frame is either raw or independently deflate compressed, with no
+// compression dictionary shared across frames. A frame is sent raw when it's
+// smaller than COMPRESSED_CONN_MIN_COMPRESS_SIZE or when compression doesn't
+// reduce its size; in the latter case, which is typical of already-compressed
+// content, the following COMPRESSED_CONN_INCOMPRESSIBLE_SKIP frames are also
+// sent raw, without attempting compression.
+//
+// As compression may reveal secrets mixed with attacker-controlled data
+// through the compressed size, as in the CRIME attack, compression is
+// disabled for the lifetime of the conn, in each direction, when the first
+// written frame is a TLS record. Content that is encrypted within some other
+// protocol is generally incompressible and is sent raw.
+type CompressedConn struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	payloadBytesWritten int64
+	frameBytesWritten   int64
+
+	net.Conn
+
+	writeMutex         sync.Mutex
+	writeChecked       bool
+	writeDisabled      bool
+	incompressibleSkip int
+	flateWriter        *flate.Writer
+	compressBuffer     bytes.Buffer
+	frameBuffer        []byte
+
+	readMutex        sync.Mutex
+	flateReader      io.ReadCloser
+	readBuffer       []byte
+	decompressBuffer []byte
+	readPending      []byte
+}
+
+// NewCompressedConn initializes a new CompressedConn.
+func NewCompressedConn(conn net.Conn) *CompressedConn {
+	return &CompressedConn{
+		Conn:        conn,
+		frameBuffer: make([]byte, compressedConnFrameHeaderSize+COMPRESSED_CONN_MAX_FRAME_SIZE),
+		readBuffer:  make([]byte, COMPRESSED_CONN_MAX_FRAME_SIZE),
+
+		// decompressBuffer has an extra byte, to detect frames that
+		// decompress to more than COMPRESSED_CONN_MAX_FRAME_SIZE.
+		decompressBuffer: make([]byte, COMPRESSED_CONN_MAX_FRAME_SIZE+1),
+	}
+}
+
+// GetWriteMetrics returns the number of bytes written to the CompressedConn
+// and the number of bytes, including frame overhead, written to the
+// underlying conn.
+func (conn *CompressedConn) GetWriteMetrics() (int64, int64) {
+	return atomic.LoadInt64(&conn.payloadBytesWritten),
+		atomic.LoadInt64(&conn.frameBytesWritten)
+}
+
+func (conn *CompressedConn) Write(buffer []byte) (int, error) {
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	n := 0
+	for n < len(buffer) {
+		end := n + COMPRESSED_CONN_MAX_FRAME_SIZE
+		if end > len(buffer) {
+			end = len(buffer)
+		}
+		err := conn.writeFrame(buffer[n:end])
+		if err != nil {
+			return n, ContextError(err)
+		}
+		n = end
+	}
+
+	return n, nil
+}
+
+// writeFrame writes a single frame. The caller must lock writeMutex.
+func (conn *CompressedConn) writeFrame(payload []byte) error {
+
+	if !conn.writeChecked {
+		conn.writeChecked = true
+		conn.writeDisabled = isTLSRecord(payload)
+	}
+
+	frameType := compressedConnFrameTypeRaw
+	framePayload := payload
+
+	if !conn.writeDisabled && len(payload) >= COMPRESSED_CONN_MIN_COMPRESS_SIZE {
+
+		if conn.incompressibleSkip > 0 {
+			conn.incompressibleSkip -= 1
+
+		} else {
+
+			compressed, err := conn.compress(payload)
+			if err != nil {
+				return ContextError(err)
+			}
+
+			if len(compressed) < len(payload) {
+				frameType = compressedConnFrameTypeDeflate
+				framePayload = compressed
+			} else {
+				conn.incompressibleSkip = COMPRESSED_CONN_INCOMPRESSIBLE_SKIP
+			}
+		}
+	}
+
+	frame := conn.frameBuffer[:compressedConnFrameHeaderSize+len(framePayload)]
+	frame[0] = frameType
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(framePayload)))
+	copy(frame[compressedConnFrameHeaderSize:], framePayload)
+
+	_, err := conn.Conn.Write(frame)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	atomic.AddInt64(&conn.payloadBytesWritten, int64(len(payload)))
+	atomic.AddInt64(&conn.frameBytesWritten, int64(len(frame)))
+
+	return nil
+}
+
+// compress deflate compresses payload into compressBuffer. The flate writer
+// is reset for each frame, so no state is shared across frames. The caller
+// must lock writeMutex.
+func (conn *CompressedConn) compress(payload []byte) ([]byte, error) {
+
+	conn.compressBuffer.Reset()
+
+	if conn.flateWriter == nil {
+		flateWriter, err := flate.NewWriter(&conn.compressBuffer, flate.BestSpeed)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		conn.flateWriter = flateWriter
+	} else {
+		conn.flateWriter.Reset(&conn.compressBuffer)
+	}
+
+	_, err := conn.flateWriter.Write(payload)
+	if err == nil {
+		err = conn.flateWriter.Close()
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return conn.compressBuffer.Bytes(), nil
+}
+
+func (conn *CompressedConn) Read(buffer []byte) (int, error) {
+
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	for len(conn.readPending) == 0 {
+		err := conn.readFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(buffer, conn.readPending)
+	conn.readPending = conn.readPending[n:]
+
+	return n, nil
+}
+
+// readFrame reads and decodes the next frame into readPending. The caller
+// must lock readMutex.
+func (conn *CompressedConn) readFrame() error {
+
+	var header [compressedConnFrameHeaderSize]byte
+	_, err := io.ReadFull(conn.Conn, header[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ContextError(err)
+		}
+		// Return io.EOF unwrapped, as expected by io.Copy.
+		return err
+	}
+
+	frameType := header[0]
+	size := int(binary.BigEndian.Uint16(header[1:3]))
+	if size > COMPRESSED_CONN_MAX_FRAME_SIZE {
+		return ContextError(fmt.Errorf("invalid frame size: %d", size))
+	}
+
+	framePayload := conn.readBuffer[:size]
+	_, err = io.ReadFull(conn.Conn, framePayload)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	switch frameType {
+
+	case compressedConnFrameTypeRaw:
+		conn.readPending = framePayload
+
+	case compressedConnFrameTypeDeflate:
+
+		if conn.flateReader == nil {
+			conn.flateReader = flate.NewReader(bytes.NewReader(framePayload))
+		} else {
+			err = conn.flateReader.(flate.Resetter).Reset(bytes.NewReader(framePayload), nil)
+			if err != nil {
+				return ContextError(err)
+			}
+		}
+
+		// The decompressed frame may not exceed the maximum frame size, which
+		// bounds the memory a peer may induce with a highly compressed frame.
+
+		n, err := io.ReadFull(conn.flateReader, conn.decompressBuffer)
+		if err != io.ErrUnexpectedEOF && err != io.EOF {
+			if err == nil {
+				return ContextError(errors.New("decompressed frame too large"))
+			}
+			return ContextError(err)
+		}
+		conn.readPending = conn.decompressBuffer[:n]
+
+	default:
+		return ContextError(fmt.Errorf("invalid frame type: %d", frameType))
+	}
+
+	return nil
+}
+
+// isTLSRecord returns true when buffer starts with a TLS record header.
+func isTLSRecord(buffer []byte) bool {
+
+	// The TLS record header is a content type, 20 (change_cipher_spec) to
+	// 23 (application_data), followed by the major version, 3, for SSL 3.0
+	// and all TLS versions.
+
+	return len(buffer) >= 3 &&
+		buffer[0] >= 20 && buffer[0] <= 23 &&
+		buffer[1] == 3
+}
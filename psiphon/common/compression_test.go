@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCompressedConn(t *testing.T) {
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 256*1024; i++ {
+		fmt.Fprintf(&text, "<tr><td class=\"item\">%d</td><td>Lorem ipsum dolor sit amet</td></tr>\n", i)
+	}
+
+	random := make([]byte, 64*1024)
+	rand.Read(random)
+
+	TLS := append([]byte{22, 3, 1, 0, 0}, text.Bytes()[:64*1024]...)
+
+	// transfer writes data through a pair of CompressedConns, over a link
+	// limited to linkBytesPerSecond when not 0, and returns the write
+	// metrics and the transfer duration.
+
+	transfer := func(
+		data []byte, linkBytesPerSecond int64) (int64, int64, time.Duration) {
+
+		clientConn, serverConn := net.Pipe()
+
+		writer := NewCompressedConn(
+			NewThrottledConn(
+				clientConn, RateLimits{WriteBytesPerSecond: linkBytesPerSecond}))
+		reader := NewCompressedConn(serverConn)
+
+		startTime := time.Now()
+
+		go func() {
+			writer.Write(data)
+			writer.Close()
+		}()
+
+		received, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("ReadAll failed: %s", err)
+		}
+		duration := time.Since(startTime)
+		reader.Close()
+
+		if !bytes.Equal(received, data) {
+			t.Fatalf("unexpected received data")
+		}
+
+		payloadBytes, frameBytes := writer.GetWriteMetrics()
+		if payloadBytes != int64(len(data)) {
+			t.Fatalf("unexpected payload bytes: %d", payloadBytes)
+		}
+
+		return payloadBytes, frameBytes, duration
+	}
+
+	frameCount := func(data []byte) int64 {
+		return int64((len(data) + COMPRESSED_CONN_MAX_FRAME_SIZE - 1) / COMPRESSED_CONN_MAX_FRAME_SIZE)
+	}
+
+	// Compressible content is compressed.
+
+	payloadBytes, frameBytes, _ := transfer(text.Bytes(), 0)
+	if frameBytes > payloadBytes/4 {
+		t.Fatalf("unexpected compressed size: %d/%d", frameBytes, payloadBytes)
+	}
+
+	// Incompressible content is sent raw.
+
+	payloadBytes, frameBytes, _ = transfer(random, 0)
+	if frameBytes != payloadBytes+frameCount(random)*compressedConnFrameHeaderSize {
+		t.Fatalf("unexpected incompressible size: %d/%d", frameBytes, payloadBytes)
+	}
+
+	// TLS content is never compressed.
+
+	payloadBytes, frameBytes, _ = transfer(TLS, 0)
+	if frameBytes != payloadBytes+frameCount(TLS)*compressedConnFrameHeaderSize {
+		t.Fatalf("unexpected TLS size: %d/%d", frameBytes, payloadBytes)
+	}
+
+	// On a slow link, compressible content is transferred in less time. The
+	// rate limiter initially permits a burst of linkBytesPerSecond, so the
+	// uncompressed transfer takes at least 1 second.
+
+	linkBytesPerSecond := int64(32 * 1024)
+
+	data := text.Bytes()[:64*1024]
+
+	_, _, compressedDuration := transfer(data, linkBytesPerSecond)
+
+	clientConn, serverConn := net.Pipe()
+	writer := NewThrottledConn(clientConn, RateLimits{WriteBytesPerSecond: linkBytesPerSecond})
+	startTime := time.Now()
+	go func() {
+		writer.Write(data)
+		writer.Close()
+	}()
+	_, err := io.Copy(ioutil.Discard, serverConn)
+	if err != nil {
+		t.Fatalf("Copy failed: %s", err)
+	}
+	uncompressedDuration := time.Since(startTime)
+
+	t.Logf("slow link transfer: compressed %s, uncompressed %s",
+		compressedDuration, uncompressedDuration)
+
+	if compressedDuration > uncompressedDuration/2 {
+		t.Fatalf("unexpected compressed transfer duration")
+	}
+}
+
+func TestCompressedConnInvalidFrame(t *testing.T) {
+
+	clientConn, serverConn := net.Pipe()
+	reader := NewCompressedConn(serverConn)
+
+	// A frame which decompresses to more than the maximum frame size is
+	// rejected.
+
+	sender := NewCompressedConn(clientConn)
+	compressed, err := sender.compress(make([]byte, 2*COMPRESSED_CONN_MAX_FRAME_SIZE))
+	if err != nil {
+		t.Fatalf("compress failed: %s", err)
+	}
+	frame := []byte{compressedConnFrameTypeDeflate, 0, byte(len(compressed))}
+	frame = append(frame, compressed...)
+
+	go func() {
+		clientConn.Write(frame)
+		clientConn.Close()
+	}()
+
+	_, err = reader.Read(make([]byte, 1024))
+	if err == nil {
+		t.Fatalf("unexpected Read success")
+	}
+}
@@ -16,6 +16,10 @@ import (
 	"hash"
 	"io"
 	"io/ioutil"
+
+	// [Psiphon]
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/internal/chacha20"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/poly1305"
 )
 
 const (
@@ -31,6 +35,11 @@ const (
 	// length fields do not overflow, so it should remain well
 	// below 4G.
 	maxPacket = 256 * 1024
+
+	// [Psiphon]
+	// RFC 4253 section 6.1 requires all implementations to be able to
+	// process packets with a total packet length of 35000 bytes.
+	minPacketSize = 35000
 )
 
 // noneCipher implements cipher.Stream and provides no encryption. It is used
@@ -125,6 +134,12 @@ var cipherModes = map[string]*streamCipherMode{
 
 	// 3des-cbc is insecure and is disabled by default.
 	tripledescbcID: {24, des.BlockSize, 0, nil},
+
+	// [Psiphon]
+	// chacha20Poly1305ID, backported from upstream, is constructed with a
+	// special case, as is AES-GCM. It's not in the default config and must
+	// be explicitly requested.
+	chacha20Poly1305ID: {64, 0, 0, nil},
 }
 
 // prefixLen is the length of the packet prefix that contains the packet length
@@ -132,11 +147,31 @@ var cipherModes = map[string]*streamCipherMode{
 const prefixLen = 5
 
 // streamPacketCipher is a packetCipher using a stream cipher.
+// [Psiphon]
+// packetLengthLimit is embedded in packet ciphers to enforce
+// Config.MaxPacketSize on received packets. The zero value enforces only
+// maxPacket.
+type packetLengthLimit struct {
+	maxPacketLength uint32
+}
+
+func (limit *packetLengthLimit) setMaxPacketLength(maxPacketLength uint32) {
+	limit.maxPacketLength = maxPacketLength
+}
+
+func (limit *packetLengthLimit) exceedsMaxPacketLength(length uint32) bool {
+	return length > maxPacket ||
+		(limit.maxPacketLength > 0 && length > limit.maxPacketLength)
+}
+
 type streamPacketCipher struct {
 	mac    hash.Hash
 	cipher cipher.Stream
 	etm    bool
 
+	// [Psiphon]
+	packetLengthLimit
+
 	// The following members are to avoid per-packet allocations.
 	prefix      [prefixLen]byte
 	seqNumBytes [4]byte
@@ -180,7 +215,8 @@ func (s *streamPacketCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, err
 		return nil, errors.New("ssh: invalid packet length, packet too small")
 	}
 
-	if length > maxPacket {
+	// [Psiphon]
+	if s.exceedsMaxPacketLength(length) {
 		return nil, errors.New("ssh: invalid packet length, packet too large")
 	}
 
@@ -302,6 +338,9 @@ type gcmCipher struct {
 	prefix [4]byte
 	iv     []byte
 	buf    []byte
+
+	// [Psiphon]
+	packetLengthLimit
 }
 
 func newGCMCipher(iv, key, macKey []byte) (packetCipher, error) {
@@ -371,7 +410,8 @@ func (c *gcmCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
 		return nil, err
 	}
 	length := binary.BigEndian.Uint32(c.prefix[:])
-	if length > maxPacket {
+	// [Psiphon]
+	if c.exceedsMaxPacketLength(length) {
 		return nil, errors.New("ssh: max packet length exceeded.")
 	}
 
@@ -412,6 +452,9 @@ type cbcCipher struct {
 	decrypter cipher.BlockMode
 	encrypter cipher.BlockMode
 
+	// [Psiphon]
+	packetLengthLimit
+
 	// The following members are to avoid per-packet allocations.
 	seqNumBytes [4]byte
 	packetData  []byte
@@ -512,7 +555,8 @@ func (c *cbcCipher) readPacketLeaky(seqNum uint32, r io.Reader) ([]byte, error)
 
 	c.decrypter.CryptBlocks(firstBlock, firstBlock)
 	length := binary.BigEndian.Uint32(firstBlock[:4])
-	if length > maxPacket {
+	// [Psiphon]
+	if c.exceedsMaxPacketLength(length) {
 		return nil, cbcError("ssh: packet too large")
 	}
 	if length+4 < maxUInt32(cbcMinPacketSize, blockSize) {
@@ -627,3 +671,149 @@ func (c *cbcCipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, pack
 
 	return nil
 }
+
+// [Psiphon]
+// chacha20Poly1305Cipher is backported from upstream golang.org/x/crypto/ssh.
+
+const chacha20Poly1305ID = "chacha20-poly1305@openssh.com"
+
+// chacha20Poly1305Cipher implements the chacha20-poly1305@openssh.com
+// AEAD, which is described here:
+//
+//   https://tools.ietf.org/html/draft-josefsson-ssh-chacha20-poly1305-openssh-00
+//
+// the methods here also implement padding, which RFC4253 Section 6
+// also requires of stream ciphers.
+type chacha20Poly1305Cipher struct {
+	lengthKey  [32]byte
+	contentKey [32]byte
+	buf        []byte
+
+	// [Psiphon]
+	packetLengthLimit
+}
+
+func newChaCha20Cipher(key, unusedIV, unusedMACKey []byte, unusedAlgs directionAlgorithms) (packetCipher, error) {
+	if len(key) != 64 {
+		panic(len(key))
+	}
+
+	c := &chacha20Poly1305Cipher{
+		buf: make([]byte, 256),
+	}
+
+	copy(c.contentKey[:], key[:32])
+	copy(c.lengthKey[:], key[32:])
+	return c, nil
+}
+
+// The Poly1305 key is obtained by encrypting 32 0-bytes.
+var chacha20PolyKeyInput [32]byte
+
+func (c *chacha20Poly1305Cipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	var counter [16]byte
+	binary.BigEndian.PutUint64(counter[8:], uint64(seqNum))
+
+	var polyKey [32]byte
+	chacha20.XORKeyStream(polyKey[:], chacha20PolyKeyInput[:], &counter, &c.contentKey)
+
+	encryptedLength := c.buf[:4]
+	if _, err := io.ReadFull(r, encryptedLength); err != nil {
+		return nil, err
+	}
+
+	var lenBytes [4]byte
+	chacha20.XORKeyStream(lenBytes[:], encryptedLength, &counter, &c.lengthKey)
+
+	length := binary.BigEndian.Uint32(lenBytes[:])
+	// [Psiphon]
+	if c.exceedsMaxPacketLength(length) {
+		return nil, errors.New("ssh: invalid packet length, packet too large")
+	}
+
+	contentEnd := 4 + length
+	packetEnd := contentEnd + poly1305.TagSize
+	if uint32(cap(c.buf)) < packetEnd {
+		c.buf = make([]byte, packetEnd)
+		copy(c.buf[:], encryptedLength)
+	} else {
+		c.buf = c.buf[:packetEnd]
+	}
+
+	if _, err := io.ReadFull(r, c.buf[4:packetEnd]); err != nil {
+		return nil, err
+	}
+
+	var mac [poly1305.TagSize]byte
+	copy(mac[:], c.buf[contentEnd:packetEnd])
+	if !poly1305.Verify(&mac, c.buf[:contentEnd], &polyKey) {
+		return nil, errors.New("ssh: MAC failure")
+	}
+
+	counter[0] = 1
+
+	plain := c.buf[4:contentEnd]
+	chacha20.XORKeyStream(plain, plain, &counter, &c.contentKey)
+
+	padding := plain[0]
+	if padding < 4 {
+		// padding is a byte, so it automatically satisfies
+		// the maximum size, which is 255.
+		return nil, fmt.Errorf("ssh: illegal padding %d", padding)
+	}
+
+	if int(padding)+1 >= len(plain) {
+		return nil, fmt.Errorf("ssh: padding %d too large", padding)
+	}
+
+	plain = plain[1 : len(plain)-int(padding)]
+
+	return plain, nil
+}
+
+func (c *chacha20Poly1305Cipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, payload []byte) error {
+	var counter [16]byte
+	binary.BigEndian.PutUint64(counter[8:], uint64(seqNum))
+
+	var polyKey [32]byte
+	chacha20.XORKeyStream(polyKey[:], chacha20PolyKeyInput[:], &counter, &c.contentKey)
+
+	// There is no blocksize, so fall back to multiple of 8 byte
+	// padding, as described in RFC 4253, Sec 6.
+	const packetSizeMultiple = 8
+
+	padding := packetSizeMultiple - (1+len(payload))%packetSizeMultiple
+	if padding < 4 {
+		padding += packetSizeMultiple
+	}
+
+	// size (4 bytes), padding (1), payload, padding, tag.
+	totalLength := 4 + 1 + len(payload) + padding + poly1305.TagSize
+	if cap(c.buf) < totalLength {
+		c.buf = make([]byte, totalLength)
+	} else {
+		c.buf = c.buf[:totalLength]
+	}
+
+	binary.BigEndian.PutUint32(c.buf, uint32(1+len(payload)+padding))
+	chacha20.XORKeyStream(c.buf, c.buf[:4], &counter, &c.lengthKey)
+	c.buf[4] = byte(padding)
+	copy(c.buf[5:], payload)
+	packetEnd := 5 + len(payload) + padding
+	if _, err := io.ReadFull(rand, c.buf[5+len(payload):packetEnd]); err != nil {
+		return err
+	}
+
+	counter[0] = 1
+	chacha20.XORKeyStream(c.buf[4:], c.buf[4:packetEnd], &counter, &c.contentKey)
+
+	var mac [poly1305.TagSize]byte
+	poly1305.Sum(&mac, c.buf[:packetEnd], &polyKey)
+
+	copy(c.buf[packetEnd:], mac[:])
+
+	if _, err := w.Write(c.buf); err != nil {
+		return err
+	}
+	return nil
+}
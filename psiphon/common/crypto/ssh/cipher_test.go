@@ -9,6 +9,8 @@ import (
 	"crypto"
 	"crypto/aes"
 	"crypto/rand"
+	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -127,3 +129,146 @@ func TestCBCOracleCounterMeasure(t *testing.T) {
 		lastRead = bytesRead
 	}
 }
+
+// [Psiphon]
+func TestChaCha20Poly1305RoundTrip(t *testing.T) {
+
+	kr := &kexResult{Hash: crypto.SHA256}
+	algs := directionAlgorithms{
+		Cipher:      chacha20Poly1305ID,
+		MAC:         "hmac-sha2-256",
+		Compression: "none",
+	}
+	client, err := newPacketCipher(clientKeys, algs, kr)
+	if err != nil {
+		t.Fatalf("newPacketCipher(client): %v", err)
+	}
+	server, err := newPacketCipher(clientKeys, algs, kr)
+	if err != nil {
+		t.Fatalf("newPacketCipher(server): %v", err)
+	}
+
+	// The packet length and the Poly1305 key are derived from the sequence
+	// number, so round trip several packets.
+	buf := &bytes.Buffer{}
+	for seqNum := uint32(0); seqNum < 3; seqNum++ {
+		want := bytes.Repeat([]byte{byte(seqNum)}, 100+int(seqNum))
+		if err := client.writePacket(seqNum, buf, rand.Reader, want); err != nil {
+			t.Fatalf("writePacket(%d): %v", seqNum, err)
+		}
+		packet, err := server.readPacket(seqNum, buf)
+		if err != nil {
+			t.Fatalf("readPacket(%d): %v", seqNum, err)
+		}
+		if !bytes.Equal(packet, want) {
+			t.Fatalf("roundtrip(%d): got %x, want %x", seqNum, packet, want)
+		}
+	}
+
+	// A packet must be read with its own sequence number.
+	if err := client.writePacket(3, buf, rand.Reader, []byte("bla bla")); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	if _, err := server.readPacket(4, buf); err == nil {
+		t.Fatalf("readPacket with wrong sequence number succeeded")
+	}
+
+	// Any modification of the ciphertext must be detected.
+	buf.Reset()
+	if err := client.writePacket(5, buf, rand.Reader, []byte("bla bla")); err != nil {
+		t.Fatalf("writePacket: %v", err)
+	}
+	packet := buf.Bytes()
+	for i := prefixLen; i < len(packet); i++ {
+		corrupt := append([]byte(nil), packet...)
+		corrupt[i] ^= 0x01
+		if _, err := server.readPacket(5, bytes.NewReader(corrupt)); err == nil {
+			t.Fatalf("corrupt byte %d: readPacket succeeded", i)
+		}
+	}
+
+	// Negotiate chacha20-poly1305@openssh.com, which isn't enabled by
+	// default, in a full handshake and round trip channel data spanning
+	// many packets.
+
+	c1, c2, err := netPipe()
+	if err != nil {
+		t.Fatalf("netPipe: %v", err)
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	serverConfig := &ServerConfig{
+		Config:       Config{Ciphers: []string{chacha20Poly1305ID}},
+		NoClientAuth: true,
+	}
+	serverConfig.AddHostKey(testSigners["ecdsa"])
+
+	clientConfig := &ClientConfig{
+		Config:          Config{Ciphers: []string{chacha20Poly1305ID}},
+		HostKeyCallback: InsecureIgnoreHostKey(),
+	}
+
+	serverErrs := make(chan error, 1)
+	go func() {
+		_, chans, reqs, err := NewServerConn(c1, serverConfig)
+		if err != nil {
+			serverErrs <- err
+			return
+		}
+		go DiscardRequests(reqs)
+		newChannel := <-chans
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			serverErrs <- err
+			return
+		}
+		go DiscardRequests(requests)
+		_, err = io.Copy(channel, channel)
+		channel.Close()
+		serverErrs <- err
+	}()
+
+	conn, chans, reqs, err := NewClientConn(c2, "", clientConfig)
+	if err != nil {
+		t.Fatalf("NewClientConn: %v", err)
+	}
+	sshClient := NewClient(conn, chans, reqs)
+	defer sshClient.Close()
+
+	algorithms := conn.(*connection).transport.algorithms
+	if algorithms.w.Cipher != chacha20Poly1305ID ||
+		algorithms.r.Cipher != chacha20Poly1305ID {
+		t.Fatalf("unexpected negotiated algorithms: %+v", algorithms)
+	}
+
+	channel, requests, err := sshClient.OpenChannel("chan", nil)
+	if err != nil {
+		t.Fatalf("OpenChannel: %v", err)
+	}
+	go DiscardRequests(requests)
+
+	want := make([]byte, 4*channelMaxPacket)
+	rand.Read(want)
+
+	writeErrs := make(chan error, 1)
+	go func() {
+		_, err := channel.Write(want)
+		channel.CloseWrite()
+		writeErrs <- err
+	}()
+
+	got, err := ioutil.ReadAll(channel)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if err := <-writeErrs; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := <-serverErrs; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("channel data mismatch")
+	}
+}
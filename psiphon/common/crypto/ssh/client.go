@@ -101,9 +101,12 @@ func (c *connection) clientHandshake(dialAddress string, config *ClientConfig) e
 		return err
 	}
 
+	// [Psiphon]
+	tr := newTransport(c.sshConn.conn, config.Rand, true /* is client */)
+	tr.setMaxPacketLength(config.MaxPacketSize)
+
 	c.transport = newClientTransport(
-		newTransport(c.sshConn.conn, config.Rand, true /* is client */),
-		c.clientVersion, c.serverVersion, config, dialAddress, c.sshConn.RemoteAddr())
+		tr, c.clientVersion, c.serverVersion, config, dialAddress, c.sshConn.RemoteAddr())
 	if err := c.transport.waitSession(); err != nil {
 		return err
 	}
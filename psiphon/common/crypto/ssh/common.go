@@ -62,6 +62,36 @@ var supportedMACs = []string{
 
 var supportedCompressions = []string{compressionNone}
 
+// [Psiphon]
+// Algorithms specifies key exchange, cipher, and MAC algorithms.
+type Algorithms struct {
+	KeyExchanges []string
+	Ciphers      []string
+	MACs         []string
+}
+
+// [Psiphon]
+// DefaultAlgorithms returns the algorithms, in preference order, which are
+// used when the corresponding Config fields are unspecified.
+func DefaultAlgorithms() Algorithms {
+	return Algorithms{
+		KeyExchanges: append([]string(nil), supportedKexAlgos...),
+		Ciphers:      append([]string(nil), supportedCiphers...),
+		MACs:         append([]string(nil), supportedMACs...),
+	}
+}
+
+// [Psiphon]
+// SecureAlgorithms returns the algorithms which may be selected in Config:
+// the default algorithms and chacha20-poly1305@openssh.com, which is secure
+// but not enabled by default. Algorithms which are implemented but disabled
+// by default as insecure, such as 3des-cbc and arcfour, are excluded.
+func SecureAlgorithms() Algorithms {
+	algorithms := DefaultAlgorithms()
+	algorithms.Ciphers = append(algorithms.Ciphers, chacha20Poly1305ID)
+	return algorithms
+}
+
 // hashFuncs keeps the mapping of supported algorithms to their respective
 // hashes needed for signature verification.
 var hashFuncs = map[string]crypto.Hash{
@@ -201,6 +231,23 @@ type Config struct {
 	// The allowed MAC algorithms. If unspecified then a sensible default
 	// is used.
 	MACs []string
+
+	// [Psiphon]
+	// MaxPacketSize, when > 0, is the maximum received packet length. A
+	// received packet with a length field exceeding MaxPacketSize is
+	// rejected before any buffer is allocated for it, and the connection
+	// fails. Values below minPacketSize, the packet size RFC 4253 requires
+	// all implementations to support, are raised to minPacketSize; and
+	// values above, and the default, are the maxPacket limit.
+	MaxPacketSize uint32
+
+	// [Psiphon]
+	// PreferredAlgorithms specifies key exchange, cipher, and MAC
+	// algorithms which a client offers first, in their order in
+	// KeyExchanges, Ciphers, and MACs, when it randomizes its KEX; only
+	// the remaining algorithms are shuffled and truncated. Preferred
+	// algorithms must also be specified in KeyExchanges, Ciphers, and MACs.
+	PreferredAlgorithms Algorithms
 }
 
 // SetDefaults sets sensible values for unset fields in config. This is
@@ -230,6 +277,13 @@ func (c *Config) SetDefaults() {
 		c.MACs = supportedMACs
 	}
 
+	// [Psiphon]
+	if c.MaxPacketSize == 0 || c.MaxPacketSize > maxPacket {
+		c.MaxPacketSize = maxPacket
+	} else if c.MaxPacketSize < minPacketSize {
+		c.MaxPacketSize = minPacketSize
+	}
+
 	if c.RekeyThreshold == 0 {
 		// cipher specific default
 	} else if c.RekeyThreshold < minRekeyThreshold {
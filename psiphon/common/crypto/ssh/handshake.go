@@ -503,11 +503,27 @@ func (t *handshakeTransport) sendKexInit() error {
 			return list[:cut]
 		}
 
-		msg.KexAlgos = truncate(permute(t.config.KeyExchanges))
-		ciphers := truncate(permute(t.config.Ciphers))
+		// Any preferred algorithms are retained, in order, ahead of the
+		// randomized remainder.
+		randomize := func(list, preferred []string) []string {
+			var prefix, remainder []string
+			for _, algo := range list {
+				if common.Contains(preferred, algo) {
+					prefix = append(prefix, algo)
+				} else {
+					remainder = append(remainder, algo)
+				}
+			}
+			return append(prefix, truncate(permute(remainder))...)
+		}
+
+		preferred := t.config.PreferredAlgorithms
+
+		msg.KexAlgos = randomize(t.config.KeyExchanges, preferred.KeyExchanges)
+		ciphers := randomize(t.config.Ciphers, preferred.Ciphers)
 		msg.CiphersClientServer = ciphers
 		msg.CiphersServerClient = ciphers
-		MACs := truncate(permute(t.config.MACs))
+		MACs := randomize(t.config.MACs, preferred.MACs)
 		msg.MACsClientServer = MACs
 		msg.MACsServerClient = MACs
 
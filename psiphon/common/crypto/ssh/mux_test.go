@@ -143,7 +143,9 @@ func TestMuxChannelOverflow(t *testing.T) {
 
 	wDone := make(chan int, 1)
 	go func() {
-		if _, err := writer.Write(make([]byte, channelWindowSize)); err != nil {
+		// [Psiphon]
+		// The channel window size is selected by getChannelWindowSize.
+		if _, err := writer.Write(make([]byte, getChannelWindowSize(writer.chanType))); err != nil {
 			t.Errorf("could not fill window: %v", err)
 		}
 		writer.Write(make([]byte, 1))
@@ -175,7 +177,9 @@ func TestMuxChannelCloseWriteUnblock(t *testing.T) {
 
 	wDone := make(chan int, 1)
 	go func() {
-		if _, err := writer.Write(make([]byte, channelWindowSize)); err != nil {
+		// [Psiphon]
+		// The channel window size is selected by getChannelWindowSize.
+		if _, err := writer.Write(make([]byte, getChannelWindowSize(writer.chanType))); err != nil {
 			t.Errorf("could not fill window: %v", err)
 		}
 		if _, err := writer.Write(make([]byte, 1)); err != io.EOF {
@@ -197,7 +201,9 @@ func TestMuxConnectionCloseWriteUnblock(t *testing.T) {
 
 	wDone := make(chan int, 1)
 	go func() {
-		if _, err := writer.Write(make([]byte, channelWindowSize)); err != nil {
+		// [Psiphon]
+		// The channel window size is selected by getChannelWindowSize.
+		if _, err := writer.Write(make([]byte, getChannelWindowSize(writer.chanType))); err != nil {
 			t.Errorf("could not fill window: %v", err)
 		}
 		if _, err := writer.Write(make([]byte, 1)); err != io.EOF {
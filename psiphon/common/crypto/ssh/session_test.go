@@ -747,12 +747,35 @@ func TestHostKeyAlgorithms(t *testing.T) {
 		}
 	}
 
-	// By default, we get the preferred algorithm, which is ECDSA 256.
+	// [Psiphon]
+	// Psiphon clients randomize the order of their offered host key
+	// algorithms, so by default either server host key may be selected.
+	// Psiphon clients also always offer KeyAlgoRSA, so the unknown host
+	// key algorithm case is tested against a server with no RSA host key.
 
+	var alg string
 	clientConf := &ClientConfig{
-		HostKeyCallback: InsecureIgnoreHostKey(),
+		HostKeyCallback: func(h string, a net.Addr, key PublicKey) error {
+			alg = key.Type()
+			return nil
+		},
+	}
+	for i := 0; i < 10; i++ {
+		c1, c2, err := netPipe()
+		if err != nil {
+			t.Fatalf("netPipe: %v", err)
+		}
+		go NewServerConn(c1, serverConf)
+		_, _, _, err = NewClientConn(c2, "", clientConf)
+		c1.Close()
+		c2.Close()
+		if err != nil {
+			t.Fatalf("NewClientConn: %v", err)
+		}
+		if alg != KeyAlgoRSA && alg != KeyAlgoECDSA256 {
+			t.Errorf("selected key algorithm %s, want %s or %s", alg, KeyAlgoRSA, KeyAlgoECDSA256)
+		}
 	}
-	connect(clientConf, KeyAlgoECDSA256)
 
 	// Client asks for RSA explicitly.
 	clientConf.HostKeyAlgorithms = []string{KeyAlgoRSA}
@@ -765,6 +788,11 @@ func TestHostKeyAlgorithms(t *testing.T) {
 	defer c1.Close()
 	defer c2.Close()
 
+	serverConf = &ServerConfig{
+		NoClientAuth: true,
+	}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+
 	go NewServerConn(c1, serverConf)
 	clientConf.HostKeyAlgorithms = []string{"nonexistent-hostkey-algo"}
 	_, _, _, err = NewClientConn(c2, "", clientConf)
@@ -47,6 +47,9 @@ type transport struct {
 	rand      io.Reader
 	isClient  bool
 	io.Closer
+
+	// [Psiphon]
+	maxPacketLength uint32
 }
 
 // packetCipher represents a combination of SSH encryption/MAC
@@ -79,6 +82,8 @@ func (t *transport) prepareKeyChange(algs *algorithms, kexResult *kexResult) err
 	if ciph, err := newPacketCipher(t.reader.dir, algs.r, kexResult); err != nil {
 		return err
 	} else {
+		// [Psiphon]
+		t.applyMaxPacketLength(ciph)
 		t.reader.pendingKeyChange <- ciph
 	}
 
@@ -91,6 +96,24 @@ func (t *transport) prepareKeyChange(algs *algorithms, kexResult *kexResult) err
 	return nil
 }
 
+// [Psiphon]
+// setMaxPacketLength sets the maximum received packet length, enforced by
+// the current and all subsequent reader packet ciphers. See
+// Config.MaxPacketSize.
+func (t *transport) setMaxPacketLength(maxPacketLength uint32) {
+	t.maxPacketLength = maxPacketLength
+	t.applyMaxPacketLength(t.reader.packetCipher)
+}
+
+// [Psiphon]
+func (t *transport) applyMaxPacketLength(ciph packetCipher) {
+	if limit, ok := ciph.(interface {
+		setMaxPacketLength(uint32)
+	}); ok {
+		limit.setMaxPacketLength(t.maxPacketLength)
+	}
+}
+
 func (t *transport) printPacket(p []byte, write bool) {
 	if len(p) == 0 {
 		return
@@ -265,6 +288,11 @@ func newPacketCipher(d direction, algs directionAlgorithms, kex *kexResult) (pac
 		return newTripleDESCBCCipher(iv, key, macKey, algs)
 	}
 
+	// [Psiphon]
+	if algs.Cipher == chacha20Poly1305ID {
+		return newChaCha20Cipher(key, iv, macKey, algs)
+	}
+
 	c := &streamPacketCipher{
 		mac: macModes[algs.MAC].new(macKey),
 		etm: macModes[algs.MAC].etm,
@@ -8,6 +8,9 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -107,3 +110,96 @@ func TestTransportMaxPacketReader(t *testing.T) {
 		t.Errorf("got %q, should mention %q", err.Error(), "large")
 	}
 }
+
+// [Psiphon]
+func TestTransportConfiguredMaxPacketReader(t *testing.T) {
+
+	maxPacketSize := uint32(64 * 1024)
+
+	readPacket := func(length uint32, body []byte) error {
+		var header [5]byte
+		binary.BigEndian.PutUint32(header[0:], length)
+		buf := &closerBuffer{}
+		buf.Write(header[:])
+		buf.Write(body)
+		tr := newTransport(buf, rand.Reader, false)
+		tr.setMaxPacketLength(maxPacketSize)
+		_, err := tr.readPacket()
+		return err
+	}
+
+	// A packet within the configured limit is read.
+
+	err := readPacket(1024, make([]byte, 1024))
+	if err != nil {
+		t.Errorf("transport failed reading packet: %v", err)
+	}
+
+	// A packet exceeding the configured limit, but not maxPacket, is
+	// rejected.
+
+	err = readPacket(maxPacketSize+1, make([]byte, maxPacketSize+1))
+	if err == nil || !strings.Contains(err.Error(), "large") {
+		t.Errorf("transport succeeded reading oversized packet: %v", err)
+	}
+
+	// A crafted length field doesn't result in a large allocation.
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	totalAlloc := memStats.TotalAlloc
+
+	err = readPacket(0xffffffff, nil)
+	if err == nil || !strings.Contains(err.Error(), "large") {
+		t.Errorf("transport succeeded reading crafted packet: %v", err)
+	}
+
+	runtime.ReadMemStats(&memStats)
+	if memStats.TotalAlloc-totalAlloc > uint64(maxPacketSize) {
+		t.Errorf("unexpected allocation: %d", memStats.TotalAlloc-totalAlloc)
+	}
+}
+
+// [Psiphon]
+func TestServerConnClosedOnMaxPacketSize(t *testing.T) {
+
+	serverConf := &ServerConfig{
+		NoClientAuth: true,
+		Config: Config{
+			MaxPacketSize: 64 * 1024,
+		},
+	}
+	serverConf.AddHostKey(testSigners["ecdsa"])
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, _, _, err := NewServerConn(serverConn, serverConf)
+		serverErr <- err
+	}()
+
+	// Send the client version line and then a packet with a length field
+	// exceeding MaxPacketSize, but not maxPacket.
+
+	go func() {
+		var header [5]byte
+		binary.BigEndian.PutUint32(header[0:], 128*1024)
+		clientConn.Write([]byte("SSH-2.0-Go\r\n"))
+		clientConn.Write(header[:])
+	}()
+	go ioutil.ReadAll(clientConn)
+
+	err := <-serverErr
+	if err == nil || !strings.Contains(err.Error(), "large") {
+		t.Fatalf("server accepted oversized packet: %v", err)
+	}
+
+	// The server conn is closed.
+
+	_, err = serverConn.Write([]byte{0})
+	if err == nil {
+		t.Fatalf("server conn not closed")
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -58,6 +59,7 @@ type Conn struct {
 	maxWriteBytes   int
 	minDelay        time.Duration
 	maxDelay        time.Duration
+	rng             *rand.Rand
 }
 
 // NewConn creates a new Conn.
@@ -81,6 +83,30 @@ func NewConn(
 	}
 }
 
+// NewSeededConn creates a new Conn which selects write sizes and delays
+// using a PRNG initialized with the specified seed, instead of a secure
+// random source. Given the same seed and the same sequence of writes, the
+// fragmentation is identical. This is intended for reproducing dials in
+// tests.
+func NewSeededConn(
+	conn net.Conn,
+	noticeEmitter func(string),
+	seed int64,
+	bytesToFragment, minWriteBytes, maxWriteBytes int,
+	minDelay, maxDelay time.Duration) *Conn {
+
+	c := NewConn(
+		conn,
+		noticeEmitter,
+		bytesToFragment,
+		minWriteBytes,
+		maxWriteBytes,
+		minDelay,
+		maxDelay)
+	c.rng = rand.New(rand.NewSource(seed))
+	return c
+}
+
 func (c *Conn) Write(buffer []byte) (int, error) {
 
 	c.writeMutex.Lock()
@@ -111,8 +137,7 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 
 	for iterations := 0; len(buffer) > 0; iterations += 1 {
 
-		delay, err := common.MakeSecureRandomPeriod(
-			c.minDelay, c.maxDelay)
+		delay, err := c.randomPeriod(c.minDelay, c.maxDelay)
 		if err != nil {
 			delay = c.minDelay
 		}
@@ -140,8 +165,7 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 			maxWriteBytes = len(buffer)
 		}
 
-		writeBytes, err := common.MakeSecureRandomRange(
-			minWriteBytes, maxWriteBytes)
+		writeBytes, err := c.randomRange(minWriteBytes, maxWriteBytes)
 		if err != nil {
 			writeBytes = maxWriteBytes
 		}
@@ -174,6 +198,30 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 	return totalBytesWritten, nil
 }
 
+// randomRange selects a random value in [min, max], using the seeded PRNG
+// when set. The caller must hold writeMutex.
+func (c *Conn) randomRange(min, max int) (int, error) {
+	if c.rng == nil {
+		return common.MakeSecureRandomRange(min, max)
+	}
+	if max <= min {
+		return min, nil
+	}
+	return min + c.rng.Intn(max-min+1), nil
+}
+
+// randomPeriod selects a random duration in [min, max), using the seeded
+// PRNG when set. The caller must hold writeMutex.
+func (c *Conn) randomPeriod(min, max time.Duration) (time.Duration, error) {
+	if c.rng == nil {
+		return common.MakeSecureRandomPeriod(min, max)
+	}
+	if max <= min {
+		return min, nil
+	}
+	return min + time.Duration(c.rng.Int63n(int64(max-min))), nil
+}
+
 func (c *Conn) Close() (err error) {
 	if !atomic.CompareAndSwapInt32(&c.isClosed, 0, 1) {
 		return nil
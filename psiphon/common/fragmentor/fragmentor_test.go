@@ -114,3 +114,39 @@ func TestFragmentor(t *testing.T) {
 		t.Errorf("goroutine failed: %s", err)
 	}
 }
+
+func TestSeededFragmentor(t *testing.T) {
+
+	data := make([]byte, 1<<14)
+	rand.Read(data)
+
+	fragment := func(seed int64) []int {
+		conn := &writeSizeRecordingConn{}
+		fragmentorConn := NewSeededConn(conn, nil, seed, len(data), 1, 512, 0, 0)
+		_, err := fragmentorConn.Write(data)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		return conn.writeSizes
+	}
+
+	writeSizes := fragment(1)
+
+	if fmt.Sprint(writeSizes) != fmt.Sprint(fragment(1)) {
+		t.Fatalf("unexpected fragmentation with same seed")
+	}
+
+	if fmt.Sprint(writeSizes) == fmt.Sprint(fragment(2)) {
+		t.Fatalf("unexpected fragmentation with different seed")
+	}
+}
+
+type writeSizeRecordingConn struct {
+	net.Conn
+	writeSizes []int
+}
+
+func (conn *writeSizeRecordingConn) Write(buffer []byte) (int, error) {
+	conn.writeSizes = append(conn.writeSizes, len(buffer))
+	return len(buffer), nil
+}
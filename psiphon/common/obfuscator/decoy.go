@@ -0,0 +1,352 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package obfuscator
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	utls "github.com/Psiphon-Labs/utls"
+	cache "github.com/patrickmn/go-cache"
+)
+
+const (
+	DECOY_SIGNAL_NONCE_LENGTH     = 12
+	DECOY_SIGNAL_TIMESTAMP_LENGTH = 4
+	DECOY_SIGNAL_MAC_LENGTH       = 16
+	DECOY_SIGNAL_LENGTH           = DECOY_SIGNAL_NONCE_LENGTH + DECOY_SIGNAL_TIMESTAMP_LENGTH + DECOY_SIGNAL_MAC_LENGTH
+	DECOY_MAX_CLOCK_SKEW          = 1 * time.Hour
+	DECOY_MAX_CLIENT_HELLO_LENGTH = 4096
+	DECOY_MAC_KEY_LABEL           = "decoy-first-flight-mac"
+	DECOY_MASK_KEY_LABEL          = "decoy-first-flight-mask"
+)
+
+// decoyAlert is the server's response to a valid decoy ClientHello: a fatal
+// handshake_failure TLS alert, as a TLS server sends when it rejects a
+// ClientHello.
+var decoyAlert = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}
+
+// The decoy first flight is an optional prelude to an OSSH connection, for
+// networks where the obfuscated SSH seed message itself may be flagged.
+//
+// Before dialing the OSSH connection, the client makes a separate decoy
+// connection to the server and sends a decoy: a TLS ClientHello, parroting
+// a common browser and specifying a benign SNI. The ClientHello session ID,
+// which a TLS client typically sets to 32 random bytes, instead carries a
+// covert signal: a nonce, a masked timestamp, and a MAC, all keyed with the
+// obfuscation keyword. The client then waits for the server's response and
+// sends no other data on the decoy connection.
+//
+// A server which verifies the signal responds with a fatal TLS alert and
+// closes the connection, as a TLS server rejecting the ClientHello would.
+// The client then closes the decoy connection and, having received the
+// covert acknowledgement, proceeds to dial the OSSH connection. When there
+// is no alert, as when the server is blocked or the connection reaches some
+// other server, the client never sends an obfuscated SSH seed message to
+// the server. In both cases, a passive observer of the decoy connection sees
+// only a failed TLS connection to a benign server, which is abandoned.
+//
+// A server which receives a ClientHello without a valid signal, as sent by
+// an active prober, treats the ClientHello as the start of a seed message,
+// so that the server responds exactly as it would to any other invalid seed
+// message. A signal is valid only within DECOY_MAX_CLOCK_SKEW of the server
+// clock and, with a DecoyHistory, only once, so replaying a recorded decoy
+// elicits no alert.
+//
+// Limitations: the subsequent OSSH connection, to the same server, remains
+// visible to a passive observer; the decoy ClientHello fingerprint is that
+// of the newest Chrome parrot in the vendored utls, which lags current
+// browsers; and clients with clocks skewed by more than
+// DECOY_MAX_CLOCK_SKEW fail to connect.
+
+// MakeDecoyClientHello returns a decoy TLS ClientHello record, for the
+// specified server name, carrying a covert signal keyed with the
+// obfuscation keyword.
+func MakeDecoyClientHello(keyword, serverName string) ([]byte, error) {
+
+	signal, err := makeDecoySignal(keyword, time.Now())
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// The UConn is used only to generate the ClientHello, and is never
+	// attached to a network conn. HelloChrome_Auto selects the most recent
+	// Chrome parrot, and tracks utls updates.
+
+	conn := utls.UClient(
+		nil,
+		&utls.Config{ServerName: serverName},
+		utls.HelloChrome_Auto)
+
+	err = conn.BuildHandshakeState()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	conn.HandshakeState.Hello.SessionId = signal
+
+	err = conn.MarshalClientHello()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	hello := conn.HandshakeState.Hello.Raw
+
+	record := make([]byte, 5, 5+len(hello))
+	record[0] = 0x16
+	record[1] = 0x03
+	record[2] = 0x01
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(hello)))
+	record = append(record, hello...)
+
+	return record, nil
+}
+
+func deriveDecoyKey(keyword, label string) []byte {
+	h := hmac.New(sha256.New, []byte(keyword))
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+func makeDecoySignal(keyword string, now time.Time) ([]byte, error) {
+
+	nonce, err := common.MakeSecureRandomBytes(DECOY_SIGNAL_NONCE_LENGTH)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	signal := make([]byte, 0, DECOY_SIGNAL_LENGTH)
+	signal = append(signal, nonce...)
+	signal = append(signal, maskDecoyTimestamp(keyword, nonce, uint32(now.Unix()/60))...)
+	signal = append(signal, makeDecoyMAC(keyword, signal)...)
+
+	return signal, nil
+}
+
+// checkDecoySignal verifies the signal and its timestamp, and returns the
+// signal nonce.
+func checkDecoySignal(keyword string, signal []byte, now time.Time) ([]byte, bool) {
+
+	if len(signal) != DECOY_SIGNAL_LENGTH {
+		return nil, false
+	}
+
+	macOffset := DECOY_SIGNAL_NONCE_LENGTH + DECOY_SIGNAL_TIMESTAMP_LENGTH
+
+	if !hmac.Equal(
+		makeDecoyMAC(keyword, signal[:macOffset]),
+		signal[macOffset:]) {
+		return nil, false
+	}
+
+	nonce := signal[:DECOY_SIGNAL_NONCE_LENGTH]
+
+	// Masking is an XOR, so masking the masked timestamp recovers it.
+	timestamp := time.Unix(60*int64(binary.BigEndian.Uint32(
+		maskDecoyTimestamp(
+			keyword,
+			nonce,
+			binary.BigEndian.Uint32(signal[DECOY_SIGNAL_NONCE_LENGTH:macOffset])))), 0)
+
+	skew := now.Sub(timestamp)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > DECOY_MAX_CLOCK_SKEW {
+		return nil, false
+	}
+
+	return nonce, true
+}
+
+// maskDecoyTimestamp masks the timestamp, which would otherwise be a
+// recognizable, plaintext value in the session ID.
+func maskDecoyTimestamp(keyword string, nonce []byte, timestamp uint32) []byte {
+	h := hmac.New(sha256.New, deriveDecoyKey(keyword, DECOY_MASK_KEY_LABEL))
+	h.Write(nonce)
+	mask := h.Sum(nil)
+	masked := make([]byte, DECOY_SIGNAL_TIMESTAMP_LENGTH)
+	binary.BigEndian.PutUint32(masked, timestamp^binary.BigEndian.Uint32(mask))
+	return masked
+}
+
+func makeDecoyMAC(keyword string, data []byte) []byte {
+	h := hmac.New(sha256.New, deriveDecoyKey(keyword, DECOY_MAC_KEY_LABEL))
+	h.Write(data)
+	return h.Sum(nil)[:DECOY_SIGNAL_MAC_LENGTH]
+}
+
+// DecoyHistory records the nonces of recently received decoy signals, so
+// that replayed decoys are rejected. A DecoyHistory is safe for concurrent
+// use.
+type DecoyHistory struct {
+	nonces *cache.Cache
+}
+
+// NewDecoyHistory creates a new DecoyHistory.
+func NewDecoyHistory() *DecoyHistory {
+	// Signals older than DECOY_MAX_CLOCK_SKEW are rejected, so nonces need
+	// only be retained for the entire window of valid timestamps.
+	return &DecoyHistory{
+		nonces: cache.New(2*DECOY_MAX_CLOCK_SKEW, 1*time.Minute),
+	}
+}
+
+// addNew records the nonce, and returns false when the nonce was already
+// recorded.
+func (history *DecoyHistory) addNew(nonce []byte) bool {
+	if history == nil {
+		return true
+	}
+	return history.nonces.Add(string(nonce), true, cache.DefaultExpiration) == nil
+}
+
+// SendDecoyFirstFlight sends the decoy first flight on conn, a dedicated
+// decoy connection, and awaits the server's acknowledgement. An error is
+// returned when the server doesn't acknowledge the decoy, in which case the
+// client must not proceed to connect to the server. In all cases, the caller
+// should then close conn, which is not used for any other data.
+//
+// Any deadline for awaiting the response must be set on conn.
+func SendDecoyFirstFlight(conn net.Conn, keyword, serverName string) error {
+
+	clientHello, err := MakeDecoyClientHello(keyword, serverName)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	_, err = conn.Write(clientHello)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	response := make([]byte, len(decoyAlert))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if !bytes.Equal(response, decoyAlert) {
+		return common.ContextError(errors.New("unexpected decoy response"))
+	}
+
+	return nil
+}
+
+// NewDecoyServerConn checks for a decoy first flight at the start of the
+// client conn. When a decoy with a valid signal is received,
+// NewDecoyServerConn consumes the decoy, sends the response, and returns
+// true, and the caller must then close conn, as a TLS server closes the
+// connection after a fatal alert. Otherwise, NewDecoyServerConn returns a
+// conn which replays all bytes read by the check, so that they're handled
+// as the start of the seed message.
+//
+// NewDecoyServerConn blocks on reading from conn.
+func NewDecoyServerConn(
+	conn net.Conn, keyword string, history *DecoyHistory) (net.Conn, bool, error) {
+
+	// The TLS record header and the handshake message type. Reading these
+	// bytes never blocks a client that doesn't send a decoy, as the seed
+	// message is always longer.
+	header := make([]byte, 6)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, false, common.ContextError(err)
+	}
+
+	recordLength := int(binary.BigEndian.Uint16(header[3:5]))
+
+	// For a seed message, these checks fail with overwhelming probability.
+	// Otherwise, the read for the rest of the record could block.
+	if header[0] != 0x16 || header[1] != 0x03 || header[2] != 0x01 ||
+		header[5] != 0x01 ||
+		recordLength < 1 || recordLength > DECOY_MAX_CLIENT_HELLO_LENGTH {
+
+		return newReplayConn(conn, header), false, nil
+	}
+
+	record := make([]byte, 5+recordLength)
+	copy(record, header)
+	_, err = io.ReadFull(conn, record[len(header):])
+	if err != nil {
+		return nil, false, common.ContextError(err)
+	}
+
+	signal := getClientHelloSessionID(record[5:])
+
+	nonce, ok := checkDecoySignal(keyword, signal, time.Now())
+	if !ok || !history.addNew(nonce) {
+		return newReplayConn(conn, record), false, nil
+	}
+
+	_, err = conn.Write(decoyAlert)
+	if err != nil {
+		return nil, false, common.ContextError(err)
+	}
+
+	return nil, true, nil
+}
+
+// getClientHelloSessionID returns the session ID from the ClientHello
+// handshake message, or nil if the message is malformed.
+func getClientHelloSessionID(hello []byte) []byte {
+
+	// Message type and length (4), version (2), and random (32).
+	offset := 4 + 2 + 32
+	if len(hello) < offset+1 {
+		return nil
+	}
+
+	sessionIDLength := int(hello[offset])
+	offset++
+	if len(hello) < offset+sessionIDLength {
+		return nil
+	}
+
+	return hello[offset : offset+sessionIDLength]
+}
+
+// replayConn returns the bytes in replay before reading from the
+// underlying conn.
+type replayConn struct {
+	net.Conn
+	replay *bytes.Reader
+}
+
+func newReplayConn(conn net.Conn, replay []byte) *replayConn {
+	return &replayConn{
+		Conn:   conn,
+		replay: bytes.NewReader(replay),
+	}
+}
+
+func (conn *replayConn) Read(buffer []byte) (int, error) {
+	if conn.replay.Len() > 0 {
+		return conn.replay.Read(buffer)
+	}
+	return conn.Conn.Read(buffer)
+}
@@ -106,10 +106,19 @@ const (
 // NewObfuscatedSshConn blocks on reading the client seed message from the
 // underlying conn.
 //
+// In client mode, seedKeyDerivations may specify one SeedKeyDerivation name,
+// the derivation to use. In server mode, seedKeyDerivations lists the
+// accepted derivations. When nil, the default derivation is used.
+//
+// In client mode, minPadding and maxPadding specify the seed message padding
+// range. In server mode, minPadding, when not nil, is the minimum seed
+// message padding accepted, and maxPadding is ignored. See ObfuscatorConfig.
+//
 func NewObfuscatedSshConn(
 	mode ObfuscatedSshConnMode,
 	conn net.Conn,
 	obfuscationKeyword string,
+	seedKeyDerivations []string,
 	minPadding, maxPadding *int) (*ObfuscatedSshConn, error) {
 
 	var err error
@@ -118,11 +127,19 @@ func NewObfuscatedSshConn(
 	var writeState ObfuscatedSshWriteState
 
 	if mode == OBFUSCATION_CONN_MODE_CLIENT {
+		if len(seedKeyDerivations) > 1 {
+			return nil, common.ContextError(errors.New("too many seed key derivations"))
+		}
+		seedKeyDerivation := SEED_KEY_DERIVATION_DEFAULT
+		if len(seedKeyDerivations) == 1 {
+			seedKeyDerivation = seedKeyDerivations[0]
+		}
 		obfuscator, err = NewClientObfuscator(
 			&ObfuscatorConfig{
-				Keyword:    obfuscationKeyword,
-				MinPadding: minPadding,
-				MaxPadding: maxPadding,
+				Keyword:           obfuscationKeyword,
+				MinPadding:        minPadding,
+				MaxPadding:        maxPadding,
+				SeedKeyDerivation: seedKeyDerivation,
 			})
 		if err != nil {
 			return nil, common.ContextError(err)
@@ -133,7 +150,12 @@ func NewObfuscatedSshConn(
 	} else {
 		// NewServerObfuscator reads a seed message from conn
 		obfuscator, err = NewServerObfuscator(
-			conn, &ObfuscatorConfig{Keyword: obfuscationKeyword})
+			conn,
+			&ObfuscatorConfig{
+				Keyword:            obfuscationKeyword,
+				MinPadding:         minPadding,
+				SeedKeyDerivations: seedKeyDerivations,
+			})
 		if err != nil {
 			// TODO: readForver() equivalent
 			return nil, common.ContextError(err)
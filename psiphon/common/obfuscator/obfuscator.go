@@ -22,7 +22,6 @@ package obfuscator
 import (
 	"bytes"
 	"crypto/rc4"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -50,9 +49,27 @@ type Obfuscator struct {
 }
 
 type ObfuscatorConfig struct {
-	Keyword    string
+	Keyword string
+
+	// MinPadding and MaxPadding specify the range of the random padding
+	// length of the client seed message. In NewServerObfuscator,
+	// MinPadding, when set, is the minimum padding length accepted;
+	// seed messages with less padding are rejected as probes, as with an
+	// invalid magic value, and MaxPadding is ignored.
 	MinPadding *int
 	MaxPadding *int
+
+	// SeedKeyDerivation is the name of the SeedKeyDerivation used by the
+	// client. The default, SEED_KEY_DERIVATION_DEFAULT, is the original
+	// obfuscated OpenSSH derivation.
+	SeedKeyDerivation string
+
+	// SeedKeyDerivations are the names of the SeedKeyDerivations accepted
+	// by the server. As the seed message doesn't indicate which derivation
+	// the client used, the server tries each derivation until the seed
+	// message magic value is successfully deobfuscated. When empty, only
+	// SEED_KEY_DERIVATION_DEFAULT is accepted.
+	SeedKeyDerivations []string
 }
 
 // NewClientObfuscator creates a new Obfuscator, staging a seed message to be
@@ -63,12 +80,18 @@ type ObfuscatorConfig struct {
 func NewClientObfuscator(
 	config *ObfuscatorConfig) (obfuscator *Obfuscator, err error) {
 
+	derivation, err := getSeedKeyDerivation(config.SeedKeyDerivation)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
 	seed, err := common.MakeSecureRandomBytes(OBFUSCATE_SEED_LENGTH)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
 
-	clientToServerCipher, serverToClientCipher, err := initObfuscatorCiphers(seed, config)
+	clientToServerCipher, serverToClientCipher, err := initObfuscatorCiphers(
+		seed, config, derivation)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -134,18 +157,27 @@ func (obfuscator *Obfuscator) ObfuscateServerToClient(buffer []byte) {
 }
 
 func initObfuscatorCiphers(
-	seed []byte, config *ObfuscatorConfig) (*rc4.Cipher, *rc4.Cipher, error) {
+	seed []byte,
+	config *ObfuscatorConfig,
+	derivation SeedKeyDerivation) (*rc4.Cipher, *rc4.Cipher, error) {
 
-	clientToServerKey, err := deriveKey(seed, []byte(config.Keyword), []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
+	clientToServerKey, err := derivation.DeriveKey(
+		seed, []byte(config.Keyword), []byte(OBFUSCATE_CLIENT_TO_SERVER_IV))
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
 
-	serverToClientKey, err := deriveKey(seed, []byte(config.Keyword), []byte(OBFUSCATE_SERVER_TO_CLIENT_IV))
+	serverToClientKey, err := derivation.DeriveKey(
+		seed, []byte(config.Keyword), []byte(OBFUSCATE_SERVER_TO_CLIENT_IV))
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
 
+	if len(clientToServerKey) != OBFUSCATE_KEY_LENGTH ||
+		len(serverToClientKey) != OBFUSCATE_KEY_LENGTH {
+		return nil, nil, common.ContextError(errors.New("invalid obfuscation key length"))
+	}
+
 	clientToServerCipher, err := rc4.NewCipher(clientToServerKey)
 	if err != nil {
 		return nil, nil, common.ContextError(err)
@@ -159,23 +191,6 @@ func initObfuscatorCiphers(
 	return clientToServerCipher, serverToClientCipher, nil
 }
 
-func deriveKey(seed, keyword, iv []byte) ([]byte, error) {
-	h := sha1.New()
-	h.Write(seed)
-	h.Write(keyword)
-	h.Write(iv)
-	digest := h.Sum(nil)
-	for i := 0; i < OBFUSCATE_HASH_ITERATIONS; i++ {
-		h.Reset()
-		h.Write(digest)
-		digest = h.Sum(nil)
-	}
-	if len(digest) < OBFUSCATE_KEY_LENGTH {
-		return nil, common.ContextError(errors.New("insufficient bytes for obfuscation key"))
-	}
-	return digest[0:OBFUSCATE_KEY_LENGTH], nil
-}
-
 func makeSeedMessage(minPadding, maxPadding int, seed []byte, clientToServerCipher *rc4.Cipher) ([]byte, error) {
 	padding, err := common.MakeSecureRandomPadding(minPadding, maxPadding)
 	if err != nil {
@@ -206,45 +221,81 @@ func makeSeedMessage(minPadding, maxPadding int, seed []byte, clientToServerCiph
 func readSeedMessage(
 	clientReader io.Reader, config *ObfuscatorConfig) (*rc4.Cipher, *rc4.Cipher, error) {
 
+	names := config.SeedKeyDerivations
+	if len(names) == 0 {
+		names = []string{SEED_KEY_DERIVATION_DEFAULT}
+	}
+
+	derivations := make([]SeedKeyDerivation, len(names))
+	for i, name := range names {
+		derivation, err := getSeedKeyDerivation(name)
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+		derivations[i] = derivation
+	}
+
 	seed := make([]byte, OBFUSCATE_SEED_LENGTH)
 	_, err := io.ReadFull(clientReader, seed)
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
 
-	clientToServerCipher, serverToClientCipher, err := initObfuscatorCiphers(seed, config)
+	obfuscatedFixedLengthFields := make([]byte, 8) // 4 bytes each for magic value and padding length
+	_, err = io.ReadFull(clientReader, obfuscatedFixedLengthFields)
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
 
-	fixedLengthFields := make([]byte, 8) // 4 bytes each for magic value and padding length
-	_, err = io.ReadFull(clientReader, fixedLengthFields)
-	if err != nil {
-		return nil, nil, common.ContextError(err)
-	}
+	// Try each accepted derivation in turn. All derivations are subject to
+	// the same magic value check, so accepting additional derivations
+	// doesn't change how the server responds to probes.
 
-	clientToServerCipher.XORKeyStream(fixedLengthFields, fixedLengthFields)
+	var clientToServerCipher, serverToClientCipher *rc4.Cipher
+	var paddingLength int32
 
-	buffer := bytes.NewReader(fixedLengthFields)
+	for _, derivation := range derivations {
 
-	var magicValue, paddingLength int32
-	err = binary.Read(buffer, binary.BigEndian, &magicValue)
-	if err != nil {
-		return nil, nil, common.ContextError(err)
+		clientToServerCipher, serverToClientCipher, err = initObfuscatorCiphers(
+			seed, config, derivation)
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+
+		fixedLengthFields := make([]byte, len(obfuscatedFixedLengthFields))
+		clientToServerCipher.XORKeyStream(fixedLengthFields, obfuscatedFixedLengthFields)
+
+		buffer := bytes.NewReader(fixedLengthFields)
+
+		var magicValue int32
+		err = binary.Read(buffer, binary.BigEndian, &magicValue)
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+		err = binary.Read(buffer, binary.BigEndian, &paddingLength)
+		if err != nil {
+			return nil, nil, common.ContextError(err)
+		}
+
+		if magicValue == OBFUSCATE_MAGIC_VALUE {
+			err = nil
+			break
+		}
+
+		err = errors.New("invalid magic value")
 	}
-	err = binary.Read(buffer, binary.BigEndian, &paddingLength)
 	if err != nil {
 		return nil, nil, common.ContextError(err)
 	}
 
-	if magicValue != OBFUSCATE_MAGIC_VALUE {
-		return nil, nil, common.ContextError(errors.New("invalid magic value"))
-	}
-
 	if paddingLength < 0 || paddingLength > OBFUSCATE_MAX_PADDING {
 		return nil, nil, common.ContextError(errors.New("invalid padding length"))
 	}
 
+	if config.MinPadding != nil && int(paddingLength) < *config.MinPadding {
+		return nil, nil, common.ContextError(errors.New("insufficient padding length"))
+	}
+
 	padding := make([]byte, paddingLength)
 	_, err = io.ReadFull(clientReader, padding)
 	if err != nil {
@@ -23,7 +23,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -76,6 +79,139 @@ func TestObfuscator(t *testing.T) {
 	}
 }
 
+func TestObfuscatorMinPadding(t *testing.T) {
+
+	keyword, _ := common.MakeSecureRandomStringHex(32)
+
+	serverMinPadding := 100
+
+	for _, testCase := range []struct {
+		clientMinPadding int
+		clientMaxPadding int
+		expectSuccess    bool
+	}{
+		{0, 0, false},
+		{0, 99, false},
+		{100, 100, true},
+		{100, 256, true},
+	} {
+
+		client, err := NewClientObfuscator(
+			&ObfuscatorConfig{
+				Keyword:    keyword,
+				MinPadding: &testCase.clientMinPadding,
+				MaxPadding: &testCase.clientMaxPadding,
+			})
+		if err != nil {
+			t.Fatalf("NewClientObfuscator failed: %s", err)
+		}
+
+		_, err = NewServerObfuscator(
+			bytes.NewReader(client.SendSeedMessage()),
+			&ObfuscatorConfig{
+				Keyword:    keyword,
+				MinPadding: &serverMinPadding,
+			})
+		if testCase.expectSuccess != (err == nil) {
+			t.Fatalf("unexpected result for %+v: %v", testCase, err)
+		}
+	}
+}
+
+func TestSeedKeyDerivation(t *testing.T) {
+
+	keyword, _ := common.MakeSecureRandomStringHex(32)
+
+	testDerivationName := "TEST-SHA256"
+
+	err := RegisterSeedKeyDerivation(
+		testDerivationName,
+		SeedKeyDerivationFunc(func(seed, keyword, iv []byte) ([]byte, error) {
+			h := sha256.New()
+			h.Write(seed)
+			h.Write(keyword)
+			h.Write(iv)
+			return h.Sum(nil)[:OBFUSCATE_KEY_LENGTH], nil
+		}))
+	if err != nil {
+		t.Fatalf("RegisterSeedKeyDerivation failed: %s", err)
+	}
+
+	err = RegisterSeedKeyDerivation(SEED_KEY_DERIVATION_SHA1, SeedKeyDerivationFunc(deriveKey))
+	if err == nil {
+		t.Fatalf("unexpected RegisterSeedKeyDerivation success")
+	}
+
+	if !IsSeedKeyDerivationRegistered(testDerivationName) ||
+		!IsSeedKeyDerivationRegistered(SEED_KEY_DERIVATION_DEFAULT) ||
+		IsSeedKeyDerivationRegistered("UNKNOWN") {
+		t.Fatalf("unexpected IsSeedKeyDerivationRegistered result")
+	}
+
+	testCases := []struct {
+		description              string
+		clientDerivation         string
+		serverDerivations        []string
+		expectHandshakeSucceeded bool
+	}{
+		{"default", SEED_KEY_DERIVATION_DEFAULT, nil, true},
+		{"explicit default", SEED_KEY_DERIVATION_SHA1, nil, true},
+		{"custom", testDerivationName, []string{testDerivationName}, true},
+		{"custom and default", testDerivationName, []string{"", testDerivationName}, true},
+		{"default and custom", "", []string{"", testDerivationName}, true},
+		{"custom not accepted", testDerivationName, nil, false},
+		{"default not accepted", "", []string{testDerivationName}, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			client, err := NewClientObfuscator(
+				&ObfuscatorConfig{
+					Keyword:           keyword,
+					SeedKeyDerivation: testCase.clientDerivation,
+				})
+			if err != nil {
+				t.Fatalf("NewClientObfuscator failed: %s", err)
+			}
+
+			server, err := NewServerObfuscator(
+				bytes.NewReader(client.SendSeedMessage()),
+				&ObfuscatorConfig{
+					Keyword:            keyword,
+					SeedKeyDerivations: testCase.serverDerivations,
+				})
+
+			if !testCase.expectHandshakeSucceeded {
+				if err == nil {
+					t.Fatalf("unexpected NewServerObfuscator success")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("NewServerObfuscator failed: %s", err)
+			}
+
+			clientMessage := []byte("client hello")
+
+			b := append([]byte(nil), clientMessage...)
+			client.ObfuscateClientToServer(b)
+			server.ObfuscateClientToServer(b)
+
+			if !bytes.Equal(clientMessage, b) {
+				t.Fatalf("unexpected client message")
+			}
+		})
+	}
+
+	_, err = NewClientObfuscator(
+		&ObfuscatorConfig{Keyword: keyword, SeedKeyDerivation: "UNKNOWN"})
+	if err == nil {
+		t.Fatalf("unexpected NewClientObfuscator success")
+	}
+}
+
 func TestObfuscatedSSHConn(t *testing.T) {
 
 	keyword, _ := common.MakeSecureRandomStringHex(32)
@@ -114,7 +250,7 @@ func TestObfuscatedSSHConn(t *testing.T) {
 
 		if err == nil {
 			conn, err = NewObfuscatedSshConn(
-				OBFUSCATION_CONN_MODE_SERVER, conn, keyword, nil, nil)
+				OBFUSCATION_CONN_MODE_SERVER, conn, keyword, nil, nil, nil)
 		}
 
 		if err == nil {
@@ -140,7 +276,7 @@ func TestObfuscatedSSHConn(t *testing.T) {
 
 		if err == nil {
 			conn, err = NewObfuscatedSshConn(
-				OBFUSCATION_CONN_MODE_CLIENT, conn, keyword, nil, nil)
+				OBFUSCATION_CONN_MODE_CLIENT, conn, keyword, nil, nil, nil)
 		}
 
 		if err == nil {
@@ -162,3 +298,177 @@ func TestObfuscatedSSHConn(t *testing.T) {
 		t.Fatalf("obfuscated SSH handshake failed: %s", err)
 	}
 }
+
+func TestDecoyFirstFlight(t *testing.T) {
+
+	keyword, _ := common.MakeSecureRandomStringHex(32)
+
+	history := NewDecoyHistory()
+
+	message := []byte("client message")
+
+	type serverResult struct {
+		isDecoy bool
+		read    []byte
+	}
+
+	// runServer runs NewDecoyServerConn for a single client conn and returns
+	// whether a decoy was received or else the first readLength bytes read
+	// from the resulting conn. As a TLS server does after sending a fatal
+	// alert, the server closes the conn after a decoy.
+	runServer := func(serverConn net.Conn, readLength int) chan serverResult {
+		result := make(chan serverResult, 1)
+		go func() {
+			conn, isDecoy, err := NewDecoyServerConn(serverConn, keyword, history)
+			if err != nil {
+				result <- serverResult{}
+				return
+			}
+			if isDecoy {
+				serverConn.Close()
+				result <- serverResult{isDecoy: true}
+				return
+			}
+			b := make([]byte, readLength)
+			_, err = io.ReadFull(conn, b)
+			if err != nil {
+				result <- serverResult{}
+				return
+			}
+			result <- serverResult{read: b}
+		}()
+		return result
+	}
+
+	// A valid decoy is acknowledged, and the decoy conn is then abandoned by
+	// both the client and the server.
+
+	clientConn, serverConn := net.Pipe()
+	result := runServer(serverConn, len(message))
+
+	err := SendDecoyFirstFlight(clientConn, keyword, "example.com")
+	if err != nil {
+		t.Fatalf("SendDecoyFirstFlight failed: %s", err)
+	}
+
+	if !(<-result).isDecoy {
+		t.Fatalf("missing decoy")
+	}
+
+	_, err = clientConn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("unexpected decoy conn read result: %v", err)
+	}
+
+	clientConn.Close()
+
+	// Without an acknowledgement, as when some other server responds with a
+	// different alert or closes the conn, SendDecoyFirstFlight fails.
+
+	for _, response := range [][]byte{
+		{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x46},
+		nil,
+	} {
+		clientConn, serverConn = net.Pipe()
+		go func(serverConn net.Conn, response []byte) {
+			header := make([]byte, 5)
+			io.ReadFull(serverConn, header)
+			io.ReadFull(serverConn, make([]byte, binary.BigEndian.Uint16(header[3:5])))
+			serverConn.Write(response)
+			serverConn.Close()
+		}(serverConn, response)
+
+		err = SendDecoyFirstFlight(clientConn, keyword, "example.com")
+		if err == nil {
+			t.Fatalf("unexpected SendDecoyFirstFlight success")
+		}
+
+		clientConn.Close()
+	}
+
+	// A replayed, or invalid, decoy is not acknowledged and is replayed as
+	// the start of the seed message.
+
+	clientHello, err := MakeDecoyClientHello(keyword, "example.com")
+	if err != nil {
+		t.Fatalf("MakeDecoyClientHello failed: %s", err)
+	}
+
+	invalidClientHello, err := MakeDecoyClientHello("invalid-keyword", "example.com")
+	if err != nil {
+		t.Fatalf("MakeDecoyClientHello failed: %s", err)
+	}
+
+	maxPadding := 0
+	seedObfuscator, err := NewClientObfuscator(
+		&ObfuscatorConfig{Keyword: keyword, MaxPadding: &maxPadding})
+	if err != nil {
+		t.Fatalf("NewClientObfuscator failed: %s", err)
+	}
+
+	testCases := []struct {
+		description    string
+		firstFlight    []byte
+		expectResponse bool
+	}{
+		{"valid decoy", clientHello, true},
+		{"replayed decoy", clientHello, false},
+		{"invalid decoy", invalidClientHello, false},
+		{"seed message", seedObfuscator.SendSeedMessage(), false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			result := runServer(serverConn, len(testCase.firstFlight)+len(message))
+
+			_, err := clientConn.Write(testCase.firstFlight)
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+
+			if testCase.expectResponse {
+				response := make([]byte, len(decoyAlert))
+				_, err := io.ReadFull(clientConn, response)
+				if err != nil || !bytes.Equal(response, decoyAlert) {
+					t.Fatalf("unexpected response")
+				}
+				if !(<-result).isDecoy {
+					t.Fatalf("missing decoy")
+				}
+				return
+			}
+
+			_, err = clientConn.Write(message)
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+
+			expected := append(append([]byte(nil), testCase.firstFlight...), message...)
+
+			r := <-result
+			if r.isDecoy || !bytes.Equal(r.read, expected) {
+				t.Fatalf("unexpected server bytes")
+			}
+		})
+	}
+
+	// Signals outside of the clock skew window are rejected.
+
+	signal, err := makeDecoySignal(keyword, time.Now().Add(-2*DECOY_MAX_CLOCK_SKEW))
+	if err != nil {
+		t.Fatalf("makeDecoySignal failed: %s", err)
+	}
+
+	if _, ok := checkDecoySignal(keyword, signal, time.Now()); ok {
+		t.Fatalf("unexpected valid signal")
+	}
+
+	if _, ok := checkDecoySignal(keyword, signal, time.Now().Add(-2*DECOY_MAX_CLOCK_SKEW)); !ok {
+		t.Fatalf("unexpected invalid signal")
+	}
+}
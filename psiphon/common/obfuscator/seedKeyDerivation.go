@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package obfuscator
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	SEED_KEY_DERIVATION_DEFAULT = ""
+	SEED_KEY_DERIVATION_SHA1    = "SHA1"
+)
+
+// SeedKeyDerivation derives an obfuscation stream cipher key from the seed
+// message seed, the obfuscation keyword, and the stream direction IV. The
+// derived key must be OBFUSCATE_KEY_LENGTH bytes.
+//
+// Alternate derivations are intended for experimentation with the
+// obfuscation handshake. The seed message format, including the seed
+// length, is unchanged, so a server may accept several derivations at once;
+// see ObfuscatorConfig.SeedKeyDerivations.
+type SeedKeyDerivation interface {
+	DeriveKey(seed, keyword, iv []byte) ([]byte, error)
+}
+
+// SeedKeyDerivationFunc is an adapter that allows a function to be used as
+// a SeedKeyDerivation.
+type SeedKeyDerivationFunc func(seed, keyword, iv []byte) ([]byte, error)
+
+// DeriveKey implements the SeedKeyDerivation interface.
+func (f SeedKeyDerivationFunc) DeriveKey(seed, keyword, iv []byte) ([]byte, error) {
+	return f(seed, keyword, iv)
+}
+
+var seedKeyDerivationsMutex sync.Mutex
+var seedKeyDerivations = map[string]SeedKeyDerivation{
+	SEED_KEY_DERIVATION_SHA1: SeedKeyDerivationFunc(deriveKey),
+}
+
+// RegisterSeedKeyDerivation adds a named SeedKeyDerivation, which may then
+// be selected with the ObfuscatedSSHSeedKeyDerivation tactics parameter and
+// accepted with the server ObfuscatedSSHSeedKeyDerivations config. The
+// built-in derivations cannot be replaced.
+//
+// Derivations should be registered, on both client and server, before
+// tactics or config are loaded.
+func RegisterSeedKeyDerivation(name string, derivation SeedKeyDerivation) error {
+
+	if name == SEED_KEY_DERIVATION_DEFAULT || name == SEED_KEY_DERIVATION_SHA1 {
+		return common.ContextError(errors.New("invalid seed key derivation name"))
+	}
+
+	if derivation == nil {
+		return common.ContextError(errors.New("missing seed key derivation"))
+	}
+
+	seedKeyDerivationsMutex.Lock()
+	defer seedKeyDerivationsMutex.Unlock()
+
+	seedKeyDerivations[name] = derivation
+
+	return nil
+}
+
+// IsSeedKeyDerivationRegistered indicates whether name is
+// SEED_KEY_DERIVATION_DEFAULT or a registered SeedKeyDerivation.
+func IsSeedKeyDerivationRegistered(name string) bool {
+	_, err := getSeedKeyDerivation(name)
+	return err == nil
+}
+
+func getSeedKeyDerivation(name string) (SeedKeyDerivation, error) {
+
+	if name == SEED_KEY_DERIVATION_DEFAULT {
+		name = SEED_KEY_DERIVATION_SHA1
+	}
+
+	seedKeyDerivationsMutex.Lock()
+	derivation, ok := seedKeyDerivations[name]
+	seedKeyDerivationsMutex.Unlock()
+
+	if !ok {
+		return nil, common.ContextError(
+			fmt.Errorf("unknown seed key derivation: %s", name))
+	}
+
+	return derivation, nil
+}
+
+// deriveKey is the original obfuscated OpenSSH key derivation, which is
+// SEED_KEY_DERIVATION_SHA1 and the default.
+func deriveKey(seed, keyword, iv []byte) ([]byte, error) {
+	h := sha1.New()
+	h.Write(seed)
+	h.Write(keyword)
+	h.Write(iv)
+	digest := h.Sum(nil)
+	for i := 0; i < OBFUSCATE_HASH_ITERATIONS; i++ {
+		h.Reset()
+		h.Write(digest)
+		digest = h.Sum(nil)
+	}
+	if len(digest) < OBFUSCATE_KEY_LENGTH {
+		return nil, common.ContextError(errors.New("insufficient bytes for obfuscation key"))
+	}
+	return digest[0:OBFUSCATE_KEY_LENGTH], nil
+}
@@ -71,16 +71,44 @@ const (
 	TacticsRetryPeriod                         = "TacticsRetryPeriod"
 	TacticsRetryPeriodJitter                   = "TacticsRetryPeriodJitter"
 	TacticsTimeout                             = "TacticsTimeout"
+	SignedTacticsURLs                          = "SignedTacticsURLs"
+	SignedTacticsSignaturePublicKey            = "SignedTacticsSignaturePublicKey"
+	FetchSignedTacticsTimeout                  = "FetchSignedTacticsTimeout"
+	AcceptPushedTactics                        = "AcceptPushedTactics"
 	ConnectionWorkerPoolSize                   = "ConnectionWorkerPoolSize"
+	MaxConcurrentConnectionAttempts            = "MaxConcurrentConnectionAttempts"
 	TunnelConnectTimeout                       = "TunnelConnectTimeout"
+	BootstrapConnectionWorkerPoolSize          = "BootstrapConnectionWorkerPoolSize"
+	BootstrapTunnelConnectTimeout              = "BootstrapTunnelConnectTimeout"
+	TunnelTCPConnectTimeout                    = "TunnelTCPConnectTimeout"
+	TunnelTLSHandshakeTimeout                  = "TunnelTLSHandshakeTimeout"
+	TunnelSSHHandshakeTimeout                  = "TunnelSSHHandshakeTimeout"
+	TunnelHandshakeAPITimeout                  = "TunnelHandshakeAPITimeout"
+	TunnelHandshakeAPIRetryCount               = "TunnelHandshakeAPIRetryCount"
+	TunnelRerandomizePeriod                    = "TunnelRerandomizePeriod"
+	TunnelRerandomizePeriodJitter              = "TunnelRerandomizePeriodJitter"
+	TunnelRerandomizeTLSProfile                = "TunnelRerandomizeTLSProfile"
+	TunnelHandshakeAPIRetryMinDelay            = "TunnelHandshakeAPIRetryMinDelay"
+	TunnelHandshakeAPIRetryMaxDelay            = "TunnelHandshakeAPIRetryMaxDelay"
+	TunnelHandshakeAPIRetryMultiplier          = "TunnelHandshakeAPIRetryMultiplier"
+	SlowTunnelDialThreshold                    = "SlowTunnelDialThreshold"
+	SlowSSHHandshakeThreshold                  = "SlowSSHHandshakeThreshold"
+	SlowHandshakeAPIThreshold                  = "SlowHandshakeAPIThreshold"
+	SlowDatastoreScanThreshold                 = "SlowDatastoreScanThreshold"
+	BandwidthTestUpstreamBytes                 = "BandwidthTestUpstreamBytes"
+	BandwidthTestDownstreamBytes               = "BandwidthTestDownstreamBytes"
+	BandwidthTestTimeout                       = "BandwidthTestTimeout"
 	EstablishTunnelTimeout                     = "EstablishTunnelTimeout"
 	EstablishTunnelWorkTime                    = "EstablishTunnelWorkTime"
 	EstablishTunnelPausePeriod                 = "EstablishTunnelPausePeriod"
 	EstablishTunnelPausePeriodJitter           = "EstablishTunnelPausePeriodJitter"
 	EstablishTunnelServerAffinityGracePeriod   = "EstablishTunnelServerAffinityGracePeriod"
+	NetworkChangeHandoffTimeout                = "NetworkChangeHandoffTimeout"
 	StaggerConnectionWorkersPeriod             = "StaggerConnectionWorkersPeriod"
 	StaggerConnectionWorkersJitter             = "StaggerConnectionWorkersJitter"
 	LimitIntensiveConnectionWorkers            = "LimitIntensiveConnectionWorkers"
+	ServerLoadHighSkipProbability              = "ServerLoadHighSkipProbability"
+	ServerLoadSignalTTL                        = "ServerLoadSignalTTL"
 	IgnoreHandshakeStatsRegexps                = "IgnoreHandshakeStatsRegexps"
 	PrioritizeTunnelProtocolsProbability       = "PrioritizeTunnelProtocolsProbability"
 	PrioritizeTunnelProtocols                  = "PrioritizeTunnelProtocols"
@@ -88,12 +116,38 @@ const (
 	InitialLimitTunnelProtocolsProbability     = "InitialLimitTunnelProtocolsProbability"
 	InitialLimitTunnelProtocols                = "InitialLimitTunnelProtocols"
 	InitialLimitTunnelProtocolsCandidateCount  = "InitialLimitTunnelProtocolsCandidateCount"
+	RegionHintInitialLimitTunnelProtocols      = "RegionHintInitialLimitTunnelProtocols"
+	RegionHintInitialLimitCandidateCount       = "RegionHintInitialLimitCandidateCount"
 	LimitTunnelProtocolsProbability            = "LimitTunnelProtocolsProbability"
 	LimitTunnelProtocols                       = "LimitTunnelProtocols"
+	PreferredTunnelProtocols                   = "PreferredTunnelProtocols"
+	PreferredTunnelProtocolsBias               = "PreferredTunnelProtocolsBias"
+	ProtocolFailureThreshold                   = "ProtocolFailureThreshold"
+	ProtocolFailureWindow                      = "ProtocolFailureWindow"
+	ProtocolDisablePeriod                      = "ProtocolDisablePeriod"
+	ProtocolReenablePeriod                     = "ProtocolReenablePeriod"
+	SuspectedBlockingFailureThreshold          = "SuspectedBlockingFailureThreshold"
+	SuspectedBlockingMinProtocols              = "SuspectedBlockingMinProtocols"
+	SuspectedBlockingMaxFailureDuration        = "SuspectedBlockingMaxFailureDuration"
+	SuspectedBlockingWindow                    = "SuspectedBlockingWindow"
+	SuspectedBlockingPausePeriod               = "SuspectedBlockingPausePeriod"
+	SuspectedBlockingMaxPausePeriod            = "SuspectedBlockingMaxPausePeriod"
+	ServerScoreSmoothingFactor                 = "ServerScoreSmoothingFactor"
+	ServerScoreDecayHalfLife                   = "ServerScoreDecayHalfLife"
+	ServerScoreTargetLatency                   = "ServerScoreTargetLatency"
+	ServerScoreExplorationWeight               = "ServerScoreExplorationWeight"
+	EstablishmentTelemetrySuccessSampleRate    = "EstablishmentTelemetrySuccessSampleRate"
+	EstablishmentTelemetryFailureSampleRate    = "EstablishmentTelemetryFailureSampleRate"
+	EstablishmentTelemetryFailureMaxCount      = "EstablishmentTelemetryFailureMaxCount"
 	LimitTLSProfilesProbability                = "LimitTLSProfilesProbability"
 	LimitTLSProfiles                           = "LimitTLSProfiles"
+	TLSProfileKeyShareGroups                   = "TLSProfileKeyShareGroups"
 	LimitQUICVersionsProbability               = "LimitQUICVersionsProbability"
 	LimitQUICVersions                          = "LimitQUICVersions"
+	QUICPacingRate                             = "QUICPacingRate"
+	QUICPacingBurstBytes                       = "QUICPacingBurstBytes"
+	ServerQUICPacingRate                       = "ServerQUICPacingRate"
+	ServerQUICPacingBurstBytes                 = "ServerQUICPacingBurstBytes"
 	FragmentorProbability                      = "FragmentorProbability"
 	FragmentorLimitProtocols                   = "FragmentorLimitProtocols"
 	FragmentorMinTotalBytes                    = "FragmentorMinTotalBytes"
@@ -110,11 +164,28 @@ const (
 	FragmentorDownstreamMaxWriteBytes          = "FragmentorDownstreamMaxWriteBytes"
 	FragmentorDownstreamMinDelay               = "FragmentorDownstreamMinDelay"
 	FragmentorDownstreamMaxDelay               = "FragmentorDownstreamMaxDelay"
+	TCPFastOpenProbability                     = "TCPFastOpenProbability"
+	TCPFastOpenLimitProtocols                  = "TCPFastOpenLimitProtocols"
 	ObfuscatedSSHMinPadding                    = "ObfuscatedSSHMinPadding"
 	ObfuscatedSSHMaxPadding                    = "ObfuscatedSSHMaxPadding"
+	OSSHDecoyFirstFlightProbability            = "OSSHDecoyFirstFlightProbability"
+	OSSHDecoyFirstFlightServerNames            = "OSSHDecoyFirstFlightServerNames"
+	ObfuscatedSSHSeedKeyDerivation             = "ObfuscatedSSHSeedKeyDerivation"
 	TunnelOperateShutdownTimeout               = "TunnelOperateShutdownTimeout"
 	TunnelPortForwardDialTimeout               = "TunnelPortForwardDialTimeout"
 	TunnelRateLimits                           = "TunnelRateLimits"
+	TunnelDSCP                                 = "TunnelDSCP"
+	TunnelSourcePortMin                        = "TunnelSourcePortMin"
+	TunnelSourcePortMax                        = "TunnelSourcePortMax"
+	TunnelSourcePortPolicy                     = "TunnelSourcePortPolicy"
+	TunnelSourcePortWindow                     = "TunnelSourcePortWindow"
+	TunnelWriteCoalescingWindow                = "TunnelWriteCoalescingWindow"
+	TunnelWriteCoalescingMaxBytes              = "TunnelWriteCoalescingMaxBytes"
+	PreferredIPAddressFamily                   = "PreferredIPAddressFamily"
+	IPAddressFamilyLearning                    = "IPAddressFamilyLearning"
+	IPAddressFamilyFallbackDelay               = "IPAddressFamilyFallbackDelay"
+	IPAddressFamilyResetRetries                = "IPAddressFamilyResetRetries"
+	PortForwardCompression                     = "PortForwardCompression"
 	AdditionalCustomHeaders                    = "AdditionalCustomHeaders"
 	SpeedTestPaddingMinBytes                   = "SpeedTestPaddingMinBytes"
 	SpeedTestPaddingMaxBytes                   = "SpeedTestPaddingMaxBytes"
@@ -128,6 +199,18 @@ const (
 	SSHKeepAlivePeriodicInactivePeriod         = "SSHKeepAlivePeriodicInactivePeriod"
 	SSHKeepAliveProbeTimeout                   = "SSHKeepAliveProbeTimeout"
 	SSHKeepAliveProbeInactivePeriod            = "SSHKeepAliveProbeInactivePeriod"
+	TunnelQoEScoreUpdatePeriod                 = "TunnelQoEScoreUpdatePeriod"
+	TunnelQoEScoreRTTWeight                    = "TunnelQoEScoreRTTWeight"
+	TunnelQoEScoreLossWeight                   = "TunnelQoEScoreLossWeight"
+	TunnelQoEScoreThroughputWeight             = "TunnelQoEScoreThroughputWeight"
+	TunnelAffinityTTL                          = "TunnelAffinityTTL"
+	TunnelPoolGrowFailureCount                 = "TunnelPoolGrowFailureCount"
+	ServerAffinityMaxAge                       = "ServerAffinityMaxAge"
+	TunnelPoolGrowFailurePeriod                = "TunnelPoolGrowFailurePeriod"
+	TunnelPoolShrinkStablePeriod               = "TunnelPoolShrinkStablePeriod"
+	TunnelAffinityMaxEntries                   = "TunnelAffinityMaxEntries"
+	DiagnosticBundleFailureThreshold           = "DiagnosticBundleFailureThreshold"
+	DiagnosticBundleMaxAttempts                = "DiagnosticBundleMaxAttempts"
 	HTTPProxyOriginServerTimeout               = "HTTPProxyOriginServerTimeout"
 	HTTPProxyMaxIdleConnectionsPerHost         = "HTTPProxyMaxIdleConnectionsPerHost"
 	FetchRemoteServerListTimeout               = "FetchRemoteServerListTimeout"
@@ -135,14 +218,21 @@ const (
 	FetchRemoteServerListStalePeriod           = "FetchRemoteServerListStalePeriod"
 	RemoteServerListSignaturePublicKey         = "RemoteServerListSignaturePublicKey"
 	RemoteServerListURLs                       = "RemoteServerListURLs"
+	RemoteServerListDecodeWorkers              = "RemoteServerListDecodeWorkers"
 	ObfuscatedServerListRootURLs               = "ObfuscatedServerListRootURLs"
+	ServerEntryRevocationListURLs              = "ServerEntryRevocationListURLs"
+	ServerEntryMaxStoredCount                  = "ServerEntryMaxStoredCount"
+	ServerEntryMaxStoredCountPerSource         = "ServerEntryMaxStoredCountPerSource"
+	ServerEntryMaxMeekFrontingAddresses        = "ServerEntryMaxMeekFrontingAddresses"
 	PsiphonAPIRequestTimeout                   = "PsiphonAPIRequestTimeout"
 	PsiphonAPIStatusRequestPeriodMin           = "PsiphonAPIStatusRequestPeriodMin"
 	PsiphonAPIStatusRequestPeriodMax           = "PsiphonAPIStatusRequestPeriodMax"
 	PsiphonAPIStatusRequestShortPeriodMin      = "PsiphonAPIStatusRequestShortPeriodMin"
 	PsiphonAPIStatusRequestShortPeriodMax      = "PsiphonAPIStatusRequestShortPeriodMax"
+	PsiphonAPIStatusRequestPeriodJitter        = "PsiphonAPIStatusRequestPeriodJitter"
 	PsiphonAPIStatusRequestPaddingMinBytes     = "PsiphonAPIStatusRequestPaddingMinBytes"
 	PsiphonAPIStatusRequestPaddingMaxBytes     = "PsiphonAPIStatusRequestPaddingMaxBytes"
+	PsiphonAPIHandshakeRequestTargetLengths    = "PsiphonAPIHandshakeRequestTargetLengths"
 	PsiphonAPIPersistentStatsMaxCount          = "PsiphonAPIPersistentStatsMaxCount"
 	PsiphonAPIConnectedRequestPeriod           = "PsiphonAPIConnectedRequestPeriod"
 	PsiphonAPIConnectedRequestRetryPeriod      = "PsiphonAPIConnectedRequestRetryPeriod"
@@ -159,6 +249,9 @@ const (
 	MeekDialDomainsOnly                        = "MeekDialDomainsOnly"
 	MeekLimitBufferSizes                       = "MeekLimitBufferSizes"
 	MeekCookieMaxPadding                       = "MeekCookieMaxPadding"
+	MeekTLSRecordFragmentationProbability      = "MeekTLSRecordFragmentationProbability"
+	MeekTLSRecordFragmentationMinBytes         = "MeekTLSRecordFragmentationMinBytes"
+	MeekTLSRecordFragmentationMaxBytes         = "MeekTLSRecordFragmentationMaxBytes"
 	MeekFullReceiveBufferLength                = "MeekFullReceiveBufferLength"
 	MeekReadPayloadChunkLength                 = "MeekReadPayloadChunkLength"
 	MeekLimitedFullReceiveBufferLength         = "MeekLimitedFullReceiveBufferLength"
@@ -170,19 +263,82 @@ const (
 	MeekPollIntervalMultiplier                 = "MeekPollIntervalMultiplier"
 	MeekPollIntervalJitter                     = "MeekPollIntervalJitter"
 	MeekApplyPollIntervalMultiplierProbability = "MeekApplyPollIntervalMultiplierProbability"
+	MeekIdlePeriod                             = "MeekIdlePeriod"
+	MeekIdleMaxPollInterval                    = "MeekIdleMaxPollInterval"
+	MeekFrontIdleTimeout                       = "MeekFrontIdleTimeout"
+	MeekFrontingRaceCount                      = "MeekFrontingRaceCount"
+	MeekFrontingDisableSNIAddresses            = "MeekFrontingDisableSNIAddresses"
+	MeekFailoverOrder                          = "MeekFailoverOrder"
+	MeekFailoverRace                           = "MeekFailoverRace"
+	MeekFrontedConnectTimeout                  = "MeekFrontedConnectTimeout"
+	MeekUnfrontedConnectTimeout                = "MeekUnfrontedConnectTimeout"
+	MeekSessionTokenLocation                   = "MeekSessionTokenLocation"
+	MeekSessionTokenHeaderName                 = "MeekSessionTokenHeaderName"
+	MeekMaxRedirects                           = "MeekMaxRedirects"
+	MeekRedirectSameOriginOnly                 = "MeekRedirectSameOriginOnly"
+	MeekURLSignatureTTL                        = "MeekURLSignatureTTL"
+	MeekURLSignatureMaxResigns                 = "MeekURLSignatureMaxResigns"
+	MeekMaxChunkSize                           = "MeekMaxChunkSize"
+	MeekMinChunkSize                           = "MeekMinChunkSize"
 	MeekRoundTripRetryDeadline                 = "MeekRoundTripRetryDeadline"
 	MeekRoundTripRetryMinDelay                 = "MeekRoundTripRetryMinDelay"
 	MeekRoundTripRetryMaxDelay                 = "MeekRoundTripRetryMaxDelay"
 	MeekRoundTripRetryMultiplier               = "MeekRoundTripRetryMultiplier"
 	MeekRoundTripTimeout                       = "MeekRoundTripTimeout"
+	MeekServerResponseHeaderTemplate           = "MeekServerResponseHeaderTemplate"
+	MeekServerALPNProtocols                    = "MeekServerALPNProtocols"
+	MeekServerAllowedSNIServerNames            = "MeekServerAllowedSNIServerNames"
+	MeekServerUnexpectedSNIBehavior            = "MeekServerUnexpectedSNIBehavior"
+	MeekServerSessionIDRotationPeriod          = "MeekServerSessionIDRotationPeriod"
+	MeekServerSessionIDRotationPeriodJitter    = "MeekServerSessionIDRotationPeriodJitter"
+	MeekServerSessionRequestRateLimit          = "MeekServerSessionRequestRateLimit"
+	MeekServerSessionRequestBurst              = "MeekServerSessionRequestBurst"
+	MeekClientALPNProtocols                    = "MeekClientALPNProtocols"
+	MeekCoalesceConnections                    = "MeekCoalesceConnections"
+	ServerReturnEgressIPAddress                = "ServerReturnEgressIPAddress"
+	ServerMaxTCPPortForwardsPerDestination     = "ServerMaxTCPPortForwardsPerDestination"
+	ServerMaxSSHChannelsPerTunnel              = "ServerMaxSSHChannelsPerTunnel"
+	ServerMinimumClientVersions                = "ServerMinimumClientVersions"
+	ServerConnectionCloseBehaviors             = "ServerConnectionCloseBehaviors"
+	ServerConnectionLogSampleRates             = "ServerConnectionLogSampleRates"
+	ServerPortForwardDialOptions               = "ServerPortForwardDialOptions"
+	ServerPortForwardDialRetries               = "ServerPortForwardDialRetries"
+	ServerPortForwardDialRetryBackoff          = "ServerPortForwardDialRetryBackoff"
+	ServerMaxConcurrentSSHHandshakes           = "ServerMaxConcurrentSSHHandshakes"
+	ServerFirstWriteDelayProbability           = "ServerFirstWriteDelayProbability"
+	ServerFirstWriteMinDelay                   = "ServerFirstWriteMinDelay"
+	ServerFirstWriteMaxDelay                   = "ServerFirstWriteMaxDelay"
+	TLSInterceptionIndicatorThreshold          = "TLSInterceptionIndicatorThreshold"
+	TLSInterceptionExpectedIssuers             = "TLSInterceptionExpectedIssuers"
+	TLSInterceptionMinCertificateAge           = "TLSInterceptionMinCertificateAge"
+	ClockSkewTolerance                         = "ClockSkewTolerance"
+	TLSInterceptionRequireSCTs                 = "TLSInterceptionRequireSCTs"
+	TransparentProxyCanaryURL                  = "TransparentProxyCanaryURL"
+	TransparentProxyCanaryExpectedResponse     = "TransparentProxyCanaryExpectedResponse"
+	TransparentProxyCanaryTimeout              = "TransparentProxyCanaryTimeout"
+	TransparentProxyAvoidProtocols             = "TransparentProxyAvoidProtocols"
+	CaptivePortalCanaryURL                     = "CaptivePortalCanaryURL"
+	CaptivePortalCanaryExpectedStatusCode      = "CaptivePortalCanaryExpectedStatusCode"
+	CaptivePortalCanaryExpectedResponse        = "CaptivePortalCanaryExpectedResponse"
+	CaptivePortalCanaryTimeout                 = "CaptivePortalCanaryTimeout"
+	CaptivePortalRecheckPeriod                 = "CaptivePortalRecheckPeriod"
+	FrontingDNSCacheMinTTL                     = "FrontingDNSCacheMinTTL"
+	FrontingDNSCacheMaxTTL                     = "FrontingDNSCacheMaxTTL"
 	TransformHostNameProbability               = "TransformHostNameProbability"
 	PickUserAgentProbability                   = "PickUserAgentProbability"
+	MeekUserAgents                             = "MeekUserAgents"
+	SSHPreferredAlgorithms                     = "SSHPreferredAlgorithms"
 )
 
 const (
 	useNetworkLatencyMultiplier = 1
 )
 
+const (
+	MEEK_SERVER_UNEXPECTED_SNI_CLOSE = "close"
+	MEEK_SERVER_UNEXPECTED_SNI_DECOY = "decoy"
+)
+
 // defaultClientParameters specifies the type, default value, and minimum
 // value for all dynamically configurable client parameters.
 //
@@ -207,13 +363,29 @@ var defaultClientParameters = map[string]struct {
 	TacticsRetryPeriodJitter: {value: 0.3, minimum: 0.0},
 	TacticsTimeout:           {value: 2 * time.Minute, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 
+	// SignedTacticsURLs specify fronted endpoints from which a signed
+	// tactics payload, authenticated with SignedTacticsSignaturePublicKey,
+	// is fetched when a tactics request to a Psiphon server fails.
+	SignedTacticsURLs:               {value: DownloadURLs{}},
+	SignedTacticsSignaturePublicKey: {value: ""},
+	FetchSignedTacticsTimeout:       {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+
+	// AcceptPushedTactics specifies whether tactics pushed by the server of
+	// an established tunnel are applied.
+	AcceptPushedTactics: {value: true},
+
 	ConnectionWorkerPoolSize:                 {value: 10, minimum: 1},
+	// MaxConcurrentConnectionAttempts limits the number of in-flight
+	// connection attempts, including racing meek failover and IP address
+	// family fallback attempts. When 0, a platform-specific default is used.
+	MaxConcurrentConnectionAttempts:          {value: 0, minimum: 0},
 	TunnelConnectTimeout:                     {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	EstablishTunnelTimeout:                   {value: 300 * time.Second, minimum: time.Duration(0)},
 	EstablishTunnelWorkTime:                  {value: 60 * time.Second, minimum: 1 * time.Second},
 	EstablishTunnelPausePeriod:               {value: 5 * time.Second, minimum: 1 * time.Millisecond},
 	EstablishTunnelPausePeriodJitter:         {value: 0.1, minimum: 0.0},
 	EstablishTunnelServerAffinityGracePeriod: {value: 1 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	NetworkChangeHandoffTimeout:              {value: 30 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
 	StaggerConnectionWorkersPeriod:           {value: time.Duration(0), minimum: time.Duration(0)},
 	StaggerConnectionWorkersJitter:           {value: 0.1, minimum: 0.0},
 	LimitIntensiveConnectionWorkers:          {value: 0, minimum: 0},
@@ -222,6 +394,136 @@ var defaultClientParameters = map[string]struct {
 	TunnelPortForwardDialTimeout:             {value: 10 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
 	TunnelRateLimits:                         {value: common.RateLimits{}},
 
+	// BootstrapConnectionWorkerPoolSize and BootstrapTunnelConnectTimeout
+	// replace ConnectionWorkerPoolSize and TunnelConnectTimeout until the
+	// first tunnel is established. When 0, the steady-state values apply.
+	// MaxConcurrentConnectionAttempts still limits bootstrap attempts.
+	BootstrapConnectionWorkerPoolSize: {value: 0, minimum: 0},
+	BootstrapTunnelConnectTimeout:     {value: time.Duration(0), minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+
+	// TunnelTCPConnectTimeout, TunnelTLSHandshakeTimeout, and
+	// TunnelSSHHandshakeTimeout limit the individual phases of a tunnel dial,
+	// within the overall TunnelConnectTimeout, so that one slow phase doesn't
+	// consume the entire budget. The TLS handshake phase applies to meek
+	// HTTPS and fronted protocols. When 0, a phase is limited only by
+	// TunnelConnectTimeout.
+	//
+	// TunnelHandshakeAPITimeout limits the handshake API request made once
+	// the SSH connection is established. When 0, PsiphonAPIRequestTimeout
+	// applies.
+	TunnelTCPConnectTimeout:   {value: time.Duration(0), minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	TunnelTLSHandshakeTimeout: {value: time.Duration(0), minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	TunnelSSHHandshakeTimeout: {value: time.Duration(0), minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	TunnelHandshakeAPITimeout: {value: time.Duration(0), minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+
+	// TunnelRerandomizePeriod, when > 0, is the period, with
+	// TunnelRerandomizePeriodJitter applied, after which the mutable
+	// obfuscation parameters of an established tunnel are re-randomized,
+	// without interrupting the tunnel. Currently, only HTTPS meek tunnels
+	// which don't share a coalesced transport may be re-randomized: new
+	// TLS connections are dialed with new TCP fragmentation and TLS record
+	// fragmentation and, when TunnelRerandomizeTLSProfile is set, a new TLS
+	// profile. Existing TLS connections are retired once idle.
+	TunnelRerandomizePeriod:       {value: time.Duration(0), minimum: time.Duration(0)},
+	TunnelRerandomizePeriodJitter: {value: 0.3, minimum: 0.0},
+	TunnelRerandomizeTLSProfile:   {value: false},
+
+	// TunnelHandshakeAPIRetryCount is the number of times a handshake API
+	// request rejected by the server is retried over the established
+	// tunnel before the tunnel is abandoned. Retries are delayed, starting
+	// with TunnelHandshakeAPIRetryMinDelay and multiplied by
+	// TunnelHandshakeAPIRetryMultiplier, up to
+	// TunnelHandshakeAPIRetryMaxDelay, after each retry. Failures of the
+	// tunnel itself are not retried. All retries are within
+	// TunnelHandshakeAPITimeout.
+	TunnelHandshakeAPIRetryCount:      {value: 0, minimum: 0},
+	TunnelHandshakeAPIRetryMinDelay:   {value: 500 * time.Millisecond, minimum: time.Duration(0)},
+	TunnelHandshakeAPIRetryMaxDelay:   {value: 5 * time.Second, minimum: time.Duration(0)},
+	TunnelHandshakeAPIRetryMultiplier: {value: 2.0, minimum: 0.0},
+
+	// SlowTunnelDialThreshold, SlowSSHHandshakeThreshold,
+	// SlowHandshakeAPIThreshold, and SlowDatastoreScanThreshold are the
+	// durations above which the tunnel base transport dial, the SSH
+	// handshake, the handshake API request, and a datastore server entry
+	// scan, respectively, emit a SlowOperation notice. When 0, the
+	// operation is not reported.
+	SlowTunnelDialThreshold:    {value: time.Duration(0), minimum: time.Duration(0)},
+	SlowSSHHandshakeThreshold:  {value: time.Duration(0), minimum: time.Duration(0)},
+	SlowHandshakeAPIThreshold:  {value: time.Duration(0), minimum: time.Duration(0)},
+	SlowDatastoreScanThreshold: {value: time.Duration(0), minimum: time.Duration(0)},
+
+	// BandwidthTestUpstreamBytes and BandwidthTestDownstreamBytes are the
+	// amounts of data sent and received in a Controller.RunBandwidthTest
+	// test, which must be within the server's limit. BandwidthTestTimeout
+	// limits the entire test.
+	BandwidthTestUpstreamBytes:   {value: 1024 * 1024, minimum: 0},
+	BandwidthTestDownstreamBytes: {value: 4 * 1024 * 1024, minimum: 0},
+	BandwidthTestTimeout:         {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+
+	// ServerLoadHighSkipProbability is the probability that a candidate
+	// server, which reported a high load level in a handshake within the
+	// last ServerLoadSignalTTL, is skipped for the current establishment
+	// round. Skipping is probabilistic so that all clients don't avoid, and
+	// then return to, the same servers at once.
+	ServerLoadHighSkipProbability: {value: 0.5, minimum: 0.0},
+	ServerLoadSignalTTL:           {value: 1 * time.Hour, minimum: time.Duration(0)},
+
+	// TunnelDSCP is the DSCP value, 1 to 63, with which tunnel sockets mark
+	// sent packets, via IP_TOS or IPV6_TCLASS. The default, 0, leaves the
+	// socket default marking in place.
+	TunnelDSCP: {value: 0, minimum: 0},
+
+	// TunnelSourcePortMin and TunnelSourcePortMax specify a range from which
+	// tunnel TCP dials select a random local source port. The default, 0,
+	// leaves source port selection to the platform's ephemeral port range.
+	// The range is ignored unless 0 < TunnelSourcePortMin <=
+	// TunnelSourcePortMax <= 65535.
+	TunnelSourcePortMin: {value: 0, minimum: 0},
+	TunnelSourcePortMax: {value: 0, minimum: 0},
+
+	// TunnelSourcePortPolicy specifies how tunnel TCP dials select source
+	// ports across reconnections: "OSDefault", the default, leaves
+	// selection to the platform or TunnelSourcePortMin/Max; "Fresh" never
+	// reuses a source port used within TunnelSourcePortWindow, hindering
+	// correlation of reconnections; and "ReuseWithinWindow" reuses the
+	// source port of a connection to the same server made within
+	// TunnelSourcePortWindow, limiting port consumption on high-churn
+	// networks. Unrecognized values select "OSDefault".
+	TunnelSourcePortPolicy: {value: "OSDefault"},
+	TunnelSourcePortWindow: {value: 2 * time.Minute, minimum: time.Duration(0)},
+
+	// TunnelWriteCoalescingWindow is the period within which small tunnel
+	// writes are coalesced into a single write of up to
+	// TunnelWriteCoalescingMaxBytes. A write made after an idle window is
+	// sent immediately, so isolated writes such as keystrokes are not
+	// delayed. The default, 0, disables coalescing. Coalescing is not
+	// applied to meek protocols, which already batch writes.
+	TunnelWriteCoalescingWindow:   {value: time.Duration(0), minimum: time.Duration(0)},
+	TunnelWriteCoalescingMaxBytes: {value: 1400, minimum: 1},
+
+	// PreferredIPAddressFamily, when "IPv4" or "IPv6", is the IP address
+	// family dialed first when a TCP dial address resolves to both families.
+	// When "", and IPAddressFamilyLearning is set, the preferred family is
+	// learned from recent dial outcomes on the current network. The
+	// non-preferred family is dialed after IPAddressFamilyFallbackDelay, or
+	// once the preferred family fails.
+	PreferredIPAddressFamily:     {value: ""},
+	IPAddressFamilyLearning:      {value: true},
+	IPAddressFamilyFallbackDelay: {value: 250 * time.Millisecond, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+
+	// IPAddressFamilyResetRetries is the maximum number of times, per TCP
+	// dial, that a dial which fails with a connection reset or connection
+	// refused error immediately retries the other IP address family, when
+	// the dial address resolves to both families. 0 disables the retries,
+	// and the other family is dialed in the usual order.
+	IPAddressFamilyResetRetries: {value: 1, minimum: 0},
+
+	// PortForwardCompression specifies whether to compress port forward
+	// data, when supported by the server. Compression may benefit very slow
+	// links, but is off by default due to the security tradeoffs; see
+	// common.CompressedConn.
+	PortForwardCompression: {value: false},
+
 	// PrioritizeTunnelProtocols parameters are obsoleted by InitialLimitTunnelProtocols.
 	// TODO: remove once no longer required for older clients.
 	PrioritizeTunnelProtocolsProbability:    {value: 1.0, minimum: 0.0},
@@ -232,15 +534,108 @@ var defaultClientParameters = map[string]struct {
 	InitialLimitTunnelProtocols:               {value: protocol.TunnelProtocols{}},
 	InitialLimitTunnelProtocolsCandidateCount: {value: 0, minimum: 0},
 
+	// RegionHintInitialLimitTunnelProtocols specifies, per region, initial
+	// limit tunnel protocols which are used, for the first
+	// RegionHintInitialLimitCandidateCount candidates, when the client
+	// config specifies a RegionHint. The region hint is used only before
+	// any tactics are applied and when InitialLimitTunnelProtocols is not
+	// set; see Config.RegionHint.
+	RegionHintInitialLimitTunnelProtocols: {value: RegionTunnelProtocols{}},
+	RegionHintInitialLimitCandidateCount:  {value: 10, minimum: 0},
+
 	LimitTunnelProtocolsProbability: {value: 1.0, minimum: 0.0},
 	LimitTunnelProtocols:            {value: protocol.TunnelProtocols{}},
 
+	// PreferredTunnelProtocols biases tunnel protocol selection towards the
+	// listed protocols without restricting selection, as LimitTunnelProtocols
+	// does. For each candidate, with probability PreferredTunnelProtocolsBias,
+	// the protocol is selected from the preferred protocols supported by the
+	// server entry, when there are any; otherwise, the protocol is selected
+	// from all candidate protocols. The preference is applied after all
+	// limits, exclusions, and protocol health checks.
+	PreferredTunnelProtocols:     {value: protocol.TunnelProtocols{}},
+	PreferredTunnelProtocolsBias: {value: 0.8, minimum: 0.0},
+
+	// Automatic disabling of repeatedly failing tunnel protocols is off when
+	// ProtocolFailureThreshold is 0.
+
+	ProtocolFailureThreshold: {value: 0, minimum: 0},
+	ProtocolFailureWindow:    {value: 10 * time.Minute, minimum: time.Duration(0)},
+	ProtocolDisablePeriod:    {value: 30 * time.Minute, minimum: time.Duration(0)},
+	ProtocolReenablePeriod:   {value: 30 * time.Minute, minimum: time.Duration(0)},
+
+	// Suspected active blocking detection is off when
+	// SuspectedBlockingFailureThreshold is 0. Blocking is suspected when
+	// SuspectedBlockingFailureThreshold connection failures, each within
+	// SuspectedBlockingMaxFailureDuration of starting to connect and with an
+	// error indicating interference rather than network loss, across at
+	// least SuspectedBlockingMinProtocols tunnel protocols, occur within
+	// SuspectedBlockingWindow without an intervening success. The
+	// establishment round is then ended and the next round starts after
+	// SuspectedBlockingPausePeriod, instead of EstablishTunnelPausePeriod.
+	// The pause doubles on each consecutive detection, up to
+	// SuspectedBlockingMaxPausePeriod.
+
+	SuspectedBlockingFailureThreshold:   {value: 0, minimum: 0},
+	SuspectedBlockingMinProtocols:       {value: 3, minimum: 1},
+	SuspectedBlockingMaxFailureDuration: {value: 5 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	SuspectedBlockingWindow:             {value: 2 * time.Minute, minimum: time.Duration(0)},
+	SuspectedBlockingPausePeriod:        {value: 5 * time.Minute, minimum: time.Duration(0)},
+	SuspectedBlockingMaxPausePeriod:     {value: 1 * time.Hour, minimum: time.Duration(0)},
+
+	// Server selection scoring is off when ServerScoreSmoothingFactor is 0.
+	// ServerScoreSmoothingFactor is the weight, up to 1, of each new
+	// outcome in the moving averages. ServerScoreTargetLatency is the
+	// connection latency which neither raises nor lowers a server's score.
+	// Every server, including servers with low scores, receives at least
+	// ServerScoreExplorationWeight selection weight.
+
+	ServerScoreSmoothingFactor:   {value: 0.0, minimum: 0.0},
+	ServerScoreDecayHalfLife:     {value: 7 * 24 * time.Hour, minimum: time.Duration(0)},
+	ServerScoreTargetLatency:     {value: 2 * time.Second, minimum: 1 * time.Millisecond},
+	ServerScoreExplorationWeight: {value: 0.1, minimum: 0.0},
+
+	// Connection establishment telemetry, the dial parameters reported for
+	// successful and failed tunnel connections, is sampled by outcome.
+
+	EstablishmentTelemetrySuccessSampleRate: {value: 1.0, minimum: 0.0},
+	EstablishmentTelemetryFailureSampleRate: {value: 1.0, minimum: 0.0},
+
+	// EstablishmentTelemetryFailureMaxCount caps the number of stored failed
+	// tunnel stats, which are pending reporting; new failed tunnel stats over
+	// the limit are not stored. 0 is no limit.
+
+	EstablishmentTelemetryFailureMaxCount: {value: 100, minimum: 0},
+
 	LimitTLSProfilesProbability: {value: 1.0, minimum: 0.0},
 	LimitTLSProfiles:            {value: protocol.TLSProfiles{}},
 
+	// TLSProfileKeyShareGroups specifies, for each listed TLS profile, the
+	// key exchange groups offered in the ClientHello, in order, overriding
+	// the profile's groups. For the TLS 1.2 profiles, the groups are sent in
+	// the supported groups extension, and "GREASE" is replaced with a random
+	// GREASE value. For the TLS 1.3 profile, a key share is sent for the
+	// first group, and all groups are sent in the supported groups
+	// extension. Profiles which aren't listed use their default groups.
+	TLSProfileKeyShareGroups: {value: TLSProfileGroups{}},
+
 	LimitQUICVersionsProbability: {value: 1.0, minimum: 0.0},
 	LimitQUICVersions:            {value: protocol.QUICVersions{protocol.QUIC_VERSION_GQUIC43}},
 
+	// QUICPacingRate is the explicit pacing rate, in bytes per second, for
+	// packets sent by the client in QUIC tunnels. Explicit pacing is in
+	// addition to the pacing derived from QUIC congestion control, which is
+	// always applied; 0 disables explicit pacing. QUICPacingBurstBytes is
+	// the number of bytes which may be sent without pacing, after an idle
+	// period, so small flows, including the QUIC handshake, are not delayed.
+	//
+	// ServerQUICPacingRate and ServerQUICPacingBurstBytes are applied
+	// server-side, per client, to packets sent by the server.
+	QUICPacingRate:             {value: 0, minimum: 0},
+	QUICPacingBurstBytes:       {value: 32768, minimum: 1500},
+	ServerQUICPacingRate:       {value: 0, minimum: 0},
+	ServerQUICPacingBurstBytes: {value: 32768, minimum: 1500},
+
 	FragmentorProbability:              {value: 0.5, minimum: 0.0},
 	FragmentorLimitProtocols:           {value: protocol.TunnelProtocols{}},
 	FragmentorMinTotalBytes:            {value: 0, minimum: 0},
@@ -258,14 +653,40 @@ var defaultClientParameters = map[string]struct {
 	FragmentorDownstreamMinDelay:       {value: time.Duration(0), minimum: time.Duration(0)},
 	FragmentorDownstreamMaxDelay:       {value: 10 * time.Millisecond, minimum: time.Duration(0)},
 
+	// TCP Fast Open is attempted, for TCP tunnel protocols in
+	// TCPFastOpenLimitProtocols, with probability TCPFastOpenProbability.
+	// The server must also be configured for TCP Fast Open.
+
+	TCPFastOpenProbability:    {value: 0.0, minimum: 0.0},
+	TCPFastOpenLimitProtocols: {value: protocol.TunnelProtocols{}},
+
 	// The Psiphon server will reject obfuscated SSH seed messages with
-	// padding greater than OBFUSCATE_MAX_PADDING.
-	// obfuscator.NewClientObfuscator will ignore invalid min/max padding
-	// configurations.
+	// padding greater than OBFUSCATE_MAX_PADDING. Set enforces that
+	// ObfuscatedSSHMinPadding <= ObfuscatedSSHMaxPadding <=
+	// OBFUSCATE_MAX_PADDING, so tactics, including per-region tactics
+	// filters, cannot configure a padding range the server won't accept.
 
 	ObfuscatedSSHMinPadding: {value: 0, minimum: 0},
 	ObfuscatedSSHMaxPadding: {value: obfuscator.OBFUSCATE_MAX_PADDING, minimum: 0},
 
+	// OSSHDecoyFirstFlightProbability is the probability that an OSSH dial
+	// is preceded by a separate, abandoned decoy connection which sends a
+	// TLS ClientHello and awaits the server's covert acknowledgement. The
+	// decoy adds a TCP connection and round trip to the dial. The decoy SNI
+	// is selected from
+	// OSSHDecoyFirstFlightServerNames, which should list benign domains;
+	// when empty, a random host name is used.
+	OSSHDecoyFirstFlightProbability: {value: 0.0, minimum: 0.0},
+	OSSHDecoyFirstFlightServerNames: {value: []string{}},
+
+	// ObfuscatedSSHSeedKeyDerivation selects the obfuscator.SeedKeyDerivation
+	// used to derive obfuscated SSH keys from the seed message. Servers
+	// accept only the derivations listed in their
+	// ObfuscatedSSHSeedKeyDerivations config, so a non-default derivation
+	// should be targeted, using tactics filters, only at servers which
+	// accept it. The default is the original obfuscated OpenSSH derivation.
+	ObfuscatedSSHSeedKeyDerivation: {value: obfuscator.SEED_KEY_DERIVATION_DEFAULT},
+
 	AdditionalCustomHeaders: {value: make(http.Header)},
 
 	// Speed test and SSH keep alive padding is intended to frustrate
@@ -292,6 +713,51 @@ var defaultClientParameters = map[string]struct {
 	SSHKeepAliveProbeTimeout:               {value: 5 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	SSHKeepAliveProbeInactivePeriod:        {value: 10 * time.Second, minimum: 1 * time.Second},
 
+	// The TunnelQoEScore weights are the relative weights of the keep alive
+	// RTT, TCP retransmission, and throughput components of the tunnel QoE
+	// score. Weights need not sum to 1. When all weights are 0, no score is
+	// reported.
+	TunnelQoEScoreUpdatePeriod:     {value: 10 * time.Second, minimum: 1 * time.Second},
+	TunnelQoEScoreRTTWeight:        {value: 0.4, minimum: 0.0},
+	TunnelQoEScoreLossWeight:       {value: 0.3, minimum: 0.0},
+	TunnelQoEScoreThroughputWeight: {value: 0.3, minimum: 0.0},
+
+	// TunnelAffinityTTL is how long port forwards to a destination host
+	// continue to use the tunnel selected for that host, when multiple
+	// tunnels are active. The window is extended by each port forward to
+	// the host. 0 disables affinity, and each port forward uses the next
+	// tunnel in round-robin order. TunnelAffinityMaxEntries bounds the
+	// number of hosts tracked; the least recently used host is evicted.
+	TunnelAffinityTTL:        {value: 10 * time.Minute, minimum: time.Duration(0)},
+
+	// TunnelPoolGrowFailureCount and TunnelPoolGrowFailurePeriod specify
+	// when adaptive tunnel pool sizing, enabled with Config.MaxTunnelPoolSize,
+	// grows the pool: the pool grows by one tunnel after
+	// TunnelPoolGrowFailureCount tunnel failures within
+	// TunnelPoolGrowFailurePeriod. The pool shrinks by one tunnel after
+	// TunnelPoolShrinkStablePeriod with no tunnel failures or pool size
+	// changes.
+
+	TunnelPoolGrowFailureCount:   {value: 2, minimum: 1},
+	TunnelPoolGrowFailurePeriod:  {value: 10 * time.Minute, minimum: 1 * time.Second},
+	TunnelPoolShrinkStablePeriod: {value: 30 * time.Minute, minimum: 1 * time.Second},
+
+	// ServerAffinityMaxAge is the maximum age of the server affinity server
+	// entry, the server of the last successful tunnel, which is replayed as
+	// the first establishment candidate. After ServerAffinityMaxAge, or on a
+	// different network, candidate selection runs from scratch. 0 disables
+	// the age limit.
+	ServerAffinityMaxAge: {value: 24 * time.Hour, minimum: time.Duration(0)},
+	TunnelAffinityMaxEntries: {value: 1000, minimum: 1},
+
+	// DiagnosticBundleFailureThreshold is the number of consecutive failed
+	// tunnel connection attempts after which a diagnostic bundle is
+	// generated, and regenerated after each further threshold failures. 0
+	// disables diagnostic bundles. DiagnosticBundleMaxAttempts is the
+	// number of most recent attempts detailed in the bundle.
+	DiagnosticBundleFailureThreshold: {value: 20, minimum: 0},
+	DiagnosticBundleMaxAttempts:      {value: 50, minimum: 1},
+
 	HTTPProxyOriginServerTimeout:       {value: 15 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
 	HTTPProxyMaxIdleConnectionsPerHost: {value: 50, minimum: 0},
 
@@ -302,15 +768,45 @@ var defaultClientParameters = map[string]struct {
 	RemoteServerListURLs:               {value: DownloadURLs{}},
 	ObfuscatedServerListRootURLs:       {value: DownloadURLs{}},
 
+	// RemoteServerListDecodeWorkers is the number of concurrent workers used
+	// to decode and validate the server entries in a downloaded remote or
+	// obfuscated server list. Server entries are still stored one at a time,
+	// in list order. A value of 1 disables concurrent decoding.
+	RemoteServerListDecodeWorkers: {value: 4, minimum: 1},
+
+	// ServerEntryRevocationListURLs specifies the locations of the signed
+	// protocol.ServerEntryRevocationList, which is fetched along with the
+	// common remote server list.
+	ServerEntryRevocationListURLs: {value: DownloadURLs{}},
+
+	// ServerEntryMaxStoredCount and ServerEntryMaxStoredCountPerSource cap
+	// the number of stored server entries, in total and for each server
+	// entry source; new server entries over the limit are not stored.
+	// ServerEntryMaxMeekFrontingAddresses rejects server entries with
+	// oversized meekFrontingAddresses lists. For all three, 0 is no limit.
+	ServerEntryMaxStoredCount:           {value: 0, minimum: 0},
+	ServerEntryMaxStoredCountPerSource:  {value: 0, minimum: 0},
+	ServerEntryMaxMeekFrontingAddresses: {value: 100, minimum: 0},
+
 	PsiphonAPIRequestTimeout: {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 
 	PsiphonAPIStatusRequestPeriodMin:       {value: 5 * time.Minute, minimum: 1 * time.Second},
 	PsiphonAPIStatusRequestPeriodMax:       {value: 10 * time.Minute, minimum: 1 * time.Second},
 	PsiphonAPIStatusRequestShortPeriodMin:  {value: 5 * time.Second, minimum: 1 * time.Second},
 	PsiphonAPIStatusRequestShortPeriodMax:  {value: 10 * time.Second, minimum: 1 * time.Second},
+	PsiphonAPIStatusRequestPeriodJitter:    {value: 0.1, minimum: 0.0},
 	PsiphonAPIStatusRequestPaddingMinBytes: {value: 0, minimum: 0},
 	PsiphonAPIStatusRequestPaddingMaxBytes: {value: 256, minimum: 0},
-	PsiphonAPIPersistentStatsMaxCount:      {value: 100, minimum: 1},
+
+	// PsiphonAPIHandshakeRequestTargetLengths specifies, for each tunnel
+	// protocol, a distribution of target lengths for the encoded handshake
+	// request. The request is padded to the selected length, so that the
+	// request length doesn't vary by protocol; a request which already
+	// exceeds the selected length isn't padded. Padding is disabled by
+	// default.
+	PsiphonAPIHandshakeRequestTargetLengths: {value: LengthDistributions{}},
+
+	PsiphonAPIPersistentStatsMaxCount: {value: 100, minimum: 1},
 
 	PsiphonAPIConnectedRequestRetryPeriod: {value: 5 * time.Second, minimum: 1 * time.Millisecond},
 
@@ -335,6 +831,9 @@ var defaultClientParameters = map[string]struct {
 	MeekDialDomainsOnly:                        {value: false},
 	MeekLimitBufferSizes:                       {value: false},
 	MeekCookieMaxPadding:                       {value: 256, minimum: 0},
+	MeekTLSRecordFragmentationProbability:      {value: 0.0, minimum: 0.0},
+	MeekTLSRecordFragmentationMinBytes:         {value: 512, minimum: 1},
+	MeekTLSRecordFragmentationMaxBytes:         {value: 16384, minimum: 1},
 	MeekFullReceiveBufferLength:                {value: 4194304, minimum: 1024},
 	MeekReadPayloadChunkLength:                 {value: 65536, minimum: 1024},
 	MeekLimitedFullReceiveBufferLength:         {value: 131072, minimum: 1024},
@@ -352,8 +851,273 @@ var defaultClientParameters = map[string]struct {
 	MeekRoundTripRetryMultiplier:               {value: 2.0, minimum: 0.0},
 	MeekRoundTripTimeout:                       {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 
+	// MeekIdleMaxPollInterval, when greater than MeekMaxPollInterval, is the
+	// maximum poll interval once a meek tunnel has exchanged no data for
+	// MeekIdlePeriod. As the meek server times out inactive sessions, this
+	// should remain well below 45 seconds. MeekFrontIdleTimeout, when set,
+	// is the front's idle connection timeout, which all poll intervals
+	// remain below.
+	MeekIdlePeriod:          {value: 30 * time.Second, minimum: time.Duration(0)},
+	MeekIdleMaxPollInterval: {value: time.Duration(0), minimum: time.Duration(0)},
+	MeekFrontIdleTimeout:    {value: time.Duration(0), minimum: time.Duration(0)},
+
+	// MeekFrontingRaceCount is the number of distinct fronts, for a fronted
+	// meek HTTPS server entry, that are dialed concurrently in a single
+	// connection attempt. The first front to complete is used. 1 disables
+	// racing.
+	MeekFrontingRaceCount: {value: 1, minimum: 1},
+
+	// MeekFailoverOrder, when "fronted" or "unfronted", is the meek class
+	// tried first when a candidate server supports both fronted and
+	// unfronted meek. When the first class fails, the other class is tried
+	// with the same server. When MeekFailoverRace is set, both classes are
+	// dialed concurrently and the first to connect is used. For the default,
+	// "", a single meek protocol is selected at random, with no failover.
+	//
+	// MeekFrontedConnectTimeout and MeekUnfrontedConnectTimeout, when not 0,
+	// replace TunnelConnectTimeout for each failover attempt of the class.
+	MeekFailoverOrder:           {value: ""},
+	MeekFailoverRace:            {value: false},
+	MeekFrontedConnectTimeout:   {value: time.Duration(0), minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+	MeekUnfrontedConnectTimeout: {value: time.Duration(0), minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
+
+	// MeekFrontingDisableSNIAddresses lists fronting addresses for which
+	// fronted meek HTTPS omits the TLS SNI extension, in addition to any
+	// listed in the server entry meekFrontingDisableSNIAddresses field.
+	// Without SNI, the front routes requests using only the Host header.
+	MeekFrontingDisableSNIAddresses: {value: []string{}},
+
+	// MeekSessionTokenLocation specifies where meek requests carry the
+	// session token; see protocol.MeekSessionTokenLocations. An invalid
+	// location is treated as "Cookie". MeekSessionTokenHeaderName is the
+	// request header for the "Header" location and, for all locations other
+	// than "Cookie", the response header in which the server returns the
+	// session ID. The location is selected once for each meek connection.
+	MeekSessionTokenLocation:   {value: protocol.MEEK_SESSION_TOKEN_LOCATION_COOKIE},
+	MeekSessionTokenHeaderName: {value: protocol.MEEK_SESSION_TOKEN_DEFAULT_HEADER_NAME},
+
+	// MeekMaxRedirects is the maximum number of HTTP redirects followed for
+	// each meek request; when 0, redirect responses fail the request. When
+	// MeekRedirectSameOriginOnly is set, a redirect to another host is not
+	// followed and is reported as a potential interception indicator.
+	MeekMaxRedirects:           {value: 0, minimum: 0},
+	MeekRedirectSameOriginOnly: {value: true},
+
+	// MeekURLSignatureTTL is the expiry of signed meek request URLs, for
+	// server entries which specify a URL signing scheme. Each request is
+	// signed when sent. MeekURLSignatureMaxResigns is the maximum number of
+	// times a request, with a signature rejected by the CDN, is re-signed
+	// and resent before the request fails.
+	MeekURLSignatureTTL:        {value: 5 * time.Minute, minimum: 1 * time.Second},
+	MeekURLSignatureMaxResigns: {value: 2, minimum: 0},
+
+	// MeekMaxChunkSize is the initial maximum size of meek request and
+	// response payloads, for middleboxes which stall or reset larger HTTP
+	// bodies. When a meek round trip fails and is retried, the client and
+	// server each halve their payload size, down to MeekMinChunkSize. Sizes
+	// are clamped to 65536, the default, fixed size. The default
+	// MeekMinChunkSize of 65536 disables backoff.
+	MeekMaxChunkSize: {value: 65536, minimum: 1024},
+	MeekMinChunkSize: {value: 65536, minimum: 1024},
+
+	// MeekServerResponseHeaderTemplate is applied server-side and names the
+	// meek server response header template; "" uses the stock Go net/http
+	// response headers.
+	MeekServerResponseHeaderTemplate: {value: ""},
+
+	// MeekServerALPNProtocols is applied server-side and specifies, in order
+	// of preference, the TLS ALPN protocols the unfronted meek server will
+	// negotiate. When a client offers none of the protocols, or offers no
+	// ALPN extension, the server falls back to HTTP/1.1.
+	//
+	// MeekClientALPNProtocols specifies the ALPN protocols offered by
+	// unfronted meek HTTPS clients. This applies only to TLS profiles which
+	// don't parrot a fixed ALPN extension; an empty list uses the TLS
+	// profile default.
+	MeekServerALPNProtocols: {value: protocol.ALPNProtocols{protocol.ALPN_PROTOCOL_HTTP1_1}},
+	MeekClientALPNProtocols: {value: protocol.ALPNProtocols{}},
+
+	// MeekServerAllowedSNIServerNames is applied server-side and lists the
+	// TLS SNI server names the unfronted meek HTTPS server expects. An entry
+	// "*.example.com" matches any subdomain of example.com, and an entry ""
+	// matches clients which send no SNI, as unfronted meek clients do when
+	// dialing the server IP address. Matching is case insensitive. An empty
+	// list accepts any SNI.
+	//
+	// When the list is not empty, TransformHostNameProbability should be 0
+	// for the same clients, as transformed host names are random SNI server
+	// names which won't be in the list.
+	//
+	// MeekServerUnexpectedSNIBehavior specifies how the server handles a
+	// TLS handshake with an SNI server name not in the list:
+	// MEEK_SERVER_UNEXPECTED_SNI_CLOSE closes the connection without
+	// completing the handshake; MEEK_SERVER_UNEXPECTED_SNI_DECOY completes
+	// the handshake and responds to all requests as a web server responds to
+	// unknown paths, and never relays meek traffic.
+	MeekServerAllowedSNIServerNames: {value: []string{}},
+	MeekServerUnexpectedSNIBehavior: {value: MEEK_SERVER_UNEXPECTED_SNI_CLOSE},
+
+	// MeekCoalesceConnections specifies whether concurrent HTTPS meek
+	// connections, such as a tunnel and an untunneled tactics request, with
+	// the same front address and TLS configuration share one HTTP transport
+	// and, for HTTP/2, a single TCP connection.
+	MeekCoalesceConnections: {value: false},
+
+	// MeekServerSessionIDRotationPeriod is applied server-side and specifies
+	// how long a meek session ID is used before the server issues the client
+	// a replacement session ID. The session, and the tunnel it relays, is
+	// unaffected; only the session token is replaced. 0 disables rotation,
+	// and a session ID lasts for the lifetime of the session.
+	MeekServerSessionIDRotationPeriod:       {value: time.Duration(0), minimum: time.Duration(0)},
+	MeekServerSessionIDRotationPeriodJitter: {value: 0.3, minimum: 0.0},
+
+	// MeekServerSessionRequestRateLimit and MeekServerSessionRequestBurst are
+	// applied server-side and limit the rate of requests, per second, in a
+	// single meek session. Requests are admitted at the sustained rate, plus
+	// a burst allowance which accommodates legitimate bursts of polling;
+	// excess requests are rejected and the session remains open. This limit
+	// is distinct from the per-client IP traffic rules meek rate limiter.
+	// 0 is no limit.
+	MeekServerSessionRequestRateLimit: {value: 0, minimum: 0},
+	MeekServerSessionRequestBurst:     {value: 50, minimum: 1},
+
+	// ServerReturnEgressIPAddress is applied server-side and specifies
+	// whether the server returns its egress IP address in the handshake
+	// response.
+	ServerReturnEgressIPAddress: {value: false},
+
+	// ServerMaxTCPPortForwardsPerDestination is applied server-side and
+	// limits the number of concurrent TCP port forwards, dialing and
+	// established, from a single tunnel to a single destination host. The
+	// default is well above the ~6 concurrent connections per origin made by
+	// browsers. 0 is no limit. This limit is distinct from the traffic rules
+	// MaxTCPPortForwardCount limit on all of a client's port forwards.
+	ServerMaxTCPPortForwardsPerDestination: {value: 64, minimum: 0},
+
+	// ServerMaxSSHChannelsPerTunnel is applied server-side and limits the
+	// number of concurrently open SSH channels, including queued and
+	// dialing port forwards, in a single tunnel. Channel opens beyond the
+	// limit are rejected. The default is well above the traffic rules
+	// default port forward limits, and is a hard cap on runaway clients.
+	// 0 is no limit.
+	ServerMaxSSHChannelsPerTunnel: {value: 4096, minimum: 0},
+
+	// ServerMinimumClientVersions is applied server-side and specifies, per
+	// tunnel protocol, the minimum client version that may complete a
+	// handshake. Older clients receive an "upgrade required" handshake
+	// response and are disconnected.
+	ServerMinimumClientVersions: {value: MinimumClientVersions{}},
+
+	// ServerConnectionCloseBehaviors is applied server-side and specifies,
+	// per tunnel protocol, how the server closes TCP client connections:
+	// with a FIN or RST, the SO_LINGER timeout, and a random close delay.
+	// See ConnectionCloseBehavior.
+	ServerConnectionCloseBehaviors: {value: ConnectionCloseBehaviors{}},
+
+	// ServerConnectionLogSampleRates is applied server-side and specifies,
+	// per tunnel protocol, the fraction of client sessions for which
+	// connection events, "server_tunnel" and "connected", are logged.
+	// Logged events record the sample rate. By default, all events are
+	// logged.
+	ServerConnectionLogSampleRates: {value: LogSampleRates{}},
+
+	// ServerPortForwardDialOptions is applied server-side and specifies, per
+	// destination port, socket options and timeouts for outbound TCP port
+	// forwards. Ports without an entry use the server defaults. See
+	// PortForwardDialOption.
+	ServerPortForwardDialOptions: {value: PortForwardDialOptions{}},
+
+	// ServerPortForwardDialRetries and ServerPortForwardDialRetryBackoff are
+	// applied server-side and specify the number of times a TCP port forward
+	// resolve or dial which fails with a transient error, such as a DNS
+	// server failure or a refused connection, is retried before the port
+	// forward is rejected, and the delay before the first retry, which
+	// doubles for each subsequent retry. Permanent failures, such as
+	// NXDOMAIN, are not retried, and retries are always bounded by the
+	// port forward dial timeout. 0 is no retries.
+	ServerPortForwardDialRetries:      {value: 0, minimum: 0},
+	ServerPortForwardDialRetryBackoff: {value: 250 * time.Millisecond, minimum: time.Duration(0)},
+
+	// ServerMaxConcurrentSSHHandshakes is applied server-side and, when > 0,
+	// limits the number of concurrent in-progress SSH handshakes, across
+	// all tunnel protocols, at which new client connections matching the
+	// tactics are admitted. When the limit is reached, new connections are
+	// closed immediately, before any obfuscation or SSH crypto work.
+	ServerMaxConcurrentSSHHandshakes: {value: 0, minimum: 0},
+
+	// ServerFirstWriteDelayProbability, ServerFirstWriteMinDelay, and
+	// ServerFirstWriteMaxDelay are applied server-side and specify the
+	// probability of, and the range of, a random delay before the server
+	// sends its first handshake response bytes on a new TCP client
+	// connection. The server caps the delay at a hard limit.
+	ServerFirstWriteDelayProbability: {value: 0.0, minimum: 0.0},
+	ServerFirstWriteMinDelay:         {value: time.Duration(0), minimum: time.Duration(0)},
+	ServerFirstWriteMaxDelay:         {value: 50 * time.Millisecond, minimum: time.Duration(0)},
+
+	// TLS interception detection is disabled when
+	// TLSInterceptionIndicatorThreshold is 0. TLSInterceptionExpectedIssuers
+	// is checked only when not empty.
+
+	TLSInterceptionIndicatorThreshold: {value: 0, minimum: 0},
+	TLSInterceptionExpectedIssuers:    {value: []string{}},
+	TLSInterceptionMinCertificateAge:  {value: time.Duration(0), minimum: time.Duration(0)},
+
+	// ClockSkewTolerance is the amount by which the local clock may be
+	// ahead of or behind the true time without failing certificate validity
+	// period checks. When the local clock is found, at handshake, to differ
+	// from the server clock by more than ClockSkewTolerance, a ClockSkew
+	// notice is emitted.
+	ClockSkewTolerance:         {value: 10 * time.Minute, minimum: time.Duration(0)},
+	TLSInterceptionRequireSCTs: {value: false},
+
+	// Transparent HTTP proxy detection is disabled when
+	// TransparentProxyCanaryURL is blank. The canary URL should be a
+	// plaintext HTTP URL for a benign, static resource whose exact response
+	// body is TransparentProxyCanaryExpectedResponse. When interference is
+	// detected, TransparentProxyAvoidProtocols, by default the plaintext HTTP
+	// meek protocols, are not selected for the remainder of the
+	// establishment.
+
+	TransparentProxyCanaryURL:              {value: ""},
+	TransparentProxyCanaryExpectedResponse: {value: ""},
+	TransparentProxyCanaryTimeout:          {value: 10 * time.Second, minimum: 1 * time.Second},
+	TransparentProxyAvoidProtocols: {value: protocol.TunnelProtocols{
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP}},
+
+	// Captive portal detection is disabled when CaptivePortalCanaryURL is
+	// blank. The canary URL should be a plaintext HTTP URL for a benign,
+	// static resource whose response has the status code
+	// CaptivePortalCanaryExpectedStatusCode and the exact body
+	// CaptivePortalCanaryExpectedResponse. When a captive portal is
+	// detected, establishment rounds are paused and the canary is rechecked
+	// every CaptivePortalRecheckPeriod until the portal is cleared.
+
+	CaptivePortalCanaryURL:                {value: ""},
+	CaptivePortalCanaryExpectedStatusCode: {value: 204, minimum: 100},
+	CaptivePortalCanaryExpectedResponse:   {value: ""},
+	CaptivePortalCanaryTimeout:            {value: 10 * time.Second, minimum: 1 * time.Second},
+	CaptivePortalRecheckPeriod:            {value: 10 * time.Second, minimum: 1 * time.Second},
+
+	// The fronting DNS cache is disabled when FrontingDNSCacheMaxTTL is 0.
+
+	FrontingDNSCacheMinTTL: {value: time.Duration(0), minimum: time.Duration(0)},
+	FrontingDNSCacheMaxTTL: {value: time.Duration(0), minimum: time.Duration(0)},
+
 	TransformHostNameProbability: {value: 0.5, minimum: 0.0},
 	PickUserAgentProbability:     {value: 0.5, minimum: 0.0},
+
+	// MeekUserAgents is a weighted pool of realistic browser User-Agents.
+	// When PickUserAgentProbability selects a User-Agent for a meek dial and
+	// the pool is not empty, the User-Agent is drawn from the pool instead
+	// of the registered picker. The User-Agent is used for all requests of
+	// the meek connection.
+	MeekUserAgents: {value: UserAgents{}},
+
+	// SSHPreferredAlgorithms specifies preferred SSH key exchange, cipher,
+	// and MAC algorithms, or a preset such as "performance". The default, no
+	// preferred algorithms, offers the SSH implementation defaults.
+	SSHPreferredAlgorithms: {value: SSHAlgorithms{}},
 }
 
 // ClientParameters is a set of client parameters. To use the parameters, call
@@ -508,6 +1272,78 @@ func (p *ClientParameters) Set(
 					}
 					return nil, common.ContextError(err)
 				}
+			case UserAgents:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
+			case MinimumClientVersions:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
+			case SSHAlgorithms:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
+			case TLSProfileGroups:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
+			case RegionTunnelProtocols:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
+			case ConnectionCloseBehaviors:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
+			case LogSampleRates:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
+			case PortForwardDialOptions:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
+			case LengthDistributions:
+				err := v.Validate()
+				if err != nil {
+					if skipOnError {
+						continue
+					}
+					return nil, common.ContextError(err)
+				}
 			case protocol.TunnelProtocols:
 				if skipOnError {
 					newValue = v.PruneInvalid()
@@ -535,6 +1371,15 @@ func (p *ClientParameters) Set(
 						return nil, common.ContextError(err)
 					}
 				}
+			case protocol.ALPNProtocols:
+				if skipOnError {
+					newValue = v.PruneInvalid()
+				} else {
+					err := v.Validate()
+					if err != nil {
+						return nil, common.ContextError(err)
+					}
+				}
 			}
 
 			// Enforce any minimums. Assumes defaultClientParameters[name]
@@ -579,6 +1424,43 @@ func (p *ClientParameters) Set(
 		counts = append(counts, count)
 	}
 
+	// Perform validation of related parameters, which can only be checked
+	// after all applyParameters have been applied. When skipping on error,
+	// an invalid combination is reverted to the default values.
+
+	minPadding := parameters[ObfuscatedSSHMinPadding].(int)
+	maxPadding := parameters[ObfuscatedSSHMaxPadding].(int)
+	if minPadding > maxPadding || maxPadding > obfuscator.OBFUSCATE_MAX_PADDING {
+		if !skipOnError {
+			return nil, common.ContextError(
+				fmt.Errorf("invalid obfuscated SSH padding range: %d-%d", minPadding, maxPadding))
+		}
+		parameters[ObfuscatedSSHMinPadding] = defaultClientParameters[ObfuscatedSSHMinPadding].value
+		parameters[ObfuscatedSSHMaxPadding] = defaultClientParameters[ObfuscatedSSHMaxPadding].value
+	}
+
+	// Seed key derivations may be registered by the client at run time, so
+	// the derivation name is checked against the current registrations.
+
+	seedKeyDerivation := parameters[ObfuscatedSSHSeedKeyDerivation].(string)
+	if !obfuscator.IsSeedKeyDerivationRegistered(seedKeyDerivation) {
+		if !skipOnError {
+			return nil, common.ContextError(
+				fmt.Errorf("unknown obfuscated SSH seed key derivation: %s", seedKeyDerivation))
+		}
+		parameters[ObfuscatedSSHSeedKeyDerivation] = defaultClientParameters[ObfuscatedSSHSeedKeyDerivation].value
+	}
+
+	unexpectedSNIBehavior := parameters[MeekServerUnexpectedSNIBehavior].(string)
+	if unexpectedSNIBehavior != MEEK_SERVER_UNEXPECTED_SNI_CLOSE &&
+		unexpectedSNIBehavior != MEEK_SERVER_UNEXPECTED_SNI_DECOY {
+		if !skipOnError {
+			return nil, common.ContextError(
+				fmt.Errorf("unknown meek server unexpected SNI behavior: %s", unexpectedSNIBehavior))
+		}
+		parameters[MeekServerUnexpectedSNIBehavior] = defaultClientParameters[MeekServerUnexpectedSNIBehavior].value
+	}
+
 	snapshot := &ClientParametersSnapshot{
 		getValueLogger: p.getValueLogger,
 		tag:            tag,
@@ -799,6 +1681,13 @@ func (p *ClientParametersSnapshot) QUICVersions(name string) protocol.QUICVersio
 	return value
 }
 
+// ALPNProtocols returns a protocol.ALPNProtocols parameter value.
+func (p *ClientParametersSnapshot) ALPNProtocols(name string) protocol.ALPNProtocols {
+	value := protocol.ALPNProtocols{}
+	p.getValue(name, &value)
+	return value
+}
+
 // DownloadURLs returns a DownloadURLs parameter value.
 func (p *ClientParametersSnapshot) DownloadURLs(name string) DownloadURLs {
 	value := DownloadURLs{}
@@ -806,6 +1695,70 @@ func (p *ClientParametersSnapshot) DownloadURLs(name string) DownloadURLs {
 	return value
 }
 
+// UserAgents returns a UserAgents parameter value.
+func (p *ClientParametersSnapshot) UserAgents(name string) UserAgents {
+	value := UserAgents{}
+	p.getValue(name, &value)
+	return value
+}
+
+// MinimumClientVersions returns a MinimumClientVersions parameter value.
+func (p *ClientParametersSnapshot) MinimumClientVersions(name string) MinimumClientVersions {
+	value := MinimumClientVersions{}
+	p.getValue(name, &value)
+	return value
+}
+
+// TLSProfileGroups returns a TLSProfileGroups parameter value.
+func (p *ClientParametersSnapshot) TLSProfileGroups(name string) TLSProfileGroups {
+	value := TLSProfileGroups{}
+	p.getValue(name, &value)
+	return value
+}
+
+// SSHAlgorithms returns a SSHAlgorithms parameter value.
+func (p *ClientParametersSnapshot) SSHAlgorithms(name string) SSHAlgorithms {
+	value := SSHAlgorithms{}
+	p.getValue(name, &value)
+	return value
+}
+
+// RegionTunnelProtocols returns a RegionTunnelProtocols parameter value.
+func (p *ClientParametersSnapshot) RegionTunnelProtocols(name string) RegionTunnelProtocols {
+	value := RegionTunnelProtocols{}
+	p.getValue(name, &value)
+	return value
+}
+
+// ConnectionCloseBehaviors returns a ConnectionCloseBehaviors parameter
+// value.
+func (p *ClientParametersSnapshot) ConnectionCloseBehaviors(name string) ConnectionCloseBehaviors {
+	value := ConnectionCloseBehaviors{}
+	p.getValue(name, &value)
+	return value
+}
+
+// LogSampleRates returns a LogSampleRates parameter value.
+func (p *ClientParametersSnapshot) LogSampleRates(name string) LogSampleRates {
+	value := LogSampleRates{}
+	p.getValue(name, &value)
+	return value
+}
+
+// PortForwardDialOptions returns a PortForwardDialOptions parameter value.
+func (p *ClientParametersSnapshot) PortForwardDialOptions(name string) PortForwardDialOptions {
+	value := PortForwardDialOptions{}
+	p.getValue(name, &value)
+	return value
+}
+
+// LengthDistributions returns a LengthDistributions parameter value.
+func (p *ClientParametersSnapshot) LengthDistributions(name string) LengthDistributions {
+	value := LengthDistributions{}
+	p.getValue(name, &value)
+	return value
+}
+
 // RateLimits returns a common.RateLimits parameter value.
 func (p *ClientParametersSnapshot) RateLimits(name string) common.RateLimits {
 	value := common.RateLimits{}
@@ -26,6 +26,8 @@ import (
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
 
@@ -43,6 +45,11 @@ func TestGetDefaultParameters(t *testing.T) {
 			if v != g {
 				t.Fatalf("String returned %+v expected %+v", v, g)
 			}
+		case []string:
+			g := p.Get().Strings(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("Strings returned %+v expected %+v", v, g)
+			}
 		case int:
 			g := p.Get().Int(name)
 			if v != g {
@@ -78,11 +85,61 @@ func TestGetDefaultParameters(t *testing.T) {
 			if !reflect.DeepEqual(v, g) {
 				t.Fatalf("QUICVersions returned %+v expected %+v", v, g)
 			}
+		case protocol.ALPNProtocols:
+			g := p.Get().ALPNProtocols(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("ALPNProtocols returned %+v expected %+v", v, g)
+			}
 		case DownloadURLs:
 			g := p.Get().DownloadURLs(name)
 			if !reflect.DeepEqual(v, g) {
 				t.Fatalf("DownloadURLs returned %+v expected %+v", v, g)
 			}
+		case UserAgents:
+			g := p.Get().UserAgents(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("UserAgents returned %+v expected %+v", v, g)
+			}
+		case MinimumClientVersions:
+			g := p.Get().MinimumClientVersions(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("MinimumClientVersions returned %+v expected %+v", v, g)
+			}
+		case TLSProfileGroups:
+			g := p.Get().TLSProfileGroups(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("TLSProfileGroups returned %+v expected %+v", v, g)
+			}
+		case SSHAlgorithms:
+			g := p.Get().SSHAlgorithms(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("SSHAlgorithms returned %+v expected %+v", v, g)
+			}
+		case RegionTunnelProtocols:
+			g := p.Get().RegionTunnelProtocols(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("RegionTunnelProtocols returned %+v expected %+v", v, g)
+			}
+		case ConnectionCloseBehaviors:
+			g := p.Get().ConnectionCloseBehaviors(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("ConnectionCloseBehaviors returned %+v expected %+v", v, g)
+			}
+		case LogSampleRates:
+			g := p.Get().LogSampleRates(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("LogSampleRates returned %+v expected %+v", v, g)
+			}
+		case PortForwardDialOptions:
+			g := p.Get().PortForwardDialOptions(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("PortForwardDialOptions returned %+v expected %+v", v, g)
+			}
+		case LengthDistributions:
+			g := p.Get().LengthDistributions(name)
+			if !reflect.DeepEqual(v, g) {
+				t.Fatalf("LengthDistributions returned %+v expected %+v", v, g)
+			}
 		case common.RateLimits:
 			g := p.Get().RateLimits(name)
 			if !reflect.DeepEqual(v, g) {
@@ -260,3 +317,263 @@ func TestLimitTunnelProtocolProbability(t *testing.T) {
 		t.Fatalf("Unexpected probability result: %d", matchCount)
 	}
 }
+
+func TestObfuscatedSSHPaddingRange(t *testing.T) {
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	// Valid range, as may be set by a region-specific tactics filter
+
+	applyParameters := map[string]interface{}{
+		"ObfuscatedSSHMinPadding": 1024,
+		"ObfuscatedSSHMaxPadding": 2048,
+	}
+
+	_, err = p.Set("", false, applyParameters)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	if p.Get().Int(ObfuscatedSSHMinPadding) != 1024 ||
+		p.Get().Int(ObfuscatedSSHMaxPadding) != 2048 {
+		t.Fatalf("Unexpected padding range")
+	}
+
+	invalidParameters := []map[string]interface{}{
+		{
+			"ObfuscatedSSHMinPadding": 2048,
+			"ObfuscatedSSHMaxPadding": 1024,
+		},
+		{
+			"ObfuscatedSSHMaxPadding": obfuscator.OBFUSCATE_MAX_PADDING + 1,
+		},
+	}
+
+	for _, applyParameters := range invalidParameters {
+
+		// No skip on error; should fail and not apply any changes
+
+		_, err = p.Set("", false, applyParameters)
+		if err == nil {
+			t.Fatalf("Set succeeded unexpectedly")
+		}
+
+		// Skip on error; should revert to the default range
+
+		_, err = p.Set("", true, applyParameters)
+		if err != nil {
+			t.Fatalf("Set failed: %s", err)
+		}
+
+		if p.Get().Int(ObfuscatedSSHMinPadding) != 0 ||
+			p.Get().Int(ObfuscatedSSHMaxPadding) != obfuscator.OBFUSCATE_MAX_PADDING {
+			t.Fatalf("Unexpected padding range")
+		}
+	}
+}
+
+func TestHandshakeRequestTargetLengths(t *testing.T) {
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	// Padding is disabled by default.
+
+	length, err := p.Get().LengthDistributions(
+		PsiphonAPIHandshakeRequestTargetLengths).SelectLength(protocol.TUNNEL_PROTOCOL_SSH)
+	if err != nil || length != 0 {
+		t.Fatalf("unexpected target length: %d, %v", length, err)
+	}
+
+	applyParameters := map[string]interface{}{
+		"PsiphonAPIHandshakeRequestTargetLengths": map[string]interface{}{
+			protocol.TUNNEL_PROTOCOL_SSH: []interface{}{
+				map[string]interface{}{"MinLength": 1000, "MaxLength": 1000, "Weight": 1},
+			},
+			LENGTH_DISTRIBUTION_ALL_PROTOCOLS: []interface{}{
+				map[string]interface{}{"MinLength": 2000, "MaxLength": 2100, "Weight": 1},
+				map[string]interface{}{"MinLength": 3000, "MaxLength": 3000, "Weight": 0},
+			},
+		},
+	}
+
+	_, err = p.Set("", false, applyParameters)
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	lengths := p.Get().LengthDistributions(PsiphonAPIHandshakeRequestTargetLengths)
+
+	for i := 0; i < 100; i++ {
+		length, err := lengths.SelectLength(protocol.TUNNEL_PROTOCOL_SSH)
+		if err != nil || length != 1000 {
+			t.Fatalf("unexpected target length: %d, %v", length, err)
+		}
+		length, err = lengths.SelectLength(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+		if err != nil || length < 2000 || length > 2100 {
+			t.Fatalf("unexpected target length: %d, %v", length, err)
+		}
+	}
+
+	invalidLengths := []interface{}{
+		map[string]interface{}{
+			"invalid-protocol": []interface{}{
+				map[string]interface{}{"MinLength": 1000, "MaxLength": 1000, "Weight": 1},
+			},
+		},
+		map[string]interface{}{
+			LENGTH_DISTRIBUTION_ALL_PROTOCOLS: []interface{}{
+				map[string]interface{}{"MinLength": 2000, "MaxLength": 1000, "Weight": 1},
+			},
+		},
+		map[string]interface{}{
+			LENGTH_DISTRIBUTION_ALL_PROTOCOLS: []interface{}{
+				map[string]interface{}{
+					"MinLength": 1000,
+					"MaxLength": protocol.PSIPHON_API_HANDSHAKE_MAX_PADDING_LENGTH + 1,
+					"Weight":    1},
+			},
+		},
+		map[string]interface{}{
+			LENGTH_DISTRIBUTION_ALL_PROTOCOLS: []interface{}{
+				map[string]interface{}{"MinLength": 1000, "MaxLength": 1000, "Weight": 0},
+			},
+		},
+	}
+
+	for _, invalidLength := range invalidLengths {
+		_, err = p.Set("", false, map[string]interface{}{
+			"PsiphonAPIHandshakeRequestTargetLengths": invalidLength})
+		if err == nil {
+			t.Fatalf("Set succeeded unexpectedly")
+		}
+	}
+}
+
+func TestTLSProfileKeyShareGroups(t *testing.T) {
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = p.Set("", false, map[string]interface{}{
+		"TLSProfileKeyShareGroups": map[string]interface{}{
+			protocol.TLS_PROFILE_CHROME_58:        []interface{}{"GREASE", "X25519", "P-256"},
+			protocol.TLS_PROFILE_TLS13_RANDOMIZED: []interface{}{"P-256", "X25519"},
+		}})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	groups := p.Get().TLSProfileGroups(TLSProfileKeyShareGroups)
+	if !reflect.DeepEqual(
+		groups[protocol.TLS_PROFILE_CHROME_58],
+		protocol.TLSGroups{"GREASE", "X25519", "P-256"}) {
+		t.Fatalf("unexpected groups: %+v", groups)
+	}
+
+	invalidGroups := []interface{}{
+		map[string]interface{}{
+			"invalid-profile": []interface{}{"X25519"},
+		},
+		map[string]interface{}{
+			protocol.TLS_PROFILE_CHROME_58: []interface{}{"X448"},
+		},
+		map[string]interface{}{
+			protocol.TLS_PROFILE_CHROME_58: []interface{}{"X25519", "X25519"},
+		},
+		map[string]interface{}{
+			protocol.TLS_PROFILE_CHROME_58: []interface{}{},
+		},
+		map[string]interface{}{
+			protocol.TLS_PROFILE_TLS13_RANDOMIZED: []interface{}{"GREASE", "X25519"},
+		},
+	}
+
+	for _, invalidGroup := range invalidGroups {
+		_, err = p.Set("", false, map[string]interface{}{
+			"TLSProfileKeyShareGroups": invalidGroup})
+		if err == nil {
+			t.Fatalf("Set succeeded unexpectedly: %+v", invalidGroup)
+		}
+	}
+}
+
+func TestSSHAlgorithms(t *testing.T) {
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = p.Set("", false, map[string]interface{}{
+		"SSHPreferredAlgorithms": map[string]interface{}{
+			"Preset": SSH_ALGORITHMS_PRESET_PERFORMANCE,
+			"MACs":   []interface{}{"hmac-sha1"},
+		}})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	defaults := ssh.Algorithms{
+		KeyExchanges: []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256"},
+		Ciphers:      []string{"aes128-ctr", "aes128-gcm@openssh.com"},
+		MACs:         []string{"hmac-sha2-256", "hmac-sha1"},
+	}
+
+	offered := p.Get().SSHAlgorithms(SSHPreferredAlgorithms).Offered(defaults, false)
+
+	expected := ssh.Algorithms{
+		KeyExchanges: []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256"},
+		Ciphers:      []string{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com", "aes128-ctr"},
+		MACs:         []string{"hmac-sha1", "hmac-sha2-256"},
+	}
+
+	if !reflect.DeepEqual(offered, expected) {
+		t.Fatalf("unexpected offered algorithms: %+v", offered)
+	}
+
+	offered = SSHAlgorithms{
+		Ciphers:      []string{"aes256-ctr"},
+		OmitDefaults: true,
+	}.Offered(defaults, false)
+
+	expected = ssh.Algorithms{
+		KeyExchanges: defaults.KeyExchanges,
+		Ciphers:      []string{"aes256-ctr"},
+		MACs:         defaults.MACs,
+	}
+
+	if !reflect.DeepEqual(offered, expected) {
+		t.Fatalf("unexpected offered algorithms: %+v", offered)
+	}
+
+	offered = SSHAlgorithms{
+		MACs:         []string{"hmac-sha2-256-etm@openssh.com"},
+		OmitDefaults: true,
+	}.Offered(defaults, true)
+
+	if !reflect.DeepEqual(offered.MACs, defaults.MACs) {
+		t.Fatalf("unexpected offered MACs: %+v", offered.MACs)
+	}
+
+	invalidAlgorithms := []interface{}{
+		map[string]interface{}{"Preset": "invalid-preset"},
+		map[string]interface{}{"KeyExchanges": []interface{}{"invalid-kex"}},
+		map[string]interface{}{"Ciphers": []interface{}{"invalid-cipher"}},
+		map[string]interface{}{"MACs": []interface{}{"hmac-md5"}},
+		map[string]interface{}{"Ciphers": []interface{}{"3des-cbc"}},
+		map[string]interface{}{"Ciphers": []interface{}{"aes128-cbc"}},
+		map[string]interface{}{"Ciphers": []interface{}{"arcfour"}},
+	}
+
+	for _, invalidAlgorithm := range invalidAlgorithms {
+		_, err = p.Set("", false, map[string]interface{}{
+			"SSHPreferredAlgorithms": invalidAlgorithm})
+		if err == nil {
+			t.Fatalf("Set succeeded unexpectedly: %+v", invalidAlgorithm)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// CONNECTION_CLOSE_BEHAVIOR_ALL_PROTOCOLS is the ConnectionCloseBehaviors
+// key which applies to all tunnel protocols without a specific entry.
+const CONNECTION_CLOSE_BEHAVIOR_ALL_PROTOCOLS = "All"
+
+// ConnectionCloseBehavior specifies how a TCP connection is closed.
+type ConnectionCloseBehavior struct {
+
+	// RSTProbability is the probability that a connection is closed with a
+	// TCP RST, by setting SO_LINGER to 0, rather than a FIN. The selection
+	// is made once for each connection.
+	RSTProbability float64
+
+	// LingerSeconds, when > 0, is the SO_LINGER timeout applied to
+	// connections which are closed with a FIN. When 0, the OS default close
+	// behavior applies.
+	LingerSeconds int
+
+	// MaxCloseDelayMilliseconds, when > 0, delays each close by a random
+	// duration of up to MaxCloseDelayMilliseconds, so that a connection
+	// isn't closed immediately after the event, such as receiving invalid
+	// data, that caused it to be closed.
+	MaxCloseDelayMilliseconds int
+}
+
+// ConnectionCloseBehaviors maps tunnel protocols to the close behavior for
+// connections using the protocol.
+type ConnectionCloseBehaviors map[string]ConnectionCloseBehavior
+
+// Validate checks that each key is a supported tunnel protocol or
+// CONNECTION_CLOSE_BEHAVIOR_ALL_PROTOCOLS, and that each behavior is valid.
+func (c ConnectionCloseBehaviors) Validate() error {
+	for tunnelProtocol, behavior := range c {
+		if tunnelProtocol != CONNECTION_CLOSE_BEHAVIOR_ALL_PROTOCOLS &&
+			!common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+			return common.ContextError(
+				fmt.Errorf("invalid tunnel protocol: %s", tunnelProtocol))
+		}
+		if behavior.RSTProbability < 0.0 || behavior.RSTProbability > 1.0 ||
+			behavior.LingerSeconds < 0 || behavior.MaxCloseDelayMilliseconds < 0 {
+			return common.ContextError(errors.New("invalid close behavior"))
+		}
+	}
+	return nil
+}
+
+// Behavior returns the close behavior for the specified tunnel protocol. A
+// protocol-specific entry takes precedence over the
+// CONNECTION_CLOSE_BEHAVIOR_ALL_PROTOCOLS entry. The zero value, the OS
+// default close behavior, is returned when neither entry exists.
+func (c ConnectionCloseBehaviors) Behavior(tunnelProtocol string) ConnectionCloseBehavior {
+	if behavior, ok := c[tunnelProtocol]; ok {
+		return behavior
+	}
+	return c[CONNECTION_CLOSE_BEHAVIOR_ALL_PROTOCOLS]
+}
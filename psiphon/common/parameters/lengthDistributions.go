@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// LENGTH_DISTRIBUTION_ALL_PROTOCOLS is the LengthDistributions key which
+// applies to all tunnel protocols without a specific entry.
+const LENGTH_DISTRIBUTION_ALL_PROTOCOLS = "All"
+
+// LengthRange is a range of target lengths, [MinLength, MaxLength], which
+// is selected with a probability proportional to Weight.
+type LengthRange struct {
+	MinLength int
+	MaxLength int
+	Weight    int
+}
+
+// LengthDistribution is a distribution of target lengths, specified as a
+// list of weighted ranges. An empirically derived distribution may be
+// approximated with a histogram of ranges.
+type LengthDistribution []LengthRange
+
+// LengthDistributions maps tunnel protocols to target length distributions.
+type LengthDistributions map[string]LengthDistribution
+
+// Validate checks that each key is a supported tunnel protocol or
+// LENGTH_DISTRIBUTION_ALL_PROTOCOLS, and that each distribution is valid.
+// Target lengths may not exceed PSIPHON_API_HANDSHAKE_MAX_PADDING_LENGTH,
+// which bounds the padding overhead.
+func (d LengthDistributions) Validate() error {
+	for tunnelProtocol, distribution := range d {
+		if tunnelProtocol != LENGTH_DISTRIBUTION_ALL_PROTOCOLS &&
+			!common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+			return common.ContextError(
+				fmt.Errorf("invalid tunnel protocol: %s", tunnelProtocol))
+		}
+		totalWeight := 0
+		for _, lengthRange := range distribution {
+			if lengthRange.MinLength < 0 ||
+				lengthRange.MinLength > lengthRange.MaxLength ||
+				lengthRange.MaxLength > protocol.PSIPHON_API_HANDSHAKE_MAX_PADDING_LENGTH ||
+				lengthRange.Weight < 0 {
+				return common.ContextError(errors.New("invalid length range"))
+			}
+			totalWeight += lengthRange.Weight
+		}
+		if len(distribution) > 0 && totalWeight == 0 {
+			return common.ContextError(errors.New("invalid length distribution weights"))
+		}
+	}
+	return nil
+}
+
+// SelectLength selects a random target length from the distribution for
+// the specified tunnel protocol. A protocol-specific entry takes precedence
+// over the LENGTH_DISTRIBUTION_ALL_PROTOCOLS entry. 0 is returned when
+// neither entry exists.
+func (d LengthDistributions) SelectLength(tunnelProtocol string) (int, error) {
+
+	distribution, ok := d[tunnelProtocol]
+	if !ok {
+		distribution = d[LENGTH_DISTRIBUTION_ALL_PROTOCOLS]
+	}
+
+	totalWeight := 0
+	for _, lengthRange := range distribution {
+		totalWeight += lengthRange.Weight
+	}
+	if totalWeight == 0 {
+		return 0, nil
+	}
+
+	n, err := common.MakeSecureRandomInt(totalWeight)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	for _, lengthRange := range distribution {
+		if n < lengthRange.Weight {
+			length, err := common.MakeSecureRandomRange(
+				lengthRange.MinLength, lengthRange.MaxLength)
+			if err != nil {
+				return 0, common.ContextError(err)
+			}
+			return length, nil
+		}
+		n -= lengthRange.Weight
+	}
+
+	// Not reached.
+	return 0, nil
+}
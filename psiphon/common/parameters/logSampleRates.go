@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// LOG_SAMPLE_RATE_ALL_PROTOCOLS is the LogSampleRates key which applies to
+// all tunnel protocols without a specific entry.
+const LOG_SAMPLE_RATE_ALL_PROTOCOLS = "All"
+
+// LogSampleRates maps tunnel protocols to the fraction, in [0.0, 1.0], of
+// events logged for connections using the protocol.
+type LogSampleRates map[string]float64
+
+// Validate checks that each key is a supported tunnel protocol or
+// LOG_SAMPLE_RATE_ALL_PROTOCOLS, and that each rate is valid.
+func (r LogSampleRates) Validate() error {
+	for tunnelProtocol, rate := range r {
+		if tunnelProtocol != LOG_SAMPLE_RATE_ALL_PROTOCOLS &&
+			!common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+			return common.ContextError(
+				fmt.Errorf("invalid tunnel protocol: %s", tunnelProtocol))
+		}
+		if rate < 0.0 || rate > 1.0 {
+			return common.ContextError(errors.New("invalid sample rate"))
+		}
+	}
+	return nil
+}
+
+// Rate returns the sample rate for the specified tunnel protocol. A
+// protocol-specific entry takes precedence over the
+// LOG_SAMPLE_RATE_ALL_PROTOCOLS entry. 1.0, log all events, is returned
+// when neither entry exists.
+func (r LogSampleRates) Rate(tunnelProtocol string) float64 {
+	if rate, ok := r[tunnelProtocol]; ok {
+		return rate
+	}
+	if rate, ok := r[LOG_SAMPLE_RATE_ALL_PROTOCOLS]; ok {
+		return rate
+	}
+	return 1.0
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// MINIMUM_CLIENT_VERSION_ALL_PROTOCOLS is the MinimumClientVersions key
+// which applies to all tunnel protocols without a specific entry.
+const MINIMUM_CLIENT_VERSION_ALL_PROTOCOLS = "All"
+
+// MinimumClientVersions maps tunnel protocols to the minimum client version,
+// the "client_version" handshake parameter, which may use the protocol.
+type MinimumClientVersions map[string]int
+
+// Validate checks that each key is a supported tunnel protocol or
+// MINIMUM_CLIENT_VERSION_ALL_PROTOCOLS, and that each version is not
+// negative.
+func (m MinimumClientVersions) Validate() error {
+	for tunnelProtocol, version := range m {
+		if tunnelProtocol != MINIMUM_CLIENT_VERSION_ALL_PROTOCOLS &&
+			!common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+			return common.ContextError(
+				fmt.Errorf("invalid tunnel protocol: %s", tunnelProtocol))
+		}
+		if version < 0 {
+			return common.ContextError(errors.New("invalid client version"))
+		}
+	}
+	return nil
+}
+
+// MinimumVersion returns the minimum client version for the specified
+// tunnel protocol. A protocol-specific entry takes precedence over the
+// MINIMUM_CLIENT_VERSION_ALL_PROTOCOLS entry. 0, no minimum, is returned
+// when neither entry exists.
+func (m MinimumClientVersions) MinimumVersion(tunnelProtocol string) int {
+	if version, ok := m[tunnelProtocol]; ok {
+		return version
+	}
+	return m[MINIMUM_CLIENT_VERSION_ALL_PROTOCOLS]
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// PortForwardDialOption specifies socket options and timeouts for TCP port
+// forwards dialed, by the server, to a destination port. Zero values retain
+// the server defaults.
+type PortForwardDialOption struct {
+
+	// DialTimeoutMilliseconds, when > 0, limits the outbound dial to the
+	// lesser of DialTimeoutMilliseconds and the client's remaining dial
+	// timeout.
+	DialTimeoutMilliseconds int
+
+	// IdleTimeoutMilliseconds, when > 0, replaces the traffic rules
+	// IdleTCPPortForwardTimeoutMilliseconds for the port forward.
+	IdleTimeoutMilliseconds int
+
+	// DisableNoDelay, when set, enables Nagle's algorithm, which may suit
+	// bulk transfers. By default, TCP_NODELAY is set, which suits
+	// interactive traffic.
+	DisableNoDelay bool
+
+	// KeepAlivePeriodMilliseconds, when > 0, is the TCP keep alive period.
+	// When < 0, TCP keep alives are disabled. When 0, the default keep alive
+	// period applies.
+	KeepAlivePeriodMilliseconds int
+
+	// ReadBufferBytes and WriteBufferBytes, when > 0, set the socket receive
+	// and send buffer sizes.
+	ReadBufferBytes  int
+	WriteBufferBytes int
+}
+
+// PortForwardDialOptions maps destination ports, as decimal strings, to the
+// dial options for TCP port forwards to the port.
+type PortForwardDialOptions map[string]PortForwardDialOption
+
+// Validate checks that each key is a valid port number and that each option
+// is valid.
+func (p PortForwardDialOptions) Validate() error {
+	for port, option := range p {
+		portNumber, err := strconv.Atoi(port)
+		if err != nil || portNumber < 1 || portNumber > 65535 {
+			return common.ContextError(fmt.Errorf("invalid port: %s", port))
+		}
+		if option.DialTimeoutMilliseconds < 0 ||
+			option.IdleTimeoutMilliseconds < 0 ||
+			option.ReadBufferBytes < 0 ||
+			option.WriteBufferBytes < 0 {
+			return common.ContextError(errors.New("invalid port forward dial option"))
+		}
+	}
+	return nil
+}
+
+// Option returns the dial options for the specified destination port. The
+// zero value, the server defaults, is returned when the port has no entry.
+func (p PortForwardDialOptions) Option(port int) PortForwardDialOption {
+	return p[strconv.Itoa(port)]
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"testing"
+)
+
+func TestPortForwardDialOptions(t *testing.T) {
+
+	options := PortForwardDialOptions{
+		"443": {DisableNoDelay: true, WriteBufferBytes: 262144},
+		"22":  {IdleTimeoutMilliseconds: 3600000, KeepAlivePeriodMilliseconds: 30000},
+	}
+
+	err := options.Validate()
+	if err != nil {
+		t.Fatalf("Validate failed: %s", err)
+	}
+
+	if !options.Option(443).DisableNoDelay ||
+		options.Option(22).IdleTimeoutMilliseconds != 3600000 {
+		t.Fatalf("unexpected option")
+	}
+
+	if options.Option(80) != (PortForwardDialOption{}) {
+		t.Fatalf("unexpected option for unlisted port")
+	}
+
+	for _, invalidOptions := range []PortForwardDialOptions{
+		{"http": {}},
+		{"0": {}},
+		{"65536": {}},
+		{"443": {DialTimeoutMilliseconds: -1}},
+		{"443": {ReadBufferBytes: -1}},
+	} {
+		err := invalidOptions.Validate()
+		if err == nil {
+			t.Fatalf("unexpected Validate success: %+v", invalidOptions)
+		}
+	}
+
+	// Invalid options are rejected by ClientParameters.Set.
+
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = p.Set("", false, map[string]interface{}{
+		ServerPortForwardDialOptions: map[string]interface{}{"http": map[string]interface{}{}},
+	})
+	if err == nil {
+		t.Fatalf("unexpected Set success")
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// RegionTunnelProtocols maps regions, ISO 3166-1 alpha-2 country codes, to
+// tunnel protocol lists.
+type RegionTunnelProtocols map[string]protocol.TunnelProtocols
+
+// Validate checks that each region is a two letter, upper case code and
+// that each tunnel protocol list is valid.
+func (r RegionTunnelProtocols) Validate() error {
+	for region, tunnelProtocols := range r {
+		if len(region) != 2 || strings.ToUpper(region) != region {
+			return common.ContextError(errors.New("invalid region"))
+		}
+		err := tunnelProtocols.Validate()
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
+	return nil
+}
+
+// Protocols returns the tunnel protocol list for the specified region, which
+// is matched case-insensitively. An empty list is returned when there is no
+// entry for the region.
+func (r RegionTunnelProtocols) Protocols(region string) protocol.TunnelProtocols {
+	return r[strings.ToUpper(region)]
+}
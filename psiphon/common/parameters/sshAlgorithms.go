@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+)
+
+const (
+	SSH_ALGORITHMS_PRESET_PERFORMANCE = "performance"
+)
+
+// SSHAlgorithmsPresets are named sets of preferred SSH algorithms.
+//
+// The "performance" preset prefers ChaCha20-Poly1305, which is faster than
+// AES on mobile devices without AES hardware acceleration, followed by
+// AES-GCM, either of which also avoids a separate MAC.
+var SSHAlgorithmsPresets = map[string]SSHAlgorithms{
+	SSH_ALGORITHMS_PRESET_PERFORMANCE: {
+		KeyExchanges: []string{"curve25519-sha256@libssh.org"},
+		Ciphers:      []string{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com"},
+	},
+}
+
+// SSHAlgorithms specifies preferred SSH key exchange, cipher, and MAC
+// algorithms, in preference order.
+//
+// Preferred algorithms are offered ahead of the default algorithms, which
+// are still offered, so that a peer which doesn't support any preferred
+// algorithm negotiates a default algorithm. When OmitDefaults is set, only
+// the preferred algorithms are offered, for classes with preferred
+// algorithms; this may be used to match the algorithms offered by another
+// SSH implementation, but fails to interoperate with peers that support
+// none of the preferred algorithms.
+//
+// When Preset is set, the named SSHAlgorithmsPresets entry supplies the
+// preferred algorithms for classes which have none specified.
+type SSHAlgorithms struct {
+	Preset       string
+	KeyExchanges []string
+	Ciphers      []string
+	MACs         []string
+	OmitDefaults bool
+}
+
+// Validate checks that the preset, if any, exists and that each algorithm
+// is one of the secure algorithms supported by the SSH implementation;
+// algorithms which the SSH implementation disables by default as insecure
+// are rejected.
+func (a SSHAlgorithms) Validate() error {
+
+	if a.Preset != "" {
+		if _, ok := SSHAlgorithmsPresets[a.Preset]; !ok {
+			return common.ContextError(
+				fmt.Errorf("unknown SSH algorithms preset: %s", a.Preset))
+		}
+	}
+
+	secure := ssh.SecureAlgorithms()
+
+	for _, check := range []struct {
+		class      string
+		algorithms []string
+		secure     []string
+	}{
+		{"key exchange", a.KeyExchanges, secure.KeyExchanges},
+		{"cipher", a.Ciphers, secure.Ciphers},
+		{"MAC", a.MACs, secure.MACs},
+	} {
+		for _, algorithm := range check.algorithms {
+			if !common.Contains(check.secure, algorithm) {
+				return common.ContextError(
+					fmt.Errorf("unsupported SSH %s algorithm: %s", check.class, algorithm))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Preferred returns the preferred algorithms, with any preset applied. When
+// omitEncryptThenMAC is set, Encrypt-then-MAC algorithms are omitted.
+//
+// The SSHAlgorithms value must be valid.
+func (a SSHAlgorithms) Preferred(omitEncryptThenMAC bool) ssh.Algorithms {
+
+	preset := SSHAlgorithmsPresets[a.Preset]
+
+	preferred := func(algorithms, presetAlgorithms []string) []string {
+		if len(algorithms) > 0 {
+			return algorithms
+		}
+		return presetAlgorithms
+	}
+
+	MACs := preferred(a.MACs, preset.MACs)
+	if omitEncryptThenMAC {
+		var nonETMMACs []string
+		for _, MAC := range MACs {
+			if !strings.Contains(MAC, "-etm@") {
+				nonETMMACs = append(nonETMMACs, MAC)
+			}
+		}
+		MACs = nonETMMACs
+	}
+
+	return ssh.Algorithms{
+		KeyExchanges: preferred(a.KeyExchanges, preset.KeyExchanges),
+		Ciphers:      preferred(a.Ciphers, preset.Ciphers),
+		MACs:         MACs,
+	}
+}
+
+// Offered returns the algorithms to offer in the SSH key exchange: the
+// Preferred algorithms followed, unless OmitDefaults is set, by defaults.
+// defaults is offered as-is for any class with no preferred algorithms.
+// When omitEncryptThenMAC is set, the caller is responsible for also
+// omitting Encrypt-then-MAC algorithms from defaults.
+//
+// The SSHAlgorithms value must be valid.
+func (a SSHAlgorithms) Offered(
+	defaults ssh.Algorithms, omitEncryptThenMAC bool) ssh.Algorithms {
+
+	offer := func(preferred, defaults []string) []string {
+		if len(preferred) == 0 {
+			return defaults
+		}
+		offered := append([]string(nil), preferred...)
+		if a.OmitDefaults {
+			return offered
+		}
+		for _, algorithm := range defaults {
+			if !common.Contains(offered, algorithm) {
+				offered = append(offered, algorithm)
+			}
+		}
+		return offered
+	}
+
+	preferred := a.Preferred(omitEncryptThenMAC)
+
+	return ssh.Algorithms{
+		KeyExchanges: offer(preferred.KeyExchanges, defaults.KeyExchanges),
+		Ciphers:      offer(preferred.Ciphers, defaults.Ciphers),
+		MACs:         offer(preferred.MACs, defaults.MACs),
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// TLSProfileGroups maps TLS profiles to the ordered list of key exchange
+// groups offered in the ClientHello when using the profile.
+type TLSProfileGroups map[string]protocol.TLSGroups
+
+// Validate checks that each TLS profile is supported and that each group
+// list is valid. The TLS 1.3 profile doesn't support GREASE values.
+func (t TLSProfileGroups) Validate() error {
+	for tlsProfile, groups := range t {
+		if !common.Contains(protocol.SupportedTLSProfiles, tlsProfile) {
+			return common.ContextError(fmt.Errorf("invalid TLS profile: %s", tlsProfile))
+		}
+		err := groups.Validate()
+		if err != nil {
+			return common.ContextError(err)
+		}
+		if tlsProfile == protocol.TLS_PROFILE_TLS13_RANDOMIZED &&
+			common.Contains(groups, protocol.TLS_GROUP_GREASE) {
+			return common.ContextError(
+				fmt.Errorf("unsupported TLS group for %s: %s", tlsProfile, protocol.TLS_GROUP_GREASE))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"errors"
+	"math"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// UserAgent specifies a User-Agent header value, its browser family, and
+// its selection weight.
+type UserAgent struct {
+
+	// UserAgent is the User-Agent header value.
+	UserAgent string
+
+	// Family is the browser family of the User-Agent, such as "Chrome". The
+	// family, not the exact value, is reported in tunnel stats.
+	Family string
+
+	// Weight is the relative likelihood of selecting this User-Agent. The
+	// weights are typically set to match real-world browser usage shares.
+	Weight float64
+}
+
+// UserAgents is a weighted pool of User-Agents.
+type UserAgents []*UserAgent
+
+// Validate checks that each UserAgent has a value, a family, and a positive
+// weight.
+func (u UserAgents) Validate() error {
+	for _, userAgent := range u {
+		if userAgent.UserAgent == "" || userAgent.Family == "" {
+			return common.ContextError(errors.New("missing User-Agent or family"))
+		}
+		if userAgent.Weight <= 0.0 || math.IsInf(userAgent.Weight, 0) {
+			return common.ContextError(errors.New("invalid User-Agent weight"))
+		}
+	}
+	return nil
+}
+
+// Select chooses a UserAgent from the pool at random, according to the
+// weights. Select returns nil when the pool is empty.
+func (u UserAgents) Select() *UserAgent {
+
+	if len(u) == 0 {
+		return nil
+	}
+
+	totalWeight := 0.0
+	for _, userAgent := range u {
+		totalWeight += userAgent.Weight
+	}
+
+	n, _ := common.MakeSecureRandomInt64(math.MaxInt64)
+	selection := float64(n) / float64(math.MaxInt64) * totalWeight
+
+	for _, userAgent := range u {
+		if selection < userAgent.Weight {
+			return userAgent
+		}
+		selection -= userAgent.Weight
+	}
+
+	// Floating point rounding may leave a small remainder.
+	return u[len(u)-1]
+}
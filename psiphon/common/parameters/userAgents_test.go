@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parameters
+
+import (
+	"testing"
+)
+
+func TestUserAgents(t *testing.T) {
+
+	invalid := []UserAgents{
+		{{UserAgent: "", Family: "Chrome", Weight: 1.0}},
+		{{UserAgent: "Mozilla/5.0", Family: "", Weight: 1.0}},
+		{{UserAgent: "Mozilla/5.0", Family: "Chrome", Weight: 0.0}},
+		{{UserAgent: "Mozilla/5.0", Family: "Chrome", Weight: -1.0}},
+	}
+
+	for _, userAgents := range invalid {
+		if userAgents.Validate() == nil {
+			t.Fatalf("unexpected validation success: %+v", userAgents[0])
+		}
+	}
+
+	if (UserAgents{}).Select() != nil {
+		t.Fatalf("unexpected selection from empty pool")
+	}
+
+	userAgents := UserAgents{
+		{UserAgent: "UserAgentA", Family: "Chrome", Weight: 0.7},
+		{UserAgent: "UserAgentB", Family: "Safari", Weight: 0.2},
+		{UserAgent: "UserAgentC", Family: "Firefox", Weight: 0.1},
+	}
+
+	err := userAgents.Validate()
+	if err != nil {
+		t.Fatalf("Validate failed: %s", err)
+	}
+
+	// Check that selections roughly follow the weights.
+
+	trials := 10000
+	counts := make(map[string]int)
+	for i := 0; i < trials; i++ {
+		counts[userAgents.Select().Family]++
+	}
+
+	for _, userAgent := range userAgents {
+		share := float64(counts[userAgent.Family]) / float64(trials)
+		if share < userAgent.Weight-0.05 || share > userAgent.Weight+0.05 {
+			t.Fatalf("unexpected %s share: %f", userAgent.Family, share)
+		}
+	}
+
+	// Check that an invalid pool is rejected by Set.
+
+	p, err := NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = p.Set("", false, map[string]interface{}{
+		MeekUserAgents: UserAgents{{UserAgent: "UserAgentA", Weight: 1.0}},
+	})
+	if err == nil {
+		t.Fatalf("unexpected Set success")
+	}
+
+	_, err = p.Set("", false, map[string]interface{}{MeekUserAgents: userAgents})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	if len(p.Get().UserAgents(MeekUserAgents)) != len(userAgents) {
+		t.Fatalf("unexpected UserAgents value")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"strconv"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// Features is a set of optional protocol feature bits, negotiated in the
+// handshake. The client advertises the features it supports and is
+// configured to use, in the PSIPHON_API_HANDSHAKE_CLIENT_FEATURES handshake
+// request parameter; the server responds, in HandshakeResponse.Features,
+// with the intersection of the client features and the features it
+// supports and has enabled. Each side then uses only the intersection of
+// its own features and the peer's features.
+//
+// Feature negotiation is compatible across version skews: bits unknown to
+// a peer are ignored, and never fatal, as the intersection excludes them;
+// a client that doesn't send features, or a server that doesn't respond
+// with features, has no negotiated features.
+//
+// Feature bits are never reused. New features must be added with a new
+// bit, and with the bit added to SupportedFeatures.
+type Features uint64
+
+const (
+	FEATURE_PORT_FORWARD_COMPRESSION Features = 1 << 0
+	FEATURE_BANDWIDTH_TEST           Features = 1 << 1
+
+	// SupportedFeatures is the set of all features implemented by this
+	// version.
+	SupportedFeatures = FEATURE_PORT_FORWARD_COMPRESSION | FEATURE_BANDWIDTH_TEST
+
+	// featuresMaxEncodedLength is the number of hex digits which encode
+	// 64 bits.
+	featuresMaxEncodedLength = 16
+)
+
+// Has indicates whether features includes all of the specified feature
+// bits.
+func (features Features) Has(feature Features) bool {
+	return features&feature == feature
+}
+
+// Negotiate returns the features in both features and peerFeatures.
+func (features Features) Negotiate(peerFeatures Features) Features {
+	return features & peerFeatures
+}
+
+// Encode returns the hex encoding of features.
+func (features Features) Encode() string {
+	return strconv.FormatUint(uint64(features), 16)
+}
+
+// DecodeFeatures decodes hex encoded features. Encodings from future
+// versions may exceed 64 bits; only the lowest 64 bits are decoded and the
+// remaining, unknown, bits are ignored. "" decodes as no features.
+func DecodeFeatures(encodedFeatures string) (Features, error) {
+
+	if encodedFeatures == "" {
+		return 0, nil
+	}
+
+	if len(encodedFeatures) > featuresMaxEncodedLength {
+		encodedFeatures = encodedFeatures[len(encodedFeatures)-featuresMaxEncodedLength:]
+	}
+
+	features, err := strconv.ParseUint(encodedFeatures, 16, 64)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return Features(features), nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+
+	features := SupportedFeatures
+
+	decodedFeatures, err := DecodeFeatures(features.Encode())
+	if err != nil {
+		t.Fatalf("DecodeFeatures failed: %s", err)
+	}
+	if decodedFeatures != features {
+		t.Fatalf("unexpected decoded features: %x", decodedFeatures)
+	}
+
+	if !features.Has(FEATURE_PORT_FORWARD_COMPRESSION) {
+		t.Fatalf("missing feature")
+	}
+
+	// Legacy peers send no features.
+
+	decodedFeatures, err = DecodeFeatures("")
+	if err != nil {
+		t.Fatalf("DecodeFeatures failed: %s", err)
+	}
+	if decodedFeatures != 0 ||
+		SupportedFeatures.Negotiate(decodedFeatures) != 0 {
+		t.Fatalf("unexpected legacy features: %x", decodedFeatures)
+	}
+
+	// Newer peers send unknown feature bits, including bits beyond 64.
+
+	futureFeatures := "f0000" + strings.Repeat("0", 16) + (SupportedFeatures | 1<<63).Encode()
+
+	decodedFeatures, err = DecodeFeatures(futureFeatures)
+	if err != nil {
+		t.Fatalf("DecodeFeatures failed: %s", err)
+	}
+	if decodedFeatures != SupportedFeatures|1<<63 {
+		t.Fatalf("unexpected future features: %x", decodedFeatures)
+	}
+	if SupportedFeatures.Negotiate(decodedFeatures) != SupportedFeatures {
+		t.Fatalf("unexpected negotiated features: %x",
+			SupportedFeatures.Negotiate(decodedFeatures))
+	}
+
+	// Features not enabled by either peer are not negotiated.
+
+	if Features(0).Negotiate(SupportedFeatures).Has(FEATURE_PORT_FORWARD_COMPRESSION) ||
+		SupportedFeatures.Negotiate(0).Has(FEATURE_PORT_FORWARD_COMPRESSION) {
+		t.Fatalf("unexpected negotiated feature")
+	}
+
+	_, err = DecodeFeatures("not hex")
+	if err == nil {
+		t.Fatalf("unexpected DecodeFeatures success")
+	}
+}
@@ -54,6 +54,8 @@ const (
 	PSIPHON_API_CONNECTED_REQUEST_NAME = "psiphon-connected"
 	PSIPHON_API_STATUS_REQUEST_NAME    = "psiphon-status"
 	PSIPHON_API_OSL_REQUEST_NAME       = "psiphon-osl"
+	PSIPHON_API_MIGRATE_REQUEST_NAME   = "psiphon-migrate"
+	PSIPHON_API_TACTICS_REQUEST_NAME   = "psiphon-tactics"
 
 	// PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME may still be used by older Android clients
 	PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME = "psiphon-client-verification"
@@ -65,7 +67,43 @@ const (
 
 	PACKET_TUNNEL_CHANNEL_TYPE = "tun@psiphon.ca"
 
+	// COMPRESSED_TCP_PORT_FORWARD_CHANNEL_TYPE is a TCP port forward
+	// channel, with the same extra data as "direct-tcpip", whose data is
+	// compressed using common.CompressedConn. Clients open this channel type
+	// only when FEATURE_PORT_FORWARD_COMPRESSION is negotiated or, for
+	// servers which don't negotiate features, when the handshake response
+	// indicates PortForwardCompression.
+	COMPRESSED_TCP_PORT_FORWARD_CHANNEL_TYPE = "compressed-direct-tcpip@psiphon.ca"
+
+	// BANDWIDTH_TEST_CHANNEL_TYPE is a bandwidth test channel, whose extra
+	// data is the SSH wire encoding of a BandwidthTestRequest. The client
+	// sends UpstreamBytes and then closes its side of the channel; the
+	// server then sends DownstreamBytes and closes the channel. Clients open
+	// this channel type only when FEATURE_BANDWIDTH_TEST is negotiated.
+	BANDWIDTH_TEST_CHANNEL_TYPE = "bandwidth-test@psiphon.ca"
+
+	// TRANSPARENT_DNS_RESOLVER_HOST is the destination host for TCP port
+	// forwards which the server redirects to its own DNS resolver. The
+	// reserved ".invalid" TLD ensures the host never resolves otherwise.
+	TRANSPARENT_DNS_RESOLVER_HOST = "dns.psiphon.invalid"
+
 	PSIPHON_API_HANDSHAKE_AUTHORIZATIONS = "authorizations"
+
+	PSIPHON_API_HANDSHAKE_CLIENT_FEATURES = "client_features"
+
+	// PSIPHON_API_HANDSHAKE_PADDING is a handshake request parameter which
+	// pads the encoded request to a target length. The value is random
+	// base64 characters, is ignored by the server, and may be no longer than
+	// PSIPHON_API_HANDSHAKE_MAX_PADDING_LENGTH.
+	PSIPHON_API_HANDSHAKE_PADDING            = "padding"
+	PSIPHON_API_HANDSHAKE_MAX_PADDING_LENGTH = 16384
+
+	// SERVER_LOAD_* are the coarse server load levels reported in the
+	// handshake response. Only the level is reported, not the number of
+	// connected clients.
+	SERVER_LOAD_LOW    = "low"
+	SERVER_LOAD_MEDIUM = "medium"
+	SERVER_LOAD_HIGH   = "high"
 )
 
 type TunnelProtocols []string
@@ -159,6 +197,11 @@ func TunnelProtocolIsFronted(protocol string) bool {
 	return protocol == TUNNEL_PROTOCOL_FRONTED_MEEK
 }
 
+func TunnelProtocolUsesFrontedMeek(protocol string) bool {
+	return protocol == TUNNEL_PROTOCOL_FRONTED_MEEK ||
+		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP
+}
+
 func TunnelProtocolIsResourceIntensive(protocol string) bool {
 	return TunnelProtocolUsesMeek(protocol) ||
 		TunnelProtocolUsesQUIC(protocol) ||
@@ -262,10 +305,91 @@ func (versions QUICVersions) PruneInvalid() QUICVersions {
 	return u
 }
 
+const (
+	TLS_GROUP_X25519 = "X25519"
+	TLS_GROUP_P256   = "P-256"
+	TLS_GROUP_P384   = "P-384"
+	TLS_GROUP_P521   = "P-521"
+	TLS_GROUP_GREASE = "GREASE"
+)
+
+// SupportedTLSGroups are the TLS key exchange groups which may be offered in
+// the ClientHello supported groups, and, for TLS 1.3, key share, extensions.
+// TLS_GROUP_GREASE is a placeholder for a random GREASE value, as sent by
+// Chrome; see RFC 8701.
+var SupportedTLSGroups = TLSGroups{
+	TLS_GROUP_X25519,
+	TLS_GROUP_P256,
+	TLS_GROUP_P384,
+	TLS_GROUP_P521,
+	TLS_GROUP_GREASE,
+}
+
+type TLSGroups []string
+
+// Validate checks that the list is not empty, that each group is supported,
+// and that no group is repeated.
+func (groups TLSGroups) Validate() error {
+	if len(groups) == 0 {
+		return common.ContextError(fmt.Errorf("empty TLS groups"))
+	}
+	for i, g := range groups {
+		if !common.Contains(SupportedTLSGroups, g) {
+			return common.ContextError(fmt.Errorf("invalid TLS group: %s", g))
+		}
+		if common.Contains(groups[:i], g) {
+			return common.ContextError(fmt.Errorf("duplicate TLS group: %s", g))
+		}
+	}
+	return nil
+}
+
+const (
+	ALPN_PROTOCOL_HTTP2   = "h2"
+	ALPN_PROTOCOL_HTTP1_1 = "http/1.1"
+)
+
+// SupportedMeekALPNProtocols are the TLS ALPN protocols which meek clients
+// and servers may negotiate. Each is a protocol the meek HTTP stacks can
+// speak, so any negotiated protocol is honored by both peers.
+var SupportedMeekALPNProtocols = ALPNProtocols{
+	ALPN_PROTOCOL_HTTP2,
+	ALPN_PROTOCOL_HTTP1_1,
+}
+
+type ALPNProtocols []string
+
+func (protocols ALPNProtocols) Validate() error {
+	for _, p := range protocols {
+		if !common.Contains(SupportedMeekALPNProtocols, p) {
+			return common.ContextError(fmt.Errorf("invalid ALPN protocol: %s", p))
+		}
+	}
+	return nil
+}
+
+func (protocols ALPNProtocols) PruneInvalid() ALPNProtocols {
+	q := make(ALPNProtocols, 0)
+	for _, p := range protocols {
+		if common.Contains(SupportedMeekALPNProtocols, p) {
+			q = append(q, p)
+		}
+	}
+	return q
+}
+
+// BandwidthTestRequest is the BANDWIDTH_TEST_CHANNEL_TYPE channel extra
+// data.
+type BandwidthTestRequest struct {
+	UpstreamBytes   uint64
+	DownstreamBytes uint64
+}
+
 type HandshakeResponse struct {
 	SSHSessionID           string              `json:"ssh_session_id"`
 	Homepages              []string            `json:"homepages"`
 	UpgradeClientVersion   string              `json:"upgrade_client_version"`
+	UpgradeRequired        bool                `json:"upgrade_required,omitempty"`
 	PageViewRegexes        []map[string]string `json:"page_view_regexes"`
 	HttpsRequestRegexes    []map[string]string `json:"https_request_regexes"`
 	EncodedServerList      []string            `json:"encoded_server_list"`
@@ -273,6 +397,10 @@ type HandshakeResponse struct {
 	ServerTimestamp        string              `json:"server_timestamp"`
 	ActiveAuthorizationIDs []string            `json:"active_authorization_ids"`
 	TacticsPayload         json.RawMessage     `json:"tactics_payload"`
+	EgressIPAddress        string              `json:"egress_ip_address,omitempty"`
+	ServerLoad             string              `json:"server_load,omitempty"`
+	PortForwardCompression bool                `json:"port_forward_compression,omitempty"`
+	Features               string              `json:"features,omitempty"`
 }
 
 type ConnectedResponse struct {
@@ -284,14 +412,131 @@ type OSLRequest struct {
 	SeedPayload     *osl.SeedPayload `json:"seed_payload"`
 }
 
+// MigrateRequest is sent by a server that is about to drain. The client is
+// expected to establish a replacement tunnel, preferring the servers in
+// EncodedServerList, before DeadlineSeconds elapses.
+type MigrateRequest struct {
+	DeadlineSeconds   int      `json:"deadline_seconds"`
+	EncodedServerList []string `json:"encoded_server_list"`
+}
+
+// TacticsRequest is sent by a server, after its tactics configuration is
+// reloaded, to push updated tactics to an established client.
+// TacticsPayload is a JSON-encoded tactics.Payload.
+type TacticsRequest struct {
+	TacticsPayload json.RawMessage `json:"tactics_payload"`
+}
+
 type SSHPasswordPayload struct {
 	SessionId          string   `json:"SessionId"`
 	SshPassword        string   `json:"SshPassword"`
 	ClientCapabilities []string `json:"ClientCapabilities"`
 }
 
+// MeekSessionTokenLocations are the request locations which may carry the
+// meek session token: the obfuscated meek cookie or, once issued, the
+// session ID. Meek servers accept the token in any location.
+//
+// The query location carries the token in a URL query parameter. The body
+// location prefixes the request body with the token, preceded by its 2-byte,
+// big-endian length.
+const (
+	MEEK_SESSION_TOKEN_LOCATION_COOKIE = "Cookie"
+	MEEK_SESSION_TOKEN_LOCATION_HEADER = "Header"
+	MEEK_SESSION_TOKEN_LOCATION_QUERY  = "Query"
+	MEEK_SESSION_TOKEN_LOCATION_BODY   = "Body"
+
+	MEEK_SESSION_TOKEN_DEFAULT_HEADER_NAME = "X-Session-Token"
+)
+
+var SupportedMeekSessionTokenLocations = []string{
+	MEEK_SESSION_TOKEN_LOCATION_COOKIE,
+	MEEK_SESSION_TOKEN_LOCATION_HEADER,
+	MEEK_SESSION_TOKEN_LOCATION_QUERY,
+	MEEK_SESSION_TOKEN_LOCATION_BODY,
+}
+
+// MeekURLSigningSchemes are the schemes for signing meek request URLs, for
+// fronting through CDNs which require signed, expiring URLs for origin
+// access. The scheme and signing key are specified in the server entry.
+//
+// The "cloudfront" scheme is a CloudFront canned policy signed URL, with an
+// RSA signing key. The "hmac-token" scheme, as supported by CDNs with URL
+// token authentication, adds a token query parameter,
+// "<expires>_<signature>", where the signature is the hex-encoded
+// HMAC-SHA256, with the signing key, of the URL path followed by the
+// decimal expiry time.
+//
+// The CDN validates the signature; meek servers ignore the
+// MeekURLSigningQueryParameters.
+const (
+	MEEK_URL_SIGNING_SCHEME_CLOUDFRONT = "cloudfront"
+	MEEK_URL_SIGNING_SCHEME_HMAC_TOKEN = "hmac-token"
+)
+
+var SupportedMeekURLSigningSchemes = []string{
+	MEEK_URL_SIGNING_SCHEME_CLOUDFRONT,
+	MEEK_URL_SIGNING_SCHEME_HMAC_TOKEN,
+}
+
+var MeekURLSigningQueryParameters = []string{
+	"Expires",
+	"Signature",
+	"Key-Pair-Id",
+	"token",
+}
+
+// MeekCookieData is the payload of the obfuscated meek cookie. When the
+// client doesn't carry the session token in a cookie, SessionIDHeader
+// specifies the response header in which the server returns the session ID;
+// otherwise, the session ID is returned in a Set-Cookie header.
+//
+// MaxChunkSize and MinChunkSize, when MaxChunkSize is not 0, bound the size
+// of meek response payloads for the session. The server starts with
+// responses of up to MaxChunkSize bytes and halves the size, down to
+// MinChunkSize, when the client retries a request; the client likewise
+// backs off its request payload size. See ClampMeekChunkSizes.
 type MeekCookieData struct {
 	MeekProtocolVersion  int    `json:"v"`
 	ClientTunnelProtocol string `json:"t"`
 	EndPoint             string `json:"e"`
+	SessionIDHeader      string `json:"h,omitempty"`
+	MaxChunkSize         int    `json:"c,omitempty"`
+	MinChunkSize         int    `json:"n,omitempty"`
+}
+
+// MEEK_MIN_CHUNK_SIZE and MEEK_MAX_CHUNK_SIZE bound meek request and
+// response payload chunk sizes. MEEK_MAX_CHUNK_SIZE is the default, fixed
+// chunk size used when chunk size backoff is not in effect.
+const (
+	MEEK_MIN_CHUNK_SIZE = 1024
+	MEEK_MAX_CHUNK_SIZE = 65536
+)
+
+// ClampMeekChunkSizes returns maxChunkSize and minChunkSize clamped to
+// MEEK_MIN_CHUNK_SIZE and MEEK_MAX_CHUNK_SIZE, with minChunkSize no greater
+// than maxChunkSize. A maxChunkSize of 0 is MEEK_MAX_CHUNK_SIZE, and a
+// minChunkSize of 0 is maxChunkSize, which disables backoff.
+func ClampMeekChunkSizes(maxChunkSize, minChunkSize int) (int, int) {
+	clamp := func(size int) int {
+		if size < MEEK_MIN_CHUNK_SIZE {
+			return MEEK_MIN_CHUNK_SIZE
+		}
+		if size > MEEK_MAX_CHUNK_SIZE {
+			return MEEK_MAX_CHUNK_SIZE
+		}
+		return size
+	}
+	if maxChunkSize == 0 {
+		maxChunkSize = MEEK_MAX_CHUNK_SIZE
+	}
+	maxChunkSize = clamp(maxChunkSize)
+	if minChunkSize == 0 {
+		minChunkSize = maxChunkSize
+	}
+	minChunkSize = clamp(minChunkSize)
+	if minChunkSize > maxChunkSize {
+		minChunkSize = maxChunkSize
+	}
+	return maxChunkSize, minChunkSize
 }
@@ -78,3 +78,30 @@ func TestTLSProfileValidation(t *testing.T) {
 		t.Errorf("unexpected %+v != %+v", prunedProfiles, SupportedTLSProfiles)
 	}
 }
+
+func TestClampMeekChunkSizes(t *testing.T) {
+
+	testCases := []struct {
+		maxChunkSize         int
+		minChunkSize         int
+		expectedMaxChunkSize int
+		expectedMinChunkSize int
+	}{
+		{0, 0, MEEK_MAX_CHUNK_SIZE, MEEK_MAX_CHUNK_SIZE},
+		{16384, 0, 16384, 16384},
+		{16384, 4096, 16384, 4096},
+		{1000000, 1, MEEK_MAX_CHUNK_SIZE, MEEK_MIN_CHUNK_SIZE},
+		{4096, 16384, 4096, 4096},
+	}
+
+	for _, testCase := range testCases {
+		maxChunkSize, minChunkSize := ClampMeekChunkSizes(
+			testCase.maxChunkSize, testCase.minChunkSize)
+		if maxChunkSize != testCase.expectedMaxChunkSize ||
+			minChunkSize != testCase.expectedMinChunkSize {
+
+			t.Errorf("unexpected chunk sizes for %+v: %d, %d",
+				testCase, maxChunkSize, minChunkSize)
+		}
+	}
+}
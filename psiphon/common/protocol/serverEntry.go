@@ -22,15 +22,21 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 )
 
 // ServerEntry represents a Psiphon server. It contains information
@@ -38,32 +44,40 @@ import (
 // several protocols. Server entries are JSON records downloaded from
 // various sources.
 type ServerEntry struct {
-	IpAddress                     string   `json:"ipAddress"`
-	WebServerPort                 string   `json:"webServerPort"` // not an int
-	WebServerSecret               string   `json:"webServerSecret"`
-	WebServerCertificate          string   `json:"webServerCertificate"`
-	SshPort                       int      `json:"sshPort"`
-	SshUsername                   string   `json:"sshUsername"`
-	SshPassword                   string   `json:"sshPassword"`
-	SshHostKey                    string   `json:"sshHostKey"`
-	SshObfuscatedPort             int      `json:"sshObfuscatedPort"`
-	SshObfuscatedQUICPort         int      `json:"sshObfuscatedQUICPort"`
-	SshObfuscatedKey              string   `json:"sshObfuscatedKey"`
-	Capabilities                  []string `json:"capabilities"`
-	Region                        string   `json:"region"`
-	MeekServerPort                int      `json:"meekServerPort"`
-	MeekCookieEncryptionPublicKey string   `json:"meekCookieEncryptionPublicKey"`
-	MeekObfuscatedKey             string   `json:"meekObfuscatedKey"`
-	MeekFrontingHost              string   `json:"meekFrontingHost"`
-	MeekFrontingHosts             []string `json:"meekFrontingHosts"`
-	MeekFrontingDomain            string   `json:"meekFrontingDomain"`
-	MeekFrontingAddresses         []string `json:"meekFrontingAddresses"`
-	MeekFrontingAddressesRegex    string   `json:"meekFrontingAddressesRegex"`
-	MeekFrontingDisableSNI        bool     `json:"meekFrontingDisableSNI"`
-	TacticsRequestPublicKey       string   `json:"tacticsRequestPublicKey"`
-	TacticsRequestObfuscatedKey   string   `json:"tacticsRequestObfuscatedKey"`
-	MarionetteFormat              string   `json:"marionetteFormat"`
-	ConfigurationVersion          int      `json:"configurationVersion"`
+	IpAddress                       string                       `json:"ipAddress"`
+	WebServerPort                   string                       `json:"webServerPort"` // not an int
+	WebServerSecret                 string                       `json:"webServerSecret"`
+	WebServerCertificate            string                       `json:"webServerCertificate"`
+	SshPort                         int                          `json:"sshPort"`
+	SshUsername                     string                       `json:"sshUsername"`
+	SshPassword                     string                       `json:"sshPassword"`
+	SshHostKey                      string                       `json:"sshHostKey"`
+	SshObfuscatedPort               int                          `json:"sshObfuscatedPort"`
+	SshObfuscatedQUICPort           int                          `json:"sshObfuscatedQUICPort"`
+	SshObfuscatedKey                string                       `json:"sshObfuscatedKey"`
+	SshObfuscatedKeys               map[string]string            `json:"sshObfuscatedKeys"`
+	Capabilities                    []string                     `json:"capabilities"`
+	Region                          string                       `json:"region"`
+	MeekServerPort                  int                          `json:"meekServerPort"`
+	MeekCookieEncryptionPublicKey   string                       `json:"meekCookieEncryptionPublicKey"`
+	MeekObfuscatedKey               string                       `json:"meekObfuscatedKey"`
+	MeekFrontingHost                string                       `json:"meekFrontingHost"`
+	MeekFrontingHosts               []string                     `json:"meekFrontingHosts"`
+	MeekFrontingDomain              string                       `json:"meekFrontingDomain"`
+	MeekFrontingAddresses           []string                     `json:"meekFrontingAddresses"`
+	MeekFrontingAddressesRegex      string                       `json:"meekFrontingAddressesRegex"`
+	MeekFrontingDisableSNI          bool                         `json:"meekFrontingDisableSNI"`
+	MeekFrontingDisableSNIAddresses []string                     `json:"meekFrontingDisableSNIAddresses"`
+	MeekPathPrefix                  string                       `json:"meekPathPrefix"`
+	MeekURLSigningScheme            string                       `json:"meekURLSigningScheme"`
+	MeekURLSigningKeyID             string                       `json:"meekURLSigningKeyID"`
+	MeekURLSigningKey               string                       `json:"meekURLSigningKey"`
+	TacticsRequestPublicKey         string                       `json:"tacticsRequestPublicKey"`
+	TacticsRequestObfuscatedKey     string                       `json:"tacticsRequestObfuscatedKey"`
+	MarionetteFormat                string                       `json:"marionetteFormat"`
+	ConfigurationVersion            int                          `json:"configurationVersion"`
+	ObfuscationParameters           *ObfuscationParameters       `json:"obfuscationParameters,omitempty"`
+	MeekFrontingTLSVerification     *MeekFrontingTLSVerification `json:"meekFrontingTLSVerification,omitempty"`
 
 	// These local fields are not expected to be present in downloaded server
 	// entries. They are added by the client to record and report stats about
@@ -101,11 +115,42 @@ func (fields ServerEntryFields) GetConfigurationVersion() int {
 	if !ok {
 		return 0
 	}
-	configurationVersionInt, ok := configurationVersion.(int)
+	// JSON numbers are unmarshaled to ServerEntryFields as float64 values.
+	switch v := configurationVersion.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+func (fields ServerEntryFields) GetLocalSource() string {
+	localSource, ok := fields["localSource"]
+	if !ok {
+		return ""
+	}
+	localSourceStr, ok := localSource.(string)
+	if !ok {
+		return ""
+	}
+	return localSourceStr
+}
+
+// GetMeekFrontingAddressesCount returns the number of items in the
+// meekFrontingAddresses field.
+func (fields ServerEntryFields) GetMeekFrontingAddressesCount() int {
+	meekFrontingAddresses, ok := fields["meekFrontingAddresses"]
 	if !ok {
 		return 0
 	}
-	return configurationVersionInt
+	switch addresses := meekFrontingAddresses.(type) {
+	case []interface{}:
+		return len(addresses)
+	case []string:
+		return len(addresses)
+	}
+	return 0
 }
 
 func (fields ServerEntryFields) SetLocalSource(source string) {
@@ -116,6 +161,179 @@ func (fields ServerEntryFields) SetLocalTimestamp(timestamp string) {
 	fields["localTimestamp"] = timestamp
 }
 
+const (
+	SERVER_ENTRY_MAX_FRAGMENTOR_WRITE_BYTES = 1500
+	SERVER_ENTRY_MAX_FRAGMENTOR_DELAY       = 100 * time.Millisecond
+)
+
+// ObfuscationParameters are optional, server-specific overrides of the
+// obfuscation client parameters, which allow for tuning and experimentation
+// with individual servers. When dialing the server, each specified value
+// replaces the corresponding client parameter value. Fragmentor overrides
+// apply only when fragmentation is selected for the dial.
+//
+// While server entries are signed, the overrides are bounded by Validate
+// and the client ignores invalid overrides, so that a faulty or malicious
+// server entry cannot force degenerate obfuscation, such as excessive
+// padding or delays.
+type ObfuscationParameters struct {
+	ObfuscatedSSHMinPadding        *int `json:"obfuscatedSSHMinPadding,omitempty"`
+	ObfuscatedSSHMaxPadding        *int `json:"obfuscatedSSHMaxPadding,omitempty"`
+	FragmentorMinWriteBytes        *int `json:"fragmentorMinWriteBytes,omitempty"`
+	FragmentorMaxWriteBytes        *int `json:"fragmentorMaxWriteBytes,omitempty"`
+	FragmentorMinDelayMicroseconds *int `json:"fragmentorMinDelayMicroseconds,omitempty"`
+	FragmentorMaxDelayMicroseconds *int `json:"fragmentorMaxDelayMicroseconds,omitempty"`
+}
+
+// Validate checks that all specified overrides are within bounds. When
+// both the minimum and the maximum of a range are specified, the minimum
+// must not exceed the maximum; when only one is specified, the range is
+// checked by the client after applying the override.
+func (params *ObfuscationParameters) Validate() error {
+
+	checkRange := func(name string, min, max *int, lower, upper int) error {
+		if min != nil && (*min < lower || *min > upper) {
+			return common.ContextError(fmt.Errorf("invalid %s minimum: %d", name, *min))
+		}
+		if max != nil && (*max < lower || *max > upper) {
+			return common.ContextError(fmt.Errorf("invalid %s maximum: %d", name, *max))
+		}
+		if min != nil && max != nil && *min > *max {
+			return common.ContextError(fmt.Errorf("invalid %s range: %d-%d", name, *min, *max))
+		}
+		return nil
+	}
+
+	err := checkRange(
+		"obfuscated SSH padding",
+		params.ObfuscatedSSHMinPadding,
+		params.ObfuscatedSSHMaxPadding,
+		0,
+		obfuscator.OBFUSCATE_MAX_PADDING)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = checkRange(
+		"fragmentor write bytes",
+		params.FragmentorMinWriteBytes,
+		params.FragmentorMaxWriteBytes,
+		1,
+		SERVER_ENTRY_MAX_FRAGMENTOR_WRITE_BYTES)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = checkRange(
+		"fragmentor delay",
+		params.FragmentorMinDelayMicroseconds,
+		params.FragmentorMaxDelayMicroseconds,
+		0,
+		int(SERVER_ENTRY_MAX_FRAGMENTOR_DELAY/time.Microsecond))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// GetObfuscationParameters returns the server entry obfuscation parameter
+// overrides, or nil when there are no overrides or when the overrides are
+// invalid, in which case an error is also returned. The client parameters
+// are then to be used as-is.
+func (serverEntry *ServerEntry) GetObfuscationParameters() (*ObfuscationParameters, error) {
+	if serverEntry.ObfuscationParameters == nil {
+		return nil, nil
+	}
+	err := serverEntry.ObfuscationParameters.Validate()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return serverEntry.ObfuscationParameters, nil
+}
+
+const (
+	MEEK_FRONTING_TLS_VERIFICATION_FULL          = "full"
+	MEEK_FRONTING_TLS_VERIFICATION_PIN           = "pin"
+	MEEK_FRONTING_TLS_VERIFICATION_SKIP_HOSTNAME = "skip-hostname"
+)
+
+// MeekFrontingTLSVerification is an optional, server-specific policy for
+// verifying the TLS certificate presented by the front, the CDN edge, when
+// dialing fronted meek. Without a policy, the front's certificate is not
+// verified, as described in DialMeek. The policies are:
+//
+// - "full": verify the certificate chain and that the certificate matches
+// the SNI server name or, when SNI is disabled, the fronting address.
+//
+// - "pin": verify only that the leaf certificate public key matches one of
+// Pins, each the base64-encoded SHA-256 digest of a SubjectPublicKeyInfo.
+// This supports fronts with misconfigured, but stable, certificates.
+//
+// - "skip-hostname": verify the certificate chain but not the hostname,
+// for fronts whose valid certificates legitimately don't match the
+// fronting address or SNI server name.
+//
+// The policy applies only to fronted meek HTTPS and there is no policy
+// which disables verification, so a server entry cannot weaken the
+// verification of unfronted connections.
+type MeekFrontingTLSVerification struct {
+	Policy string   `json:"policy"`
+	Pins   []string `json:"pins,omitempty"`
+}
+
+// Validate checks that the policy is a supported policy and that pins are
+// specified, and are valid, if and only if the policy is "pin".
+func (verification *MeekFrontingTLSVerification) Validate() error {
+
+	switch verification.Policy {
+	case MEEK_FRONTING_TLS_VERIFICATION_FULL,
+		MEEK_FRONTING_TLS_VERIFICATION_SKIP_HOSTNAME:
+
+		if len(verification.Pins) > 0 {
+			return common.ContextError(
+				fmt.Errorf("unexpected pins for policy: %s", verification.Policy))
+		}
+
+	case MEEK_FRONTING_TLS_VERIFICATION_PIN:
+
+		if len(verification.Pins) == 0 {
+			return common.ContextError(errors.New("missing pins"))
+		}
+		for _, pin := range verification.Pins {
+			digest, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(digest) != sha256.Size {
+				return common.ContextError(fmt.Errorf("invalid pin: %s", pin))
+			}
+		}
+
+	default:
+		return common.ContextError(
+			fmt.Errorf("invalid policy: %s", verification.Policy))
+	}
+
+	return nil
+}
+
+// GetMeekFrontingTLSVerification returns the server entry fronting TLS
+// verification policy to apply when dialing with the specified tunnel
+// protocol. nil is returned when there is no policy or when the protocol
+// is not fronted meek HTTPS. An error is returned when the policy is
+// invalid; the dial should not proceed, as the policy can't be applied.
+func (serverEntry *ServerEntry) GetMeekFrontingTLSVerification(
+	tunnelProtocol string) (*MeekFrontingTLSVerification, error) {
+
+	if serverEntry.MeekFrontingTLSVerification == nil ||
+		!TunnelProtocolIsFronted(tunnelProtocol) {
+		return nil, nil
+	}
+	err := serverEntry.MeekFrontingTLSVerification.Validate()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return serverEntry.MeekFrontingTLSVerification, nil
+}
+
 // GetCapability returns the server capability corresponding
 // to the tunnel protocol.
 func GetCapability(protocol string) string {
@@ -135,6 +353,17 @@ func (serverEntry *ServerEntry) SupportsProtocol(protocol string) bool {
 	return common.Contains(serverEntry.Capabilities, requiredCapability)
 }
 
+// GetObfuscatedSSHKey returns the Obfuscated SSH secret key to use for the
+// specified tunnel protocol. When the server entry has a distinct key for
+// the protocol, in SshObfuscatedKeys, that key is used; otherwise the key
+// shared by all protocols, SshObfuscatedKey, is used.
+func (serverEntry *ServerEntry) GetObfuscatedSSHKey(protocol string) string {
+	if key, ok := serverEntry.SshObfuscatedKeys[protocol]; ok {
+		return key
+	}
+	return serverEntry.SshObfuscatedKey
+}
+
 // GetSupportedProtocols returns a list of tunnel protocols supported
 // by the ServerEntry's capabilities.
 func (serverEntry *ServerEntry) GetSupportedProtocols(
@@ -305,8 +534,13 @@ func decodeServerEntry(
 }
 
 // ValidateServerEntryFields checks for malformed server entries.
-// Currently, it checks for a valid ipAddress. This is important since
-// the IP address is the key used to store/lookup the server entry.
+// It checks for a valid ipAddress. This is important since the IP
+// address is the key used to store/lookup the server entry.
+//
+// ValidateServerEntryFields also rejects entries with implausible port
+// values, which cannot be dialed and may indicate a buggy or malicious
+// server entry source. Port fields which are not present, or zero, are
+// permitted, as not all servers support all protocols.
 // TODO: validate more fields?
 func ValidateServerEntryFields(serverEntryFields ServerEntryFields) error {
 	ipAddress := serverEntryFields.GetIPAddress()
@@ -314,9 +548,55 @@ func ValidateServerEntryFields(serverEntryFields ServerEntryFields) error {
 		return common.ContextError(
 			fmt.Errorf("server entry has invalid ipAddress: %s", ipAddress))
 	}
+
+	if webServerPort, ok := serverEntryFields["webServerPort"]; ok {
+		webServerPortStr, ok := webServerPort.(string)
+		if !ok {
+			return common.ContextError(
+				fmt.Errorf("server entry has invalid webServerPort: %v", webServerPort))
+		}
+		if webServerPortStr != "" {
+			port, err := strconv.Atoi(webServerPortStr)
+			if err != nil || port < 1 || port > 65535 {
+				return common.ContextError(
+					fmt.Errorf("server entry has invalid webServerPort: %s", webServerPortStr))
+			}
+		}
+	}
+
+	for _, name := range serverEntryPortFields {
+		value, ok := serverEntryFields[name]
+		if !ok {
+			continue
+		}
+		var port float64
+		switch v := value.(type) {
+		case float64:
+			port = v
+		case int:
+			port = float64(v)
+		default:
+			ok = false
+		}
+		if !ok || port != float64(int(port)) || port < 0 || port > 65535 {
+			return common.ContextError(
+				fmt.Errorf("server entry has invalid %s: %v", name, value))
+		}
+	}
+
 	return nil
 }
 
+// serverEntryPortFields are the integer port fields checked by
+// ValidateServerEntryFields. JSON numbers are unmarshaled into
+// ServerEntryFields as float64 values; int values are also accepted.
+var serverEntryPortFields = []string{
+	"sshPort",
+	"sshObfuscatedPort",
+	"sshObfuscatedQUICPort",
+	"meekServerPort",
+}
+
 // DecodeServerEntryList extracts server entries from the list encoding
 // used by remote server lists and Psiphon server handshake requests.
 // Each server entry is validated and invalid entries are skipped.
@@ -354,6 +634,22 @@ type StreamingServerEntryDecoder struct {
 	scanner           *bufio.Scanner
 	timestamp         string
 	serverEntrySource string
+	workers           int
+	startOnce         sync.Once
+	stopOnce          sync.Once
+	stopBroadcast     chan struct{}
+	decodes           chan *serverEntryDecode
+	scanErr           error
+}
+
+// serverEntryDecode is a single encoded server entry line which is decoded
+// by a StreamingServerEntryDecoder worker. done is closed once the decode
+// is complete.
+type serverEntryDecode struct {
+	encodedServerEntry string
+	serverEntryFields  ServerEntryFields
+	err                error
+	done               chan struct{}
 }
 
 // NewStreamingServerEntryDecoder creates a new StreamingServerEntryDecoder.
@@ -365,23 +661,49 @@ func NewStreamingServerEntryDecoder(
 		scanner:           bufio.NewScanner(encodedServerEntryListReader),
 		timestamp:         timestamp,
 		serverEntrySource: serverEntrySource,
+		workers:           1,
 	}
 }
 
+// NewParallelStreamingServerEntryDecoder creates a new
+// StreamingServerEntryDecoder which decodes and validates server entries
+// using the specified number of concurrent workers. Next still returns
+// server entries in input order, and at most a small multiple of workers
+// decoded server entries are buffered at once.
+//
+// The caller must call Close when done with the decoder, to stop the
+// workers in the case where the stream is not read to completion.
+func NewParallelStreamingServerEntryDecoder(
+	encodedServerEntryListReader io.Reader,
+	timestamp, serverEntrySource string,
+	workers int) *StreamingServerEntryDecoder {
+
+	decoder := NewStreamingServerEntryDecoder(
+		encodedServerEntryListReader, timestamp, serverEntrySource)
+	if workers > 1 {
+		decoder.workers = workers
+		decoder.stopBroadcast = make(chan struct{})
+	}
+	return decoder
+}
+
 // Next reads and decodes, and validates the next server entry from the
 // input stream, returning a nil server entry when the stream is complete.
 //
 // Limitations:
-// - Each encoded server entry line cannot exceed bufio.MaxScanTokenSize,
-//   the default buffer size which this decoder uses. This is 64K.
-// - DecodeServerEntry is called on each encoded server entry line, which
-//   will allocate memory to hex decode and JSON deserialze the server
-//   entry. As this is not presently reusing a fixed buffer, each call
-//   will allocate additional memory; garbage collection is necessary to
-//   reclaim that memory for reuse for the next server entry.
-//
+//   - Each encoded server entry line cannot exceed bufio.MaxScanTokenSize,
+//     the default buffer size which this decoder uses. This is 64K.
+//   - DecodeServerEntry is called on each encoded server entry line, which
+//     will allocate memory to hex decode and JSON deserialze the server
+//     entry. As this is not presently reusing a fixed buffer, each call
+//     will allocate additional memory; garbage collection is necessary to
+//     reclaim that memory for reuse for the next server entry.
 func (decoder *StreamingServerEntryDecoder) Next() (ServerEntryFields, error) {
 
+	if decoder.workers > 1 {
+		return decoder.parallelNext()
+	}
+
 	for {
 		if !decoder.scanner.Scan() {
 			return nil, common.ContextError(decoder.scanner.Err())
@@ -390,18 +712,125 @@ func (decoder *StreamingServerEntryDecoder) Next() (ServerEntryFields, error) {
 		// TODO: use scanner.Bytes which doesn't allocate, instead of scanner.Text
 
 		// TODO: skip this entry and continue if can't decode?
-		serverEntryFields, err := DecodeServerEntryFields(
-			decoder.scanner.Text(), decoder.timestamp, decoder.serverEntrySource)
+		serverEntryFields, err := decoder.decode(decoder.scanner.Text())
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
 
-		if ValidateServerEntryFields(serverEntryFields) != nil {
+		if serverEntryFields == nil {
 			// Skip this entry and continue with the next one
-			// TODO: invoke a logging callback
 			continue
 		}
 
 		return serverEntryFields, nil
 	}
 }
+
+// Close stops any decoder workers. Close doesn't close the underlying
+// reader.
+func (decoder *StreamingServerEntryDecoder) Close() {
+	if decoder.workers > 1 {
+		decoder.stopOnce.Do(func() {
+			close(decoder.stopBroadcast)
+		})
+	}
+}
+
+// decode decodes and validates a single encoded server entry. A nil server
+// entry and nil error is returned for an invalid server entry, which is to
+// be skipped.
+func (decoder *StreamingServerEntryDecoder) decode(
+	encodedServerEntry string) (ServerEntryFields, error) {
+
+	serverEntryFields, err := DecodeServerEntryFields(
+		encodedServerEntry, decoder.timestamp, decoder.serverEntrySource)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if ValidateServerEntryFields(serverEntryFields) != nil {
+		// TODO: invoke a logging callback
+		return nil, nil
+	}
+
+	return serverEntryFields, nil
+}
+
+func (decoder *StreamingServerEntryDecoder) parallelNext() (ServerEntryFields, error) {
+
+	decoder.startOnce.Do(decoder.startWorkers)
+
+	for {
+		select {
+		case <-decoder.stopBroadcast:
+			return nil, common.ContextError(errors.New("decoder closed"))
+		case decode, ok := <-decoder.decodes:
+			if !ok {
+				// decoder.scanErr is set before decodes is closed.
+				return nil, common.ContextError(decoder.scanErr)
+			}
+
+			<-decode.done
+
+			if decode.err != nil {
+				return nil, common.ContextError(decode.err)
+			}
+
+			if decode.serverEntryFields == nil {
+				continue
+			}
+
+			return decode.serverEntryFields, nil
+		}
+	}
+}
+
+// startWorkers starts a scanner goroutine, which reads encoded server entry
+// lines and enqueues them both for a decode worker and, in input order, for
+// Next; and the decode workers.
+func (decoder *StreamingServerEntryDecoder) startWorkers() {
+
+	// The decodes queue length bounds the number of encoded and decoded
+	// server entries held in memory.
+	decoder.decodes = make(chan *serverEntryDecode, 2*decoder.workers)
+
+	pending := make(chan *serverEntryDecode, decoder.workers)
+
+	go func() {
+		defer close(decoder.decodes)
+		defer close(pending)
+
+		for decoder.scanner.Scan() {
+
+			decode := &serverEntryDecode{
+				encodedServerEntry: decoder.scanner.Text(),
+				done:               make(chan struct{}),
+			}
+
+			select {
+			case decoder.decodes <- decode:
+			case <-decoder.stopBroadcast:
+				return
+			}
+
+			select {
+			case pending <- decode:
+			case <-decoder.stopBroadcast:
+				return
+			}
+		}
+
+		decoder.scanErr = decoder.scanner.Err()
+	}()
+
+	for i := 0; i < decoder.workers; i++ {
+		go func() {
+			for decode := range pending {
+				decode.serverEntryFields, decode.err = decoder.decode(
+					decode.encodedServerEntry)
+				decode.encodedServerEntry = ""
+				close(decode.done)
+			}
+		}()
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// ServerEntryRevocationList is a list of revoked server entries, such as
+// the server entries of decommissioned servers. Clients skip revoked server
+// entries, which may still be replayed, with their original, valid
+// signatures; for example, by a censor which operates a sinkhole at a
+// decommissioned server's former IP address.
+//
+// The list is distributed in an AuthenticatedDataPackage, signed with the
+// remote server list signing key. Each new list must have a higher
+// SequenceNumber than the previous list, which prevents rolling back to
+// an older list with fewer revocations.
+type ServerEntryRevocationList struct {
+	SequenceNumber       int64                `json:"sequenceNumber"`
+	RevokedServerEntries []RevokedServerEntry `json:"revokedServerEntries"`
+}
+
+// RevokedServerEntry revokes all server entries with the specified IP
+// address and a configuration version less than or equal to
+// ConfigurationVersion. Server entries with higher configuration versions,
+// such as the server entry of a new server reusing the IP address, are not
+// revoked.
+type RevokedServerEntry struct {
+	IPAddress            string `json:"ipAddress"`
+	ConfigurationVersion int    `json:"configurationVersion"`
+}
+
+// DecodeServerEntryRevocationList unmarshals and validates a
+// ServerEntryRevocationList, which must be the payload of an authenticated
+// data package.
+func DecodeServerEntryRevocationList(payload string) (*ServerEntryRevocationList, error) {
+
+	var list *ServerEntryRevocationList
+	err := json.Unmarshal([]byte(payload), &list)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if list == nil {
+		return nil, common.ContextError(errors.New("missing revocation list"))
+	}
+
+	for _, revokedServerEntry := range list.RevokedServerEntries {
+		if net.ParseIP(revokedServerEntry.IPAddress) == nil {
+			return nil, common.ContextError(errors.New("invalid revoked IP address"))
+		}
+	}
+
+	return list, nil
+}
+
+// GetRevokedConfigurationVersions returns a map from revoked server entry
+// IP address to the highest revoked configuration version.
+func (list *ServerEntryRevocationList) GetRevokedConfigurationVersions() map[string]int {
+
+	revoked := make(map[string]int)
+	for _, revokedServerEntry := range list.RevokedServerEntries {
+		version, ok := revoked[revokedServerEntry.IPAddress]
+		if !ok || revokedServerEntry.ConfigurationVersion > version {
+			revoked[revokedServerEntry.IPAddress] = revokedServerEntry.ConfigurationVersion
+		}
+	}
+	return revoked
+}
+
+// IsRevokedServerEntry indicates whether the server entry is revoked, given revoked
+// configuration versions from GetRevokedConfigurationVersions.
+func IsRevokedServerEntry(
+	revoked map[string]int, serverEntryFields ServerEntryFields) bool {
+
+	version, ok := revoked[serverEntryFields.GetIPAddress()]
+	return ok && serverEntryFields.GetConfigurationVersion() <= version
+}
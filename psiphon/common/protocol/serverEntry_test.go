@@ -21,7 +21,10 @@ package protocol
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/hex"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -33,6 +36,8 @@ const (
 	_VALID_FUTURE_SERVER_ENTRY                    = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.1","webServerPort":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>","dummyFutureField":"dummyFutureField"}`
 	_INVALID_WINDOWS_REGISTRY_LEGACY_SERVER_ENTRY = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
 	_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY    = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.","webServerPort":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
+	_INVALID_PORT_SERVER_ENTRY                    = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.1","webServerPort":"80","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":70000,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
+	_INVALID_WEB_SERVER_PORT_SERVER_ENTRY         = `192.168.0.1 80 <webServerSecret> <webServerCertificate> {"ipAddress":"192.168.0.1","webServerPort":"0","webServerSecret":"<webServerSecret>","webServerCertificate":"<webServerCertificate>","sshPort":22,"sshUsername":"<sshUsername>","sshPassword":"<sshPassword>","sshHostKey":"<sshHostKey>","sshObfuscatedPort":443,"sshObfuscatedKey":"<sshObfuscatedKey>","capabilities":["handshake","SSH","OSSH","VPN"],"region":"CA","meekServerPort":8080,"meekCookieEncryptionPublicKey":"<meekCookieEncryptionPublicKey>","meekObfuscatedKey":"<meekObfuscatedKey>","meekFrontingDomain":"<meekFrontingDomain>","meekFrontingHost":"<meekFrontingHost>"}`
 	_EXPECTED_IP_ADDRESS                          = `192.168.0.1`
 	_EXPECTED_DUMMY_FUTURE_FIELD                  = `dummyFutureField`
 )
@@ -119,10 +124,126 @@ func TestStreamingServerEntryDecoder(t *testing.T) {
 	}
 }
 
+func TestParallelStreamingServerEntryDecoder(t *testing.T) {
+
+	// Server entries are returned in input order, with invalid entries
+	// skipped.
+
+	serverEntryCount := 1000
+	encodedServerEntryList := makeTestEncodedServerEntryList(serverEntryCount)
+
+	decoder := NewParallelStreamingServerEntryDecoder(
+		strings.NewReader(encodedServerEntryList),
+		common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_REMOTE, 4)
+	defer decoder.Close()
+
+	for i := 0; ; i++ {
+		serverEntryFields, err := decoder.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %s", err)
+		}
+		if serverEntryFields == nil {
+			if i != serverEntryCount {
+				t.Fatalf("unexpected number of valid server entries: %d", i)
+			}
+			break
+		}
+		if serverEntryFields.GetIPAddress() != makeTestIPAddress(i) {
+			t.Fatalf("unexpected server entry order: %s", serverEntryFields.GetIPAddress())
+		}
+	}
+
+	// A decode failure fails the stream, after returning all preceding
+	// server entries.
+
+	decoder = NewParallelStreamingServerEntryDecoder(
+		strings.NewReader(
+			makeTestEncodedServerEntryList(10)+"\ninvalid\n"+
+				makeTestEncodedServerEntryList(10)),
+		common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_REMOTE, 4)
+	defer decoder.Close()
+
+	count := 0
+	for {
+		serverEntryFields, err := decoder.Next()
+		if err != nil {
+			break
+		}
+		if serverEntryFields == nil {
+			t.Fatalf("unexpected decode success")
+		}
+		count += 1
+	}
+	if count != 10 {
+		t.Fatalf("unexpected number of valid server entries: %d", count)
+	}
+
+	// Close stops a decoder which is not read to completion.
+
+	decoder = NewParallelStreamingServerEntryDecoder(
+		strings.NewReader(encodedServerEntryList),
+		common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_REMOTE, 4)
+	_, err := decoder.Next()
+	if err != nil {
+		t.Fatalf("Next failed: %s", err)
+	}
+	decoder.Close()
+}
+
+func BenchmarkStreamingServerEntryDecoder(b *testing.B) {
+
+	encodedServerEntryList := makeTestEncodedServerEntryList(10000)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				decoder := NewParallelStreamingServerEntryDecoder(
+					strings.NewReader(encodedServerEntryList),
+					common.GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_REMOTE, workers)
+				for {
+					serverEntryFields, err := decoder.Next()
+					if err != nil {
+						b.Fatalf("Next failed: %s", err)
+					}
+					if serverEntryFields == nil {
+						break
+					}
+				}
+				decoder.Close()
+			}
+		})
+	}
+}
+
+func makeTestIPAddress(i int) string {
+	return fmt.Sprintf("10.%d.%d.%d", (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+}
+
+// makeTestEncodedServerEntryList returns an encoded server entry list with
+// count valid server entries, each with a distinct IP address, interleaved
+// with invalid server entries.
+func makeTestEncodedServerEntryList(count int) string {
+	encodedServerEntries := make([]string, 0, 2*count)
+	for i := 0; i < count; i++ {
+		serverEntry := strings.Replace(
+			_VALID_NORMAL_SERVER_ENTRY, _EXPECTED_IP_ADDRESS, makeTestIPAddress(i), -1)
+		encodedServerEntries = append(
+			encodedServerEntries,
+			hex.EncodeToString([]byte(serverEntry)),
+			hex.EncodeToString([]byte(_INVALID_PORT_SERVER_ENTRY)))
+	}
+	return strings.Join(encodedServerEntries, "\n")
+}
+
 // Directly call DecodeServerEntryFields and ValidateServerEntry with invalid inputs
 func TestInvalidServerEntries(t *testing.T) {
 
-	testCases := [2]string{_INVALID_WINDOWS_REGISTRY_LEGACY_SERVER_ENTRY, _INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY}
+	testCases := [4]string{
+		_INVALID_WINDOWS_REGISTRY_LEGACY_SERVER_ENTRY,
+		_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY,
+		_INVALID_PORT_SERVER_ENTRY,
+		_INVALID_WEB_SERVER_PORT_SERVER_ENTRY,
+	}
 
 	for _, testCase := range testCases {
 		encodedServerEntry := hex.EncodeToString([]byte(testCase))
@@ -152,3 +273,103 @@ func TestDecodeServerEntryStruct(t *testing.T) {
 		t.Errorf("unexpected IP address in decoded server entry: %s", serverEntry.IpAddress)
 	}
 }
+
+func TestGetObfuscatedSSHKey(t *testing.T) {
+
+	serverEntry := &ServerEntry{
+		SshObfuscatedKey: "<sshObfuscatedKey>",
+		SshObfuscatedKeys: map[string]string{
+			TUNNEL_PROTOCOL_OBFUSCATED_SSH: "<osshObfuscatedKey>",
+		},
+	}
+
+	if serverEntry.GetObfuscatedSSHKey(TUNNEL_PROTOCOL_OBFUSCATED_SSH) != "<osshObfuscatedKey>" {
+		t.Errorf("unexpected distinct obfuscated SSH key")
+	}
+
+	if serverEntry.GetObfuscatedSSHKey(TUNNEL_PROTOCOL_UNFRONTED_MEEK) != "<sshObfuscatedKey>" {
+		t.Errorf("unexpected shared obfuscated SSH key")
+	}
+}
+
+func TestGetObfuscationParameters(t *testing.T) {
+
+	serverEntry := &ServerEntry{}
+
+	params, err := serverEntry.GetObfuscationParameters()
+	if params != nil || err != nil {
+		t.Errorf("unexpected obfuscation parameters: %+v, %v", params, err)
+	}
+
+	intPtr := func(i int) *int { return &i }
+
+	for _, testCase := range []struct {
+		params ObfuscationParameters
+		valid  bool
+	}{
+		{ObfuscationParameters{
+			ObfuscatedSSHMinPadding: intPtr(0),
+			ObfuscatedSSHMaxPadding: intPtr(256)}, true},
+		{ObfuscationParameters{
+			ObfuscatedSSHMaxPadding: intPtr(0)}, true},
+		{ObfuscationParameters{
+			FragmentorMinWriteBytes:        intPtr(10),
+			FragmentorMaxDelayMicroseconds: intPtr(1000)}, true},
+		{ObfuscationParameters{
+			ObfuscatedSSHMaxPadding: intPtr(1000000)}, false},
+		{ObfuscationParameters{
+			ObfuscatedSSHMinPadding: intPtr(-1)}, false},
+		{ObfuscationParameters{
+			ObfuscatedSSHMinPadding: intPtr(512),
+			ObfuscatedSSHMaxPadding: intPtr(256)}, false},
+		{ObfuscationParameters{
+			FragmentorMinWriteBytes: intPtr(0)}, false},
+		{ObfuscationParameters{
+			FragmentorMaxDelayMicroseconds: intPtr(60000000)}, false},
+	} {
+		serverEntry.ObfuscationParameters = &testCase.params
+		params, err := serverEntry.GetObfuscationParameters()
+		if testCase.valid != (err == nil) || testCase.valid != (params != nil) {
+			t.Errorf("unexpected result for %+v: %v", testCase.params, err)
+		}
+	}
+}
+
+func TestGetMeekFrontingTLSVerification(t *testing.T) {
+
+	serverEntry := &ServerEntry{}
+
+	verification, err := serverEntry.GetMeekFrontingTLSVerification(TUNNEL_PROTOCOL_FRONTED_MEEK)
+	if verification != nil || err != nil {
+		t.Errorf("unexpected verification: %+v, %v", verification, err)
+	}
+
+	pin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	for _, testCase := range []struct {
+		verification MeekFrontingTLSVerification
+		valid        bool
+	}{
+		{MeekFrontingTLSVerification{Policy: "full"}, true},
+		{MeekFrontingTLSVerification{Policy: "skip-hostname"}, true},
+		{MeekFrontingTLSVerification{Policy: "pin", Pins: []string{pin}}, true},
+		{MeekFrontingTLSVerification{Policy: "pin"}, false},
+		{MeekFrontingTLSVerification{Policy: "pin", Pins: []string{"invalid"}}, false},
+		{MeekFrontingTLSVerification{Policy: "full", Pins: []string{pin}}, false},
+		{MeekFrontingTLSVerification{Policy: "none"}, false},
+		{MeekFrontingTLSVerification{Policy: ""}, false},
+	} {
+		serverEntry.MeekFrontingTLSVerification = &testCase.verification
+		verification, err := serverEntry.GetMeekFrontingTLSVerification(TUNNEL_PROTOCOL_FRONTED_MEEK)
+		if testCase.valid != (err == nil) || testCase.valid != (verification != nil) {
+			t.Errorf("unexpected result for %+v: %v", testCase.verification, err)
+		}
+
+		// The policy, valid or not, never applies to unfronted protocols.
+		verification, err = serverEntry.GetMeekFrontingTLSVerification(
+			TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS)
+		if verification != nil || err != nil {
+			t.Errorf("unexpected unfronted verification: %+v, %v", verification, err)
+		}
+	}
+}
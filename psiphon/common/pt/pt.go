@@ -0,0 +1,523 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+
+Package pt launches and dials through Pluggable Transport client proxies,
+such as obfs4proxy and snowflake-client, which implement the Tor Pluggable
+Transport Specification, version 1:
+https://gitweb.torproject.org/torspec.git/tree/pt-spec.txt
+
+The PT client executable is run as a managed proxy. Once the PT reports its
+SOCKS5 listener, each Dial connects to the listener and issues a SOCKS5
+CONNECT to the PT server, passing the per-connection PT arguments, such as
+the obfs4 bridge "cert", in the SOCKS5 username and password fields as the
+specification prescribes.
+
+*/
+package pt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	PT_PROTOCOL_VERSION      = "1"
+	PT_LAUNCH_TIMEOUT        = 30 * time.Second
+	PT_SHUTDOWN_GRACE_PERIOD = 2 * time.Second
+)
+
+// ClientConfig specifies a PT client executable and the transport it is to
+// provide.
+type ClientConfig struct {
+
+	// Path is the path of the PT client executable.
+	Path string
+
+	// Args are any command line arguments for the PT client executable.
+	Args []string
+
+	// Transport is the name of the transport to request from the PT, such
+	// as "obfs4" or "snowflake".
+	Transport string
+
+	// StateDirectory is the directory in which the PT may store persistent
+	// state. The directory is created when it does not exist.
+	StateDirectory string
+
+	// Logger, when set, receives the PT's LOG messages and other status
+	// output.
+	Logger func(message string)
+}
+
+// Client manages a PT client process and dials through its SOCKS5 proxy.
+// The PT process is launched on the first Dial and is relaunched on a
+// subsequent Dial should it exit. Client is safe for concurrent use.
+type Client struct {
+	config *ClientConfig
+
+	mutex   sync.Mutex
+	process *process
+}
+
+type process struct {
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	proxyAddress string
+	exited       chan struct{}
+}
+
+// NewClient initializes a new Client. No PT process is launched until the
+// first Dial.
+func NewClient(config *ClientConfig) *Client {
+	return &Client{config: config}
+}
+
+// Dial connects to the PT server at address through the PT. options are the
+// per-connection PT arguments; for example, obfs4 requires "cert" and
+// "iat-mode". The returned conn carries the transported stream.
+func (client *Client) Dial(
+	ctx context.Context,
+	address string,
+	options map[string]string) (net.Conn, error) {
+
+	proxyAddress, err := client.getProxyAddress(ctx)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Interrupt the SOCKS5 handshake when ctx is done.
+	handshakeDone := make(chan struct{})
+	handshakeInterrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			close(handshakeInterrupted)
+		case <-handshakeDone:
+		}
+	}()
+
+	err = socks5Connect(conn, address, encodeOptions(options))
+
+	close(handshakeDone)
+	select {
+	case <-handshakeInterrupted:
+		if err == nil {
+			err = ctx.Err()
+		}
+	default:
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, common.ContextError(err)
+	}
+
+	return conn, nil
+}
+
+// Close stops any running PT process. A subsequent Dial launches a new PT
+// process.
+func (client *Client) Close() error {
+
+	client.mutex.Lock()
+	process := client.process
+	client.process = nil
+	client.mutex.Unlock()
+
+	if process == nil {
+		return nil
+	}
+
+	// With TOR_PT_EXIT_ON_STDIN_CLOSE, closing stdin signals the PT to
+	// shutdown gracefully. The PT is killed if it doesn't exit promptly.
+	process.stdin.Close()
+
+	select {
+	case <-process.exited:
+	case <-time.After(PT_SHUTDOWN_GRACE_PERIOD):
+		process.cmd.Process.Kill()
+		<-process.exited
+	}
+
+	return nil
+}
+
+func (client *Client) getProxyAddress(ctx context.Context) (string, error) {
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.process != nil {
+		select {
+		case <-client.process.exited:
+			client.process = nil
+		default:
+			return client.process.proxyAddress, nil
+		}
+	}
+
+	process, err := client.launch(ctx)
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	client.process = process
+
+	return process.proxyAddress, nil
+}
+
+func (client *Client) launch(ctx context.Context) (*process, error) {
+
+	if client.config.Path == "" || client.config.Transport == "" {
+		return nil, common.ContextError(errors.New("missing PT configuration"))
+	}
+
+	if client.config.StateDirectory != "" {
+		err := os.MkdirAll(client.config.StateDirectory, 0700)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	// The PT process outlives the Dial that launches it, so it's not
+	// started with exec.CommandContext; ctx bounds only the launch.
+
+	cmd := exec.Command(client.config.Path, client.config.Args...)
+	cmd.Env = append(
+		os.Environ(),
+		"TOR_PT_MANAGED_TRANSPORT_VER="+PT_PROTOCOL_VERSION,
+		"TOR_PT_STATE_LOCATION="+client.config.StateDirectory,
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1",
+		"TOR_PT_CLIENT_TRANSPORTS="+client.config.Transport)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	process := &process{
+		cmd:    cmd,
+		stdin:  stdin,
+		exited: make(chan struct{}),
+	}
+
+	type setupResult struct {
+		proxyAddress string
+		err          error
+	}
+	setupResultChannel := make(chan setupResult, 1)
+
+	go func() {
+
+		scanner := bufio.NewScanner(stdout)
+		setupDone := false
+		var transportProxyAddress string
+
+		for scanner.Scan() {
+			line := scanner.Text()
+			if setupDone {
+				client.log(line)
+				continue
+			}
+			proxyAddress, done, err := client.parseSetupLine(line, &transportProxyAddress)
+			if err != nil {
+				setupResultChannel <- setupResult{err: err}
+				setupDone = true
+			} else if done {
+				setupResultChannel <- setupResult{proxyAddress: proxyAddress}
+				setupDone = true
+			}
+		}
+
+		if !setupDone {
+			setupResultChannel <- setupResult{
+				err: errors.New("PT exited before completing setup")}
+		}
+
+		cmd.Wait()
+		close(process.exited)
+	}()
+
+	var result setupResult
+
+	timer := time.NewTimer(PT_LAUNCH_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case result = <-setupResultChannel:
+	case <-timer.C:
+		result.err = errors.New("PT setup timeout")
+	case <-ctx.Done():
+		result.err = ctx.Err()
+	}
+
+	if result.err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		<-process.exited
+		return nil, common.ContextError(result.err)
+	}
+
+	process.proxyAddress = result.proxyAddress
+
+	return process, nil
+}
+
+// parseSetupLine parses a line of PT managed proxy setup output. The PT
+// proxy address, recorded in transportProxyAddress when the transport
+// CMETHOD is received, is returned once CMETHODS DONE is received.
+func (client *Client) parseSetupLine(
+	line string, transportProxyAddress *string) (string, bool, error) {
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", false, nil
+	}
+
+	switch fields[0] {
+
+	case "VERSION":
+		if len(fields) != 2 || fields[1] != PT_PROTOCOL_VERSION {
+			return "", false, fmt.Errorf("unexpected PT version: %s", line)
+		}
+
+	case "VERSION-ERROR", "ENV-ERROR", "PROXY-ERROR", "CMETHOD-ERROR":
+		return "", false, fmt.Errorf("PT setup failed: %s", line)
+
+	case "CMETHOD":
+		if len(fields) < 4 {
+			return "", false, fmt.Errorf("invalid CMETHOD: %s", line)
+		}
+		if fields[1] != client.config.Transport {
+			return "", false, nil
+		}
+		if fields[2] != "socks5" {
+			return "", false, fmt.Errorf("unsupported PT proxy type: %s", fields[2])
+		}
+		*transportProxyAddress = fields[3]
+
+	case "CMETHODS":
+		if len(fields) != 2 || fields[1] != "DONE" {
+			return "", false, fmt.Errorf("invalid CMETHODS: %s", line)
+		}
+		if *transportProxyAddress == "" {
+			return "", false, fmt.Errorf(
+				"PT did not provide transport: %s", client.config.Transport)
+		}
+		return *transportProxyAddress, true, nil
+
+	default:
+		client.log(line)
+	}
+
+	return "", false, nil
+}
+
+func (client *Client) log(message string) {
+	if client.config.Logger != nil {
+		client.config.Logger(message)
+	}
+}
+
+// encodeOptions encodes PT arguments as a semicolon-separated list of
+// key=value pairs, escaping "\", "=", and ";" with a backslash. Keys are
+// sorted so that the encoding is deterministic.
+func encodeOptions(options map[string]string) string {
+
+	escape := func(s string) string {
+		s = strings.Replace(s, `\`, `\\`, -1)
+		s = strings.Replace(s, `=`, `\=`, -1)
+		s = strings.Replace(s, `;`, `\;`, -1)
+		return s
+	}
+
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = escape(key) + "=" + escape(options[key])
+	}
+
+	return strings.Join(pairs, ";")
+}
+
+// socks5Connect performs a SOCKS5 CONNECT to address through the PT proxy
+// conn. Non-empty encodedOptions are sent using username/password
+// authentication: the first 255 bytes in the username and the remainder in
+// the password, which is a single NUL byte when there is no remainder.
+func socks5Connect(conn net.Conn, address, encodedOptions string) error {
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return common.ContextError(fmt.Errorf("invalid port: %s", portString))
+	}
+
+	if len(encodedOptions) > 255+255 {
+		return common.ContextError(errors.New("PT arguments too long"))
+	}
+
+	method := byte(0x00)
+	if encodedOptions != "" {
+		method = 0x02
+	}
+
+	_, err = conn.Write([]byte{0x05, 0x01, method})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	var reply [2]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return common.ContextError(errors.New("SOCKS5 method negotiation failed"))
+	}
+
+	if method == 0x02 {
+
+		username := encodedOptions
+		password := "\x00"
+		if len(username) > 255 {
+			username, password = encodedOptions[:255], encodedOptions[255:]
+		}
+
+		request := []byte{0x01, byte(len(username))}
+		request = append(request, username...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+
+		_, err = conn.Write(request)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		_, err = io.ReadFull(conn, reply[:])
+		if err != nil {
+			return common.ContextError(err)
+		}
+		if reply[0] != 0x01 || reply[1] != 0x00 {
+			return common.ContextError(errors.New("SOCKS5 authentication failed"))
+		}
+	}
+
+	request := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, 0x01)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, 0x04)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return common.ContextError(errors.New("invalid host"))
+		}
+		request = append(request, 0x03, byte(len(host)))
+		request = append(request, host...)
+	}
+	var portBytes [2]byte
+	binary.BigEndian.PutUint16(portBytes[:], uint16(port))
+	request = append(request, portBytes[:]...)
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	var response [4]byte
+	_, err = io.ReadFull(conn, response[:])
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if response[0] != 0x05 {
+		return common.ContextError(errors.New("invalid SOCKS5 response"))
+	}
+	if response[1] != 0x00 {
+		return common.ContextError(
+			fmt.Errorf("SOCKS5 connect failed: %d", response[1]))
+	}
+
+	// Discard the bound address.
+	var boundAddressLength int
+	switch response[3] {
+	case 0x01:
+		boundAddressLength = net.IPv4len
+	case 0x04:
+		boundAddressLength = net.IPv6len
+	case 0x03:
+		var length [1]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return common.ContextError(err)
+		}
+		boundAddressLength = int(length[0])
+	default:
+		return common.ContextError(errors.New("invalid SOCKS5 bound address type"))
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundAddressLength+2))
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fakePTEnvironmentVariable = "PSIPHON_PT_TEST_FAKE_PT"
+
+func TestMain(m *testing.M) {
+
+	// When launched as a PT by Client, the test binary runs as a fake PT
+	// managed proxy.
+	if os.Getenv(fakePTEnvironmentVariable) != "" {
+		runFakePT()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestClient(t *testing.T) {
+
+	// The PT server is an echo server which first echoes the PT arguments
+	// received by the fake PT.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	stateDirectory, err := ioutil.TempDir("", "psiphon-pt-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(stateDirectory)
+
+	os.Setenv(fakePTEnvironmentVariable, "1")
+	defer os.Unsetenv(fakePTEnvironmentVariable)
+
+	client := NewClient(&ClientConfig{
+		Path:           os.Args[0],
+		Transport:      "obfs4",
+		StateDirectory: filepath.Join(stateDirectory, "pt_state"),
+	})
+	defer client.Close()
+
+	options := map[string]string{
+		"cert":     strings.Repeat("x", 300) + "=;\\",
+		"iat-mode": "0",
+	}
+	expectedOptions := encodeOptions(options)
+
+	for i := 0; i < 2; i++ {
+
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+		conn, err := client.Dial(ctx, listener.Addr().String(), options)
+		cancelFunc()
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+
+		echoOptions := make([]byte, len(expectedOptions))
+		_, err = io.ReadFull(conn, echoOptions)
+		if err != nil {
+			t.Fatalf("ReadFull failed: %s", err)
+		}
+		if string(echoOptions) != expectedOptions {
+			t.Fatalf("unexpected PT arguments: %s", echoOptions)
+		}
+
+		message := []byte("transported")
+		_, err = conn.Write(message)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		echo := make([]byte, len(message))
+		_, err = io.ReadFull(conn, echo)
+		if err != nil || string(echo) != string(message) {
+			t.Fatalf("unexpected echo: %s, %v", echo, err)
+		}
+
+		conn.Close()
+
+		// The PT process must be relaunched after Close.
+		client.Close()
+	}
+
+	if _, err := os.Stat(filepath.Join(stateDirectory, "pt_state")); err != nil {
+		t.Fatalf("missing PT state directory: %s", err)
+	}
+}
+
+func TestEncodeOptions(t *testing.T) {
+
+	encoded := encodeOptions(map[string]string{"b": `x=y;z\`, "a": "1"})
+	if encoded != `a=1;b=x\=y\;z\\` {
+		t.Fatalf("unexpected encoding: %s", encoded)
+	}
+}
+
+// runFakePT implements a minimal PT managed proxy: the SOCKS5 proxy
+// connects to the requested address, writes the received PT arguments to the
+// connection as the transport handshake, and then relays.
+func runFakePT() {
+
+	if os.Getenv("TOR_PT_MANAGED_TRANSPORT_VER") != "1" {
+		fmt.Println("VERSION-ERROR no-version")
+		return
+	}
+	fmt.Println("VERSION 1")
+
+	if os.Getenv("TOR_PT_CLIENT_TRANSPORTS") != "obfs4" {
+		fmt.Println("CMETHOD-ERROR unexpected transports")
+		return
+	}
+
+	err := os.MkdirAll(os.Getenv("TOR_PT_STATE_LOCATION"), 0700)
+	if err != nil {
+		fmt.Println("ENV-ERROR " + err.Error())
+		return
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("CMETHOD-ERROR obfs4 " + err.Error())
+		return
+	}
+
+	fmt.Println("CMETHOD obfs4 socks5 " + listener.Addr().String())
+	fmt.Println("CMETHODS DONE")
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleFakePTConn(conn)
+		}
+	}()
+
+	// Exit when stdin is closed, as per TOR_PT_EXIT_ON_STDIN_CLOSE.
+	io.Copy(ioutil.Discard, os.Stdin)
+}
+
+func handleFakePTConn(conn net.Conn) {
+	defer conn.Close()
+
+	options, address, err := readFakePTSOCKS5Request(conn)
+	if err != nil {
+		return
+	}
+
+	serverConn, err := net.Dial("tcp", address)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer serverConn.Close()
+
+	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	if err != nil {
+		return
+	}
+
+	_, err = serverConn.Write([]byte(options))
+	if err != nil {
+		return
+	}
+
+	go io.Copy(serverConn, conn)
+	io.Copy(conn, serverConn)
+}
+
+func readFakePTSOCKS5Request(conn net.Conn) (string, string, error) {
+
+	readBytes := func(n int) ([]byte, error) {
+		b := make([]byte, n)
+		_, err := io.ReadFull(conn, b)
+		return b, err
+	}
+
+	header, err := readBytes(3)
+	if err != nil {
+		return "", "", err
+	}
+	if header[0] != 0x05 || header[1] != 0x01 || header[2] != 0x02 {
+		return "", "", errors.New("unexpected methods")
+	}
+	conn.Write([]byte{0x05, 0x02})
+
+	version, err := readBytes(2)
+	if err != nil || version[0] != 0x01 {
+		return "", "", errors.New("unexpected auth version")
+	}
+	username, err := readBytes(int(version[1]))
+	if err != nil {
+		return "", "", err
+	}
+	passwordLength, err := readBytes(1)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := readBytes(int(passwordLength[0]))
+	if err != nil {
+		return "", "", err
+	}
+	options := string(username)
+	if string(password) != "\x00" {
+		options += string(password)
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	request, err := readBytes(4)
+	if err != nil || request[1] != 0x01 || request[3] != 0x01 {
+		return "", "", errors.New("unexpected request")
+	}
+	addressBytes, err := readBytes(6)
+	if err != nil {
+		return "", "", err
+	}
+	address := net.JoinHostPort(
+		net.IP(addressBytes[:4]).String(),
+		fmt.Sprintf("%d", binary.BigEndian.Uint16(addressBytes[4:])))
+
+	return options, address, nil
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package quic
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+const (
+	PACING_BUCKET_IDLE_TIMEOUT = SERVER_IDLE_TIMEOUT
+	PACING_BUCKET_GC_PERIOD    = 1 * time.Minute
+)
+
+// PacingParameters returns the explicit pacing rate, in bytes per second,
+// and the burst size, in bytes, for packets sent to the specified address.
+// A rate of 0 disables explicit pacing for the address.
+type PacingParameters func(addr net.Addr) (int, int)
+
+// pacedPacketConn is a net.PacketConn which paces the packets written to
+// each destination address using a token bucket, so that packets are sent
+// smoothly at the target rate rather than in bursts.
+//
+// The token bucket allows up to the burst size to be sent immediately, so
+// small flows, such as the QUIC handshake and interactive traffic, are not
+// delayed. Once the burst is consumed, WriteTo blocks until the packet may
+// be sent at the target rate. With one bucket per destination address, one
+// paced QUIC session doesn't delay other sessions sharing a server socket.
+//
+// Explicit pacing is in addition to the QUIC congestion control pacing,
+// which is always applied by quic-go and which derives the pacing rate from
+// the congestion window and RTT.
+type pacedPacketConn struct {
+	net.PacketConn
+	getParameters PacingParameters
+	mutex         sync.Mutex
+	buckets       map[string]*pacingBucket
+	lastGC        monotime.Time
+}
+
+type pacingBucket struct {
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastUpdate monotime.Time
+}
+
+// newPacedPacketConn wraps conn with explicit pacing. getParameters is
+// called once for each new destination address.
+func newPacedPacketConn(
+	conn net.PacketConn, getParameters PacingParameters) *pacedPacketConn {
+
+	return &pacedPacketConn{
+		PacketConn:    conn,
+		getParameters: getParameters,
+		buckets:       make(map[string]*pacingBucket),
+		lastGC:        monotime.Now(),
+	}
+}
+
+func (conn *pacedPacketConn) WriteTo(buffer []byte, addr net.Addr) (int, error) {
+
+	delay := conn.reserve(addr, len(buffer))
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	return conn.PacketConn.WriteTo(buffer, addr)
+}
+
+// reserve takes size tokens from the bucket for addr and returns how long
+// to wait before sending. The bucket may go into debt, which is repaid
+// before subsequent packets are sent, so concurrent writers to the same
+// address are paced in aggregate.
+func (conn *pacedPacketConn) reserve(addr net.Addr, size int) time.Duration {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	now := monotime.Now()
+
+	if now.Sub(conn.lastGC) > PACING_BUCKET_GC_PERIOD {
+		for key, bucket := range conn.buckets {
+			if now.Sub(bucket.lastUpdate) > PACING_BUCKET_IDLE_TIMEOUT {
+				delete(conn.buckets, key)
+			}
+		}
+		conn.lastGC = now
+	}
+
+	key := addr.String()
+	bucket, ok := conn.buckets[key]
+	if !ok {
+		rate, burst := conn.getParameters(addr)
+		if burst < 1 {
+			burst = 1
+		}
+		bucket = &pacingBucket{
+			rate:       float64(rate),
+			burst:      float64(burst),
+			tokens:     float64(burst),
+			lastUpdate: now,
+		}
+		conn.buckets[key] = bucket
+	}
+
+	if bucket.rate <= 0 {
+		bucket.lastUpdate = now
+		return 0
+	}
+
+	bucket.tokens += now.Sub(bucket.lastUpdate).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.lastUpdate = now
+
+	bucket.tokens -= float64(size)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// NewPacedPacketConn wraps conn, a client QUIC packet conn, with explicit
+// pacing at the specified rate, in bytes per second, and burst size, in
+// bytes. When rate is 0, conn is returned unchanged.
+func NewPacedPacketConn(conn net.PacketConn, rate, burst int) net.PacketConn {
+	if rate <= 0 {
+		return conn
+	}
+	return newPacedPacketConn(
+		conn, func(_ net.Addr) (int, int) { return rate, burst })
+}
@@ -68,10 +68,13 @@ var serverIdleTimeout = SERVER_IDLE_TIMEOUT
 // Listener is a net.Listener.
 type Listener struct {
 	quic_go.Listener
+	packetConn net.PacketConn
 }
 
-// Listen creates a new Listener.
-func Listen(addr string) (*Listener, error) {
+// Listen creates a new Listener. When pacingParameters is not nil, packets
+// sent to each client are explicitly paced according to the parameters
+// returned for the client address; see pacedPacketConn.
+func Listen(addr string, pacingParameters PacingParameters) (*Listener, error) {
 
 	certificate, privateKey, err := common.GenerateWebServerCertificate(
 		common.GenerateHostName())
@@ -97,14 +100,31 @@ func Listen(addr string) (*Listener, error) {
 		KeepAlive:             true,
 	}
 
-	quicListener, err := quic_go.ListenAddr(
-		addr, tlsConfig, quicConfig)
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var packetConn net.PacketConn
+	packetConn, err = net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if pacingParameters != nil {
+		packetConn = newPacedPacketConn(packetConn, pacingParameters)
+	}
+
+	quicListener, err := quic_go.Listen(
+		packetConn, tlsConfig, quicConfig)
 	if err != nil {
+		packetConn.Close()
 		return nil, common.ContextError(err)
 	}
 
 	return &Listener{
-		Listener: quicListener,
+		Listener:   quicListener,
+		packetConn: packetConn,
 	}, nil
 }
 
@@ -125,6 +145,17 @@ func (listener *Listener) Accept() (net.Conn, error) {
 	}, nil
 }
 
+// Close closes the listener and its underlying packet conn, which, unlike
+// with quic_go.ListenAddr, is not closed by quic_go.Listener.
+func (listener *Listener) Close() error {
+	err := listener.Listener.Close()
+	closeErr := listener.packetConn.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 var supportedVersionNumbers = map[string]quic_go.VersionNumber{
 	protocol.QUIC_VERSION_GQUIC39: quic_go.VersionGQUIC39,
 	protocol.QUIC_VERSION_GQUIC43: quic_go.VersionGQUIC43,
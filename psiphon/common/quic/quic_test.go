@@ -21,8 +21,10 @@ package quic
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -57,7 +59,7 @@ func runQUIC(t *testing.T, negotiateQUICVersion string) {
 	// connection termination packets.
 	serverIdleTimeout = 1 * time.Second
 
-	listener, err := Listen("127.0.0.1:0")
+	listener, err := Listen("127.0.0.1:0", nil)
 	if err != nil {
 		t.Fatalf("Listen failed: %s", err)
 	}
@@ -195,3 +197,266 @@ func runQUIC(t *testing.T, negotiateQUICVersion string) {
 		t.Error("unexpected Accept after Close")
 	}
 }
+
+func TestQUICMigration(t *testing.T) {
+	for negotiateQUICVersion, _ := range supportedVersionNumbers {
+		t.Run(negotiateQUICVersion, func(t *testing.T) {
+			runQUICMigration(t, negotiateQUICVersion)
+		})
+	}
+}
+
+func runQUICMigration(t *testing.T, negotiateQUICVersion string) {
+
+	listener, err := Listen("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	serverConns := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serverConns <- conn
+		io.Copy(conn, conn)
+	}()
+
+	remoteAddr, err := net.ResolveUDPAddr("udp", serverAddress)
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr failed: %s", err)
+	}
+
+	packetConn, err := newRebindingPacketConn()
+	if err != nil {
+		t.Fatalf("newRebindingPacketConn failed: %s", err)
+	}
+	defer packetConn.Close()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFunc()
+
+	conn, err := Dial(
+		ctx,
+		packetConn,
+		remoteAddr,
+		serverAddress,
+		negotiateQUICVersion)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	echo := func() {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		message := []byte("test")
+		_, err := conn.Write(message)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		response := make([]byte, len(message))
+		_, err = io.ReadFull(conn, response)
+		if err != nil {
+			t.Fatalf("ReadFull failed: %s", err)
+		}
+	}
+
+	echo()
+
+	serverConn := <-serverConns
+
+	if serverConn.RemoteAddr().String() != packetConn.LocalAddr().String() {
+		t.Fatalf("unexpected server remote address: %s", serverConn.RemoteAddr())
+	}
+
+	// Simulate a NAT rebinding: the client's source address changes and
+	// packets sent to the original address are no longer delivered. The
+	// session must continue, with the server sending to the new address.
+
+	err = packetConn.rebind()
+	if err != nil {
+		t.Fatalf("rebind failed: %s", err)
+	}
+
+	echo()
+	echo()
+
+	if serverConn.RemoteAddr().String() != packetConn.LocalAddr().String() {
+		t.Fatalf("unexpected server remote address: %s", serverConn.RemoteAddr())
+	}
+}
+
+// rebindingPacketConn is a net.PacketConn which can switch to a new local
+// UDP socket mid-session, closing the previous socket.
+type rebindingPacketConn struct {
+	mutex      sync.Mutex
+	packetConn net.PacketConn
+	packets    chan rebindingPacket
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+type rebindingPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+func newRebindingPacketConn() (*rebindingPacketConn, error) {
+	conn := &rebindingPacketConn{
+		packets: make(chan rebindingPacket, 1024),
+		closed:  make(chan struct{}),
+	}
+	err := conn.rebind()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	return conn, nil
+}
+
+func (conn *rebindingPacketConn) rebind() error {
+	packetConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	conn.mutex.Lock()
+	if conn.packetConn != nil {
+		conn.packetConn.Close()
+	}
+	conn.packetConn = packetConn
+	conn.mutex.Unlock()
+
+	go func() {
+		for {
+			b := make([]byte, 2048)
+			n, addr, err := packetConn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			select {
+			case conn.packets <- rebindingPacket{data: b[:n], addr: addr}:
+			case <-conn.closed:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (conn *rebindingPacketConn) current() net.PacketConn {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.packetConn
+}
+
+func (conn *rebindingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-conn.packets:
+		return copy(b, packet.data), packet.addr, nil
+	case <-conn.closed:
+		return 0, nil, common.ContextError(errors.New("closed"))
+	}
+}
+
+func (conn *rebindingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return conn.current().WriteTo(b, addr)
+}
+
+func (conn *rebindingPacketConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return conn.current().Close()
+}
+
+func (conn *rebindingPacketConn) LocalAddr() net.Addr {
+	return conn.current().LocalAddr()
+}
+
+func (conn *rebindingPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *rebindingPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (conn *rebindingPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func TestPacing(t *testing.T) {
+
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer receiver.Close()
+
+	unpacedReceiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer unpacedReceiver.Close()
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+
+	rate := 100000
+	burst := 10000
+
+	conn := newPacedPacketConn(
+		packetConn,
+		func(addr net.Addr) (int, int) {
+			if addr.String() == unpacedReceiver.LocalAddr().String() {
+				return 0, 0
+			}
+			return rate, burst
+		})
+	defer conn.Close()
+
+	buffer := make([]byte, 1000)
+
+	write := func(addr net.Addr, count int) time.Duration {
+		start := time.Now()
+		for i := 0; i < count; i++ {
+			_, err := conn.WriteTo(buffer, addr)
+			if err != nil {
+				t.Fatalf("WriteTo failed: %s", err)
+			}
+		}
+		return time.Since(start)
+	}
+
+	// The burst is sent without pacing.
+
+	elapsed := write(receiver.LocalAddr(), burst/len(buffer))
+	if elapsed > 50*time.Millisecond {
+		t.Fatalf("unexpected burst duration: %s", elapsed)
+	}
+
+	// Once the burst is consumed, packets are sent at the pacing rate.
+
+	count := 20
+	expected := time.Duration(count*len(buffer)) * time.Second / time.Duration(rate)
+
+	elapsed = write(receiver.LocalAddr(), count)
+	if elapsed < expected*9/10 || elapsed > expected*3 {
+		t.Fatalf("unexpected paced duration: %s", elapsed)
+	}
+
+	// Pacing to one address doesn't delay packets sent to another address.
+
+	elapsed = write(unpacedReceiver.LocalAddr(), count)
+	if elapsed > 50*time.Millisecond {
+		t.Fatalf("unexpected unpaced duration: %s", elapsed)
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	SERVER_LIST_DIFF_MAX_RESULT_SIZE = 64 * 1024 * 1024
+
+	binaryDiffBlockSize = 16
+	binaryDiffOpCopy    = 0
+	binaryDiffOpInsert  = 1
+)
+
+// serverListDiff is the payload of a signed server list diff. The diff is
+// applicable only to the base server list with digest BaseDigest, and must
+// produce the server list with digest ResultDigest.
+//
+// As the serverListDiff is carried in an AuthenticatedDataPackage, the
+// package signature covers ResultDigest and so authenticates the resulting
+// server list, not only the diff.
+type serverListDiff struct {
+	BaseDigest   []byte `json:"baseDigest"`
+	ResultDigest []byte `json:"resultDigest"`
+	Diff         []byte `json:"diff"`
+}
+
+// WriteServerListDiff creates a signed binary diff which transforms
+// baseServerList into serverList. The diff is signed by the given key, the
+// server list signing key, and is in the AuthenticatedDataPackage format.
+func WriteServerListDiff(
+	baseServerList, serverList []byte,
+	signingPublicKey, signingPrivateKey string) ([]byte, error) {
+
+	if len(serverList) > SERVER_LIST_DIFF_MAX_RESULT_SIZE {
+		return nil, ContextError(errors.New("server list exceeds maximum size"))
+	}
+
+	diffJSON, err := json.Marshal(
+		&serverListDiff{
+			BaseDigest:   sha256sum(string(baseServerList)),
+			ResultDigest: sha256sum(string(serverList)),
+			Diff:         makeBinaryDiff(baseServerList, serverList),
+		})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	signedDiff, err := WriteAuthenticatedDataPackage(
+		string(diffJSON), signingPublicKey, signingPrivateKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return signedDiff, nil
+}
+
+// ApplyServerListDiff verifies and applies a signed server list diff, created
+// by WriteServerListDiff, to baseServerList and returns the resulting server
+// list. An error is returned when the diff signature is invalid, when the
+// diff is not for baseServerList, or when the resulting server list does not
+// match the signed result digest. baseServerList is not modified.
+func ApplyServerListDiff(
+	baseServerList, signedDiff []byte, signingPublicKey string) ([]byte, error) {
+
+	diffJSON, err := ReadAuthenticatedDataPackage(signedDiff, true, signingPublicKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	var diff serverListDiff
+	err = json.Unmarshal([]byte(diffJSON), &diff)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if !bytes.Equal(diff.BaseDigest, sha256sum(string(baseServerList))) {
+		return nil, ContextError(errors.New("unexpected base server list digest"))
+	}
+
+	serverList, err := applyBinaryDiff(baseServerList, diff.Diff)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if !bytes.Equal(diff.ResultDigest, sha256sum(string(serverList))) {
+		return nil, ContextError(errors.New("unexpected result server list digest"))
+	}
+
+	return serverList, nil
+}
+
+// makeBinaryDiff creates a binary diff which transforms base into target.
+//
+// The diff format is the target length followed by a sequence of
+// operations: a copy of a range of base, or an insert of literal bytes. All
+// integers are uvarints.
+//
+// Matches are found by indexing base in aligned blocks and extending each
+// block match forward. This is effective for server lists, where updates
+// add, remove, and replace whole lines.
+func makeBinaryDiff(base, target []byte) []byte {
+
+	blockIndex := make(map[string]int)
+	for offset := 0; offset+binaryDiffBlockSize <= len(base); offset += binaryDiffBlockSize {
+		block := string(base[offset : offset+binaryDiffBlockSize])
+		if _, ok := blockIndex[block]; !ok {
+			blockIndex[block] = offset
+		}
+	}
+
+	var diff bytes.Buffer
+	writeUvarint(&diff, uint64(len(target)))
+
+	insertStart := 0
+
+	flushInsert := func(end int) {
+		if end > insertStart {
+			diff.WriteByte(binaryDiffOpInsert)
+			writeUvarint(&diff, uint64(end-insertStart))
+			diff.Write(target[insertStart:end])
+		}
+	}
+
+	i := 0
+	for i+binaryDiffBlockSize <= len(target) {
+
+		baseOffset, ok := blockIndex[string(target[i:i+binaryDiffBlockSize])]
+		if !ok {
+			i += 1
+			continue
+		}
+
+		length := binaryDiffBlockSize
+		for i+length < len(target) &&
+			baseOffset+length < len(base) &&
+			target[i+length] == base[baseOffset+length] {
+			length += 1
+		}
+
+		flushInsert(i)
+
+		diff.WriteByte(binaryDiffOpCopy)
+		writeUvarint(&diff, uint64(baseOffset))
+		writeUvarint(&diff, uint64(length))
+
+		i += length
+		insertStart = i
+	}
+
+	flushInsert(len(target))
+
+	return diff.Bytes()
+}
+
+// applyBinaryDiff applies a diff created by makeBinaryDiff to base. All diff
+// operations are bounds checked, so a corrupt diff results in an error.
+func applyBinaryDiff(base, diff []byte) ([]byte, error) {
+
+	reader := bytes.NewReader(diff)
+
+	targetLength, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if targetLength > SERVER_LIST_DIFF_MAX_RESULT_SIZE {
+		return nil, ContextError(errors.New("diff result exceeds maximum size"))
+	}
+
+	target := make([]byte, 0, int(targetLength))
+
+	for reader.Len() > 0 {
+
+		op, _ := reader.ReadByte()
+
+		switch op {
+
+		case binaryDiffOpCopy:
+			offset, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			if offset > uint64(len(base)) || length > uint64(len(base))-offset ||
+				length > targetLength-uint64(len(target)) {
+				return nil, ContextError(errors.New("invalid diff copy"))
+			}
+			target = append(target, base[offset:offset+length]...)
+
+		case binaryDiffOpInsert:
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			if length > uint64(reader.Len()) ||
+				length > targetLength-uint64(len(target)) {
+				return nil, ContextError(errors.New("invalid diff insert"))
+			}
+			start := len(diff) - reader.Len()
+			target = append(target, diff[start:start+int(length)]...)
+			reader.Seek(int64(length), io.SeekCurrent)
+
+		default:
+			return nil, ContextError(fmt.Errorf("invalid diff operation: %d", op))
+		}
+	}
+
+	if uint64(len(target)) != targetLength {
+		return nil, ContextError(errors.New("unexpected diff result length"))
+	}
+
+	return target, nil
+}
+
+func writeUvarint(buffer *bytes.Buffer, value uint64) {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(encoded[:], value)
+	buffer.Write(encoded[:n])
+}
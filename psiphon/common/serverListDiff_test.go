@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestServerListDiff(t *testing.T) {
+
+	signingPublicKey, signingPrivateKey, err := GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	makeServerList := func(count int) []byte {
+		var lines []string
+		for i := 0; i < count; i++ {
+			entry, err := MakeSecureRandomBytes(256)
+			if err != nil {
+				t.Fatalf("MakeSecureRandomBytes failed: %s", err)
+			}
+			lines = append(lines, hex.EncodeToString(entry))
+		}
+		return []byte(strings.Join(lines, "\n"))
+	}
+
+	// The updated server list drops some server entries and adds new ones.
+
+	baseServerList := makeServerList(100)
+	serverList := append(
+		append([]byte(nil), baseServerList[len(baseServerList)/2:]...),
+		makeServerList(10)...)
+
+	signedDiff, err := WriteServerListDiff(
+		baseServerList, serverList, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("WriteServerListDiff failed: %s", err)
+	}
+
+	if len(signedDiff) >= len(Compress(serverList)) {
+		t.Fatalf("unexpected diff size: %d", len(signedDiff))
+	}
+
+	result, err := ApplyServerListDiff(baseServerList, signedDiff, signingPublicKey)
+	if err != nil {
+		t.Fatalf("ApplyServerListDiff failed: %s", err)
+	}
+	if !bytes.Equal(result, serverList) {
+		t.Fatalf("unexpected result server list")
+	}
+
+	// The diff must not apply to a different base server list.
+
+	_, err = ApplyServerListDiff(serverList, signedDiff, signingPublicKey)
+	if err == nil {
+		t.Fatalf("unexpected ApplyServerListDiff success with wrong base")
+	}
+
+	// The diff must be signed with the expected key.
+
+	wrongSigningPublicKey, _, err := GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	_, err = ApplyServerListDiff(baseServerList, signedDiff, wrongSigningPublicKey)
+	if err == nil {
+		t.Fatalf("unexpected ApplyServerListDiff success with wrong key")
+	}
+
+	// A corrupt diff must fail.
+
+	corruptDiff := append([]byte(nil), signedDiff...)
+	corruptDiff[len(corruptDiff)/2] ^= 0xff
+
+	_, err = ApplyServerListDiff(baseServerList, corruptDiff, signingPublicKey)
+	if err == nil {
+		t.Fatalf("unexpected ApplyServerListDiff success with corrupt diff")
+	}
+}
+
+func TestBinaryDiff(t *testing.T) {
+
+	inputs := [][]byte{
+		[]byte(""),
+		[]byte("a"),
+		[]byte(strings.Repeat("0123456789abcdef", 10)),
+		[]byte(strings.Repeat("0123456789abcdef", 5) + "X" + strings.Repeat("0123456789abcdef", 5)),
+		[]byte("fedcba9876543210" + strings.Repeat("0123456789abcdef", 3)),
+	}
+
+	for _, base := range inputs {
+		for _, target := range inputs {
+
+			diff := makeBinaryDiff(base, target)
+
+			result, err := applyBinaryDiff(base, diff)
+			if err != nil {
+				t.Fatalf("applyBinaryDiff failed: %s", err)
+			}
+			if !bytes.Equal(result, target) {
+				t.Fatalf("unexpected result: %s", result)
+			}
+
+			// Truncated diffs must fail without panicking.
+
+			for i := 0; i < len(diff); i++ {
+				result, err := applyBinaryDiff(base, diff[:i])
+				if err == nil && !bytes.Equal(result, target) {
+					t.Fatalf("unexpected truncated diff result")
+				}
+			}
+		}
+	}
+
+	_, err := applyBinaryDiff([]byte("base"), []byte{4, binaryDiffOpCopy, 2, 4})
+	if err == nil {
+		t.Fatalf("unexpected success with out of bounds copy")
+	}
+}
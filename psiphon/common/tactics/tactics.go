@@ -73,6 +73,31 @@ server public key is obtained from the server entry. The server entry also
 contains capabilities indicating that a Psiphon server supports tactics requests
 and which meek protocol is to be used.
 
+In fully-blocked bootstrap scenarios, where no tactics-capable Psiphon server
+is reachable, the client may instead fetch a signed tactics payload from a
+fronted or otherwise untunneled endpoint, such as a CDN or cloud storage
+location. Signed tactics payloads are created with MakeSignedTacticsPayload
+and are authenticated, as remote server lists are, with a digital signature
+that's verified by HandleSignedTacticsPayload. As signed tactics payloads are
+static resources, they aren't tailored to the client's attributes.
+
+Signed tactics payloads also include a signed epoch and version. The client
+persists the highest epoch and version it has applied and rejects signed
+payloads with a lower epoch and version, so that an adversary who can
+intercept the signed tactics fetch cannot replay an older payload to roll
+the client back to a blocked configuration. Within an epoch, each published
+payload must have a higher version than the last. Should the stored version
+get ahead erroneously, for example when a payload is published with a
+mistaken, very large version, publishers recover by incrementing the epoch,
+which resets the version sequence.
+
+When the server tactics configuration specifies a version, the server pushes
+updated tactics to established clients, over their tunnels, after the
+configuration is reloaded, so that clients needn't reconnect to receive the
+update. Pushed payloads, created by GetPushedTacticsPayload and handled by
+HandlePushedTacticsPayload, are version checked in the same sequence as
+signed payloads.
+
 The Psiphon client requests, stores, and applies distinct tactics based on its
 current network context. The client uses platform-specific APIs to obtain a fine
 grain network ID based on, for example BSSID for WiFi or MCC/MNC for mobile.
@@ -153,6 +178,7 @@ package tactics
 
 import (
 	"bytes"
+	"compress/zlib"
 	"context"
 	"crypto/md5"
 	"crypto/rand"
@@ -161,6 +187,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -184,6 +211,8 @@ const (
 	SPEED_TEST_END_POINT               = "speedtest"
 	TACTICS_END_POINT                  = "tactics"
 	MAX_REQUEST_BODY_SIZE              = 65536
+	MAX_SIGNED_TACTICS_PAYLOAD_SIZE    = 65536
+	MAX_PUSHED_TACTICS_PAYLOAD_SIZE    = 65536
 	SPEED_TEST_PADDING_MIN_SIZE        = 0
 	SPEED_TEST_PADDING_MAX_SIZE        = 256
 	TACTICS_PADDING_MAX_SIZE           = 256
@@ -237,6 +266,14 @@ type Server struct {
 	// tactics parameters via Listeners.
 	EnforceLimitsServerSide bool
 
+	// Epoch and Version version the tactics configuration. When Version is
+	// > 0, tactics are pushed to established clients after a reload; see
+	// GetPushedTacticsPayload. Clients apply pushed tactics only with a
+	// version at least as high as the last signed or pushed tactics they
+	// applied, so pushed and signed tactics share one version sequence.
+	Epoch   int64
+	Version int64
+
 	// DefaultTactics is the baseline tactics for all clients. It must include a
 	// TTL and Probability.
 	DefaultTactics Tactics
@@ -270,6 +307,8 @@ type Filter struct {
 	Regions []string
 	// ISPs specifies a list of GeoIP ISPs the client must match.
 	ISPs []string
+	// ASNs specifies a list of GeoIP ASNs the client must match.
+	ASNs []string
 
 	// APIParameters specifies API, e.g. handshake, parameter names and
 	// a list of values, one of which must be specified to match this
@@ -283,6 +322,7 @@ type Filter struct {
 
 	regionLookup map[string]bool
 	ispLookup    map[string]bool
+	asnLookup    map[string]bool
 }
 
 // Range is a filter field which specifies that the aggregation of
@@ -317,6 +357,27 @@ type Payload struct {
 
 	// Tactics is a JSON-encoded Tactics struct and may be nil.
 	Tactics json.RawMessage
+
+	// Epoch and Version are set only in signed and pushed tactics payloads.
+	// In signed payloads, they are covered by the signature. See
+	// MakeSignedTacticsPayload and GetPushedTacticsPayload.
+	Epoch   int64 `json:",omitempty"`
+	Version int64 `json:",omitempty"`
+}
+
+// SignedTacticsVersion is the epoch and version of a signed tactics
+// payload. Versions are ordered by epoch and then by version.
+type SignedTacticsVersion struct {
+	Epoch   int64
+	Version int64
+}
+
+// Less indicates whether version is lower than other.
+func (version SignedTacticsVersion) Less(other SignedTacticsVersion) bool {
+	if version.Epoch != other.Epoch {
+		return version.Epoch < other.Epoch
+	}
+	return version.Version < other.Version
 }
 
 // Record is the tactics data persisted by the client. There is one
@@ -457,6 +518,8 @@ func NewServer(
 			server.RequestPrivateKey = newServer.RequestPrivateKey
 			server.RequestObfuscatedKey = newServer.RequestObfuscatedKey
 			server.EnforceLimitsServerSide = newServer.EnforceLimitsServerSide
+			server.Epoch = newServer.Epoch
+			server.Version = newServer.Version
 			server.DefaultTactics = newServer.DefaultTactics
 			server.FilteredTactics = newServer.FilteredTactics
 
@@ -490,6 +553,10 @@ func (server *Server) Validate() error {
 		}
 	}
 
+	if server.Epoch < 0 || server.Version < 0 {
+		return common.ContextError(errors.New("invalid version"))
+	}
+
 	validateTactics := func(tactics *Tactics, isDefault bool) error {
 
 		// Allow "" for 0, even though ParseDuration does not.
@@ -590,9 +657,16 @@ func (server *Server) initLookups() {
 		}
 
 		if len(filteredTactics.Filter.ISPs) >= lookupThreshold {
-			filteredTactics.Filter.regionLookup = make(map[string]bool)
+			filteredTactics.Filter.ispLookup = make(map[string]bool)
 			for _, ISP := range filteredTactics.Filter.ISPs {
-				filteredTactics.Filter.regionLookup[ISP] = true
+				filteredTactics.Filter.ispLookup[ISP] = true
+			}
+		}
+
+		if len(filteredTactics.Filter.ASNs) >= lookupThreshold {
+			filteredTactics.Filter.asnLookup = make(map[string]bool)
+			for _, ASN := range filteredTactics.Filter.ASNs {
+				filteredTactics.Filter.asnLookup[ASN] = true
 			}
 		}
 
@@ -617,7 +691,45 @@ func (server *Server) GetTacticsPayload(
 	geoIPData common.GeoIPData,
 	apiParams common.APIParameters) (*Payload, error) {
 
-	tactics, err := server.getTactics(geoIPData, apiParams)
+	return server.GetSnapshot().GetTacticsPayload(geoIPData, apiParams)
+}
+
+// Snapshot is an immutable view of the tactics configuration, taken by
+// GetSnapshot. Reloading the configuration replaces the Server's values but
+// never modifies values referenced by an existing Snapshot, so all tactics
+// obtained from one Snapshot are consistent with a single configuration,
+// even when a reload occurs concurrently. A nil Snapshot has no tactics.
+type Snapshot struct {
+	loaded          bool
+	version         SignedTacticsVersion
+	defaultTactics  Tactics
+	filteredTactics []struct {
+		Filter  Filter
+		Tactics Tactics
+	}
+}
+
+// GetSnapshot returns a Snapshot of the current tactics configuration.
+func (server *Server) GetSnapshot() *Snapshot {
+
+	server.ReloadableFile.RLock()
+	defer server.ReloadableFile.RUnlock()
+
+	return &Snapshot{
+		loaded:          server.loaded,
+		version:         SignedTacticsVersion{Epoch: server.Epoch, Version: server.Version},
+		defaultTactics:  server.DefaultTactics,
+		filteredTactics: server.FilteredTactics,
+	}
+}
+
+// GetTacticsPayload is Server.GetTacticsPayload using the tactics in the
+// snapshot.
+func (snapshot *Snapshot) GetTacticsPayload(
+	geoIPData common.GeoIPData,
+	apiParams common.APIParameters) (*Payload, error) {
+
+	tactics, err := snapshot.getTactics(geoIPData, apiParams)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -667,23 +779,65 @@ func (server *Server) GetTacticsPayload(
 	return payload, nil
 }
 
-func (server *Server) getTactics(
+// GetPushedTacticsPayload returns a tactics payload to push to an
+// established client, over its tunnel, after a tactics configuration
+// reload. The payload always includes the tactics, as the client's stored
+// tag isn't known after the handshake, and includes the configuration epoch
+// and version for the client's rollback check. nil is returned when the
+// configuration has no version, which disables pushing tactics, or has no
+// tactics for the client.
+//
+// apiParams are the client's handshake API parameters. Tactics filters are
+// matched as in GetTacticsPayload, except that filters on speed test
+// samples, which aren't sent after the handshake, don't match.
+func (snapshot *Snapshot) GetPushedTacticsPayload(
 	geoIPData common.GeoIPData,
-	apiParams common.APIParameters) (*Tactics, error) {
+	apiParams common.APIParameters) (*Payload, error) {
 
-	server.ReloadableFile.RLock()
-	defer server.ReloadableFile.RUnlock()
+	if snapshot == nil || snapshot.version.Version <= 0 {
+		return nil, nil
+	}
+
+	tactics, err := snapshot.getTactics(geoIPData, apiParams)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if tactics == nil {
+		return nil, nil
+	}
 
-	if !server.loaded {
+	marshaledTactics, err := json.Marshal(tactics)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// MD5 hash is used solely as a data checksum and not for any security purpose.
+	digest := md5.Sum(marshaledTactics)
+	tag := hex.EncodeToString(digest[:])
+
+	return &Payload{
+		Tag:     tag,
+		Tactics: marshaledTactics,
+		Epoch:   snapshot.version.Epoch,
+		Version: snapshot.version.Version,
+	}, nil
+}
+
+func (snapshot *Snapshot) getTactics(
+	geoIPData common.GeoIPData,
+	apiParams common.APIParameters) (*Tactics, error) {
+
+	if snapshot == nil || !snapshot.loaded {
 		// No tactics configuration was loaded.
 		return nil, nil
 	}
 
-	tactics := server.DefaultTactics.clone()
+	tactics := snapshot.defaultTactics.clone()
 
 	var aggregatedValues map[string]int
 
-	for _, filteredTactics := range server.FilteredTactics {
+	for _, filteredTactics := range snapshot.filteredTactics {
 
 		if len(filteredTactics.Filter.Regions) > 0 {
 			if filteredTactics.Filter.regionLookup != nil {
@@ -709,6 +863,18 @@ func (server *Server) getTactics(
 			}
 		}
 
+		if len(filteredTactics.Filter.ASNs) > 0 {
+			if filteredTactics.Filter.asnLookup != nil {
+				if !filteredTactics.Filter.asnLookup[geoIPData.ASN] {
+					continue
+				}
+			} else {
+				if !common.Contains(filteredTactics.Filter.ASNs, geoIPData.ASN) {
+					continue
+				}
+			}
+		}
+
 		if filteredTactics.Filter.APIParameters != nil {
 			mismatch := false
 			for name, values := range filteredTactics.Filter.APIParameters {
@@ -1106,7 +1272,7 @@ func (listener *Listener) Accept() (net.Conn, error) {
 
 		geoIPData := listener.geoIPLookup(common.IPAddressFromAddr(conn.RemoteAddr()))
 
-		tactics, err := listener.server.getTactics(geoIPData, make(common.APIParameters))
+		p, err := listener.server.GetServerSideParameters(geoIPData)
 		if err != nil {
 			listener.server.logger.WithContextFields(
 				common.LogFields{"error": err}).Warning("failed to get tactics for connection")
@@ -1115,28 +1281,12 @@ func (listener *Listener) Accept() (net.Conn, error) {
 			return conn, nil
 		}
 
-		if tactics == nil {
-			// This server isn't configured with tactics.
-			return conn, nil
-		}
-
-		if !common.FlipWeightedCoin(tactics.Probability) {
-			// Skip tactics with the configured probability.
-			return conn, nil
-		}
-
-		clientParameters, err := parameters.NewClientParameters(nil)
-		if err != nil {
+		if p == nil {
+			// This server isn't configured with tactics, or the tactics
+			// were skipped.
 			return conn, nil
 		}
 
-		_, err = clientParameters.Set("", false, tactics.Parameters)
-		if err != nil {
-			return conn, nil
-		}
-
-		p := clientParameters.Get()
-
 		if listener.server.EnforceLimitsServerSide {
 			tunnelProtocols := p.TunnelProtocols(parameters.LimitTunnelProtocols)
 			if len(tunnelProtocols) > 0 &&
@@ -1188,6 +1338,49 @@ func (listener *Listener) Accept() (net.Conn, error) {
 	}
 }
 
+// GetServerSideParameters returns client parameters, with tactics applied,
+// for use in a server-side implementation of tactics parameters for a
+// client with the specified GeoIP data. Tactics filtering is limited to
+// GeoIP attributes. GetServerSideParameters returns nil when the server
+// isn't configured with tactics or when the tactics are skipped, with the
+// configured probability.
+func (server *Server) GetServerSideParameters(
+	geoIPData common.GeoIPData) (*parameters.ClientParametersSnapshot, error) {
+
+	return server.GetSnapshot().GetServerSideParameters(geoIPData)
+}
+
+// GetServerSideParameters is Server.GetServerSideParameters using the
+// tactics in the snapshot.
+func (snapshot *Snapshot) GetServerSideParameters(
+	geoIPData common.GeoIPData) (*parameters.ClientParametersSnapshot, error) {
+
+	tactics, err := snapshot.getTactics(geoIPData, make(common.APIParameters))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if tactics == nil {
+		return nil, nil
+	}
+
+	if !common.FlipWeightedCoin(tactics.Probability) {
+		return nil, nil
+	}
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	_, err = clientParameters.Set("", false, tactics.Parameters)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return clientParameters.Get(), nil
+}
+
 // RoundTripper performs a round trip to the specified endpoint, sending the
 // request body and returning the response body. The context may be used to
 // set a timeout or cancel the rount trip.
@@ -1206,6 +1399,8 @@ type Storer interface {
 	GetTacticsRecord(networkID string) ([]byte, error)
 	SetSpeedTestSamplesRecord(networkID string, record []byte) error
 	GetSpeedTestSamplesRecord(networkID string) ([]byte, error)
+	SetSignedTacticsVersionRecord(record []byte) error
+	GetSignedTacticsVersionRecord() ([]byte, error)
 }
 
 // SetTacticsAPIParameters populates apiParams with the additional
@@ -1463,6 +1658,237 @@ func FetchTactics(
 	return record, nil
 }
 
+// MakeSignedTacticsPayload creates a signed tactics payload, containing the
+// specified tactics, for distribution via a fronted or otherwise untunneled
+// endpoint. The payload is signed with the given key and compressed, using
+// the common authenticated data package format. The tactics must specify a
+// TTL and non-zero Probability.
+//
+// The version must be > 0 and must be higher than the version of any
+// previously published payload with the same epoch; clients reject payloads
+// older than the last payload they applied.
+func MakeSignedTacticsPayload(
+	tactics *Tactics,
+	version SignedTacticsVersion,
+	signingPublicKey string,
+	signingPrivateKey string) ([]byte, error) {
+
+	if version.Epoch < 0 || version.Version <= 0 {
+		return nil, common.ContextError(errors.New("invalid version"))
+	}
+
+	marshaledTactics, err := json.Marshal(tactics)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// As in GetTacticsPayload, the tag is an MD5 data checksum of the
+	// tactics; the signature provides authentication.
+	digest := md5.Sum(marshaledTactics)
+	tag := hex.EncodeToString(digest[:])
+
+	payload := &Payload{
+		Tag:     tag,
+		Tactics: marshaledTactics,
+		Epoch:   version.Epoch,
+		Version: version.Version,
+	}
+
+	marshaledPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	signedPayload, err := common.WriteAuthenticatedDataPackage(
+		string(marshaledPayload), signingPublicKey, signingPrivateKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if len(signedPayload) > MAX_SIGNED_TACTICS_PAYLOAD_SIZE {
+		return nil, common.ContextError(errors.New("signed payload exceeds size limit"))
+	}
+
+	return signedPayload, nil
+}
+
+// HandleSignedTacticsPayload verifies the signature of a signed tactics
+// payload, created by MakeSignedTacticsPayload, and updates the stored
+// tactics with the payload, as HandleTacticsPayload does. Both the signed
+// payload and its decompressed contents are limited to
+// MAX_SIGNED_TACTICS_PAYLOAD_SIZE.
+//
+// Payloads without a version, or with a lower version than the last applied
+// signed or pushed payload, are rejected. The version of the applied payload is
+// persisted; the version is shared by all network IDs.
+//
+// HandleSignedTacticsPayload is called by the Psiphon client to handle a
+// signed tactics payload fetched independently of any tunnel or Psiphon
+// server.
+func HandleSignedTacticsPayload(
+	storer Storer,
+	networkID string,
+	signingPublicKey string,
+	signedPayload []byte) (*Record, error) {
+
+	if len(signedPayload) > MAX_SIGNED_TACTICS_PAYLOAD_SIZE {
+		return nil, common.ContextError(errors.New("signed payload exceeds size limit"))
+	}
+
+	// Decompress with a size limit rather than using
+	// ReadAuthenticatedDataPackage decompression, which is unbounded.
+
+	zlibReader, err := zlib.NewReader(bytes.NewReader(signedPayload))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	packageJSON, err := ioutil.ReadAll(
+		io.LimitReader(zlibReader, MAX_SIGNED_TACTICS_PAYLOAD_SIZE+1))
+	zlibReader.Close()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if len(packageJSON) > MAX_SIGNED_TACTICS_PAYLOAD_SIZE {
+		return nil, common.ContextError(errors.New("payload exceeds size limit"))
+	}
+
+	marshaledPayload, err := common.ReadAuthenticatedDataPackage(
+		packageJSON, false, signingPublicKey)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var payload *Payload
+	err = json.Unmarshal([]byte(marshaledPayload), &payload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if payload == nil || payload.Tactics == nil {
+		return nil, common.ContextError(errors.New("missing tactics"))
+	}
+
+	record, err := handleVersionedTacticsPayload(storer, networkID, payload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return record, nil
+}
+
+// HandlePushedTacticsPayload updates the stored tactics with a payload
+// pushed by the server of an established tunnel, created by
+// GetPushedTacticsPayload, as HandleTacticsPayload does. The payload is
+// limited to MAX_PUSHED_TACTICS_PAYLOAD_SIZE.
+//
+// Pushed payloads are authenticated by the tunnel's SSH connection and are
+// version checked exactly as signed payloads are: payloads without a
+// version, or with a lower version than the last applied signed or pushed
+// payload, are rejected.
+func HandlePushedTacticsPayload(
+	storer Storer,
+	networkID string,
+	marshaledPayload []byte) (*Record, error) {
+
+	if len(marshaledPayload) > MAX_PUSHED_TACTICS_PAYLOAD_SIZE {
+		return nil, common.ContextError(errors.New("pushed payload exceeds size limit"))
+	}
+
+	var payload *Payload
+	err := json.Unmarshal(marshaledPayload, &payload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if payload == nil || payload.Tactics == nil {
+		return nil, common.ContextError(errors.New("missing tactics"))
+	}
+
+	record, err := handleVersionedTacticsPayload(storer, networkID, payload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return record, nil
+}
+
+func handleVersionedTacticsPayload(
+	storer Storer,
+	networkID string,
+	payload *Payload) (*Record, error) {
+
+	if payload.Epoch < 0 || payload.Version <= 0 {
+		return nil, common.ContextError(errors.New("missing version"))
+	}
+
+	version := SignedTacticsVersion{
+		Epoch:   payload.Epoch,
+		Version: payload.Version,
+	}
+
+	storedVersion, err := getStoredSignedTacticsVersion(storer)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if version.Less(storedVersion) {
+		return nil, common.ContextError(
+			fmt.Errorf("tactics version %d.%d is older than applied version %d.%d",
+				version.Epoch, version.Version, storedVersion.Epoch, storedVersion.Version))
+	}
+
+	record, err := HandleTacticsPayload(storer, networkID, payload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if storedVersion.Less(version) {
+		err = setStoredSignedTacticsVersion(storer, version)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	return record, nil
+}
+
+func getStoredSignedTacticsVersion(storer Storer) (SignedTacticsVersion, error) {
+
+	var version SignedTacticsVersion
+
+	marshaledVersion, err := storer.GetSignedTacticsVersionRecord()
+	if err != nil {
+		return version, common.ContextError(err)
+	}
+
+	if marshaledVersion == nil {
+		return version, nil
+	}
+
+	err = json.Unmarshal(marshaledVersion, &version)
+	if err != nil {
+		return version, common.ContextError(err)
+	}
+
+	return version, nil
+}
+
+func setStoredSignedTacticsVersion(storer Storer, version SignedTacticsVersion) error {
+
+	marshaledVersion, err := json.Marshal(version)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = storer.SetSignedTacticsVersionRecord(marshaledVersion)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 // MakeSpeedTestResponse creates a speed test response prefixed
 // with a timestamp and followed by random padding. The timestamp
 // enables the client performing the speed test to record the
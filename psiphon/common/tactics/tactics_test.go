@@ -22,6 +22,7 @@ package tactics
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -803,9 +804,462 @@ func TestTactics(t *testing.T) {
 	// TODO: test Server.Validate with invalid tactics configurations
 }
 
+func TestTacticsGeoIPFilters(t *testing.T) {
+
+	// Long and short ISP and ASN lists test both map and slice lookups
+
+	tacticsConfig := `
+    {
+      "DefaultTactics" : {
+        "TTL" : "1s",
+        "Probability" : 1.0
+      },
+      "FilteredTactics" : [
+        {
+          "Filter" : {
+            "ISPs": ["I1", "I2", "I3", "I4", "I5", "I6"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "ConnectionWorkerPoolSize" : 1
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "ASNs": ["1", "2", "3", "4", "5", "6"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "LimitIntensiveConnectionWorkers" : 2
+            }
+          }
+        },
+        {
+          "Filter" : {
+            "ISPs": ["I7"],
+            "ASNs": ["7"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "ConnectionWorkerPoolSize" : 7
+            }
+          }
+        }
+      ]
+    }
+    `
+
+	configFile, err := ioutil.TempFile("", "tactics.config")
+	if err != nil {
+		t.Fatalf("TempFile failed: %s", err)
+	}
+	defer os.Remove(configFile.Name())
+
+	_, err = configFile.Write([]byte(tacticsConfig))
+	configFile.Close()
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	server, err := NewServer(nil, nil, nil, configFile.Name())
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	testCases := []struct {
+		description        string
+		geoIPData          common.GeoIPData
+		expectedParameters map[string]interface{}
+	}{
+		{
+			"no match",
+			common.GeoIPData{ISP: "I0", ASN: "0"},
+			map[string]interface{}{},
+		},
+		{
+			"ISP match",
+			common.GeoIPData{ISP: "I1", ASN: "0"},
+			map[string]interface{}{"ConnectionWorkerPoolSize": 1.0},
+		},
+		{
+			"ASN match",
+			common.GeoIPData{ISP: "I0", ASN: "6"},
+			map[string]interface{}{"LimitIntensiveConnectionWorkers": 2.0},
+		},
+		{
+			"ISP and ASN match",
+			common.GeoIPData{ISP: "I7", ASN: "7"},
+			map[string]interface{}{"ConnectionWorkerPoolSize": 7.0},
+		},
+		{
+			"ISP match ASN mismatch",
+			common.GeoIPData{ISP: "I7", ASN: "8"},
+			map[string]interface{}{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			tactics, err := server.GetSnapshot().getTactics(testCase.geoIPData, nil)
+			if err != nil {
+				t.Fatalf("getTactics failed: %s", err)
+			}
+
+			parameters := tactics.Parameters
+			if parameters == nil {
+				parameters = map[string]interface{}{}
+			}
+
+			if !reflect.DeepEqual(parameters, testCase.expectedParameters) {
+				t.Fatalf("unexpected parameters: %+v", parameters)
+			}
+		})
+	}
+}
+
+func TestTacticsReloadSnapshot(t *testing.T) {
+
+	// Each configuration sets both parameters to the same value, so a
+	// torn read, mixing two configurations, is detected as a mismatch.
+
+	makeTacticsConfig := func(value int) []byte {
+		return []byte(fmt.Sprintf(`
+    {
+      "DefaultTactics" : {
+        "TTL" : "1s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "ConnectionWorkerPoolSize" : %d
+        }
+      },
+      "FilteredTactics" : [
+        {
+          "Filter" : {
+            "Regions": ["R1"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "LimitIntensiveConnectionWorkers" : %d
+            }
+          }
+        }
+      ]
+    }
+    `, value, value))
+	}
+
+	configFile, err := ioutil.TempFile("", "tactics.config")
+	if err != nil {
+		t.Fatalf("TempFile failed: %s", err)
+	}
+	configFileName := configFile.Name()
+	configFile.Close()
+	defer os.Remove(configFileName)
+
+	err = ioutil.WriteFile(configFileName, makeTacticsConfig(1), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	server, err := NewServer(nil, nil, nil, configFileName)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	stopReloading := make(chan struct{})
+	reloadErrors := make(chan error, 1)
+	reloadsDone := make(chan struct{})
+
+	go func() {
+		defer close(reloadsDone)
+		for i := 2; ; i++ {
+			select {
+			case <-stopReloading:
+				return
+			default:
+			}
+			// Write to a temporary file and rename, so the reload never
+			// reads a partially written file.
+			newFileName := configFileName + ".new"
+			err := ioutil.WriteFile(newFileName, makeTacticsConfig(i), 0600)
+			if err == nil {
+				err = os.Rename(newFileName, configFileName)
+			}
+			if err == nil {
+				_, err = server.Reload()
+			}
+			if err != nil {
+				reloadErrors <- err
+				return
+			}
+		}
+	}()
+
+	geoIPData := common.GeoIPData{Country: "R1"}
+
+	handshakeErrors := make(chan error, 100)
+
+	for i := 0; i < 100; i++ {
+		go func() {
+
+			// As in a handshake, multiple tactics lookups are made using one
+			// snapshot, with a reload possibly occurring between lookups.
+
+			snapshot := server.GetSnapshot()
+
+			var values []int
+
+			for j := 0; j < 10; j++ {
+
+				p, err := snapshot.GetServerSideParameters(geoIPData)
+				if err != nil {
+					handshakeErrors <- err
+					return
+				}
+
+				values = append(values,
+					p.Int(parameters.ConnectionWorkerPoolSize),
+					p.Int(parameters.LimitIntensiveConnectionWorkers))
+
+				payload, err := snapshot.GetTacticsPayload(
+					geoIPData,
+					common.APIParameters{STORED_TACTICS_TAG_PARAMETER_NAME: ""})
+				if err != nil {
+					handshakeErrors <- err
+					return
+				}
+
+				var tactics Tactics
+				err = json.Unmarshal(payload.Tactics, &tactics)
+				if err != nil {
+					handshakeErrors <- err
+					return
+				}
+
+				for _, name := range []string{
+					parameters.ConnectionWorkerPoolSize,
+					parameters.LimitIntensiveConnectionWorkers} {
+
+					value, _ := tactics.Parameters[name].(float64)
+					values = append(values, int(value))
+				}
+			}
+
+			for _, value := range values {
+				if value != values[0] {
+					handshakeErrors <- fmt.Errorf("torn read: %v", values)
+					return
+				}
+			}
+
+			handshakeErrors <- nil
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		err := <-handshakeErrors
+		if err != nil {
+			t.Errorf("handshake failed: %s", err)
+		}
+	}
+
+	close(stopReloading)
+	<-reloadsDone
+
+	select {
+	case err := <-reloadErrors:
+		t.Fatalf("Reload failed: %s", err)
+	default:
+	}
+}
+
+func TestSignedTactics(t *testing.T) {
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	otherSigningPublicKey, otherSigningPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	tactics := &Tactics{
+		TTL:         "1h",
+		Probability: 1.0,
+		Parameters: map[string]interface{}{
+			"LimitTunnelProtocols": []string{protocol.TUNNEL_PROTOCOL_FRONTED_MEEK},
+		},
+	}
+
+	signedPayload, err := MakeSignedTacticsPayload(
+		tactics, SignedTacticsVersion{Version: 2}, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("MakeSignedTacticsPayload failed: %s", err)
+	}
+
+	networkID := "NETWORK1"
+	storer := newTestStorer()
+
+	record, err := HandleSignedTacticsPayload(
+		storer, networkID, signingPublicKey, signedPayload)
+	if err != nil {
+		t.Fatalf("HandleSignedTacticsPayload failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(record.Tactics.Parameters["LimitTunnelProtocols"],
+		[]interface{}{protocol.TUNNEL_PROTOCOL_FRONTED_MEEK}) {
+
+		t.Fatalf("unexpected tactics: %+v", record.Tactics)
+	}
+
+	storedRecord, err := UseStoredTactics(storer, networkID)
+	if err != nil {
+		t.Fatalf("UseStoredTactics failed: %s", err)
+	}
+	if storedRecord == nil || storedRecord.Tag != record.Tag {
+		t.Fatalf("unexpected stored tactics: %+v", storedRecord)
+	}
+
+	// The same version may be applied again, while an older version is
+	// rejected.
+
+	_, err = HandleSignedTacticsPayload(
+		storer, networkID, signingPublicKey, signedPayload)
+	if err != nil {
+		t.Fatalf("HandleSignedTacticsPayload failed: %s", err)
+	}
+
+	oldSignedPayload, err := MakeSignedTacticsPayload(
+		tactics, SignedTacticsVersion{Version: 1}, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("MakeSignedTacticsPayload failed: %s", err)
+	}
+
+	_, err = HandleSignedTacticsPayload(
+		storer, networkID, signingPublicKey, oldSignedPayload)
+	if err == nil || !strings.Contains(err.Error(), "older than applied version") {
+		t.Fatalf("HandleSignedTacticsPayload unexpectedly succeeded: %v", err)
+	}
+
+	// The applied version applies to all network IDs.
+
+	_, err = HandleSignedTacticsPayload(
+		storer, "NETWORK2", signingPublicKey, oldSignedPayload)
+	if err == nil {
+		t.Fatalf("HandleSignedTacticsPayload unexpectedly succeeded")
+	}
+
+	// Recovery from an erroneously high version: a new epoch resets the
+	// version sequence.
+
+	highSignedPayload, err := MakeSignedTacticsPayload(
+		tactics, SignedTacticsVersion{Version: 1000000}, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("MakeSignedTacticsPayload failed: %s", err)
+	}
+
+	_, err = HandleSignedTacticsPayload(
+		storer, networkID, signingPublicKey, highSignedPayload)
+	if err != nil {
+		t.Fatalf("HandleSignedTacticsPayload failed: %s", err)
+	}
+
+	newEpochSignedPayload, err := MakeSignedTacticsPayload(
+		tactics, SignedTacticsVersion{Epoch: 1, Version: 1}, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("MakeSignedTacticsPayload failed: %s", err)
+	}
+
+	_, err = HandleSignedTacticsPayload(
+		storer, networkID, signingPublicKey, newEpochSignedPayload)
+	if err != nil {
+		t.Fatalf("HandleSignedTacticsPayload failed: %s", err)
+	}
+
+	_, err = HandleSignedTacticsPayload(
+		storer, networkID, signingPublicKey, highSignedPayload)
+	if err == nil {
+		t.Fatalf("HandleSignedTacticsPayload unexpectedly succeeded")
+	}
+
+	// A version is required.
+
+	_, err = MakeSignedTacticsPayload(
+		tactics, SignedTacticsVersion{}, signingPublicKey, signingPrivateKey)
+	if err == nil {
+		t.Fatalf("MakeSignedTacticsPayload unexpectedly succeeded")
+	}
+
+	// A payload signed with another key is rejected.
+
+	otherSignedPayload, err := MakeSignedTacticsPayload(
+		tactics, SignedTacticsVersion{Version: 2}, otherSigningPublicKey, otherSigningPrivateKey)
+	if err != nil {
+		t.Fatalf("MakeSignedTacticsPayload failed: %s", err)
+	}
+
+	_, err = HandleSignedTacticsPayload(
+		newTestStorer(), networkID, signingPublicKey, otherSignedPayload)
+	if err == nil {
+		t.Fatalf("HandleSignedTacticsPayload unexpectedly succeeded")
+	}
+
+	// A modified payload is rejected.
+
+	packageJSON, err := common.Decompress(signedPayload)
+	if err != nil {
+		t.Fatalf("Decompress failed: %s", err)
+	}
+
+	var dataPackage *common.AuthenticatedDataPackage
+	err = json.Unmarshal(packageJSON, &dataPackage)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	dataPackage.Data = strings.Replace(dataPackage.Data, "FRONTED", "UNFRONTED", 1)
+
+	packageJSON, err = json.Marshal(dataPackage)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	_, err = HandleSignedTacticsPayload(
+		newTestStorer(), networkID, signingPublicKey, common.Compress(packageJSON))
+	if err == nil {
+		t.Fatalf("HandleSignedTacticsPayload unexpectedly succeeded")
+	}
+
+	// Payloads which exceed the size limit, compressed or decompressed, are
+	// rejected.
+
+	_, err = HandleSignedTacticsPayload(
+		newTestStorer(),
+		networkID,
+		signingPublicKey,
+		make([]byte, MAX_SIGNED_TACTICS_PAYLOAD_SIZE+1))
+	if err == nil {
+		t.Fatalf("HandleSignedTacticsPayload unexpectedly succeeded")
+	}
+
+	_, err = HandleSignedTacticsPayload(
+		newTestStorer(),
+		networkID,
+		signingPublicKey,
+		common.Compress(make([]byte, MAX_SIGNED_TACTICS_PAYLOAD_SIZE+1)))
+	if err == nil || !strings.Contains(err.Error(), "size limit") {
+		t.Fatalf("HandleSignedTacticsPayload unexpectedly succeeded: %v", err)
+	}
+}
+
 type testStorer struct {
-	tacticsRecords         map[string][]byte
-	speedTestSampleRecords map[string][]byte
+	tacticsRecords             map[string][]byte
+	speedTestSampleRecords     map[string][]byte
+	signedTacticsVersionRecord []byte
 }
 
 func newTestStorer() *testStorer {
@@ -833,6 +1287,15 @@ func (s *testStorer) GetSpeedTestSamplesRecord(networkID string) ([]byte, error)
 	return s.speedTestSampleRecords[networkID], nil
 }
 
+func (s *testStorer) SetSignedTacticsVersionRecord(record []byte) error {
+	s.signedTacticsVersionRecord = record
+	return nil
+}
+
+func (s *testStorer) GetSignedTacticsVersionRecord() ([]byte, error) {
+	return s.signedTacticsVersionRecord, nil
+}
+
 type testLogger struct {
 }
 
@@ -879,3 +1342,144 @@ func (l *testLoggerContext) Warning(args ...interface{}) {
 func (l *testLoggerContext) Error(args ...interface{}) {
 	l.log("ERROR", fmt.Sprint(args...))
 }
+
+func TestPushedTactics(t *testing.T) {
+
+	tacticsConfigTemplate := `
+    {
+      "Epoch" : 0,
+      "Version" : %d,
+      "DefaultTactics" : {
+        "TTL" : "1h",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "ConnectionWorkerPoolSize" : %d
+        }
+      }
+    }
+    `
+
+	configFile, err := ioutil.TempFile("", "tactics.config")
+	if err != nil {
+		t.Fatalf("TempFile failed: %s", err)
+	}
+	configFileName := configFile.Name()
+	configFile.Close()
+	defer os.Remove(configFileName)
+
+	writeConfig := func(version, poolSize int) {
+		err := ioutil.WriteFile(
+			configFileName,
+			[]byte(fmt.Sprintf(tacticsConfigTemplate, version, poolSize)),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	// Without a version, tactics aren't pushed.
+
+	writeConfig(0, 1)
+
+	server, err := NewServer(nil, nil, nil, configFileName)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	payload, err := server.GetSnapshot().GetPushedTacticsPayload(common.GeoIPData{}, nil)
+	if err != nil {
+		t.Fatalf("GetPushedTacticsPayload failed: %s", err)
+	}
+	if payload != nil {
+		t.Fatalf("unexpected pushed payload")
+	}
+
+	getPushedPayload := func(version, poolSize int) []byte {
+
+		writeConfig(version, poolSize)
+
+		// Ensure the config file modification time changes for Reload.
+		modTime := time.Now().Add(time.Duration(version) * time.Second)
+		err := os.Chtimes(configFileName, modTime, modTime)
+		if err != nil {
+			t.Fatalf("Chtimes failed: %s", err)
+		}
+
+		_, err = server.Reload()
+		if err != nil {
+			t.Fatalf("Reload failed: %s", err)
+		}
+
+		payload, err := server.GetSnapshot().GetPushedTacticsPayload(common.GeoIPData{}, nil)
+		if err != nil {
+			t.Fatalf("GetPushedTacticsPayload failed: %s", err)
+		}
+		if payload == nil || payload.Tactics == nil || payload.Version != int64(version) {
+			t.Fatalf("unexpected pushed payload: %+v", payload)
+		}
+
+		marshaledPayload, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatalf("Marshal failed: %s", err)
+		}
+
+		return marshaledPayload
+	}
+
+	oldPayload := getPushedPayload(1, 2)
+	newPayload := getPushedPayload(2, 3)
+
+	networkID := "NETWORK1"
+	storer := newTestStorer()
+
+	record, err := HandlePushedTacticsPayload(storer, networkID, newPayload)
+	if err != nil {
+		t.Fatalf("HandlePushedTacticsPayload failed: %s", err)
+	}
+	if record.Tactics.Parameters["ConnectionWorkerPoolSize"] != 3.0 {
+		t.Fatalf("unexpected tactics: %+v", record.Tactics)
+	}
+
+	// Pushed tactics are version checked: an older pushed payload is
+	// rejected, as is an older signed payload.
+
+	_, err = HandlePushedTacticsPayload(storer, networkID, oldPayload)
+	if err == nil || !strings.Contains(err.Error(), "older than applied version") {
+		t.Fatalf("HandlePushedTacticsPayload unexpectedly succeeded: %v", err)
+	}
+
+	signingPublicKey, signingPrivateKey, err := common.GenerateAuthenticatedDataPackageKeys()
+	if err != nil {
+		t.Fatalf("GenerateAuthenticatedDataPackageKeys failed: %s", err)
+	}
+
+	signedPayload, err := MakeSignedTacticsPayload(
+		&record.Tactics, SignedTacticsVersion{Version: 1}, signingPublicKey, signingPrivateKey)
+	if err != nil {
+		t.Fatalf("MakeSignedTacticsPayload failed: %s", err)
+	}
+
+	_, err = HandleSignedTacticsPayload(
+		storer, networkID, signingPublicKey, signedPayload)
+	if err == nil {
+		t.Fatalf("HandleSignedTacticsPayload unexpectedly succeeded")
+	}
+
+	// Unversioned and oversized payloads are rejected.
+
+	unversionedPayload, err := json.Marshal(&Payload{Tag: "tag", Tactics: []byte("{}")})
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	_, err = HandlePushedTacticsPayload(newTestStorer(), networkID, unversionedPayload)
+	if err == nil {
+		t.Fatalf("HandlePushedTacticsPayload unexpectedly succeeded")
+	}
+
+	_, err = HandlePushedTacticsPayload(
+		newTestStorer(), networkID, make([]byte, MAX_PUSHED_TACTICS_PAYLOAD_SIZE+1))
+	if err == nil {
+		t.Fatalf("HandlePushedTacticsPayload unexpectedly succeeded")
+	}
+}
@@ -24,20 +24,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"unicode"
 
+	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/pt"
 )
 
 const (
-	TUNNEL_POOL_SIZE = 1
+	TUNNEL_POOL_SIZE                    = 1
+	PLUGGABLE_TRANSPORT_STATE_DIRECTORY = "pt_state"
 )
 
 // Config is the Psiphon configuration specified by the application. This
@@ -55,9 +60,39 @@ type Config struct {
 	// Warning: If the datastore file, DataStoreDirectory/DATA_STORE_FILENAME,
 	// exists but fails to open for any reason (checksum error, unexpected
 	// file format, etc.) it will be deleted in order to pave a new datastore
-	// and continue running.
+	// and continue running. A DataStoreRecovered notice is emitted. Server
+	// entries are restored by the next embedded server list import and
+	// remote server list fetch; all other stored state is lost.
 	DataStoreDirectory string
 
+	// BackupCorruptDataStore specifies that a corrupt datastore file is
+	// retained, as DataStoreDirectory/DATA_STORE_FILENAME.corrupt, instead
+	// of being deleted. Only the most recent corrupt datastore file is
+	// retained. This is intended for diagnosing datastore corruption.
+	BackupCorruptDataStore bool
+
+	// DataStoreShardServerEntries enables sharding of stored server entries
+	// across multiple datastore buckets, selected by a hash prefix of the
+	// server entry ID. Scans of very large server lists are faster when
+	// sharded, as the shards are scanned in parallel. When this value
+	// changes, the stored server entries are migrated when the datastore is
+	// opened.
+	DataStoreShardServerEntries bool
+
+	// DataStoreWriteBufferSize is the maximum number of failed non-critical
+	// datastore writes which are buffered in memory and retried. Non-critical
+	// writes are those of stats and learned connection state, such as server
+	// affinity, server scores, and protocol health; failures of these writes,
+	// as when device storage is temporarily unavailable, don't fail tunnel
+	// establishment or API requests. When the buffer is full, additional
+	// failed writes are dropped and counted. Failures of critical writes,
+	// such as storing server entries and tactics, are always returned.
+	//
+	// When omitted, the default DATA_STORE_WRITE_BUFFER_SIZE is used. When 0,
+	// non-critical writes aren't buffered and failures are returned, as for
+	// critical writes.
+	DataStoreWriteBufferSize *int
+
 	// PropagationChannelId is a string identifier which indicates how the
 	// Psiphon client was distributed. This parameter is required. This value
 	// is supplied by and depends on the Psiphon Network, and is typically
@@ -110,20 +145,102 @@ type Config struct {
 	// free port (a notice reporting the selected port is emitted).
 	LocalSocksProxyPort int
 
+	// LocalSocksProxyUnixSocketPath, when set, specifies a Unix domain socket
+	// path on which to run the local SOCKS proxy, in place of a TCP port.
+	// When set, LocalSocksProxyPort and ListenInterface are ignored for the
+	// SOCKS proxy. The socket is accessible only to the user running the
+	// client.
+	LocalSocksProxyUnixSocketPath string
+
+	// LocalSocksProxyUsername and LocalSocksProxyPassword, when set, require
+	// local SOCKS proxy clients to authenticate using SOCKS5 username/password
+	// authentication (RFC 1929). Unauthenticated connections, including all
+	// SOCKS4a connections, are rejected. This prevents other users and
+	// processes on a shared host from using the tunnel via the SOCKS proxy.
+	// When set, both values must be non-empty.
+	LocalSocksProxyUsername string
+	LocalSocksProxyPassword string
+
 	// LocalHttpProxyPort specifies a port number for the local HTTP proxy
 	// running at 127.0.0.1. For the default value, 0, the system selects a
 	// free port (a notice reporting the selected port is emitted).
 	LocalHttpProxyPort int
 
+	// LocalHttpProxyUnixSocketPath, when set, specifies a Unix domain socket
+	// path on which to run the local HTTP proxy, in place of a TCP port.
+	// When set, LocalHttpProxyPort and ListenInterface are ignored for the
+	// HTTP proxy. The socket is accessible only to the user running the
+	// client. URL proxy rewriting, which requires a TCP proxy address, is
+	// not supported.
+	LocalHttpProxyUnixSocketPath string
+
 	// DisableLocalHTTPProxy disables running the local HTTP proxy.
 	DisableLocalHTTPProxy bool
 
+	// EnableLocalDNSProxy enables running the local DNS proxy, which accepts
+	// UDP and TCP DNS queries and resolves them through the tunnel, using
+	// the server's DNS resolver. Except for bypass domains, queries are
+	// never resolved outside of the tunnel; when no tunnel is connected,
+	// queries fail.
+	EnableLocalDNSProxy bool
+
+	// LocalDNSProxyPort specifies a port number for the local DNS proxy,
+	// which listens for both UDP and TCP queries on the same port. For the
+	// default value, 0, the system selects a free port (a notice reporting
+	// the selected port is emitted).
+	LocalDNSProxyPort int
+
+	// LocalDNSProxyBlockedDomains specifies domains for which the local DNS
+	// proxy answers NXDOMAIN, without resolving. Subdomains of a blocked
+	// domain are also blocked. This may be used to block known-malicious
+	// domains, or leak-prone domains such as "use-application-dns.net",
+	// which signals browsers to not use their own DNS-over-HTTPS resolvers.
+	LocalDNSProxyBlockedDomains []string
+
+	// LocalDNSProxyBypassDomains specifies domains which the local DNS proxy
+	// resolves using the system resolver, outside of the tunnel, so that
+	// local network names, such as printers and intranet hosts, continue to
+	// resolve. Subdomains of a bypass domain are also bypassed. Blocked
+	// domains take precedence.
+	//
+	// Unless LocalDNSProxyDisableDefaultBypassDomains is set, the captive
+	// portal detection domains in DNS_PROXY_DEFAULT_BYPASS_DOMAINS are also
+	// bypassed.
+	LocalDNSProxyBypassDomains               []string
+	LocalDNSProxyDisableDefaultBypassDomains bool
+
+	// LocalDNSProxySeparateTunnel specifies that local DNS proxy queries are
+	// resolved through a dedicated tunnel, to a different server than the
+	// tunnels used for port forwards, so that no single server observes
+	// both a client's DNS lookups and its connections. Each tunnel is
+	// dedicated to either DNS or port forwards for its lifetime.
+	//
+	// LocalDNSProxySeparateTunnel requires EnableLocalDNSProxy and a
+	// TunnelPoolSize of at least 2. The DNS tunnel is an additional tunnel,
+	// with the additional connection, keep alive, and battery overhead of
+	// an extra tunnel, which is not used for port forwards. DNS queries fail
+	// while there is no DNS tunnel, including when only one tunnel has been
+	// established; as usual, queries are never resolved outside of a tunnel.
+	LocalDNSProxySeparateTunnel bool
+
 	// NetworkLatencyMultiplier is a multiplier that is to be applied to
 	// default network event timeouts. Set this to tune performance for
 	// slow networks.
 	// When set, must be >= 1.0.
 	NetworkLatencyMultiplier float64
 
+	// PreferredIPAddressFamily, when "IPv4" or "IPv6", specifies the IP
+	// address family that is dialed first when a TCP dial address resolves
+	// to both families. For the default, "", the preferred family is learned
+	// from recent dial outcomes on the current network.
+	PreferredIPAddressFamily string
+
+	// MeekFailoverOrder, when "fronted" or "unfronted", specifies which meek
+	// class is tried first for servers supporting both fronted and unfronted
+	// meek, with failover to the other class. Tactics may override this
+	// value. For the default, "", there is no meek failover.
+	MeekFailoverOrder string
+
 	// TunnelProtocol indicates which protocol to use. For the default, "",
 	// all protocols are used.
 	//
@@ -183,11 +300,67 @@ type Config struct {
 	// recommended.
 	ConnectionWorkerPoolSize int
 
+	// MaxConcurrentConnectionAttempts specifies the maximum number of
+	// concurrent in-flight connection attempts, including additional
+	// attempts made when racing meek failover and IP address family
+	// fallback dials. If omitted or when 0, a platform-specific default is
+	// used; this is recommended.
+	MaxConcurrentConnectionAttempts int
+
+	// BootstrapProfile selects the establishment parallelism and
+	// per-candidate connect timeout used until the first tunnel is
+	// established: "fast", for good, unmetered networks; "balanced", the
+	// steady-state settings; or "conservative", for metered networks. If
+	// omitted, the defaults, or any values set by tactics, are used.
+	BootstrapProfile string
+
+	// BootstrapConnectionWorkerPoolSize and
+	// BootstrapTunnelConnectTimeoutSeconds override the corresponding
+	// BootstrapProfile settings. If omitted or when 0, the profile settings
+	// are used. See parameters.BootstrapConnectionWorkerPoolSize.
+	BootstrapConnectionWorkerPoolSize    int
+	BootstrapTunnelConnectTimeoutSeconds *int
+
+	// ConnectionPreference biases tunnel protocol selection, buffer sizing,
+	// and write coalescing towards "latency", for responsive browsing, or
+	// "throughput", for downloads. "balanced" uses the defaults. The
+	// preference is a hint: tunnel protocol limits and any values set by
+	// tactics take precedence. If omitted, the defaults are used.
+	ConnectionPreference string
+
 	// TunnelPoolSize specifies how many tunnels to run in parallel. Port
 	// forwards are multiplexed over multiple tunnels. If omitted or when 0,
 	// the default is TUNNEL_POOL_SIZE, which is recommended.
 	TunnelPoolSize int
 
+	// MaxTunnelPoolSize enables adaptive tunnel pool sizing when greater
+	// than TunnelPoolSize. With adaptive sizing, TunnelPoolSize is the
+	// minimum pool size; the pool grows, up to MaxTunnelPoolSize, when
+	// tunnel failures are frequent, so that another tunnel is already
+	// established when the active tunnel fails; and shrinks when tunnels are
+	// stable, to reduce server load and battery usage. The thresholds are
+	// set by the TunnelPoolGrow and TunnelPoolShrink parameters.
+	MaxTunnelPoolSize int
+
+	// ShareTLSSessionCache specifies that all meek tunnels share a single
+	// TLS session cache, per TLS profile, so that a new tunnel may resume
+	// the TLS session of a previous tunnel to the same front or server.
+	// This saves a full TLS handshake but allows an observer, such as a
+	// CDN, to link the tunnels by their session tickets; and so, by
+	// default, each tunnel uses an isolated TLS session cache.
+	ShareTLSSessionCache bool
+
+	// TunnelTCPConnectTimeoutMilliseconds, TunnelTLSHandshakeTimeoutMilliseconds,
+	// TunnelSSHHandshakeTimeoutMilliseconds, and
+	// TunnelHandshakeAPITimeoutMilliseconds specify per-phase tunnel
+	// connection timeouts. When omitted, the defaults, or any values set by
+	// tactics, are used; tactics values override these config values. See
+	// the corresponding parameters, such as parameters.TunnelTCPConnectTimeout.
+	TunnelTCPConnectTimeoutMilliseconds   *int
+	TunnelTLSHandshakeTimeoutMilliseconds *int
+	TunnelSSHHandshakeTimeoutMilliseconds *int
+	TunnelHandshakeAPITimeoutMilliseconds *int
+
 	// StaggerConnectionWorkersMilliseconds adds a specified delay before
 	// making each server candidate available to connection workers. This
 	// option is enabled when StaggerConnectionWorkersMilliseconds > 0.
@@ -211,6 +384,37 @@ type Config struct {
 	// https://github.com/Psiphon-Labs/psiphon-tunnel-core/tree/master/psiphon/upstreamproxy
 	UpstreamProxyURL string
 
+	// PluggableTransportPath, when set, is the path of a Tor Pluggable
+	// Transport client executable, such as obfs4proxy, through which
+	// OSSH tunnels are dialed. The PT is launched as a managed proxy, as per
+	// version 1 of the PT specification, and must provide a SOCKS5 proxy.
+	// The PT then carries the OSSH stream to a PT server, such as an obfs4
+	// bridge, which must forward to the Psiphon server's OSSH port.
+	//
+	// As the PT makes its own network connections, UpstreamProxyURL,
+	// DeviceBinder, and fragmentation don't apply to PT dials. PTs are
+	// not supported on mobile platforms, which can't launch executables.
+	PluggableTransportPath string
+
+	// PluggableTransportArgs are any command line arguments for the PT
+	// client executable.
+	PluggableTransportArgs []string
+
+	// PluggableTransportName is the name of the transport to request from
+	// the PT, such as "obfs4" or "snowflake". Required with
+	// PluggableTransportPath.
+	PluggableTransportName string
+
+	// PluggableTransportServerAddress is the host:port address of the PT
+	// server. When the host is omitted, as in ":7002", the IP address of
+	// the selected server entry is used, which supports PT servers colocated
+	// with each Psiphon server. Required with PluggableTransportPath.
+	PluggableTransportServerAddress string
+
+	// PluggableTransportOptions are the per-connection PT arguments; for
+	// example, obfs4 requires "cert" and "iat-mode".
+	PluggableTransportOptions map[string]string
+
 	// CustomHeaders is a set of additional arbitrary HTTP headers that are
 	// added to all plaintext HTTP requests and requests made through an HTTP
 	// upstream proxy when specified by UpstreamProxyURL.
@@ -264,6 +468,20 @@ type Config struct {
 	// handling, and application of parameters.
 	DisableTactics bool
 
+	// SignedTacticsURLs is a list of URLs which specify locations to fetch
+	// a signed tactics payload. This facility is used to bootstrap tactics,
+	// independent of any tunnel, when a tactics request to a Psiphon server
+	// cannot be completed. The URLs are expected to be fronted or otherwise
+	// hard-to-block endpoints, such as CDN or cloud storage locations. At
+	// least one DownloadURL must have OnlyAfterAttempts = 0.
+	SignedTacticsURLs parameters.DownloadURLs
+
+	// SignedTacticsSignaturePublicKey specifies a public key that's used to
+	// authenticate the signed tactics payload fetched from
+	// SignedTacticsURLs. This value is supplied by and depends on the
+	// Psiphon Network, and is typically embedded in the client binary.
+	SignedTacticsSignaturePublicKey string
+
 	// TransformHostNames specifies whether to use hostname transformation
 	// circumvention strategies. Set to "always" to always transform, "never"
 	// to never transform, and "", the default, for the default transformation
@@ -319,6 +537,23 @@ type Config struct {
 	// client binary.
 	RemoteServerListSignaturePublicKey string
 
+	// ServerEntryRevocationListURLs is a list of URLs which specify locations
+	// to fetch the signed server entry revocation list, which lists
+	// decommissioned servers whose server entries are to be skipped. The
+	// revocation list is authenticated with
+	// RemoteServerListSignaturePublicKey and is fetched along with the
+	// common remote server list. This value is supplied by and depends on
+	// the Psiphon Network, and is typically embedded in the client binary.
+	// All URLs must point to the same entity with the same ETag. At least
+	// one DownloadURL must have OnlyAfterAttempts = 0.
+	ServerEntryRevocationListURLs parameters.DownloadURLs
+
+	// ServerEntryRevocationListDownloadFilename specifies a target filename
+	// for storing the server entry revocation list download. Data is stored
+	// in co-located files (ServerEntryRevocationListDownloadFilename.part*)
+	// to allow for resumable downloading.
+	ServerEntryRevocationListDownloadFilename string
+
 	// DisableRemoteServerListFetcher disables fetching remote server lists.
 	// This is used for special case temporary tunnels.
 	DisableRemoteServerListFetcher bool
@@ -439,6 +674,21 @@ type Config struct {
 	// region.
 	DeviceRegion string
 
+	// RegionHint is an optional, coarse region hint for the host device,
+	// a ISO 3166-1 alpha-2 country code which the host app may infer from,
+	// for example, the OS locale or timezone. Unlike DeviceRegion,
+	// RegionHint is never sent to a server.
+	//
+	// RegionHint is used, before any server contact, to select initial
+	// limit tunnel protocols from the RegionHintInitialLimitTunnelProtocols
+	// parameter. It is a hint only and never overrides tactics: once tactics
+	// are applied, including stored tactics, or when
+	// InitialLimitTunnelProtocols is set, RegionHint is not used.
+	//
+	// When RegionHint is omitted, the last known client region, persisted
+	// after a previous handshake, is used as the hint. See LastKnownRegion.
+	RegionHint string
+
 	// EmitDiagnosticNotices indicates whether to output notices containing
 	// detailed information about the Psiphon session. As these notices may
 	// contain sensitive network information, they should not be insecurely
@@ -501,9 +751,48 @@ type Config struct {
 	// calling clientParameters.Set directly will fail to add config values.
 	clientParameters *parameters.ClientParameters
 
-	dynamicConfigMutex sync.Mutex
-	sponsorID          string
-	authorizations     []string
+	dynamicConfigMutex   sync.Mutex
+	sponsorID            string
+	authorizations       []string
+	networkConditionHint string
+	bootstrapping        bool
+
+	// lastKnownRegion is the client region reported in a handshake made by
+	// this controller, and storedLastKnownRegion is the persisted region
+	// loaded when the controller was created. See LastKnownRegion.
+	lastKnownRegion       *lastKnownRegionRecord
+	storedLastKnownRegion string
+
+	tlsInterceptionDetected        bool
+	transparentProxyAvoidProtocols protocol.TunnelProtocols
+
+	// serverLoads records the most recent load level reported by each
+	// server, keyed by server IP address. See setServerLoad.
+	serverLoads map[string]serverLoad
+
+	// frontingDNSCache is shared by all fronted meek dials made using this
+	// config. See dnsCache.
+	frontingDNSCache *dnsCache
+
+	// ipAddressFamilyPreference is shared by all TCP dials made using this
+	// config. See ipAddressFamilyPreference.
+	ipAddressFamilyPreference *ipAddressFamilyPreference
+
+	// sourcePortHistory is shared by all tunnel TCP dials made using this
+	// config. See sourcePortHistory.
+	sourcePortHistory *sourcePortHistory
+
+	// connectionAttempts limits concurrent connection attempts made using
+	// this config. See connectionAttemptLimiter.
+	connectionAttempts *connectionAttemptLimiter
+
+	// sharedTLSClientSessionCache is shared by all meek dials made using
+	// this config when ShareTLSSessionCache is set, and is otherwise nil.
+	sharedTLSClientSessionCache *TLSClientSessionCache
+
+	// pluggableTransportClient is shared by all PT dials made using this
+	// config. pluggableTransportClient is nil when no PT is configured.
+	pluggableTransportClient *pt.Client
 
 	deviceBinder    DeviceBinder
 	networkIDGetter NetworkIDGetter
@@ -595,6 +884,12 @@ func (config *Config) Commit() error {
 			errors.New("sponsor ID is missing from the configuration file"))
 	}
 
+	if (config.LocalSocksProxyUsername != "" || config.LocalSocksProxyPassword != "") &&
+		(config.LocalSocksProxyUsername == "" || config.LocalSocksProxyPassword == "") {
+		return common.ContextError(
+			errors.New("LocalSocksProxyUsername and LocalSocksProxyPassword must both be set"))
+	}
+
 	_, err := strconv.Atoi(config.ClientVersion)
 	if err != nil {
 		return common.ContextError(
@@ -629,6 +924,21 @@ func (config *Config) Commit() error {
 			}
 		}
 
+		if config.ServerEntryRevocationListURLs != nil {
+			if config.RemoteServerListSignaturePublicKey == "" {
+				return common.ContextError(errors.New("missing RemoteServerListSignaturePublicKey"))
+			}
+			if config.ServerEntryRevocationListDownloadFilename == "" {
+				return common.ContextError(errors.New("missing ServerEntryRevocationListDownloadFilename"))
+			}
+		}
+
+	}
+
+	if config.SignedTacticsURLs != nil {
+		if config.SignedTacticsSignaturePublicKey == "" {
+			return common.ContextError(errors.New("missing SignedTacticsSignaturePublicKey"))
+		}
 	}
 
 	if config.SplitTunnelRoutesURLFormat != "" {
@@ -655,6 +965,24 @@ func (config *Config) Commit() error {
 		return common.ContextError(errors.New("packet tunnel mode requires TunnelPoolSize to be 1"))
 	}
 
+	if config.LocalDNSProxySeparateTunnel {
+		if !config.EnableLocalDNSProxy {
+			return common.ContextError(errors.New("LocalDNSProxySeparateTunnel requires EnableLocalDNSProxy"))
+		}
+		if config.TunnelPoolSize < 2 {
+			return common.ContextError(errors.New("LocalDNSProxySeparateTunnel requires TunnelPoolSize of at least 2"))
+		}
+	}
+
+	if config.MaxTunnelPoolSize != 0 {
+		if config.MaxTunnelPoolSize < config.TunnelPoolSize {
+			return common.ContextError(errors.New("MaxTunnelPoolSize must not be less than TunnelPoolSize"))
+		}
+		if config.PacketTunnelTunFileDescriptor > 0 && config.MaxTunnelPoolSize != 1 {
+			return common.ContextError(errors.New("packet tunnel mode requires MaxTunnelPoolSize to be 1"))
+		}
+	}
+
 	// SessionID must be PSIPHON_API_CLIENT_SESSION_ID_LENGTH lowercase hex-encoded bytes.
 
 	if config.SessionID == "" {
@@ -686,6 +1014,32 @@ func (config *Config) Commit() error {
 		return common.ContextError(errors.New("invalid ObfuscatedSSHAlgorithms"))
 	}
 
+	if config.PreferredIPAddressFamily != "" &&
+		config.PreferredIPAddressFamily != IP_ADDRESS_FAMILY_IPV4 &&
+		config.PreferredIPAddressFamily != IP_ADDRESS_FAMILY_IPV6 {
+
+		return common.ContextError(errors.New("invalid PreferredIPAddressFamily"))
+	}
+
+	if config.BootstrapProfile != "" &&
+		!isValidBootstrapProfile(config.BootstrapProfile) {
+
+		return common.ContextError(errors.New("invalid BootstrapProfile"))
+	}
+
+	if config.ConnectionPreference != "" &&
+		!isValidConnectionPreference(config.ConnectionPreference) {
+
+		return common.ContextError(errors.New("invalid ConnectionPreference"))
+	}
+
+	if config.MeekFailoverOrder != "" &&
+		config.MeekFailoverOrder != MEEK_FAILOVER_ORDER_FRONTED &&
+		config.MeekFailoverOrder != MEEK_FAILOVER_ORDER_UNFRONTED {
+
+		return common.ContextError(errors.New("invalid MeekFailoverOrder"))
+	}
+
 	// clientParameters.Set will validate the config fields applied to parameters.
 
 	err = config.SetClientParameters("", false, nil)
@@ -693,6 +1047,38 @@ func (config *Config) Commit() error {
 		return common.ContextError(err)
 	}
 
+	config.frontingDNSCache = newDNSCache(config.clientParameters)
+
+	config.ipAddressFamilyPreference = newIPAddressFamilyPreference(config)
+
+	config.sourcePortHistory = newSourcePortHistory()
+
+	config.connectionAttempts = newConnectionAttemptLimiter(config)
+
+	if config.ShareTLSSessionCache {
+		config.sharedTLSClientSessionCache = NewTLSClientSessionCache()
+	}
+
+	if config.UsePluggableTransport() {
+		if config.PluggableTransportName == "" {
+			return common.ContextError(errors.New("missing PluggableTransportName"))
+		}
+		_, _, err := net.SplitHostPort(config.PluggableTransportServerAddress)
+		if err != nil {
+			return common.ContextError(errors.New("invalid PluggableTransportServerAddress"))
+		}
+		config.pluggableTransportClient = pt.NewClient(
+			&pt.ClientConfig{
+				Path:           config.PluggableTransportPath,
+				Args:           config.PluggableTransportArgs,
+				Transport:      config.PluggableTransportName,
+				StateDirectory: filepath.Join(config.DataStoreDirectory, PLUGGABLE_TRANSPORT_STATE_DIRECTORY),
+				Logger: func(message string) {
+					NoticeInfo("pluggable transport: %s", message)
+				},
+			})
+	}
+
 	// Set defaults for dynamic config fields.
 
 	config.SetDynamicConfig(config.SponsorId, config.Authorizations)
@@ -771,6 +1157,8 @@ func (config *Config) SetClientParameters(tag string, skipOnError bool, applyPar
 			config.clientParameters.Get().Float(parameters.NetworkLatencyMultiplier))
 	}
 
+	noticeConnectionPreference(config)
+
 	return nil
 }
 
@@ -801,10 +1189,101 @@ func (config *Config) GetAuthorizations() []string {
 	return config.authorizations
 }
 
+// setTLSInterceptionDetected records whether TLS interception has been
+// detected on a fronted meek connection.
+func (config *Config) setTLSInterceptionDetected(detected bool) {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	config.tlsInterceptionDetected = detected
+}
+
+// isTLSInterceptionDetected indicates whether TLS interception has been
+// detected since the last reset.
+func (config *Config) isTLSInterceptionDetected() bool {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	return config.tlsInterceptionDetected
+}
+
+// setTransparentProxyAvoidProtocols records the tunnel protocols to avoid
+// after transparent HTTP proxy interference has been detected. nil resets
+// the detection.
+func (config *Config) setTransparentProxyAvoidProtocols(
+	avoidProtocols protocol.TunnelProtocols) {
+
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	config.transparentProxyAvoidProtocols = avoidProtocols
+}
+
+// getTransparentProxyAvoidProtocols returns the tunnel protocols to avoid
+// due to transparent HTTP proxy interference detected since the last reset.
+func (config *Config) getTransparentProxyAvoidProtocols() protocol.TunnelProtocols {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	return config.transparentProxyAvoidProtocols
+}
+
+type serverLoad struct {
+	level      string
+	recordTime monotime.Time
+}
+
+// setServerLoad records the load level reported by the server in its
+// handshake response. The record is in-memory only, and expires after
+// ServerLoadSignalTTL.
+func (config *Config) setServerLoad(serverIPAddress, level string) {
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+	if config.serverLoads == nil {
+		config.serverLoads = make(map[string]serverLoad)
+	}
+	if level == "" {
+		delete(config.serverLoads, serverIPAddress)
+		return
+	}
+	config.serverLoads[serverIPAddress] = serverLoad{
+		level:      level,
+		recordTime: monotime.Now(),
+	}
+}
+
+// skipLoadedServer indicates whether to skip the specified server as an
+// establishment candidate, as the server recently reported a high load
+// level. Servers are skipped with probability
+// ServerLoadHighSkipProbability.
+func (config *Config) skipLoadedServer(serverIPAddress string) bool {
+
+	p := config.clientParameters.Get()
+	ttl := p.Duration(parameters.ServerLoadSignalTTL)
+	skipProbability := p.Float(parameters.ServerLoadHighSkipProbability)
+	p = nil
+
+	config.dynamicConfigMutex.Lock()
+	load, ok := config.serverLoads[serverIPAddress]
+	if ok && monotime.Since(load.recordTime) >= ttl {
+		delete(config.serverLoads, serverIPAddress)
+		ok = false
+	}
+	config.dynamicConfigMutex.Unlock()
+
+	if !ok || load.level != protocol.SERVER_LOAD_HIGH {
+		return false
+	}
+
+	return common.FlipWeightedCoin(skipProbability)
+}
+
 func (config *Config) UseUpstreamProxy() bool {
 	return config.UpstreamProxyURL != ""
 }
 
+// UsePluggableTransport indicates whether OSSH tunnels are dialed through
+// a Pluggable Transport.
+func (config *Config) UsePluggableTransport() bool {
+	return config.PluggableTransportPath != ""
+}
+
 func (config *Config) makeConfigParameters() map[string]interface{} {
 
 	// Build set of config values to apply to parameters.
@@ -820,6 +1299,14 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.NetworkLatencyMultiplier] = config.NetworkLatencyMultiplier
 	}
 
+	if config.PreferredIPAddressFamily != "" {
+		applyParameters[parameters.PreferredIPAddressFamily] = config.PreferredIPAddressFamily
+	}
+
+	if config.MeekFailoverOrder != "" {
+		applyParameters[parameters.MeekFailoverOrder] = config.MeekFailoverOrder
+	}
+
 	if len(config.LimitTunnelProtocols) > 0 {
 		applyParameters[parameters.LimitTunnelProtocols] = protocol.TunnelProtocols(config.LimitTunnelProtocols)
 	} else if config.TunnelProtocol != "" {
@@ -851,6 +1338,44 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.ConnectionWorkerPoolSize] = config.ConnectionWorkerPoolSize
 	}
 
+	if config.MaxConcurrentConnectionAttempts != 0 {
+		applyParameters[parameters.MaxConcurrentConnectionAttempts] = config.MaxConcurrentConnectionAttempts
+	}
+
+	if config.BootstrapProfile != "" {
+		profile := bootstrapProfiles[config.BootstrapProfile]
+		applyParameters[parameters.BootstrapConnectionWorkerPoolSize] = profile.connectionWorkerPoolSize
+		applyParameters[parameters.BootstrapTunnelConnectTimeout] = profile.tunnelConnectTimeout.String()
+	}
+
+	if config.BootstrapConnectionWorkerPoolSize != 0 {
+		applyParameters[parameters.BootstrapConnectionWorkerPoolSize] = config.BootstrapConnectionWorkerPoolSize
+	}
+
+	if config.BootstrapTunnelConnectTimeoutSeconds != nil {
+		applyParameters[parameters.BootstrapTunnelConnectTimeout] = fmt.Sprintf("%ds", *config.BootstrapTunnelConnectTimeoutSeconds)
+	}
+
+	if config.ConnectionPreference != "" {
+		applyConnectionPreference(config.ConnectionPreference, applyParameters)
+	}
+
+	if config.TunnelTCPConnectTimeoutMilliseconds != nil {
+		applyParameters[parameters.TunnelTCPConnectTimeout] = fmt.Sprintf("%dms", *config.TunnelTCPConnectTimeoutMilliseconds)
+	}
+
+	if config.TunnelTLSHandshakeTimeoutMilliseconds != nil {
+		applyParameters[parameters.TunnelTLSHandshakeTimeout] = fmt.Sprintf("%dms", *config.TunnelTLSHandshakeTimeoutMilliseconds)
+	}
+
+	if config.TunnelSSHHandshakeTimeoutMilliseconds != nil {
+		applyParameters[parameters.TunnelSSHHandshakeTimeout] = fmt.Sprintf("%dms", *config.TunnelSSHHandshakeTimeoutMilliseconds)
+	}
+
+	if config.TunnelHandshakeAPITimeoutMilliseconds != nil {
+		applyParameters[parameters.TunnelHandshakeAPITimeout] = fmt.Sprintf("%dms", *config.TunnelHandshakeAPITimeoutMilliseconds)
+	}
+
 	if config.StaggerConnectionWorkersMilliseconds > 0 {
 		applyParameters[parameters.StaggerConnectionWorkersPeriod] = fmt.Sprintf("%dms", config.StaggerConnectionWorkersMilliseconds)
 	}
@@ -859,7 +1384,8 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 		applyParameters[parameters.LimitIntensiveConnectionWorkers] = config.LimitIntensiveConnectionWorkers
 	}
 
-	applyParameters[parameters.MeekLimitBufferSizes] = config.LimitMeekBufferSizes
+	applyParameters[parameters.MeekLimitBufferSizes] = config.LimitMeekBufferSizes ||
+		connectionPreferences[config.ConnectionPreference].limitMeekBufferSizes
 
 	applyParameters[parameters.IgnoreHandshakeStatsRegexps] = config.IgnoreHandshakeStatsRegexps
 
@@ -894,6 +1420,16 @@ func (config *Config) makeConfigParameters() map[string]interface{} {
 			applyParameters[parameters.ObfuscatedServerListRootURLs] = config.ObfuscatedServerListRootURLs
 		}
 
+		if config.ServerEntryRevocationListURLs != nil {
+			applyParameters[parameters.RemoteServerListSignaturePublicKey] = config.RemoteServerListSignaturePublicKey
+			applyParameters[parameters.ServerEntryRevocationListURLs] = config.ServerEntryRevocationListURLs
+		}
+
+	}
+
+	if config.SignedTacticsURLs != nil {
+		applyParameters[parameters.SignedTacticsSignaturePublicKey] = config.SignedTacticsSignaturePublicKey
+		applyParameters[parameters.SignedTacticsURLs] = config.SignedTacticsURLs
 	}
 
 	applyParameters[parameters.SplitTunnelRoutesURLFormat] = config.SplitTunnelRoutesURLFormat
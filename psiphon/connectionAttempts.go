@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	// CONNECTION_ATTEMPTS_DEFAULT_LIMIT and
+	// CONNECTION_ATTEMPTS_MOBILE_DEFAULT_LIMIT are the limits on concurrent
+	// in-flight connection attempts when MaxConcurrentConnectionAttempts is
+	// 0. The mobile limit matches the default ConnectionWorkerPoolSize, so
+	// racing attempts only use capacity left idle by connection workers.
+	CONNECTION_ATTEMPTS_DEFAULT_LIMIT        = 20
+	CONNECTION_ATTEMPTS_MOBILE_DEFAULT_LIMIT = 10
+)
+
+// connectionAttemptLimiter is a semaphore which limits the number of
+// concurrent in-flight connection attempts made during tunnel establishment,
+// including the additional attempts made by racing features: the racing
+// meek failover attempt and the racing IP address family fallback dial.
+//
+// Each connection worker acquires a slot, waiting when none is available,
+// before attempting to connect to a candidate. Racing features only try to
+// acquire additional slots and, when none are available, make their
+// additional attempts sequentially, after the first attempt fails, within
+// the connection worker's slot. So, on constrained devices, racing doesn't
+// increase the peak number of concurrent attempts beyond the limit.
+//
+// The limit is the MaxConcurrentConnectionAttempts parameter, read on each
+// acquire, so tactics changes apply to subsequent attempts.
+type connectionAttemptLimiter struct {
+	config   *Config
+	mutex    sync.Mutex
+	inFlight int
+	released chan struct{}
+}
+
+func newConnectionAttemptLimiter(config *Config) *connectionAttemptLimiter {
+	return &connectionAttemptLimiter{
+		config:   config,
+		released: make(chan struct{}),
+	}
+}
+
+func (limiter *connectionAttemptLimiter) limit() int {
+
+	limit := limiter.config.GetClientParameters().Int(
+		parameters.MaxConcurrentConnectionAttempts)
+
+	if limit > 0 {
+		return limit
+	}
+
+	if isMobileClientPlatform(limiter.config.ClientPlatform) {
+		return CONNECTION_ATTEMPTS_MOBILE_DEFAULT_LIMIT
+	}
+
+	return CONNECTION_ATTEMPTS_DEFAULT_LIMIT
+}
+
+// isMobileClientPlatform indicates whether the client platform is a mobile
+// platform. As with the server's platform checks, ClientPlatform may contain
+// additional information along with the platform name.
+func isMobileClientPlatform(clientPlatform string) bool {
+	clientPlatform = strings.ToLower(clientPlatform)
+	return strings.Contains(clientPlatform, "android") ||
+		strings.Contains(clientPlatform, "ios")
+}
+
+// acquire waits for and acquires a slot. acquire returns false, without
+// acquiring a slot, when ctx is done first. A nil limiter always acquires.
+func (limiter *connectionAttemptLimiter) acquire(ctx context.Context) bool {
+
+	if limiter == nil {
+		return true
+	}
+
+	for {
+		limiter.mutex.Lock()
+		if limiter.inFlight < limiter.limit() {
+			limiter.inFlight += 1
+			limiter.mutex.Unlock()
+			return true
+		}
+		released := limiter.released
+		limiter.mutex.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// tryAcquire acquires a slot when one is immediately available.
+func (limiter *connectionAttemptLimiter) tryAcquire() bool {
+
+	if limiter == nil {
+		return true
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if limiter.inFlight < limiter.limit() {
+		limiter.inFlight += 1
+		return true
+	}
+	return false
+}
+
+// release releases a slot acquired with acquire or tryAcquire and wakes any
+// waiting acquire calls.
+func (limiter *connectionAttemptLimiter) release() {
+
+	if limiter == nil {
+		return
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.inFlight -= 1
+	close(limiter.released)
+	limiter.released = make(chan struct{})
+}
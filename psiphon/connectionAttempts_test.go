@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestConnectionAttemptLimiter(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	config := &Config{
+		ClientPlatform:   "Android_4.0.4_com.example.exampleclientlibraryapp",
+		clientParameters: clientParameters,
+	}
+
+	limiter := newConnectionAttemptLimiter(config)
+
+	if limiter.limit() != CONNECTION_ATTEMPTS_MOBILE_DEFAULT_LIMIT {
+		t.Fatalf("unexpected mobile default limit: %d", limiter.limit())
+	}
+
+	config.ClientPlatform = "Windows"
+
+	if limiter.limit() != CONNECTION_ATTEMPTS_DEFAULT_LIMIT {
+		t.Fatalf("unexpected default limit: %d", limiter.limit())
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.MaxConcurrentConnectionAttempts: 2,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	if !limiter.acquire(context.Background()) || !limiter.tryAcquire() {
+		t.Fatalf("unexpected acquire failure")
+	}
+
+	// At the limit, tryAcquire fails and acquire waits.
+
+	if limiter.tryAcquire() {
+		t.Fatalf("unexpected tryAcquire success")
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelFunc()
+
+	if limiter.acquire(ctx) {
+		t.Fatalf("unexpected acquire success")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- limiter.acquire(context.Background())
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("unexpected acquire before release")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	limiter.release()
+
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Fatalf("unexpected acquire failure")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("acquire not unblocked by release")
+	}
+
+	// Racing attempts acquire all or none of the required slots.
+
+	limiter.release()
+
+	config.connectionAttempts = limiter
+
+	if acquireRaceSlots(config, 2) {
+		t.Fatalf("unexpected race slots acquired")
+	}
+
+	if !acquireRaceSlots(config, 1) {
+		t.Fatalf("unexpected race slots failure")
+	}
+
+	if limiter.tryAcquire() {
+		t.Fatalf("unexpected tryAcquire success")
+	}
+
+	// A nil limiter doesn't limit.
+
+	limiter = nil
+
+	if !limiter.acquire(context.Background()) || !limiter.tryAcquire() {
+		t.Fatalf("unexpected nil limiter acquire failure")
+	}
+	limiter.release()
+}
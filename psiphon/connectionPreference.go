@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	CONNECTION_PREFERENCE_LATENCY    = "latency"
+	CONNECTION_PREFERENCE_THROUGHPUT = "throughput"
+	CONNECTION_PREFERENCE_BALANCED   = "balanced"
+)
+
+// connectionPreference specifies the parameter values which bias tunnel
+// protocol selection, buffer sizing, and write coalescing towards either
+// low latency or high throughput.
+//
+// These values are applied as config parameters, and so tactics, which may
+// be required for circumvention, still take precedence. A preference
+// doesn't select congestion control, which isn't configurable: QUIC
+// protocols always use their built-in congestion control, and TCP
+// protocols use the platform's.
+type connectionPreference struct {
+	preferredProtocols      func(string) bool
+	writeCoalescingWindow   time.Duration
+	writeCoalescingMaxBytes int
+	limitMeekBufferSizes    bool
+}
+
+var connectionPreferences = map[string]connectionPreference{
+
+	// The latency preference favors direct protocols, avoiding the polling
+	// round trips of meek and the overhead of the higher-latency
+	// Marionette and TapDance transports; sends writes immediately; and
+	// uses smaller meek buffers, so request payloads are sent sooner.
+	CONNECTION_PREFERENCE_LATENCY: {
+		preferredProtocols: func(tunnelProtocol string) bool {
+			return !protocol.TunnelProtocolUsesMeek(tunnelProtocol) &&
+				!protocol.TunnelProtocolUsesMarionette(tunnelProtocol) &&
+				!protocol.TunnelProtocolUsesTapdance(tunnelProtocol)
+		},
+		limitMeekBufferSizes: true,
+	},
+
+	// The throughput preference additionally avoids QUIC, which has
+	// comparatively high per-packet CPU overhead, and coalesces small writes
+	// into fewer, larger writes.
+	CONNECTION_PREFERENCE_THROUGHPUT: {
+		preferredProtocols: func(tunnelProtocol string) bool {
+			return !protocol.TunnelProtocolUsesMeek(tunnelProtocol) &&
+				!protocol.TunnelProtocolUsesMarionette(tunnelProtocol) &&
+				!protocol.TunnelProtocolUsesTapdance(tunnelProtocol) &&
+				!protocol.TunnelProtocolUsesQUIC(tunnelProtocol)
+		},
+		writeCoalescingWindow:   5 * time.Millisecond,
+		writeCoalescingMaxBytes: 16384,
+	},
+
+	// The balanced preference uses the defaults.
+	CONNECTION_PREFERENCE_BALANCED: {},
+}
+
+// isValidConnectionPreference indicates whether preference is a supported
+// connection preference.
+func isValidConnectionPreference(preference string) bool {
+	_, ok := connectionPreferences[preference]
+	return ok
+}
+
+// applyConnectionPreference adds the parameter values for the specified
+// connection preference to applyParameters. MeekLimitBufferSizes is applied
+// by makeConfigParameters, as LimitMeekBufferSizes may also be set.
+func applyConnectionPreference(
+	preference string, applyParameters map[string]interface{}) {
+
+	connectionPreference, ok := connectionPreferences[preference]
+	if !ok || preference == CONNECTION_PREFERENCE_BALANCED {
+		return
+	}
+
+	var preferredProtocols protocol.TunnelProtocols
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+		if connectionPreference.preferredProtocols(tunnelProtocol) {
+			preferredProtocols = append(preferredProtocols, tunnelProtocol)
+		}
+	}
+	applyParameters[parameters.PreferredTunnelProtocols] = preferredProtocols
+
+	applyParameters[parameters.TunnelWriteCoalescingWindow] =
+		connectionPreference.writeCoalescingWindow.String()
+	if connectionPreference.writeCoalescingMaxBytes > 0 {
+		applyParameters[parameters.TunnelWriteCoalescingMaxBytes] =
+			connectionPreference.writeCoalescingMaxBytes
+	}
+}
+
+// noticeConnectionPreference emits the effective connection preference
+// settings, after any tactics are applied, for diagnostics.
+func noticeConnectionPreference(config *Config) {
+
+	if config.ConnectionPreference == "" {
+		return
+	}
+
+	p := config.GetClientParameters()
+
+	NoticeConnectionPreference(
+		config.ConnectionPreference,
+		p.TunnelProtocols(parameters.PreferredTunnelProtocols),
+		p.Float(parameters.PreferredTunnelProtocolsBias),
+		p.Duration(parameters.TunnelWriteCoalescingWindow),
+		p.Int(parameters.TunnelWriteCoalescingMaxBytes),
+		p.Bool(parameters.MeekLimitBufferSizes))
+}
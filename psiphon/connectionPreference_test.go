@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestConnectionPreference(t *testing.T) {
+
+	loadConfig := func(configJSON string) (*Config, error) {
+		config, err := LoadConfig([]byte(configJSON))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		return config, config.Commit()
+	}
+
+	baseConfigJSON := `
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"`
+
+	config, err := loadConfig("{" + baseConfigJSON + `,
+        "ConnectionPreference" : "latency"}`)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	p := config.GetClientParameters()
+	preferredProtocols := p.TunnelProtocols(parameters.PreferredTunnelProtocols)
+	if !common.Contains(preferredProtocols, protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH) ||
+		common.Contains(preferredProtocols, protocol.TUNNEL_PROTOCOL_FRONTED_MEEK) ||
+		p.Duration(parameters.TunnelWriteCoalescingWindow) != 0 ||
+		!p.Bool(parameters.MeekLimitBufferSizes) {
+		t.Fatalf("unexpected latency preference settings")
+	}
+
+	config, err = loadConfig("{" + baseConfigJSON + `,
+        "ConnectionPreference" : "throughput"}`)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	p = config.GetClientParameters()
+	preferredProtocols = p.TunnelProtocols(parameters.PreferredTunnelProtocols)
+	if !common.Contains(preferredProtocols, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH) ||
+		common.Contains(preferredProtocols, protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH) ||
+		p.Duration(parameters.TunnelWriteCoalescingWindow) != 5*time.Millisecond ||
+		p.Bool(parameters.MeekLimitBufferSizes) {
+		t.Fatalf("unexpected throughput preference settings")
+	}
+
+	// Tactics take precedence over the preference.
+
+	err = config.SetClientParameters("tag", false, map[string]interface{}{
+		parameters.TunnelWriteCoalescingWindow: "0s",
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	if config.GetClientParameters().Duration(parameters.TunnelWriteCoalescingWindow) != 0 {
+		t.Fatalf("unexpected tactics override")
+	}
+
+	_, err = loadConfig("{" + baseConfigJSON + `,
+        "ConnectionPreference" : "unknown"}`)
+	if err == nil {
+		t.Fatalf("unexpected Commit success with invalid ConnectionPreference")
+	}
+
+	// The preference biases, but doesn't restrict, protocol selection, and
+	// never overrides limits.
+
+	serverEntry := &protocol.ServerEntry{
+		Capabilities: []string{
+			protocol.GetCapability(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH),
+			protocol.GetCapability(protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK),
+		},
+	}
+
+	state := &limitTunnelProtocolsState{
+		preferredProtocols:     protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+		preferredProtocolsBias: 1.0,
+	}
+
+	for i := 0; i < 100; i++ {
+		selectedProtocol, _, err := state.selectProtocol(0, false, false, nil, nil, serverEntry)
+		if err != nil {
+			t.Fatalf("selectProtocol failed: %s", err)
+		}
+		if selectedProtocol != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+			t.Fatalf("unexpected selected protocol: %s", selectedProtocol)
+		}
+	}
+
+	state.preferredProtocolsBias = 0.5
+	selected := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		selectedProtocol, _, err := state.selectProtocol(0, false, false, nil, nil, serverEntry)
+		if err != nil {
+			t.Fatalf("selectProtocol failed: %s", err)
+		}
+		selected[selectedProtocol] = true
+	}
+	if len(selected) != 2 {
+		t.Fatalf("unexpected selected protocols: %v", selected)
+	}
+
+	state.preferredProtocolsBias = 1.0
+	state.protocols = protocol.TunnelProtocols{protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK}
+	selectedProtocol, _, err := state.selectProtocol(0, false, false, nil, nil, serverEntry)
+	if err != nil {
+		t.Fatalf("selectProtocol failed: %s", err)
+	}
+	if selectedProtocol != protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK {
+		t.Fatalf("unexpected selected protocol: %s", selectedProtocol)
+	}
+}
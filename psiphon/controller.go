@@ -27,9 +27,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Psiphon-Labs/goarista/monotime"
@@ -55,9 +60,18 @@ type Controller struct {
 	establishedOnce                         bool
 	tunnels                                 []*Tunnel
 	nextTunnel                              int
+	tunnelAffinity                          *tunnelAffinity
+	diagnostics                             *connectionDiagnostics
+	recentEvents                            *recentEvents
+	tunnelPoolSizer                         *tunnelPoolSizer
+	handoffTunnels                          []*Tunnel
 	startedConnectedReporter                bool
 	isEstablishing                          bool
 	establishLimitTunnelProtocolsState      *limitTunnelProtocolsState
+	establishProtocolHealth                 *protocolHealth
+	establishSuspectedBlocking              *suspectedBlocking
+	establishCaptivePortal                  *captivePortal
+	establishServerScores                   *serverScores
 	concurrentEstablishTunnelsMutex         sync.Mutex
 	establishConnectTunnelCount             int
 	concurrentEstablishTunnels              int
@@ -74,9 +88,18 @@ type Controller struct {
 	signalFetchObfuscatedServerLists        chan struct{}
 	signalDownloadUpgrade                   chan string
 	signalReportConnected                   chan struct{}
+	signalNetworkChanged                    chan struct{}
+	signalReconnect                         chan struct{}
+	reconnectResetReplay                    int32
+	signalPause                             chan struct{}
+	pauseRequested                          int32
+	isPaused                                bool
+	establishIgnoreServerAffinity           bool
+	migratingTunnels                        chan *tunnelMigration
 	serverAffinityDoneBroadcast             chan struct{}
 	packetTunnelClient                      *tun.Client
 	packetTunnelTransport                   *PacketTunnelTransport
+	serverEntrySourceManager                *serverEntrySourceManager
 }
 
 // NewController initializes a new controller.
@@ -100,17 +123,23 @@ func NewController(config *Config) (controller *Controller, err error) {
 		DnsServerGetter:               config.DnsServerGetter,
 		IPv6Synthesizer:               config.IPv6Synthesizer,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
+		IPAddressFamilyFallbackDelay:  config.clientParameters.Get().Duration(parameters.IPAddressFamilyFallbackDelay),
+		ipAddressFamilyPreference:     config.ipAddressFamilyPreference,
 	}
 
+	tunnelPoolSizer := newTunnelPoolSizer(config)
+
 	controller = &Controller{
 		config:       config,
 		sessionId:    config.SessionID,
 		runWaitGroup: new(sync.WaitGroup),
 		// connectedTunnels and failedTunnels buffer sizes are large enough to
-		// receive full pools of tunnels without blocking. Senders should not block.
-		connectedTunnels:         make(chan *Tunnel, config.TunnelPoolSize),
-		failedTunnels:            make(chan *Tunnel, config.TunnelPoolSize),
+		// receive full pools of tunnels, at the maximum pool size, without
+		// blocking. Senders should not block.
+		connectedTunnels:         make(chan *Tunnel, tunnelPoolSizer.getMaxSize()),
+		failedTunnels:            make(chan *Tunnel, tunnelPoolSizer.getMaxSize()),
 		tunnels:                  make([]*Tunnel, 0),
+		tunnelAffinity:           newTunnelAffinity(),
 		establishedOnce:          false,
 		startedConnectedReporter: false,
 		isEstablishing:           false,
@@ -122,6 +151,30 @@ func NewController(config *Config) (controller *Controller, err error) {
 		signalFetchObfuscatedServerLists:  make(chan struct{}),
 		signalDownloadUpgrade:             make(chan string),
 		signalReportConnected:             make(chan struct{}),
+		signalNetworkChanged:              make(chan struct{}, 1),
+		signalReconnect:                   make(chan struct{}, 1),
+		signalPause:                       make(chan struct{}, 1),
+		migratingTunnels:                  make(chan *tunnelMigration, tunnelPoolSizer.getMaxSize()),
+		serverEntrySourceManager:          newServerEntrySourceManager(),
+		tunnelPoolSizer:                   tunnelPoolSizer,
+	}
+
+	controller.diagnostics = newConnectionDiagnostics(config)
+	controller.diagnostics.setTunnelPoolSize(tunnelPoolSizer.getSize())
+
+	controller.recentEvents = newRecentEvents()
+	setNoticeRecentEvents(controller.recentEvents)
+
+	// The persisted last known region is loaded once, so that a region
+	// learned by this controller is used only on the next cold start.
+
+	lastKnownRegion, err := loadLastKnownRegion()
+	if err != nil {
+		NoticeAlert("load last known region failed: %s", err)
+	} else if lastKnownRegion != nil {
+		config.dynamicConfigMutex.Lock()
+		config.storedLastKnownRegion = lastKnownRegion.Region
+		config.dynamicConfigMutex.Unlock()
 	}
 
 	controller.splitTunnelClassifier = NewSplitTunnelClassifier(config, controller)
@@ -207,6 +260,19 @@ func (controller *Controller) Run(ctx context.Context) {
 		defer httpProxy.Close()
 	}
 
+	if controller.config.EnableLocalDNSProxy {
+		var tunneler Tunneler = controller
+		if controller.config.LocalDNSProxySeparateTunnel {
+			tunneler = &dnsTunneler{controller: controller}
+		}
+		dnsProxy, err := NewDNSProxy(controller.config, tunneler, listenIP)
+		if err != nil {
+			NoticeAlert("error initializing local DNS proxy: %s", err)
+			return
+		}
+		defer dnsProxy.Close()
+	}
+
 	if !controller.config.DisableRemoteServerListFetcher {
 
 		if controller.config.RemoteServerListURLs != nil {
@@ -226,6 +292,11 @@ func (controller *Controller) Run(ctx context.Context) {
 		}
 	}
 
+	for _, source := range controller.serverEntrySourceManager.getSources() {
+		controller.runWaitGroup.Add(1)
+		go controller.serverEntrySourceFetcher(source)
+	}
+
 	if controller.config.UpgradeDownloadURLs != nil {
 		controller.runWaitGroup.Add(1)
 		go controller.upgradeDownloader()
@@ -262,6 +333,10 @@ func (controller *Controller) Run(ctx context.Context) {
 
 	controller.splitTunnelClassifier.Shutdown()
 
+	if controller.config.pluggableTransportClient != nil {
+		controller.config.pluggableTransportClient.Close()
+	}
+
 	NoticeInfo("exiting controller")
 
 	NoticeExiting()
@@ -281,6 +356,29 @@ func (controller *Controller) SetDynamicConfig(sponsorID string, authorizations
 	controller.config.SetDynamicConfig(sponsorID, authorizations)
 }
 
+// SetNetworkConditionHint sets an advisory hint, from the host application,
+// describing current network conditions; for example, a mobile device on a
+// congested cellular network. Supported hints are "normal", the default,
+// "congested", and "poor". The hint reduces the concurrency of tunnel
+// establishment and lengthens tunnel connect timeouts, establishment pauses,
+// and SSH keep alive periods and timeouts, within fixed bounds. See
+// networkConditionAdjustments.
+//
+// Adjustments apply to subsequent establishment rounds, dials, and keep
+// alives; in-progress operations are not interrupted.
+func (controller *Controller) SetNetworkConditionHint(hint string) {
+	controller.config.SetNetworkConditionHint(hint)
+}
+
+// GetDiagnosticBundle returns the most recent diagnostic bundle, a JSON
+// encoded DiagnosticBundle, which is generated after repeated tunnel
+// connection failures and announced with a DiagnosticBundleAvailable notice.
+// Returns false when no bundle has been generated. The bundle contains no
+// addresses or user-identifying data, and may be sent to support.
+func (controller *Controller) GetDiagnosticBundle() ([]byte, bool) {
+	return controller.diagnostics.getBundle()
+}
+
 // TerminateNextActiveTunnel terminates the active tunnel, which will initiate
 // establishment of a new tunnel.
 func (controller *Controller) TerminateNextActiveTunnel() {
@@ -291,6 +389,83 @@ func (controller *Controller) TerminateNextActiveTunnel() {
 	}
 }
 
+// NetworkChanged signals the controller that the host network has changed;
+// for example, a mobile device switching from WiFi to cellular. This is
+// intended to be invoked by the host application's network monitor.
+//
+// On a network change, the controller performs a tunnel handoff: the current
+// tunnels are retained as handoff tunnels while a replacement tunnel is
+// established on the new network. New port forwards are dialed through the
+// handoff tunnels until a replacement is registered. Once the tunnel pool is
+// refilled, or NetworkChangeHandoffTimeout elapses, the handoff tunnels are
+// closed, which cleanly closes any port forwards that remain on them.
+//
+// The packet tunnel, when running, migrates to the replacement tunnel, as
+// the tun.Client persists across tunnels. SOCKS and HTTP proxy port forwards
+// are bound to the SSH channels of their tunnel and cannot migrate.
+//
+// When the replacement tunnel connects to the same server as a handoff
+// tunnel, the server will close the handoff tunnel on handshake, as it has
+// the same session ID.
+//
+// Replacement tunnel establishment ignores server affinity, as the server
+// of the last successful tunnel was selected on the previous network.
+func (controller *Controller) NetworkChanged() {
+	select {
+	case controller.signalNetworkChanged <- *new(struct{}):
+	default:
+	}
+}
+
+// Reconnect signals the controller to close all tunnels, including any
+// tunnels being established, and immediately start establishing a new
+// tunnel. This is intended to be invoked by the host application, for
+// example when the user reports that the current tunnel is performing
+// poorly. Reconnect may be called at any time, including while connecting.
+//
+// When resetReplay is set, the new establishment ignores server affinity,
+// so the previously used server is not favored and candidate server and
+// protocol selection runs from scratch.
+func (controller *Controller) Reconnect(resetReplay bool) {
+	if resetReplay {
+		atomic.StoreInt32(&controller.reconnectResetReplay, 1)
+	}
+	select {
+	case controller.signalReconnect <- *new(struct{}):
+	default:
+	}
+}
+
+// Pause signals the controller to suspend tunneling, to save battery while
+// the host application is in the background. All tunnels, including any
+// tunnels being established, are closed, releasing their sockets and
+// stopping keepalives and status requests; and no new tunnels are
+// established until Resume is called. The local proxies remain running,
+// and port forwards fail while paused.
+//
+// Pause retains the state used to reconnect quickly on Resume: server
+// affinity, which favors the last-used server, and the replay dial
+// parameters of the last successful tunnels. Server affinity is still
+// ignored on resume when the network changes, or when a Reconnect with
+// resetReplay is requested, while paused.
+func (controller *Controller) Pause() {
+	atomic.StoreInt32(&controller.pauseRequested, 1)
+	select {
+	case controller.signalPause <- *new(struct{}):
+	default:
+	}
+}
+
+// Resume signals the controller to resume tunneling after Pause. A new
+// tunnel is established immediately. Resume has no effect when not paused.
+func (controller *Controller) Resume() {
+	atomic.StoreInt32(&controller.pauseRequested, 0)
+	select {
+	case controller.signalPause <- *new(struct{}):
+	default:
+	}
+}
+
 // remoteServerListFetcher fetches an out-of-band list of server entries
 // for more tunnel candidates. It fetches when signalled, with retries
 // on failure.
@@ -579,13 +754,179 @@ func (controller *Controller) runTunnels() {
 	// Start running
 
 	controller.startEstablishing()
+
+	var handoffTimer *time.Timer
+	var handoffTimeout <-chan time.Time
+
+	// With adaptive tunnel pool sizing, periodically check if the tunnels
+	// have been stable long enough to shrink the pool.
+
+	var poolSizeTicker *time.Ticker
+	var poolSizeTick <-chan time.Time
+	if controller.tunnelPoolSizer.isAdaptive() {
+		poolSizeTicker = time.NewTicker(TUNNEL_POOL_SIZE_CHECK_PERIOD)
+		defer poolSizeTicker.Stop()
+		poolSizeTick = poolSizeTicker.C
+	}
+
+	resetHandoffTimer := func(timeout time.Duration) {
+		if handoffTimer != nil {
+			handoffTimer.Stop()
+		}
+		handoffTimer = time.NewTimer(timeout)
+		handoffTimeout = handoffTimer.C
+	}
+
 loop:
 	for {
 		select {
+		case <-controller.signalNetworkChanged:
+
+			count := controller.startTunnelHandoff()
+
+			NoticeInfo("network changed: handing off %d tunnels", count)
+			controller.diagnostics.traceEvent("network changed")
+
+			// Server affinity learned on the previous network isn't replayed.
+			// Network IDs, when available, also invalidate server affinity;
+			// see isServerAffinityExpired.
+			controller.establishIgnoreServerAffinity = true
+
+			if count > 0 {
+				resetHandoffTimer(
+					controller.config.clientParameters.Get().Duration(
+						parameters.NetworkChangeHandoffTimeout))
+			}
+
+			controller.startEstablishing()
+
+		case migration := <-controller.migratingTunnels:
+
+			if !controller.handoffTunnel(migration.tunnel) {
+				// The tunnel has already failed or been handed off.
+				break
+			}
+
+			NoticeInfo("server requested migration: %s", migration.tunnel.serverEntry.IpAddress)
+
+			// The handoff tunnel is closed no later than the server's drain
+			// deadline. The server closes the tunnel at the deadline in any
+			// case.
+			timeout := controller.config.clientParameters.Get().Duration(
+				parameters.NetworkChangeHandoffTimeout)
+			if migration.deadline > 0 && migration.deadline < timeout {
+				timeout = migration.deadline
+			}
+			resetHandoffTimer(timeout)
+
+			controller.startEstablishing()
+
+		case <-controller.signalPause:
+
+			// Only the latest Pause or Resume call, which sets pauseRequested,
+			// is applied.
+
+			isPaused := atomic.LoadInt32(&controller.pauseRequested) == 1
+			if isPaused == controller.isPaused {
+				break
+			}
+
+			if !isPaused {
+				NoticePaused(false)
+				controller.diagnostics.traceEvent("resumed")
+				controller.isPaused = false
+				controller.startEstablishing()
+				break
+			}
+
+			NoticePaused(true)
+			controller.diagnostics.traceEvent("paused")
+
+			// As for a reconnect, stop any in-progress establishment, and
+			// close all tunnels. startEstablishing is a no-op while paused.
+
+			controller.isPaused = true
+			controller.stopEstablishing()
+
+		pauseDrain:
+			for {
+				select {
+				case connectedTunnel := <-controller.connectedTunnels:
+					controller.discardTunnel(connectedTunnel)
+				default:
+					break pauseDrain
+				}
+			}
+
+			if handoffTimer != nil {
+				handoffTimer.Stop()
+				handoffTimer = nil
+				handoffTimeout = nil
+			}
+
+			controller.terminateAllTunnels(TUNNEL_DISCONNECT_REASON_PAUSED)
+
+		case <-controller.signalReconnect:
+
+			resetReplay := atomic.SwapInt32(&controller.reconnectResetReplay, 0) == 1
+
+			NoticeInfo("reconnecting: reset replay: %v", resetReplay)
+
+			// Stop any in-progress establishment, discarding any connected
+			// tunnels not yet activated, so that all tunnels are replaced.
+
+			controller.stopEstablishing()
+
+		drain:
+			for {
+				select {
+				case connectedTunnel := <-controller.connectedTunnels:
+					controller.discardTunnel(connectedTunnel)
+				default:
+					break drain
+				}
+			}
+
+			if handoffTimer != nil {
+				handoffTimer.Stop()
+				handoffTimer = nil
+				handoffTimeout = nil
+			}
+
+			controller.terminateAllTunnels(TUNNEL_DISCONNECT_REASON_RECONNECT)
+
+			// stopEstablishing clears establishIgnoreServerAffinity, except
+			// when paused, in which case a network change while paused still
+			// applies on resume.
+			if resetReplay {
+				controller.establishIgnoreServerAffinity = true
+			}
+			controller.startEstablishing()
+
+		case <-poolSizeTick:
+			size, changed := controller.tunnelPoolSizer.checkStable()
+			if changed {
+				controller.setTunnelPoolSize(size)
+				controller.terminateExcessTunnels()
+			}
+
+		case <-handoffTimeout:
+			NoticeAlert("tunnel handoff timed out")
+			controller.closeHandoffTunnels()
+			handoffTimer = nil
+			handoffTimeout = nil
+
 		case failedTunnel := <-controller.failedTunnels:
 			NoticeAlert("tunnel failed: %s", failedTunnel.serverEntry.IpAddress)
 			controller.terminateTunnel(failedTunnel)
 
+			// With adaptive tunnel pool sizing, frequent failures grow the pool;
+			// the following startEstablishing fills the larger pool.
+			size, changed := controller.tunnelPoolSizer.recordFailure()
+			if changed {
+				controller.setTunnelPoolSize(size)
+			}
+
 			// Clear the reference to this tunnel before calling startEstablishing,
 			// which will invoke a garbage collection.
 			failedTunnel = nil
@@ -727,6 +1068,13 @@ loop:
 			// possible solution is establish target MIN(CountServerEntries(region, protocol), TunnelPoolSize)
 			if controller.isFullyEstablished() {
 				controller.stopEstablishing()
+
+				if handoffTimer != nil {
+					handoffTimer.Stop()
+					handoffTimer = nil
+					handoffTimeout = nil
+				}
+				controller.closeHandoffTunnels()
 			}
 
 		case <-controller.runCtx.Done():
@@ -736,8 +1084,12 @@ loop:
 
 	// Stop running
 
+	if handoffTimer != nil {
+		handoffTimer.Stop()
+	}
+
 	controller.stopEstablishing()
-	controller.terminateAllTunnels()
+	controller.terminateAllTunnels(TUNNEL_DISCONNECT_REASON_STOPPED)
 
 	// Drain tunnel channels
 	close(controller.connectedTunnels)
@@ -779,6 +1131,25 @@ func (controller *Controller) SignalTunnelFailure(tunnel *Tunnel) {
 	}
 }
 
+type tunnelMigration struct {
+	tunnel   *Tunnel
+	deadline time.Duration
+}
+
+// SignalTunnelMigration implements the TunnelOwner interface. This function
+// is called by HandleMigrateRequest when the tunnel's server has indicated
+// that it is about to drain. The Controller will signal runTunnels to
+// hand off the tunnel, establishing a replacement tunnel before the
+// specified drain deadline.
+func (controller *Controller) SignalTunnelMigration(tunnel *Tunnel, deadline time.Duration) {
+	// Don't block. In case there's no room, the tunnel isn't migrated and
+	// will be replaced after the server closes it.
+	select {
+	case controller.migratingTunnels <- &tunnelMigration{tunnel: tunnel, deadline: deadline}:
+	default:
+	}
+}
+
 // discardTunnel disposes of a successful connection that is no longer required.
 func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 	NoticeInfo("discard tunnel: %s", tunnel.serverEntry.IpAddress)
@@ -795,7 +1166,7 @@ func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	if len(controller.tunnels) >= controller.config.TunnelPoolSize {
+	if len(controller.tunnels) >= controller.tunnelPoolSizer.getSize() {
 		return false
 	}
 	// Perform a final check just in case we've established
@@ -807,6 +1178,20 @@ func (controller *Controller) registerTunnel(tunnel *Tunnel) bool {
 		}
 	}
 	controller.establishedOnce = true
+	controller.config.setBootstrapping(false)
+
+	// With LocalDNSProxySeparateTunnel, a new tunnel is dedicated to DNS when
+	// there's no active DNS tunnel but there's an active port forward
+	// tunnel. So the first tunnel established is always used for port
+	// forwards.
+	if controller.config.LocalDNSProxySeparateTunnel &&
+		len(controller.tunnels) > 0 &&
+		controller.activeDNSTunnel() == nil {
+
+		NoticeInfo("DNS tunnel: %s", tunnel.serverEntry.IpAddress)
+		tunnel.isDNSTunnel = true
+	}
+
 	controller.tunnels = append(controller.tunnels, tunnel)
 	NoticeTunnels(len(controller.tunnels))
 
@@ -834,7 +1219,7 @@ func (controller *Controller) hasEstablishedOnce() bool {
 func (controller *Controller) isFullyEstablished() bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	return len(controller.tunnels) >= controller.config.TunnelPoolSize
+	return len(controller.tunnels) >= controller.tunnelPoolSizer.getSize()
 }
 
 // numTunnels returns the number of active and outstanding tunnels.
@@ -844,10 +1229,41 @@ func (controller *Controller) numTunnels() (int, int) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
 	active := len(controller.tunnels)
-	outstanding := controller.config.TunnelPoolSize - len(controller.tunnels)
+	outstanding := controller.tunnelPoolSizer.getSize() - len(controller.tunnels)
 	return active, outstanding
 }
 
+// setTunnelPoolSize reports a tunnel pool size change made by adaptive
+// tunnel pool sizing.
+func (controller *Controller) setTunnelPoolSize(size int) {
+	NoticeTunnelPoolSize(size)
+	controller.diagnostics.setTunnelPoolSize(size)
+	controller.diagnostics.traceEvent("tunnel pool size: %d", size)
+}
+
+// terminateExcessTunnels closes the most recently established active
+// tunnels in excess of the current tunnel pool size, after the pool has
+// shrunk.
+func (controller *Controller) terminateExcessTunnels() {
+	controller.tunnelMutex.Lock()
+	excessCount := len(controller.tunnels) - controller.tunnelPoolSizer.getSize()
+	var excessTunnels []*Tunnel
+	for i := len(controller.tunnels) - 1; i >= 0 && len(excessTunnels) < excessCount; i-- {
+		// Retain any DNS tunnel, as a replacement DNS tunnel isn't established
+		// when the pool is full.
+		if !controller.tunnels[i].isDNSTunnel {
+			excessTunnels = append(excessTunnels, controller.tunnels[i])
+		}
+	}
+	controller.tunnelMutex.Unlock()
+
+	for _, tunnel := range excessTunnels {
+		NoticeInfo("closing excess tunnel: %s", tunnel.serverEntry.IpAddress)
+		tunnel.setDisconnectReason(TUNNEL_DISCONNECT_REASON_POOL_RESIZED)
+		controller.terminateTunnel(tunnel)
+	}
+}
+
 // terminateTunnel removes a tunnel from the pool of active tunnels
 // and closes the tunnel. The next-tunnel state used by getNextActiveTunnel
 // is adjusted as required.
@@ -864,25 +1280,111 @@ func (controller *Controller) terminateTunnel(tunnel *Tunnel) {
 			if controller.nextTunnel >= len(controller.tunnels) {
 				controller.nextTunnel = 0
 			}
+			controller.tunnelAffinity.removeTunnel(activeTunnel)
 			activeTunnel.Close(false)
 			NoticeTunnels(len(controller.tunnels))
-			break
+			return
+		}
+	}
+	for index, handoffTunnel := range controller.handoffTunnels {
+		if tunnel == handoffTunnel {
+			controller.handoffTunnels = append(
+				controller.handoffTunnels[:index], controller.handoffTunnels[index+1:]...)
+			handoffTunnel.Close(false)
+			if len(controller.tunnels) == 0 && len(controller.handoffTunnels) == 0 {
+				NoticeTunnels(0)
+			}
+			return
+		}
+	}
+}
+
+// startTunnelHandoff moves all active tunnels to the handoff list, emptying
+// the pool of active tunnels so that establishment will fill it with
+// replacement tunnels. Handoff tunnels remain open and are used by
+// getNextActiveTunnel when no active tunnel is available. Any tunnels
+// remaining from a previous handoff are closed. Returns the number of
+// tunnels handed off.
+//
+// NoticeTunnels is not emitted, as the handoff tunnels remain usable.
+func (controller *Controller) startTunnelHandoff() int {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	for _, handoffTunnel := range controller.handoffTunnels {
+		handoffTunnel.Close(false)
+	}
+	for _, tunnel := range controller.tunnels {
+		tunnel.setDisconnectReason(TUNNEL_DISCONNECT_REASON_NETWORK_CHANGED)
+	}
+	controller.handoffTunnels = controller.tunnels
+	controller.tunnels = make([]*Tunnel, 0)
+	controller.nextTunnel = 0
+	controller.tunnelAffinity.clear()
+	return len(controller.handoffTunnels)
+}
+
+// handoffTunnel moves the specified tunnel from the pool of active tunnels
+// to the handoff list. Returns false if the tunnel is not an active tunnel.
+// As with startTunnelHandoff, NoticeTunnels is not emitted.
+func (controller *Controller) handoffTunnel(tunnel *Tunnel) bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	for index, activeTunnel := range controller.tunnels {
+		if tunnel == activeTunnel {
+			controller.tunnels = append(
+				controller.tunnels[:index], controller.tunnels[index+1:]...)
+			if controller.nextTunnel > index {
+				controller.nextTunnel--
+			}
+			if controller.nextTunnel >= len(controller.tunnels) {
+				controller.nextTunnel = 0
+			}
+			controller.tunnelAffinity.removeTunnel(tunnel)
+			tunnel.setDisconnectReason(TUNNEL_DISCONNECT_REASON_MIGRATION)
+			controller.handoffTunnels = append(controller.handoffTunnels, tunnel)
+			return true
 		}
 	}
+	return false
+}
+
+// closeHandoffTunnels closes all handoff tunnels, in parallel.
+func (controller *Controller) closeHandoffTunnels() {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if len(controller.handoffTunnels) == 0 {
+		return
+	}
+	closeWaitGroup := new(sync.WaitGroup)
+	closeWaitGroup.Add(len(controller.handoffTunnels))
+	for _, handoffTunnel := range controller.handoffTunnels {
+		tunnel := handoffTunnel
+		go func() {
+			defer closeWaitGroup.Done()
+			tunnel.Close(false)
+		}()
+	}
+	closeWaitGroup.Wait()
+	controller.handoffTunnels = nil
+	if len(controller.tunnels) == 0 {
+		NoticeTunnels(0)
+	}
 }
 
 // terminateAllTunnels empties the tunnel pool, closing all active tunnels.
-// This is used when shutting down the controller.
-func (controller *Controller) terminateAllTunnels() {
+// This is used when shutting down the controller and when reconnecting.
+// reason is the disconnect reason reported for each tunnel.
+func (controller *Controller) terminateAllTunnels(reason string) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
 	// Closing all tunnels in parallel. In an orderly shutdown, each tunnel
 	// may take a few seconds to send a final status request. We only want
 	// to wait as long as the single slowest tunnel.
 	closeWaitGroup := new(sync.WaitGroup)
-	closeWaitGroup.Add(len(controller.tunnels))
-	for _, activeTunnel := range controller.tunnels {
+	closeWaitGroup.Add(len(controller.tunnels) + len(controller.handoffTunnels))
+	for _, activeTunnel := range append(controller.tunnels, controller.handoffTunnels...) {
 		tunnel := activeTunnel
+		tunnel.setDisconnectReason(reason)
 		go func() {
 			defer closeWaitGroup.Done()
 			tunnel.Close(false)
@@ -891,23 +1393,101 @@ func (controller *Controller) terminateAllTunnels() {
 	closeWaitGroup.Wait()
 	controller.tunnels = make([]*Tunnel, 0)
 	controller.nextTunnel = 0
+	controller.handoffTunnels = nil
+	controller.tunnelAffinity.clear()
 	NoticeTunnels(len(controller.tunnels))
 }
 
 // getNextActiveTunnel returns the next tunnel from the pool of active
-// tunnels. Currently, tunnel selection order is simple round-robin.
+// tunnels. Currently, tunnel selection order is simple round-robin. When
+// there are no active tunnels and a tunnel handoff is in progress, a
+// handoff tunnel is returned. DNS tunnels are never returned.
 func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
+	return controller.nextActiveTunnel()
+}
+
+// nextActiveTunnel implements getNextActiveTunnel. The caller must lock the
+// tunnel mutex.
+func (controller *Controller) nextActiveTunnel() (tunnel *Tunnel) {
 	for i := len(controller.tunnels); i > 0; i-- {
 		tunnel = controller.tunnels[controller.nextTunnel]
 		controller.nextTunnel =
 			(controller.nextTunnel + 1) % len(controller.tunnels)
+		if tunnel.isDNSTunnel {
+			continue
+		}
+		return tunnel
+	}
+	for _, tunnel := range controller.handoffTunnels {
+		if !tunnel.isDNSTunnel {
+			return tunnel
+		}
+	}
+	return nil
+}
+
+// activeDNSTunnel returns the active DNS tunnel, if any. The caller must
+// lock the tunnel mutex.
+func (controller *Controller) activeDNSTunnel() *Tunnel {
+	for _, tunnel := range controller.tunnels {
+		if tunnel.isDNSTunnel {
+			return tunnel
+		}
+	}
+	return nil
+}
+
+// getDNSTunnel returns the tunnel to use for local DNS proxy queries with
+// LocalDNSProxySeparateTunnel: the active DNS tunnel or, when a tunnel
+// handoff is in progress, a DNS handoff tunnel. Port forward tunnels are
+// never returned.
+func (controller *Controller) getDNSTunnel() *Tunnel {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	tunnel := controller.activeDNSTunnel()
+	if tunnel != nil {
 		return tunnel
 	}
+	for _, tunnel := range controller.handoffTunnels {
+		if tunnel.isDNSTunnel {
+			return tunnel
+		}
+	}
 	return nil
 }
 
+// getActiveTunnelForHost returns the active tunnel to use for a port
+// forward to host. When multiple tunnels are active, the tunnel previously
+// selected for host is returned, subject to TunnelAffinityTTL; see
+// tunnelAffinity. Otherwise, getActiveTunnelForHost is getNextActiveTunnel.
+func (controller *Controller) getActiveTunnelForHost(host string) *Tunnel {
+
+	p := controller.config.clientParameters.Get()
+	ttl := p.Duration(parameters.TunnelAffinityTTL)
+	maxEntries := p.Int(parameters.TunnelAffinityMaxEntries)
+	p = nil
+
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	if ttl <= 0 || host == "" || len(controller.tunnels) < 2 {
+		return controller.nextActiveTunnel()
+	}
+
+	host = strings.ToLower(host)
+	now := monotime.Now()
+
+	tunnel := controller.tunnelAffinity.get(host, now)
+	if tunnel == nil {
+		tunnel = controller.nextActiveTunnel()
+	}
+	controller.tunnelAffinity.set(host, tunnel, now, ttl, maxEntries)
+
+	return tunnel
+}
+
 // isActiveTunnelServerEntry is used to check if there's already
 // an existing tunnel to a candidate server.
 func (controller *Controller) isActiveTunnelServerEntry(
@@ -929,7 +1509,11 @@ func (controller *Controller) isActiveTunnelServerEntry(
 func (controller *Controller) Dial(
 	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (conn net.Conn, err error) {
 
-	tunnel := controller.getNextActiveTunnel()
+	// When remoteAddr can't be split, host is "" and the tunnel is selected
+	// without affinity.
+	host, _, _ := net.SplitHostPort(remoteAddr)
+
+	tunnel := controller.getActiveTunnelForHost(host)
 	if tunnel == nil {
 		return nil, common.ContextError(errors.New("no active tunnels"))
 	}
@@ -967,11 +1551,88 @@ func (controller *Controller) DirectDial(remoteAddr string) (conn net.Conn, err
 	return DialTCP(controller.runCtx, remoteAddr, controller.untunneledDialConfig)
 }
 
+// dnsTunneler is the Tunneler used by the local DNS proxy with
+// LocalDNSProxySeparateTunnel. Dial establishes port forwards through the
+// DNS tunnel only, and never through a port forward tunnel.
+type dnsTunneler struct {
+	controller *Controller
+}
+
+func (tunneler *dnsTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	tunnel := tunneler.controller.getDNSTunnel()
+	if tunnel == nil {
+		return nil, common.ContextError(errors.New("no active DNS tunnel"))
+	}
+
+	tunneledConn, err := tunnel.Dial(remoteAddr, alwaysTunnel, downstreamConn)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return tunneledConn, nil
+}
+
+func (tunneler *dnsTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return tunneler.controller.DirectDial(remoteAddr)
+}
+
+func (tunneler *dnsTunneler) SignalComponentFailure() {
+	tunneler.controller.SignalComponentFailure()
+}
+
 type limitTunnelProtocolsState struct {
-	useUpstreamProxy      bool
-	initialProtocols      protocol.TunnelProtocols
-	initialCandidateCount int
-	protocols             protocol.TunnelProtocols
+	useUpstreamProxy       bool
+	initialProtocols       protocol.TunnelProtocols
+	initialCandidateCount  int
+	protocols              protocol.TunnelProtocols
+	preferredProtocols     protocol.TunnelProtocols
+	preferredProtocolsBias float64
+}
+
+// newLimitTunnelProtocolsState initializes a limitTunnelProtocolsState from
+// the specified parameters.
+//
+// When no tactics have been applied, as indicated by an empty parameters
+// tag, and no initial limit is set, the initial limit is selected using the
+// config RegionHint or last known region, if any. Region hint protocols are
+// restricted to LimitTunnelProtocols, when set.
+func newLimitTunnelProtocolsState(
+	config *Config, p *parameters.ClientParametersSnapshot) *limitTunnelProtocolsState {
+
+	state := &limitTunnelProtocolsState{
+		useUpstreamProxy:       config.UseUpstreamProxy(),
+		initialProtocols:       p.TunnelProtocols(parameters.InitialLimitTunnelProtocols),
+		initialCandidateCount:  p.Int(parameters.InitialLimitTunnelProtocolsCandidateCount),
+		protocols:              p.TunnelProtocols(parameters.LimitTunnelProtocols),
+		preferredProtocols:     p.TunnelProtocols(parameters.PreferredTunnelProtocols),
+		preferredProtocolsBias: p.Float(parameters.PreferredTunnelProtocolsBias),
+	}
+
+	regionHint := config.getRegionHint()
+
+	if regionHint == "" || p.Tag() != "" ||
+		(len(state.initialProtocols) > 0 && state.initialCandidateCount > 0) {
+		return state
+	}
+
+	var hintProtocols protocol.TunnelProtocols
+	for _, tunnelProtocol := range p.RegionTunnelProtocols(
+		parameters.RegionHintInitialLimitTunnelProtocols).Protocols(regionHint) {
+
+		if len(state.protocols) == 0 || common.Contains(state.protocols, tunnelProtocol) {
+			hintProtocols = append(hintProtocols, tunnelProtocol)
+		}
+	}
+
+	if len(hintProtocols) > 0 {
+		state.initialProtocols = hintProtocols
+		state.initialCandidateCount = p.Int(parameters.RegionHintInitialLimitCandidateCount)
+		NoticeInfo("region hint initial limit tunnel protocols: %v", hintProtocols)
+	}
+
+	return state
 }
 
 func (l *limitTunnelProtocolsState) isInitialCandidate(
@@ -990,8 +1651,16 @@ func (l *limitTunnelProtocolsState) isCandidate(
 
 var errNoProtocolSupported = errors.New("server does not support any required protocol")
 
+// selectProtocol selects a tunnel protocol for the candidate server entry.
+// The candidate protocols from which the selection was made are also
+// returned.
 func (l *limitTunnelProtocolsState) selectProtocol(
-	connectTunnelCount int, excludeIntensive bool, serverEntry *protocol.ServerEntry) (string, error) {
+	connectTunnelCount int,
+	excludeIntensive bool,
+	excludeMeekHTTPS bool,
+	excludeProtocols protocol.TunnelProtocols,
+	health *protocolHealth,
+	serverEntry *protocol.ServerEntry) (string, protocol.TunnelProtocols, error) {
 
 	limitProtocols := l.protocols
 
@@ -1004,8 +1673,32 @@ func (l *limitTunnelProtocolsState) selectProtocol(
 		limitProtocols,
 		excludeIntensive)
 
+	if excludeMeekHTTPS {
+		var nonMeekHTTPSProtocols []string
+		for _, candidateProtocol := range candidateProtocols {
+			if !protocol.TunnelProtocolUsesMeekHTTPS(candidateProtocol) {
+				nonMeekHTTPSProtocols = append(nonMeekHTTPSProtocols, candidateProtocol)
+			}
+		}
+		candidateProtocols = nonMeekHTTPSProtocols
+	}
+
+	if len(excludeProtocols) > 0 {
+		var nonExcludedProtocols []string
+		for _, candidateProtocol := range candidateProtocols {
+			if !common.Contains(excludeProtocols, candidateProtocol) {
+				nonExcludedProtocols = append(nonExcludedProtocols, candidateProtocol)
+			}
+		}
+		candidateProtocols = nonExcludedProtocols
+	}
+
+	// Skip protocols disabled due to repeated failures, and down-rank
+	// protocols being re-enabled.
+	candidateProtocols = health.filterProtocols(candidateProtocols)
+
 	if len(candidateProtocols) == 0 {
-		return "", errNoProtocolSupported
+		return "", nil, errNoProtocolSupported
 	}
 
 	// Pick at random from the supported protocols. This ensures that we'll
@@ -1013,14 +1706,34 @@ func (l *limitTunnelProtocolsState) selectProtocol(
 	// configuration, it may be the case that some protocol is only available
 	// through multi-capability servers, and a simpler ranked preference of
 	// protocols could lead to that protocol never being selected.
+	//
+	// Any preferred protocols only bias the selection, for the same reason:
+	// the remaining candidate protocols are still selected, with probability
+	// 1 - preferredProtocolsBias.
 
-	index, err := common.MakeSecureRandomInt(len(candidateProtocols))
+	selectionProtocols := candidateProtocols
+
+	if len(l.preferredProtocols) > 0 &&
+		common.FlipWeightedCoin(l.preferredProtocolsBias) {
+
+		var preferredProtocols []string
+		for _, candidateProtocol := range candidateProtocols {
+			if common.Contains(l.preferredProtocols, candidateProtocol) {
+				preferredProtocols = append(preferredProtocols, candidateProtocol)
+			}
+		}
+		if len(preferredProtocols) > 0 {
+			selectionProtocols = preferredProtocols
+		}
+	}
+
+	index, err := common.MakeSecureRandomInt(len(selectionProtocols))
 	if err != nil {
-		return "", common.ContextError(err)
+		return "", nil, common.ContextError(err)
 	}
-	selectedProtocol := candidateProtocols[index]
+	selectedProtocol := selectionProtocols[index]
 
-	return selectedProtocol, nil
+	return selectedProtocol, candidateProtocols, nil
 
 }
 
@@ -1032,12 +1745,22 @@ type candidateServerEntry struct {
 
 // startEstablishing creates a pool of worker goroutines which will
 // attempt to establish tunnels to candidate servers. The candidates
-// are generated by another goroutine.
+// are generated by another goroutine. startEstablishing is a no-op while
+// paused.
 func (controller *Controller) startEstablishing() {
+	if controller.isPaused {
+		return
+	}
 	if controller.isEstablishing {
 		return
 	}
 	NoticeInfo("start establishing")
+	controller.diagnostics.traceEvent("start establishing")
+
+	// TLS interception detection is reset for each establishment, as the
+	// network may have changed.
+	controller.config.setTLSInterceptionDetected(false)
+	controller.config.setTransparentProxyAvoidProtocols(nil)
 
 	controller.concurrentEstablishTunnelsMutex.Lock()
 	controller.establishConnectTunnelCount = 0
@@ -1146,15 +1869,53 @@ func (controller *Controller) launchEstablishing() {
 
 	p := controller.config.clientParameters.Get()
 
-	controller.establishLimitTunnelProtocolsState = &limitTunnelProtocolsState{
-		useUpstreamProxy:      controller.config.UseUpstreamProxy(),
-		initialProtocols:      p.TunnelProtocols(parameters.InitialLimitTunnelProtocols),
-		initialCandidateCount: p.Int(parameters.InitialLimitTunnelProtocolsCandidateCount),
-		protocols:             p.TunnelProtocols(parameters.LimitTunnelProtocols),
+	controller.establishLimitTunnelProtocolsState =
+		newLimitTunnelProtocolsState(controller.config, p)
+
+	// Protocol health is loaded once per establishment, as the network ID
+	// may have changed. As with establishLimitTunnelProtocolsState, the
+	// establishProtocolHealth field must not be replaced after this point;
+	// protocolHealth is safe for concurrent use by establishment workers.
+
+	controller.establishProtocolHealth = newProtocolHealth(
+		controller.config,
+		controller.establishLimitTunnelProtocolsState.protocols)
+
+	if weights := controller.establishProtocolHealth.getWeights(); len(weights) > 0 {
+		NoticeProtocolHealth(weights)
 	}
 
-	workerPoolSize := controller.config.clientParameters.Get().Int(
-		parameters.ConnectionWorkerPoolSize)
+	// Suspected blocking detection is reset on each establishment, as the
+	// network may have changed.
+
+	controller.establishSuspectedBlocking = newSuspectedBlocking(controller.config)
+
+	// Captive portal detection is also reset on each establishment.
+
+	controller.establishCaptivePortal = newCaptivePortal(controller.config)
+
+	// Server scores, which are nil when scoring is disabled, are recorded by
+	// establishment workers; the ServerEntryIterator applies the scores.
+
+	controller.establishServerScores = newServerScores(controller.config)
+
+	// Until the first tunnel is established, the bootstrap connection
+	// settings apply; see Config.BootstrapProfile. Connection workers still
+	// acquire connection attempt slots, so the bootstrap worker pool size
+	// doesn't exceed MaxConcurrentConnectionAttempts.
+
+	bootstrapping := !controller.hasEstablishedOnce()
+	controller.config.setBootstrapping(bootstrapping)
+
+	workerPoolSize := controller.config.clientParameters.Get().Int(parameters.ConnectionWorkerPoolSize)
+	if bootstrapping {
+		bootstrapWorkerPoolSize := controller.config.clientParameters.Get().Int(
+			parameters.BootstrapConnectionWorkerPoolSize)
+		if bootstrapWorkerPoolSize > 0 {
+			workerPoolSize = bootstrapWorkerPoolSize
+		}
+	}
+	workerPoolSize = controller.config.getNetworkConditionAdjustments().scaleConcurrency(workerPoolSize)
 
 	p = nil
 
@@ -1171,6 +1932,16 @@ func (controller *Controller) launchEstablishing() {
 		controller.config,
 		controller.establishLimitTunnelProtocolsState)
 
+	// Transparent proxy detection runs concurrently with the establishment
+	// workers. Until interference is detected, all protocols may be
+	// selected.
+
+	controller.establishWaitGroup.Add(1)
+	go controller.runTransparentProxyDetection()
+
+	controller.establishWaitGroup.Add(1)
+	go controller.runCaptivePortalDetection()
+
 	for i := 0; i < workerPoolSize; i++ {
 		controller.establishWaitGroup.Add(1)
 		go controller.establishTunnelWorker()
@@ -1199,6 +1970,7 @@ func (controller *Controller) stopEstablishing() {
 	controller.establishWaitGroup = nil
 	controller.candidateServerEntries = nil
 	controller.serverAffinityDoneBroadcast = nil
+	controller.establishIgnoreServerAffinity = false
 
 	controller.concurrentEstablishTunnelsMutex.Lock()
 	peakConcurrent := controller.peakConcurrentEstablishTunnels
@@ -1212,6 +1984,11 @@ func (controller *Controller) stopEstablishing() {
 	NoticeInfo("peak concurrent establish tunnels: %d", peakConcurrent)
 	NoticeInfo("peak concurrent resource intensive establish tunnels: %d", peakConcurrentIntensive)
 
+	hits, misses := controller.config.frontingDNSCache.getStats()
+	if hits > 0 || misses > 0 {
+		NoticeFrontingDNSCache(hits, misses)
+	}
+
 	emitMemoryMetrics()
 	DoGarbageCollection()
 }
@@ -1259,7 +2036,11 @@ func (controller *Controller) getTactics(done chan struct{}) {
 			if serverEntry == nil {
 				if iteration == 0 {
 					NoticeAlert("tactics request skipped: no capable servers")
-					return
+
+					// Without any tactics-capable server, signed tactics
+					// are the only source of tactics.
+					tacticsRecord = controller.fetchSignedTactics(iteration)
+					break
 				}
 
 				iterator.Reset()
@@ -1273,6 +2054,13 @@ func (controller *Controller) getTactics(done chan struct{}) {
 
 			NoticeAlert("tactics request failed: %s", err)
 
+			// Try signed tactics, which may be fetched via fronted
+			// endpoints that are reachable when Psiphon servers are not.
+			tacticsRecord = controller.fetchSignedTactics(iteration)
+			if tacticsRecord != nil {
+				break
+			}
+
 			// On error, proceed with a retry, as the error is likely
 			// due to a network failure.
 			//
@@ -1332,10 +2120,18 @@ func (controller *Controller) doFetchTactics(
 
 	tacticsProtocol := tacticsProtocols[index]
 
+	dialParams, err := MakeDialParameters(
+		controller.config,
+		serverEntry,
+		tacticsProtocol)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
 	meekConfig, err := initMeekConfig(
 		controller.config,
 		serverEntry,
-		tacticsProtocol,
+		dialParams,
 		"")
 	if err != nil {
 		return nil, common.ContextError(err)
@@ -1343,7 +2139,7 @@ func (controller *Controller) doFetchTactics(
 
 	meekConfig.RoundTripperOnly = true
 
-	dialConfig, dialStats := initDialConfig(controller.config, meekConfig)
+	dialConfig, dialStats := initDialConfig(controller.config, meekConfig, dialParams)
 
 	NoticeRequestingTactics(
 		serverEntry.IpAddress,
@@ -1415,6 +2211,100 @@ func (controller *Controller) doFetchTactics(
 	return tacticsRecord, nil
 }
 
+// fetchSignedTactics fetches a signed tactics payload from one of the
+// SignedTacticsURLs, independent of any tunnel or Psiphon server. nil is
+// returned when no SignedTacticsURLs are configured or the fetch fails.
+func (controller *Controller) fetchSignedTactics(attempt int) *tactics.Record {
+
+	p := controller.config.clientParameters.Get()
+	urls := p.DownloadURLs(parameters.SignedTacticsURLs)
+	publicKey := p.String(parameters.SignedTacticsSignaturePublicKey)
+	timeout := p.Duration(parameters.FetchSignedTacticsTimeout)
+	p = nil
+
+	if len(urls) == 0 {
+		return nil
+	}
+
+	tacticsRecord, err := controller.doFetchSignedTactics(
+		urls, publicKey, timeout, attempt)
+	if err != nil {
+		NoticeAlert("signed tactics request failed: %s", err)
+		return nil
+	}
+
+	NoticeInfo("fetched signed tactics")
+
+	return tacticsRecord
+}
+
+func (controller *Controller) doFetchSignedTactics(
+	urls parameters.DownloadURLs,
+	publicKey string,
+	timeout time.Duration,
+	attempt int) (*tactics.Record, error) {
+
+	ctx, cancelFunc := context.WithTimeout(controller.establishCtx, timeout)
+	defer cancelFunc()
+
+	networkID := controller.config.networkIDGetter.GetNetworkID()
+
+	// The signed payload has its own verification mechanism, so the URL
+	// may specify SkipVerify.
+
+	downloadURL, _, skipVerify := urls.Select(attempt)
+
+	httpClient, err := MakeUntunneledHTTPClient(
+		ctx,
+		controller.config,
+		controller.untunneledDialConfig,
+		nil,
+		skipVerify)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	request, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("User-Agent", MakePsiphonUserAgent(controller.config))
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	// Read at most one byte more than the size limit, so that
+	// HandleSignedTacticsPayload rejects oversize payloads without reading
+	// the entire response.
+
+	signedPayload, err := ioutil.ReadAll(
+		io.LimitReader(response.Body, tactics.MAX_SIGNED_TACTICS_PAYLOAD_SIZE+1))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if networkID != controller.config.networkIDGetter.GetNetworkID() {
+		return nil, common.ContextError(errors.New("network ID changed"))
+	}
+
+	tacticsRecord, err := tactics.HandleSignedTacticsPayload(
+		GetTacticsStorer(), networkID, publicKey, signedPayload)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return tacticsRecord, nil
+}
+
 // establishCandidateGenerator populates the candidate queue with server entries
 // from the data store. Server entries are iterated in rank order, so that promoted
 // servers with higher rank are priority candidates.
@@ -1431,7 +2321,8 @@ func (controller *Controller) establishCandidateGenerator() {
 	establishStartTime := monotime.Now()
 	var totalNetworkWaitDuration time.Duration
 
-	applyServerAffinity, iterator, err := NewServerEntryIterator(controller.config)
+	applyServerAffinity, iterator, err := NewServerEntryIterator(
+		controller.config, controller.establishIgnoreServerAffinity)
 	if err != nil {
 		NoticeAlert("failed to iterate over candidates: %s", err)
 		controller.SignalComponentFailure()
@@ -1440,7 +2331,7 @@ func (controller *Controller) establishCandidateGenerator() {
 	defer iterator.Close()
 
 	// TODO: reconcile server affinity scheme with multi-tunnel mode
-	if controller.config.TunnelPoolSize > 1 {
+	if controller.tunnelPoolSizer.getSize() > 1 {
 		applyServerAffinity = false
 	}
 
@@ -1469,6 +2360,16 @@ loop:
 			controller.establishLimitTunnelProtocolsState,
 			initialCount,
 			count)
+		controller.diagnostics.traceEvent(
+			"candidate servers: region %q, protocols %v, initial count %d, count %d",
+			controller.config.EgressRegion,
+			controller.establishLimitTunnelProtocolsState.protocols,
+			initialCount,
+			count)
+
+		if controller.config.EgressRegion != "" && count == 0 {
+			NoticeEgressRegionUnavailable(controller.config.EgressRegion)
+		}
 
 		// A "round" consists of a new shuffle of the server entries
 		// and attempted connections up to the end of the server entry
@@ -1511,6 +2412,13 @@ loop:
 				continue
 			}
 
+			// Probabilistically skip servers which recently reported a high
+			// load. The server affinity candidate is never skipped.
+			if !isServerAffinityCandidate &&
+				controller.config.skipLoadedServer(serverEntry.IpAddress) {
+				continue
+			}
+
 			// adjustedEstablishStartTime is establishStartTime shifted
 			// to exclude time spent waiting for network connectivity.
 			adjustedEstablishStartTime := establishStartTime.Add(totalNetworkWaitDuration)
@@ -1545,6 +2453,17 @@ loop:
 				break
 			}
 
+			if controller.establishSuspectedBlocking.isDetected() {
+				// End the round early and apply the suspected blocking pause.
+				break
+			}
+
+			if controller.establishCaptivePortal.isDetected() {
+				// End the round early and wait for the captive portal to
+				// be cleared.
+				break
+			}
+
 			if wasServerAffinityCandidate {
 
 				// Don't start the next candidate until either the server affinity
@@ -1594,6 +2513,18 @@ loop:
 		// Free up resources now, but don't reset until after the pause.
 		iterator.Close()
 
+		// While a captive portal is detected, all connection attempts and
+		// remote server list fetches are expected to fail. Instead of
+		// pausing and iterating again, wait for the portal to be cleared;
+		// then start over immediately.
+		if controller.establishCaptivePortal.isDetected() {
+			if !controller.waitForCaptivePortal() {
+				break loop
+			}
+			iterator.Reset()
+			continue
+		}
+
 		// Trigger a common remote server list fetch, since we may have failed
 		// to connect with all known servers. Don't block sending signal, since
 		// this signal may have already been sent.
@@ -1629,11 +2560,24 @@ loop:
 		// be more rounds if required).
 
 		p := controller.config.clientParameters.Get()
+		jitter := p.Float(parameters.EstablishTunnelPausePeriodJitter)
 		timeout := common.JitterDuration(
-			p.Duration(parameters.EstablishTunnelPausePeriod),
-			p.Float(parameters.EstablishTunnelPausePeriodJitter))
+			controller.config.getNetworkConditionAdjustments().scalePeriod(
+				p.Duration(parameters.EstablishTunnelPausePeriod)),
+			jitter)
 		p = nil
 
+		// When active blocking is suspected, pause for the extended,
+		// escalating suspected blocking period instead. The app may use the
+		// notice to suggest alternatives, such as changing networks.
+		if pausePeriod, ok := controller.establishSuspectedBlocking.takePausePeriod(); ok {
+			timeout = common.JitterDuration(pausePeriod, jitter)
+			NoticeSuspectedBlocking(timeout)
+			controller.diagnostics.traceEvent("suspected active blocking")
+		}
+
+		controller.diagnostics.traceEvent("establish round ended: pausing %s", timeout.Round(time.Second))
+
 		timer := time.NewTimer(timeout)
 		select {
 		case <-timer.C:
@@ -1665,6 +2609,13 @@ loop:
 			continue
 		}
 
+		// Wait for a connection attempt slot. The limit applies across all
+		// connection workers and to the additional attempts made by racing
+		// dials. See connectionAttemptLimiter.
+		if !controller.config.connectionAttempts.acquire(controller.establishCtx) {
+			break loop
+		}
+
 		// Select the tunnel protocol. The selection will be made at random from
 		// protocols supported by the server entry, optionally limited by
 		// LimitTunnelProtocols.
@@ -1678,8 +2629,8 @@ loop:
 		// it's likely that the next candidate is not intensive. In this case, a
 		// StaggerConnectionWorkersMilliseconds delay may still be incurred.
 
-		limitIntensiveConnectionWorkers := controller.config.clientParameters.Get().Int(
-			parameters.LimitIntensiveConnectionWorkers)
+		limitIntensiveConnectionWorkers := controller.config.getNetworkConditionAdjustments().scaleConcurrency(
+			controller.config.clientParameters.Get().Int(parameters.LimitIntensiveConnectionWorkers))
 
 		controller.concurrentEstablishTunnelsMutex.Lock()
 
@@ -1689,17 +2640,33 @@ loop:
 			excludeIntensive = true
 		}
 
-		selectedProtocol, err := controller.establishLimitTunnelProtocolsState.selectProtocol(
-			controller.establishConnectTunnelCount,
-			excludeIntensive,
-			candidateServerEntry.serverEntry)
+		// When TLS interception has been detected on a fronted meek
+		// connection, avoid TLS-based meek protocols, which will likely also
+		// be intercepted, and switch to other protocols.
+		excludeMeekHTTPS := controller.config.isTLSInterceptionDetected()
+
+		// When transparent HTTP proxy interference has been detected, avoid
+		// the plaintext transports the proxy is likely to break.
+		excludeProtocols := controller.config.getTransparentProxyAvoidProtocols()
+
+		selectedProtocol, candidateProtocols, err :=
+			controller.establishLimitTunnelProtocolsState.selectProtocol(
+				controller.establishConnectTunnelCount,
+				excludeIntensive,
+				excludeMeekHTTPS,
+				excludeProtocols,
+				controller.establishProtocolHealth,
+				candidateServerEntry.serverEntry)
 		if err != nil {
 
 			controller.concurrentEstablishTunnelsMutex.Unlock()
 
+			controller.config.connectionAttempts.release()
+
 			// selectProtocol returns errNoProtocolSupported when the server
 			// does not support any protocol that remains after applying the
-			// LimitTunnelProtocols parameter and the excludeIntensive flag.
+			// LimitTunnelProtocols parameter, the excludeIntensive and
+			// excludeMeekHTTPS flags, excludeProtocols, and protocol health.
 			// Silently skip the candidate in this case.
 			if err != errNoProtocolSupported {
 				NoticeInfo("failed to select protocol for %s: %s",
@@ -1735,17 +2702,50 @@ loop:
 
 		controller.concurrentEstablishTunnelsMutex.Unlock()
 
+		// When the server supports both fronted and unfronted meek, the
+		// MeekFailoverOrder parameter may specify a failover plan, which
+		// tries both classes. A racing failover plan dials two meek
+		// protocols concurrently, but is counted as a single intensive
+		// establishment.
+
+		failover, err := selectMeekFailover(
+			controller.config.clientParameters.Get(),
+			selectedProtocol,
+			candidateProtocols)
+		if err != nil {
+			NoticeAlert("failed to select meek failover: %s", err)
+			failover = nil
+		}
+
 		// ConnectTunnel will allocate significant memory, so first attempt to
 		// reclaim as much as possible.
 		DoGarbageCollection()
 
-		tunnel, err := ConnectTunnel(
-			controller.establishCtx,
-			controller.config,
-			controller.sessionId,
-			candidateServerEntry.serverEntry,
-			selectedProtocol,
-			candidateServerEntry.adjustedEstablishStartTime)
+		connectStartTime := monotime.Now()
+
+		var tunnel *Tunnel
+		if failover != nil {
+			tunnel, err = connectMeekFailover(
+				controller.establishCtx,
+				controller.config,
+				controller.sessionId,
+				candidateServerEntry.serverEntry,
+				failover,
+				controller.establishProtocolHealth,
+				candidateServerEntry.adjustedEstablishStartTime)
+		} else {
+			tunnel, err = ConnectTunnel(
+				controller.establishCtx,
+				controller.config,
+				controller.sessionId,
+				candidateServerEntry.serverEntry,
+				selectedProtocol,
+				candidateServerEntry.adjustedEstablishStartTime)
+		}
+
+		connectDuration := monotime.Since(connectStartTime)
+
+		controller.config.connectionAttempts.release()
 
 		controller.concurrentEstablishTunnelsMutex.Lock()
 		if isIntensive {
@@ -1786,9 +2786,39 @@ loop:
 			NoticeInfo("failed to connect to %s: %s",
 				candidateServerEntry.serverEntry.IpAddress, err)
 
+			controller.diagnostics.recordFailure(
+				controller.establishProtocolHealth,
+				selectedProtocol,
+				candidateServerEntry.serverEntry.Region,
+				failover != nil,
+				connectDuration,
+				err)
+
+			// connectMeekFailover records the health of each attempt.
+			if failover == nil {
+				controller.establishProtocolHealth.recordFailure(selectedProtocol)
+			}
+
+			controller.establishSuspectedBlocking.recordFailure(
+				selectedProtocol, connectDuration, err)
+
+			controller.establishServerScores.recordOutcome(
+				candidateServerEntry.serverEntry.IpAddress, false, 0)
+
 			continue
 		}
 
+		if failover == nil {
+			controller.establishProtocolHealth.recordSuccess(selectedProtocol)
+		}
+
+		controller.establishSuspectedBlocking.recordSuccess()
+
+		controller.establishServerScores.recordOutcome(
+			candidateServerEntry.serverEntry.IpAddress, true, connectDuration)
+
+		controller.diagnostics.recordSuccess()
+
 		// Deliver connected tunnel.
 		// Don't block. Assumes the receiver has a buffer large enough for
 		// the number of desired tunnels. If there's no room, the tunnel must
@@ -0,0 +1,869 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestNetworkChangeHandoffTimeout(t *testing.T) {
+
+	c := newTestTunnelController(t, map[string]interface{}{
+		parameters.NetworkChangeHandoffTimeout: "1s",
+	})
+	defer c.stop()
+
+	tunnel := c.deliverTunnel("192.0.2.1")
+
+	c.controller.NetworkChanged()
+
+	c.waitForNotice("network changed: handing off 1 tunnels")
+
+	// The handoff tunnel remains usable until the replacement tunnel is
+	// established or the handoff times out.
+
+	tunnels, handoffTunnels := c.getTunnels()
+	if len(tunnels) != 0 || len(handoffTunnels) != 1 || handoffTunnels[0] != tunnel {
+		t.Fatalf("unexpected tunnels after network change")
+	}
+	if c.controller.getNextActiveTunnel() != tunnel {
+		t.Fatalf("handoff tunnel not used after network change")
+	}
+	if c.isClosed(tunnel) {
+		t.Fatalf("handoff tunnel closed after network change")
+	}
+
+	// With no replacement tunnel, the handoff tunnel is closed after
+	// NetworkChangeHandoffTimeout, while establishment continues.
+
+	c.waitForNotice("tunnel handoff timed out")
+
+	c.waitFor("handoff tunnel closed", func() bool {
+		_, handoffTunnels := c.getTunnels()
+		return len(handoffTunnels) == 0 && c.isClosed(tunnel)
+	})
+
+	if c.controller.getNextActiveTunnel() != nil {
+		t.Fatalf("unexpected active tunnel after handoff timeout")
+	}
+	if c.countNotices("TunnelDisconnected: network_changed") != 1 {
+		t.Fatalf("unexpected disconnected notices after handoff timeout")
+	}
+	if c.countNotices("Tunnels: 0") != 1 {
+		t.Fatalf("unexpected tunnels notices after handoff timeout")
+	}
+	if c.countNotices("stop establishing") != 1 {
+		t.Fatalf("establishment stopped after handoff timeout")
+	}
+}
+
+func TestNetworkChangeHandoffPoolRefill(t *testing.T) {
+
+	c := newTestTunnelController(t, nil)
+	defer c.stop()
+
+	tunnel := c.deliverTunnel("192.0.2.1")
+
+	c.controller.NetworkChanged()
+
+	c.waitForNotice("network changed: handing off 1 tunnels")
+
+	// Establishment restarts to fill the emptied tunnel pool.
+
+	c.waitFor("establishment restarted", func() bool {
+		return c.countNotices("start establishing") == 2
+	})
+
+	// When the replacement tunnel fills the pool, establishment stops and the
+	// handoff tunnel is closed without waiting for the handoff timeout.
+
+	replacementTunnel := c.deliverTunnel("192.0.2.2")
+
+	c.waitFor("handoff tunnel closed", func() bool {
+		_, handoffTunnels := c.getTunnels()
+		return len(handoffTunnels) == 0 && c.isClosed(tunnel)
+	})
+
+	tunnels, _ := c.getTunnels()
+	if len(tunnels) != 1 || tunnels[0] != replacementTunnel {
+		t.Fatalf("unexpected tunnels after pool refill")
+	}
+	if c.controller.getNextActiveTunnel() != replacementTunnel {
+		t.Fatalf("replacement tunnel not used after pool refill")
+	}
+	if c.isClosed(replacementTunnel) {
+		t.Fatalf("replacement tunnel closed after pool refill")
+	}
+	if c.countNotices("stop establishing") != 2 {
+		t.Fatalf("establishment not stopped after pool refill")
+	}
+	if c.countNotices("tunnel handoff timed out") != 0 {
+		t.Fatalf("unexpected handoff timeout after pool refill")
+	}
+	if c.countNotices("Tunnels: 0") != 0 {
+		t.Fatalf("unexpected tunnels notice after pool refill")
+	}
+}
+
+func TestNetworkChangeHandoffTunnelFailure(t *testing.T) {
+
+	c := newTestTunnelController(t, nil)
+	defer c.stop()
+
+	tunnel := c.deliverTunnel("192.0.2.1")
+
+	c.controller.NetworkChanged()
+
+	c.waitForNotice("network changed: handing off 1 tunnels")
+
+	// A failed handoff tunnel is removed and closed, while establishment of
+	// the replacement tunnel continues.
+
+	c.controller.SignalTunnelFailure(tunnel)
+
+	c.waitFor("handoff tunnel closed", func() bool {
+		_, handoffTunnels := c.getTunnels()
+		return len(handoffTunnels) == 0 && c.isClosed(tunnel)
+	})
+
+	if c.controller.getNextActiveTunnel() != nil {
+		t.Fatalf("unexpected active tunnel after handoff tunnel failure")
+	}
+	if c.countNotices("Tunnels: 0") != 1 {
+		t.Fatalf("unexpected tunnels notices after handoff tunnel failure")
+	}
+	if c.countNotices("stop establishing") != 1 {
+		t.Fatalf("establishment stopped after handoff tunnel failure")
+	}
+
+	// A subsequent network change has no tunnels to hand off, and the
+	// replacement tunnel fills the pool.
+
+	c.controller.NetworkChanged()
+
+	c.waitForNotice("network changed: handing off 0 tunnels")
+
+	replacementTunnel := c.deliverTunnel("192.0.2.2")
+
+	c.waitFor("replacement tunnel registered", func() bool {
+		tunnels, _ := c.getTunnels()
+		return len(tunnels) == 1 && tunnels[0] == replacementTunnel
+	})
+
+	if c.countNotices("tunnel handoff timed out") != 0 {
+		t.Fatalf("unexpected handoff timeout after handoff tunnel failure")
+	}
+}
+
+func TestTunnelMigrationDeadline(t *testing.T) {
+
+	// The migrating tunnel is closed at the server's drain deadline or after
+	// NetworkChangeHandoffTimeout, whichever is sooner. A zero deadline
+	// applies NetworkChangeHandoffTimeout.
+
+	testCases := []struct {
+		description    string
+		handoffTimeout string
+		deadline       time.Duration
+	}{
+		{"deadline before handoff timeout", "1m", 200 * time.Millisecond},
+		{"handoff timeout before deadline", "200ms", time.Minute},
+		{"no deadline", "200ms", 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			c := newTestTunnelController(t, map[string]interface{}{
+				parameters.NetworkChangeHandoffTimeout: testCase.handoffTimeout,
+			})
+			defer c.stop()
+
+			tunnel := c.deliverTunnel("192.0.2.1")
+
+			startTime := time.Now()
+
+			c.controller.SignalTunnelMigration(tunnel, testCase.deadline)
+
+			c.waitForNotice("server requested migration: 192.0.2.1")
+
+			_, handoffTunnels := c.getTunnels()
+			if len(handoffTunnels) != 1 || handoffTunnels[0] != tunnel {
+				t.Fatalf("migrating tunnel not handed off")
+			}
+
+			c.waitFor("establishment restarted", func() bool {
+				return c.countNotices("start establishing") == 2
+			})
+
+			c.waitForNotice("tunnel handoff timed out")
+
+			if time.Since(startTime) > 5*time.Second {
+				t.Fatalf("unexpected handoff duration: %s", time.Since(startTime))
+			}
+
+			c.waitFor("migrating tunnel closed", func() bool {
+				return c.isClosed(tunnel)
+			})
+
+			if c.countNotices("TunnelDisconnected: migration") != 1 {
+				t.Fatalf("unexpected disconnected notices after migration")
+			}
+		})
+	}
+}
+
+func TestPauseDuringEstablishment(t *testing.T) {
+
+	c := newTestTunnelController(t, map[string]interface{}{
+		parameters.ServerAffinityMaxAge: "1ns",
+	})
+	defer c.stop()
+
+	c.setExpiredServerAffinity("192.0.2.10")
+
+	// Pause stops the in-progress establishment.
+
+	c.controller.Pause()
+
+	c.waitForNotice("Paused: true")
+	c.waitForNotice("stopped establishing")
+
+	// Network changes and reconnects while paused don't start establishment.
+
+	c.controller.NetworkChanged()
+	c.waitForNotice("network changed: handing off 0 tunnels")
+
+	c.controller.Reconnect(false)
+	c.waitForNotice("reconnecting: reset replay: false")
+
+	if c.countNotices("start establishing") != 1 {
+		t.Fatalf("establishment started while paused")
+	}
+
+	// Resume starts establishment. As the network changed while paused,
+	// server affinity is ignored.
+
+	c.controller.Resume()
+
+	c.waitForNotice("Paused: false")
+
+	if c.waitForEstablishmentServerAffinity() {
+		t.Fatalf("server affinity applied after network change while paused")
+	}
+	if c.countNotices("start establishing") != 2 {
+		t.Fatalf("unexpected establishment count after resume")
+	}
+
+	// A tunnel established after resume is used.
+
+	tunnel := c.deliverTunnel("192.0.2.1")
+
+	if c.controller.getNextActiveTunnel() != tunnel {
+		t.Fatalf("tunnel not used after resume")
+	}
+
+	// Without a network change while paused, server affinity is applied on
+	// resume.
+
+	c.controller.Pause()
+	c.waitFor("second pause", func() bool {
+		return c.countNotices("Paused: true") == 2
+	})
+
+	c.controller.Resume()
+	c.waitFor("second resume", func() bool {
+		return c.countNotices("Paused: false") == 2
+	})
+
+	if !c.waitForEstablishmentServerAffinity() {
+		t.Fatalf("server affinity not applied after resume")
+	}
+}
+
+func TestPauseResumeRepeated(t *testing.T) {
+
+	c := newTestTunnelController(t, nil)
+	defer c.stop()
+
+	// Resume has no effect when not paused. Delivering a tunnel ensures the
+	// Resume signal has been handled.
+
+	c.controller.Resume()
+	c.waitForPauseSignal()
+
+	tunnel := c.deliverTunnel("192.0.2.1")
+
+	if c.countNotices("Paused: false") != 0 {
+		t.Fatalf("unexpected resume when not paused")
+	}
+
+	for i := 1; i <= 2; i++ {
+
+		// Repeated Pause calls pause once, closing all tunnels.
+
+		c.controller.Pause()
+		c.controller.Pause()
+		c.waitForPauseSignal()
+		c.controller.Pause()
+		c.waitForPauseSignal()
+
+		c.waitFor("tunnel closed", func() bool {
+			tunnels, _ := c.getTunnels()
+			return len(tunnels) == 0 && c.isClosed(tunnel)
+		})
+
+		if c.controller.getNextActiveTunnel() != nil {
+			t.Fatalf("unexpected active tunnel while paused")
+		}
+		if c.countNotices("TunnelDisconnected: paused") != i {
+			t.Fatalf("unexpected disconnected notices while paused")
+		}
+
+		// Repeated Resume calls resume once, starting one establishment.
+
+		c.controller.Resume()
+		c.controller.Resume()
+		c.waitForPauseSignal()
+		c.controller.Resume()
+		c.waitForPauseSignal()
+
+		tunnel = c.deliverTunnel(fmt.Sprintf("192.0.2.%d", i+1))
+
+		if c.countNotices("Paused: true") != i ||
+			c.countNotices("Paused: false") != i {
+			t.Fatalf("unexpected paused notices")
+		}
+		if c.countNotices("start establishing") != i+1 {
+			t.Fatalf("unexpected establishment count after resume")
+		}
+	}
+}
+
+func TestPauseDuringTunnelHandoff(t *testing.T) {
+
+	c := newTestTunnelController(t, map[string]interface{}{
+		parameters.NetworkChangeHandoffTimeout: "200ms",
+	})
+	defer c.stop()
+
+	tunnel := c.deliverTunnel("192.0.2.1")
+
+	c.controller.NetworkChanged()
+
+	c.waitForNotice("network changed: handing off 1 tunnels")
+
+	// Pause closes the handoff tunnel and stops the handoff timer.
+
+	c.controller.Pause()
+
+	c.waitForNotice("Paused: true")
+
+	c.waitFor("handoff tunnel closed", func() bool {
+		_, handoffTunnels := c.getTunnels()
+		return len(handoffTunnels) == 0 && c.isClosed(tunnel)
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	if c.countNotices("tunnel handoff timed out") != 0 {
+		t.Fatalf("unexpected handoff timeout while paused")
+	}
+
+	startCount := c.countNotices("start establishing")
+
+	// Resume establishes a new tunnel to fill the pool.
+
+	c.controller.Resume()
+
+	c.waitForNotice("Paused: false")
+
+	c.waitFor("establishment restarted", func() bool {
+		return c.countNotices("start establishing") == startCount+1
+	})
+
+	replacementTunnel := c.deliverTunnel("192.0.2.2")
+
+	if c.controller.getNextActiveTunnel() != replacementTunnel {
+		t.Fatalf("replacement tunnel not used after resume")
+	}
+}
+
+func TestReconnectDuringEstablishment(t *testing.T) {
+
+	c := newTestTunnelController(t, map[string]interface{}{
+		parameters.ServerAffinityMaxAge: "1ns",
+	})
+	defer c.stop()
+
+	c.setExpiredServerAffinity("192.0.2.10")
+
+	reconnect := func(resetReplay bool, expectedStartCount int) bool {
+		c.controller.Reconnect(resetReplay)
+		c.waitForNotice(fmt.Sprintf("reconnecting: reset replay: %v", resetReplay))
+		c.waitFor("establishment restarted", func() bool {
+			return c.countNotices("start establishing") == expectedStartCount
+		})
+		return c.waitForEstablishmentServerAffinity()
+	}
+
+	// Reconnect restarts the in-progress establishment, which applies server
+	// affinity unless resetReplay is set. resetReplay applies only to the
+	// following establishment.
+
+	if !reconnect(false, 2) {
+		t.Fatalf("server affinity not applied after reconnect")
+	}
+
+	if reconnect(true, 3) {
+		t.Fatalf("server affinity applied after reconnect with reset replay")
+	}
+
+	if !reconnect(false, 4) {
+		t.Fatalf("server affinity not applied after reconnect")
+	}
+
+	if c.countNotices("stopped establishing") != 3 {
+		t.Fatalf("unexpected stopped establishing count")
+	}
+
+	// A tunnel established after reconnecting is used, and a subsequent
+	// reconnect closes it.
+
+	tunnel := c.deliverTunnel("192.0.2.1")
+
+	if c.controller.getNextActiveTunnel() != tunnel {
+		t.Fatalf("tunnel not used after reconnect")
+	}
+
+	if reconnect(true, 5) {
+		t.Fatalf("server affinity applied after reconnect with reset replay")
+	}
+
+	c.waitFor("tunnel closed", func() bool {
+		tunnels, _ := c.getTunnels()
+		return len(tunnels) == 0 && c.isClosed(tunnel)
+	})
+
+	if c.countNotices("TunnelDisconnected: reconnect") != 1 {
+		t.Fatalf("unexpected disconnected notices after reconnect")
+	}
+
+	// A reconnect with resetReplay while paused applies on resume.
+
+	c.controller.Pause()
+	c.waitForNotice("Paused: true")
+
+	c.controller.Reconnect(true)
+	c.waitForNotice("reconnecting: reset replay: true")
+
+	c.controller.Resume()
+	c.waitForNotice("Paused: false")
+
+	c.waitFor("establishment resumed", func() bool {
+		return c.countNotices("start establishing") == 6
+	})
+
+	if c.waitForEstablishmentServerAffinity() {
+		t.Fatalf("server affinity applied after reconnect with reset replay while paused")
+	}
+}
+
+// testTunnelController runs a Controller which has no server entries, so
+// that tunnel establishment makes no connections. Tests deliver tunnels,
+// connected to a local SSH server, as if established by the Controller, and
+// check the Controller's tunnels and the notices it emits.
+type testTunnelController struct {
+	t            *testing.T
+	dataDirName  string
+	config       *Config
+	controller   *Controller
+	sshListener  net.Listener
+	stopRunning  context.CancelFunc
+	runWaitGroup *sync.WaitGroup
+	noticesMutex sync.Mutex
+	notices      []string
+}
+
+func newTestTunnelController(
+	t *testing.T, applyParameters map[string]interface{}) *testTunnelController {
+
+	c := &testTunnelController{
+		t:            t,
+		runWaitGroup: new(sync.WaitGroup),
+	}
+
+	var err error
+	c.dataDirName, err = ioutil.TempDir("", "psiphon-controller-tunnels-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+
+	// Notices are recorded as "<type>: <value>", where the value is the
+	// message for Info and Alert notices.
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil {
+				return
+			}
+			var value interface{}
+			switch noticeType {
+			case "Info", "Alert":
+				value = payload["message"]
+			case "Tunnels":
+				value = payload["count"]
+			case "TunnelDisconnected":
+				value = payload["reason"]
+			case "Paused":
+				value = payload["isPaused"]
+			case "CandidateServers":
+				value = payload["count"]
+			default:
+				return
+			}
+			c.noticesMutex.Lock()
+			c.notices = append(c.notices, fmt.Sprintf("%s: %v", noticeType, value))
+			c.noticesMutex.Unlock()
+		}))
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "DisableTactics" : true,
+        "DisableApi" : true,
+        "DisableLocalSocksProxy" : true,
+        "DisableLocalHTTPProxy" : true,
+        "DisablePeriodicSshKeepAlive" : true
+    }`
+	c.config, err = LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	c.config.DataStoreDirectory = c.dataDirName
+
+	err = c.config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	p := map[string]interface{}{
+		parameters.EstablishTunnelTimeout: "0s",
+	}
+	for name, value := range applyParameters {
+		p[name] = value
+	}
+	err = c.config.SetClientParameters("", true, p)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(c.config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	c.sshListener = runTestSSHServer(t)
+
+	c.controller, err = NewController(c.config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+
+	ctx, stopRunning := context.WithCancel(context.Background())
+	c.stopRunning = stopRunning
+
+	c.runWaitGroup.Add(1)
+	go func() {
+		defer c.runWaitGroup.Done()
+		c.controller.Run(ctx)
+	}()
+
+	c.waitForNotice("start establishing")
+
+	return c
+}
+
+func (c *testTunnelController) stop() {
+	c.stopRunning()
+	c.runWaitGroup.Wait()
+	c.sshListener.Close()
+	CloseDataStore()
+	SetNoticeWriter(os.Stderr)
+	os.RemoveAll(c.dataDirName)
+}
+
+// runTestSSHServer runs an SSH server, for test tunnels, which accepts any
+// client and rejects all channels and requests.
+func runTestSSHServer(t *testing.T) net.Listener {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey failed: %s", err)
+	}
+
+	sshServerConfig := &ssh.ServerConfig{
+		NoClientAuth: true,
+	}
+	sshServerConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(conn, sshServerConfig)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for newChannel := range channels {
+					newChannel.Reject(ssh.Prohibited, "")
+				}
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// deliverTunnel connects a tunnel for the specified server IP address and
+// delivers it to the Controller, as an establish worker does, and waits
+// until the tunnel is activated and registered.
+func (c *testTunnelController) deliverTunnel(ipAddress string) *Tunnel {
+
+	tunnel := c.makeTunnel(ipAddress)
+
+	c.controller.connectedTunnels <- tunnel
+
+	c.waitFor("tunnel registered", func() bool {
+		tunnels, _ := c.getTunnels()
+		for _, registeredTunnel := range tunnels {
+			if registeredTunnel == tunnel {
+				return true
+			}
+		}
+		return false
+	})
+
+	return tunnel
+}
+
+// makeTunnel connects a tunnel to the test SSH server. The tunnel is
+// initialized in the same way as by dialTunnel.
+func (c *testTunnelController) makeTunnel(ipAddress string) *Tunnel {
+
+	conn, err := net.Dial("tcp", c.sshListener.Addr().String())
+	if err != nil {
+		c.t.Fatalf("Dial failed: %s", err)
+	}
+
+	monitoredConn, err := common.NewActivityMonitoredConn(conn, 0, false, nil, nil)
+	if err != nil {
+		c.t.Fatalf("NewActivityMonitoredConn failed: %s", err)
+	}
+
+	sshClientConfig := &ssh.ClientConfig{
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	sshClientConn, sshChannels, sshRequests, err := ssh.NewClientConn(
+		monitoredConn, "", sshClientConfig)
+	if err != nil {
+		c.t.Fatalf("NewClientConn failed: %s", err)
+	}
+
+	noRequests := make(chan *ssh.Request)
+	close(noRequests)
+
+	return &Tunnel{
+		mutex:                      new(sync.Mutex),
+		config:                     c.config,
+		serverEntry:                &protocol.ServerEntry{IpAddress: ipAddress},
+		protocol:                   protocol.TUNNEL_PROTOCOL_SSH,
+		conn:                       monitoredConn,
+		sshClient:                  ssh.NewClient(sshClientConn, sshChannels, noRequests),
+		sshServerRequests:          sshRequests,
+		signalPortForwardFailure:   make(chan struct{}, 1),
+		adjustedEstablishStartTime: monotime.Now(),
+	}
+}
+
+// setExpiredServerAffinity stores a server entry, which supports no tunnel
+// protocols and so is never dialed, and sets server affinity to that server.
+// With a ServerAffinityMaxAge of 1ns, the server affinity is always expired,
+// which is noticed only by establishments that don't ignore server
+// affinity. See waitForEstablishmentServerAffinity.
+func (c *testTunnelController) setExpiredServerAffinity(ipAddress string) {
+
+	encodedServerEntry, err := protocol.EncodeServerEntry(
+		&protocol.ServerEntry{IpAddress: ipAddress})
+	if err != nil {
+		c.t.Fatalf("EncodeServerEntry failed: %s", err)
+	}
+
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		encodedServerEntry,
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		c.t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+
+	err = StoreServerEntry(serverEntryFields, true)
+	if err != nil {
+		c.t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	err = setServerAffinityState(ipAddress, "")
+	if err != nil {
+		c.t.Fatalf("setServerAffinityState failed: %s", err)
+	}
+}
+
+// waitForEstablishmentServerAffinity waits until the latest establishment
+// has started iterating over candidates, and returns whether it applied
+// server affinity: that is, when a "server affinity expired" notice was
+// emitted by the establishment. setExpiredServerAffinity must be called
+// first.
+func (c *testTunnelController) waitForEstablishmentServerAffinity() bool {
+
+	var appliedServerAffinity bool
+
+	c.waitFor("establishment candidates", func() bool {
+		c.noticesMutex.Lock()
+		defer c.noticesMutex.Unlock()
+		start := -1
+		for i, notice := range c.notices {
+			if notice == "Info: start establishing" {
+				start = i
+			}
+		}
+		if start == -1 {
+			return false
+		}
+		appliedServerAffinity = false
+		for _, notice := range c.notices[start+1:] {
+			if notice == "Info: server affinity expired" {
+				appliedServerAffinity = true
+			}
+			if strings.HasPrefix(notice, "CandidateServers: ") {
+				return true
+			}
+		}
+		return false
+	})
+
+	return appliedServerAffinity
+}
+
+// waitForPauseSignal waits until the Controller has received all Pause and
+// Resume signals.
+func (c *testTunnelController) waitForPauseSignal() {
+	c.waitFor("pause signal received", func() bool {
+		return len(c.controller.signalPause) == 0
+	})
+}
+
+// getTunnels returns copies of the Controller's active and handoff tunnel
+// lists.
+func (c *testTunnelController) getTunnels() ([]*Tunnel, []*Tunnel) {
+	c.controller.tunnelMutex.Lock()
+	defer c.controller.tunnelMutex.Unlock()
+	return append([]*Tunnel(nil), c.controller.tunnels...),
+		append([]*Tunnel(nil), c.controller.handoffTunnels...)
+}
+
+func (c *testTunnelController) isClosed(tunnel *Tunnel) bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.isClosed
+}
+
+// countNotices returns the number of recorded notices with the specified
+// type and value; for example, "Tunnels: 0". For Info and Alert notices,
+// the value is the message and the type may be omitted.
+func (c *testTunnelController) countNotices(notice string) int {
+	c.noticesMutex.Lock()
+	defer c.noticesMutex.Unlock()
+	count := 0
+	for _, recordedNotice := range c.notices {
+		if recordedNotice == notice ||
+			recordedNotice == "Info: "+notice ||
+			recordedNotice == "Alert: "+notice {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (c *testTunnelController) waitForNotice(notice string) {
+	c.waitFor(fmt.Sprintf("notice %q", notice), func() bool {
+		return c.countNotices(notice) > 0
+	})
+}
+
+func (c *testTunnelController) waitFor(description string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			c.noticesMutex.Lock()
+			notices := strings.Join(c.notices, "\n")
+			c.noticesMutex.Unlock()
+			c.t.Fatalf("timed out waiting for %s; notices:\n%s", description, notices)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
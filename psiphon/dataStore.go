@@ -21,15 +21,20 @@ package psiphon
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
+	"runtime"
 	"sync"
+	"time"
 
+	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
@@ -42,15 +47,31 @@ var (
 	datastoreSLOKsBucket                        = []byte("SLOKs")
 	datastoreTacticsBucket                      = []byte("tactics")
 	datastoreSpeedTestSamplesBucket             = []byte("speedTestSamples")
+	datastoreProtocolHealthBucket               = []byte("protocolHealth")
+	datastoreIPAddressFamilyBucket              = []byte("ipAddressFamily")
+	datastoreServerScoresBucket                 = []byte("serverScores")
+	datastoreFailedTunnelStatsBucket            = []byte("failedTunnelStats")
 	datastoreLastConnectedKey                   = "lastConnected"
 	datastoreLastServerEntryFilterKey           = []byte("lastServerEntryFilter")
 	datastoreAffinityServerEntryIDKey           = []byte("affinityServerEntryID")
+	datastoreAffinityPromotedTimeKey            = []byte("affinityPromotedTime")
+	datastoreAffinityNetworkIDKey               = []byte("affinityNetworkID")
+	datastoreServerEntryRevocationListKey       = []byte("serverEntryRevocationList")
+	datastoreSignedTacticsVersionKey            = []byte("signedTacticsVersion")
+	datastoreLastKnownRegionKey                 = []byte("lastKnownRegion")
 	datastorePersistentStatTypeRemoteServerList = string(datastoreRemoteServerListStatsBucket)
+	datastorePersistentStatTypeFailedTunnel     = string(datastoreFailedTunnelStatsBucket)
 	datastoreServerEntryFetchGCThreshold        = 20
-
-	datastoreInitalizeMutex sync.Mutex
-	datastoreReferenceMutex sync.Mutex
-	activeDatastoreDB       *datastoreDB
+	datastoreServerEntryShardCount              = 16
+	datastoreServerEntryShardBuckets            = makeServerEntryShardBuckets()
+	datastoreServerEntryMigrationBatchSize      = 1000
+
+	datastoreInitalizeMutex           sync.Mutex
+	datastoreReferenceMutex           sync.Mutex
+	activeDatastoreDB                 *datastoreDB
+	activeDatastoreShardServerEntries bool
+	activeDatastoreClientParameters   *parameters.ClientParameters
+	activeDatastoreWriteBuffer        *datastoreWriteBuffer
 )
 
 // OpenDataStore opens and initializes the singleton data store instance.
@@ -67,15 +88,28 @@ func OpenDataStore(config *Config) error {
 		return common.ContextError(errors.New("db already open"))
 	}
 
-	newDB, err := datastoreOpenDB(config.DataStoreDirectory)
+	newDB, err := datastoreOpenDB(
+		config.DataStoreDirectory, config.BackupCorruptDataStore)
 	if err != nil {
 		return common.ContextError(err)
 	}
 
 	datastoreReferenceMutex.Lock()
 	activeDatastoreDB = newDB
+	activeDatastoreShardServerEntries = config.DataStoreShardServerEntries
+	activeDatastoreClientParameters = config.clientParameters
+	activeDatastoreWriteBuffer = newDatastoreWriteBuffer(config)
 	datastoreReferenceMutex.Unlock()
 
+	err = migrateServerEntryShards()
+	if err != nil {
+		datastoreReferenceMutex.Lock()
+		activeDatastoreDB = nil
+		datastoreReferenceMutex.Unlock()
+		newDB.close()
+		return common.ContextError(err)
+	}
+
 	_ = resetAllPersistentStatsToUnreported()
 
 	return nil
@@ -87,6 +121,13 @@ func CloseDataStore() {
 	datastoreInitalizeMutex.Lock()
 	defer datastoreInitalizeMutex.Unlock()
 
+	// Make a final attempt to complete any buffered writes.
+	datastoreReferenceMutex.Lock()
+	writeBuffer := activeDatastoreWriteBuffer
+	activeDatastoreWriteBuffer = nil
+	datastoreReferenceMutex.Unlock()
+	writeBuffer.close()
+
 	datastoreReferenceMutex.Lock()
 	defer datastoreReferenceMutex.Unlock()
 
@@ -102,6 +143,112 @@ func CloseDataStore() {
 	activeDatastoreDB = nil
 }
 
+func makeServerEntryShardBuckets() [][]byte {
+	buckets := make([][]byte, datastoreServerEntryShardCount)
+	for i := 0; i < datastoreServerEntryShardCount; i++ {
+		buckets[i] = []byte(fmt.Sprintf("serverEntries-%02d", i))
+	}
+	return buckets
+}
+
+// getServerEntryBuckets returns the names of all buckets which store server
+// entries.
+func getServerEntryBuckets() [][]byte {
+	datastoreReferenceMutex.Lock()
+	shardServerEntries := activeDatastoreShardServerEntries
+	datastoreReferenceMutex.Unlock()
+
+	if !shardServerEntries {
+		return [][]byte{datastoreServerEntriesBucket}
+	}
+	return datastoreServerEntryShardBuckets
+}
+
+// getServerEntryBucket returns the name of the bucket which stores the
+// server entry with the specified ID. When sharded, the shard is selected by
+// a prefix of the SHA-256 hash of the ID, which distributes server entries
+// evenly across the shards.
+func getServerEntryBucket(serverEntryID []byte) []byte {
+	datastoreReferenceMutex.Lock()
+	shardServerEntries := activeDatastoreShardServerEntries
+	datastoreReferenceMutex.Unlock()
+
+	if !shardServerEntries {
+		return datastoreServerEntriesBucket
+	}
+	digest := sha256.Sum256(serverEntryID)
+	return datastoreServerEntryShardBuckets[int(digest[0])%datastoreServerEntryShardCount]
+}
+
+// migrateServerEntryShards moves any server entries stored in the buckets of
+// the inactive layout -- sharded or unsharded -- to the buckets of the active
+// layout. This automatically migrates an existing datastore when
+// DataStoreShardServerEntries changes. Entries are moved in batches, each in
+// a separate transaction, to bound transaction size; an interrupted migration
+// resumes the next time the datastore is opened.
+func migrateServerEntryShards() error {
+
+	datastoreReferenceMutex.Lock()
+	shardServerEntries := activeDatastoreShardServerEntries
+	datastoreReferenceMutex.Unlock()
+
+	sourceBuckets := datastoreServerEntryShardBuckets
+	if shardServerEntries {
+		sourceBuckets = [][]byte{datastoreServerEntriesBucket}
+	}
+
+	migratedCount := 0
+
+	for _, sourceBucket := range sourceBuckets {
+		for {
+			batchCount := 0
+			err := datastoreUpdate(func(tx *datastoreTx) error {
+
+				bucket := tx.bucket(sourceBucket)
+
+				var keys [][]byte
+				cursor := bucket.cursor()
+				for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+					keys = append(keys, append([]byte(nil), key...))
+					if len(keys) >= datastoreServerEntryMigrationBatchSize {
+						break
+					}
+				}
+				cursor.close()
+
+				for _, key := range keys {
+					// Must make a copy as slice is only valid within transaction.
+					value := append([]byte(nil), bucket.get(key)...)
+					err := tx.bucket(getServerEntryBucket(key)).put(key, value)
+					if err != nil {
+						return common.ContextError(err)
+					}
+					err = bucket.delete(key)
+					if err != nil {
+						return common.ContextError(err)
+					}
+				}
+
+				batchCount = len(keys)
+				return nil
+			})
+			if err != nil {
+				return common.ContextError(err)
+			}
+			if batchCount == 0 {
+				break
+			}
+			migratedCount += batchCount
+		}
+	}
+
+	if migratedCount > 0 {
+		NoticeInfo("migrated %d server entries", migratedCount)
+	}
+
+	return nil
+}
+
 func datastoreView(fn func(tx *datastoreTx) error) error {
 
 	datastoreReferenceMutex.Lock()
@@ -136,6 +283,27 @@ func datastoreUpdate(fn func(tx *datastoreTx) error) error {
 	return err
 }
 
+// datastoreNonCriticalUpdate performs a non-critical datastore update. When
+// the update fails, it's buffered for retry in the datastore write buffer,
+// and no error is returned. fn may be invoked more than once, and must not
+// depend on state which may change before it's retried.
+//
+// When write buffering is disabled, datastoreNonCriticalUpdate is
+// equivalent to datastoreUpdate.
+func datastoreNonCriticalUpdate(fn func(tx *datastoreTx) error) error {
+
+	datastoreReferenceMutex.Lock()
+	writeBuffer := activeDatastoreWriteBuffer
+	datastoreReferenceMutex.Unlock()
+
+	if writeBuffer == nil {
+		return datastoreUpdate(fn)
+	}
+
+	writeBuffer.write(fn)
+	return nil
+}
+
 // StoreServerEntry adds the server entry to the data store.
 //
 // When a server entry already exists for a given server, it will be
@@ -144,7 +312,17 @@ func datastoreUpdate(fn func(tx *datastoreTx) error) error {
 //
 // If the server entry data is malformed, an alert notice is issued and
 // the entry is skipped; no error is returned.
+//
+// StoreServerEntry doesn't apply the server entry store limits or the
+// server entry revocation list; see StoreServerEntries.
 func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExists bool) error {
+	return storeServerEntry(nil, serverEntryFields, replaceIfExists)
+}
+
+func storeServerEntry(
+	limits *serverEntryLimits,
+	serverEntryFields protocol.ServerEntryFields,
+	replaceIfExists bool) error {
 
 	// Server entries should already be validated before this point,
 	// so instead of skipping we fail with an error.
@@ -154,6 +332,10 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 			fmt.Errorf("invalid server entry: %s", err))
 	}
 
+	if limits != nil && !limits.checkFields(serverEntryFields) {
+		return nil
+	}
+
 	// BoltDB implementation note:
 	// For simplicity, we don't maintain indexes on server entry
 	// region or supported protocols. Instead, we perform full-bucket
@@ -164,10 +346,10 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 
 	err = datastoreUpdate(func(tx *datastoreTx) error {
 
-		serverEntries := tx.bucket(datastoreServerEntriesBucket)
-
 		ipAddress := serverEntryFields.GetIPAddress()
 
+		serverEntries := tx.bucket(getServerEntryBucket([]byte(ipAddress)))
+
 		// Check not only that the entry exists, but is valid. This
 		// will replace in the rare case where the data is corrupt.
 		existingConfigurationVersion := -1
@@ -192,6 +374,12 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 			return nil
 		}
 
+		// Only new server entries are subject to the count limits; updates
+		// to existing entries don't change the stored count.
+		if !exists && limits != nil && !limits.checkCount(serverEntryFields) {
+			return nil
+		}
+
 		data, err := json.Marshal(serverEntryFields)
 		if err != nil {
 			return common.ContextError(err)
@@ -201,6 +389,10 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 			return common.ContextError(err)
 		}
 
+		if !exists && limits != nil {
+			limits.addCount(serverEntryFields)
+		}
+
 		NoticeInfo("updated server %s", ipAddress)
 
 		return nil
@@ -212,15 +404,269 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 	return nil
 }
 
+// serverEntryLimits applies the ServerEntryMaxStoredCount,
+// ServerEntryMaxStoredCountPerSource, and
+// ServerEntryMaxMeekFrontingAddresses limits to a batch of server entries
+// being stored, preventing a malicious or buggy server entry source from
+// flooding the data store or storing degenerate server entries.
+//
+// New server entries over the count limits are rejected; existing server
+// entries are not evicted, as there's no ranking of stored server entries
+// which would indicate which entries are expendable. Existing server
+// entries may still be updated. Rejected server entries are reported, per
+// batch, in an alert notice.
+//
+// serverEntryLimits also rejects server entries revoked by the stored
+// server entry revocation list.
+type serverEntryLimits struct {
+	maxCount                 int
+	maxCountPerSource        int
+	maxMeekFrontingAddresses int
+	revoked                  map[string]int
+	count                    int
+	sourceCounts             map[string]int
+	rejectedCount            int
+	rejectedFieldsCount      int
+	rejectedRevokedCount     int
+}
+
+// newServerEntryLimits initializes a serverEntryLimits for a batch of
+// server entries. When count limits are configured, the existing stored
+// server entries are counted.
+func newServerEntryLimits(config *Config) *serverEntryLimits {
+
+	p := config.GetClientParameters()
+	limits := &serverEntryLimits{
+		maxCount:                 p.Int(parameters.ServerEntryMaxStoredCount),
+		maxCountPerSource:        p.Int(parameters.ServerEntryMaxStoredCountPerSource),
+		maxMeekFrontingAddresses: p.Int(parameters.ServerEntryMaxMeekFrontingAddresses),
+		sourceCounts:             make(map[string]int),
+	}
+	p = nil
+
+	revocationList, err := getServerEntryRevocationList()
+	if err != nil {
+		NoticeAlert("newServerEntryLimits failed: %s", err)
+	} else if revocationList != nil {
+		limits.revoked = revocationList.GetRevokedConfigurationVersions()
+	}
+
+	if limits.maxCount > 0 || limits.maxCountPerSource > 0 {
+		err := scanServerEntries(func(serverEntry *protocol.ServerEntry) {
+			limits.count += 1
+			limits.sourceCounts[serverEntry.LocalSource] += 1
+		})
+		if err != nil {
+			NoticeAlert("newServerEntryLimits failed: %s", err)
+		}
+	}
+
+	return limits
+}
+
+func (limits *serverEntryLimits) checkFields(
+	serverEntryFields protocol.ServerEntryFields) bool {
+
+	if protocol.IsRevokedServerEntry(limits.revoked, serverEntryFields) {
+		limits.rejectedRevokedCount += 1
+		return false
+	}
+
+	if limits.maxMeekFrontingAddresses > 0 &&
+		serverEntryFields.GetMeekFrontingAddressesCount() > limits.maxMeekFrontingAddresses {
+
+		limits.rejectedFieldsCount += 1
+		return false
+	}
+	return true
+}
+
+func (limits *serverEntryLimits) checkCount(
+	serverEntryFields protocol.ServerEntryFields) bool {
+
+	if (limits.maxCount > 0 && limits.count >= limits.maxCount) ||
+		(limits.maxCountPerSource > 0 &&
+			limits.sourceCounts[serverEntryFields.GetLocalSource()] >= limits.maxCountPerSource) {
+
+		limits.rejectedCount += 1
+		return false
+	}
+	return true
+}
+
+func (limits *serverEntryLimits) addCount(
+	serverEntryFields protocol.ServerEntryFields) {
+
+	limits.count += 1
+	limits.sourceCounts[serverEntryFields.GetLocalSource()] += 1
+}
+
+// noticeRejected emits an alert notice reporting any server entries
+// rejected in the batch.
+func (limits *serverEntryLimits) noticeRejected() {
+	if limits.rejectedCount > 0 {
+		NoticeAlert(
+			"rejected %d new server entries: stored server entry limit exceeded",
+			limits.rejectedCount)
+	}
+	if limits.rejectedFieldsCount > 0 {
+		NoticeAlert(
+			"rejected %d server entries: meekFrontingAddresses limit exceeded",
+			limits.rejectedFieldsCount)
+	}
+	if limits.rejectedRevokedCount > 0 {
+		NoticeAlert(
+			"rejected %d server entries: server entry revoked",
+			limits.rejectedRevokedCount)
+	}
+}
+
+// SetServerEntryRevocationList stores a new server entry revocation list,
+// which must already be authenticated, and deletes any stored server
+// entries which it revokes.
+//
+// To prevent rollback, the new list must have a higher sequence number than
+// the stored list. A list with the same sequence number as the stored list
+// is ignored, and a list with a lower sequence number is rejected with an
+// error.
+func SetServerEntryRevocationList(list *protocol.ServerEntryRevocationList) error {
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	deletedCount := 0
+
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+
+		keyValues := tx.bucket(datastoreKeyValueBucket)
+
+		existingList, err := unmarshalServerEntryRevocationList(
+			keyValues.get(datastoreServerEntryRevocationListKey))
+		if err != nil {
+			// In case of data corruption, replace the stored list.
+			NoticeAlert("SetServerEntryRevocationList: %s", err)
+			existingList = nil
+		}
+
+		if existingList != nil {
+			if list.SequenceNumber == existingList.SequenceNumber {
+				return nil
+			}
+			if list.SequenceNumber < existingList.SequenceNumber {
+				return common.ContextError(
+					fmt.Errorf(
+						"revocation list sequence number %d is lower than stored %d",
+						list.SequenceNumber, existingList.SequenceNumber))
+			}
+		}
+
+		err = keyValues.put(datastoreServerEntryRevocationListKey, data)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		affinityServerEntryID := keyValues.get(datastoreAffinityServerEntryIDKey)
+
+		revoked := list.GetRevokedConfigurationVersions()
+
+		for ipAddress := range revoked {
+
+			serverEntryID := []byte(ipAddress)
+			serverEntries := tx.bucket(getServerEntryBucket(serverEntryID))
+
+			existingData := serverEntries.get(serverEntryID)
+			if existingData == nil {
+				continue
+			}
+
+			var serverEntryFields protocol.ServerEntryFields
+			err := json.Unmarshal(existingData, &serverEntryFields)
+			if err != nil || !protocol.IsRevokedServerEntry(revoked, serverEntryFields) {
+				continue
+			}
+
+			err = serverEntries.delete(serverEntryID)
+			if err != nil {
+				return common.ContextError(err)
+			}
+
+			if bytes.Equal(affinityServerEntryID, serverEntryID) {
+				err = keyValues.delete(datastoreAffinityServerEntryIDKey)
+				if err != nil {
+					return common.ContextError(err)
+				}
+			}
+
+			deletedCount += 1
+		}
+
+		return nil
+	})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if deletedCount > 0 {
+		NoticeInfo("deleted %d revoked server entries", deletedCount)
+	}
+
+	return nil
+}
+
+// getServerEntryRevocationList returns the stored server entry revocation
+// list, or nil when no list is stored.
+func getServerEntryRevocationList() (*protocol.ServerEntryRevocationList, error) {
+
+	var list *protocol.ServerEntryRevocationList
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		var err error
+		list, err = unmarshalServerEntryRevocationList(
+			tx.bucket(datastoreKeyValueBucket).get(datastoreServerEntryRevocationListKey))
+		return err
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return list, nil
+}
+
+func unmarshalServerEntryRevocationList(
+	data []byte) (*protocol.ServerEntryRevocationList, error) {
+
+	if data == nil {
+		return nil, nil
+	}
+
+	var list *protocol.ServerEntryRevocationList
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return list, nil
+}
+
 // StoreServerEntries stores a list of server entries.
 // There is an independent transaction for each entry insert/update.
+//
+// New server entries which exceed the ServerEntryMaxStoredCount or
+// ServerEntryMaxStoredCountPerSource limits, server entries which exceed
+// the ServerEntryMaxMeekFrontingAddresses limit, and revoked server entries
+// are skipped and reported in an alert notice; no error is returned.
 func StoreServerEntries(
 	config *Config,
 	serverEntries []protocol.ServerEntryFields,
 	replaceIfExists bool) error {
 
+	limits := newServerEntryLimits(config)
+	defer limits.noticeRejected()
+
 	for _, serverEntryFields := range serverEntries {
-		err := StoreServerEntry(serverEntryFields, replaceIfExists)
+		err := storeServerEntry(limits, serverEntryFields, replaceIfExists)
 		if err != nil {
 			return common.ContextError(err)
 		}
@@ -231,6 +677,7 @@ func StoreServerEntries(
 
 // StreamingStoreServerEntries stores a list of server entries.
 // There is an independent transaction for each entry insert/update.
+// The StoreServerEntries limits are applied.
 func StreamingStoreServerEntries(
 	config *Config,
 	serverEntries *protocol.StreamingServerEntryDecoder,
@@ -241,6 +688,11 @@ func StreamingStoreServerEntries(
 	// so this isn't true constant-memory streaming (it depends on garbage
 	// collection).
 
+	defer serverEntries.Close()
+
+	limits := newServerEntryLimits(config)
+	defer limits.noticeRejected()
+
 	n := 0
 	for {
 		serverEntry, err := serverEntries.Next()
@@ -253,7 +705,7 @@ func StreamingStoreServerEntries(
 			break
 		}
 
-		err = StoreServerEntry(serverEntry, replaceIfExists)
+		err = storeServerEntry(limits, serverEntry, replaceIfExists)
 		if err != nil {
 			return common.ContextError(err)
 		}
@@ -268,16 +720,38 @@ func StreamingStoreServerEntries(
 	return nil
 }
 
+// getServerEntry returns the stored server entry with the specified IP
+// address, or nil when there is no such server entry.
+func getServerEntry(ipAddress string) (*protocol.ServerEntry, error) {
+
+	var serverEntry *protocol.ServerEntry
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		serverEntryID := []byte(ipAddress)
+		data := tx.bucket(getServerEntryBucket(serverEntryID)).get(serverEntryID)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &serverEntry)
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return serverEntry, nil
+}
+
 // PromoteServerEntry sets the server affinity server entry ID to the
-// specified server entry IP address.
+// specified server entry IP address. This is a non-critical write; see
+// datastoreNonCriticalUpdate.
 func PromoteServerEntry(config *Config, ipAddress string) error {
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreNonCriticalUpdate(func(tx *datastoreTx) error {
 
 		serverEntryID := []byte(ipAddress)
 
 		// Ensure the corresponding server entry exists before
 		// setting server affinity.
-		bucket := tx.bucket(datastoreServerEntriesBucket)
+		bucket := tx.bucket(getServerEntryBucket(serverEntryID))
 		data := bucket.get(serverEntryID)
 		if data == nil {
 			NoticeAlert(
@@ -292,6 +766,15 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 			return err
 		}
 
+		networkID := ""
+		if config.networkIDGetter != nil {
+			networkID = config.networkIDGetter.GetNetworkID()
+		}
+		err = putServerAffinityReplayState(bucket, networkID)
+		if err != nil {
+			return err
+		}
+
 		// Store the current server entry filter (e.g, region, etc.) that
 		// was in use when the entry was promoted. This is used to detect
 		// when the top ranked server entry was promoted under a different
@@ -311,6 +794,122 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 	return nil
 }
 
+// getServerAffinityState returns the current server affinity server entry
+// ID and the server entry filter that was in use when the server entry was
+// promoted. Either value is "" when not set.
+func getServerAffinityState() (string, string, error) {
+
+	var serverEntryID, filter string
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreKeyValueBucket)
+		serverEntryID = string(bucket.get(datastoreAffinityServerEntryIDKey))
+		filter = string(bucket.get(datastoreLastServerEntryFilterKey))
+		return nil
+	})
+
+	if err != nil {
+		return "", "", common.ContextError(err)
+	}
+	return serverEntryID, filter, nil
+}
+
+// setServerAffinityState sets the server affinity server entry ID and
+// server entry filter. Unlike PromoteServerEntry, an error is returned when
+// the corresponding server entry does not exist.
+func setServerAffinityState(serverEntryID, filter string) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+
+		bucket := tx.bucket(getServerEntryBucket([]byte(serverEntryID)))
+		if bucket.get([]byte(serverEntryID)) == nil {
+			return errors.New("unknown server entry")
+		}
+
+		bucket = tx.bucket(datastoreKeyValueBucket)
+		err := bucket.put(datastoreAffinityServerEntryIDKey, []byte(serverEntryID))
+		if err != nil {
+			return err
+		}
+
+		// The network is not known, so the server affinity isn't limited to
+		// a network.
+		err = putServerAffinityReplayState(bucket, "")
+		if err != nil {
+			return err
+		}
+
+		return bucket.put(datastoreLastServerEntryFilterKey, []byte(filter))
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// putServerAffinityReplayState records the time the server affinity server
+// entry was promoted, and the network ID of the network it was promoted on,
+// which are checked by isServerAffinityExpired. When networkID is "", the
+// server affinity applies on any network.
+func putServerAffinityReplayState(bucket *datastoreBucket, networkID string) error {
+
+	err := bucket.put(
+		datastoreAffinityPromotedTimeKey,
+		[]byte(time.Now().UTC().Format(time.RFC3339)))
+	if err != nil {
+		return err
+	}
+
+	return bucket.put(datastoreAffinityNetworkIDKey, []byte(networkID))
+}
+
+// isServerAffinityExpired indicates whether the server affinity server entry
+// should no longer be replayed: when it was promoted more than
+// ServerAffinityMaxAge ago, or on a different network than the current
+// network. Server affinity promoted before the promotion time was recorded
+// is expired.
+func isServerAffinityExpired(config *Config) (bool, error) {
+
+	maxAge := config.GetClientParameters().Duration(parameters.ServerAffinityMaxAge)
+
+	currentNetworkID := ""
+	if config.networkIDGetter != nil {
+		currentNetworkID = config.networkIDGetter.GetNetworkID()
+	}
+
+	expired := false
+	err := datastoreView(func(tx *datastoreTx) error {
+
+		bucket := tx.bucket(datastoreKeyValueBucket)
+
+		if bucket.get(datastoreAffinityServerEntryIDKey) == nil {
+			return nil
+		}
+
+		if maxAge > 0 {
+			promotedTime, err := time.Parse(
+				time.RFC3339, string(bucket.get(datastoreAffinityPromotedTimeKey)))
+			if err != nil || time.Since(promotedTime) > maxAge {
+				expired = true
+				return nil
+			}
+		}
+
+		networkID := string(bucket.get(datastoreAffinityNetworkIDKey))
+		if networkID != "" && networkID != currentNetworkID {
+			expired = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return false, common.ContextError(err)
+	}
+
+	return expired, nil
+}
+
 func makeServerEntryFilterValue(config *Config) ([]byte, error) {
 
 	// Currently, only a change of EgressRegion will "break" server affinity.
@@ -354,10 +953,14 @@ type ServerEntryIterator struct {
 	applyServerAffinity          bool
 	serverEntryIDs               [][]byte
 	serverEntryIndex             int
+	affinityServerEntryID        []byte
+	pendingServerEntryBuckets    [][]byte
 	isTacticsServerEntryIterator bool
 	isTargetServerEntryIterator  bool
 	hasNextTargetServerEntry     bool
 	targetServerEntry            *protocol.ServerEntry
+	serverScores                 *serverScores
+	serverScoreWeights           map[string]float64
 }
 
 // NewServerEntryIterator creates a new ServerEntryIterator.
@@ -366,13 +969,14 @@ type ServerEntryIterator struct {
 // as affinity servers or not. When the server entry selection filter changes
 // such as from a specific region to any region, or when there was no previous
 // filter/iterator, the the first server(s) are arbitrary and should not be
-// given affinity treatment.
+// given affinity treatment. When ignoreServerAffinity is set, no server is
+// given affinity treatment and all servers are shuffled.
 //
 // NewServerEntryIterator and any returned ServerEntryIterator are not
 // designed for concurrent use as not all related datastore operations are
 // performed in a single transaction.
-//
-func NewServerEntryIterator(config *Config) (bool, *ServerEntryIterator, error) {
+func NewServerEntryIterator(
+	config *Config, ignoreServerAffinity bool) (bool, *ServerEntryIterator, error) {
 
 	// When configured, this target server entry is the only candidate
 	if config.TargetServerEntry != "" {
@@ -384,11 +988,23 @@ func NewServerEntryIterator(config *Config) (bool, *ServerEntryIterator, error)
 		return false, nil, common.ContextError(err)
 	}
 
-	applyServerAffinity := !filterChanged
+	affinityExpired := false
+	if !filterChanged && !ignoreServerAffinity {
+		affinityExpired, err = isServerAffinityExpired(config)
+		if err != nil {
+			return false, nil, common.ContextError(err)
+		}
+		if affinityExpired {
+			NoticeInfo("server affinity expired")
+		}
+	}
+
+	applyServerAffinity := !filterChanged && !ignoreServerAffinity && !affinityExpired
 
 	iterator := &ServerEntryIterator{
 		config:              config,
 		applyServerAffinity: applyServerAffinity,
+		serverScores:        newServerScores(config),
 	}
 
 	err = iterator.Reset()
@@ -486,48 +1102,97 @@ func (iterator *ServerEntryIterator) Reset() error {
 	//
 	// So the underlying serverEntriesBucket could change after the serverEntryIDs
 	// list is built.
+	//
+	// When server entries are sharded, the shards are visited in a random
+	// order and each shard's server entry IDs are loaded only once the
+	// previous shard is exhausted. This bounds the startup cost of selecting
+	// the first candidates from a very large server list to loading a
+	// single shard.
 
-	var serverEntryIDs [][]byte
-
-	err := datastoreView(func(tx *datastoreTx) error {
+	var affinityServerEntryID []byte
 
-		bucket := tx.bucket(datastoreKeyValueBucket)
+	if iterator.applyServerAffinity {
+		err := datastoreView(func(tx *datastoreTx) error {
+			value := tx.bucket(datastoreKeyValueBucket).get(datastoreAffinityServerEntryIDKey)
+			if value != nil {
+				affinityServerEntryID = append([]byte(nil), value...)
+			}
+			return nil
+		})
+		if err != nil {
+			return common.ContextError(err)
+		}
+	}
 
-		serverEntryIDs = make([][]byte, 0)
-		shuffleHead := 0
+	// When server scoring is enabled, the server score weights are loaded
+	// once per cycle and applied to each shard as it's loaded.
 
-		var affinityServerEntryID []byte
-		if iterator.applyServerAffinity {
-			affinityServerEntryID = bucket.get(datastoreAffinityServerEntryIDKey)
-			if affinityServerEntryID != nil {
-				serverEntryIDs = append(serverEntryIDs, append([]byte(nil), affinityServerEntryID...))
-				shuffleHead = 1
-			}
+	if iterator.serverScores != nil {
+		weights, err := iterator.serverScores.loadWeights()
+		if err != nil {
+			NoticeAlert("load server score weights failed: %s", err)
 		}
+		iterator.serverScoreWeights = weights
+	}
+
+	buckets := append([][]byte(nil), getServerEntryBuckets()...)
+	rand.Shuffle(len(buckets), func(i, j int) {
+		buckets[i], buckets[j] = buckets[j], buckets[i]
+	})
+
+	iterator.affinityServerEntryID = affinityServerEntryID
+	iterator.pendingServerEntryBuckets = buckets
+
+	err := iterator.loadNextServerEntryBucket()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if affinityServerEntryID != nil {
+		iterator.serverEntryIDs = append(
+			[][]byte{affinityServerEntryID}, iterator.serverEntryIDs...)
+	}
+
+	return nil
+}
 
-		bucket = tx.bucket(datastoreServerEntriesBucket)
+// loadNextServerEntryBucket replaces the iterator's list of server entry IDs
+// with the shuffled IDs stored in the next pending server entry bucket.
+// When server score weights are loaded, the shuffle is weighted.
+func (iterator *ServerEntryIterator) loadNextServerEntryBucket() error {
+
+	bucketName := iterator.pendingServerEntryBuckets[0]
+	iterator.pendingServerEntryBuckets = iterator.pendingServerEntryBuckets[1:]
+
+	serverEntryIDs := make([][]byte, 0)
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(bucketName)
 		cursor := bucket.cursor()
 		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
-			if affinityServerEntryID != nil {
-				if bytes.Equal(affinityServerEntryID, key) {
+			if iterator.affinityServerEntryID != nil {
+				if bytes.Equal(iterator.affinityServerEntryID, key) {
 					continue
 				}
 			}
 			serverEntryIDs = append(serverEntryIDs, append([]byte(nil), key...))
 		}
 		cursor.close()
-
-		for i := len(serverEntryIDs) - 1; i > shuffleHead-1; i-- {
-			j := rand.Intn(i+1-shuffleHead) + shuffleHead
-			serverEntryIDs[i], serverEntryIDs[j] = serverEntryIDs[j], serverEntryIDs[i]
-		}
-
 		return nil
 	})
 	if err != nil {
 		return common.ContextError(err)
 	}
 
+	if iterator.serverScoreWeights != nil {
+		iterator.serverScores.weightedShuffle(serverEntryIDs, iterator.serverScoreWeights)
+	} else {
+		for i := len(serverEntryIDs) - 1; i > 0; i-- {
+			j := rand.Intn(i + 1)
+			serverEntryIDs[i], serverEntryIDs[j] = serverEntryIDs[j], serverEntryIDs[i]
+		}
+	}
+
 	iterator.serverEntryIDs = serverEntryIDs
 	iterator.serverEntryIndex = 0
 
@@ -538,6 +1203,9 @@ func (iterator *ServerEntryIterator) Reset() error {
 func (iterator *ServerEntryIterator) Close() {
 	iterator.serverEntryIDs = nil
 	iterator.serverEntryIndex = 0
+	iterator.affinityServerEntryID = nil
+	iterator.pendingServerEntryBuckets = nil
+	iterator.serverScoreWeights = nil
 }
 
 // Next returns the next server entry, by rank, for a ServerEntryIterator.
@@ -566,8 +1234,15 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 	// filter requirements.
 	for {
 		if iterator.serverEntryIndex >= len(iterator.serverEntryIDs) {
-			// There is no next item
-			return nil, nil
+			if len(iterator.pendingServerEntryBuckets) == 0 {
+				// There is no next item
+				return nil, nil
+			}
+			err = iterator.loadNextServerEntryBucket()
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			continue
 		}
 
 		serverEntryID := iterator.serverEntryIDs[iterator.serverEntryIndex]
@@ -576,7 +1251,7 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 		var data []byte
 
 		err = datastoreView(func(tx *datastoreTx) error {
-			bucket := tx.bucket(datastoreServerEntriesBucket)
+			bucket := tx.bucket(getServerEntryBucket(serverEntryID))
 			value := bucket.get(serverEntryID)
 			if value != nil {
 				// Must make a copy as slice is only valid within transaction.
@@ -642,32 +1317,77 @@ func MakeCompatibleServerEntry(serverEntry *protocol.ServerEntry) *protocol.Serv
 	return serverEntry
 }
 
+// scanServerEntries invokes scanner for each stored server entry. When
+// server entries are sharded, the shards are scanned, and server entries
+// decoded, in parallel on multi-core devices. Calls to scanner are
+// serialized.
 func scanServerEntries(scanner func(*protocol.ServerEntry)) error {
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreServerEntriesBucket)
-		cursor := bucket.cursor()
-		n := 0
-		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
-			var serverEntry *protocol.ServerEntry
-			err := json.Unmarshal(value, &serverEntry)
-			if err != nil {
-				// In case of data corruption or a bug causing this condition,
-				// do not stop iterating.
-				NoticeAlert("scanServerEntries: %s", common.ContextError(err))
-				continue
+
+	startTime := monotime.Now()
+
+	datastoreReferenceMutex.Lock()
+	clientParameters := activeDatastoreClientParameters
+	datastoreReferenceMutex.Unlock()
+
+	defer noticeSlowOperation(
+		clientParameters, parameters.SlowDatastoreScanThreshold, "datastore_scan", startTime)
+
+	var mutex sync.Mutex
+	n := 0
+
+	scanBucket := func(bucketName []byte) error {
+		return datastoreView(func(tx *datastoreTx) error {
+			bucket := tx.bucket(bucketName)
+			cursor := bucket.cursor()
+			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+				var serverEntry *protocol.ServerEntry
+				err := json.Unmarshal(value, &serverEntry)
+				if err != nil {
+					// In case of data corruption or a bug causing this condition,
+					// do not stop iterating.
+					NoticeAlert("scanServerEntries: %s", common.ContextError(err))
+					continue
+				}
+
+				mutex.Lock()
+				scanner(serverEntry)
+				n += 1
+				if n == datastoreServerEntryFetchGCThreshold {
+					DoGarbageCollection()
+					n = 0
+				}
+				mutex.Unlock()
 			}
-			scanner(serverEntry)
+			cursor.close()
+			return nil
+		})
+	}
 
-			n += 1
-			if n == datastoreServerEntryFetchGCThreshold {
-				DoGarbageCollection()
-				n = 0
+	// Limit the number of concurrent shard scans to the number of CPUs, as
+	// scanning is CPU bound.
+
+	buckets := getServerEntryBuckets()
+
+	bucketNames := make(chan []byte, len(buckets))
+	for _, bucketName := range buckets {
+		bucketNames <- bucketName
+	}
+	close(bucketNames)
+
+	var scanGroup errgroup.Group
+	for i := 0; i < runtime.NumCPU() && i < len(buckets); i++ {
+		scanGroup.Go(func() error {
+			for bucketName := range bucketNames {
+				err := scanBucket(bucketName)
+				if err != nil {
+					return err
+				}
 			}
-		}
-		cursor.close()
-		return nil
-	})
+			return nil
+		})
+	}
 
+	err := scanGroup.Wait()
 	if err != nil {
 		return common.ContextError(err)
 	}
@@ -901,11 +1621,13 @@ var persistentStatStateReporting = []byte("1")
 
 var persistentStatTypes = []string{
 	datastorePersistentStatTypeRemoteServerList,
+	datastorePersistentStatTypeFailedTunnel,
 }
 
 // StorePersistentStat adds a new persistent stat record, which
 // is set to StateUnreported and is an immediate candidate for
-// reporting.
+// reporting. This is a non-critical write; see
+// datastoreNonCriticalUpdate.
 //
 // The stat is a JSON byte array containing fields as
 // required by the Psiphon server API. It's assumed that the
@@ -913,14 +1635,36 @@ var persistentStatTypes = []string{
 // function as a key in the key/value datastore. This assumption
 // is currently satisfied by the fields sessionId + tunnelNumber
 // for tunnel stats, and URL + ETag for remote server list stats.
+// Failed tunnel stats, which are recorded with storePersistentStat,
+// aren't necessarily unique, and a stat identical to an existing
+// record is stored once.
 func StorePersistentStat(statType string, stat []byte) error {
+	return storePersistentStat(statType, stat, 0)
+}
+
+// storePersistentStat is StorePersistentStat with a cap, maxCount, on
+// the number of stored records of statType. When the cap is reached, the
+// new stat is not stored; records are removed once reported. 0 is no
+// limit.
+func storePersistentStat(statType string, stat []byte, maxCount int) error {
 
 	if !common.Contains(persistentStatTypes, statType) {
 		return common.ContextError(fmt.Errorf("invalid persistent stat type: %s", statType))
 	}
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreNonCriticalUpdate(func(tx *datastoreTx) error {
 		bucket := tx.bucket([]byte(statType))
+		if maxCount > 0 {
+			count := 0
+			cursor := bucket.cursor()
+			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+				count++
+			}
+			cursor.close()
+			if count >= maxCount {
+				return nil
+			}
+		}
 		err := bucket.put(stat, persistentStatStateUnreported)
 		return err
 	})
@@ -1212,18 +1956,118 @@ func (t *TacticsStorer) GetTacticsRecord(networkID string) ([]byte, error) {
 }
 
 func (t *TacticsStorer) SetSpeedTestSamplesRecord(networkID string, record []byte) error {
-	return setBucketValue(datastoreSpeedTestSamplesBucket, []byte(networkID), record)
+	return setNonCriticalBucketValue(datastoreSpeedTestSamplesBucket, []byte(networkID), record)
 }
 
 func (t *TacticsStorer) GetSpeedTestSamplesRecord(networkID string) ([]byte, error) {
 	return getBucketValue(datastoreSpeedTestSamplesBucket, []byte(networkID))
 }
 
+func (t *TacticsStorer) SetSignedTacticsVersionRecord(record []byte) error {
+	return setBucketValue(datastoreKeyValueBucket, datastoreSignedTacticsVersionKey, record)
+}
+
+func (t *TacticsStorer) GetSignedTacticsVersionRecord() ([]byte, error) {
+	return getBucketValue(datastoreKeyValueBucket, datastoreSignedTacticsVersionKey)
+}
+
 // GetTacticsStorer creates a TacticsStorer.
 func GetTacticsStorer() *TacticsStorer {
 	return &TacticsStorer{}
 }
 
+// setLastKnownRegionRecord stores the last known client region record.
+func setLastKnownRegionRecord(record []byte) error {
+	return setNonCriticalBucketValue(datastoreKeyValueBucket, datastoreLastKnownRegionKey, record)
+}
+
+// getLastKnownRegionRecord returns the last known client region record, or
+// nil when there is no record.
+func getLastKnownRegionRecord() ([]byte, error) {
+	return getBucketValue(datastoreKeyValueBucket, datastoreLastKnownRegionKey)
+}
+
+// setProtocolHealthRecord stores the protocol health record for the
+// specified network ID.
+func setProtocolHealthRecord(networkID string, record []byte) error {
+	return setNonCriticalBucketValue(datastoreProtocolHealthBucket, []byte(networkID), record)
+}
+
+// getProtocolHealthRecord returns the protocol health record for the
+// specified network ID, or nil when there is no record.
+func getProtocolHealthRecord(networkID string) ([]byte, error) {
+	return getBucketValue(datastoreProtocolHealthBucket, []byte(networkID))
+}
+
+// setIPAddressFamilyRecord stores the IP address family dial outcome record
+// for the specified network ID.
+func setIPAddressFamilyRecord(networkID string, record []byte) error {
+	return setNonCriticalBucketValue(datastoreIPAddressFamilyBucket, []byte(networkID), record)
+}
+
+// getIPAddressFamilyRecord returns the IP address family dial outcome record
+// for the specified network ID, or nil when there is no record.
+func getIPAddressFamilyRecord(networkID string) ([]byte, error) {
+	return getBucketValue(datastoreIPAddressFamilyBucket, []byte(networkID))
+}
+
+// setServerScoreRecord stores the server selection score record for the
+// specified server entry ID.
+func setServerScoreRecord(serverEntryID string, record []byte) error {
+	return setNonCriticalBucketValue(datastoreServerScoresBucket, []byte(serverEntryID), record)
+}
+
+// getServerScoreRecord returns the server selection score record for the
+// specified server entry ID, or nil when there is no record.
+func getServerScoreRecord(serverEntryID string) ([]byte, error) {
+	return getBucketValue(datastoreServerScoresBucket, []byte(serverEntryID))
+}
+
+// getServerScoreRecords returns all server selection score records, keyed
+// by server entry ID.
+func getServerScoreRecords() (map[string][]byte, error) {
+
+	records := make(map[string][]byte)
+
+	err := datastoreView(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerScoresBucket)
+		cursor := bucket.cursor()
+		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			records[string(key)] = append([]byte(nil), value...)
+		}
+		cursor.close()
+		return nil
+	})
+
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return records, nil
+}
+
+// deleteServerScoreRecords deletes the server selection score records for
+// the specified server entry IDs.
+func deleteServerScoreRecords(serverEntryIDs []string) error {
+
+	err := datastoreUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(datastoreServerScoresBucket)
+		for _, serverEntryID := range serverEntryIDs {
+			err := bucket.delete([]byte(serverEntryID))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 func setBucketValue(bucket, key, value []byte) error {
 
 	err := datastoreUpdate(func(tx *datastoreTx) error {
@@ -1239,6 +2083,23 @@ func setBucketValue(bucket, key, value []byte) error {
 	return nil
 }
 
+// setNonCriticalBucketValue is setBucketValue for non-critical values; see
+// datastoreNonCriticalUpdate.
+func setNonCriticalBucketValue(bucket, key, value []byte) error {
+
+	err := datastoreNonCriticalUpdate(func(tx *datastoreTx) error {
+		bucket := tx.bucket(bucket)
+		err := bucket.put(key, value)
+		return err
+	})
+
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 func getBucketValue(bucket, key []byte) ([]byte, error) {
 
 	var value []byte
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	DATA_STORE_WRITE_BUFFER_SIZE         = 100
+	DATA_STORE_WRITE_RETRY_PERIOD        = 30 * time.Second
+	DATA_STORE_WRITE_MAX_ATTEMPTS        = 10
+	DATA_STORE_WRITE_DROPPED_NOTICE_SPAN = 100
+)
+
+// datastoreWriteBuffer buffers failed non-critical datastore writes in
+// memory and retries them, so transient storage failures, such as when
+// encrypted storage is locked or the disk is full on a mobile device, don't
+// fail tunnel establishment or API requests.
+//
+// Buffered writes are retried, in order, before each subsequent
+// non-critical write and every DATA_STORE_WRITE_RETRY_PERIOD. Each buffered
+// write is retried independently, so a write which fails for reasons other
+// than storage availability doesn't block other writes; such a write is
+// dropped after DATA_STORE_WRITE_MAX_ATTEMPTS. When the buffer is full, new
+// failed writes are dropped. Dropped writes are counted and reported in
+// alert notices.
+type datastoreWriteBuffer struct {
+	maxSize    int
+	mutex      sync.Mutex
+	writes     []*datastoreWrite
+	retryTimer *time.Timer
+	dropped    int
+	closed     bool
+
+	// update is datastoreUpdate, and is overridden by tests.
+	update func(fn func(tx *datastoreTx) error) error
+}
+
+type datastoreWrite struct {
+	fn       func(tx *datastoreTx) error
+	attempts int
+}
+
+// newDatastoreWriteBuffer creates a datastoreWriteBuffer according to
+// Config.DataStoreWriteBufferSize. nil is returned when buffering is
+// disabled.
+func newDatastoreWriteBuffer(config *Config) *datastoreWriteBuffer {
+
+	maxSize := DATA_STORE_WRITE_BUFFER_SIZE
+	if config.DataStoreWriteBufferSize != nil {
+		maxSize = *config.DataStoreWriteBufferSize
+	}
+
+	if maxSize <= 0 {
+		return nil
+	}
+
+	return &datastoreWriteBuffer{
+		maxSize: maxSize,
+		update:  datastoreUpdate,
+	}
+}
+
+// write retries any buffered writes and then performs the write fn,
+// buffering fn when it fails.
+func (buffer *datastoreWriteBuffer) write(fn func(tx *datastoreTx) error) {
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.retry()
+
+	// When writes are already buffered, it's likely that storage remains
+	// unavailable, and fn is buffered without an immediate attempt, which
+	// also preserves the write order.
+
+	if len(buffer.writes) == 0 {
+		err := buffer.update(fn)
+		if err == nil {
+			return
+		}
+		NoticeAlert("buffering failed datastore write: %s", common.ContextError(err))
+	}
+
+	buffer.add(&datastoreWrite{fn: fn, attempts: 1})
+}
+
+// close makes a final attempt to complete any buffered writes and stops
+// retrying. close may be called on a nil buffer.
+func (buffer *datastoreWriteBuffer) close() {
+
+	if buffer == nil {
+		return
+	}
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.retry()
+
+	if len(buffer.writes) > 0 {
+		buffer.drop(len(buffer.writes))
+		buffer.writes = nil
+	}
+
+	if buffer.retryTimer != nil {
+		buffer.retryTimer.Stop()
+		buffer.retryTimer = nil
+	}
+
+	buffer.closed = true
+}
+
+func (buffer *datastoreWriteBuffer) timerRetry() {
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.retryTimer = nil
+
+	if buffer.closed {
+		return
+	}
+
+	buffer.retry()
+	buffer.scheduleRetry()
+}
+
+// retry attempts each buffered write. The caller must lock the mutex.
+func (buffer *datastoreWriteBuffer) retry() {
+
+	var remaining []*datastoreWrite
+
+	for _, write := range buffer.writes {
+		err := buffer.update(write.fn)
+		if err == nil {
+			continue
+		}
+		write.attempts++
+		if write.attempts >= DATA_STORE_WRITE_MAX_ATTEMPTS {
+			buffer.drop(1)
+			continue
+		}
+		remaining = append(remaining, write)
+	}
+
+	if len(buffer.writes) > 0 && len(remaining) == 0 {
+		NoticeInfo("completed buffered datastore writes")
+	}
+
+	buffer.writes = remaining
+}
+
+// add buffers a failed write, or drops it when the buffer is full. The
+// caller must lock the mutex.
+func (buffer *datastoreWriteBuffer) add(write *datastoreWrite) {
+
+	if len(buffer.writes) >= buffer.maxSize {
+		buffer.drop(1)
+		return
+	}
+
+	buffer.writes = append(buffer.writes, write)
+	buffer.scheduleRetry()
+}
+
+// drop counts dropped writes, emitting an alert notice for the first drop
+// and for every DATA_STORE_WRITE_DROPPED_NOTICE_SPAN subsequent drops. The
+// caller must lock the mutex.
+func (buffer *datastoreWriteBuffer) drop(count int) {
+
+	for i := 0; i < count; i++ {
+		buffer.dropped++
+		if buffer.dropped%DATA_STORE_WRITE_DROPPED_NOTICE_SPAN == 1 {
+			NoticeAlert("dropped failed datastore writes: %d", buffer.dropped)
+		}
+	}
+}
+
+// scheduleRetry starts the retry timer, if not started, when writes are
+// buffered. The caller must lock the mutex.
+func (buffer *datastoreWriteBuffer) scheduleRetry() {
+
+	if buffer.retryTimer == nil && len(buffer.writes) > 0 && !buffer.closed {
+		buffer.retryTimer = time.AfterFunc(
+			DATA_STORE_WRITE_RETRY_PERIOD, buffer.timerRetry)
+	}
+}
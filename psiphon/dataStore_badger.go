@@ -31,7 +31,8 @@ import (
 )
 
 const (
-	DATA_STORE_DIRECTORY = "psiphon.badgerdb"
+	DATA_STORE_DIRECTORY      = "psiphon.badgerdb"
+	DATA_STORE_IMPLEMENTATION = "badger"
 )
 
 type datastoreDB struct {
@@ -52,7 +53,8 @@ type datastoreCursor struct {
 	prefix         []byte
 }
 
-func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
+func datastoreOpenDB(
+	rootDataDirectory string, _ bool) (*datastoreDB, error) {
 
 	dbDirectory := filepath.Join(rootDataDirectory, "psiphon.badgerdb")
 
@@ -22,6 +22,7 @@
 package psiphon
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -30,6 +31,10 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 )
 
+const (
+	DATA_STORE_IMPLEMENTATION = "bolt"
+)
+
 type datastoreDB struct {
 	boltDB *bolt.DB
 }
@@ -46,7 +51,8 @@ type datastoreCursor struct {
 	boltCursor *bolt.Cursor
 }
 
-func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
+func datastoreOpenDB(
+	rootDataDirectory string, backupCorruptDataStore bool) (*datastoreDB, error) {
 
 	filename := filepath.Join(rootDataDirectory, "psiphon.boltdb")
 
@@ -59,26 +65,21 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 			NoticeAlert("datastoreOpenDB retry: %d", retry)
 		}
 
-		newDB, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+		newDB, err = tryDatastoreOpenDB(filename)
 
-		// The datastore file may be corrupt, so attempt to delete and try again
-		if err != nil {
-			NoticeAlert("bolt.Open error: %s", err)
-			os.Remove(filename)
-			continue
+		// A timeout indicates that the datastore file is locked by another
+		// process, and is not a sign of corruption.
+		if err == bolt.ErrTimeout {
+			break
 		}
 
-		// Run consistency checks on datastore and emit errors for diagnostics purposes
-		// We assume this will complete quickly for typical size Psiphon datastores.
-		err = newDB.View(func(tx *bolt.Tx) error {
-			return tx.SynchronousCheck()
-		})
-
-		// The datastore file may be corrupt, so attempt to delete and try again
+		// The datastore file may be corrupt, so discard it and try again with
+		// a new datastore file. Any server entries in the embedded server
+		// list are restored when the embedded server list is next imported,
+		// which clients do each time the datastore is opened.
 		if err != nil {
-			NoticeAlert("bolt.SynchronousCheck error: %s", err)
-			newDB.Close()
-			os.Remove(filename)
+			NoticeAlert("tryDatastoreOpenDB error: %s", err)
+			recoverCorruptDatastoreFile(filename, backupCorruptDataStore, err)
 			continue
 		}
 
@@ -89,6 +90,48 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 		return nil, common.ContextError(err)
 	}
 
+	return &datastoreDB{boltDB: newDB}, nil
+}
+
+// tryDatastoreOpenDB opens and checks the datastore file and initializes
+// the datastore buckets. bolt may panic when accessing a corrupt datastore
+// file, so any panic is recovered and returned as an error.
+func tryDatastoreOpenDB(filename string) (retDB *bolt.DB, retErr error) {
+
+	var newDB *bolt.DB
+
+	defer func() {
+		if r := recover(); r != nil {
+			if newDB != nil {
+				// Close releases the file lock; it may also panic.
+				func() {
+					defer func() { _ = recover() }()
+					newDB.Close()
+				}()
+			}
+			retDB = nil
+			retErr = common.ContextError(fmt.Errorf("panic: %v", r))
+		}
+	}()
+
+	newDB, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, err
+		}
+		return nil, common.ContextError(err)
+	}
+
+	// Run consistency checks on datastore and emit errors for diagnostics purposes
+	// We assume this will complete quickly for typical size Psiphon datastores.
+	err = newDB.View(func(tx *bolt.Tx) error {
+		return tx.SynchronousCheck()
+	})
+	if err != nil {
+		newDB.Close()
+		return nil, common.ContextError(err)
+	}
+
 	err = newDB.Update(func(tx *bolt.Tx) error {
 		requiredBuckets := [][]byte{
 			datastoreServerEntriesBucket,
@@ -97,10 +140,15 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 			datastoreUrlETagsBucket,
 			datastoreKeyValueBucket,
 			datastoreRemoteServerListStatsBucket,
+			datastoreFailedTunnelStatsBucket,
 			datastoreSLOKsBucket,
 			datastoreTacticsBucket,
 			datastoreSpeedTestSamplesBucket,
+			datastoreProtocolHealthBucket,
+			datastoreIPAddressFamilyBucket,
+			datastoreServerScoresBucket,
 		}
+		requiredBuckets = append(requiredBuckets, datastoreServerEntryShardBuckets...)
 		for _, bucket := range requiredBuckets {
 			_, err := tx.CreateBucketIfNotExists(bucket)
 			if err != nil {
@@ -110,6 +158,7 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 		return nil
 	})
 	if err != nil {
+		newDB.Close()
 		return nil, common.ContextError(err)
 	}
 
@@ -132,10 +181,39 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 		return nil
 	})
 	if err != nil {
+		newDB.Close()
 		return nil, common.ContextError(err)
 	}
 
-	return &datastoreDB{boltDB: newDB}, nil
+	return newDB, nil
+}
+
+// recoverCorruptDatastoreFile discards a corrupt datastore file, so that a
+// new datastore file may be created. When backupCorruptDataStore is set,
+// the corrupt file is retained, replacing any previous backup, for
+// diagnostics.
+func recoverCorruptDatastoreFile(
+	filename string, backupCorruptDataStore bool, corruptErr error) {
+
+	backupFilename := ""
+
+	if backupCorruptDataStore {
+		backupFilename = filename + ".corrupt"
+		err := os.Rename(filename, backupFilename)
+		if err != nil && !os.IsNotExist(err) {
+			NoticeAlert("backup corrupt datastore failed: %s", common.ContextError(err))
+			backupFilename = ""
+		}
+	}
+
+	if backupFilename == "" {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			NoticeAlert("remove corrupt datastore failed: %s", common.ContextError(err))
+		}
+	}
+
+	NoticeDataStoreRecovered(corruptErr, backupFilename)
 }
 
 func (db *datastoreDB) close() error {
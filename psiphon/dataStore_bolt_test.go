@@ -0,0 +1,115 @@
+// +build !BADGER_DB,!FILES_DB
+
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDatastoreCorruptionRecovery(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	filename := filepath.Join(testDataDirName, "psiphon.boltdb")
+	backupFilename := filename + ".corrupt"
+
+	config := &Config{
+		DataStoreDirectory:     testDataDirName,
+		BackupCorruptDataStore: true,
+	}
+
+	openDataStore := func() {
+		err := OpenDataStore(config)
+		if err != nil {
+			t.Fatalf("OpenDataStore failed: %s", err)
+		}
+	}
+
+	// Populate a datastore, then overwrite its pages beyond the meta pages,
+	// as may happen with an unclean shutdown.
+
+	openDataStore()
+	populateTestServerEntries(t, 100)
+	CloseDataStore()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	pageSize := os.Getpagesize()
+	if len(data) <= 2*pageSize {
+		t.Fatalf("unexpected datastore size: %d", len(data))
+	}
+	copy(data[2*pageSize:], bytes.Repeat([]byte{0xff}, len(data)-2*pageSize))
+	err = ioutil.WriteFile(filename, data, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	// The corrupt datastore is replaced with a new, empty datastore, and the
+	// corrupt file is retained.
+
+	openDataStore()
+	if count := CountServerEntries(); count != 0 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+	populateTestServerEntries(t, 10)
+	CloseDataStore()
+
+	backupData, err := ioutil.ReadFile(backupFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(data, backupData) {
+		t.Fatalf("unexpected backup contents")
+	}
+
+	// A file which isn't a datastore file is also replaced.
+
+	err = ioutil.WriteFile(filename, []byte("not a datastore"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	config.BackupCorruptDataStore = false
+
+	openDataStore()
+	if count := CountServerEntries(); count != 0 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+	CloseDataStore()
+
+	// Without BackupCorruptDataStore, the previous backup is left as-is.
+
+	backupData, err = ioutil.ReadFile(backupFilename)
+	if err != nil || !bytes.Equal(data, backupData) {
+		t.Fatalf("unexpected backup contents: %v", err)
+	}
+}
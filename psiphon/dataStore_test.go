@@ -0,0 +1,542 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestServerEntryShardMigration(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	serverEntryCount := 2500
+
+	openDataStore := func(shardServerEntries bool) {
+		err := OpenDataStore(&Config{
+			DataStoreDirectory:          testDataDirName,
+			DataStoreShardServerEntries: shardServerEntries,
+		})
+		if err != nil {
+			t.Fatalf("OpenDataStore failed: %s", err)
+		}
+	}
+
+	checkServerEntries := func() {
+		count := CountServerEntries()
+		if count != serverEntryCount {
+			t.Fatalf("unexpected server entry count: %d", count)
+		}
+		for _, i := range []int{0, serverEntryCount / 2, serverEntryCount - 1} {
+			ipAddress := testServerEntryIPAddress(i)
+			err := setServerAffinityState(ipAddress, "")
+			if err != nil {
+				t.Fatalf("setServerAffinityState failed: %s", err)
+			}
+			serverEntryID, _, err := getServerAffinityState()
+			if err != nil || serverEntryID != ipAddress {
+				t.Fatalf("missing server entry: %s", ipAddress)
+			}
+		}
+	}
+
+	// Store unsharded, then migrate to sharded and back.
+
+	openDataStore(false)
+	populateTestServerEntries(t, serverEntryCount)
+	checkServerEntries()
+	CloseDataStore()
+
+	openDataStore(true)
+	checkServerEntries()
+	for _, bucket := range getServerEntryBuckets() {
+		if bucketCount := countBucketKeys(t, bucket); bucketCount == 0 {
+			t.Fatalf("unexpected empty shard: %s", bucket)
+		}
+	}
+	if countBucketKeys(t, datastoreServerEntriesBucket) != 0 {
+		t.Fatalf("unexpected unsharded server entries")
+	}
+	CloseDataStore()
+
+	openDataStore(false)
+	checkServerEntries()
+	for _, bucket := range datastoreServerEntryShardBuckets {
+		if countBucketKeys(t, bucket) != 0 {
+			t.Fatalf("unexpected sharded server entries: %s", bucket)
+		}
+	}
+	CloseDataStore()
+}
+
+func TestServerEntryStoreLimits(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-limits-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	config, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataStoreDirectory = testDataDirName
+
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	applyParameters := map[string]interface{}{
+		parameters.ServerEntryMaxStoredCount:           5,
+		parameters.ServerEntryMaxStoredCountPerSource:  3,
+		parameters.ServerEntryMaxMeekFrontingAddresses: 2,
+	}
+
+	err = config.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	makeServerEntries := func(
+		first, count int, source string) []protocol.ServerEntryFields {
+
+		serverEntries := make([]protocol.ServerEntryFields, count)
+		for i := 0; i < count; i++ {
+			serverEntries[i] = protocol.ServerEntryFields{
+				"ipAddress":    testServerEntryIPAddress(first + i),
+				"sshPort":      22.0,
+				"capabilities": []interface{}{"SSH"},
+				"localSource":  source,
+			}
+		}
+		return serverEntries
+	}
+
+	storeServerEntries := func(serverEntries []protocol.ServerEntryFields) {
+		err := StoreServerEntries(config, serverEntries, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntries failed: %s", err)
+		}
+	}
+
+	// The per-source limit rejects the fourth and fifth entries.
+
+	storeServerEntries(makeServerEntries(0, 5, protocol.SERVER_ENTRY_SOURCE_REMOTE))
+	if count := CountServerEntries(); count != 3 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	// Updates to existing entries are not subject to the limits.
+
+	storeServerEntries(makeServerEntries(0, 3, protocol.SERVER_ENTRY_SOURCE_REMOTE))
+	if count := CountServerEntries(); count != 3 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	// The total limit rejects the third entry from another source.
+
+	storeServerEntries(makeServerEntries(10, 3, protocol.SERVER_ENTRY_SOURCE_DISCOVERY))
+	if count := CountServerEntries(); count != 5 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	// Oversized meekFrontingAddresses lists are rejected, even when the
+	// entry exists.
+
+	serverEntries := makeServerEntries(0, 1, protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	serverEntries[0]["meekFrontingAddresses"] = []interface{}{"a", "b", "c"}
+	serverEntries[0]["region"] = "CA"
+	storeServerEntries(serverEntries)
+
+	var serverEntry *protocol.ServerEntry
+	err = datastoreView(func(tx *datastoreTx) error {
+		ipAddress := []byte(testServerEntryIPAddress(0))
+		data := tx.bucket(getServerEntryBucket(ipAddress)).get(ipAddress)
+		return json.Unmarshal(data, &serverEntry)
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+	if serverEntry.Region == "CA" {
+		t.Fatalf("unexpected server entry update")
+	}
+
+	// Implausible ports fail validation.
+
+	serverEntries = makeServerEntries(20, 1, protocol.SERVER_ENTRY_SOURCE_TARGET)
+	serverEntries[0]["sshPort"] = 65536.0
+	err = StoreServerEntries(config, serverEntries, true)
+	if err == nil {
+		t.Fatalf("unexpected StoreServerEntries success")
+	}
+}
+
+func BenchmarkScanServerEntriesUnsharded(b *testing.B) {
+	benchmarkScanServerEntries(b, false)
+}
+
+func BenchmarkScanServerEntriesSharded(b *testing.B) {
+	benchmarkScanServerEntries(b, true)
+}
+
+func benchmarkScanServerEntries(b *testing.B, shardServerEntries bool) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-benchmark")
+	if err != nil {
+		b.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	err = OpenDataStore(&Config{
+		DataStoreDirectory:          testDataDirName,
+		DataStoreShardServerEntries: shardServerEntries,
+	})
+	if err != nil {
+		b.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	serverEntryCount := 100000
+
+	populateTestServerEntries(b, serverEntryCount)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		count := CountServerEntries()
+		if count != serverEntryCount {
+			b.Fatalf("unexpected server entry count: %d", count)
+		}
+	}
+}
+
+func testServerEntryIPAddress(i int) string {
+	return fmt.Sprintf("10.%d.%d.%d", (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+}
+
+// populateTestServerEntries stores server entries directly, in large
+// transactions, as storing a large number of entries with StoreServerEntry,
+// which uses one transaction per entry, is slow.
+func populateTestServerEntries(tb testing.TB, serverEntryCount int) {
+
+	for i := 0; i < serverEntryCount; {
+		err := datastoreUpdate(func(tx *datastoreTx) error {
+			for j := 0; j < datastoreServerEntryMigrationBatchSize && i < serverEntryCount; j++ {
+				ipAddress := testServerEntryIPAddress(i)
+				data, err := json.Marshal(&protocol.ServerEntry{
+					IpAddress:            ipAddress,
+					SshPort:              22,
+					Capabilities:         []string{"SSH", "OSSH", "FRONTED-MEEK"},
+					Region:               "CA",
+					ConfigurationVersion: 1,
+				})
+				if err != nil {
+					return err
+				}
+				err = tx.bucket(getServerEntryBucket([]byte(ipAddress))).put(
+					[]byte(ipAddress), data)
+				if err != nil {
+					return err
+				}
+				i++
+			}
+			return nil
+		})
+		if err != nil {
+			tb.Fatalf("datastoreUpdate failed: %s", err)
+		}
+	}
+}
+
+func countBucketKeys(t *testing.T, bucketName []byte) int {
+	count := 0
+	err := datastoreView(func(tx *datastoreTx) error {
+		cursor := tx.bucket(bucketName).cursor()
+		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			count++
+		}
+		cursor.close()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+	return count
+}
+
+func BenchmarkServerEntryIteratorUnsharded(b *testing.B) {
+	benchmarkServerEntryIterator(b, false)
+}
+
+func BenchmarkServerEntryIteratorSharded(b *testing.B) {
+	benchmarkServerEntryIterator(b, true)
+}
+
+// benchmarkServerEntryIterator measures the latency of selecting the first
+// server entry candidate, as at the start of establishment.
+func benchmarkServerEntryIterator(b *testing.B, shardServerEntries bool) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-benchmark")
+	if err != nil {
+		b.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	config := &Config{
+		DataStoreDirectory:          testDataDirName,
+		DataStoreShardServerEntries: shardServerEntries,
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		b.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	populateTestServerEntries(b, 100000)
+
+	iterator := &ServerEntryIterator{config: config}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := iterator.Reset()
+		if err != nil {
+			b.Fatalf("Reset failed: %s", err)
+		}
+		serverEntry, err := iterator.Next()
+		if err != nil || serverEntry == nil {
+			b.Fatalf("Next failed: %v", err)
+		}
+	}
+}
+
+func TestServerEntryRevocationList(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-revocation-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	config, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataStoreDirectory = testDataDirName
+
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	makeServerEntry := func(index, configurationVersion int) protocol.ServerEntryFields {
+		return protocol.ServerEntryFields{
+			"ipAddress":            testServerEntryIPAddress(index),
+			"sshPort":              22.0,
+			"capabilities":         []interface{}{"SSH"},
+			"configurationVersion": float64(configurationVersion),
+		}
+	}
+
+	storeServerEntries := func(serverEntries ...protocol.ServerEntryFields) {
+		err := StoreServerEntries(config, serverEntries, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntries failed: %s", err)
+		}
+	}
+
+	storeServerEntries(makeServerEntry(0, 1), makeServerEntry(1, 1), makeServerEntry(2, 1))
+
+	// Storing the list deletes revoked stored entries.
+
+	err = SetServerEntryRevocationList(
+		&protocol.ServerEntryRevocationList{
+			SequenceNumber: 2,
+			RevokedServerEntries: []protocol.RevokedServerEntry{
+				{IPAddress: testServerEntryIPAddress(0), ConfigurationVersion: 1},
+				{IPAddress: testServerEntryIPAddress(1), ConfigurationVersion: 0},
+			},
+		})
+	if err != nil {
+		t.Fatalf("SetServerEntryRevocationList failed: %s", err)
+	}
+	if count := CountServerEntries(); count != 2 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	// A replayed revoked entry is skipped, while a newer configuration
+	// version is stored.
+
+	storeServerEntries(makeServerEntry(0, 1))
+	if count := CountServerEntries(); count != 2 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	storeServerEntries(makeServerEntry(0, 2))
+	if count := CountServerEntries(); count != 3 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+
+	// The list cannot be rolled back.
+
+	err = SetServerEntryRevocationList(
+		&protocol.ServerEntryRevocationList{SequenceNumber: 1})
+	if err == nil {
+		t.Fatalf("unexpected rollback success")
+	}
+
+	err = SetServerEntryRevocationList(
+		&protocol.ServerEntryRevocationList{SequenceNumber: 2})
+	if err != nil {
+		t.Fatalf("SetServerEntryRevocationList failed: %s", err)
+	}
+
+	list, err := getServerEntryRevocationList()
+	if err != nil {
+		t.Fatalf("getServerEntryRevocationList failed: %s", err)
+	}
+	if list.SequenceNumber != 2 || len(list.RevokedServerEntries) != 2 {
+		t.Fatalf("unexpected revocation list: %+v", list)
+	}
+}
+
+func TestDataStoreWriteBuffer(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-write-buffer-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	bufferSize := 2
+
+	err = OpenDataStore(&Config{
+		DataStoreDirectory:       testDataDirName,
+		DataStoreWriteBufferSize: &bufferSize,
+	})
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	// Simulate unavailable storage.
+
+	writeBuffer := activeDatastoreWriteBuffer
+	storageAvailable := false
+	writeBuffer.update = func(fn func(tx *datastoreTx) error) error {
+		if !storageAvailable {
+			return errors.New("storage unavailable")
+		}
+		return datastoreUpdate(fn)
+	}
+
+	// Non-critical writes don't fail. Writes beyond the buffer size are
+	// dropped.
+
+	for _, networkID := range []string{"1", "2", "3"} {
+		err := setProtocolHealthRecord(networkID, []byte(networkID))
+		if err != nil {
+			t.Fatalf("setProtocolHealthRecord failed: %s", err)
+		}
+	}
+
+	record, err := getProtocolHealthRecord("1")
+	if err != nil || record != nil {
+		t.Fatalf("unexpected record: %s, %v", record, err)
+	}
+
+	if len(writeBuffer.writes) != 2 || writeBuffer.dropped != 1 {
+		t.Fatalf("unexpected buffer state: %d, %d",
+			len(writeBuffer.writes), writeBuffer.dropped)
+	}
+
+	// When storage is available, buffered writes are completed, in order,
+	// before the next write.
+
+	storageAvailable = true
+
+	err = setProtocolHealthRecord("4", []byte("4"))
+	if err != nil {
+		t.Fatalf("setProtocolHealthRecord failed: %s", err)
+	}
+
+	for _, networkID := range []string{"1", "2", "3", "4"} {
+		record, err := getProtocolHealthRecord(networkID)
+		if err != nil {
+			t.Fatalf("getProtocolHealthRecord failed: %s", err)
+		}
+		expected := networkID
+		if networkID == "3" {
+			expected = ""
+		}
+		if string(record) != expected {
+			t.Fatalf("unexpected record for %s: %s", networkID, record)
+		}
+	}
+
+	if len(writeBuffer.writes) != 0 {
+		t.Fatalf("unexpected buffered writes: %d", len(writeBuffer.writes))
+	}
+}
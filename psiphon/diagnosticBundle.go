@@ -0,0 +1,316 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	DIAGNOSTIC_FAILURE_CANCELED            = "canceled"
+	DIAGNOSTIC_FAILURE_TIMEOUT             = "timeout"
+	DIAGNOSTIC_FAILURE_DNS                 = "dns"
+	DIAGNOSTIC_FAILURE_CONNECTION_REFUSED  = "connection_refused"
+	DIAGNOSTIC_FAILURE_NETWORK_UNREACHABLE = "network_unreachable"
+	DIAGNOSTIC_FAILURE_CONNECTION_RESET    = "connection_reset"
+	DIAGNOSTIC_FAILURE_TLS                 = "tls"
+	DIAGNOSTIC_FAILURE_SSH                 = "ssh"
+	DIAGNOSTIC_FAILURE_HANDSHAKE           = "handshake"
+	DIAGNOSTIC_FAILURE_OTHER               = "other"
+
+	DIAGNOSTIC_BUNDLE_MAX_TRACE_EVENTS = 100
+)
+
+// DiagnosticBundle is a privacy-safe summary of repeated tunnel connection
+// failures, for the host application to offer to send to support when the
+// client can't connect. See Controller.GetDiagnosticBundle.
+//
+// The bundle contains no server or client IP addresses, domain names, error
+// messages, network IDs, or other user-identifying data. Connection errors
+// are reported only as DIAGNOSTIC_FAILURE categories; servers only by
+// region; and networks only by the network condition hint.
+type DiagnosticBundle struct {
+	GeneratedAt           string                              `json:"generatedAt"`
+	ClientPlatform        string                              `json:"clientPlatform"`
+	ClientVersion         string                              `json:"clientVersion"`
+	NetworkConditionHint  string                              `json:"networkConditionHint"`
+	ConsecutiveFailures   int                                 `json:"consecutiveFailures"`
+	TunnelPoolSize        int                                 `json:"tunnelPoolSize"`
+	FailureCounts         map[string]int                      `json:"failureCounts"`
+	ProtocolCounts        map[string]*DiagnosticProtocolCount `json:"protocolCounts"`
+	ProtocolHealthWeights map[string]float64                  `json:"protocolHealthWeights,omitempty"`
+	Attempts              []*DiagnosticAttempt                `json:"attempts"`
+	DecisionTrace         []*DiagnosticTraceEvent             `json:"decisionTrace"`
+}
+
+// DiagnosticProtocolCount is the number of failed attempts, and their
+// failure categories, for one tunnel protocol.
+type DiagnosticProtocolCount struct {
+	Failures      int            `json:"failures"`
+	FailureCounts map[string]int `json:"failureCounts"`
+}
+
+// DiagnosticAttempt is one failed tunnel connection attempt. Failover is
+// set when the attempt was a meek failover plan, which may have dialed
+// multiple protocols.
+type DiagnosticAttempt struct {
+	Timestamp            string `json:"timestamp"`
+	TunnelProtocol       string `json:"tunnelProtocol"`
+	ServerRegion         string `json:"serverRegion"`
+	Failover             bool   `json:"failover,omitempty"`
+	DurationMilliseconds int64  `json:"durationMilliseconds"`
+	Failure              string `json:"failure"`
+}
+
+// DiagnosticTraceEvent is an establishment decision, such as the start of
+// establishment or a pause between establishment rounds.
+type DiagnosticTraceEvent struct {
+	Timestamp string `json:"timestamp"`
+	Event     string `json:"event"`
+}
+
+// connectionDiagnostics records tunnel connection failures, since the last
+// successful connection, and generates a DiagnosticBundle after every
+// DiagnosticBundleFailureThreshold consecutive failures. The most recent
+// bundle is retained after a successful connection.
+type connectionDiagnostics struct {
+	config *Config
+
+	mutex               sync.Mutex
+	consecutiveFailures int
+	failureCounts       map[string]int
+	protocolCounts      map[string]*DiagnosticProtocolCount
+	attempts            []*DiagnosticAttempt
+	trace               []*DiagnosticTraceEvent
+	bundle              []byte
+	tunnelPoolSize      int
+}
+
+func newConnectionDiagnostics(config *Config) *connectionDiagnostics {
+
+	diagnostics := &connectionDiagnostics{
+		config: config,
+	}
+	diagnostics.reset()
+	return diagnostics
+}
+
+func (diagnostics *connectionDiagnostics) reset() {
+	diagnostics.consecutiveFailures = 0
+	diagnostics.failureCounts = make(map[string]int)
+	diagnostics.protocolCounts = make(map[string]*DiagnosticProtocolCount)
+	diagnostics.attempts = nil
+	diagnostics.trace = nil
+}
+
+// traceEvent records an establishment decision. The event must not include
+// any server or user-identifying data.
+func (diagnostics *connectionDiagnostics) traceEvent(format string, args ...interface{}) {
+
+	diagnostics.mutex.Lock()
+	defer diagnostics.mutex.Unlock()
+
+	if len(diagnostics.trace) >= DIAGNOSTIC_BUNDLE_MAX_TRACE_EVENTS {
+		diagnostics.trace = diagnostics.trace[1:]
+	}
+	diagnostics.trace = append(diagnostics.trace, &DiagnosticTraceEvent{
+		Timestamp: diagnosticTimestamp(),
+		Event:     fmt.Sprintf(format, args...),
+	})
+}
+
+// recordFailure records a failed tunnel connection attempt and, when the
+// failure threshold is reached, generates a new diagnostic bundle, which
+// includes the current weights of health, when not nil.
+func (diagnostics *connectionDiagnostics) recordFailure(
+	health *protocolHealth,
+	tunnelProtocol string,
+	serverRegion string,
+	failover bool,
+	duration time.Duration,
+	err error) {
+
+	p := diagnostics.config.GetClientParameters()
+	threshold := p.Int(parameters.DiagnosticBundleFailureThreshold)
+	maxAttempts := p.Int(parameters.DiagnosticBundleMaxAttempts)
+	p = nil
+
+	if threshold <= 0 {
+		return
+	}
+
+	failure := classifyConnectionError(err)
+
+	diagnostics.mutex.Lock()
+	defer diagnostics.mutex.Unlock()
+
+	diagnostics.consecutiveFailures += 1
+	diagnostics.failureCounts[failure] += 1
+
+	protocolCount, ok := diagnostics.protocolCounts[tunnelProtocol]
+	if !ok {
+		protocolCount = &DiagnosticProtocolCount{FailureCounts: make(map[string]int)}
+		diagnostics.protocolCounts[tunnelProtocol] = protocolCount
+	}
+	protocolCount.Failures += 1
+	protocolCount.FailureCounts[failure] += 1
+
+	for len(diagnostics.attempts) >= maxAttempts {
+		diagnostics.attempts = diagnostics.attempts[1:]
+	}
+	diagnostics.attempts = append(diagnostics.attempts, &DiagnosticAttempt{
+		Timestamp:            diagnosticTimestamp(),
+		TunnelProtocol:       tunnelProtocol,
+		ServerRegion:         serverRegion,
+		Failover:             failover,
+		DurationMilliseconds: int64(duration / time.Millisecond),
+		Failure:              failure,
+	})
+
+	if diagnostics.consecutiveFailures%threshold != 0 {
+		return
+	}
+
+	bundle, err := json.Marshal(diagnostics.makeBundle(health))
+	if err != nil {
+		NoticeAlert("failed to generate diagnostic bundle: %s", common.ContextError(err))
+		return
+	}
+	diagnostics.bundle = bundle
+
+	NoticeDiagnosticBundleAvailable(diagnostics.consecutiveFailures)
+}
+
+// setTunnelPoolSize records the current tunnel pool size, which is
+// reported in subsequent bundles.
+func (diagnostics *connectionDiagnostics) setTunnelPoolSize(size int) {
+	diagnostics.mutex.Lock()
+	defer diagnostics.mutex.Unlock()
+	diagnostics.tunnelPoolSize = size
+}
+
+// recordSuccess records a successful tunnel connection, resetting the
+// recorded failures. Any generated bundle is retained.
+func (diagnostics *connectionDiagnostics) recordSuccess() {
+	diagnostics.mutex.Lock()
+	defer diagnostics.mutex.Unlock()
+	diagnostics.reset()
+}
+
+// getBundle returns the most recently generated diagnostic bundle, if any.
+func (diagnostics *connectionDiagnostics) getBundle() ([]byte, bool) {
+	diagnostics.mutex.Lock()
+	defer diagnostics.mutex.Unlock()
+	return diagnostics.bundle, diagnostics.bundle != nil
+}
+
+// makeBundle creates a DiagnosticBundle from the recorded failures. The
+// caller must lock the mutex.
+func (diagnostics *connectionDiagnostics) makeBundle(
+	health *protocolHealth) *DiagnosticBundle {
+
+	diagnostics.config.dynamicConfigMutex.Lock()
+	networkConditionHint := diagnostics.config.networkConditionHint
+	diagnostics.config.dynamicConfigMutex.Unlock()
+
+	if networkConditionHint == "" {
+		networkConditionHint = NETWORK_CONDITION_HINT_NORMAL
+	}
+
+	return &DiagnosticBundle{
+		GeneratedAt:           diagnosticTimestamp(),
+		ClientPlatform:        diagnostics.config.ClientPlatform,
+		ClientVersion:         diagnostics.config.ClientVersion,
+		NetworkConditionHint:  networkConditionHint,
+		ConsecutiveFailures:   diagnostics.consecutiveFailures,
+		TunnelPoolSize:        diagnostics.tunnelPoolSize,
+		FailureCounts:         diagnostics.failureCounts,
+		ProtocolCounts:        diagnostics.protocolCounts,
+		ProtocolHealthWeights: health.getWeights(),
+		Attempts:              diagnostics.attempts,
+		DecisionTrace:         diagnostics.trace,
+	}
+}
+
+func diagnosticTimestamp() string {
+	return time.Now().UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+// classifyConnectionError maps a tunnel connection error to a
+// DIAGNOSTIC_FAILURE category. Only the category is retained, as error
+// messages may contain addresses.
+func classifyConnectionError(err error) string {
+
+	if err == nil {
+		return DIAGNOSTIC_FAILURE_OTHER
+	}
+
+	message := strings.ToLower(err.Error())
+
+	contains := func(substrings ...string) bool {
+		for _, substring := range substrings {
+			if strings.Contains(message, substring) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return DIAGNOSTIC_FAILURE_TIMEOUT
+	}
+
+	// The checks are ordered from the most to the least specific. Errors are
+	// wrapped with common.ContextError, so matching is by message. The TLS
+	// and SSH libraries prefix errors with "tls:" and "ssh:", and handshake
+	// API request errors are wrapped by ServerContext.doHandshakeRequest.
+
+	switch {
+	case contains(context.Canceled.Error()):
+		return DIAGNOSTIC_FAILURE_CANCELED
+	case contains("no such host", "lookup "):
+		return DIAGNOSTIC_FAILURE_DNS
+	case contains("connection refused"):
+		return DIAGNOSTIC_FAILURE_CONNECTION_REFUSED
+	case contains("network is unreachable", "no route to host", "host is down"):
+		return DIAGNOSTIC_FAILURE_NETWORK_UNREACHABLE
+	case contains("timeout", "timed out", context.DeadlineExceeded.Error()):
+		return DIAGNOSTIC_FAILURE_TIMEOUT
+	case contains("connection reset", "broken pipe", "eof"):
+		return DIAGNOSTIC_FAILURE_CONNECTION_RESET
+	case contains("tls:", "certificate", "x509"):
+		return DIAGNOSTIC_FAILURE_TLS
+	case contains("ssh:"):
+		return DIAGNOSTIC_FAILURE_SSH
+	case contains("handshakerequest"):
+		return DIAGNOSTIC_FAILURE_HANDSHAKE
+	}
+
+	return DIAGNOSTIC_FAILURE_OTHER
+}
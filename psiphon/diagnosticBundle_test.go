@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestConnectionDiagnostics(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.DiagnosticBundleFailureThreshold: 3,
+		parameters.DiagnosticBundleMaxAttempts:      2,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	config := &Config{
+		ClientPlatform:   "Windows",
+		ClientVersion:    "1",
+		clientParameters: clientParameters,
+	}
+
+	diagnostics := newConnectionDiagnostics(config)
+
+	diagnostics.traceEvent("start establishing")
+
+	connectErrors := []error{
+		errors.New("psiphon.dialSsh: dial tcp 192.0.2.1:443: connect: connection refused"),
+		errors.New("psiphon.dialSsh: ssh: handshake failed: unexpected message"),
+		context.DeadlineExceeded,
+	}
+
+	for i, err := range connectErrors {
+		if _, ok := diagnostics.getBundle(); ok {
+			t.Fatalf("unexpected bundle after %d failures", i)
+		}
+		diagnostics.recordFailure(nil, "OSSH", "CA", false, time.Second, err)
+	}
+
+	bundleJSON, ok := diagnostics.getBundle()
+	if !ok {
+		t.Fatalf("missing bundle")
+	}
+
+	// No addresses or error messages are included.
+
+	if strings.Contains(string(bundleJSON), "192.0.2.1") ||
+		strings.Contains(string(bundleJSON), "unexpected message") {
+		t.Fatalf("unexpected bundle contents: %s", bundleJSON)
+	}
+
+	var bundle DiagnosticBundle
+	err = json.Unmarshal(bundleJSON, &bundle)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	if bundle.ConsecutiveFailures != 3 ||
+		bundle.FailureCounts[DIAGNOSTIC_FAILURE_CONNECTION_REFUSED] != 1 ||
+		bundle.FailureCounts[DIAGNOSTIC_FAILURE_SSH] != 1 ||
+		bundle.FailureCounts[DIAGNOSTIC_FAILURE_TIMEOUT] != 1 ||
+		bundle.ProtocolCounts["OSSH"].Failures != 3 ||
+		len(bundle.Attempts) != 2 ||
+		len(bundle.DecisionTrace) != 1 ||
+		bundle.NetworkConditionHint != NETWORK_CONDITION_HINT_NORMAL {
+		t.Fatalf("unexpected bundle: %s", bundleJSON)
+	}
+
+	// A success resets the failures, and retains the bundle.
+
+	diagnostics.recordSuccess()
+
+	for i := 0; i < 2; i++ {
+		diagnostics.recordFailure(nil, "OSSH", "CA", false, time.Second, connectErrors[0])
+	}
+
+	retainedBundleJSON, ok := diagnostics.getBundle()
+	if !ok || string(retainedBundleJSON) != string(bundleJSON) {
+		t.Fatalf("unexpected bundle")
+	}
+
+	diagnostics.recordFailure(nil, "OSSH", "CA", false, time.Second, connectErrors[0])
+
+	bundleJSON, _ = diagnostics.getBundle()
+	bundle = DiagnosticBundle{}
+	json.Unmarshal(bundleJSON, &bundle)
+	if bundle.ConsecutiveFailures != 3 ||
+		bundle.FailureCounts[DIAGNOSTIC_FAILURE_CONNECTION_REFUSED] != 3 ||
+		len(bundle.DecisionTrace) != 0 {
+		t.Fatalf("unexpected bundle: %s", bundleJSON)
+	}
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	DIAL_PARAMETERS_VERSION = 1
+)
+
+// DialParameters are the tunnel protocol and the randomized selections made
+// for a tunnel dial: meek fronting and host name transformation, TLS
+// profile, User-Agent, SSH client version, QUIC SNI and version, obfuscated
+// SSH padding length, TCP Fast Open, the OSSH decoy first flight, the
+// fragmentor PRNG seed, the IP address family reset retry limit, the meek
+// payload chunk size bounds, and any fronted/unfronted meek failover attempt.
+// MakeDialParameters makes new selections, and the dial applies the
+// selections as-is.
+//
+// DialParameters may be serialized, with MarshalDialParameters, as a test
+// fixture. A test may then load the fixture with UnmarshalDialParameters
+// and call ConnectTunnelWithDialParameters to reproduce the dial, given the
+// same server entry and client parameters.
+//
+// The server entry is referenced by IP address and no server entry secrets,
+// such as obfuscation keys, the meek cookie encryption key, or SSH
+// credentials, are embedded; these are taken from the server entry at dial
+// time. Values which are generated for each connection, including
+// obfuscation keys and padding bytes, TLS randoms, and meek polling and
+// request padding, are not reproduced.
+type DialParameters struct {
+	Version                    int    `json:"v"`
+	ServerEntryIPAddress       string `json:"serverEntryIPAddress"`
+	TunnelProtocol             string `json:"tunnelProtocol"`
+	MeekDialAddress            string `json:"meekDialAddress,omitempty"`
+	MeekHostHeader             string `json:"meekHostHeader,omitempty"`
+	MeekSNIServerName          string `json:"meekSNIServerName,omitempty"`
+	MeekTransformedHostName    bool   `json:"meekTransformedHostName,omitempty"`
+	MeekMaxChunkSize           int    `json:"meekMaxChunkSize,omitempty"`
+	MeekMinChunkSize           int    `json:"meekMinChunkSize,omitempty"`
+	TLSProfile                 string `json:"tlsProfile,omitempty"`
+	SelectedUserAgent          bool   `json:"selectedUserAgent,omitempty"`
+	UserAgent                  string `json:"userAgent,omitempty"`
+	UserAgentFamily            string `json:"userAgentFamily,omitempty"`
+	SSHClientVersion           string `json:"sshClientVersion,omitempty"`
+	QUICDialSNIAddress         string `json:"quicDialSNIAddress,omitempty"`
+	QUICVersion                string `json:"quicVersion,omitempty"`
+	ObfuscatedSSHPaddingLength int    `json:"obfuscatedSSHPaddingLength"`
+	TCPFastOpen                bool   `json:"tcpFastOpen,omitempty"`
+	OSSHDecoyFirstFlight       bool   `json:"osshDecoyFirstFlight,omitempty"`
+	OSSHDecoyServerName        string `json:"osshDecoyServerName,omitempty"`
+	FragmentorSeed             int64  `json:"fragmentorSeed"`
+
+	// IPAddressFamilyResetRetries bounds the immediate retries of the other
+	// IP address family when a TCP dial is reset or refused.
+	IPAddressFamilyResetRetries int `json:"ipAddressFamilyResetRetries,omitempty"`
+
+	// The meek failover fields are set by connectMeekFailover. A non-zero
+	// MeekConnectTimeout replaces TunnelConnectTimeout for the dial.
+	MeekFailoverOrder   string        `json:"meekFailoverOrder,omitempty"`
+	MeekFailoverRace    bool          `json:"meekFailoverRace,omitempty"`
+	MeekFailoverAttempt int           `json:"meekFailoverAttempt,omitempty"`
+	MeekConnectTimeout  time.Duration `json:"meekConnectTimeout,omitempty"`
+}
+
+// MakeDialParameters makes new dial parameter selections for dialing the
+// specified server entry with the specified tunnel protocol.
+//
+// The User-Agent is selected when initializing the dial config, as the
+// selection depends on the dial headers; see initDialConfig.
+func MakeDialParameters(
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	tunnelProtocol string) (*DialParameters, error) {
+
+	p := config.clientParameters.Get()
+
+	dialParams := &DialParameters{
+		Version:              DIAL_PARAMETERS_VERSION,
+		ServerEntryIPAddress: serverEntry.IpAddress,
+		TunnelProtocol:       tunnelProtocol,
+	}
+
+	switch {
+	case tunnelProtocol == protocol.TUNNEL_PROTOCOL_SSH:
+		dialParams.SSHClientVersion = pickSSHClientVersion()
+
+	case protocol.TunnelProtocolUsesQUIC(tunnelProtocol):
+		dialParams.QUICDialSNIAddress = fmt.Sprintf(
+			"%s:%d", common.GenerateHostName(), serverEntry.SshObfuscatedQUICPort)
+		dialParams.QUICVersion = selectQUICVersion(config.clientParameters)
+
+	case protocol.TunnelProtocolUsesMeek(tunnelProtocol):
+		err := selectMeekDialParameters(config, serverEntry, dialParams)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	if tunnelProtocol != protocol.TUNNEL_PROTOCOL_SSH {
+
+		// Server entry padding overrides are applied as in dialSsh. Invalid
+		// overrides are ignored.
+
+		minPadding := p.Int(parameters.ObfuscatedSSHMinPadding)
+		maxPadding := p.Int(parameters.ObfuscatedSSHMaxPadding)
+		obfuscationParameters, err := serverEntry.GetObfuscationParameters()
+		if err == nil && obfuscationParameters != nil {
+			minPadding, maxPadding = overrideRange(
+				minPadding,
+				maxPadding,
+				obfuscationParameters.ObfuscatedSSHMinPadding,
+				obfuscationParameters.ObfuscatedSSHMaxPadding)
+		}
+		dialParams.ObfuscatedSSHPaddingLength, err = common.MakeSecureRandomRange(
+			minPadding, maxPadding)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	tcpFastOpenProtocols := p.TunnelProtocols(parameters.TCPFastOpenLimitProtocols)
+	dialParams.TCPFastOpen = p.WeightedCoinFlip(parameters.TCPFastOpenProbability) &&
+		(len(tcpFastOpenProtocols) == 0 || common.Contains(tcpFastOpenProtocols, tunnelProtocol))
+
+	if tunnelProtocol == protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH &&
+		p.WeightedCoinFlip(parameters.OSSHDecoyFirstFlightProbability) {
+
+		dialParams.OSSHDecoyFirstFlight = true
+		dialParams.OSSHDecoyServerName = common.GenerateHostName()
+		serverNames := p.Strings(parameters.OSSHDecoyFirstFlightServerNames)
+		if len(serverNames) > 0 {
+			index, _ := common.MakeSecureRandomInt(len(serverNames))
+			dialParams.OSSHDecoyServerName = serverNames[index]
+		}
+	}
+
+	// The seed is never 0, which indicates no seed in DialConfig.
+	seed, err := common.MakeSecureRandomInt64(math.MaxInt64)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	dialParams.FragmentorSeed = seed + 1
+
+	dialParams.IPAddressFamilyResetRetries = p.Int(parameters.IPAddressFamilyResetRetries)
+
+	return dialParams, nil
+}
+
+// selectMeekDialParameters selects the meek dial address, host header, SNI
+// server name, TLS profile, and payload chunk size bounds for a meek tunnel
+// protocol.
+func selectMeekDialParameters(
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	dialParams *DialParameters) error {
+
+	doMeekTransformHostName := func() bool {
+		return config.clientParameters.Get().WeightedCoinFlip(
+			parameters.TransformHostNameProbability)
+	}
+
+	var dialAddress string
+	var SNIServerName, hostHeader string
+	transformedHostName := false
+
+	switch dialParams.TunnelProtocol {
+	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:
+
+		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		dialAddress = fmt.Sprintf("%s:443", frontingAddress)
+		if !isMeekFrontingSNIDisabled(config, serverEntry, frontingAddress) {
+			SNIServerName = frontingAddress
+			if doMeekTransformHostName() {
+				SNIServerName = common.GenerateHostName()
+				transformedHostName = true
+			}
+		}
+		hostHeader = frontingHost
+
+	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
+
+		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		dialAddress = fmt.Sprintf("%s:80", frontingAddress)
+		hostHeader = frontingHost
+
+	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK:
+
+		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		hostname := serverEntry.IpAddress
+		if doMeekTransformHostName() {
+			hostname = common.GenerateHostName()
+			transformedHostName = true
+		}
+		if serverEntry.MeekServerPort == 80 {
+			hostHeader = hostname
+		} else {
+			hostHeader = fmt.Sprintf("%s:%d", hostname, serverEntry.MeekServerPort)
+		}
+
+	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET:
+
+		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		SNIServerName = serverEntry.IpAddress
+		if doMeekTransformHostName() {
+			SNIServerName = common.GenerateHostName()
+			transformedHostName = true
+		}
+		if serverEntry.MeekServerPort == 443 {
+			hostHeader = serverEntry.IpAddress
+		} else {
+			hostHeader = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		}
+
+	default:
+		return common.ContextError(
+			fmt.Errorf("unknown tunnel protocol: %s", dialParams.TunnelProtocol))
+	}
+
+	// The underlying TLS will automatically disable SNI for IP address server name
+	// values; we have this explicit check here so we record the correct value for stats.
+	if net.ParseIP(SNIServerName) != nil {
+		SNIServerName = ""
+	}
+
+	// Pin the TLS profile for the entire meek connection.
+	selectedTLSProfile := ""
+	if protocol.TunnelProtocolUsesMeekHTTPS(dialParams.TunnelProtocol) {
+		selectedTLSProfile = SelectTLSProfile(config.clientParameters)
+	}
+
+	dialParams.MeekDialAddress = dialAddress
+	dialParams.MeekHostHeader = hostHeader
+	dialParams.MeekSNIServerName = SNIServerName
+	dialParams.MeekTransformedHostName = transformedHostName
+	dialParams.TLSProfile = selectedTLSProfile
+
+	// The chunk size bounds, which are sent to the server in the meek
+	// cookie, are fixed for the meek connection.
+	p := config.clientParameters.Get()
+	dialParams.MeekMaxChunkSize, dialParams.MeekMinChunkSize =
+		protocol.ClampMeekChunkSizes(
+			p.Int(parameters.MeekMaxChunkSize), p.Int(parameters.MeekMinChunkSize))
+
+	return nil
+}
+
+// MarshalDialParameters serializes dial parameters as a test fixture.
+func MarshalDialParameters(dialParams *DialParameters) ([]byte, error) {
+
+	fixture, err := json.MarshalIndent(dialParams, "", "    ")
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return fixture, nil
+}
+
+// UnmarshalDialParameters loads dial parameters serialized by
+// MarshalDialParameters. An error is returned when the dial parameters
+// version is unsupported or when the dial parameters don't reference the
+// specified server entry or aren't compatible with it.
+func UnmarshalDialParameters(
+	fixture []byte, serverEntry *protocol.ServerEntry) (*DialParameters, error) {
+
+	var dialParams *DialParameters
+	err := json.Unmarshal(fixture, &dialParams)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if dialParams == nil {
+		return nil, common.ContextError(errors.New("missing dial parameters"))
+	}
+
+	if dialParams.Version != DIAL_PARAMETERS_VERSION {
+		return nil, common.ContextError(
+			fmt.Errorf("unsupported dial parameters version: %d", dialParams.Version))
+	}
+
+	if dialParams.ServerEntryIPAddress != serverEntry.IpAddress {
+		return nil, common.ContextError(errors.New("unexpected server entry"))
+	}
+
+	if !serverEntry.SupportsProtocol(dialParams.TunnelProtocol) {
+		return nil, common.ContextError(
+			fmt.Errorf("server does not support tunnel protocol: %s", dialParams.TunnelProtocol))
+	}
+
+	if protocol.TunnelProtocolUsesMeek(dialParams.TunnelProtocol) &&
+		dialParams.MeekDialAddress == "" {
+
+		return nil, common.ContextError(errors.New("missing meek dial address"))
+	}
+
+	return dialParams, nil
+}
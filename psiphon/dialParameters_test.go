@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/server"
+)
+
+func TestDialParametersFixture(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-dial-parameters-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "TransformHostNameProbability" : 0.5,
+        "PickUserAgentProbability" : 1.0
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	_, _, _, _, encodedServerEntry, err := server.GenerateConfig(
+		&server.GenerateConfigParams{
+			ServerIPAddress:      "0.1.0.0",
+			EnableSSHAPIRequests: true,
+			WebServerPort:        8000,
+			TunnelProtocolPorts: map[string]int{
+				protocol.TUNNEL_PROTOCOL_SSH:                  4000,
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH:       4001,
+				protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH:  4002,
+				protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS: 4003,
+			},
+		})
+	if err != nil {
+		t.Fatalf("error generating server config: %s", err)
+	}
+
+	serverEntry, err := protocol.DecodeServerEntry(
+		string(encodedServerEntry),
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	if err != nil {
+		t.Fatalf("error decoding server entry: %s", err)
+	}
+
+	otherServerEntry := *serverEntry
+	otherServerEntry.IpAddress = "0.1.0.1"
+
+	for _, tunnelProtocol := range []string{
+		protocol.TUNNEL_PROTOCOL_SSH,
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+	} {
+
+		dialParams, err := MakeDialParameters(clientConfig, serverEntry, tunnelProtocol)
+		if err != nil {
+			t.Fatalf("MakeDialParameters failed: %s", err)
+		}
+
+		// As in dialSsh, initialize the meek and dial configs, which
+		// records the User-Agent selection.
+
+		var meekConfig *MeekConfig
+		if protocol.TunnelProtocolUsesMeek(tunnelProtocol) {
+			meekConfig, err = initMeekConfig(clientConfig, serverEntry, dialParams, "")
+			if err != nil {
+				t.Fatalf("initMeekConfig failed: %s", err)
+			}
+		}
+
+		dialConfig, _ := initDialConfig(clientConfig, meekConfig, dialParams)
+
+		fixture, err := MarshalDialParameters(dialParams)
+		if err != nil {
+			t.Fatalf("MarshalDialParameters failed: %s", err)
+		}
+
+		t.Logf("%s", string(fixture))
+
+		replayDialParams, err := UnmarshalDialParameters(fixture, serverEntry)
+		if err != nil {
+			t.Fatalf("UnmarshalDialParameters failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(dialParams, replayDialParams) {
+			t.Fatalf("unexpected dial parameters: %+v", replayDialParams)
+		}
+
+		// The dial parameters must reproduce the same meek and dial configs.
+
+		var replayMeekConfig *MeekConfig
+		if meekConfig != nil {
+			replayMeekConfig, err = initMeekConfig(clientConfig, serverEntry, replayDialParams, "")
+			if err != nil {
+				t.Fatalf("initMeekConfig failed: %s", err)
+			}
+			if replayMeekConfig.DialAddress != meekConfig.DialAddress ||
+				replayMeekConfig.SNIServerName != meekConfig.SNIServerName ||
+				replayMeekConfig.HostHeader != meekConfig.HostHeader ||
+				replayMeekConfig.TLSProfile != meekConfig.TLSProfile {
+				t.Fatalf("unexpected meek config: %+v", replayMeekConfig)
+			}
+			if !replayDialParams.SelectedUserAgent {
+				t.Fatalf("expected selected User-Agent")
+			}
+		}
+
+		replayDialConfig, _ := initDialConfig(clientConfig, replayMeekConfig, replayDialParams)
+
+		if !reflect.DeepEqual(replayDialConfig.CustomHeaders, dialConfig.CustomHeaders) ||
+			replayDialConfig.FragmentorSeed != dialConfig.FragmentorSeed ||
+			replayDialConfig.FragmentorSeed == 0 {
+			t.Fatalf("unexpected dial config: %+v", replayDialConfig)
+		}
+
+		// Fixtures must not load with a different server entry.
+
+		_, err = UnmarshalDialParameters(fixture, &otherServerEntry)
+		if err == nil {
+			t.Fatalf("UnmarshalDialParameters unexpectedly succeeded")
+		}
+	}
+}
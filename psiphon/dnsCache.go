@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// dnsCache is a cache of resolved IP addresses, used when dialing fronting
+// addresses.
+//
+// The cache TTL is decoupled from the authoritative DNS record TTL: the
+// record TTL is clamped to the range [FrontingDNSCacheMinTTL,
+// FrontingDNSCacheMaxTTL]. FrontingDNSCacheMaxTTL limits staleness for
+// fronts which frequently rotate IP addresses, while FrontingDNSCacheMinTTL
+// avoids excessive lookups for short record TTLs. When the record TTL is
+// not available, it's taken to be 0 and FrontingDNSCacheMinTTL applies. The
+// cache is disabled when FrontingDNSCacheMaxTTL is 0.
+type dnsCache struct {
+	hits             int64
+	misses           int64
+	clientParameters *parameters.ClientParameters
+	mutex            sync.Mutex
+	entries          map[string]*dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ips    []net.IP
+	expiry monotime.Time
+}
+
+func newDNSCache(clientParameters *parameters.ClientParameters) *dnsCache {
+	return &dnsCache{
+		clientParameters: clientParameters,
+		entries:          make(map[string]*dnsCacheEntry),
+	}
+}
+
+// lookupIP returns cached IP addresses for host, when available, or else
+// resolves the host with LookupIP and caches the result.
+func (cache *dnsCache) lookupIP(
+	ctx context.Context, host string, config *DialConfig) ([]net.IP, error) {
+
+	p := cache.clientParameters.Get()
+	minTTL := p.Duration(parameters.FrontingDNSCacheMinTTL)
+	maxTTL := p.Duration(parameters.FrontingDNSCacheMaxTTL)
+	p = nil
+
+	if maxTTL <= 0 || net.ParseIP(host) != nil {
+		return LookupIP(ctx, host, config)
+	}
+
+	now := monotime.Now()
+
+	cache.mutex.Lock()
+	entry, ok := cache.entries[host]
+	if ok && now.Before(entry.expiry) {
+		ips := append([]net.IP(nil), entry.ips...)
+		cache.mutex.Unlock()
+		atomic.AddInt64(&cache.hits, 1)
+		return ips, nil
+	}
+	if ok {
+		delete(cache.entries, host)
+	}
+	cache.mutex.Unlock()
+
+	atomic.AddInt64(&cache.misses, 1)
+
+	ips, ttl, err := lookupIPWithTTL(ctx, host, config)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	if ttl > 0 && len(ips) > 0 {
+		cache.mutex.Lock()
+		cache.entries[host] = &dnsCacheEntry{
+			ips:    append([]net.IP(nil), ips...),
+			expiry: now.Add(ttl),
+		}
+		cache.mutex.Unlock()
+	}
+
+	return ips, nil
+}
+
+// lookupIP resolves host using the dnsCache, when set, or else LookupIP.
+func (config *DialConfig) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if config.dnsCache != nil {
+		return config.dnsCache.lookupIP(ctx, host, config)
+	}
+	return LookupIP(ctx, host, config)
+}
+
+// getStats returns and resets the cache hit and miss counts.
+func (cache *dnsCache) getStats() (int64, int64) {
+	return atomic.SwapInt64(&cache.hits, 0), atomic.SwapInt64(&cache.misses, 0)
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestDNSCache(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	cache := newDNSCache(clientParameters)
+
+	lookup := func() {
+		ips, err := cache.lookupIP(context.Background(), "localhost", &DialConfig{})
+		if err != nil {
+			t.Fatalf("lookupIP failed: %s", err)
+		}
+		if len(ips) == 0 {
+			t.Fatalf("unexpected empty IP address list")
+		}
+	}
+
+	// When disabled, lookups are not cached or counted.
+
+	lookup()
+	lookup()
+
+	hits, misses := cache.getStats()
+	if hits != 0 || misses != 0 {
+		t.Fatalf("unexpected disabled cache stats: %d, %d", hits, misses)
+	}
+
+	// The system resolver doesn't provide a record TTL, so the minimum TTL
+	// applies.
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"FrontingDNSCacheMinTTL": "1m",
+		"FrontingDNSCacheMaxTTL": "1h",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	lookup()
+	lookup()
+	lookup()
+
+	hits, misses = cache.getStats()
+	if hits != 2 || misses != 1 {
+		t.Fatalf("unexpected cache stats: %d, %d", hits, misses)
+	}
+
+	// With no minimum TTL, lookups without a record TTL are not cached.
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"FrontingDNSCacheMaxTTL": "1h",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	cache = newDNSCache(clientParameters)
+
+	lookup()
+	lookup()
+
+	hits, misses = cache.getStats()
+	if hits != 0 || misses != 2 {
+		t.Fatalf("unexpected uncached stats: %d, %d", hits, misses)
+	}
+}
@@ -0,0 +1,606 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	DNS_PROXY_UPSTREAM_TIMEOUT     = 10 * time.Second
+	DNS_PROXY_MAX_CONCURRENT       = 100
+	DNS_PROXY_CACHE_MAX_ENTRIES    = 1000
+	DNS_PROXY_CACHE_MAX_TTL        = 1 * time.Hour
+	DNS_PROXY_DEFAULT_UDP_SIZE     = dns.MinMsgSize
+	DNS_PROXY_MAX_REQUEST_UDP_SIZE = dns.DefaultMsgSize
+	DNS_PROXY_BYPASS_TTL           = 10
+)
+
+// DNS_PROXY_DEFAULT_BYPASS_DOMAINS are operating system and browser captive
+// portal detection domains, which must be resolved using the local network
+// resolver for captive portal detection to work.
+var DNS_PROXY_DEFAULT_BYPASS_DOMAINS = []string{
+	"captive.apple.com",
+	"connectivitycheck.gstatic.com",
+	"connectivitycheck.android.com",
+	"clients3.google.com",
+	"www.msftconnecttest.com",
+	"www.msftncsi.com",
+	"detectportal.firefox.com",
+	"nmcheck.gnome.org",
+	"connectivity-check.ubuntu.com",
+}
+
+// DNSProxy is a DNS server that accepts local host UDP and TCP DNS queries
+// and resolves each query through the tunnel, by relaying the query to the
+// server's DNS resolver over a TCP port forward. Together with the SOCKS and
+// HTTP proxies, this allows for system-wide configurations without DNS
+// leaks.
+//
+// Queries for bypass domains, such as local network names and captive
+// portal detection domains, are the only queries resolved outside of the
+// tunnel. Bypass queries are resolved using the system resolver, for A and
+// AAAA queries only; other bypass query types are answered with no records.
+// Bypass responses are not cached.
+//
+// Queries are relayed unmodified, so EDNS options are preserved. As the
+// upstream transport is TCP, large responses are always received in full;
+// responses which exceed the UDP size limit of a UDP query are truncated,
+// with the TC bit set, and the client will retry the query over TCP.
+//
+// Responses are cached, according to their record TTLs, and queries for
+// blocked domains are answered with NXDOMAIN without being relayed.
+type DNSProxy struct {
+	tunneler               Tunneler
+	blockedDomains         []string
+	bypassDomains          []string
+	bypassMutex            sync.Mutex
+	bypassInFlight         map[string]bool
+	udpServer              *dns.Server
+	tcpServer              *dns.Server
+	serveWaitGroup         *sync.WaitGroup
+	stopListeningBroadcast chan struct{}
+	semaphore              chan struct{}
+	cacheMutex             sync.Mutex
+	cache                  map[string]*dnsProxyCacheEntry
+}
+
+type dnsProxyCacheEntry struct {
+	response *dns.Msg
+	created  monotime.Time
+	expiry   monotime.Time
+}
+
+// NewDNSProxy initializes a new DNS proxy. It begins listening for UDP and
+// TCP queries, starts goroutines that run the servers, and returns leaving
+// the servers running.
+func NewDNSProxy(
+	config *Config,
+	tunneler Tunneler,
+	listenIP string) (*DNSProxy, error) {
+
+	packetConn, err := net.ListenPacket(
+		"udp", fmt.Sprintf("%s:%d", listenIP, config.LocalDNSProxyPort))
+	if err != nil {
+		if IsAddressInUseError(err) {
+			NoticeDNSProxyPortInUse(config.LocalDNSProxyPort)
+		}
+		return nil, common.ContextError(err)
+	}
+
+	// When the system selects the port, the TCP listener uses the port
+	// selected for the UDP listener.
+	listenPort := packetConn.LocalAddr().(*net.UDPAddr).Port
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenIP, listenPort))
+	if err != nil {
+		packetConn.Close()
+		if IsAddressInUseError(err) {
+			NoticeDNSProxyPortInUse(listenPort)
+		}
+		return nil, common.ContextError(err)
+	}
+
+	blockedDomains := make([]string, len(config.LocalDNSProxyBlockedDomains))
+	for i, domain := range config.LocalDNSProxyBlockedDomains {
+		blockedDomains[i] = dns.Fqdn(strings.ToLower(domain))
+	}
+
+	var bypassDomains []string
+	if !config.LocalDNSProxyDisableDefaultBypassDomains {
+		bypassDomains = append(bypassDomains, DNS_PROXY_DEFAULT_BYPASS_DOMAINS...)
+	}
+	bypassDomains = append(bypassDomains, config.LocalDNSProxyBypassDomains...)
+	for i, domain := range bypassDomains {
+		bypassDomains[i] = dns.Fqdn(strings.ToLower(domain))
+	}
+
+	proxy := &DNSProxy{
+		tunneler:               tunneler,
+		blockedDomains:         blockedDomains,
+		bypassDomains:          bypassDomains,
+		bypassInFlight:         make(map[string]bool),
+		serveWaitGroup:         new(sync.WaitGroup),
+		stopListeningBroadcast: make(chan struct{}),
+		semaphore:              make(chan struct{}, DNS_PROXY_MAX_CONCURRENT),
+		cache:                  make(map[string]*dnsProxyCacheEntry),
+	}
+
+	handler := dns.HandlerFunc(proxy.handleQuery)
+
+	proxy.udpServer = &dns.Server{
+		PacketConn: packetConn,
+		Handler:    handler,
+		UDPSize:    DNS_PROXY_MAX_REQUEST_UDP_SIZE,
+	}
+
+	proxy.tcpServer = &dns.Server{
+		Listener: listener,
+		Handler:  handler,
+	}
+
+	err = proxy.startServer(proxy.udpServer)
+	if err != nil {
+		packetConn.Close()
+		listener.Close()
+		return nil, common.ContextError(err)
+	}
+
+	err = proxy.startServer(proxy.tcpServer)
+	if err != nil {
+		listener.Close()
+		proxy.Close()
+		return nil, common.ContextError(err)
+	}
+
+	NoticeListeningDNSProxyPort(listenPort)
+
+	return proxy, nil
+}
+
+// startServer starts a goroutine that runs the server and waits until the
+// server has started, so that Close can always shutdown the server.
+func (proxy *DNSProxy) startServer(server *dns.Server) error {
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+
+	serveErr := make(chan error, 1)
+
+	proxy.serveWaitGroup.Add(1)
+	go func() {
+		defer proxy.serveWaitGroup.Done()
+
+		err := server.ActivateAndServe()
+		if err == nil {
+			err = errors.New("server stopped")
+		}
+		serveErr <- err
+
+		select {
+		case <-started:
+		default:
+			// Failed to start; the error is returned by startServer.
+			return
+		}
+
+		select {
+		case <-proxy.stopListeningBroadcast:
+			// Ignore the error caused by Close.
+			return
+		default:
+		}
+
+		NoticeAlert("DNS proxy serve error: %s", common.ContextError(err))
+		proxy.tunneler.SignalComponentFailure()
+	}()
+
+	select {
+	case <-started:
+		return nil
+	case err := <-serveErr:
+		return common.ContextError(err)
+	}
+}
+
+// Close terminates the servers and waits for the server goroutines to
+// complete.
+func (proxy *DNSProxy) Close() {
+
+	// Shutdown closes the listeners. Shutdown returns an error when in
+	// progress queries don't complete within the server read timeout; this
+	// is not waited on as any in progress query is interrupted when the
+	// tunnel closes.
+	close(proxy.stopListeningBroadcast)
+	proxy.udpServer.Shutdown()
+	proxy.tcpServer.Shutdown()
+	proxy.serveWaitGroup.Wait()
+	NoticeInfo("DNS proxy stopped")
+}
+
+func (proxy *DNSProxy) handleQuery(writer dns.ResponseWriter, request *dns.Msg) {
+
+	response, err := proxy.resolve(request)
+	if err != nil {
+		NoticeLocalProxyError("DNS", common.ContextError(err))
+		response = new(dns.Msg)
+		response.SetRcode(request, dns.RcodeServerFailure)
+	}
+
+	if _, ok := writer.RemoteAddr().(*net.UDPAddr); ok {
+		response = truncateDNSResponse(request, response)
+	}
+
+	err = writer.WriteMsg(response)
+	if err != nil {
+		NoticeLocalProxyError("DNS", common.ContextError(err))
+	}
+}
+
+func (proxy *DNSProxy) resolve(request *dns.Msg) (*dns.Msg, error) {
+
+	if len(request.Question) != 1 {
+		response := new(dns.Msg)
+		response.SetRcodeFormatError(request)
+		return response, nil
+	}
+
+	question := request.Question[0]
+
+	if proxy.isBlocked(question.Name) {
+		response := new(dns.Msg)
+		response.SetRcode(request, dns.RcodeNameError)
+		return response, nil
+	}
+
+	if proxy.isBypassed(question.Name) {
+		select {
+		case proxy.semaphore <- struct{}{}:
+		default:
+			return nil, common.ContextError(
+				fmt.Errorf("exceeded %d concurrent queries", DNS_PROXY_MAX_CONCURRENT))
+		}
+		defer func() { <-proxy.semaphore }()
+
+		response, err := proxy.resolveBypass(request)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		return response, nil
+	}
+
+	cacheKey := makeDNSProxyCacheKey(request)
+
+	response := proxy.getCachedResponse(cacheKey)
+	if response != nil {
+		response.Id = request.Id
+		response.Question = request.Question
+		return response, nil
+	}
+
+	select {
+	case proxy.semaphore <- struct{}{}:
+	default:
+		return nil, common.ContextError(
+			fmt.Errorf("exceeded %d concurrent queries", DNS_PROXY_MAX_CONCURRENT))
+	}
+	defer func() { <-proxy.semaphore }()
+
+	response, err := proxy.resolveThroughTunnel(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	proxy.cacheResponse(cacheKey, response)
+
+	return response, nil
+}
+
+// resolveThroughTunnel relays the query to the server's DNS resolver, using
+// a TCP port forward to protocol.TRANSPARENT_DNS_RESOLVER_HOST.
+func (proxy *DNSProxy) resolveThroughTunnel(request *dns.Msg) (*dns.Msg, error) {
+
+	conn, err := proxy.tunneler.Dial(
+		fmt.Sprintf("%s:%d", protocol.TRANSPARENT_DNS_RESOLVER_HOST, DNS_PORT),
+		true,
+		nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Port forward conns don't support deadlines, so the timeout is
+	// enforced by closing the conn.
+	closeTimer := time.AfterFunc(DNS_PROXY_UPSTREAM_TIMEOUT, func() { conn.Close() })
+	defer closeTimer.Stop()
+
+	// dns.Conn frames messages with a length prefix, as required for TCP.
+	dnsConn := &dns.Conn{Conn: conn}
+	defer dnsConn.Close()
+
+	err = dnsConn.WriteMsg(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	response, err := dnsConn.ReadMsg()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if response.Id != request.Id {
+		return nil, common.ContextError(fmt.Errorf("unexpected response ID"))
+	}
+
+	return response, nil
+}
+
+// resolveBypass resolves an A or AAAA query using the system resolver,
+// outside of the tunnel.
+//
+// When the system resolver is itself configured to use the DNS proxy, a
+// bypass query would loop back to the proxy. Such a looped query, a bypass
+// query for a name and type already being resolved, is answered with a
+// server failure.
+func (proxy *DNSProxy) resolveBypass(request *dns.Msg) (*dns.Msg, error) {
+
+	question := request.Question[0]
+
+	response := new(dns.Msg)
+	response.SetReply(request)
+
+	var network string
+	switch question.Qtype {
+	case dns.TypeA:
+		network = "ip4"
+	case dns.TypeAAAA:
+		network = "ip6"
+	default:
+		return response, nil
+	}
+
+	inFlightKey := strings.ToLower(question.Name) + "/" + network
+
+	proxy.bypassMutex.Lock()
+	looped := proxy.bypassInFlight[inFlightKey]
+	proxy.bypassInFlight[inFlightKey] = true
+	proxy.bypassMutex.Unlock()
+
+	if looped {
+		return nil, common.ContextError(errors.New("bypass query loop"))
+	}
+
+	defer func() {
+		proxy.bypassMutex.Lock()
+		delete(proxy.bypassInFlight, inFlightKey)
+		proxy.bypassMutex.Unlock()
+	}()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), DNS_PROXY_UPSTREAM_TIMEOUT)
+	defer cancelFunc()
+
+	IPs, err := net.DefaultResolver.LookupIP(
+		ctx, network, strings.TrimSuffix(question.Name, "."))
+	if err != nil {
+
+		// The system resolver doesn't distinguish between a name which
+		// doesn't exist and a name with no records of the query type, so
+		// both are answered with no records, which doesn't prevent the
+		// client from trying the other query type.
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return response, nil
+		}
+		return nil, common.ContextError(err)
+	}
+
+	for _, IP := range IPs {
+		header := dns.RR_Header{
+			Name:   question.Name,
+			Rrtype: question.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    DNS_PROXY_BYPASS_TTL,
+		}
+		if question.Qtype == dns.TypeA {
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: IP})
+		} else {
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: IP})
+		}
+	}
+
+	return response, nil
+}
+
+// isBlocked checks if name is a blocked domain or a subdomain of a blocked
+// domain.
+func (proxy *DNSProxy) isBlocked(name string) bool {
+	return isDNSSubDomain(proxy.blockedDomains, name)
+}
+
+// isBypassed checks if name is a bypass domain or a subdomain of a bypass
+// domain.
+func (proxy *DNSProxy) isBypassed(name string) bool {
+	return isDNSSubDomain(proxy.bypassDomains, name)
+}
+
+func isDNSSubDomain(domains []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, domain := range domains {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// makeDNSProxyCacheKey returns a cache key for the query. In addition to
+// the question, the key includes the query flags which affect the response
+// content.
+func makeDNSProxyCacheKey(request *dns.Msg) string {
+
+	question := request.Question[0]
+
+	dnssecOK := false
+	if opt := request.IsEdns0(); opt != nil {
+		dnssecOK = opt.Do()
+	}
+
+	return strings.Join(
+		[]string{
+			strings.ToLower(question.Name),
+			strconv.Itoa(int(question.Qtype)),
+			strconv.Itoa(int(question.Qclass)),
+			strconv.FormatBool(dnssecOK),
+			strconv.FormatBool(request.CheckingDisabled),
+		},
+		"/")
+}
+
+// getCachedResponse returns a copy of the cached response for the key, with
+// record TTLs reduced by the time elapsed since the response was cached, or
+// nil when there is no unexpired cached response.
+func (proxy *DNSProxy) getCachedResponse(cacheKey string) *dns.Msg {
+
+	now := monotime.Now()
+
+	proxy.cacheMutex.Lock()
+	defer proxy.cacheMutex.Unlock()
+
+	entry, ok := proxy.cache[cacheKey]
+	if !ok {
+		return nil
+	}
+
+	if !now.Before(entry.expiry) {
+		delete(proxy.cache, cacheKey)
+		return nil
+	}
+
+	response := entry.response.Copy()
+
+	elapsed := uint32(now.Sub(entry.created) / time.Second)
+	for _, records := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range records {
+			header := record.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+
+	return response
+}
+
+// cacheResponse caches a successful or NXDOMAIN response for the minimum
+// TTL of its records, up to DNS_PROXY_CACHE_MAX_TTL. Responses without
+// records, which have no TTL, and truncated responses are not cached.
+func (proxy *DNSProxy) cacheResponse(cacheKey string, response *dns.Msg) {
+
+	if response.Truncated ||
+		(response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	ttl := time.Duration(-1)
+	for _, records := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range records {
+			header := record.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			recordTTL := time.Duration(header.Ttl) * time.Second
+			if ttl < 0 || recordTTL < ttl {
+				ttl = recordTTL
+			}
+		}
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	if ttl > DNS_PROXY_CACHE_MAX_TTL {
+		ttl = DNS_PROXY_CACHE_MAX_TTL
+	}
+
+	now := monotime.Now()
+
+	proxy.cacheMutex.Lock()
+	defer proxy.cacheMutex.Unlock()
+
+	if len(proxy.cache) >= DNS_PROXY_CACHE_MAX_ENTRIES {
+		for key, entry := range proxy.cache {
+			if !now.Before(entry.expiry) {
+				delete(proxy.cache, key)
+			}
+		}
+		if len(proxy.cache) >= DNS_PROXY_CACHE_MAX_ENTRIES {
+			return
+		}
+	}
+
+	proxy.cache[cacheKey] = &dnsProxyCacheEntry{
+		response: response.Copy(),
+		created:  now,
+		expiry:   now.Add(ttl),
+	}
+}
+
+// truncateDNSResponse returns response when it fits within the UDP size
+// limit of the UDP query, or else returns a truncated response with the TC
+// bit set, which signals the client to retry over TCP. The size limit is
+// 512 bytes or, for EDNS queries, the requestor's advertised UDP payload
+// size.
+func truncateDNSResponse(request, response *dns.Msg) *dns.Msg {
+
+	maxSize := DNS_PROXY_DEFAULT_UDP_SIZE
+	if opt := request.IsEdns0(); opt != nil && int(opt.UDPSize()) > maxSize {
+		maxSize = int(opt.UDPSize())
+	}
+
+	response.Compress = true
+	if response.Len() <= maxSize {
+		return response
+	}
+
+	truncated := new(dns.Msg)
+	truncated.SetRcode(request, response.Rcode)
+	truncated.Truncated = true
+	if opt := response.IsEdns0(); opt != nil {
+		truncated.Extra = []dns.RR{opt}
+	}
+
+	return truncated
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+type testDNSTunneler struct {
+	resolverAddress string
+	dials           int32
+}
+
+func (tunneler *testDNSTunneler) Dial(
+	remoteAddr string, _ bool, _ net.Conn) (net.Conn, error) {
+
+	if remoteAddr != fmt.Sprintf("%s:%d", protocol.TRANSPARENT_DNS_RESOLVER_HOST, DNS_PORT) {
+		return nil, errors.New("unexpected remote address")
+	}
+	atomic.AddInt32(&tunneler.dials, 1)
+	return net.Dial("tcp", tunneler.resolverAddress)
+}
+
+func (tunneler *testDNSTunneler) DirectDial(string) (net.Conn, error) {
+	return nil, errors.New("unexpected direct dial")
+}
+
+func (tunneler *testDNSTunneler) SignalComponentFailure() {
+}
+
+func TestDNSProxy(t *testing.T) {
+
+	// Run a TCP DNS server, standing in for the server's DNS resolver. The
+	// "large." TXT response exceeds the UDP size limit.
+
+	resolverListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	resolver := &dns.Server{
+		Listener: resolverListener,
+		Handler: dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+			response := new(dns.Msg)
+			response.SetReply(request)
+			question := request.Question[0]
+			count := 1
+			if question.Name == "large.example.com." {
+				count = 20
+			}
+			for i := 0; i < count; i++ {
+				response.Answer = append(response.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{
+						Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{strings.Repeat("x", 100)},
+				})
+			}
+			writer.WriteMsg(response)
+		}),
+	}
+	go resolver.ActivateAndServe()
+	defer resolver.Shutdown()
+
+	tunneler := &testDNSTunneler{resolverAddress: resolverListener.Addr().String()}
+
+	config := &Config{
+		LocalDNSProxyBlockedDomains: []string{"blocked.example.com"},
+		LocalDNSProxyBypassDomains:  []string{"localhost"},
+	}
+
+	proxy, err := NewDNSProxy(config, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewDNSProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	proxyAddress := proxy.udpServer.PacketConn.LocalAddr().String()
+
+	queryType := func(network, name string, qtype uint16) *dns.Msg {
+		client := &dns.Client{Net: network}
+		request := new(dns.Msg)
+		request.SetQuestion(name, qtype)
+		response, _, err := client.Exchange(request, proxyAddress)
+		// ErrTruncated is returned along with a valid truncated response.
+		if err != nil && err != dns.ErrTruncated {
+			t.Fatalf("Exchange %s %s failed: %s", network, name, err)
+		}
+		return response
+	}
+
+	query := func(network, name string) *dns.Msg {
+		return queryType(network, name, dns.TypeTXT)
+	}
+
+	response := query("udp", "small.example.com.")
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+		t.Fatalf("unexpected response: %s", response)
+	}
+
+	// The second query is answered from the cache.
+
+	response = query("udp", "small.example.com.")
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+		t.Fatalf("unexpected cached response: %s", response)
+	}
+	if atomic.LoadInt32(&tunneler.dials) != 1 {
+		t.Fatalf("unexpected dial count: %d", tunneler.dials)
+	}
+
+	response = query("udp", "sub.blocked.example.com.")
+	if response.Rcode != dns.RcodeNameError {
+		t.Fatalf("unexpected blocked response: %s", response)
+	}
+	if atomic.LoadInt32(&tunneler.dials) != 1 {
+		t.Fatalf("unexpected dial count: %d", tunneler.dials)
+	}
+
+	// Bypass domains are resolved by the system resolver, without a tunnel
+	// dial.
+
+	response = queryType("udp", "localhost.", dns.TypeA)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) == 0 {
+		t.Fatalf("unexpected bypass response: %s", response)
+	}
+	if a, ok := response.Answer[0].(*dns.A); !ok || !a.A.IsLoopback() {
+		t.Fatalf("unexpected bypass answer: %s", response.Answer[0])
+	}
+	if atomic.LoadInt32(&tunneler.dials) != 1 {
+		t.Fatalf("unexpected dial count: %d", tunneler.dials)
+	}
+
+	response = query("udp", "large.example.com.")
+	if !response.Truncated || len(response.Answer) != 0 {
+		t.Fatalf("unexpected truncated response: %s", response)
+	}
+
+	response = query("tcp", "large.example.com.")
+	if response.Truncated || len(response.Answer) != 20 {
+		t.Fatalf("unexpected TCP response: %s", response)
+	}
+}
+
+func TestDNSProxySeparateTunnel(t *testing.T) {
+
+	config := &Config{
+		EnableLocalDNSProxy:         true,
+		LocalDNSProxySeparateTunnel: true,
+		TunnelPoolSize:              3,
+		TargetServerEntry:           "target",
+	}
+
+	controller := &Controller{
+		config:          config,
+		tunnelAffinity:  newTunnelAffinity(),
+		tunnelPoolSizer: newTunnelPoolSizer(config),
+	}
+
+	tunneler := &dnsTunneler{controller: controller}
+
+	newTunnel := func(ipAddress string) *Tunnel {
+		return &Tunnel{serverEntry: &protocol.ServerEntry{IpAddress: ipAddress}}
+	}
+
+	// The first tunnel is used for port forwards, and there's no DNS tunnel.
+
+	tunnel1 := newTunnel("192.168.0.1")
+	if !controller.registerTunnel(tunnel1) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if controller.getDNSTunnel() != nil {
+		t.Fatalf("unexpected DNS tunnel")
+	}
+
+	_, err := tunneler.Dial("127.0.0.1:53", true, nil)
+	if err == nil {
+		t.Fatalf("unexpected DNS dial success")
+	}
+
+	// The second tunnel is dedicated to DNS, and never used for port
+	// forwards.
+
+	tunnel2 := newTunnel("192.168.0.2")
+	tunnel3 := newTunnel("192.168.0.3")
+	if !controller.registerTunnel(tunnel2) || !controller.registerTunnel(tunnel3) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if controller.getDNSTunnel() != tunnel2 || tunnel3.isDNSTunnel {
+		t.Fatalf("unexpected DNS tunnel")
+	}
+
+	for i := 0; i < 6; i++ {
+		tunnel := controller.getNextActiveTunnel()
+		if tunnel != tunnel1 && tunnel != tunnel3 {
+			t.Fatalf("unexpected port forward tunnel: %s", tunnel.serverEntry.IpAddress)
+		}
+	}
+
+	// When only the DNS tunnel remains, it's still not used for port
+	// forwards; and a replacement tunnel is used for port forwards.
+
+	controller.tunnels = []*Tunnel{tunnel2}
+	controller.nextTunnel = 0
+
+	if controller.getNextActiveTunnel() != nil {
+		t.Fatalf("unexpected port forward tunnel")
+	}
+
+	tunnel4 := newTunnel("192.168.0.4")
+	if !controller.registerTunnel(tunnel4) {
+		t.Fatalf("registerTunnel failed")
+	}
+
+	if tunnel4.isDNSTunnel ||
+		controller.getDNSTunnel() != tunnel2 ||
+		controller.getNextActiveTunnel() != tunnel4 {
+
+		t.Fatalf("unexpected tunnel roles")
+	}
+}
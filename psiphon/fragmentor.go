@@ -22,7 +22,9 @@ package psiphon
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"net"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/fragmentor"
@@ -38,7 +40,8 @@ func NewTCPFragmentorDialer(
 	clientParameters *parameters.ClientParameters) Dialer {
 
 	p := clientParameters.Get()
-	coinFlip := p.WeightedCoinFlip(parameters.FragmentorProbability)
+	coinFlip := flipFragmentorCoin(
+		newFragmentorPRNG(config), p.Float(parameters.FragmentorProbability))
 	p = nil
 
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -72,20 +75,30 @@ func DialTCPFragmentor(
 		return conn, nil
 	}
 
+	rng := newFragmentorPRNG(config)
+
 	var coinFlip bool
 	if oneTimeCoinFlip != nil {
 		coinFlip = *oneTimeCoinFlip
 	} else {
-		coinFlip = p.WeightedCoinFlip(parameters.FragmentorProbability)
+		coinFlip = flipFragmentorCoin(rng, p.Float(parameters.FragmentorProbability))
 	}
 
 	if coinFlip {
 		return conn, nil
 	}
 
-	totalBytes, err := common.MakeSecureRandomRange(
-		p.Int(parameters.FragmentorMinTotalBytes),
-		p.Int(parameters.FragmentorMaxTotalBytes))
+	var totalBytes int
+	minTotalBytes := p.Int(parameters.FragmentorMinTotalBytes)
+	maxTotalBytes := p.Int(parameters.FragmentorMaxTotalBytes)
+	if rng != nil {
+		totalBytes = minTotalBytes
+		if maxTotalBytes > minTotalBytes {
+			totalBytes += rng.Intn(maxTotalBytes - minTotalBytes + 1)
+		}
+	} else {
+		totalBytes, err = common.MakeSecureRandomRange(minTotalBytes, maxTotalBytes)
+	}
 	if err != nil {
 		totalBytes = 0
 		NoticeAlert("MakeSecureRandomRange failed: %s", common.ContextError(err))
@@ -95,13 +108,88 @@ func DialTCPFragmentor(
 		return conn, nil
 	}
 
+	minWriteBytes := p.Int(parameters.FragmentorMinWriteBytes)
+	maxWriteBytes := p.Int(parameters.FragmentorMaxWriteBytes)
+	minDelay := p.Duration(parameters.FragmentorMinDelay)
+	maxDelay := p.Duration(parameters.FragmentorMaxDelay)
+
+	if config.ObfuscationParameters != nil {
+
+		minWriteBytes, maxWriteBytes = overrideRange(
+			minWriteBytes,
+			maxWriteBytes,
+			config.ObfuscationParameters.FragmentorMinWriteBytes,
+			config.ObfuscationParameters.FragmentorMaxWriteBytes)
+
+		minDelayMicroseconds, maxDelayMicroseconds := overrideRange(
+			int(minDelay/time.Microsecond),
+			int(maxDelay/time.Microsecond),
+			config.ObfuscationParameters.FragmentorMinDelayMicroseconds,
+			config.ObfuscationParameters.FragmentorMaxDelayMicroseconds)
+		minDelay = time.Duration(minDelayMicroseconds) * time.Microsecond
+		maxDelay = time.Duration(maxDelayMicroseconds) * time.Microsecond
+	}
+
+	noticeEmitter := func(message string) { NoticeInfo(message) }
+
+	if rng != nil {
+		return fragmentor.NewSeededConn(
+				conn,
+				noticeEmitter,
+				rng.Int63(),
+				totalBytes,
+				minWriteBytes,
+				maxWriteBytes,
+				minDelay,
+				maxDelay),
+			nil
+	}
+
 	return fragmentor.NewConn(
 			conn,
-			func(message string) { NoticeInfo(message) },
+			noticeEmitter,
 			totalBytes,
-			p.Int(parameters.FragmentorMinWriteBytes),
-			p.Int(parameters.FragmentorMaxWriteBytes),
-			p.Duration(parameters.FragmentorMinDelay),
-			p.Duration(parameters.FragmentorMaxDelay)),
+			minWriteBytes,
+			maxWriteBytes,
+			minDelay,
+			maxDelay),
 		nil
 }
+
+// newFragmentorPRNG returns a PRNG seeded with config.FragmentorSeed, or nil
+// when no seed is set, in which case secure random selections are made.
+func newFragmentorPRNG(config *DialConfig) *rand.Rand {
+	if config.FragmentorSeed == 0 {
+		return nil
+	}
+	return rand.New(rand.NewSource(config.FragmentorSeed))
+}
+
+// flipFragmentorCoin is a weighted coin flip, as in
+// ClientParametersSnapshot.WeightedCoinFlip, using rng when not nil.
+func flipFragmentorCoin(rng *rand.Rand, weight float64) bool {
+	if rng == nil {
+		return common.FlipWeightedCoin(weight)
+	}
+	return rng.Float64() > 1.0-weight
+}
+
+// overrideRange applies the optional server entry overrides to a min/max
+// range. When only one end of the range is overridden and the result is an
+// invalid range, the other end is adjusted to match the override.
+func overrideRange(min, max int, overrideMin, overrideMax *int) (int, int) {
+	if overrideMin != nil {
+		min = *overrideMin
+	}
+	if overrideMax != nil {
+		max = *overrideMax
+	}
+	if min > max {
+		if overrideMin != nil {
+			max = min
+		} else {
+			min = max
+		}
+	}
+	return min, max
+}
@@ -98,11 +98,15 @@ func NewHttpProxy(
 	tunneler Tunneler,
 	listenIP string) (proxy *HttpProxy, err error) {
 
-	listener, err := net.Listen(
-		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalHttpProxyPort))
+	listener, err := listenLocalProxy(
+		listenIP, config.LocalHttpProxyPort, config.LocalHttpProxyUnixSocketPath)
 	if err != nil {
-		if IsAddressInUseError(err) {
-			NoticeHttpProxyPortInUse(config.LocalHttpProxyPort)
+		if isLocalProxyAddressInUse(err) {
+			if config.LocalHttpProxyUnixSocketPath != "" {
+				NoticeHttpProxyUnixSocketInUse(config.LocalHttpProxyUnixSocketPath)
+			} else {
+				NoticeHttpProxyPortInUse(config.LocalHttpProxyPort)
+			}
 		}
 		return nil, common.ContextError(err)
 	}
@@ -159,8 +163,15 @@ func NewHttpProxy(
 		Jar:       nil,
 	}
 
-	proxyIP, proxyPortString, _ := net.SplitHostPort(listener.Addr().String())
-	proxyPort, _ := strconv.Atoi(proxyPortString)
+	// For a Unix domain socket listener, proxyIP and proxyPort are left
+	// unset, as the proxy has no TCP address.
+	var proxyIP string
+	var proxyPort int
+	if config.LocalHttpProxyUnixSocketPath == "" {
+		var proxyPortString string
+		proxyIP, proxyPortString, _ = net.SplitHostPort(listener.Addr().String())
+		proxyPort, _ = strconv.Atoi(proxyPortString)
+	}
 
 	proxy = &HttpProxy{
 		tunneler:               tunneler,
@@ -191,7 +202,11 @@ func NewHttpProxy(
 	// NoticeListeningHttpProxyPort after that call.
 	// Also, check the listen backlog queue length -- shouldn't it be possible
 	// to enqueue pending connections between net.Listen() and httpServer.Serve()?
-	NoticeListeningHttpProxyPort(proxy.listenPort)
+	if config.LocalHttpProxyUnixSocketPath != "" {
+		NoticeListeningHttpProxyUnixSocket(config.LocalHttpProxyUnixSocketPath)
+	} else {
+		NoticeListeningHttpProxyPort(proxy.listenPort)
+	}
 
 	return proxy, nil
 }
@@ -514,7 +529,13 @@ func (proxy *HttpProxy) relayHTTPRequest(
 
 			switch key {
 			case "m3u8":
-				err = rewriteM3U8(proxy.listenIP, proxy.listenPort, response)
+				// Rewritten URLs must reference the proxy using a TCP
+				// address, which a Unix domain socket proxy doesn't have.
+				if proxy.listenPort == 0 {
+					err = errors.New("rewrite not supported on Unix domain socket")
+				} else {
+					err = rewriteM3U8(proxy.listenIP, proxy.listenPort, response)
+				}
 			}
 
 			if err != nil {
@@ -0,0 +1,507 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	IP_ADDRESS_FAMILY_IPV4 = "IPv4"
+	IP_ADDRESS_FAMILY_IPV6 = "IPv6"
+
+	// IP_ADDRESS_FAMILY_MAX_SAMPLES bounds the recorded dial outcomes per
+	// address family. When exceeded, the counts are halved, so that the
+	// learned preference tracks recent history.
+	IP_ADDRESS_FAMILY_MAX_SAMPLES = 16
+)
+
+// ipAddressFamilyPreference selects which IP address family, IPv4 or IPv6,
+// is dialed first when a TCP dial address resolves to both families.
+//
+// On networks where IPv6 is present but broken, or where IPv4 is degraded,
+// for example by carrier-grade NAT, dialing the other family first reduces
+// connect latency. The preferred family is the PreferredIPAddressFamily
+// parameter, when set, or else is learned from the success and failure of
+// recent dials of each family on the current network. Dial outcomes are
+// recorded per network ID and persisted in the datastore.
+//
+// When a family is preferred, the dial races the families: the preferred
+// family is dialed first, and the other family is dialed after
+// IPAddressFamilyFallbackDelay or once the preferred family fails. The
+// first family to connect wins, which is recorded as a failure for the
+// other family. When no family is preferred, addresses are dialed serially,
+// in random order, as before.
+//
+// Some networks reset, or refuse, connections of one family while allowing
+// the other. When a dial fails with a connection reset or refused error,
+// the other family is retried immediately, instead of after any remaining
+// addresses of the failed family or after the fallback delay, up to
+// DialConfig.IPAddressFamilyResetRetries times per dial.
+//
+// Starting the other family after the fallback delay, while the preferred
+// family dial is still in progress, requires an additional connection
+// attempt slot. When no slot is available, the other family is dialed only
+// once the preferred family fails. See connectionAttemptLimiter.
+type ipAddressFamilyPreference struct {
+	config *Config
+	mutex  sync.Mutex
+	states map[string]*ipAddressFamilyState
+}
+
+// ipAddressFamilyState is the persisted dial outcome history for a single
+// network.
+type ipAddressFamilyState struct {
+	Successes map[string]int `json:"successes"`
+	Failures  map[string]int `json:"failures"`
+}
+
+func newIPAddressFamilyPreference(config *Config) *ipAddressFamilyPreference {
+	return &ipAddressFamilyPreference{
+		config: config,
+		states: make(map[string]*ipAddressFamilyState),
+	}
+}
+
+func getIPAddressFamily(IP net.IP) string {
+	if IP.To4() != nil {
+		return IP_ADDRESS_FAMILY_IPV4
+	}
+	return IP_ADDRESS_FAMILY_IPV6
+}
+
+// isConnectionResetError indicates whether a dial error is an immediate
+// connection reset or connection refused. As dial errors are wrapped by
+// common.ContextError, the error message is checked.
+func isConnectionResetError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, syscall.ECONNRESET.Error()) ||
+		strings.Contains(message, syscall.ECONNREFUSED.Error())
+}
+
+// ipAddressFamilyResetRetries tracks the IP address family reset retries
+// remaining for a single dial.
+type ipAddressFamilyResetRetries struct {
+	remaining int32
+	callback  func()
+}
+
+func newIPAddressFamilyResetRetries(config *DialConfig) *ipAddressFamilyResetRetries {
+	if config.IPAddressFamilyResetRetries <= 0 {
+		return nil
+	}
+	return &ipAddressFamilyResetRetries{
+		remaining: int32(config.IPAddressFamilyResetRetries),
+		callback:  config.IPAddressFamilyResetRetryCallback,
+	}
+}
+
+// take consumes a retry when err is a connection reset error and a retry
+// remains. The caller must only call take when the other family may be
+// dialed.
+func (retries *ipAddressFamilyResetRetries) take(err error) bool {
+	if retries == nil || !isConnectionResetError(err) {
+		return false
+	}
+	if atomic.AddInt32(&retries.remaining, -1) < 0 {
+		return false
+	}
+	if retries.callback != nil {
+		retries.callback()
+	}
+	return true
+}
+
+// getState returns the dial outcome history for the current network,
+// loading any persisted history. The caller must lock the mutex.
+func (preference *ipAddressFamilyPreference) getState() (string, *ipAddressFamilyState) {
+
+	// As with protocol health, when no NetworkIDGetter is configured, all
+	// history is recorded under a single, blank network ID.
+	networkID := ""
+	if preference.config.networkIDGetter != nil {
+		networkID = preference.config.networkIDGetter.GetNetworkID()
+	}
+
+	state, ok := preference.states[networkID]
+	if ok {
+		return networkID, state
+	}
+
+	state = &ipAddressFamilyState{}
+
+	record, err := getIPAddressFamilyRecord(networkID)
+	if err != nil {
+		NoticeAlert("getIPAddressFamilyRecord failed: %s", err)
+	} else if record != nil {
+		err = json.Unmarshal(record, state)
+		if err != nil {
+			NoticeAlert("invalid IP address family record: %s", common.ContextError(err))
+			state = &ipAddressFamilyState{}
+		}
+	}
+
+	if state.Successes == nil {
+		state.Successes = make(map[string]int)
+	}
+	if state.Failures == nil {
+		state.Failures = make(map[string]int)
+	}
+
+	preference.states[networkID] = state
+
+	return networkID, state
+}
+
+// getPreferredFamily returns the preferred IP address family, or "" when
+// neither family is preferred. The learned preference is the family with
+// the higher recent success rate; a family with no recorded dials has a
+// success rate of 0.5.
+func (preference *ipAddressFamilyPreference) getPreferredFamily() string {
+
+	if preference == nil {
+		return ""
+	}
+
+	p := preference.config.GetClientParameters()
+	preferredFamily := p.String(parameters.PreferredIPAddressFamily)
+	learn := p.Bool(parameters.IPAddressFamilyLearning)
+
+	if preferredFamily == IP_ADDRESS_FAMILY_IPV4 || preferredFamily == IP_ADDRESS_FAMILY_IPV6 {
+		return preferredFamily
+	}
+
+	if !learn {
+		return ""
+	}
+
+	preference.mutex.Lock()
+	defer preference.mutex.Unlock()
+
+	_, state := preference.getState()
+
+	successRate := func(family string) float64 {
+		successes := state.Successes[family]
+		total := successes + state.Failures[family]
+		if total == 0 {
+			return 0.5
+		}
+		return float64(successes) / float64(total)
+	}
+
+	IPv4SuccessRate := successRate(IP_ADDRESS_FAMILY_IPV4)
+	IPv6SuccessRate := successRate(IP_ADDRESS_FAMILY_IPV6)
+
+	if IPv4SuccessRate > IPv6SuccessRate {
+		return IP_ADDRESS_FAMILY_IPV4
+	} else if IPv6SuccessRate > IPv4SuccessRate {
+		return IP_ADDRESS_FAMILY_IPV6
+	}
+	return ""
+}
+
+// recordOutcome records a dial success or failure for the specified IP
+// address family on the current network.
+func (preference *ipAddressFamilyPreference) recordOutcome(family string, success bool) {
+
+	if preference == nil ||
+		!preference.config.GetClientParameters().Bool(parameters.IPAddressFamilyLearning) {
+		return
+	}
+
+	preference.mutex.Lock()
+	defer preference.mutex.Unlock()
+
+	networkID, state := preference.getState()
+
+	if success {
+		state.Successes[family] += 1
+	} else {
+		state.Failures[family] += 1
+	}
+
+	if state.Successes[family]+state.Failures[family] > IP_ADDRESS_FAMILY_MAX_SAMPLES {
+		state.Successes[family] /= 2
+		state.Failures[family] /= 2
+	}
+
+	record, err := json.Marshal(state)
+	if err != nil {
+		NoticeAlert("marshal IP address family record failed: %s", common.ContextError(err))
+		return
+	}
+
+	err = setIPAddressFamilyRecord(networkID, record)
+	if err != nil {
+		NoticeAlert("setIPAddressFamilyRecord failed: %s", err)
+	}
+}
+
+// dialIPAddresses dials the resolved IPs for a TCP dial address using
+// dialIP, ordering and racing the IP address families according to the
+// DialConfig ipAddressFamilyPreference, and retrying the other family on
+// connection resets according to DialConfig.IPAddressFamilyResetRetries.
+func dialIPAddresses(
+	ctx context.Context,
+	IPs []net.IP,
+	config *DialConfig,
+	dialIP func(context.Context, net.IP) (net.Conn, error)) (net.Conn, error) {
+
+	preference := config.ipAddressFamilyPreference
+	resetRetries := newIPAddressFamilyResetRetries(config)
+	preferredFamily := preference.getPreferredFamily()
+
+	// Iterate over a pseudorandom permutation of the destination IPs.
+
+	var primaryIPs, fallbackIPs []net.IP
+	families := make(map[string]bool)
+	for _, index := range rand.Perm(len(IPs)) {
+		IP := IPs[index]
+		family := getIPAddressFamily(IP)
+		families[family] = true
+		if preferredFamily == "" || family == preferredFamily {
+			primaryIPs = append(primaryIPs, IP)
+		} else {
+			fallbackIPs = append(fallbackIPs, IP)
+		}
+	}
+
+	if len(primaryIPs) == 0 || len(fallbackIPs) == 0 {
+
+		// There's no race when only one family is to be dialed. Dial outcomes
+		// are recorded only when the dial address resolves to both families,
+		// as otherwise the outcome says nothing about which family to prefer.
+		// Dials interrupted by the dial context being canceled are not
+		// recorded, while timeouts are recorded as failures.
+
+		var recordOutcome func(net.IP, error)
+		if len(families) > 1 {
+			recordOutcome = func(IP net.IP, err error) {
+				if err == nil || ctx.Err() != context.Canceled {
+					preference.recordOutcome(getIPAddressFamily(IP), err == nil)
+				}
+			}
+		}
+
+		return dialIPsSerially(
+			ctx, append(primaryIPs, fallbackIPs...), dialIP, recordOutcome, resetRetries)
+	}
+
+	fallbackDelay := config.IPAddressFamilyFallbackDelay
+
+	raceCtx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	type dialResult struct {
+		conn   net.Conn
+		err    error
+		family string
+	}
+
+	results := make(chan dialResult, 2)
+
+	dialFamily := func(IPs []net.IP, releaseSlot bool) {
+		if releaseSlot {
+			defer config.connectionAttempts.release()
+		}
+		conn, err := dialIPsSerially(raceCtx, IPs, dialIP, nil, nil)
+		results <- dialResult{conn: conn, err: err, family: getIPAddressFamily(IPs[0])}
+	}
+
+	// When a primary family dial is reset, the remaining primary IPs are
+	// abandoned, by canceling the primary family dial context, and the
+	// primary failure immediately starts the fallback family dial.
+
+	go func() {
+		primaryCtx, primaryCancelFunc := context.WithCancel(raceCtx)
+		defer primaryCancelFunc()
+		conn, err := dialIPsSerially(
+			primaryCtx,
+			primaryIPs,
+			func(ctx context.Context, IP net.IP) (net.Conn, error) {
+				conn, err := dialIP(ctx, IP)
+				if resetRetries.take(err) {
+					primaryCancelFunc()
+				}
+				return conn, err
+			},
+			nil,
+			nil)
+		results <- dialResult{conn: conn, err: err, family: getIPAddressFamily(primaryIPs[0])}
+	}()
+	pendingCount := 1
+
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+	fallbackStarted := false
+
+	// A fallback started after a primary failure uses the primary's slot.
+
+	startFallback := func(racing bool) {
+		if fallbackStarted {
+			return
+		}
+		if racing && !config.connectionAttempts.tryAcquire() {
+			return
+		}
+		fallbackStarted = true
+		go dialFamily(fallbackIPs, racing)
+		pendingCount += 1
+	}
+
+	drainResults := func(count int) {
+		for i := 0; i < count; i++ {
+			result := <-results
+			if result.conn != nil {
+				result.conn.Close()
+			}
+		}
+	}
+
+	var firstErr error
+	failedFamilies := make(map[string]bool)
+
+	for {
+		select {
+
+		case <-fallbackTimer.C:
+			startFallback(true)
+
+		case result := <-results:
+			pendingCount -= 1
+
+			if result.err == nil {
+
+				// The winning family succeeded and any other started family,
+				// which hasn't already failed, lost the race.
+				cancelFunc()
+				preference.recordOutcome(result.family, true)
+				if fallbackStarted {
+					for family := range families {
+						if family != result.family && !failedFamilies[family] {
+							preference.recordOutcome(family, false)
+						}
+					}
+				}
+
+				// Close any conn established by the losing family.
+				go drainResults(pendingCount)
+
+				return result.conn, nil
+			}
+
+			if ctx.Err() != context.Canceled {
+				preference.recordOutcome(result.family, false)
+			}
+			failedFamilies[result.family] = true
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+
+			if ctx.Err() != nil {
+				drainResults(pendingCount)
+				return nil, common.ContextError(firstErr)
+			}
+
+			if !fallbackStarted {
+				startFallback(false)
+			} else if pendingCount == 0 {
+				return nil, common.ContextError(firstErr)
+			}
+		}
+	}
+}
+
+// dialIPsSerially dials each IP in turn until a dial succeeds or the dial
+// context is done. recordOutcome, when not nil, is called with the outcome
+// of each dial. When resetRetries is not nil and a dial is reset, the next
+// remaining IP of the other family, if any, is dialed next.
+//
+// Unlike net.Dial, the dial context deadline isn't fractionalized, as the
+// dial is generally intended to apply to a single attempt. So these serial
+// retries are most useful in cases of immediate failure, such as "no route
+// to host" errors when a host resolves to both IPv4 and IPv6 but IPv6
+// addresses are unreachable.
+func dialIPsSerially(
+	ctx context.Context,
+	IPs []net.IP,
+	dialIP func(context.Context, net.IP) (net.Conn, error),
+	recordOutcome func(net.IP, error),
+	resetRetries *ipAddressFamilyResetRetries) (net.Conn, error) {
+
+	lastErr := errors.New("no IP address")
+
+	// Copy IPs, which may be reordered.
+	IPs = append([]net.IP(nil), IPs...)
+
+	for i := 0; i < len(IPs); i++ {
+
+		IP := IPs[i]
+
+		conn, err := dialIP(ctx, IP)
+
+		if recordOutcome != nil {
+			recordOutcome(IP, err)
+		}
+
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+
+		if ctx.Err() != nil {
+			// Skip retry as dial context has timed out or been canceled.
+			break
+		}
+
+		if resetRetries != nil {
+			family := getIPAddressFamily(IP)
+			for j := i + 1; j < len(IPs); j++ {
+				if getIPAddressFamily(IPs[j]) != family {
+					if resetRetries.take(err) {
+						alternateIP := IPs[j]
+						copy(IPs[i+2:j+1], IPs[i+1:j])
+						IPs[i+1] = alternateIP
+					}
+					break
+				}
+			}
+		}
+	}
+
+	return nil, common.ContextError(lastErr)
+}
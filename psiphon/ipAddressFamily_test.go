@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestIPAddressFamilyPreference(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-ip-address-family-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "NetworkID" : "NETWORK1"
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	IPv4 := net.ParseIP("192.0.2.1")
+	IPv6 := net.ParseIP("2001:db8::1")
+	IPs := []net.IP{IPv4, IPv6}
+
+	fallbackDelay := 100 * time.Millisecond
+
+	dialConfig := &DialConfig{
+		IPAddressFamilyFallbackDelay: fallbackDelay,
+		ipAddressFamilyPreference:    newIPAddressFamilyPreference(clientConfig),
+	}
+
+	// dialIP connects IPv4 addresses and, when brokenIPv6 is set, hangs on
+	// IPv6 addresses until the dial context is done.
+
+	brokenIPv6 := true
+
+	dialIP := func(ctx context.Context, IP net.IP) (net.Conn, error) {
+		if getIPAddressFamily(IP) == IP_ADDRESS_FAMILY_IPV6 && brokenIPv6 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+
+	// With no dial history, neither family is preferred.
+
+	if dialConfig.ipAddressFamilyPreference.getPreferredFamily() != "" {
+		t.Fatalf("unexpected initial preferred family")
+	}
+
+	// A configured preference is dialed first, and the other family is
+	// dialed after the fallback delay.
+
+	err = clientConfig.SetClientParameters(
+		"", true, map[string]interface{}{
+			parameters.PreferredIPAddressFamily: IP_ADDRESS_FAMILY_IPV6,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	startTime := time.Now()
+	conn, err := dialIPAddresses(context.Background(), IPs, dialConfig, dialIP)
+	if err != nil {
+		t.Fatalf("dialIPAddresses failed: %s", err)
+	}
+	conn.Close()
+	if time.Since(startTime) < fallbackDelay {
+		t.Fatalf("fallback dialed before delay")
+	}
+
+	// The lost race is a recorded failure for IPv6, so IPv4 is learned as
+	// the preferred family.
+
+	err = clientConfig.SetClientParameters("", true, nil)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	if dialConfig.ipAddressFamilyPreference.getPreferredFamily() != IP_ADDRESS_FAMILY_IPV4 {
+		t.Fatalf("unexpected learned preferred family")
+	}
+
+	// The preferred family connects without waiting for the fallback delay.
+
+	startTime = time.Now()
+	conn, err = dialIPAddresses(context.Background(), IPs, dialConfig, dialIP)
+	if err != nil {
+		t.Fatalf("dialIPAddresses failed: %s", err)
+	}
+	conn.Close()
+	if time.Since(startTime) >= fallbackDelay {
+		t.Fatalf("preferred family dial delayed")
+	}
+
+	// The learned preference is persisted for the network.
+
+	preference := newIPAddressFamilyPreference(clientConfig)
+	if preference.getPreferredFamily() != IP_ADDRESS_FAMILY_IPV4 {
+		t.Fatalf("unexpected persisted preferred family")
+	}
+
+	// When the preferred family fails, the fallback is dialed immediately.
+
+	failingDialIP := func(ctx context.Context, IP net.IP) (net.Conn, error) {
+		if getIPAddressFamily(IP) == IP_ADDRESS_FAMILY_IPV4 {
+			return nil, errors.New("no route to host")
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+
+	startTime = time.Now()
+	conn, err = dialIPAddresses(context.Background(), IPs, dialConfig, failingDialIP)
+	if err != nil {
+		t.Fatalf("dialIPAddresses failed: %s", err)
+	}
+	conn.Close()
+	if time.Since(startTime) >= fallbackDelay {
+		t.Fatalf("fallback dial delayed")
+	}
+
+	// When both families fail, the dial fails.
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), fallbackDelay/2)
+	defer cancelFunc()
+
+	_, err = dialIPAddresses(
+		ctx, IPs, dialConfig,
+		func(ctx context.Context, IP net.IP) (net.Conn, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	if err == nil {
+		t.Fatalf("unexpected dialIPAddresses success")
+	}
+
+	// With learning disabled and no configured preference, neither family
+	// is preferred.
+
+	err = clientConfig.SetClientParameters(
+		"", true, map[string]interface{}{
+			parameters.IPAddressFamilyLearning: false,
+		})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	if dialConfig.ipAddressFamilyPreference.getPreferredFamily() != "" {
+		t.Fatalf("unexpected preferred family with learning disabled")
+	}
+}
+
+func TestIPAddressFamilyResetRetry(t *testing.T) {
+
+	IPs := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("192.0.2.3"),
+		net.ParseIP("2001:db8::1"),
+	}
+
+	// dialIP refuses IPv4 connections and connects IPv6 addresses.
+
+	var IPv4Dials int
+
+	dialIP := func(ctx context.Context, IP net.IP) (net.Conn, error) {
+		if getIPAddressFamily(IP) == IP_ADDRESS_FAMILY_IPV4 {
+			IPv4Dials += 1
+			return nil, common.ContextError(syscall.ECONNREFUSED)
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+
+	retries := 0
+
+	dialConfig := &DialConfig{
+		IPAddressFamilyResetRetries:       1,
+		IPAddressFamilyResetRetryCallback: func() { retries += 1 },
+	}
+
+	// Whatever the random dial order, a refused IPv4 dial is followed by
+	// the IPv6 dial.
+
+	for i := 0; i < 10; i++ {
+
+		IPv4Dials = 0
+		retries = 0
+
+		conn, err := dialIPAddresses(context.Background(), IPs, dialConfig, dialIP)
+		if err != nil {
+			t.Fatalf("dialIPAddresses failed: %s", err)
+		}
+		conn.Close()
+
+		if IPv4Dials > 1 || retries != IPv4Dials {
+			t.Fatalf("unexpected dials: %d, %d", IPv4Dials, retries)
+		}
+	}
+
+	// Other errors don't consume retries.
+
+	otherErrorDialIP := func(ctx context.Context, IP net.IP) (net.Conn, error) {
+		return nil, errors.New("no route to host")
+	}
+
+	retries = 0
+
+	_, err := dialIPAddresses(context.Background(), IPs, dialConfig, otherErrorDialIP)
+	if err == nil {
+		t.Fatalf("unexpected dialIPAddresses success")
+	}
+
+	if retries != 0 {
+		t.Fatalf("unexpected retries: %d", retries)
+	}
+
+	// With retries disabled, all IPs are still dialed.
+
+	dialConfig.IPAddressFamilyResetRetries = 0
+
+	IPv6Dials := 0
+
+	_, err = dialIPAddresses(
+		context.Background(), IPs, dialConfig,
+		func(ctx context.Context, IP net.IP) (net.Conn, error) {
+			if getIPAddressFamily(IP) == IP_ADDRESS_FAMILY_IPV6 {
+				IPv6Dials += 1
+			}
+			return nil, common.ContextError(syscall.ECONNRESET)
+		})
+	if err == nil {
+		t.Fatalf("unexpected dialIPAddresses success")
+	}
+
+	if IPv6Dials != 1 || retries != 0 {
+		t.Fatalf("unexpected dials: %d, %d", IPv6Dials, retries)
+	}
+}
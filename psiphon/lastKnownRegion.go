@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// LastKnownRegion is the client region, as determined by the server and
+// reported to the client in the handshake, most recently learned by the
+// client. The region is persisted, so that it remains available while the
+// client is offline and across restarts.
+//
+// The region may be stale, as the device may have moved since the region
+// was learned. Stale is false only when the region was reported in a
+// handshake made by the current controller; Timestamp is when the region
+// was reported.
+type LastKnownRegion struct {
+	Region    string `json:"region"`
+	Timestamp string `json:"timestamp"`
+	Stale     bool   `json:"stale"`
+}
+
+type lastKnownRegionRecord struct {
+	Region    string `json:"region"`
+	Timestamp string `json:"timestamp"`
+}
+
+// recordLastKnownRegion records the client region reported in a handshake,
+// both for the current controller and in the datastore. Failure to store
+// the region is not fatal.
+func (config *Config) recordLastKnownRegion(region string) {
+
+	if region == "" {
+		return
+	}
+
+	record := &lastKnownRegionRecord{
+		Region:    region,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	config.dynamicConfigMutex.Lock()
+	config.lastKnownRegion = record
+	config.dynamicConfigMutex.Unlock()
+
+	value, err := json.Marshal(record)
+	if err == nil {
+		err = setLastKnownRegionRecord(value)
+	}
+	if err != nil {
+		NoticeAlert("store last known region failed: %s", common.ContextError(err))
+	}
+}
+
+// loadLastKnownRegion loads the persisted last known client region, which
+// is nil when no region has been recorded.
+func loadLastKnownRegion() (*lastKnownRegionRecord, error) {
+
+	value, err := getLastKnownRegionRecord()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if value == nil {
+		return nil, nil
+	}
+
+	var record lastKnownRegionRecord
+	err = json.Unmarshal(value, &record)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &record, nil
+}
+
+// getRegionHint returns the region hint used to select initial limit
+// tunnel protocols: Config.RegionHint or, when not set, the persisted last
+// known region loaded when the controller was created.
+func (config *Config) getRegionHint() string {
+
+	if config.RegionHint != "" {
+		return config.RegionHint
+	}
+
+	config.dynamicConfigMutex.Lock()
+	defer config.dynamicConfigMutex.Unlock()
+
+	return config.storedLastKnownRegion
+}
+
+// GetLastKnownRegion returns the last known client region, or nil when no
+// region has been learned. Returned regions not reported during the
+// current controller's lifetime are marked as stale. See LastKnownRegion.
+func (controller *Controller) GetLastKnownRegion() *LastKnownRegion {
+
+	config := controller.config
+
+	config.dynamicConfigMutex.Lock()
+	record := config.lastKnownRegion
+	config.dynamicConfigMutex.Unlock()
+
+	stale := false
+
+	if record == nil {
+		var err error
+		record, err = loadLastKnownRegion()
+		if err != nil {
+			NoticeAlert("load last known region failed: %s", err)
+			return nil
+		}
+		if record == nil {
+			return nil
+		}
+		stale = true
+	}
+
+	return &LastKnownRegion{
+		Region:    record.Region,
+		Timestamp: record.Timestamp,
+		Stale:     stale,
+	}
+}
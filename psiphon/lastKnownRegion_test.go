@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestLastKnownRegion(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-last-known-region-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	makeConfig := func() *Config {
+		clientConfigJSON := `
+        {
+            "ClientPlatform" : "Windows",
+            "ClientVersion" : "0",
+            "SponsorId" : "0",
+            "PropagationChannelId" : "0",
+            "DisableRemoteServerListFetcher" : true
+        }`
+		clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+		if err != nil {
+			t.Fatalf("error processing configuration file: %s", err)
+		}
+		clientConfig.DataStoreDirectory = testDataDirName
+		err = clientConfig.Commit()
+		if err != nil {
+			t.Fatalf("error committing configuration file: %s", err)
+		}
+		return clientConfig
+	}
+
+	clientConfig := makeConfig()
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	controller, err := NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+
+	if controller.GetLastKnownRegion() != nil {
+		t.Fatalf("unexpected last known region")
+	}
+
+	// A region reported during the controller's lifetime is current.
+
+	clientConfig.recordLastKnownRegion("CA")
+
+	region := controller.GetLastKnownRegion()
+	if region == nil || region.Region != "CA" || region.Stale || region.Timestamp == "" {
+		t.Fatalf("unexpected last known region: %+v", region)
+	}
+
+	// A new controller loads the persisted region, which is stale, and uses
+	// it as the region hint.
+
+	clientConfig = makeConfig()
+
+	controller, err = NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+
+	region = controller.GetLastKnownRegion()
+	if region == nil || region.Region != "CA" || !region.Stale {
+		t.Fatalf("unexpected last known region: %+v", region)
+	}
+
+	applyParameters := map[string]interface{}{
+		parameters.RegionHintInitialLimitTunnelProtocols: parameters.RegionTunnelProtocols{
+			"CA": {protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+		},
+	}
+	err = clientConfig.SetClientParameters("", false, applyParameters)
+	if err != nil {
+		t.Fatalf("error setting client parameters: %s", err)
+	}
+
+	state := newLimitTunnelProtocolsState(
+		clientConfig, clientConfig.clientParameters.Get())
+	if len(state.initialProtocols) != 1 ||
+		state.initialProtocols[0] != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+		t.Fatalf("unexpected initial limit: %v", state.initialProtocols)
+	}
+
+	// Config.RegionHint takes precedence.
+
+	clientConfig.RegionHint = "US"
+
+	state = newLimitTunnelProtocolsState(
+		clientConfig, clientConfig.clientParameters.Get())
+	if len(state.initialProtocols) != 0 {
+		t.Fatalf("unexpected initial limit: %v", state.initialProtocols)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -208,3 +209,109 @@ func TestLimitTunnelProtocols(t *testing.T) {
 		t.Fatalf("unexpected connecting count")
 	}
 }
+
+func TestRegionHintInitialLimitTunnelProtocols(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-region-hint-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "RegionHint" : "ca"
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	regionProtocols := parameters.RegionTunnelProtocols{
+		"CA": {"OSSH", "UNFRONTED-MEEK-OSSH"},
+		"US": {"SSH"},
+	}
+
+	testCases := []struct {
+		description       string
+		tag               string
+		applyParameters   map[string]interface{}
+		expectedProtocols protocol.TunnelProtocols
+		expectedCount     int
+	}{
+		{
+			"region hint",
+			"",
+			map[string]interface{}{},
+			protocol.TunnelProtocols{"OSSH", "UNFRONTED-MEEK-OSSH"},
+			5,
+		},
+		{
+			"region hint restricted to limit",
+			"",
+			map[string]interface{}{
+				parameters.LimitTunnelProtocols: protocol.TunnelProtocols{"OSSH", "SSH"},
+			},
+			protocol.TunnelProtocols{"OSSH"},
+			5,
+		},
+		{
+			"initial limit set",
+			"",
+			map[string]interface{}{
+				parameters.InitialLimitTunnelProtocols:               protocol.TunnelProtocols{"SSH"},
+				parameters.InitialLimitTunnelProtocolsCandidateCount: 20,
+			},
+			protocol.TunnelProtocols{"SSH"},
+			20,
+		},
+		{
+			"tactics applied",
+			"tactics-tag",
+			map[string]interface{}{},
+			protocol.TunnelProtocols{},
+			0,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			applyParameters := map[string]interface{}{
+				parameters.RegionHintInitialLimitTunnelProtocols: regionProtocols,
+				parameters.RegionHintInitialLimitCandidateCount:  5,
+			}
+			for name, value := range testCase.applyParameters {
+				applyParameters[name] = value
+			}
+
+			err := clientConfig.SetClientParameters(testCase.tag, false, applyParameters)
+			if err != nil {
+				t.Fatalf("error setting client parameters: %s", err)
+			}
+
+			state := newLimitTunnelProtocolsState(
+				clientConfig, clientConfig.clientParameters.Get())
+
+			if len(state.initialProtocols) != len(testCase.expectedProtocols) ||
+				(len(state.initialProtocols) > 0 &&
+					!reflect.DeepEqual(state.initialProtocols, testCase.expectedProtocols)) ||
+				state.initialCandidateCount != testCase.expectedCount {
+
+				t.Fatalf("unexpected initial limit: %v %d",
+					state.initialProtocols, state.initialCandidateCount)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// LOCAL_PROXY_UNIX_SOCKET_PERMISSIONS restricts local proxy Unix domain
+// socket access to the user running the client.
+const LOCAL_PROXY_UNIX_SOCKET_PERMISSIONS = 0600
+
+// listenLocalProxy creates a listener for a local proxy. When unixSocketPath
+// is set, the listener is a Unix domain socket at that path; otherwise the
+// listener is a TCP listener on listenIP and port.
+//
+// Unix domain sockets are created with LOCAL_PROXY_UNIX_SOCKET_PERMISSIONS.
+// A stale socket file left behind by a previous client process is replaced,
+// but a socket in use by another process is not. The socket file is removed
+// when the listener is closed.
+//
+// Listen errors are returned unwrapped, so that callers may check
+// isLocalProxyAddressInUse.
+func listenLocalProxy(
+	listenIP string, port int, unixSocketPath string) (net.Listener, error) {
+
+	if unixSocketPath == "" {
+		return net.Listen("tcp", fmt.Sprintf("%s:%d", listenIP, port))
+	}
+
+	err := removeStaleUnixSocket(unixSocketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", unixSocketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Note: the socket is briefly accessible, according to the process
+	// umask, between creation and this chmod. Embedders requiring stricter
+	// guarantees should place the socket in a directory accessible only to
+	// the user running the client.
+	err = os.Chmod(unixSocketPath, LOCAL_PROXY_UNIX_SOCKET_PERMISSIONS)
+	if err != nil {
+		listener.Close()
+		return nil, common.ContextError(err)
+	}
+
+	return listener, nil
+}
+
+// isLocalProxyAddressInUse indicates whether a listenLocalProxy error is due
+// to the TCP port or Unix domain socket already being in use.
+func isLocalProxyAddressInUse(err error) bool {
+	return err == errUnixSocketInUse || IsAddressInUseError(err)
+}
+
+var errUnixSocketInUse = errors.New("Unix domain socket in use")
+
+func removeStaleUnixSocket(unixSocketPath string) error {
+
+	fileInfo, err := os.Lstat(unixSocketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// Don't remove anything other than a socket, in case the path is
+	// misconfigured.
+	if fileInfo.Mode()&os.ModeSocket == 0 {
+		return common.ContextError(
+			fmt.Errorf("not a Unix domain socket: %s", unixSocketPath))
+	}
+
+	conn, err := net.Dial("unix", unixSocketPath)
+	if err == nil {
+		conn.Close()
+		return errUnixSocketInUse
+	}
+
+	err = os.Remove(unixSocketPath)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
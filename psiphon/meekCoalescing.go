@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// meekTransportKey identifies HTTPS meek transports which may be shared:
+// the front address and the TLS configuration of the connections dialed by
+// the transport. Requests are routed to the meek server by the Host header
+// and session token of each request, so MeekConns with different meek
+// servers behind the same front may share a transport.
+type meekTransportKey struct {
+	dialAddress                 string
+	sniServerName               string
+	tlsProfile                  string
+	useObfuscatedSessionTickets bool
+	obfuscatedKey               string
+	verificationPolicy          string
+	verificationPins            string
+	nextProtos                  string
+	upstreamProxyURL            string
+}
+
+func makeMeekTransportKey(
+	meekConfig *MeekConfig,
+	dialConfig *DialConfig,
+	nextProtos []string) meekTransportKey {
+
+	key := meekTransportKey{
+		dialAddress:                 meekConfig.DialAddress,
+		sniServerName:               meekConfig.SNIServerName,
+		tlsProfile:                  meekConfig.TLSProfile,
+		useObfuscatedSessionTickets: meekConfig.UseObfuscatedSessionTickets,
+		nextProtos:                  strings.Join(nextProtos, ","),
+		upstreamProxyURL:            dialConfig.UpstreamProxyURL,
+	}
+	if meekConfig.UseObfuscatedSessionTickets {
+		key.obfuscatedKey = meekConfig.MeekObfuscatedKey
+	}
+	if meekConfig.FrontingTLSVerification != nil {
+		key.verificationPolicy = meekConfig.FrontingTLSVerification.Policy
+		key.verificationPins = strings.Join(meekConfig.FrontingTLSVerification.Pins, ",")
+	}
+	return key
+}
+
+// meekSharedTransport is an HTTPS meek transport shared by concurrent
+// MeekConns with the same meekTransportKey, when MeekCoalesceConnections is
+// set. As a browser does, requests to the front reuse established
+// connections: with HTTP/2, all requests are multiplexed over a single
+// connection; with HTTP/1.1, idle connections are reused.
+//
+// Each request retains its own Host header, session token, and body, so the
+// meek session framing of each MeekConn is unchanged. The transport, and its
+// TLS dialer, are those of the first MeekConn, including the dial
+// configuration and the negotiated application protocol; subsequent
+// MeekConns skip the TLS pre-dial.
+//
+// The shared transport is closed when the last MeekConn using it is closed.
+type meekSharedTransport struct {
+	key             meekTransportKey
+	transport       transporter
+	cachedTLSDialer *cachedTLSDialer
+	stopRunning     context.CancelFunc
+	referenceCount  int
+}
+
+var meekSharedTransports = struct {
+	mutex      sync.Mutex
+	transports map[meekTransportKey]*meekSharedTransport
+}{
+	transports: make(map[meekTransportKey]*meekSharedTransport),
+}
+
+// getMeekSharedTransport returns the shared transport for key, adding a
+// reference, or nil when there is no shared transport.
+func getMeekSharedTransport(key meekTransportKey) *meekSharedTransport {
+
+	meekSharedTransports.mutex.Lock()
+	defer meekSharedTransports.mutex.Unlock()
+
+	shared, ok := meekSharedTransports.transports[key]
+	if !ok {
+		return nil
+	}
+	shared.referenceCount += 1
+	return shared
+}
+
+// addMeekSharedTransport shares transport, and its cachedTLSDialer, using
+// key. The returned shared transport has one reference. When another
+// transport was concurrently shared using the same key, nil is returned and
+// the caller retains ownership of transport.
+func addMeekSharedTransport(
+	key meekTransportKey,
+	transport transporter,
+	cachedTLSDialer *cachedTLSDialer) *meekSharedTransport {
+
+	meekSharedTransports.mutex.Lock()
+	defer meekSharedTransports.mutex.Unlock()
+
+	if _, ok := meekSharedTransports.transports[key]; ok {
+		return nil
+	}
+
+	// Dials by the shared transport can't use the request context of any one
+	// MeekConn, as that context is cancelled when the MeekConn is closed, so
+	// dials are made in the context of the shared transport.
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	cachedTLSDialer.setRequestContext(runCtx)
+
+	shared := &meekSharedTransport{
+		key:             key,
+		transport:       transport,
+		cachedTLSDialer: cachedTLSDialer,
+		stopRunning:     stopRunning,
+		referenceCount:  1,
+	}
+	meekSharedTransports.transports[key] = shared
+	return shared
+}
+
+// release removes a reference to the shared transport, closing the
+// transport when no references remain.
+func (shared *meekSharedTransport) release() {
+
+	meekSharedTransports.mutex.Lock()
+	shared.referenceCount -= 1
+	closeTransport := shared.referenceCount == 0
+	if closeTransport {
+		delete(meekSharedTransports.transports, shared.key)
+	}
+	meekSharedTransports.mutex.Unlock()
+
+	if closeTransport {
+		shared.stopRunning()
+		shared.cachedTLSDialer.close()
+		shared.transport.CloseIdleConnections()
+	}
+}
+
+// RoundTrip implements the transporter interface.
+//
+// The HTTP/1.1 and HTTP/2 transports pool connections by request URL host,
+// which is the meek server Host header. So that MeekConns with different
+// Host headers share connections, the request URL host is replaced with the
+// front address, which is the address that is always dialed, and the Host
+// header is retained. Only the Host header is sent.
+func (shared *meekSharedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+
+	coalescedRequest := *request
+	coalescedURL := *request.URL
+	coalescedURL.Host = shared.key.dialAddress
+	coalescedRequest.URL = &coalescedURL
+	if coalescedRequest.Host == "" {
+		coalescedRequest.Host = request.URL.Host
+	}
+
+	return shared.transport.RoundTrip(&coalescedRequest)
+}
+
+// CloseIdleConnections implements the transporter interface.
+func (shared *meekSharedTransport) CloseIdleConnections() {
+	shared.transport.CloseIdleConnections()
+}
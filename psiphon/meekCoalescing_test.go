@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+type testMeekTransport struct {
+	requests        []*http.Request
+	closedIdleConns int
+}
+
+func (transport *testMeekTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	transport.requests = append(transport.requests, request)
+	return nil, errors.New("test transport")
+}
+
+func (transport *testMeekTransport) CloseIdleConnections() {
+	transport.closedIdleConns += 1
+}
+
+func TestMeekSharedTransport(t *testing.T) {
+
+	meekConfig := &MeekConfig{
+		DialAddress:   "192.0.2.1:443",
+		SNIServerName: "front.example.com",
+		TLSProfile:    "test",
+	}
+	dialConfig := &DialConfig{}
+
+	key := makeMeekTransportKey(meekConfig, dialConfig, nil)
+
+	otherMeekConfig := *meekConfig
+	otherMeekConfig.SNIServerName = "other.example.com"
+	if makeMeekTransportKey(&otherMeekConfig, dialConfig, nil) == key {
+		t.Fatalf("unexpected key match")
+	}
+
+	otherMeekConfig = *meekConfig
+	otherMeekConfig.HostHeader = "meek.example.com"
+	if makeMeekTransportKey(&otherMeekConfig, dialConfig, nil) != key {
+		t.Fatalf("unexpected key mismatch")
+	}
+
+	if getMeekSharedTransport(key) != nil {
+		t.Fatalf("unexpected shared transport")
+	}
+
+	preConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	transport := &testMeekTransport{}
+	shared := addMeekSharedTransport(
+		key, transport, newCachedTLSDialer(preConn, nil))
+	if shared == nil {
+		t.Fatalf("addMeekSharedTransport failed")
+	}
+
+	if addMeekSharedTransport(key, &testMeekTransport{}, nil) != nil {
+		t.Fatalf("unexpected addMeekSharedTransport success")
+	}
+
+	if getMeekSharedTransport(key) != shared {
+		t.Fatalf("missing shared transport")
+	}
+
+	// Requests with different Host headers are pooled under the front
+	// address, and retain their Host headers.
+
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		request, _ := http.NewRequest("POST", "https://"+host+"/", nil)
+		shared.RoundTrip(request)
+	}
+
+	if len(transport.requests) != 2 {
+		t.Fatalf("unexpected request count: %d", len(transport.requests))
+	}
+	for i, host := range []string{"a.example.com", "b.example.com"} {
+		request := transport.requests[i]
+		if request.URL.Host != meekConfig.DialAddress || request.Host != host {
+			t.Fatalf("unexpected request: %s %s", request.URL.Host, request.Host)
+		}
+	}
+
+	// The transport is closed, and no longer shared, when the last reference
+	// is released.
+
+	shared.release()
+	if transport.closedIdleConns != 0 {
+		t.Fatalf("unexpected close")
+	}
+
+	shared.release()
+	if transport.closedIdleConns != 1 {
+		t.Fatalf("unexpected close count: %d", transport.closedIdleConns)
+	}
+
+	if getMeekSharedTransport(key) != nil {
+		t.Fatalf("unexpected shared transport")
+	}
+
+	// The unused pre-dialed conn is closed.
+
+	_, err := peerConn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatalf("unexpected pre-dialed conn read success")
+	}
+}
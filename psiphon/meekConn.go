@@ -56,8 +56,9 @@ import (
 // https://bitbucket.org/psiphon/psiphon-circumvention-system/src/default/go/meek-client/meek-client.go
 
 const (
-	MEEK_PROTOCOL_VERSION           = 3
-	MEEK_MAX_REQUEST_PAYLOAD_LENGTH = 65536
+	MEEK_PROTOCOL_VERSION                 = 3
+	MEEK_MAX_REQUEST_PAYLOAD_LENGTH       = 65536
+	MEEK_FRONT_IDLE_TIMEOUT_POLL_FRACTION = 0.8
 )
 
 // MeekConfig specifies the behavior of a MeekConn
@@ -92,10 +93,23 @@ type MeekConfig struct {
 	// HostHeader is the value to place in the HTTP request Host header.
 	HostHeader string
 
+	// PathPrefix is the URL path prefix under which the meek server accepts
+	// requests. When blank, requests are made to "/".
+	PathPrefix string
+
 	// TransformedHostName records whether a hostname transformation is
 	// in effect. This value is used for stats reporting.
 	TransformedHostName bool
 
+	// MaxChunkSize and MinChunkSize bound the size of request and response
+	// payloads. Payloads start at up to MaxChunkSize bytes and, when a
+	// round trip is retried, the size is halved, down to MinChunkSize. The
+	// bounds are sent to the server in the meek cookie. See
+	// protocol.ClampMeekChunkSizes; when MaxChunkSize is 0, the fixed
+	// MEEK_MAX_REQUEST_PAYLOAD_LENGTH is used.
+	MaxChunkSize int
+	MinChunkSize int
+
 	// ClientTunnelProtocol is the protocol the client is using. It's
 	// included in the meek cookie for optional use by the server, in
 	// cases where the server cannot unambiguously determine the
@@ -110,10 +124,34 @@ type MeekConfig struct {
 	// incuding buffers are allocated.
 	RoundTripperOnly bool
 
+	// TLSInterceptionDetected, when set, enables TLS interception detection
+	// for HTTPS meek connections. See CustomTLSConfig.TLSInterceptionDetected.
+	// TLSInterceptionDetected is also called when a response redirects to
+	// another host and MeekRedirectSameOriginOnly is set.
+	TLSInterceptionDetected func(indicators []string)
+
+	// TLSClientSessionCache, when set, is a TLS session cache shared with
+	// other meek connections. When nil, the meek connection uses its own,
+	// isolated TLS session cache, so that its session tickets can't be used
+	// to link it with other tunnels.
+	TLSClientSessionCache *TLSClientSessionCache
+
+	// FrontingTLSVerification, when set, is the server entry policy for
+	// verifying the front's TLS certificate. See
+	// protocol.MeekFrontingTLSVerification.
+	FrontingTLSVerification *protocol.MeekFrontingTLSVerification
+
 	// The following values are used to create the obfuscated meek cookie.
 
 	MeekCookieEncryptionPublicKey string
 	MeekObfuscatedKey             string
+
+	// URLSigningScheme, URLSigningKeyID, and URLSigningKey, when
+	// URLSigningScheme is set, specify that meek request URLs are signed,
+	// for CDNs which require signed URLs. See protocol.MeekURLSigningSchemes.
+	URLSigningScheme string
+	URLSigningKeyID  string
+	URLSigningKey    string
 }
 
 // MeekConn is a network connection that tunnels TCP over HTTP and supports "fronting". Meek sends
@@ -133,6 +171,14 @@ type MeekConn struct {
 	additionalHeaders http.Header
 	cookie            *http.Cookie
 	cachedTLSDialer   *cachedTLSDialer
+	sharedTransport   *meekSharedTransport
+	tokenLocation     string
+	tokenHeaderName   string
+	maxRedirects      int
+	sameOriginOnly    bool
+	redirectDetected  func(indicators []string)
+	urlSigner         *meekURLSigner
+	maxResigns        int
 	transport         transporter
 	mutex             sync.Mutex
 	isClosed          bool
@@ -140,6 +186,13 @@ type MeekConn struct {
 	stopRunning       context.CancelFunc
 	relayWaitGroup    *sync.WaitGroup
 
+	// For Rerandomize; set only when cachedTLSDialer is set
+	rerandomizeTLSConfig      *CustomTLSConfig
+	rerandomizeDialConfig     *DialConfig
+	rerandomizeTunnelProtocol string
+	rerandomizeSessionCache   *TLSClientSessionCache
+	isHTTP2                   bool
+
 	// For round tripper mode
 	roundTripperOnly              bool
 	meekCookieEncryptionPublicKey string
@@ -147,6 +200,9 @@ type MeekConn struct {
 	clientTunnelProtocol          string
 
 	// For relay mode
+	chunkSize               int32
+	maxChunkSize            int
+	minChunkSize            int
 	fullReceiveBufferLength int
 	readPayloadChunkLength  int
 	emptyReceiveBuffer      chan *bytes.Buffer
@@ -180,6 +236,8 @@ func DialMeek(
 	cleanupStopRunning := true
 	cleanupCachedTLSDialer := true
 	var cachedTLSDialer *cachedTLSDialer
+	cleanupSharedTransport := true
+	var sharedTransport *meekSharedTransport
 
 	// Cleanup in error cases
 	defer func() {
@@ -189,12 +247,17 @@ func DialMeek(
 		if cleanupCachedTLSDialer && cachedTLSDialer != nil {
 			cachedTLSDialer.close()
 		}
+		if cleanupSharedTransport && sharedTransport != nil {
+			sharedTransport.release()
+		}
 	}()
 
 	// Configure transport: HTTP or HTTPS
 
 	var scheme string
 	var transport transporter
+	var tlsConfig *CustomTLSConfig
+	isHTTP2 := false
 	var additionalHeaders http.Header
 	var proxyUrl func(*http.Request) (*url.URL, error)
 
@@ -240,7 +303,7 @@ func DialMeek(
 			meekConfig.ClientTunnelProtocol,
 			meekConfig.ClientParameters)
 
-		tlsConfig := &CustomTLSConfig{
+		tlsConfig = &CustomTLSConfig{
 			ClientParameters:              meekConfig.ClientParameters,
 			DialAddr:                      meekConfig.DialAddress,
 			Dial:                          tcpDialer,
@@ -248,73 +311,132 @@ func DialMeek(
 			SkipVerify:                    true,
 			TLSProfile:                    meekConfig.TLSProfile,
 			TrustedCACertificatesFilename: dialConfig.TrustedCACertificatesFilename,
+			TLSInterceptionDetected:       meekConfig.TLSInterceptionDetected,
+		}
+		if meekConfig.TLSClientSessionCache != nil {
+			tlsConfig.SetClientSessionCache(meekConfig.TLSClientSessionCache)
+		} else {
+			tlsConfig.EnableClientSessionCache(meekConfig.ClientParameters)
+		}
+
+		// A server entry fronting TLS verification policy replaces
+		// SkipVerify, as above, with the specified verification.
+		if meekConfig.FrontingTLSVerification != nil {
+			tlsConfig.SkipVerify = false
+			switch meekConfig.FrontingTLSVerification.Policy {
+			case protocol.MEEK_FRONTING_TLS_VERIFICATION_PIN:
+				tlsConfig.VerifyPins = meekConfig.FrontingTLSVerification.Pins
+			case protocol.MEEK_FRONTING_TLS_VERIFICATION_SKIP_HOSTNAME:
+				tlsConfig.VerifySkipHostname = true
+			}
 		}
-		tlsConfig.EnableClientSessionCache(meekConfig.ClientParameters)
 
 		if meekConfig.UseObfuscatedSessionTickets {
 			tlsConfig.ObfuscatedSessionTicketKey = meekConfig.MeekObfuscatedKey
 		}
 
-		tlsDialer := NewCustomTLSDialer(tlsConfig)
+		p := meekConfig.ClientParameters.Get()
+		if p.WeightedCoinFlip(parameters.MeekTLSRecordFragmentationProbability) {
+			tlsConfig.RecordFragmentMinBytes = p.Int(parameters.MeekTLSRecordFragmentationMinBytes)
+			tlsConfig.RecordFragmentMaxBytes = p.Int(parameters.MeekTLSRecordFragmentationMaxBytes)
+		}
+		tlsConfig.HandshakeTimeout = p.Duration(parameters.TunnelTLSHandshakeTimeout)
+		if !protocol.TunnelProtocolIsFronted(meekConfig.ClientTunnelProtocol) {
+			// Only "h2" and "http/1.1" are permitted by the parameter, so the
+			// negotiated protocol is always one handled below.
+			tlsConfig.NextProtos = p.ALPNProtocols(parameters.MeekClientALPNProtocols)
+		}
+		coalesceConnections := p.Bool(parameters.MeekCoalesceConnections)
+		p = nil
+
+		// When coalescing, use any existing shared transport for this front
+		// and TLS configuration, skipping the pre-dial. See
+		// meekSharedTransport.
 
-		// Pre-dial one TLS connection in order to inspect the negotiated
-		// application protocol. Then we create an HTTP/2 or HTTP/1.1 transport
-		// depending on which protocol was negotiated. The TLS dialer
-		// is assumed to negotiate only "h2" or "http/1.1"; or not negotiate
-		// an application protocol.
-		//
-		// We cannot rely on net/http's HTTP/2 support since it's only
-		// activated when http.Transport.DialTLS returns a golang crypto/tls.Conn;
-		// e.g., https://github.com/golang/go/blob/c8aec4095e089ff6ac50d18e97c3f46561f14f48/src/net/http/transport.go#L1040
-		//
-		// The pre-dialed connection is stored in a cachedTLSDialer, which will
-		// return the cached pre-dialed connection to its first Dial caller, and
-		// use the tlsDialer for all other Dials.
-		//
-		// cachedTLSDialer.close() must be called on all exits paths from this
-		// function and in meek.Close() to ensure the cached conn is closed in
-		// any case where no Dial call is made.
-		//
-		// The pre-dial must be interruptible so that DialMeek doesn't block and
-		// hang/delay a shutdown or end of establishment. So the pre-dial uses
-		// the Controller's PendingConns, not the MeekConn PendingConns. For this
-		// purpose, a special preDialer is configured.
-		//
-		// Only one pre-dial attempt is made; there are no retries. This differs
-		// from relayRoundTrip, which retries and may redial for each retry.
-		// Retries at the pre-dial phase are less useful since there's no active
-		// session to preserve, and establishment will simply try another server.
-		// Note that the underlying TCPDial may still try multiple IP addreses when
-		// the destination is a domain and ir resolves to multiple IP adresses.
-
-		// The pre-dial is made within the parent dial context, so that DialMeek
-		// may be interrupted. Subsequent dials are made within the meek round trip
-		// request context. Since http.DialTLS doesn't take a context argument
-		// (yet; as of Go 1.9 this issue is still open: https://github.com/golang/go/issues/21526),
-		// cachedTLSDialer is used as a conduit to send the request context.
-		// meekConn.relayRoundTrip sets its request context into cachedTLSDialer,
-		// and cachedTLSDialer.dial uses that context.
-
-		// As DialAddr is set in the CustomTLSConfig, no address is required here.
-		preConn, err := tlsDialer(ctx, "tcp", "")
-		if err != nil {
-			return nil, common.ContextError(err)
+		var transportKey meekTransportKey
+		if coalesceConnections {
+			transportKey = makeMeekTransportKey(meekConfig, dialConfig, tlsConfig.NextProtos)
+			sharedTransport = getMeekSharedTransport(transportKey)
 		}
 
-		cachedTLSDialer = newCachedTLSDialer(preConn, tlsDialer)
+		if sharedTransport != nil {
+
+			transport = sharedTransport
 
-		if IsTLSConnUsingHTTP2(preConn) {
-			NoticeInfo("negotiated HTTP/2 for %s", meekConfig.DialAddress)
-			transport = &http2.Transport{
-				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
-					return cachedTLSDialer.dial(network, addr)
-				},
-			}
 		} else {
-			transport = &http.Transport{
-				DialTLS: func(network, addr string) (net.Conn, error) {
-					return cachedTLSDialer.dial(network, addr)
-				},
+
+			tlsDialer := NewCustomTLSDialer(tlsConfig)
+
+			// Pre-dial one TLS connection in order to inspect the negotiated
+			// application protocol. Then we create an HTTP/2 or HTTP/1.1 transport
+			// depending on which protocol was negotiated. The TLS dialer
+			// is assumed to negotiate only "h2" or "http/1.1"; or not negotiate
+			// an application protocol.
+			//
+			// We cannot rely on net/http's HTTP/2 support since it's only
+			// activated when http.Transport.DialTLS returns a golang crypto/tls.Conn;
+			// e.g., https://github.com/golang/go/blob/c8aec4095e089ff6ac50d18e97c3f46561f14f48/src/net/http/transport.go#L1040
+			//
+			// The pre-dialed connection is stored in a cachedTLSDialer, which will
+			// return the cached pre-dialed connection to its first Dial caller, and
+			// use the tlsDialer for all other Dials.
+			//
+			// cachedTLSDialer.close() must be called on all exits paths from this
+			// function and in meek.Close() to ensure the cached conn is closed in
+			// any case where no Dial call is made.
+			//
+			// The pre-dial must be interruptible so that DialMeek doesn't block and
+			// hang/delay a shutdown or end of establishment. So the pre-dial uses
+			// the Controller's PendingConns, not the MeekConn PendingConns. For this
+			// purpose, a special preDialer is configured.
+			//
+			// Only one pre-dial attempt is made; there are no retries. This differs
+			// from relayRoundTrip, which retries and may redial for each retry.
+			// Retries at the pre-dial phase are less useful since there's no active
+			// session to preserve, and establishment will simply try another server.
+			// Note that the underlying TCPDial may still try multiple IP addreses when
+			// the destination is a domain and ir resolves to multiple IP adresses.
+
+			// The pre-dial is made within the parent dial context, so that DialMeek
+			// may be interrupted. Subsequent dials are made within the meek round trip
+			// request context. Since http.DialTLS doesn't take a context argument
+			// (yet; as of Go 1.9 this issue is still open: https://github.com/golang/go/issues/21526),
+			// cachedTLSDialer is used as a conduit to send the request context.
+			// meekConn.relayRoundTrip sets its request context into cachedTLSDialer,
+			// and cachedTLSDialer.dial uses that context.
+
+			// As DialAddr is set in the CustomTLSConfig, no address is required here.
+			preConn, err := tlsDialer(ctx, "tcp", "")
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+
+			cachedTLSDialer = newCachedTLSDialer(preConn, tlsDialer)
+
+			isHTTP2 = IsTLSConnUsingHTTP2(preConn)
+
+			if isHTTP2 {
+				NoticeInfo("negotiated HTTP/2 for %s", meekConfig.DialAddress)
+				transport = &http2.Transport{
+					DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+						return cachedTLSDialer.dial(network, addr)
+					},
+				}
+			} else {
+				transport = &http.Transport{
+					DialTLS: func(network, addr string) (net.Conn, error) {
+						return cachedTLSDialer.dial(network, addr)
+					},
+				}
+			}
+
+			if coalesceConnections {
+				shared := addMeekSharedTransport(transportKey, transport, cachedTLSDialer)
+				if shared != nil {
+					sharedTransport = shared
+					transport = sharedTransport
+					cachedTLSDialer = nil
+				}
 			}
 		}
 
@@ -380,10 +502,15 @@ func DialMeek(
 		}
 	}
 
+	path := "/"
+	if meekConfig.PathPrefix != "" {
+		path = meekConfig.PathPrefix
+	}
+
 	url := &url.URL{
 		Scheme: scheme,
 		Host:   meekConfig.HostHeader,
-		Path:   "/",
+		Path:   path,
 	}
 
 	if meekConfig.UseHTTPS {
@@ -400,6 +527,37 @@ func DialMeek(
 		}
 	}
 
+	// The session token location is pinned for the lifetime of the MeekConn.
+	// The server accepts the token in any location, so a tactics change
+	// doesn't affect existing sessions. The redirect configuration is also
+	// pinned.
+
+	p := meekConfig.ClientParameters.Get()
+	tokenLocation := p.String(parameters.MeekSessionTokenLocation)
+	tokenHeaderName := p.String(parameters.MeekSessionTokenHeaderName)
+	maxRedirects := p.Int(parameters.MeekMaxRedirects)
+	sameOriginOnly := p.Bool(parameters.MeekRedirectSameOriginOnly)
+	signatureTTL := p.Duration(parameters.MeekURLSignatureTTL)
+	maxResigns := p.Int(parameters.MeekURLSignatureMaxResigns)
+	p = nil
+
+	if !common.Contains(protocol.SupportedMeekSessionTokenLocations, tokenLocation) ||
+		(tokenLocation != protocol.MEEK_SESSION_TOKEN_LOCATION_COOKIE && tokenHeaderName == "") {
+		tokenLocation = protocol.MEEK_SESSION_TOKEN_LOCATION_COOKIE
+	}
+
+	var urlSigner *meekURLSigner
+	if meekConfig.URLSigningScheme != "" {
+		urlSigner, err = newMeekURLSigner(
+			meekConfig.URLSigningScheme,
+			meekConfig.URLSigningKeyID,
+			meekConfig.URLSigningKey,
+			signatureTTL)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
 	// The main loop of a MeekConn is run in the relay() goroutine.
 	// A MeekConn implements net.Conn concurrency semantics:
 	// "Multiple goroutines may invoke methods on a Conn simultaneously."
@@ -421,6 +579,14 @@ func DialMeek(
 		url:               url,
 		additionalHeaders: additionalHeaders,
 		cachedTLSDialer:   cachedTLSDialer,
+		sharedTransport:   sharedTransport,
+		tokenLocation:     tokenLocation,
+		tokenHeaderName:   tokenHeaderName,
+		maxRedirects:      maxRedirects,
+		sameOriginOnly:    sameOriginOnly,
+		redirectDetected:  meekConfig.TLSInterceptionDetected,
+		urlSigner:         urlSigner,
+		maxResigns:        maxResigns,
 		transport:         transport,
 		isClosed:          false,
 		runCtx:            runCtx,
@@ -429,20 +595,42 @@ func DialMeek(
 		roundTripperOnly:  meekConfig.RoundTripperOnly,
 	}
 
-	// stopRunning and cachedTLSDialer will now be closed in meek.Close()
+	if cachedTLSDialer != nil {
+		meek.rerandomizeTLSConfig = tlsConfig
+		meek.rerandomizeDialConfig = dialConfig
+		meek.rerandomizeTunnelProtocol = meekConfig.ClientTunnelProtocol
+		meek.rerandomizeSessionCache = meekConfig.TLSClientSessionCache
+		meek.isHTTP2 = isHTTP2
+	}
+
+	// stopRunning, cachedTLSDialer, and sharedTransport will now be closed in
+	// meek.Close()
 	cleanupStopRunning = false
 	cleanupCachedTLSDialer = false
+	cleanupSharedTransport = false
 
 	// Allocate relay resources, including buffers and running the relay
 	// go routine, only when running in relay mode.
 	if !meek.roundTripperOnly {
 
+		meek.maxChunkSize = MEEK_MAX_REQUEST_PAYLOAD_LENGTH
+		meek.minChunkSize = MEEK_MAX_REQUEST_PAYLOAD_LENGTH
+		if meekConfig.MaxChunkSize != 0 {
+			meek.maxChunkSize, meek.minChunkSize = protocol.ClampMeekChunkSizes(
+				meekConfig.MaxChunkSize, meekConfig.MinChunkSize)
+		}
+		meek.chunkSize = int32(meek.maxChunkSize)
+		cookieMaxChunkSize, cookieMinChunkSize := meek.cookieChunkSizes()
+
 		cookie, err := makeMeekCookie(
 			meek.clientParameters,
 			meekConfig.MeekCookieEncryptionPublicKey,
 			meekConfig.MeekObfuscatedKey,
 			meekConfig.ClientTunnelProtocol,
-			"")
+			"",
+			meek.sessionIDHeader(),
+			cookieMaxChunkSize,
+			cookieMinChunkSize)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -486,7 +674,9 @@ type cachedTLSDialer struct {
 	usedCachedConn int32
 	cachedConn     net.Conn
 	requestCtx     atomic.Value
+	mutex          sync.Mutex
 	dialer         Dialer
+	isClosed       bool
 }
 
 func newCachedTLSDialer(cachedConn net.Conn, dialer Dialer) *cachedTLSDialer {
@@ -510,16 +700,117 @@ func (c *cachedTLSDialer) dial(network, addr string) (net.Conn, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	return c.dialer(ctx, network, addr)
+	c.mutex.Lock()
+	dialer := c.dialer
+	c.mutex.Unlock()
+	return dialer(ctx, network, addr)
+}
+
+// reset replaces the dialer and sets a new cached conn, which is returned
+// to the next dial caller. reset returns false, and the caller must close
+// cachedConn, when the cachedTLSDialer is closed.
+func (c *cachedTLSDialer) reset(cachedConn net.Conn, dialer Dialer) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.isClosed {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&c.usedCachedConn, 0, 1) {
+		c.cachedConn.Close()
+	}
+	c.cachedConn = cachedConn
+	c.dialer = dialer
+	atomic.StoreInt32(&c.usedCachedConn, 0)
+	return true
 }
 
 func (c *cachedTLSDialer) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.isClosed = true
 	if atomic.CompareAndSwapInt32(&c.usedCachedConn, 0, 1) {
 		c.cachedConn.Close()
 		c.cachedConn = nil
 	}
 }
 
+// Rerandomize re-selects the mutable obfuscation parameters of the TLS
+// connections underlying an HTTPS MeekConn, without interrupting the meek
+// session: TCP fragmentation, ignoring any replayed fragmentor seed; TLS
+// record fragmentation; and, when TunnelRerandomizeTLSProfile is set, the
+// TLS profile. A new TLS connection is pre-dialed with the new parameters
+// and is used for the next request; existing connections are retired once
+// idle.
+//
+// As the HTTP transport is fixed, the new parameters are discarded when the
+// new connection negotiates a different application protocol. Rerandomize
+// is unsupported for HTTP MeekConns and MeekConns using a shared, coalesced
+// transport.
+//
+// Rerandomize must not be called concurrently.
+func (meek *MeekConn) Rerandomize(ctx context.Context) error {
+
+	if meek.rerandomizeTLSConfig == nil {
+		return common.ContextError(errors.New("operation unsupported"))
+	}
+
+	tlsConfig := *meek.rerandomizeTLSConfig
+
+	dialConfig := *meek.rerandomizeDialConfig
+	dialConfig.FragmentorSeed = 0
+
+	tlsConfig.Dial = NewTCPFragmentorDialer(
+		&dialConfig,
+		meek.rerandomizeTunnelProtocol,
+		meek.clientParameters)
+
+	p := meek.clientParameters.Get()
+	tlsConfig.RecordFragmentMinBytes = 0
+	tlsConfig.RecordFragmentMaxBytes = 0
+	if p.WeightedCoinFlip(parameters.MeekTLSRecordFragmentationProbability) {
+		tlsConfig.RecordFragmentMinBytes = p.Int(parameters.MeekTLSRecordFragmentationMinBytes)
+		tlsConfig.RecordFragmentMaxBytes = p.Int(parameters.MeekTLSRecordFragmentationMaxBytes)
+	}
+	rerandomizeTLSProfile := p.Bool(parameters.TunnelRerandomizeTLSProfile)
+	p = nil
+
+	if rerandomizeTLSProfile {
+		tlsProfile := SelectTLSProfile(meek.clientParameters)
+		if tlsProfile != "" && tlsProfile != tlsConfig.TLSProfile {
+			// Sessions aren't resumed with a different TLS profile.
+			tlsConfig.TLSProfile = tlsProfile
+			if meek.rerandomizeSessionCache != nil {
+				tlsConfig.SetClientSessionCache(meek.rerandomizeSessionCache)
+			} else {
+				tlsConfig.EnableClientSessionCache(meek.clientParameters)
+			}
+		}
+	}
+
+	tlsDialer := NewCustomTLSDialer(&tlsConfig)
+
+	conn, err := tlsDialer(ctx, "tcp", "")
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if IsTLSConnUsingHTTP2(conn) != meek.isHTTP2 {
+		conn.Close()
+		return common.ContextError(errors.New("negotiated application protocol changed"))
+	}
+
+	if !meek.cachedTLSDialer.reset(conn, tlsDialer) {
+		conn.Close()
+		return common.ContextError(errors.New("meek connection closed"))
+	}
+
+	meek.rerandomizeTLSConfig = &tlsConfig
+
+	meek.transport.CloseIdleConnections()
+
+	return nil
+}
+
 // Close terminates the meek connection. Close waits for the relay goroutine
 // to stop (in relay mode) and releases HTTP transport resources.
 // A mutex is required to support net.Conn concurrency semantics.
@@ -536,7 +827,11 @@ func (meek *MeekConn) Close() (err error) {
 			meek.cachedTLSDialer.close()
 		}
 		meek.relayWaitGroup.Wait()
-		meek.transport.CloseIdleConnections()
+		if meek.sharedTransport != nil {
+			meek.sharedTransport.release()
+		} else {
+			meek.transport.CloseIdleConnections()
+		}
 	}
 	return nil
 }
@@ -574,7 +869,9 @@ func (meek *MeekConn) RoundTrip(
 		meek.meekCookieEncryptionPublicKey,
 		meek.meekObfuscatedKey,
 		meek.clientTunnelProtocol,
-		endPoint)
+		endPoint,
+		meek.sessionIDHeader(),
+		0, 0)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -592,22 +889,58 @@ func (meek *MeekConn) RoundTrip(
 	// At this time, RoundTrip is used for tactics in Controller and
 	// the concurrency constraints are satisfied.
 
-	request, cancelFunc, err := meek.newRequest(
-		ctx, cookie, bytes.NewReader(requestBody), 0)
-	if err != nil {
-		return nil, common.ContextError(err)
-	}
-	defer cancelFunc()
+	redirects := 0
+	resigns := 0
 
-	response, err := meek.transport.RoundTrip(request)
-	if err == nil {
-		defer response.Body.Close()
-		if response.StatusCode != http.StatusOK {
-			err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+	for {
+
+		request, cancelFunc, err := meek.newRequest(
+			ctx, cookie, bytes.NewReader(requestBody), len(requestBody))
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		response, err := meek.transport.RoundTrip(request)
+		if err != nil {
+			cancelFunc()
+			return nil, common.ContextError(err)
+		}
+
+		if meek.isRedirect(response) {
+			response.Body.Close()
+			cancelFunc()
+			err = meek.followRedirect(response, redirects)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			redirects += 1
+			continue
+		}
+
+		if meek.isSignatureRejected(response, resigns) {
+			response.Body.Close()
+			cancelFunc()
+			NoticeInfo("meek request signature rejected: re-signing")
+			resigns += 1
+			continue
+		}
+
+		responseBody, err := readRoundTripResponse(response)
+		response.Body.Close()
+		cancelFunc()
+		if err != nil {
+			return nil, common.ContextError(err)
 		}
+
+		return responseBody, nil
 	}
-	if err != nil {
-		return nil, common.ContextError(err)
+}
+
+func readRoundTripResponse(response *http.Response) ([]byte, error) {
+
+	if response.StatusCode != http.StatusOK {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
 	}
 
 	responseBody, err := ioutil.ReadAll(response.Body)
@@ -618,6 +951,76 @@ func (meek *MeekConn) RoundTrip(
 	return responseBody, nil
 }
 
+// isRedirect indicates whether response is a redirect to be handled by
+// followRedirect. Redirects are handled only when enabled by
+// MeekMaxRedirects.
+func (meek *MeekConn) isRedirect(response *http.Response) bool {
+	if meek.maxRedirects <= 0 {
+		return false
+	}
+	switch response.StatusCode {
+	case http.StatusMovedPermanently,
+		http.StatusFound,
+		http.StatusSeeOther,
+		http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// followRedirect checks the redirect response to a meek request, the
+// redirects-th redirect for the request, and, when the redirect may be
+// followed, updates the meek URL to the redirect target. The target is used
+// for the redirected request and for all subsequent requests.
+//
+// Redirected requests are always resent as POSTs, for all redirect status
+// codes, and carry the same session token and payload as the original
+// request; the meek server doesn't receive redirected requests.
+//
+// A redirect which changes the URL scheme is never followed, as the meek
+// transport is fixed to either HTTP or HTTPS. When sameOriginOnly is set, a
+// redirect to another host isn't followed and is reported to
+// redirectDetected: a front may redirect within its own origin, but a
+// cross-origin redirect may indicate an interception proxy.
+//
+// followRedirect is not safe for concurrent calls; it's called only
+// from RoundTrip or relayRoundTrip, which don't run concurrently.
+func (meek *MeekConn) followRedirect(response *http.Response, redirects int) error {
+
+	if redirects >= meek.maxRedirects {
+		return common.ContextError(errors.New("too many redirects"))
+	}
+
+	location := response.Header.Get("Location")
+	if location == "" {
+		return common.ContextError(errors.New("missing redirect location"))
+	}
+
+	target, err := meek.url.Parse(location)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if target.Scheme != meek.url.Scheme ||
+		(meek.sameOriginOnly && target.Host != meek.url.Host) {
+
+		if meek.redirectDetected != nil {
+			meek.redirectDetected([]string{"cross-origin redirect"})
+		}
+
+		return common.ContextError(errors.New("cross-origin redirect"))
+	}
+
+	target.Fragment = ""
+
+	meek.url = target
+
+	NoticeInfo("meek request redirected: %d", response.StatusCode)
+
+	return nil
+}
+
 // Read reads data from the connection.
 // net.Conn Deadlines are ignored. net.Conn concurrency semantics are supported.
 func (meek *MeekConn) Read(buffer []byte) (n int, err error) {
@@ -660,7 +1063,7 @@ func (meek *MeekConn) Write(buffer []byte) (n int, err error) {
 		case <-meek.runCtx.Done():
 			return 0, common.ContextError(errors.New("meek connection has closed"))
 		}
-		writeLen := MEEK_MAX_REQUEST_PAYLOAD_LENGTH - sendBuffer.Len()
+		writeLen := meek.getChunkSize() - sendBuffer.Len()
 		if writeLen > 0 {
 			if writeLen > len(buffer) {
 				writeLen = len(buffer)
@@ -713,7 +1116,7 @@ func (meek *MeekConn) replaceSendBuffer(sendBuffer *bytes.Buffer) {
 	switch {
 	case sendBuffer.Len() == 0:
 		meek.emptySendBuffer <- sendBuffer
-	case sendBuffer.Len() >= MEEK_MAX_REQUEST_PAYLOAD_LENGTH:
+	case sendBuffer.Len() >= meek.getChunkSize():
 		meek.fullSendBuffer <- sendBuffer
 	default:
 		meek.partialSendBuffer <- sendBuffer
@@ -723,7 +1126,8 @@ func (meek *MeekConn) replaceSendBuffer(sendBuffer *bytes.Buffer) {
 // relay sends and receives tunneled traffic (payload). An HTTP request is
 // triggered when data is in the write queue or at a polling interval.
 // There's a geometric increase, up to a maximum, in the polling interval when
-// no data is exchanged. Only one HTTP request is in flight at a time.
+// no data is exchanged; see nextMeekPollInterval. Only one HTTP request is in
+// flight at a time.
 func (meek *MeekConn) relay() {
 	// Note: meek.Close() calls here in relay() are made asynchronously
 	// (using goroutines) since Close() will wait on this WaitGroup.
@@ -735,6 +1139,8 @@ func (meek *MeekConn) relay() {
 		p.Float(parameters.MeekMinPollIntervalJitter))
 	p = nil
 
+	lastActivityTime := monotime.Now()
+
 	timeout := time.NewTimer(interval)
 	defer timeout.Stop()
 
@@ -788,47 +1194,95 @@ func (meek *MeekConn) relay() {
 			return
 		}
 
-		// Calculate polling interval. When data is received,
-		// immediately request more. Otherwise, schedule next
-		// poll with exponential back off. Jitter and coin
-		// flips are used to avoid trivial, static traffic
-		// timing patterns.
+		isActive := receivedPayloadSize > 0 || sendPayloadSize > 0
+		if isActive {
+			lastActivityTime = monotime.Now()
+		}
 
-		p := meek.clientParameters.Get()
+		interval = nextMeekPollInterval(
+			meek.clientParameters.Get(),
+			interval,
+			isActive,
+			monotime.Since(lastActivityTime))
+	}
+}
 
-		if receivedPayloadSize > 0 || sendPayloadSize > 0 {
+// nextMeekPollInterval calculates the next polling interval. When data is
+// exchanged, more is requested immediately. Otherwise, the next poll is
+// scheduled with exponential back off, up to MeekMaxPollInterval. Once the
+// tunnel has been idle for MeekIdlePeriod, the back off continues up to
+// MeekIdleMaxPollInterval, when set, reducing the overhead of idle tunnels.
+//
+// When MeekFrontIdleTimeout, the front's (CDN's) idle connection timeout, is
+// set, the interval remains below the timeout so that the front doesn't
+// close the idle underlying connection.
+//
+// Jitter and coin flips are used to avoid trivial, static traffic timing
+// patterns.
+func nextMeekPollInterval(
+	p *parameters.ClientParametersSnapshot,
+	interval time.Duration,
+	isActive bool,
+	idleDuration time.Duration) time.Duration {
+
+	if isActive {
+		return 0
+	}
 
-			interval = 0
+	maxPollIntervalJitter := p.Float(parameters.MeekMaxPollIntervalJitter)
 
-		} else if interval == 0 {
+	if interval == 0 {
 
-			interval = common.JitterDuration(
-				p.Duration(parameters.MeekMinPollInterval),
-				p.Float(parameters.MeekMinPollIntervalJitter))
+		interval = common.JitterDuration(
+			p.Duration(parameters.MeekMinPollInterval),
+			p.Float(parameters.MeekMinPollIntervalJitter))
 
-		} else {
+	} else {
 
-			if p.WeightedCoinFlip(parameters.MeekApplyPollIntervalMultiplierProbability) {
+		if p.WeightedCoinFlip(parameters.MeekApplyPollIntervalMultiplierProbability) {
 
-				interval =
-					time.Duration(float64(interval) *
-						p.Float(parameters.MeekPollIntervalMultiplier))
-			}
+			interval =
+				time.Duration(float64(interval) *
+					p.Float(parameters.MeekPollIntervalMultiplier))
+		}
 
-			interval = common.JitterDuration(
-				interval,
-				p.Float(parameters.MeekPollIntervalJitter))
+		interval = common.JitterDuration(
+			interval,
+			p.Float(parameters.MeekPollIntervalJitter))
 
-			if interval >= p.Duration(parameters.MeekMaxPollInterval) {
+		maxPollInterval := p.Duration(parameters.MeekMaxPollInterval)
+		idleMaxPollInterval := p.Duration(parameters.MeekIdleMaxPollInterval)
+		if idleMaxPollInterval > maxPollInterval &&
+			idleDuration >= p.Duration(parameters.MeekIdlePeriod) {
 
-				interval = common.JitterDuration(
-					p.Duration(parameters.MeekMaxPollInterval),
-					p.Float(parameters.MeekMaxPollIntervalJitter))
-			}
+			maxPollInterval = idleMaxPollInterval
 		}
 
-		p = nil
+		if interval >= maxPollInterval {
+
+			interval = common.JitterDuration(
+				maxPollInterval,
+				maxPollIntervalJitter)
+		}
+	}
+
+	frontIdleTimeout := p.Duration(parameters.MeekFrontIdleTimeout)
+	if frontIdleTimeout > 0 {
+
+		// Jitter is applied downwards only, so the interval never exceeds
+		// the limit.
+
+		limit := time.Duration(
+			float64(frontIdleTimeout) * MEEK_FRONT_IDLE_TIMEOUT_POLL_FRACTION)
+
+		if interval > limit {
+			reduction, _ := common.MakeSecureRandomPeriod(
+				0, time.Duration(float64(limit)*maxPollIntervalJitter))
+			interval = limit - reduction
+		}
 	}
+
+	return interval
 }
 
 // readCloseSignaller is an io.ReadCloser wrapper for an io.Reader
@@ -906,6 +1360,32 @@ func (meek *MeekConn) newRequest(
 		meek.cachedTLSDialer.setRequestContext(requestCtx)
 	}
 
+	if cookie == nil {
+		cookie = meek.cookie
+	}
+
+	if meek.tokenLocation == protocol.MEEK_SESSION_TOKEN_LOCATION_BODY {
+
+		// Prefix the body with the 2-byte length and the session token.
+		// prefixedReadCloser preserves body Close calls, which the relay
+		// awaits.
+
+		prefix := make([]byte, 2+len(cookie.Value))
+		prefix[0] = byte(len(cookie.Value) >> 8)
+		prefix[1] = byte(len(cookie.Value))
+		copy(prefix[2:], cookie.Value)
+
+		if body == nil {
+			body = bytes.NewReader(prefix)
+		} else {
+			body = &prefixedReadCloser{
+				Reader: io.MultiReader(bytes.NewReader(prefix), body),
+				body:   body,
+			}
+		}
+		contentLength += len(prefix)
+	}
+
 	request, err := http.NewRequest("POST", meek.url.String(), body)
 	if err != nil {
 		return nil, cancelFunc, common.ContextError(err)
@@ -923,14 +1403,104 @@ func (meek *MeekConn) newRequest(
 
 	request.Header.Set("Content-Type", "application/octet-stream")
 
-	if cookie == nil {
-		cookie = meek.cookie
+	switch meek.tokenLocation {
+	case protocol.MEEK_SESSION_TOKEN_LOCATION_HEADER:
+		request.Header.Set(meek.tokenHeaderName, cookie.Value)
+	case protocol.MEEK_SESSION_TOKEN_LOCATION_QUERY:
+		query := request.URL.Query()
+		query.Set(cookie.Name, cookie.Value)
+		request.URL.RawQuery = query.Encode()
+	case protocol.MEEK_SESSION_TOKEN_LOCATION_BODY:
+		// Already added to the body.
+	default:
+		request.AddCookie(cookie)
+	}
+
+	// The URL is signed last, as the signature may cover the query
+	// parameters, including a session token.
+	if meek.urlSigner != nil {
+		err := meek.urlSigner.sign(request.URL)
+		if err != nil {
+			return nil, cancelFunc, common.ContextError(err)
+		}
 	}
-	request.AddCookie(cookie)
 
 	return request, cancelFunc, nil
 }
 
+// isSignatureRejected indicates whether response is a rejection of the
+// request URL signature, in which case the request is to be re-signed and
+// resent, up to maxResigns times for each request, instead of failing. The
+// resigns-th re-sign for the request is being considered.
+func (meek *MeekConn) isSignatureRejected(response *http.Response, resigns int) bool {
+	return meek.urlSigner != nil &&
+		resigns < meek.maxResigns &&
+		meek.urlSigner.isSignatureRejected(response)
+}
+
+// getChunkSize returns the current maximum request payload size.
+func (meek *MeekConn) getChunkSize() int {
+	return int(atomic.LoadInt32(&meek.chunkSize))
+}
+
+// GetChunkSize returns the current maximum request payload size, which is
+// reduced from the initial MeekConfig.MaxChunkSize when round trips fail.
+func (meek *MeekConn) GetChunkSize() int {
+	return meek.getChunkSize()
+}
+
+// backOffChunkSize halves the maximum request payload size, down to the
+// minimum chunk size, after a failed round trip. The server similarly
+// halves its response payload size when it receives the retry. Payloads
+// already buffered are sent as-is.
+func (meek *MeekConn) backOffChunkSize() {
+	chunkSize := meek.getChunkSize()
+	if chunkSize <= meek.minChunkSize {
+		return
+	}
+	chunkSize /= 2
+	if chunkSize < meek.minChunkSize {
+		chunkSize = meek.minChunkSize
+	}
+	atomic.StoreInt32(&meek.chunkSize, int32(chunkSize))
+	NoticeInfo("meek chunk size reduced: %d", chunkSize)
+}
+
+// cookieChunkSizes returns the chunk size bounds to send in the meek
+// cookie. 0 values, which are omitted from the cookie, are returned when
+// the default, fixed size is used, so the cookie is unchanged for servers
+// and clients which don't use chunk size backoff.
+func (meek *MeekConn) cookieChunkSizes() (int, int) {
+	if meek.maxChunkSize == MEEK_MAX_REQUEST_PAYLOAD_LENGTH &&
+		meek.minChunkSize == MEEK_MAX_REQUEST_PAYLOAD_LENGTH {
+		return 0, 0
+	}
+	return meek.maxChunkSize, meek.minChunkSize
+}
+
+// sessionIDHeader returns the response header in which the server is to
+// return the session ID. "" indicates a Set-Cookie header.
+func (meek *MeekConn) sessionIDHeader() string {
+	if meek.tokenLocation == protocol.MEEK_SESSION_TOKEN_LOCATION_COOKIE {
+		return ""
+	}
+	return meek.tokenHeaderName
+}
+
+// prefixedReadCloser is a request body with a session token prefix. Close
+// closes the original body, when it's an io.Closer.
+type prefixedReadCloser struct {
+	io.Reader
+	body io.Reader
+}
+
+func (r *prefixedReadCloser) Close() error {
+	if closer, ok := r.body.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 // relayRoundTrip configures and makes the actual HTTP POST request
 func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 
@@ -988,6 +1558,13 @@ func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 
 	receivedPayloadSize := int64(0)
 
+	// Redirected requests, and requests re-signed after a URL signature
+	// rejection, are not retries; redirects and resigns are subtracted from
+	// try when determining whether a request is a retry. The CDN, and not
+	// the meek server, responds in these cases.
+	redirects := 0
+	resigns := 0
+
 	for try := 0; ; try++ {
 
 		// Omit the request payload when retrying after receiving a
@@ -1024,7 +1601,7 @@ func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 		// When retrying, add a Range header to indicate how much
 		// of the response was already received.
 
-		if try > 0 {
+		if try > redirects+resigns {
 			expectedStatusCode = http.StatusPartialContent
 			request.Header.Set("Range", fmt.Sprintf("bytes=%d-", receivedPayloadSize))
 		}
@@ -1057,6 +1634,31 @@ func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 			// ...continue to retry
 		}
 
+		if err == nil && meek.isRedirect(response) {
+
+			// The meek server hasn't received the request payload, which is
+			// resent to the redirect target.
+			response.Body.Close()
+			cancelFunc()
+			err = meek.followRedirect(response, redirects)
+			if err != nil {
+				return 0, common.ContextError(err)
+			}
+			redirects += 1
+			continue
+		}
+
+		if err == nil && meek.isSignatureRejected(response, resigns) {
+
+			// An expired or otherwise rejected signature doesn't fail the
+			// round trip; the request is re-signed and resent.
+			response.Body.Close()
+			cancelFunc()
+			NoticeInfo("meek request signature rejected: re-signing")
+			resigns += 1
+			continue
+		}
+
 		if err == nil {
 
 			if response.StatusCode != expectedStatusCode &&
@@ -1072,10 +1674,17 @@ func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 			}
 
 			// Update meek session cookie
-			for _, c := range response.Cookies() {
-				if meek.cookie.Name == c.Name {
-					meek.cookie.Value = c.Value
-					break
+			if meek.tokenLocation != protocol.MEEK_SESSION_TOKEN_LOCATION_COOKIE {
+				sessionID := response.Header.Get(meek.tokenHeaderName)
+				if sessionID != "" {
+					meek.cookie.Value = sessionID
+				}
+			} else {
+				for _, c := range response.Cookies() {
+					if meek.cookie.Name == c.Name {
+						meek.cookie.Value = c.Value
+						break
+					}
 				}
 			}
 
@@ -1119,6 +1728,11 @@ func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 		// streaming the response payload. Always retry once. Then
 		// retry if time remains; when the next delay exceeds the time
 		// remaining until the deadline, do not retry.
+		//
+		// Stalls and resets may be caused by middleboxes which fail on
+		// larger payloads, so subsequent payloads are reduced in size.
+
+		meek.backOffChunkSize()
 
 		now := monotime.Now()
 
@@ -1227,6 +1841,9 @@ func makeMeekCookie(
 	meekObfuscatedKey string,
 	clientTunnelProtocol string,
 	endPoint string,
+	sessionIDHeader string,
+	maxChunkSize int,
+	minChunkSize int,
 
 ) (cookie *http.Cookie, err error) {
 
@@ -1234,6 +1851,9 @@ func makeMeekCookie(
 		MeekProtocolVersion:  MEEK_PROTOCOL_VERSION,
 		ClientTunnelProtocol: clientTunnelProtocol,
 		EndPoint:             endPoint,
+		SessionIDHeader:      sessionIDHeader,
+		MaxChunkSize:         maxChunkSize,
+		MinChunkSize:         minChunkSize,
 	}
 	serializedCookie, err := json.Marshal(cookieData)
 	if err != nil {
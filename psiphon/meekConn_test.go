@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	tris "github.com/Psiphon-Labs/tls-tris"
+)
+
+func TestMeekPollInterval(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"MeekMinPollInterval":                        "100ms",
+		"MeekMinPollIntervalJitter":                  0.0,
+		"MeekPollIntervalMultiplier":                 2.0,
+		"MeekPollIntervalJitter":                     0.0,
+		"MeekMaxPollInterval":                        "1s",
+		"MeekMaxPollIntervalJitter":                  0.1,
+		"MeekApplyPollIntervalMultiplierProbability": 1.0,
+		"MeekIdlePeriod":                             "10s",
+		"MeekIdleMaxPollInterval":                    "20s",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	p := clientParameters.Get()
+
+	interval := nextMeekPollInterval(p, 5*time.Second, true, 0)
+	if interval != 0 {
+		t.Fatalf("unexpected active interval: %s", interval)
+	}
+
+	interval = nextMeekPollInterval(p, 0, false, 0)
+	if interval != 100*time.Millisecond {
+		t.Fatalf("unexpected initial interval: %s", interval)
+	}
+
+	// Before MeekIdlePeriod, the interval is capped at MeekMaxPollInterval,
+	// with jitter.
+
+	for i := 0; i < 10; i++ {
+		interval = nextMeekPollInterval(p, interval, false, time.Second)
+	}
+	if interval < 900*time.Millisecond || interval > 1100*time.Millisecond {
+		t.Fatalf("unexpected max interval: %s", interval)
+	}
+
+	// After MeekIdlePeriod, the interval backs off to MeekIdleMaxPollInterval.
+
+	for i := 0; i < 10; i++ {
+		interval = nextMeekPollInterval(p, interval, false, 15*time.Second)
+	}
+	if interval < 18*time.Second || interval > 22*time.Second {
+		t.Fatalf("unexpected idle max interval: %s", interval)
+	}
+
+	// With MeekFrontIdleTimeout, the interval remains below the timeout and
+	// varies.
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"MeekMaxPollIntervalJitter": 0.1,
+		"MeekIdleMaxPollInterval":   "20s",
+		"MeekFrontIdleTimeout":      "10s",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	p = clientParameters.Get()
+
+	intervals := make(map[time.Duration]bool)
+	for i := 0; i < 10; i++ {
+		interval = nextMeekPollInterval(p, interval, false, 15*time.Second)
+		if interval >= 10*time.Second {
+			t.Fatalf("unexpected front idle interval: %s", interval)
+		}
+		intervals[interval] = true
+	}
+	if len(intervals) < 2 {
+		t.Fatalf("unexpected static interval: %s", interval)
+	}
+}
+
+func TestMeekRerandomize(t *testing.T) {
+
+	certificate, privateKey, err := common.GenerateWebServerCertificate("example.com")
+	if err != nil {
+		t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+	}
+
+	tlsCertificate, err := tris.X509KeyPair([]byte(certificate), []byte(privateKey))
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %s", err)
+	}
+
+	listener, err := tris.Listen(
+		"tcp", "127.0.0.1:0", &tris.Config{Certificates: []tris.Certificate{tlsCertificate}})
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"TunnelRerandomizeTLSProfile": true,
+		"LimitTLSProfiles":            protocol.TLSProfiles{protocol.TLS_PROFILE_RANDOMIZED},
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	dialConfig := &DialConfig{FragmentorSeed: 1}
+
+	tlsConfig := &CustomTLSConfig{
+		ClientParameters: clientParameters,
+		DialAddr:         listener.Addr().String(),
+		Dial:             NewTCPDialer(dialConfig),
+		SNIServerName:    "example.com",
+		SkipVerify:       true,
+		TLSProfile:       protocol.TLS_PROFILE_CHROME_58,
+	}
+	tlsConfig.EnableClientSessionCache(clientParameters)
+
+	preConn, peerConn := net.Pipe()
+	defer peerConn.Close()
+
+	cachedTLSDialer := newCachedTLSDialer(preConn, nil)
+	transport := &testMeekTransport{}
+
+	meek := &MeekConn{
+		clientParameters:          clientParameters,
+		cachedTLSDialer:           cachedTLSDialer,
+		transport:                 transport,
+		rerandomizeTLSConfig:      tlsConfig,
+		rerandomizeDialConfig:     dialConfig,
+		rerandomizeTunnelProtocol: protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+	}
+
+	// Re-randomization replaces the cached conn and the dialer, with a new
+	// TLS profile, and retires idle connections.
+
+	err = meek.Rerandomize(context.Background())
+	if err != nil {
+		t.Fatalf("Rerandomize failed: %s", err)
+	}
+
+	_, err = peerConn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatalf("unexpected replaced cached conn read success")
+	}
+
+	if meek.rerandomizeTLSConfig.TLSProfile != protocol.TLS_PROFILE_RANDOMIZED ||
+		meek.rerandomizeTLSConfig.utlsClientSessionCache == tlsConfig.utlsClientSessionCache ||
+		tlsConfig.TLSProfile != protocol.TLS_PROFILE_CHROME_58 {
+		t.Fatalf("unexpected TLS config")
+	}
+
+	if transport.closedIdleConns != 1 {
+		t.Fatalf("unexpected close count: %d", transport.closedIdleConns)
+	}
+
+	conn, err := cachedTLSDialer.dial("tcp", "")
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	conn.Close()
+
+	cachedTLSDialer.setRequestContext(context.Background())
+	conn, err = cachedTLSDialer.dial("tcp", "")
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	conn.Close()
+
+	// The new parameters are discarded when the negotiated application
+	// protocol changes.
+
+	meek.isHTTP2 = true
+
+	err = meek.Rerandomize(context.Background())
+	if err == nil {
+		t.Fatalf("unexpected Rerandomize success")
+	}
+
+	// Re-randomization fails once closed.
+
+	meek.isHTTP2 = false
+	cachedTLSDialer.close()
+
+	err = meek.Rerandomize(context.Background())
+	if err == nil {
+		t.Fatalf("unexpected Rerandomize success after close")
+	}
+
+	// Re-randomization is unsupported without a cached TLS dialer.
+
+	err = (&MeekConn{}).Rerandomize(context.Background())
+	if err == nil {
+		t.Fatalf("unexpected Rerandomize success")
+	}
+}
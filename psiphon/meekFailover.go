@@ -0,0 +1,257 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	MEEK_FAILOVER_ORDER_FRONTED   = "fronted"
+	MEEK_FAILOVER_ORDER_UNFRONTED = "unfronted"
+)
+
+// meekFailover is a fronted/unfronted meek failover plan for a single
+// candidate server: the meek protocols to try, in order, and the dial
+// timeout for each attempt.
+type meekFailover struct {
+	order     string
+	race      bool
+	protocols []string
+	timeouts  []time.Duration
+}
+
+// selectMeekFailover returns a meekFailover plan when the MeekFailoverOrder
+// parameter is set, selectedProtocol is a meek protocol, and the candidate
+// protocols include a meek protocol of the other class. The selected
+// protocol is retained as one attempt, and the other attempt is selected at
+// random from the candidate protocols of the other class. nil is returned
+// when failover doesn't apply.
+func selectMeekFailover(
+	p *parameters.ClientParametersSnapshot,
+	selectedProtocol string,
+	candidateProtocols protocol.TunnelProtocols) (*meekFailover, error) {
+
+	order := p.String(parameters.MeekFailoverOrder)
+	if (order != MEEK_FAILOVER_ORDER_FRONTED && order != MEEK_FAILOVER_ORDER_UNFRONTED) ||
+		!protocol.TunnelProtocolUsesMeek(selectedProtocol) {
+		return nil, nil
+	}
+
+	selectedFronted := protocol.TunnelProtocolUsesFrontedMeek(selectedProtocol)
+
+	var otherProtocols []string
+	for _, candidateProtocol := range candidateProtocols {
+		if protocol.TunnelProtocolUsesMeek(candidateProtocol) &&
+			protocol.TunnelProtocolUsesFrontedMeek(candidateProtocol) != selectedFronted {
+			otherProtocols = append(otherProtocols, candidateProtocol)
+		}
+	}
+
+	if len(otherProtocols) == 0 {
+		return nil, nil
+	}
+
+	index, err := common.MakeSecureRandomInt(len(otherProtocols))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	otherProtocol := otherProtocols[index]
+
+	frontedTimeout := p.Duration(parameters.MeekFrontedConnectTimeout)
+	unfrontedTimeout := p.Duration(parameters.MeekUnfrontedConnectTimeout)
+
+	failover := &meekFailover{
+		order: order,
+		race:  p.Bool(parameters.MeekFailoverRace),
+	}
+
+	if selectedFronted == (order == MEEK_FAILOVER_ORDER_FRONTED) {
+		failover.protocols = []string{selectedProtocol, otherProtocol}
+	} else {
+		failover.protocols = []string{otherProtocol, selectedProtocol}
+	}
+
+	for _, failoverProtocol := range failover.protocols {
+		timeout := unfrontedTimeout
+		if protocol.TunnelProtocolUsesFrontedMeek(failoverProtocol) {
+			timeout = frontedTimeout
+		}
+		failover.timeouts = append(failover.timeouts, timeout)
+	}
+
+	return failover, nil
+}
+
+// connectMeekFailover connects a tunnel to serverEntry using the meek
+// failover plan. Attempts are made in order, each starting once the
+// previous attempt fails or, when racing, all at once, in which case the
+// first tunnel to connect is used and the remaining tunnels are discarded.
+//
+// Each racing attempt after the first requires an additional connection
+// attempt slot. When slots aren't available, the attempts are made in order
+// instead, within the caller's slot, and the race flag recorded for the
+// attempts is false.
+//
+// The failover order, race flag, attempt index, and attempt timeout are
+// recorded in the dial parameters of each attempt. Each attempt outcome is
+// recorded in protocol health.
+func connectMeekFailover(
+	ctx context.Context,
+	config *Config,
+	sessionId string,
+	serverEntry *protocol.ServerEntry,
+	failover *meekFailover,
+	health *protocolHealth,
+	adjustedEstablishStartTime monotime.Time) (*Tunnel, error) {
+
+	race := failover.race
+	if race && !acquireRaceSlots(config, len(failover.protocols)-1) {
+		race = false
+	}
+
+	connect := func(ctx context.Context, attempt int) (*Tunnel, error) {
+
+		dialParams, err := MakeDialParameters(
+			config, serverEntry, failover.protocols[attempt])
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		dialParams.MeekFailoverOrder = failover.order
+		dialParams.MeekFailoverRace = race
+		dialParams.MeekFailoverAttempt = attempt
+		dialParams.MeekConnectTimeout = failover.timeouts[attempt]
+
+		tunnel, err := ConnectTunnelWithDialParameters(
+			ctx, config, sessionId, serverEntry, dialParams, adjustedEstablishStartTime)
+
+		// Don't record attempts interrupted by establishment stopping or by
+		// another racing attempt connecting.
+		if ctx.Err() == nil {
+			if err != nil {
+				health.recordFailure(failover.protocols[attempt])
+			} else {
+				health.recordSuccess(failover.protocols[attempt])
+			}
+		}
+
+		return tunnel, err
+	}
+
+	if !race {
+
+		var firstErr error
+		for attempt := range failover.protocols {
+
+			tunnel, err := connect(ctx, attempt)
+			if err == nil {
+				if attempt > 0 {
+					NoticeInfo("meek failover to %s for %s",
+						failover.protocols[attempt], serverEntry.IpAddress)
+				}
+				return tunnel, nil
+			}
+
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			if ctx.Err() != nil {
+				break
+			}
+		}
+
+		return nil, common.ContextError(firstErr)
+	}
+
+	type raceResult struct {
+		attempt int
+		tunnel  *Tunnel
+		err     error
+	}
+
+	raceCtx, cancelRace := context.WithCancel(ctx)
+	results := make(chan raceResult, len(failover.protocols))
+
+	for attempt := range failover.protocols {
+		go func(attempt int) {
+			if attempt > 0 {
+				defer config.connectionAttempts.release()
+			}
+			tunnel, err := connect(raceCtx, attempt)
+			results <- raceResult{attempt: attempt, tunnel: tunnel, err: err}
+		}(attempt)
+	}
+
+	var firstErr error
+	for i := 0; i < len(failover.protocols); i++ {
+
+		result := <-results
+
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+
+		// Interrupt the remaining attempts and discard any that connect.
+
+		cancelRace()
+		go func(remaining int) {
+			for j := 0; j < remaining; j++ {
+				result := <-results
+				if result.tunnel != nil {
+					result.tunnel.Close(true)
+				}
+			}
+		}(len(failover.protocols) - i - 1)
+
+		NoticeInfo("meek failover race won by %s for %s",
+			failover.protocols[result.attempt], serverEntry.IpAddress)
+
+		return result.tunnel, nil
+	}
+
+	cancelRace()
+
+	return nil, common.ContextError(firstErr)
+}
+
+// acquireRaceSlots acquires count additional connection attempt slots, when
+// all are immediately available. Otherwise, no slots are acquired.
+func acquireRaceSlots(config *Config, count int) bool {
+	for i := 0; i < count; i++ {
+		if !config.connectionAttempts.tryAcquire() {
+			for j := 0; j < i; j++ {
+				config.connectionAttempts.release()
+			}
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2015, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestSelectMeekFailover(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	candidateProtocols := protocol.TunnelProtocols{
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+	}
+
+	// With the default MeekFailoverOrder, there is no failover.
+
+	failover, err := selectMeekFailover(
+		clientParameters.Get(), protocol.TUNNEL_PROTOCOL_FRONTED_MEEK, candidateProtocols)
+	if err != nil {
+		t.Fatalf("selectMeekFailover failed: %s", err)
+	}
+	if failover != nil {
+		t.Fatalf("unexpected failover: %+v", failover)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.MeekFailoverOrder:           MEEK_FAILOVER_ORDER_UNFRONTED,
+		parameters.MeekFailoverRace:            true,
+		parameters.MeekUnfrontedConnectTimeout: "5s",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	testCases := []struct {
+		description       string
+		selectedProtocol  string
+		candidates        protocol.TunnelProtocols
+		expectedProtocols []string
+	}{
+		{
+			"fronted selected",
+			protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+			candidateProtocols,
+			[]string{protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, protocol.TUNNEL_PROTOCOL_FRONTED_MEEK},
+		},
+		{
+			"unfronted selected",
+			protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+			candidateProtocols,
+			[]string{protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, protocol.TUNNEL_PROTOCOL_FRONTED_MEEK},
+		},
+		{
+			"non-meek selected",
+			protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			candidateProtocols,
+			nil,
+		},
+		{
+			"no other class",
+			protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+			protocol.TunnelProtocols{
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+				protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP,
+			},
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			failover, err := selectMeekFailover(
+				clientParameters.Get(), testCase.selectedProtocol, testCase.candidates)
+			if err != nil {
+				t.Fatalf("selectMeekFailover failed: %s", err)
+			}
+
+			if testCase.expectedProtocols == nil {
+				if failover != nil {
+					t.Fatalf("unexpected failover: %+v", failover)
+				}
+				return
+			}
+
+			if failover == nil {
+				t.Fatalf("missing failover")
+			}
+
+			if len(failover.protocols) != len(testCase.expectedProtocols) ||
+				failover.protocols[0] != testCase.expectedProtocols[0] ||
+				failover.protocols[1] != testCase.expectedProtocols[1] {
+				t.Fatalf("unexpected failover protocols: %v", failover.protocols)
+			}
+
+			if failover.order != MEEK_FAILOVER_ORDER_UNFRONTED || !failover.race {
+				t.Fatalf("unexpected failover: %+v", failover)
+			}
+
+			// The unfronted attempt has the MeekUnfrontedConnectTimeout and
+			// the fronted attempt uses the default TunnelConnectTimeout.
+			if failover.timeouts[0] != 5*time.Second || failover.timeouts[1] != 0 {
+				t.Fatalf("unexpected failover timeouts: %v", failover.timeouts)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// meekURLSigner signs meek request URLs, for CDNs which require signed,
+// expiring URLs; see protocol.MeekURLSigningSchemes. Each request is signed,
+// immediately before it's sent, with an expiry of ttl.
+//
+// When the CDN rejects a signature, typically because the local clock is
+// skewed, the signer adjusts its clock offset using the response Date
+// header so that the request may be re-signed and resent.
+type meekURLSigner struct {
+	scheme      string
+	keyID       string
+	rsaKey      *rsa.PrivateKey
+	hmacKey     []byte
+	ttl         time.Duration
+	clockOffset int64
+}
+
+// newMeekURLSigner initializes a new meekURLSigner. The key is base64
+// encoded: for "cloudfront", a DER-encoded PKCS #1 or PKCS #8 RSA private
+// key; for "hmac-token", the HMAC key.
+func newMeekURLSigner(
+	scheme, keyID, key string, ttl time.Duration) (*meekURLSigner, error) {
+
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	signer := &meekURLSigner{
+		scheme: scheme,
+		keyID:  keyID,
+		ttl:    ttl,
+	}
+
+	switch scheme {
+
+	case protocol.MEEK_URL_SIGNING_SCHEME_CLOUDFRONT:
+
+		if keyID == "" {
+			return nil, common.ContextError(errors.New("missing key ID"))
+		}
+
+		rsaKey, err := x509.ParsePKCS1PrivateKey(decodedKey)
+		if err != nil {
+			privateKey, err := x509.ParsePKCS8PrivateKey(decodedKey)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			var ok bool
+			rsaKey, ok = privateKey.(*rsa.PrivateKey)
+			if !ok {
+				return nil, common.ContextError(errors.New("unexpected key type"))
+			}
+		}
+		signer.rsaKey = rsaKey
+
+	case protocol.MEEK_URL_SIGNING_SCHEME_HMAC_TOKEN:
+
+		if len(decodedKey) == 0 {
+			return nil, common.ContextError(errors.New("missing key"))
+		}
+		signer.hmacKey = decodedKey
+
+	default:
+		return nil, common.ContextError(
+			fmt.Errorf("unsupported URL signing scheme: %s", scheme))
+	}
+
+	return signer, nil
+}
+
+// sign adds signature query parameters to requestURL. Any existing
+// signature query parameters are replaced.
+func (signer *meekURLSigner) sign(requestURL *url.URL) error {
+
+	query := requestURL.Query()
+	for _, name := range protocol.MeekURLSigningQueryParameters {
+		query.Del(name)
+	}
+	requestURL.RawQuery = query.Encode()
+
+	now := time.Now().Add(time.Duration(atomic.LoadInt64(&signer.clockOffset)))
+	expires := strconv.FormatInt(now.Add(signer.ttl).Unix(), 10)
+
+	switch signer.scheme {
+
+	case protocol.MEEK_URL_SIGNING_SCHEME_CLOUDFRONT:
+
+		// The canned policy resource is the URL, including any query
+		// parameters, without the signature query parameters.
+
+		policy := fmt.Sprintf(
+			`{"Statement":[{"Resource":"%s","Condition":{"DateLessThan":{"AWS:EpochTime":%s}}}]}`,
+			requestURL.String(), expires)
+
+		digest := sha1.Sum([]byte(policy))
+		signature, err := rsa.SignPKCS1v15(
+			rand.Reader, signer.rsaKey, crypto.SHA1, digest[:])
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		query.Set("Expires", expires)
+		query.Set("Signature", cloudFrontBase64(signature))
+		query.Set("Key-Pair-Id", signer.keyID)
+
+	case protocol.MEEK_URL_SIGNING_SCHEME_HMAC_TOKEN:
+
+		mac := hmac.New(sha256.New, signer.hmacKey)
+		mac.Write([]byte(requestURL.EscapedPath() + expires))
+
+		query.Set("token", expires+"_"+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	requestURL.RawQuery = query.Encode()
+
+	return nil
+}
+
+// cloudFrontBase64 is the CloudFront URL-safe base64 encoding, which
+// replaces the standard '+', '=', and '/' characters.
+func cloudFrontBase64(data []byte) string {
+	return strings.NewReplacer("+", "-", "=", "_", "/", "~").Replace(
+		base64.StdEncoding.EncodeToString(data))
+}
+
+// isSignatureRejected indicates whether response is a CDN rejection of the
+// request signature. When the signature is rejected, the clock offset is
+// updated using the response Date header, when present, and the request
+// may be re-signed and resent.
+func (signer *meekURLSigner) isSignatureRejected(response *http.Response) bool {
+
+	if response.StatusCode != http.StatusForbidden {
+		return false
+	}
+
+	date, err := http.ParseTime(response.Header.Get("Date"))
+	if err == nil {
+		atomic.StoreInt64(&signer.clockOffset, int64(time.Until(date)))
+	}
+
+	return true
+}
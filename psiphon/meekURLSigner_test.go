@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestMeekURLSigner(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+	encodedRSAKey := base64.StdEncoding.EncodeToString(
+		x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	hmacKey := []byte("hmac key")
+	encodedHMACKey := base64.StdEncoding.EncodeToString(hmacKey)
+
+	_, err = newMeekURLSigner(
+		protocol.MEEK_URL_SIGNING_SCHEME_CLOUDFRONT, "", encodedRSAKey, time.Minute)
+	if err == nil {
+		t.Fatalf("unexpected success without key ID")
+	}
+
+	_, err = newMeekURLSigner("unknown", "", encodedHMACKey, time.Minute)
+	if err == nil {
+		t.Fatalf("unexpected success with unknown scheme")
+	}
+
+	// CloudFront canned policy signature
+
+	signer, err := newMeekURLSigner(
+		protocol.MEEK_URL_SIGNING_SCHEME_CLOUDFRONT, "KEYPAIRID", encodedRSAKey, time.Minute)
+	if err != nil {
+		t.Fatalf("newMeekURLSigner failed: %s", err)
+	}
+
+	requestURL, _ := url.Parse("https://example.com/path?Expires=1&session=abc")
+
+	err = signer.sign(requestURL)
+	if err != nil {
+		t.Fatalf("sign failed: %s", err)
+	}
+
+	query := requestURL.Query()
+	expires := query.Get("Expires")
+	if query.Get("Key-Pair-Id") != "KEYPAIRID" ||
+		query.Get("session") != "abc" ||
+		len(query["Expires"]) != 1 {
+		t.Fatalf("unexpected signed URL: %s", requestURL)
+	}
+
+	expiresTime, _ := strconv.ParseInt(expires, 10, 64)
+	if expiresTime < time.Now().Unix() || expiresTime > time.Now().Add(2*time.Minute).Unix() {
+		t.Fatalf("unexpected expiry: %s", expires)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(
+		strings.NewReplacer("-", "+", "_", "=", "~", "/").Replace(query.Get("Signature")))
+	if err != nil {
+		t.Fatalf("DecodeString failed: %s", err)
+	}
+
+	policy := fmt.Sprintf(
+		`{"Statement":[{"Resource":"https://example.com/path?session=abc","Condition":{"DateLessThan":{"AWS:EpochTime":%s}}}]}`,
+		expires)
+	digest := sha1.Sum([]byte(policy))
+
+	err = rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA1, digest[:], signature)
+	if err != nil {
+		t.Fatalf("VerifyPKCS1v15 failed: %s", err)
+	}
+
+	// HMAC token signature
+
+	signer, err = newMeekURLSigner(
+		protocol.MEEK_URL_SIGNING_SCHEME_HMAC_TOKEN, "", encodedHMACKey, time.Minute)
+	if err != nil {
+		t.Fatalf("newMeekURLSigner failed: %s", err)
+	}
+
+	requestURL, _ = url.Parse("https://example.com/path")
+
+	err = signer.sign(requestURL)
+	if err != nil {
+		t.Fatalf("sign failed: %s", err)
+	}
+
+	token := strings.SplitN(requestURL.Query().Get("token"), "_", 2)
+	if len(token) != 2 {
+		t.Fatalf("unexpected token: %s", requestURL)
+	}
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte("/path" + token[0]))
+	if token[1] != hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("unexpected token MAC: %s", requestURL)
+	}
+
+	// A rejection adjusts the clock offset, and the expiry of subsequent
+	// signatures, using the response Date header.
+
+	if signer.isSignatureRejected(&http.Response{StatusCode: http.StatusOK}) {
+		t.Fatalf("unexpected signature rejection")
+	}
+
+	serverTime := time.Now().Add(time.Hour)
+
+	response := &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     make(http.Header),
+	}
+	response.Header.Set("Date", serverTime.UTC().Format(http.TimeFormat))
+
+	if !signer.isSignatureRejected(response) {
+		t.Fatalf("unexpected signature acceptance")
+	}
+
+	err = signer.sign(requestURL)
+	if err != nil {
+		t.Fatalf("sign failed: %s", err)
+	}
+
+	token = strings.SplitN(requestURL.Query().Get("token"), "_", 2)
+	expiresTime, _ = strconv.ParseInt(token[0], 10, 64)
+	if expiresTime < serverTime.Add(30*time.Second).Unix() {
+		t.Fatalf("unexpected adjusted expiry: %s", token[0])
+	}
+}
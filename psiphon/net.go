@@ -35,6 +35,7 @@ import (
 
 	"github.com/Psiphon-Labs/dns"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
 
 const DNS_PORT = 53
@@ -83,6 +84,98 @@ type DialConfig struct {
 	// domain name.
 	// The callback may be invoked by a concurrent goroutine.
 	ResolvedIPCallback func(string)
+
+	// DSCP, when 1 to 63, is the DSCP value with which TCP and UDP sockets
+	// mark sent packets. Setting the DSCP value is not supported on Windows.
+	// Failure to set the DSCP value is not fatal.
+	DSCP int
+
+	// ObfuscationParameters, when set, are server entry obfuscation
+	// parameter overrides, validated by the caller. The fragmentor overrides
+	// are applied by DialTCPFragmentor.
+	ObfuscationParameters *protocol.ObfuscationParameters
+
+	// FragmentorSeed, when not 0, seeds the PRNG used by DialTCPFragmentor
+	// and NewTCPFragmentorDialer for all fragmentor selections, so that
+	// fragmentation may be reproduced; see DialParameters.
+	FragmentorSeed int64
+
+	// TCPFastOpen specifies whether to attempt TCP Fast Open for TCP dials,
+	// sending the initial write in the SYN. TCP Fast Open is currently
+	// supported only on Linux and is not used with UpstreamProxyURL. When
+	// TCP Fast Open is unavailable, the dial proceeds without it.
+	//
+	// When the SYN data is dropped, as done by some middleboxes, the kernel
+	// retransmits the SYN without data and suspends TCP Fast Open for the
+	// destination, so no additional fallback is required.
+	TCPFastOpen bool
+
+	// TCPFastOpenCallback, when set, is called once for each conn dialed
+	// with TCP Fast Open, when the first data is received, with whether the
+	// server acknowledged the SYN data. When no TCP Fast Open cookie is
+	// cached for the server, no SYN data is sent and the cookie is obtained
+	// for subsequent dials.
+	// The callback may be invoked by a concurrent goroutine.
+	TCPFastOpenCallback func(synDataAcked bool)
+
+	// TCPConnectTimeout, when > 0, limits the TCP connect phase of TCP
+	// dials, including any upstream proxy connect, within any deadline of
+	// the dial context. The resulting conn is not subject to the timeout.
+	TCPConnectTimeout time.Duration
+
+	// SourcePortMin and SourcePortMax, when SourcePortMin is > 0, specify a
+	// range from which TCP dials select a random local source port, instead
+	// of the platform's ephemeral port selection. When the selected port is
+	// in use, another port is selected, up to TCP_SOURCE_PORT_BIND_ATTEMPTS
+	// times, after which the dial falls back to an ephemeral port. Source
+	// port selection is not supported on Windows.
+	SourcePortMin int
+	SourcePortMax int
+
+	// SourcePortPolicy specifies how TCP dials select source ports across
+	// reconnections: SOURCE_PORT_POLICY_OS_DEFAULT, the default,
+	// SOURCE_PORT_POLICY_FRESH, or SOURCE_PORT_POLICY_REUSE_WITHIN_WINDOW,
+	// with SourcePortWindow as the window; see sourcePortHistory. The
+	// policies require sourcePortHistory and are not supported on Windows.
+	// SourcePortReusedCallback, when set, is called when a TCP dial reuses
+	// a source port. The callback may be invoked by a concurrent goroutine.
+	SourcePortPolicy         string
+	SourcePortWindow         time.Duration
+	SourcePortReusedCallback func()
+
+	// IPAddressFamilyFallbackDelay is the delay after which a TCP dial
+	// address that resolves to both IPv4 and IPv6 addresses starts dialing
+	// the non-preferred IP address family, racing the preferred family. The
+	// delay applies only when a family is preferred; see
+	// ipAddressFamilyPreference.
+	IPAddressFamilyFallbackDelay time.Duration
+
+	// IPAddressFamilyResetRetries is the maximum number of times a TCP dial
+	// which fails with a connection reset or refused error immediately
+	// retries the other IP address family. IPAddressFamilyResetRetryCallback,
+	// when set, is called for each retry. See dialIPAddresses.
+	IPAddressFamilyResetRetries       int
+	IPAddressFamilyResetRetryCallback func()
+
+	// dnsCache, when set, is used to resolve domain names in TCP dial
+	// addresses. dnsCache is not used with UpstreamProxyURL.
+	dnsCache *dnsCache
+
+	// ipAddressFamilyPreference, when set, orders and races the IPv4 and
+	// IPv6 addresses of TCP dial addresses and records dial outcomes.
+	ipAddressFamilyPreference *ipAddressFamilyPreference
+
+	// sourcePortHistory, when set, records source ports for
+	// SourcePortPolicy.
+	sourcePortHistory *sourcePortHistory
+
+	// connectionAttempts, when set, limits when a racing IP address family
+	// fallback dial is started before the preferred family dial fails.
+	connectionAttempts *connectionAttemptLimiter
+
+	// tcpConnCallback, when set, is called with each TCP conn dialed. When
+	// dialing through an upstream proxy, the conn is the conn to the proxy.
+	tcpConnCallback func(net.Conn)
 }
 
 // NetworkConnectivityChecker defines the interface to the external
@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"time"
+)
+
+const (
+	NETWORK_CONDITION_HINT_NORMAL    = "normal"
+	NETWORK_CONDITION_HINT_CONGESTED = "congested"
+	NETWORK_CONDITION_HINT_POOR      = "poor"
+)
+
+// networkConditionAdjustments modulate the aggressiveness of tunnel
+// establishment and operation according to a network condition hint
+// provided by the host application; see Controller.SetNetworkConditionHint.
+//
+// Hints are advisory and the adjustments are bounded: concurrency is only
+// ever reduced, to no fewer than one worker, and timeouts and periods are
+// only ever lengthened, by at most networkConditionMaxMultiplier. So a hint
+// cannot increase load on the network beyond what the client parameters
+// allow, and cannot disable a timeout.
+type networkConditionAdjustments struct {
+
+	// concurrencyFactor scales the number of establishment workers and the
+	// limit on concurrent resource intensive protocol workers.
+	concurrencyFactor float64
+
+	// timeoutMultiplier scales tunnel connect and SSH keep alive timeouts.
+	timeoutMultiplier float64
+
+	// periodMultiplier scales the SSH keep alive period and the pause
+	// between establishment rounds.
+	periodMultiplier float64
+}
+
+const networkConditionMaxMultiplier = 2.0
+
+var networkConditionHintAdjustments = map[string]networkConditionAdjustments{
+	NETWORK_CONDITION_HINT_NORMAL:    {1.0, 1.0, 1.0},
+	NETWORK_CONDITION_HINT_CONGESTED: {0.5, 1.5, 1.5},
+	NETWORK_CONDITION_HINT_POOR:      {0.25, 2.0, 2.0},
+}
+
+// isValidNetworkConditionHint indicates whether hint is a supported network
+// condition hint.
+func isValidNetworkConditionHint(hint string) bool {
+	_, ok := networkConditionHintAdjustments[hint]
+	return ok
+}
+
+// SetNetworkConditionHint sets the network condition hint. An unsupported
+// hint is ignored, leaving the current hint in place.
+func (config *Config) SetNetworkConditionHint(hint string) {
+
+	if !isValidNetworkConditionHint(hint) {
+		NoticeAlert("unsupported network condition hint: %s", hint)
+		return
+	}
+
+	config.dynamicConfigMutex.Lock()
+	changed := config.networkConditionHint != hint
+	config.networkConditionHint = hint
+	config.dynamicConfigMutex.Unlock()
+
+	if changed {
+		NoticeInfo("network condition hint: %s", hint)
+	}
+}
+
+// getNetworkConditionAdjustments returns the adjustments for the current
+// network condition hint.
+func (config *Config) getNetworkConditionAdjustments() networkConditionAdjustments {
+
+	config.dynamicConfigMutex.Lock()
+	hint := config.networkConditionHint
+	config.dynamicConfigMutex.Unlock()
+
+	adjustments, ok := networkConditionHintAdjustments[hint]
+	if !ok {
+		adjustments = networkConditionHintAdjustments[NETWORK_CONDITION_HINT_NORMAL]
+	}
+	return adjustments
+}
+
+// scaleConcurrency reduces a concurrency limit. A limit of 0, meaning no
+// limit, is not changed, and a positive limit is not reduced below 1.
+func (adjustments networkConditionAdjustments) scaleConcurrency(limit int) int {
+
+	if limit <= 0 || adjustments.concurrencyFactor >= 1.0 {
+		return limit
+	}
+
+	scaled := int(float64(limit) * adjustments.concurrencyFactor)
+	if scaled < 1 {
+		scaled = 1
+	}
+	return scaled
+}
+
+// scaleTimeout lengthens a timeout. A timeout of 0, meaning no timeout, is
+// not changed.
+func (adjustments networkConditionAdjustments) scaleTimeout(timeout time.Duration) time.Duration {
+	return scaleNetworkConditionDuration(timeout, adjustments.timeoutMultiplier)
+}
+
+// scalePeriod lengthens a period.
+func (adjustments networkConditionAdjustments) scalePeriod(period time.Duration) time.Duration {
+	return scaleNetworkConditionDuration(period, adjustments.periodMultiplier)
+}
+
+func scaleNetworkConditionDuration(duration time.Duration, multiplier float64) time.Duration {
+
+	if duration <= 0 || multiplier <= 1.0 {
+		return duration
+	}
+
+	if multiplier > networkConditionMaxMultiplier {
+		multiplier = networkConditionMaxMultiplier
+	}
+
+	return time.Duration(float64(duration) * multiplier)
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNetworkConditionHint(t *testing.T) {
+
+	config := &Config{}
+
+	adjustments := config.getNetworkConditionAdjustments()
+	if adjustments.scaleConcurrency(10) != 10 ||
+		adjustments.scaleTimeout(time.Second) != time.Second ||
+		adjustments.scalePeriod(time.Second) != time.Second {
+		t.Fatalf("unexpected default adjustments")
+	}
+
+	config.SetNetworkConditionHint(NETWORK_CONDITION_HINT_POOR)
+
+	adjustments = config.getNetworkConditionAdjustments()
+	if adjustments.scaleConcurrency(10) != 2 ||
+		adjustments.scaleTimeout(time.Second) != 2*time.Second ||
+		adjustments.scalePeriod(time.Second) != 2*time.Second {
+		t.Fatalf("unexpected poor adjustments")
+	}
+
+	// Adjustments are bounded: concurrency isn't reduced below 1 and no limit
+	// or no timeout remain unchanged.
+
+	if adjustments.scaleConcurrency(1) != 1 ||
+		adjustments.scaleConcurrency(0) != 0 ||
+		adjustments.scaleTimeout(0) != 0 {
+		t.Fatalf("unexpected bounded adjustments")
+	}
+
+	// An unsupported hint is ignored.
+
+	config.SetNetworkConditionHint("unknown")
+
+	adjustments = config.getNetworkConditionAdjustments()
+	if adjustments.scaleConcurrency(10) != 2 {
+		t.Fatalf("unexpected adjustments after unsupported hint")
+	}
+
+	config.SetNetworkConditionHint(NETWORK_CONDITION_HINT_CONGESTED)
+
+	adjustments = config.getNetworkConditionAdjustments()
+	if adjustments.scaleConcurrency(10) != 5 ||
+		adjustments.scaleTimeout(2*time.Second) != 3*time.Second {
+		t.Fatalf("unexpected congested adjustments")
+	}
+}
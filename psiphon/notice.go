@@ -47,6 +47,8 @@ type noticeLogger struct {
 	rotatingCurrentFileSize    int64
 	rotatingSyncFrequency      int
 	rotatingCurrentNoticeCount int
+	recentEvents               *recentEvents
+	detachedBuffer             *noticeBuffer
 }
 
 var singletonNoticeLogger = noticeLogger{
@@ -100,6 +102,73 @@ func SetNoticeWriter(writer io.Writer) {
 	singletonNoticeLogger.writer = writer
 }
 
+// DetachNoticeWriter stops writing notices to the writer set by
+// SetNoticeWriter, and instead retains notices in a bounded, in-memory
+// buffer until AttachNoticeWriter is called. This is intended for host
+// applications which temporarily stop consuming notices, as when a mobile
+// app is backgrounded, and which would otherwise lose notices or block
+// notice producers.
+//
+// maxNotices specifies the buffer size; when <= 0, the default,
+// NOTICE_BUFFER_DEFAULT_MAX_NOTICES, is used. When the buffer is full, the
+// oldest notices are dropped, with critical notices, such as Tunnels,
+// ActiveTunnel, and Error notices, retained in preference to other
+// notices.
+//
+// Notices written to the homepage and rotating notice files are not
+// affected. Calling DetachNoticeWriter while detached has no effect.
+func DetachNoticeWriter(maxNotices int) {
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	if singletonNoticeLogger.detachedBuffer != nil {
+		return
+	}
+
+	singletonNoticeLogger.detachedBuffer = newNoticeBuffer(maxNotices)
+}
+
+// AttachNoticeWriter resumes writing notices to the writer after
+// DetachNoticeWriter. Buffered notices are first written to the writer, in
+// the order they were emitted. When notices were dropped, the buffered
+// notices are preceded by a NoticesDropped notice with the count of dropped
+// notices.
+func AttachNoticeWriter() {
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	buffer := singletonNoticeLogger.detachedBuffer
+	if buffer == nil {
+		return
+	}
+	singletonNoticeLogger.detachedBuffer = nil
+
+	if buffer.dropped > 0 {
+		_, _ = singletonNoticeLogger.writer.Write(
+			encodeNotice(
+				"NoticesDropped", 0,
+				time.Now().UTC().Format(common.RFC3339Milli),
+				"count", buffer.dropped))
+	}
+
+	for _, notice := range buffer.notices {
+		_, _ = singletonNoticeLogger.writer.Write(notice.output)
+	}
+}
+
+// setNoticeRecentEvents sets the recentEvents which records lifecycle
+// notices. There is one recentEvents, belonging to the most recently
+// created controller.
+func setNoticeRecentEvents(recentEvents *recentEvents) {
+
+	singletonNoticeLogger.mutex.Lock()
+	defer singletonNoticeLogger.mutex.Unlock()
+
+	singletonNoticeLogger.recentEvents = recentEvents
+}
+
 // SetNoticeFiles configures files for notice writing.
 //
 // - When homepageFilename is not "", homepages are written to the specified file
@@ -188,36 +257,25 @@ const (
 // outputNotice encodes a notice in JSON and writes it to the output writer.
 func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args ...interface{}) {
 
-	if (noticeFlags&noticeIsDiagnostic != 0) && atomic.LoadInt32(&nl.logDiagnostics) != 1 {
-		return
-	}
+	timestamp := time.Now().UTC().Format(common.RFC3339Milli)
 
-	obj := make(map[string]interface{})
-	noticeData := make(map[string]interface{})
-	obj["noticeType"] = noticeType
-	obj["showUser"] = (noticeFlags&noticeShowUser != 0)
-	obj["data"] = noticeData
-	obj["timestamp"] = time.Now().UTC().Format(common.RFC3339Milli)
-	for i := 0; i < len(args)-1; i += 2 {
-		name, ok := args[i].(string)
-		value := args[i+1]
-		if ok {
-			noticeData[name] = value
+	// Lifecycle events are recorded before the diagnostic check, as only
+	// non-diagnostic fields are recorded.
+	if isRecentEvent(noticeType) {
+		nl.mutex.Lock()
+		recentEvents := nl.recentEvents
+		nl.mutex.Unlock()
+		if recentEvents != nil {
+			recentEvents.record(noticeType, timestamp, args...)
 		}
 	}
-	encodedJson, err := json.Marshal(obj)
-	var output []byte
-	if err == nil {
-		output = append(encodedJson, byte('\n'))
 
-	} else {
-		// Try to emit a properly formatted notice that the outer client can report.
-		// One scenario where this is useful is if the preceding Marshal fails due to
-		// bad data in the args. This has happened for a json.RawMessage field.
-		output = makeNoticeInternalError(
-			fmt.Sprintf("marshal notice failed: %s", common.ContextError(err)))
+	if (noticeFlags&noticeIsDiagnostic != 0) && atomic.LoadInt32(&nl.logDiagnostics) != 1 {
+		return
 	}
 
+	output := encodeNotice(noticeType, noticeFlags, timestamp, args...)
+
 	nl.mutex.Lock()
 	defer nl.mutex.Unlock()
 
@@ -253,10 +311,42 @@ func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args
 	}
 
 	if !skipWriter {
-		_, _ = nl.writer.Write(output)
+		if nl.detachedBuffer != nil {
+			nl.detachedBuffer.add(output, isCriticalNotice(noticeType, noticeFlags))
+		} else {
+			_, _ = nl.writer.Write(output)
+		}
 	}
 }
 
+// encodeNotice encodes a notice in JSON, with a trailing newline.
+func encodeNotice(
+	noticeType string, noticeFlags uint32, timestamp string, args ...interface{}) []byte {
+
+	obj := make(map[string]interface{})
+	noticeData := make(map[string]interface{})
+	obj["noticeType"] = noticeType
+	obj["showUser"] = (noticeFlags&noticeShowUser != 0)
+	obj["data"] = noticeData
+	obj["timestamp"] = timestamp
+	for i := 0; i < len(args)-1; i += 2 {
+		name, ok := args[i].(string)
+		value := args[i+1]
+		if ok {
+			noticeData[name] = value
+		}
+	}
+	encodedJson, err := json.Marshal(obj)
+	if err != nil {
+		// Try to emit a properly formatted notice that the outer client can report.
+		// One scenario where this is useful is if the preceding Marshal fails due to
+		// bad data in the args. This has happened for a json.RawMessage field.
+		return makeNoticeInternalError(
+			fmt.Sprintf("marshal notice failed: %s", common.ContextError(err)))
+	}
+	return append(encodedJson, byte('\n'))
+}
+
 // NoticeInteralError is an error formatting or writing notices.
 // A NoticeInteralError handler must not call a Notice function.
 func makeNoticeInternalError(errorMessage string) []byte {
@@ -389,6 +479,56 @@ func NoticeCandidateServers(
 		"count", count)
 }
 
+// NoticeEgressRegionUnavailable indicates that no known server egresses in
+// the region specified by EgressRegion, so no tunnel can be established
+// unless servers in the region are later discovered, as by a remote server
+// list fetch. The host application may prompt the user to select another
+// region.
+func NoticeEgressRegionUnavailable(region string) {
+	singletonNoticeLogger.outputNotice(
+		"EgressRegionUnavailable", 0,
+		"region", region)
+}
+
+// NoticeProtocolHealth reports the current selection weight of each tunnel
+// protocol with recorded protocol health state. A weight of 0 indicates the
+// protocol is disabled; a weight between 0 and 1 indicates the protocol is
+// being re-enabled.
+func NoticeProtocolHealth(weights map[string]float64) {
+	singletonNoticeLogger.outputNotice(
+		"ProtocolHealth", noticeIsDiagnostic,
+		"weights", weights)
+}
+
+// NoticeProtocolDisabled reports that a tunnel protocol has been
+// temporarily disabled due to repeated connection failures.
+func NoticeProtocolDisabled(tunnelProtocol string, disabledUntil time.Time) {
+	singletonNoticeLogger.outputNotice(
+		"ProtocolDisabled", noticeIsDiagnostic,
+		"protocol", tunnelProtocol,
+		"disabledUntil", disabledUntil)
+}
+
+// NoticeSuspectedBlocking reports that the pattern of tunnel connection
+// failures suggests active blocking, and that establishment is pausing for
+// pausePeriod before trying again. The app may suggest alternatives, such
+// as changing networks.
+func NoticeSuspectedBlocking(pausePeriod time.Duration) {
+	singletonNoticeLogger.outputNotice(
+		"SuspectedBlocking", 0,
+		"pausePeriod", pausePeriod)
+}
+
+// NoticeDataStoreRecovered reports that a corrupt datastore was discarded
+// and replaced with a new datastore. backupFilename is the retained corrupt
+// datastore file, when backed up, or "".
+func NoticeDataStoreRecovered(err error, backupFilename string) {
+	singletonNoticeLogger.outputNotice(
+		"DataStoreRecovered", 0,
+		"error", err.Error(),
+		"backupFilename", backupFilename)
+}
+
 // NoticeAvailableEgressRegions is what regions are available for egress from.
 // Consecutive reports of the same list of regions are suppressed.
 func NoticeAvailableEgressRegions(regions []string) {
@@ -443,13 +583,36 @@ func noticeWithDialStats(noticeType, ipAddress, region, protocol string, dialSta
 	}
 
 	if dialStats.SelectedUserAgent {
-		args = append(args, "userAgent", dialStats.UserAgent)
+		if dialStats.UserAgentFamily != "" {
+			args = append(args, "userAgentFamily", dialStats.UserAgentFamily)
+		} else {
+			args = append(args, "userAgent", dialStats.UserAgent)
+		}
 	}
 
 	if dialStats.SelectedTLSProfile {
 		args = append(args, "TLSProfile", dialStats.TLSProfile)
 	}
 
+	if atomic.LoadInt32(&dialStats.TCPFastOpenAttempted) == 1 {
+		args = append(args,
+			"TCPFastOpenSucceeded", atomic.LoadInt32(&dialStats.TCPFastOpenSucceeded) == 1)
+	}
+
+	if dialStats.OSSHDecoyFirstFlight {
+		args = append(args, "OSSHDecoyFirstFlight", true)
+	}
+
+	if dialStats.OSSHSeedKeyDerivation != "" {
+		args = append(args, "OSSHSeedKeyDerivation", dialStats.OSSHSeedKeyDerivation)
+	}
+
+	if dialStats.SourcePortPolicy != "" {
+		args = append(args,
+			"sourcePortPolicy", dialStats.SourcePortPolicy,
+			"sourcePortReused", atomic.LoadInt32(&dialStats.SourcePortReused) == 1)
+	}
+
 	singletonNoticeLogger.outputNotice(
 		noticeType, noticeIsDiagnostic,
 		args...)
@@ -502,6 +665,36 @@ func NoticeListeningSocksProxyPort(port int) {
 		"port", port)
 }
 
+// NoticeSocksProxyUnixSocketInUse is a failure to use the configured
+// LocalSocksProxyUnixSocketPath, which is in use by another process
+func NoticeSocksProxyUnixSocketInUse(path string) {
+	singletonNoticeLogger.outputNotice(
+		"SocksProxyUnixSocketInUse",
+		noticeShowUser, "path", path)
+}
+
+// NoticeListeningSocksProxyUnixSocket is the Unix domain socket path for the
+// listening local SOCKS proxy
+func NoticeListeningSocksProxyUnixSocket(path string) {
+	singletonNoticeLogger.outputNotice(
+		"ListeningSocksProxyUnixSocket", 0,
+		"path", path)
+}
+
+// NoticeDNSProxyPortInUse is a failure to use the configured LocalDNSProxyPort
+func NoticeDNSProxyPortInUse(port int) {
+	singletonNoticeLogger.outputNotice(
+		"DNSProxyPortInUse",
+		noticeShowUser, "port", port)
+}
+
+// NoticeListeningDNSProxyPort is the selected port for the listening local DNS proxy
+func NoticeListeningDNSProxyPort(port int) {
+	singletonNoticeLogger.outputNotice(
+		"ListeningDNSProxyPort", 0,
+		"port", port)
+}
+
 // NoticeHttpProxyPortInUse is a failure to use the configured LocalHttpProxyPort
 func NoticeHttpProxyPortInUse(port int) {
 	singletonNoticeLogger.outputNotice(
@@ -516,6 +709,22 @@ func NoticeListeningHttpProxyPort(port int) {
 		"port", port)
 }
 
+// NoticeHttpProxyUnixSocketInUse is a failure to use the configured
+// LocalHttpProxyUnixSocketPath, which is in use by another process
+func NoticeHttpProxyUnixSocketInUse(path string) {
+	singletonNoticeLogger.outputNotice(
+		"HttpProxyUnixSocketInUse",
+		noticeShowUser, "path", path)
+}
+
+// NoticeListeningHttpProxyUnixSocket is the Unix domain socket path for the
+// listening local HTTP proxy
+func NoticeListeningHttpProxyUnixSocket(path string) {
+	singletonNoticeLogger.outputNotice(
+		"ListeningHttpProxyUnixSocket", 0,
+		"path", path)
+}
+
 // NoticeClientUpgradeAvailable is an available client upgrade, as per the handshake. The
 // client should download and install an upgrade.
 func NoticeClientUpgradeAvailable(version string) {
@@ -524,6 +733,16 @@ func NoticeClientUpgradeAvailable(version string) {
 		"version", version)
 }
 
+// NoticeClientUpgradeRequired indicates that a server rejected the client
+// handshake because the client version is below the server's minimum client
+// version. The client should download and install an upgrade; version is
+// the available upgrade version, if known.
+func NoticeClientUpgradeRequired(version string) {
+	singletonNoticeLogger.outputNotice(
+		"ClientUpgradeRequired", 0,
+		"version", version)
+}
+
 // NoticeClientIsLatestVersion reports that an upgrade check was made and the client
 // is already the latest version. availableVersion is the version available for download,
 // if known.
@@ -567,6 +786,27 @@ func NoticeTunnels(count int) {
 		"count", count)
 }
 
+// NoticeTunnelDisconnected indicates that an active tunnel has disconnected.
+// reason is one of the TUNNEL_DISCONNECT_REASON values, such as
+// "keepalive_timeout" or "network_changed", and willReconnect indicates
+// whether a replacement tunnel will be established. As with Tunnels, the
+// client should use Tunnels to determine connected state; this notice
+// explains why a disconnect occurred.
+func NoticeTunnelDisconnected(reason string, willReconnect bool) {
+	singletonNoticeLogger.outputNotice(
+		"TunnelDisconnected", 0,
+		"reason", reason,
+		"willReconnect", willReconnect)
+}
+
+// NoticePaused indicates that tunneling has been paused, when isPaused is
+// set, or resumed. See Controller.Pause.
+func NoticePaused(isPaused bool) {
+	singletonNoticeLogger.outputNotice(
+		"Paused", 0,
+		"isPaused", isPaused)
+}
+
 // NoticeSessionId is the session ID used across all tunnels established by the controller.
 func NoticeSessionId(sessionId string) {
 	singletonNoticeLogger.outputNotice(
@@ -640,6 +880,15 @@ func NoticeTotalBytesTransferred(ipAddress string, sent, received int64) {
 		"received", received)
 }
 
+// NoticeFrontingDNSCache reports fronting DNS cache hit and miss counts
+// since the last report.
+func NoticeFrontingDNSCache(hits, misses int64) {
+	singletonNoticeLogger.outputNotice(
+		"FrontingDNSCache", noticeIsDiagnostic,
+		"hits", hits,
+		"misses", misses)
+}
+
 // NoticeLocalProxyError reports a local proxy error message. Repetitive
 // errors for a given proxy type are suppressed.
 func NoticeLocalProxyError(proxyType string, err error) {
@@ -706,6 +955,42 @@ func NoticeServerTimestamp(timestamp string) {
 		"timestamp", timestamp)
 }
 
+// NoticeEgressIPAddress reports the public IP address from which the
+// current tunnel's port forwarded traffic egresses, as reported by the
+// server.
+func NoticeEgressIPAddress(IPAddress string) {
+	singletonNoticeLogger.outputNotice(
+		"EgressIPAddress", 0,
+		"ipAddress", IPAddress)
+}
+
+// NoticeClockSkew reports that the local clock differs significantly from
+// the server clock. skewSeconds is positive when the local clock is ahead.
+func NoticeClockSkew(skew time.Duration) {
+	singletonNoticeLogger.outputNotice(
+		"ClockSkew", 0,
+		"skewSeconds", int64(skew/time.Second))
+}
+
+// NoticeSlowOperation reports that an operation exceeded its slow operation
+// threshold parameter. durationMilliseconds is the operation duration.
+func NoticeSlowOperation(operation string, duration time.Duration) {
+	singletonNoticeLogger.outputNotice(
+		"SlowOperation", 0,
+		"operation", operation,
+		"durationMilliseconds", int64(duration/time.Millisecond))
+}
+
+// NoticeBandwidthTest reports the result of a tunnel bandwidth test.
+func NoticeBandwidthTest(result *BandwidthTestResult) {
+	singletonNoticeLogger.outputNotice(
+		"BandwidthTest", 0,
+		"upstreamBytes", result.UpstreamBytes,
+		"downstreamBytes", result.DownstreamBytes,
+		"upstreamBitsPerSecond", result.UpstreamBitsPerSecond,
+		"downstreamBitsPerSecond", result.DownstreamBitsPerSecond)
+}
+
 // NoticeActiveAuthorizationIDs reports the authorizations the server has accepted.
 // Each ID is a base64-encoded accesscontrol.Authorization.ID value.
 func NoticeActiveAuthorizationIDs(activeAuthorizationIDs []string) {
@@ -732,6 +1017,52 @@ func NoticeNetworkID(networkID string) {
 		"NetworkID", 0, "ID", networkID)
 }
 
+// NoticeTransparentProxyDetected reports that the transparent HTTP proxy
+// canary request indicated interference, and that avoidProtocols will not be
+// selected for the remainder of the establishment.
+func NoticeTransparentProxyDetected(indicators []string, avoidProtocols []string) {
+	singletonNoticeLogger.outputNotice(
+		"TransparentProxyDetected", noticeIsDiagnostic,
+		"indicators", indicators,
+		"avoidProtocols", avoidProtocols)
+}
+
+// NoticeCaptivePortalDetected reports that the captive portal canary
+// request indicated a captive portal. Tunnel establishment is paused until
+// the portal is cleared; the app may prompt the user to authenticate with
+// the portal.
+func NoticeCaptivePortalDetected(indicators []string) {
+	singletonNoticeLogger.outputNotice(
+		"CaptivePortalDetected", 0,
+		"indicators", indicators)
+}
+
+// NoticeCaptivePortalCleared reports that a detected captive portal no
+// longer intercepts the canary request, and tunnel establishment has
+// resumed.
+func NoticeCaptivePortalCleared() {
+	singletonNoticeLogger.outputNotice(
+		"CaptivePortalCleared", 0)
+}
+
+// NoticeTunnelPoolSize indicates that adaptive tunnel pool sizing has
+// changed the target number of tunnels to run in parallel.
+func NoticeTunnelPoolSize(size int) {
+	singletonNoticeLogger.outputNotice(
+		"TunnelPoolSize", 0,
+		"size", size)
+}
+
+// NoticeDiagnosticBundleAvailable indicates that a diagnostic bundle has been
+// generated after consecutiveFailures failed tunnel connection attempts. The
+// host application may retrieve the bundle with
+// Controller.GetDiagnosticBundle and offer to send it to support.
+func NoticeDiagnosticBundleAvailable(consecutiveFailures int) {
+	singletonNoticeLogger.outputNotice(
+		"DiagnosticBundleAvailable", 0,
+		"consecutiveFailures", consecutiveFailures)
+}
+
 type repetitiveNoticeState struct {
 	message string
 	repeats int
@@ -960,3 +1291,23 @@ func (context *commonLogContext) Warning(args ...interface{}) {
 func (context *commonLogContext) Error(args ...interface{}) {
 	context.outputNotice("Error", args...)
 }
+
+// NoticeConnectionPreference reports the effective settings selected by the
+// ConnectionPreference config, after any tactics are applied.
+func NoticeConnectionPreference(
+	preference string,
+	preferredProtocols []string,
+	preferredProtocolsBias float64,
+	writeCoalescingWindow time.Duration,
+	writeCoalescingMaxBytes int,
+	limitMeekBufferSizes bool) {
+
+	singletonNoticeLogger.outputNotice(
+		"ConnectionPreference", 0,
+		"preference", preference,
+		"preferredProtocols", preferredProtocols,
+		"preferredProtocolsBias", preferredProtocolsBias,
+		"writeCoalescingWindow", writeCoalescingWindow,
+		"writeCoalescingMaxBytes", writeCoalescingMaxBytes,
+		"limitMeekBufferSizes", limitMeekBufferSizes)
+}
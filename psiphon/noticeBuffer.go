@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+const (
+	NOTICE_BUFFER_DEFAULT_MAX_NOTICES = 1000
+)
+
+// criticalNoticeTypes lists the notice types which are prioritized for
+// retention in a noticeBuffer: notices which change the connection state
+// presented by the app UI, or which require user action. Notices with the
+// showUser flag are also critical.
+var criticalNoticeTypes = map[string]bool{
+	"ActiveTunnel":          true,
+	"Tunnels":               true,
+	"TunnelDisconnected":    true,
+	"Paused":                true,
+	"Homepage":              true,
+	"ClientRegion":          true,
+	"Error":                 true,
+	"Alert":                 true,
+	"UpstreamProxyError":    true,
+	"ClientUpgradeRequired": true,
+	"CaptivePortalDetected": true,
+	"CaptivePortalCleared":  true,
+	"Exiting":               true,
+}
+
+func isCriticalNotice(noticeType string, noticeFlags uint32) bool {
+	return noticeFlags&noticeShowUser != 0 || criticalNoticeTypes[noticeType]
+}
+
+// noticeBuffer is a bounded, in-memory queue of encoded notices, which
+// retains notices while the notice writer is detached; see
+// DetachNoticeWriter.
+//
+// When the buffer is full, the oldest non-critical notice is dropped to
+// make room for a new notice. When all buffered notices are critical, the
+// oldest critical notice is dropped. Dropped notices are counted.
+type noticeBuffer struct {
+	maxNotices int
+	notices    []bufferedNotice
+	dropped    int
+}
+
+type bufferedNotice struct {
+	output   []byte
+	critical bool
+}
+
+func newNoticeBuffer(maxNotices int) *noticeBuffer {
+	if maxNotices <= 0 {
+		maxNotices = NOTICE_BUFFER_DEFAULT_MAX_NOTICES
+	}
+	return &noticeBuffer{maxNotices: maxNotices}
+}
+
+// add adds an encoded notice to the buffer, dropping a notice when the
+// buffer is full.
+func (buffer *noticeBuffer) add(output []byte, critical bool) {
+
+	if len(buffer.notices) >= buffer.maxNotices {
+
+		// When there's no non-critical notice, drop the oldest notice.
+		drop := 0
+		for i, notice := range buffer.notices {
+			if !notice.critical {
+				drop = i
+				break
+			}
+		}
+
+		buffer.notices = append(buffer.notices[:drop], buffer.notices[drop+1:]...)
+		buffer.dropped++
+	}
+
+	buffer.notices = append(
+		buffer.notices, bufferedNotice{output: output, critical: critical})
+}
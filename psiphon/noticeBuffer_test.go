@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNoticeBuffer(t *testing.T) {
+
+	var output bytes.Buffer
+	SetNoticeWriter(&output)
+	defer SetNoticeWriter(os.Stderr)
+
+	maxNotices := 5
+
+	DetachNoticeWriter(maxNotices)
+
+	NoticeTunnels(0)
+	for i := 0; i < 10; i++ {
+		NoticeInfo("info %d", i)
+	}
+	NoticeTunnels(1)
+
+	if output.Len() != 0 {
+		t.Fatalf("unexpected output while detached")
+	}
+
+	AttachNoticeWriter()
+
+	NoticeInfo("attached")
+
+	var noticeTypes []string
+	var messages []string
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		var notice struct {
+			NoticeType string                 `json:"noticeType"`
+			Data       map[string]interface{} `json:"data"`
+		}
+		err := json.Unmarshal([]byte(line), &notice)
+		if err != nil {
+			t.Fatalf("json.Unmarshal failed: %s", err)
+		}
+		noticeTypes = append(noticeTypes, notice.NoticeType)
+		if notice.NoticeType == "Info" {
+			messages = append(messages, notice.Data["message"].(string))
+		}
+		if notice.NoticeType == "NoticesDropped" && notice.Data["count"].(float64) != 7 {
+			t.Fatalf("unexpected dropped count: %v", notice.Data["count"])
+		}
+	}
+
+	// The oldest Info notices are dropped, while the critical Tunnels
+	// notices are retained.
+
+	expectedNoticeTypes := "NoticesDropped Tunnels Info Info Info Tunnels Info"
+	if strings.Join(noticeTypes, " ") != expectedNoticeTypes {
+		t.Fatalf("unexpected notices: %v", noticeTypes)
+	}
+
+	expectedMessages := "info 7 info 8 info 9 attached"
+	if strings.Join(messages, " ") != expectedMessages {
+		t.Fatalf("unexpected messages: %v", messages)
+	}
+}
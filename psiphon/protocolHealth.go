@@ -0,0 +1,303 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// protocolHealth tracks tunnel protocol connection failures and temporarily
+// disables tunnel protocols which repeatedly fail, as happens when a
+// protocol is newly blocked in the client's region. This avoids wasting
+// establishment attempts on blocked protocols.
+//
+// When ProtocolFailureThreshold failures, without an intervening success,
+// occur within ProtocolFailureWindow, the protocol is disabled for
+// ProtocolDisablePeriod. The protocol is then gradually re-enabled over
+// ProtocolReenablePeriod: during this period, its selection weight
+// increases linearly from 0 to 1, so that recovery is probed with a
+// limited number of attempts. A success fully re-enables the protocol; a
+// failure while probing disables the protocol again.
+//
+// Protocol health is recorded per network ID and persisted in the
+// datastore, so disabled protocols remain disabled across restarts and
+// health learned on one network is not applied to another.
+//
+// Protocol health is applied after the LimitTunnelProtocols and TLS
+// interception exclusions, at the same protocol granularity. The last
+// enabled protocol among the protocols permitted for establishment is never
+// disabled, so protocol health alone never prevents establishment.
+type protocolHealth struct {
+	networkID          string
+	failureThreshold   int
+	failureWindow      time.Duration
+	disablePeriod      time.Duration
+	reenablePeriod     time.Duration
+	permittedProtocols protocol.TunnelProtocols
+
+	mutex  sync.Mutex
+	states map[string]*protocolHealthState
+}
+
+// protocolHealthState is the persisted health state for a single tunnel
+// protocol. Wall clock times are used as the state is persisted across
+// restarts.
+type protocolHealthState struct {
+	FailureCount  int       `json:"failureCount"`
+	FailureStart  time.Time `json:"failureStart"`
+	DisabledUntil time.Time `json:"disabledUntil"`
+}
+
+// newProtocolHealth initializes protocol health for an establishment,
+// loading any persisted state for the current network ID. As with the
+// LimitTunnelProtocols parameters, the protocol health parameters are set
+// once per establishment.
+func newProtocolHealth(
+	config *Config, permittedProtocols protocol.TunnelProtocols) *protocolHealth {
+
+	p := config.clientParameters.Get()
+
+	if len(permittedProtocols) == 0 {
+		permittedProtocols = protocol.SupportedTunnelProtocols
+	}
+
+	// When no NetworkIDGetter is configured, all protocol health is
+	// recorded under a single, blank network ID.
+	networkID := ""
+	if config.networkIDGetter != nil {
+		networkID = config.networkIDGetter.GetNetworkID()
+	}
+
+	health := &protocolHealth{
+		networkID:          networkID,
+		failureThreshold:   p.Int(parameters.ProtocolFailureThreshold),
+		failureWindow:      p.Duration(parameters.ProtocolFailureWindow),
+		disablePeriod:      p.Duration(parameters.ProtocolDisablePeriod),
+		reenablePeriod:     p.Duration(parameters.ProtocolReenablePeriod),
+		permittedProtocols: permittedProtocols,
+		states:             make(map[string]*protocolHealthState),
+	}
+
+	record, err := getProtocolHealthRecord(health.networkID)
+	if err != nil {
+		NoticeAlert("getProtocolHealthRecord failed: %s", err)
+	} else if record != nil {
+		err = json.Unmarshal(record, &health.states)
+		if err != nil {
+			NoticeAlert("invalid protocol health record: %s", common.ContextError(err))
+			health.states = make(map[string]*protocolHealthState)
+		}
+	}
+
+	return health
+}
+
+func (health *protocolHealth) isEnabled() bool {
+	return health != nil && health.failureThreshold > 0
+}
+
+// weight returns the selection weight for the specified protocol: 1 when
+// the protocol is enabled, 0 when the protocol is disabled, and a value
+// in between when the protocol is being re-enabled. The caller must lock
+// the mutex.
+func (health *protocolHealth) weight(tunnelProtocol string, now time.Time) float64 {
+
+	state, ok := health.states[tunnelProtocol]
+	if !ok || state.DisabledUntil.IsZero() {
+		return 1.0
+	}
+
+	if now.Before(state.DisabledUntil) {
+		return 0.0
+	}
+
+	elapsed := now.Sub(state.DisabledUntil)
+	if health.reenablePeriod <= 0 || elapsed >= health.reenablePeriod {
+		return 1.0
+	}
+
+	return float64(elapsed) / float64(health.reenablePeriod)
+}
+
+// filterProtocols returns the candidate protocols which are selected
+// according to their protocol health weights. Protocols being re-enabled
+// are selected with a probability equal to their weight.
+func (health *protocolHealth) filterProtocols(
+	candidateProtocols protocol.TunnelProtocols) protocol.TunnelProtocols {
+
+	if !health.isEnabled() {
+		return candidateProtocols
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	now := time.Now()
+
+	var selectedProtocols protocol.TunnelProtocols
+	for _, candidateProtocol := range candidateProtocols {
+		weight := health.weight(candidateProtocol, now)
+		if weight >= 1.0 || (weight > 0.0 && common.FlipWeightedCoin(weight)) {
+			selectedProtocols = append(selectedProtocols, candidateProtocol)
+		}
+	}
+
+	return selectedProtocols
+}
+
+// recordFailure records a failed tunnel connection using the specified
+// protocol, disabling the protocol when the failure threshold is reached.
+func (health *protocolHealth) recordFailure(tunnelProtocol string) {
+
+	if !health.isEnabled() {
+		return
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	now := time.Now()
+
+	state, ok := health.states[tunnelProtocol]
+	if !ok {
+		state = &protocolHealthState{}
+		health.states[tunnelProtocol] = state
+	}
+
+	weight := health.weight(tunnelProtocol, now)
+
+	if weight == 0.0 {
+		// The protocol is already disabled.
+		return
+	}
+
+	disable := false
+
+	if weight < 1.0 {
+
+		// A failure while probing for recovery disables the protocol again.
+		disable = true
+
+	} else {
+
+		if !state.DisabledUntil.IsZero() {
+			// The protocol was fully re-enabled by elapsed time.
+			state.DisabledUntil = time.Time{}
+		}
+
+		if state.FailureCount == 0 || now.Sub(state.FailureStart) > health.failureWindow {
+			state.FailureCount = 0
+			state.FailureStart = now
+		}
+
+		state.FailureCount += 1
+
+		disable = state.FailureCount >= health.failureThreshold
+	}
+
+	if disable && health.isLastEnabledProtocol(tunnelProtocol, now) {
+		disable = false
+	}
+
+	if disable {
+		state.FailureCount = 0
+		state.FailureStart = time.Time{}
+		state.DisabledUntil = now.Add(health.disablePeriod)
+		NoticeProtocolDisabled(tunnelProtocol, state.DisabledUntil)
+	}
+
+	health.store()
+}
+
+// recordSuccess records a successful tunnel connection using the specified
+// protocol, which fully re-enables the protocol.
+func (health *protocolHealth) recordSuccess(tunnelProtocol string) {
+
+	if !health.isEnabled() {
+		return
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if _, ok := health.states[tunnelProtocol]; !ok {
+		return
+	}
+
+	delete(health.states, tunnelProtocol)
+
+	health.store()
+}
+
+// isLastEnabledProtocol checks if all permitted protocols other than the
+// specified protocol are disabled. The caller must lock the mutex.
+func (health *protocolHealth) isLastEnabledProtocol(
+	tunnelProtocol string, now time.Time) bool {
+
+	for _, permittedProtocol := range health.permittedProtocols {
+		if permittedProtocol != tunnelProtocol &&
+			health.weight(permittedProtocol, now) > 0.0 {
+			return false
+		}
+	}
+	return true
+}
+
+// getWeights returns the current selection weight of each protocol with
+// recorded health state, for diagnostics.
+func (health *protocolHealth) getWeights() map[string]float64 {
+
+	if !health.isEnabled() {
+		return nil
+	}
+
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	now := time.Now()
+
+	weights := make(map[string]float64)
+	for tunnelProtocol := range health.states {
+		weights[tunnelProtocol] = health.weight(tunnelProtocol, now)
+	}
+	return weights
+}
+
+// store persists the protocol health state. The caller must lock the
+// mutex.
+func (health *protocolHealth) store() {
+
+	record, err := json.Marshal(health.states)
+	if err != nil {
+		NoticeAlert("marshal protocol health record failed: %s", common.ContextError(err))
+		return
+	}
+
+	err = setProtocolHealthRecord(health.networkID, record)
+	if err != nil {
+		NoticeAlert("setProtocolHealthRecord failed: %s", err)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestProtocolHealth(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-protocol-health-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "NetworkID" : "NETWORK1"
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	applyParameters := make(map[string]interface{})
+	applyParameters[parameters.ProtocolFailureThreshold] = 3
+	applyParameters[parameters.ProtocolFailureWindow] = "1h"
+	applyParameters[parameters.ProtocolDisablePeriod] = "1h"
+	applyParameters[parameters.ProtocolReenablePeriod] = "1h"
+
+	err = clientConfig.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		t.Fatalf("error setting client parameters: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	permittedProtocols := protocol.TunnelProtocols{
+		protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+	}
+
+	health := newProtocolHealth(clientConfig, permittedProtocols)
+
+	// Failures below the threshold, or interrupted by a success, don't
+	// disable the protocol.
+
+	failingProtocol := protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS
+
+	health.recordFailure(failingProtocol)
+	health.recordFailure(failingProtocol)
+	health.recordSuccess(failingProtocol)
+	health.recordFailure(failingProtocol)
+	health.recordFailure(failingProtocol)
+
+	if len(health.filterProtocols(permittedProtocols)) != 2 {
+		t.Fatalf("unexpected disabled protocol")
+	}
+
+	// Reaching the threshold disables the protocol.
+
+	health.recordFailure(failingProtocol)
+
+	filteredProtocols := health.filterProtocols(permittedProtocols)
+	if len(filteredProtocols) != 1 || filteredProtocols[0] != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+		t.Fatalf("unexpected filtered protocols: %+v", filteredProtocols)
+	}
+
+	// The last enabled protocol is not disabled.
+
+	for i := 0; i < 3; i++ {
+		health.recordFailure(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+	}
+
+	filteredProtocols = health.filterProtocols(permittedProtocols)
+	if len(filteredProtocols) != 1 || filteredProtocols[0] != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+		t.Fatalf("unexpected filtered protocols: %+v", filteredProtocols)
+	}
+	health.recordSuccess(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+
+	// The disabled state is persisted.
+
+	health = newProtocolHealth(clientConfig, permittedProtocols)
+
+	weights := health.getWeights()
+	if len(weights) != 1 || weights[failingProtocol] != 0.0 {
+		t.Fatalf("unexpected weights: %+v", weights)
+	}
+
+	// After the disable period, the protocol is gradually re-enabled.
+
+	health.mutex.Lock()
+	health.states[failingProtocol].DisabledUntil = time.Now().Add(-30 * time.Minute)
+	health.mutex.Unlock()
+
+	weight := health.getWeights()[failingProtocol]
+	if weight < 0.4 || weight > 0.6 {
+		t.Fatalf("unexpected re-enabling weight: %f", weight)
+	}
+
+	// A failure while re-enabling disables the protocol again.
+
+	health.recordFailure(failingProtocol)
+
+	if health.getWeights()[failingProtocol] != 0.0 {
+		t.Fatalf("unexpected weight after re-enabling failure")
+	}
+
+	// A success fully re-enables the protocol.
+
+	health.recordSuccess(failingProtocol)
+
+	if len(health.getWeights()) != 0 {
+		t.Fatalf("unexpected weights after success")
+	}
+
+	// Protocol health is not shared across networks.
+
+	health.recordFailure(failingProtocol)
+	health.recordFailure(failingProtocol)
+	health.recordFailure(failingProtocol)
+
+	clientConfig.networkIDGetter = newStaticNetworkGetter("NETWORK2")
+
+	health = newProtocolHealth(clientConfig, permittedProtocols)
+
+	if len(health.getWeights()) != 0 {
+		t.Fatalf("unexpected weights on new network")
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ReachabilityReport is the result of ProbeReachability.
+type ReachabilityReport struct {
+	StartTime string                `json:"startTime"`
+	Results   []*ReachabilityResult `json:"results"`
+}
+
+// ReachabilityResult is the outcome of probing one server entry with one
+// tunnel protocol. For meek protocols, the front used for the probe is
+// included. ConnectDurationMilliseconds is the time taken to connect, or to
+// fail.
+type ReachabilityResult struct {
+	ServerEntryIPAddress        string `json:"serverEntryIPAddress"`
+	ServerEntryRegion           string `json:"serverEntryRegion"`
+	TunnelProtocol              string `json:"tunnelProtocol"`
+	MeekDialAddress             string `json:"meekDialAddress,omitempty"`
+	MeekSNIServerName           string `json:"meekSNIServerName,omitempty"`
+	Reachable                   bool   `json:"reachable"`
+	Error                       string `json:"error,omitempty"`
+	ConnectDurationMilliseconds int64  `json:"connectDurationMilliseconds"`
+}
+
+// ProbeReachability tests which tunnel protocols and fronts are reachable
+// from the current network, without establishing a usable tunnel. Up to
+// maxServerEntries stored server entries are probed, each with every
+// supported tunnel protocol permitted by LimitTunnelProtocols.
+//
+// Each probe dials the server exactly as in tunnel establishment, with the
+// same dial parameter selections and obfuscation, up to the completion of
+// the SSH handshake; the tunnel is then closed. No handshake API request is
+// made and no port forwards are opened, so no user traffic is sent. As in
+// establishment, up to ConnectionWorkerPoolSize probes run concurrently.
+//
+// The datastore must be open. ProbeReachability returns when all probes
+// complete or when ctx is done, in which case the report includes only the
+// completed probes.
+func ProbeReachability(
+	ctx context.Context,
+	config *Config,
+	maxServerEntries int) (*ReachabilityReport, error) {
+
+	if maxServerEntries <= 0 {
+		return nil, common.ContextError(errors.New("invalid maxServerEntries"))
+	}
+
+	sessionId, err := MakeSessionId()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	_, iterator, err := NewServerEntryIterator(config, true)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer iterator.Close()
+
+	type candidate struct {
+		serverEntry    *protocol.ServerEntry
+		tunnelProtocol string
+	}
+
+	// The iterator isn't designed for concurrent use, so candidates are
+	// enumerated before the probes start.
+
+	limitTunnelProtocols := config.clientParameters.Get().TunnelProtocols(
+		parameters.LimitTunnelProtocols)
+
+	var candidates []candidate
+	for i := 0; i < maxServerEntries; i++ {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		for _, tunnelProtocol := range serverEntry.GetSupportedProtocols(
+			config.UseUpstreamProxy(), limitTunnelProtocols, false) {
+
+			candidates = append(candidates, candidate{serverEntry, tunnelProtocol})
+		}
+	}
+
+	report := &ReachabilityReport{
+		StartTime: common.GetCurrentTimestamp(),
+	}
+
+	workerCount := config.ConnectionWorkerPoolSize
+	if workerCount <= 0 {
+		workerCount = 1
+	}
+
+	candidateChannel := make(chan candidate)
+	var reportMutex sync.Mutex
+	var waitGroup sync.WaitGroup
+
+	for i := 0; i < workerCount; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for candidate := range candidateChannel {
+				result := probeReachability(
+					ctx, config, sessionId, candidate.serverEntry, candidate.tunnelProtocol)
+				if result == nil {
+					continue
+				}
+				NoticeInfo("reachability of %s %s: %t, %dms",
+					result.ServerEntryIPAddress,
+					result.TunnelProtocol,
+					result.Reachable,
+					result.ConnectDurationMilliseconds)
+				reportMutex.Lock()
+				report.Results = append(report.Results, result)
+				reportMutex.Unlock()
+			}
+		}()
+	}
+
+loop:
+	for _, candidate := range candidates {
+		select {
+		case candidateChannel <- candidate:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(candidateChannel)
+
+	waitGroup.Wait()
+
+	return report, nil
+}
+
+// probeReachability performs a single probe. nil is returned when the probe
+// is interrupted by ctx, as the outcome doesn't reflect network conditions.
+func probeReachability(
+	ctx context.Context,
+	config *Config,
+	sessionId string,
+	serverEntry *protocol.ServerEntry,
+	tunnelProtocol string) *ReachabilityResult {
+
+	result := &ReachabilityResult{
+		ServerEntryIPAddress: serverEntry.IpAddress,
+		ServerEntryRegion:    serverEntry.Region,
+		TunnelProtocol:       tunnelProtocol,
+	}
+
+	dialParams, err := MakeDialParameters(config, serverEntry, tunnelProtocol)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.MeekDialAddress = dialParams.MeekDialAddress
+	result.MeekSNIServerName = dialParams.MeekSNIServerName
+
+	startTime := monotime.Now()
+
+	tunnel, err := ConnectTunnelWithDialParameters(
+		ctx, config, sessionId, serverEntry, dialParams, startTime)
+
+	result.ConnectDurationMilliseconds =
+		int64(monotime.Since(startTime) / time.Millisecond)
+
+	if ctx.Err() != nil {
+		if tunnel != nil {
+			tunnel.Close(true)
+		}
+		return nil
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	tunnel.Close(true)
+	result.Reachable = true
+
+	return result
+}
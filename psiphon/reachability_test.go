@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestProbeReachability(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-reachability-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	// The server accepts connections and then immediately closes them, so
+	// each probe fails.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	port := float64(listener.Addr().(*net.TCPAddr).Port)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	config, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataStoreDirectory = testDataDirName
+
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = config.SetClientParameters("", true, map[string]interface{}{
+		parameters.LimitTunnelProtocols: protocol.TunnelProtocols{
+			protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+	})
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	var serverEntries []protocol.ServerEntryFields
+	for _, IPAddress := range []string{"127.0.0.1", "127.0.0.2"} {
+		serverEntries = append(serverEntries, protocol.ServerEntryFields{
+			"ipAddress":         IPAddress,
+			"region":            "CA",
+			"sshPort":           port,
+			"sshObfuscatedPort": port,
+			"sshObfuscatedKey":  "0000000000000000000000000000000000000000000000000000000000000000",
+			"capabilities":      []interface{}{"SSH", "OSSH"},
+			"localSource":       protocol.SERVER_ENTRY_SOURCE_EMBEDDED,
+		})
+	}
+	err = StoreServerEntries(config, serverEntries, true)
+	if err != nil {
+		t.Fatalf("StoreServerEntries failed: %s", err)
+	}
+
+	_, err = ProbeReachability(context.Background(), config, 0)
+	if err == nil {
+		t.Fatalf("unexpected ProbeReachability success")
+	}
+
+	// Only the one server entry is probed, with the one protocol permitted by
+	// LimitTunnelProtocols.
+
+	report, err := ProbeReachability(context.Background(), config, 1)
+	if err != nil {
+		t.Fatalf("ProbeReachability failed: %s", err)
+	}
+
+	if report.StartTime == "" || len(report.Results) != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	result := report.Results[0]
+	if result.TunnelProtocol != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH ||
+		result.ServerEntryRegion != "CA" ||
+		result.Reachable ||
+		result.Error == "" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	// A probe interrupted by ctx isn't reported.
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	cancelFunc()
+
+	report, err = ProbeReachability(ctx, config, 2)
+	if err != nil {
+		t.Fatalf("ProbeReachability failed: %s", err)
+	}
+
+	if len(report.Results) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
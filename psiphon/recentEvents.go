@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+)
+
+const (
+	RECENT_EVENTS_MAX_EVENTS = 100
+)
+
+// RecentEvent is a tunnel lifecycle event, recorded from the corresponding
+// notice. See Controller.GetRecentEvents.
+type RecentEvent struct {
+	Timestamp string                 `json:"timestamp"`
+	EventType string                 `json:"eventType"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// recentEventFields lists the notice types which are recorded as recent
+// events and, for each type, the notice data fields which are retained.
+//
+// Only fields which contain no server or client IP addresses, domain names,
+// error messages, network IDs, or other user-identifying data are retained;
+// for example, the ActiveTunnel server IP address is omitted. Recording
+// doesn't depend on SetEmitDiagnosticNotices, as diagnostic fields are never
+// retained.
+var recentEventFields = map[string][]string{
+	"ConnectingServer":          {"region", "protocol"},
+	"ConnectedServer":           {"region", "protocol"},
+	"ActiveTunnel":              {"protocol", "isTCS"},
+	"Tunnels":                   {"count"},
+	"TunnelDisconnected":        {"reason", "willReconnect"},
+	"TunnelPoolSize":            {"size"},
+	"Paused":                    {"isPaused"},
+	"SuspectedBlocking":         {"pausePeriod"},
+	"ProtocolDisabled":          {"protocol", "disabledUntil"},
+	"DiagnosticBundleAvailable": {"consecutiveFailures"},
+	"Exiting":                   {},
+}
+
+// recentEvents is a bounded, in-memory history of the most recent tunnel
+// lifecycle events, for host applications which display a connection log.
+// Unlike the notice stream, the history is retained by the controller, so
+// an application UI which detaches and later reattaches can retrieve events
+// it did not receive.
+type recentEvents struct {
+	mutex  sync.Mutex
+	events []*RecentEvent
+}
+
+func newRecentEvents() *recentEvents {
+	return &recentEvents{}
+}
+
+// isRecentEvent indicates whether notices of type noticeType are recorded.
+func isRecentEvent(noticeType string) bool {
+	_, ok := recentEventFields[noticeType]
+	return ok
+}
+
+// record adds an event for the notice, with the notice data name/value
+// pairs in args, discarding the oldest event when the history is full.
+// Notice data fields not listed in recentEventFields are discarded.
+func (r *recentEvents) record(noticeType, timestamp string, args ...interface{}) {
+
+	fields, ok := recentEventFields[noticeType]
+	if !ok {
+		return
+	}
+
+	var data map[string]interface{}
+	for i := 0; i < len(args)-1; i += 2 {
+		name, ok := args[i].(string)
+		if !ok {
+			continue
+		}
+		for _, field := range fields {
+			if name == field {
+				if data == nil {
+					data = make(map[string]interface{})
+				}
+				data[name] = args[i+1]
+				break
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.events) >= RECENT_EVENTS_MAX_EVENTS {
+		r.events = r.events[1:]
+	}
+	r.events = append(r.events, &RecentEvent{
+		Timestamp: timestamp,
+		EventType: noticeType,
+		Data:      data,
+	})
+}
+
+// get returns a copy of the recorded events, oldest first.
+func (r *recentEvents) get() []*RecentEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	events := make([]*RecentEvent, len(r.events))
+	copy(events, r.events)
+	return events
+}
+
+// GetRecentEvents returns the most recent tunnel lifecycle events, up to
+// RECENT_EVENTS_MAX_EVENTS, oldest first. Events include connection attempts,
+// active tunnels, disconnects and their reasons, pauses, and suspected
+// blocking, and contain no addresses or user-identifying data. See
+// recentEventFields.
+//
+// The history is retained for the lifetime of the controller, including
+// after Run returns, and reflects the notices emitted while this controller
+// was the most recently created controller.
+func (controller *Controller) GetRecentEvents() []*RecentEvent {
+	return controller.recentEvents.get()
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRecentEvents(t *testing.T) {
+
+	recentEvents := newRecentEvents()
+	setNoticeRecentEvents(recentEvents)
+	defer setNoticeRecentEvents(nil)
+
+	// Diagnostic notices are recorded, without diagnostic fields, even when
+	// diagnostic notices aren't emitted.
+
+	dialStats := &DialStats{}
+	dialStats.MeekResolvedIPAddress.Store("")
+
+	NoticeConnectingServer("192.0.2.1", "CA", "OSSH", dialStats)
+	NoticeActiveTunnel("192.0.2.1", "OSSH", true)
+	NoticeInfo("not recorded")
+	NoticeTunnels(1)
+	NoticeTunnelDisconnected(TUNNEL_DISCONNECT_REASON_FAILED, true)
+
+	events := recentEvents.get()
+
+	expectedEvents := []string{
+		"ConnectingServer map[protocol:OSSH region:CA]",
+		"ActiveTunnel map[isTCS:true protocol:OSSH]",
+		"Tunnels map[count:1]",
+		"TunnelDisconnected map[reason:failed willReconnect:true]",
+	}
+
+	if len(events) != len(expectedEvents) {
+		t.Fatalf("unexpected event count: %d", len(events))
+	}
+
+	for i, event := range events {
+		description := fmt.Sprintf("%s %v", event.EventType, event.Data)
+		if description != expectedEvents[i] {
+			t.Fatalf("unexpected event: %s", description)
+		}
+		if event.Timestamp == "" {
+			t.Fatalf("missing timestamp")
+		}
+	}
+
+	// The history is bounded, discarding the oldest events.
+
+	for i := 0; i < RECENT_EVENTS_MAX_EVENTS; i++ {
+		NoticeTunnelPoolSize(i)
+	}
+
+	events = recentEvents.get()
+
+	if len(events) != RECENT_EVENTS_MAX_EVENTS ||
+		events[0].EventType != "TunnelPoolSize" ||
+		events[0].Data["size"] != 0 {
+
+		t.Fatalf("unexpected bounded events")
+	}
+}
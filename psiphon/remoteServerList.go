@@ -24,6 +24,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"time"
 
@@ -52,10 +53,21 @@ func FetchCommonRemoteServerList(
 
 	NoticeInfo("fetching common remote server list")
 
+	// The revocation list is fetched first so that revoked server entries
+	// in the remote server list are skipped. Failure to fetch the revocation
+	// list doesn't fail the remote server list fetch, as any previously
+	// stored revocation list continues to apply.
+	err := fetchServerEntryRevocationList(
+		ctx, config, attempt, tunnel, untunneledDialConfig)
+	if err != nil {
+		NoticeAlert("failed to fetch server entry revocation list: %s", err)
+	}
+
 	p := config.clientParameters.Get()
 	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
 	urls := p.DownloadURLs(parameters.RemoteServerListURLs)
 	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	decodeWorkers := p.Int(parameters.RemoteServerListDecodeWorkers)
 	p = nil
 
 	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
@@ -95,10 +107,11 @@ func FetchCommonRemoteServerList(
 
 	err = StreamingStoreServerEntries(
 		config,
-		protocol.NewStreamingServerEntryDecoder(
+		protocol.NewParallelStreamingServerEntryDecoder(
 			serverListPayloadReader,
 			common.GetCurrentTimestamp(),
-			protocol.SERVER_ENTRY_SOURCE_REMOTE),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE,
+			decodeWorkers),
 		true)
 	if err != nil {
 		return fmt.Errorf("failed to store common remote server list: %s", common.ContextError(err))
@@ -115,6 +128,78 @@ func FetchCommonRemoteServerList(
 	return nil
 }
 
+// fetchServerEntryRevocationList downloads the server entry revocation list
+// from config.ServerEntryRevocationListURLs, validates its digital signature
+// using the public key config.RemoteServerListSignaturePublicKey, and
+// stores the list. To prevent rollback, a list with a lower sequence number
+// than the stored list is rejected.
+func fetchServerEntryRevocationList(
+	ctx context.Context,
+	config *Config,
+	attempt int,
+	tunnel *Tunnel,
+	untunneledDialConfig *DialConfig) error {
+
+	p := config.clientParameters.Get()
+	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
+	urls := p.DownloadURLs(parameters.ServerEntryRevocationListURLs)
+	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	p = nil
+
+	if len(urls) == 0 {
+		return nil
+	}
+
+	downloadURL, canonicalURL, skipVerify := urls.Select(attempt)
+
+	newETag, err := downloadRemoteServerListFile(
+		ctx,
+		config,
+		tunnel,
+		untunneledDialConfig,
+		downloadTimeout,
+		downloadURL,
+		canonicalURL,
+		skipVerify,
+		"",
+		config.ServerEntryRevocationListDownloadFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// When the resource is unchanged, skip.
+	if newETag == "" {
+		return nil
+	}
+
+	dataPackage, err := ioutil.ReadFile(config.ServerEntryRevocationListDownloadFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	payload, err := common.ReadAuthenticatedDataPackage(dataPackage, true, publicKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	list, err := protocol.DecodeServerEntryRevocationList(payload)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = SetServerEntryRevocationList(list)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = SetUrlETag(canonicalURL, newETag)
+	if err != nil {
+		NoticeAlert("failed to set ETag for server entry revocation list: %s", common.ContextError(err))
+	}
+
+	return nil
+}
+
 // FetchObfuscatedServerLists downloads the obfuscated remote server lists
 // from config.ObfuscatedServerListRootURLs.
 // It first downloads the OSL registry, and then downloads each seeded OSL
@@ -139,6 +224,7 @@ func FetchObfuscatedServerLists(
 	publicKey := p.String(parameters.RemoteServerListSignaturePublicKey)
 	urls := p.DownloadURLs(parameters.ObfuscatedServerListRootURLs)
 	downloadTimeout := p.Duration(parameters.FetchRemoteServerListTimeout)
+	decodeWorkers := p.Int(parameters.RemoteServerListDecodeWorkers)
 	p = nil
 
 	rootURL, canonicalRootURL, skipVerify := urls.Select(attempt)
@@ -289,10 +375,11 @@ func FetchObfuscatedServerLists(
 
 		err = StreamingStoreServerEntries(
 			config,
-			protocol.NewStreamingServerEntryDecoder(
+			protocol.NewParallelStreamingServerEntryDecoder(
 				serverListPayloadReader,
 				common.GetCurrentTimestamp(),
-				protocol.SERVER_ENTRY_SOURCE_OBFUSCATED),
+				protocol.SERVER_ENTRY_SOURCE_OBFUSCATED,
+				decodeWorkers),
 			true)
 		if err != nil {
 			file.Close()
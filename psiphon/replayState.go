@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	REPLAY_STATE_VERSION = 1
+)
+
+// replayState is the serialized form of the learned connection state
+// exported by ExportReplayState. replayState must not include any user
+// identifying data; server entry IDs and the server entry filter are not
+// specific to the user.
+type replayState struct {
+	Version               int    `json:"v"`
+	AffinityServerEntryID string `json:"affinityServerEntryID"`
+	ServerEntryFilter     string `json:"serverEntryFilter"`
+}
+
+// ExportReplayState serializes the learned connection state, currently the
+// server affinity state, into a versioned blob which may be imported on
+// another device with ImportReplayState. This is intended for QA and
+// support, to reproduce connection behavior observed on a device.
+func (controller *Controller) ExportReplayState() ([]byte, error) {
+
+	serverEntryID, filter, err := getServerAffinityState()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	blob, err := json.Marshal(&replayState{
+		Version:               REPLAY_STATE_VERSION,
+		AffinityServerEntryID: serverEntryID,
+		ServerEntryFilter:     filter,
+	})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return blob, nil
+}
+
+// ImportReplayState restores learned connection state exported by
+// ExportReplayState. The state is validated against the current server list
+// and config, and an error is returned, with no state changed, when the
+// state is incompatible: when the version is unsupported, when the affinity
+// server entry is not in the local server list, or when the server entry
+// filter, such as the EgressRegion, differs.
+//
+// The imported state takes effect the next time establishment starts.
+func (controller *Controller) ImportReplayState(blob []byte) error {
+
+	var state replayState
+	err := json.Unmarshal(blob, &state)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if state.Version != REPLAY_STATE_VERSION {
+		return common.ContextError(
+			fmt.Errorf("unsupported replay state version: %d", state.Version))
+	}
+
+	if state.AffinityServerEntryID == "" {
+		return nil
+	}
+
+	currentFilter, err := makeServerEntryFilterValue(controller.config)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if state.ServerEntryFilter != string(currentFilter) {
+		return common.ContextError(errors.New("incompatible server entry filter"))
+	}
+
+	err = setServerAffinityState(state.AffinityServerEntryID, state.ServerEntryFilter)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/server"
+)
+
+func TestReplayState(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-replay-state-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	_, _, _, _, encodedServerEntry, err := server.GenerateConfig(
+		&server.GenerateConfigParams{
+			ServerIPAddress:      "0.1.0.0",
+			EnableSSHAPIRequests: true,
+			WebServerPort:        8000,
+			TunnelProtocolPorts:  map[string]int{"OSSH": 4000},
+		})
+	if err != nil {
+		t.Fatalf("error generating server config: %s", err)
+	}
+
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		string(encodedServerEntry),
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	if err != nil {
+		t.Fatalf("error decoding server entry: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		serverEntryFields["ipAddress"] = fmt.Sprintf("0.1.0.%d", i)
+		err = StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+
+	controller, err := NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
+
+	err = PromoteServerEntry(clientConfig, "0.1.0.0")
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+
+	blob, err := controller.ExportReplayState()
+	if err != nil {
+		t.Fatalf("ExportReplayState failed: %s", err)
+	}
+
+	err = PromoteServerEntry(clientConfig, "0.1.0.1")
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+
+	err = controller.ImportReplayState(blob)
+	if err != nil {
+		t.Fatalf("ImportReplayState failed: %s", err)
+	}
+
+	serverEntryID, _, err := getServerAffinityState()
+	if err != nil {
+		t.Fatalf("getServerAffinityState failed: %s", err)
+	}
+
+	if serverEntryID != "0.1.0.0" {
+		t.Fatalf("unexpected affinity server entry: %s", serverEntryID)
+	}
+
+	// Incompatible state must be rejected and not applied
+
+	var state replayState
+	err = json.Unmarshal(blob, &state)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	unknownServerEntry := state
+	unknownServerEntry.AffinityServerEntryID = "0.1.0.2"
+
+	unsupportedVersion := state
+	unsupportedVersion.Version = REPLAY_STATE_VERSION + 1
+
+	otherFilter := state
+	otherFilter.ServerEntryFilter = "CA"
+
+	for _, incompatibleState := range []replayState{
+		unknownServerEntry, unsupportedVersion, otherFilter} {
+
+		blob, err := json.Marshal(&incompatibleState)
+		if err != nil {
+			t.Fatalf("Marshal failed: %s", err)
+		}
+
+		err = controller.ImportReplayState(blob)
+		if err == nil {
+			t.Fatalf("ImportReplayState unexpectedly succeeded: %+v", incompatibleState)
+		}
+	}
+
+	serverEntryID, _, err = getServerAffinityState()
+	if err != nil {
+		t.Fatalf("getServerAffinityState failed: %s", err)
+	}
+
+	if serverEntryID != "0.1.0.0" {
+		t.Fatalf("unexpected affinity server entry: %s", serverEntryID)
+	}
+
+	// Server affinity expires after ServerAffinityMaxAge, and on a different
+	// network.
+
+	expired, err := isServerAffinityExpired(clientConfig)
+	if err != nil || expired {
+		t.Fatalf("unexpected expired server affinity: %s", err)
+	}
+
+	err = datastoreUpdate(func(tx *datastoreTx) error {
+		return tx.bucket(datastoreKeyValueBucket).put(
+			datastoreAffinityPromotedTimeKey,
+			[]byte(time.Now().Add(-25*time.Hour).UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		t.Fatalf("datastoreUpdate failed: %s", err)
+	}
+
+	expired, err = isServerAffinityExpired(clientConfig)
+	if err != nil || !expired {
+		t.Fatalf("unexpected unexpired server affinity: %s", err)
+	}
+
+	clientConfig.networkIDGetter = newStaticNetworkGetter("NETWORK1")
+
+	err = PromoteServerEntry(clientConfig, "0.1.0.0")
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+
+	expired, err = isServerAffinityExpired(clientConfig)
+	if err != nil || expired {
+		t.Fatalf("unexpected expired server affinity: %s", err)
+	}
+
+	clientConfig.networkIDGetter = newStaticNetworkGetter("NETWORK2")
+
+	expired, err = isServerAffinityExpired(clientConfig)
+	if err != nil || !expired {
+		t.Fatalf("unexpected unexpired server affinity: %s", err)
+	}
+}
@@ -32,6 +32,7 @@ import (
 	"unicode"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
 )
@@ -42,6 +43,7 @@ const (
 	CLIENT_PLATFORM_ANDROID = "Android"
 	CLIENT_PLATFORM_WINDOWS = "Windows"
 	CLIENT_PLATFORM_IOS     = "iOS"
+	CLIENT_PLATFORM_OTHER   = "Other"
 )
 
 // sshAPIRequestHandler routes Psiphon API requests transported as
@@ -106,8 +108,11 @@ func dispatchAPIRequestHandler(
 	// terminating in the case of a bug.
 	defer func() {
 		if e := recover(); e != nil {
-			if intentionalPanic, ok := e.(IntentionalPanicError); ok {
-				panic(intentionalPanic)
+			if IsIntentionalPanic(e) {
+				if !invokePanicHandler(e, debug.Stack()) {
+					panic(e)
+				}
+				reterr = common.ContextError(errors.New("request handler panic"))
 			} else {
 				log.LogPanicRecover(e, debug.Stack())
 				reterr = common.ContextError(errors.New("request handler panic"))
@@ -172,11 +177,21 @@ func dispatchAPIRequestHandler(
 	return nil, common.ContextError(fmt.Errorf("invalid request name: %s", name))
 }
 
+// handshakePaddingParams is the optional handshake request padding, which
+// is otherwise ignored.
+var handshakePaddingParams = []requestParamSpec{
+	{protocol.PSIPHON_API_HANDSHAKE_PADDING, isHandshakePadding, requestParamOptional | requestParamNotLogged},
+}
+
 var handshakeRequestParams = append(
 	append(
-		// Note: legacy clients may not send "session_id" in handshake
-		[]requestParamSpec{{"session_id", isHexDigits, requestParamOptional}},
-		tacticsParams...),
+		append(
+			// Note: legacy clients may not send "session_id" in handshake
+			[]requestParamSpec{
+				{"session_id", isHexDigits, requestParamOptional},
+				{protocol.PSIPHON_API_HANDSHAKE_CLIENT_FEATURES, isHexDigits, requestParamOptional}},
+			tacticsParams...),
+		handshakePaddingParams...),
 	baseRequestParams...)
 
 // handshakeAPIRequestHandler implements the "handshake" API request.
@@ -196,6 +211,11 @@ func handshakeAPIRequestHandler(
 		return nil, common.ContextError(err)
 	}
 
+	err = validateRequestParams(support.Config, params, handshakePaddingParams)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
 	sessionID, _ := getStringRequestParam(params, "client_session_id")
 	sponsorID, _ := getStringRequestParam(params, "sponsor_id")
 	clientVersion, _ := getStringRequestParam(params, "client_version")
@@ -211,9 +231,64 @@ func handshakeAPIRequestHandler(
 		}
 	}
 
+	// Legacy clients don't send client features, and negotiate no features.
+	// Unknown feature bits, sent by newer clients, are excluded from the
+	// negotiated features.
+	clientFeatures := protocol.Features(0)
+	if params[protocol.PSIPHON_API_HANDSHAKE_CLIENT_FEATURES] != nil {
+		encodedFeatures, err := getStringRequestParam(params, protocol.PSIPHON_API_HANDSHAKE_CLIENT_FEATURES)
+		if err == nil {
+			clientFeatures, err = protocol.DecodeFeatures(encodedFeatures)
+		}
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
 	// Note: no guarantee that PsinetDatabase won't reload between database calls
 	db := support.PsinetDatabase
 
+	tacticsSnapshot, err := support.TunnelServer.GetClientTacticsSnapshot(sessionID)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Clients older than the minimum client version are rejected before the
+	// handshake state is set, so no port forwards are permitted. The
+	// response signals that an upgrade is required and the client is then
+	// disconnected.
+
+	if isClientUpgradeRequired(tacticsSnapshot, geoIPData, params) {
+
+		log.WithContextFields(
+			getRequestLogFields(
+				"",
+				geoIPData,
+				nil,
+				params,
+				baseRequestParams)).Info("handshake rejected: upgrade required")
+
+		err := support.TunnelServer.DisconnectUpgradeRequiredClient(sessionID)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		handshakeResponse := protocol.HandshakeResponse{
+			SSHSessionID:         sessionID,
+			UpgradeRequired:      true,
+			UpgradeClientVersion: db.GetUpgradeClientVersion(clientVersion, normalizedPlatform),
+			ClientRegion:         geoIPData.Country,
+			ServerTimestamp:      common.GetCurrentTimestamp(),
+		}
+
+		responsePayload, err := json.Marshal(handshakeResponse)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		return responsePayload, nil
+	}
+
 	httpsRequestRegexes := db.GetHttpsRequestRegexes(sponsorID)
 
 	// Flag the SSH client as having completed its handshake. This
@@ -235,7 +310,7 @@ func handshakeAPIRequestHandler(
 		return nil, common.ContextError(err)
 	}
 
-	tacticsPayload, err := support.TacticsServer.GetTacticsPayload(
+	tacticsPayload, err := tacticsSnapshot.GetTacticsPayload(
 		common.GeoIPData(geoIPData), params)
 	if err != nil {
 		return nil, common.ContextError(err)
@@ -295,6 +370,10 @@ func handshakeAPIRequestHandler(
 		ServerTimestamp:        common.GetCurrentTimestamp(),
 		ActiveAuthorizationIDs: activeAuthorizationIDs,
 		TacticsPayload:         marshaledTacticsPayload,
+		EgressIPAddress:        getHandshakeEgressIPAddress(support, tacticsSnapshot, geoIPData),
+		ServerLoad:             support.TunnelServer.GetServerLoad(),
+		PortForwardCompression: support.Config.EnablePortForwardCompression,
+		Features:               getServerFeatures(support).Negotiate(clientFeatures).Encode(),
 	}
 
 	responsePayload, err := json.Marshal(handshakeResponse)
@@ -305,6 +384,86 @@ func handshakeAPIRequestHandler(
 	return responsePayload, nil
 }
 
+// getServerFeatures returns the protocol features supported and enabled by
+// the server.
+func getServerFeatures(support *SupportServices) protocol.Features {
+	features := protocol.Features(0)
+	if support.Config.EnablePortForwardCompression {
+		features |= protocol.FEATURE_PORT_FORWARD_COMPRESSION
+	}
+	if support.Config.EnableBandwidthTest {
+		features |= protocol.FEATURE_BANDWIDTH_TEST
+	}
+	return features
+}
+
+// getHandshakeEgressIPAddress returns the server egress IP address to
+// report to the client, or "" when reporting is not enabled by tactics for
+// the client. The egress IP address is not reported by default, as some
+// operators do not expose egress IP addresses.
+func getHandshakeEgressIPAddress(
+	support *SupportServices,
+	tacticsSnapshot *tactics.Snapshot,
+	geoIPData GeoIPData) string {
+
+	egressIPAddress := support.Config.GetEgressIPAddress()
+	if egressIPAddress == "" {
+		return ""
+	}
+
+	p, err := tacticsSnapshot.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for handshake")
+		return ""
+	}
+
+	if p == nil || !p.Bool(parameters.ServerReturnEgressIPAddress) {
+		return ""
+	}
+
+	return egressIPAddress
+}
+
+// isClientUpgradeRequired indicates whether the client version is below the
+// ServerMinimumClientVersions tactics parameter value for the client's
+// tunnel protocol. There is no minimum version by default.
+func isClientUpgradeRequired(
+	tacticsSnapshot *tactics.Snapshot,
+	geoIPData GeoIPData,
+	params common.APIParameters) bool {
+
+	p, err := tacticsSnapshot.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for handshake")
+		return false
+	}
+
+	if p == nil {
+		return false
+	}
+
+	tunnelProtocol, _ := getStringRequestParam(params, "relay_protocol")
+
+	minimumVersion := p.MinimumClientVersions(
+		parameters.ServerMinimumClientVersions).MinimumVersion(tunnelProtocol)
+	if minimumVersion == 0 {
+		return false
+	}
+
+	// client_version is validated by isIntString.
+	clientVersion, _ := getStringRequestParam(params, "client_version")
+	version, err := strconv.Atoi(clientVersion)
+	if err != nil {
+		return false
+	}
+
+	return version < minimumVersion
+}
+
 var connectedRequestParams = append(
 	[]requestParamSpec{
 		{"session_id", isHexDigits, 0},
@@ -329,13 +488,22 @@ func connectedAPIRequestHandler(
 		return nil, common.ContextError(err)
 	}
 
-	log.LogRawFieldsWithTimestamp(
-		getRequestLogFields(
+	// As with "server_tunnel", "connected" events may be sampled.
+
+	tunnelProtocol, _ := getStringRequestParam(params, "relay_protocol")
+	sessionID, _ := getStringRequestParam(params, "client_session_id")
+	sampleRate := getConnectionLogSampleRate(support, geoIPData, tunnelProtocol)
+
+	if isConnectionLogSampled(sessionID, sampleRate) {
+		logFields := getRequestLogFields(
 			"connected",
 			geoIPData,
 			authorizedAccessTypes,
 			params,
-			connectedRequestParams))
+			connectedRequestParams)
+		logFields["log_sample_rate"] = sampleRate
+		log.LogRawFieldsWithTimestamp(logFields)
+	}
 
 	connectedResponse := protocol.ConnectedResponse{
 		ConnectedTimestamp: common.TruncateTimestampToHour(common.GetCurrentTimestamp()),
@@ -355,6 +523,13 @@ var statusRequestParams = append(
 		{"connected", isBooleanFlag, 0}},
 	baseRequestParams...)
 
+var failedTunnelStatParams = append(
+	[]requestParamSpec{
+		{"relay_protocol", isRelayProtocol, 0},
+		{"client_failed_timestamp", isISO8601Date, 0},
+		{"tunnel_error", isAnyString, 0}},
+	baseDialRequestParams...)
+
 // statusAPIRequestHandler implements the "status" API request.
 // Clients make periodic status requests which deliver client-side
 // recorded data transfer and tunnel duration stats.
@@ -459,6 +634,16 @@ func statusAPIRequestHandler(
 		}
 	}
 
+	// Failed tunnel connection stats
+	// Older clients may not submit this data
+
+	failedTunnelFields, err := getFailedTunnelStatsLogFields(
+		support.Config, geoIPData, authorizedAccessTypes, params, statusData)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	logQueue = append(logQueue, failedTunnelFields...)
+
 	for _, logItem := range logQueue {
 		log.LogRawFieldsWithTimestamp(logItem)
 	}
@@ -466,6 +651,60 @@ func statusAPIRequestHandler(
 	return make([]byte, 0), nil
 }
 
+// getFailedTunnelStatsLogFields validates the status request
+// failed_tunnel_stats, when present, and returns the "failed_tunnel" log
+// fields for each stat. Any invalid stat fails the entire status request.
+//
+// The session fields are taken from the status request; the dial fields,
+// which describe the failed connection, are taken from the stat.
+func getFailedTunnelStatsLogFields(
+	config *Config,
+	geoIPData GeoIPData,
+	authorizedAccessTypes []string,
+	params common.APIParameters,
+	statusData common.APIParameters) ([]LogFields, error) {
+
+	if statusData["failed_tunnel_stats"] == nil {
+		return nil, nil
+	}
+
+	failedTunnelStats, err := getJSONObjectArrayRequestParam(statusData, "failed_tunnel_stats")
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	logFields := make([]LogFields, 0, len(failedTunnelStats))
+
+	for _, failedTunnelStat := range failedTunnelStats {
+
+		err := validateRequestParams(config, failedTunnelStat, failedTunnelStatParams)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		failedTunnelFields := getRequestLogFields(
+			"failed_tunnel",
+			geoIPData,
+			authorizedAccessTypes,
+			params,
+			baseSessionRequestParams)
+
+		for name, value := range getRequestLogFields(
+			"",
+			geoIPData,
+			nil,
+			failedTunnelStat,
+			failedTunnelStatParams) {
+
+			failedTunnelFields[name] = value
+		}
+
+		logFields = append(logFields, failedTunnelFields)
+	}
+
+	return logFields, nil
+}
+
 // clientVerificationAPIRequestHandler is just a compliance stub
 // for older Android clients that still send verification requests
 func clientVerificationAPIRequestHandler(
@@ -526,7 +765,9 @@ const (
 // OPTIONAL_COMMON_INPUTS in psi_web.
 // Each param is expected to be a string, unless requestParamArray
 // is specified, in which case an array of string is expected.
-var baseRequestParams = []requestParamSpec{
+// baseSessionRequestParams are the base request params which are common to
+// all connections in a client session.
+var baseSessionRequestParams = []requestParamSpec{
 	{"server_secret", isServerSecret, requestParamNotLogged},
 	{"client_session_id", isHexDigits, requestParamNotLogged},
 	{"propagation_channel_id", isHexDigits, 0},
@@ -537,6 +778,14 @@ var baseRequestParams = []requestParamSpec{
 	{"relay_protocol", isRelayProtocol, 0},
 	{"tunnel_whole_device", isBooleanFlag, requestParamOptional},
 	{"device_region", isAnyString, requestParamOptional},
+	{tactics.APPLIED_TACTICS_TAG_PARAMETER_NAME, isAnyString, requestParamOptional},
+}
+
+// baseDialRequestParams are the base request params which describe how a
+// tunnel connection was dialed. Clients omit these params for connections
+// not sampled for connection establishment telemetry;
+// establishment_telemetry_sample_rate is the client's sample rate.
+var baseDialRequestParams = []requestParamSpec{
 	{"ssh_client_version", isAnyString, requestParamOptional},
 	{"upstream_proxy_type", isUpstreamProxyType, requestParamOptional},
 	{"upstream_proxy_custom_header_names", isAnyString, requestParamOptional | requestParamArray},
@@ -546,13 +795,25 @@ var baseRequestParams = []requestParamSpec{
 	{"meek_host_header", isHostHeader, requestParamOptional},
 	{"meek_transformed_host_name", isBooleanFlag, requestParamOptional},
 	{"user_agent", isAnyString, requestParamOptional},
+	{"user_agent_family", isAnyString, requestParamOptional},
 	{"tls_profile", isAnyString, requestParamOptional},
+	{"tcp_fast_open", isBooleanFlag, requestParamOptional},
+	{"tcp_fast_open_succeeded", isBooleanFlag, requestParamOptional},
+	{"ossh_decoy_first_flight", isBooleanFlag, requestParamOptional},
+	{"ossh_seed_key_derivation", isAnyString, requestParamOptional},
+	{"ip_address_family_reset_retries", isIntString, requestParamOptional},
+	{"source_port_policy", isAnyString, requestParamOptional},
+	{"source_port_reused", isBooleanFlag, requestParamOptional},
 	{"server_entry_region", isRegionCode, requestParamOptional},
 	{"server_entry_source", isServerEntrySource, requestParamOptional},
 	{"server_entry_timestamp", isISO8601Date, requestParamOptional},
-	{tactics.APPLIED_TACTICS_TAG_PARAMETER_NAME, isAnyString, requestParamOptional},
+	{"establishment_telemetry_sample_rate", isSampleRate, requestParamOptional},
 }
 
+var baseRequestParams = append(
+	append([]requestParamSpec{}, baseSessionRequestParams...),
+	baseDialRequestParams...)
+
 func validateRequestParams(
 	config *Config,
 	params common.APIParameters,
@@ -668,6 +929,7 @@ func getRequestLogFields(
 	logFields["client_region"] = strings.Replace(geoIPData.Country, " ", "_", -1)
 	logFields["client_city"] = strings.Replace(geoIPData.City, " ", "_", -1)
 	logFields["client_isp"] = strings.Replace(geoIPData.ISP, " ", "_", -1)
+	logFields["client_asn"] = geoIPData.ASN
 
 	if len(authorizedAccessTypes) > 0 {
 		logFields["authorized_access_types"] = authorizedAccessTypes
@@ -711,6 +973,9 @@ func getRequestLogFields(
 			case "client_version", "establishment_duration":
 				intValue, _ := strconv.Atoi(strValue)
 				logFields[expectedParam.name] = intValue
+			case "establishment_telemetry_sample_rate":
+				floatValue, _ := strconv.ParseFloat(strValue, 64)
+				logFields[expectedParam.name] = floatValue
 			case "meek_dial_address":
 				host, _, _ := net.SplitHostPort(strValue)
 				if isIPAddress(nil, host) {
@@ -901,10 +1166,31 @@ func normalizeClientPlatform(clientPlatform string) string {
 	return CLIENT_PLATFORM_WINDOWS
 }
 
+// getClientPlatformStatsBucket maps the reported client platform to one of
+// a fixed set of buckets, for partitioning load stats. Unlike
+// normalizeClientPlatform, unrecognized platforms, including spoofed values,
+// are bucketed as CLIENT_PLATFORM_OTHER rather than as Windows.
+func getClientPlatformStatsBucket(clientPlatform string) string {
+
+	if strings.Contains(strings.ToLower(clientPlatform), strings.ToLower(CLIENT_PLATFORM_ANDROID)) {
+		return CLIENT_PLATFORM_ANDROID
+	} else if strings.HasPrefix(clientPlatform, CLIENT_PLATFORM_IOS) {
+		return CLIENT_PLATFORM_IOS
+	} else if strings.HasPrefix(clientPlatform, CLIENT_PLATFORM_WINDOWS) {
+		return CLIENT_PLATFORM_WINDOWS
+	}
+
+	return CLIENT_PLATFORM_OTHER
+}
+
 func isAnyString(config *Config, value string) bool {
 	return true
 }
 
+func isHandshakePadding(_ *Config, value string) bool {
+	return len(value) <= protocol.PSIPHON_API_HANDSHAKE_MAX_PADDING_LENGTH
+}
+
 func isMobileClientPlatform(clientPlatform string) bool {
 	normalizedClientPlatform := normalizeClientPlatform(clientPlatform)
 	return normalizedClientPlatform == CLIENT_PLATFORM_ANDROID ||
@@ -952,6 +1238,11 @@ func isBooleanFlag(_ *Config, value string) bool {
 	return value == "0" || value == "1"
 }
 
+func isSampleRate(_ *Config, value string) bool {
+	sampleRate, err := strconv.ParseFloat(value, 64)
+	return err == nil && sampleRate >= 0.0 && sampleRate <= 1.0
+}
+
 func isUpstreamProxyType(_ *Config, value string) bool {
 	value = strings.ToLower(value)
 	return value == "http" || value == "socks5" || value == "socks4a"
@@ -0,0 +1,217 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+func TestClientUpgradeRequired(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-api-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	tacticsConfigJSON := `
+    {
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "ServerMinimumClientVersions" : {"All" : 100, "OSSH" : 200}
+        }
+      }
+    }
+    `
+
+	tacticsConfigFilename := filepath.Join(testDataDirName, "tactics_config.json")
+	err = ioutil.WriteFile(tacticsConfigFilename, []byte(tacticsConfigJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	tacticsServer, err := tactics.NewServer(
+		CommonLogger(log), nil, nil, tacticsConfigFilename)
+	if err != nil {
+		t.Fatalf("tactics.NewServer failed: %s", err)
+	}
+
+	tacticsSnapshot := tacticsServer.GetSnapshot()
+
+	testCases := []struct {
+		tunnelProtocol  string
+		clientVersion   string
+		upgradeRequired bool
+	}{
+		{protocol.TUNNEL_PROTOCOL_SSH, "99", true},
+		{protocol.TUNNEL_PROTOCOL_SSH, "100", false},
+		{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, "150", true},
+		{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, "200", false},
+	}
+
+	for _, testCase := range testCases {
+
+		params := common.APIParameters{
+			"relay_protocol": testCase.tunnelProtocol,
+			"client_version": testCase.clientVersion,
+		}
+
+		upgradeRequired := isClientUpgradeRequired(tacticsSnapshot, GeoIPData{}, params)
+		if upgradeRequired != testCase.upgradeRequired {
+			t.Fatalf("unexpected upgrade required for %s %s: %v",
+				testCase.tunnelProtocol, testCase.clientVersion, upgradeRequired)
+		}
+	}
+
+	// There is no minimum version without tactics.
+
+	params := common.APIParameters{
+		"relay_protocol": protocol.TUNNEL_PROTOCOL_SSH,
+		"client_version": "1",
+	}
+
+	if isClientUpgradeRequired(nil, GeoIPData{}, params) {
+		t.Fatalf("unexpected upgrade required without tactics")
+	}
+}
+
+func TestGetClientPlatformStatsBucket(t *testing.T) {
+
+	testCases := []struct {
+		clientPlatform string
+		bucket         string
+	}{
+		{"Android_4.0.4_com.example.exampleClientLibraryApp", CLIENT_PLATFORM_ANDROID},
+		{"iOS-13.1_com.example.app", CLIENT_PLATFORM_IOS},
+		{"Windows", CLIENT_PLATFORM_WINDOWS},
+		{"", CLIENT_PLATFORM_OTHER},
+		{"Linux", CLIENT_PLATFORM_OTHER},
+		{"spoofed-value-1234567890", CLIENT_PLATFORM_OTHER},
+	}
+
+	for _, testCase := range testCases {
+		bucket := getClientPlatformStatsBucket(testCase.clientPlatform)
+		if bucket != testCase.bucket {
+			t.Errorf("unexpected bucket for %s: %s", testCase.clientPlatform, bucket)
+		}
+	}
+}
+
+func TestGetFailedTunnelStatsLogFields(t *testing.T) {
+
+	params := common.APIParameters{
+		"server_secret":          "secret",
+		"client_session_id":      "0123456789abcdef",
+		"propagation_channel_id": "ABCDEF",
+		"sponsor_id":             "012345",
+		"client_version":         "1",
+		"client_platform":        "Windows",
+		"relay_protocol":         protocol.TUNNEL_PROTOCOL_SSH,
+	}
+
+	makeStatusData := func(failedTunnelStats string) common.APIParameters {
+		var statusData common.APIParameters
+		err := json.Unmarshal(
+			[]byte(`{"failed_tunnel_stats" : `+failedTunnelStats+`}`), &statusData)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+		return statusData
+	}
+
+	validStat := `{
+        "relay_protocol" : "OSSH",
+        "client_failed_timestamp" : "2019-01-01T01:00:00Z",
+        "tunnel_error" : "dial failed",
+        "server_entry_region" : "CA",
+        "establishment_telemetry_sample_rate" : "0.5"}`
+
+	// Older clients omit failed_tunnel_stats.
+
+	logFields, err := getFailedTunnelStatsLogFields(
+		&Config{}, GeoIPData{}, nil, params, common.APIParameters{})
+	if err != nil || logFields != nil {
+		t.Fatalf("unexpected result: %v, %v", logFields, err)
+	}
+
+	// Session fields are taken from the status request, and dial fields
+	// from the stat.
+
+	logFields, err = getFailedTunnelStatsLogFields(
+		&Config{}, GeoIPData{}, nil, params,
+		makeStatusData("["+validStat+", "+validStat+"]"))
+	if err != nil {
+		t.Fatalf("getFailedTunnelStatsLogFields failed: %s", err)
+	}
+	if len(logFields) != 2 {
+		t.Fatalf("unexpected log fields count: %d", len(logFields))
+	}
+
+	expectedFields := LogFields{
+		"event_name":                          "failed_tunnel",
+		"propagation_channel_id":              "ABCDEF",
+		"relay_protocol":                      protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		"client_failed_timestamp":             "2019-01-01T01:00:00Z",
+		"tunnel_error":                        "dial failed",
+		"server_entry_region":                 "CA",
+		"establishment_telemetry_sample_rate": 0.5,
+	}
+	for name, value := range expectedFields {
+		if logFields[0][name] != value {
+			t.Fatalf("unexpected log field %s: %v", name, logFields[0][name])
+		}
+	}
+	for _, name := range []string{"server_secret", "client_session_id"} {
+		if _, ok := logFields[0][name]; ok {
+			t.Fatalf("unexpected log field: %s", name)
+		}
+	}
+
+	// Any invalid stat fails the request.
+
+	invalidStats := []string{
+		`{}`,
+		`"stat"`,
+		`[{"client_failed_timestamp" : "2019-01-01T01:00:00Z", "tunnel_error" : "dial failed"}]`,
+		`[{"relay_protocol" : "INVALID", "client_failed_timestamp" : "2019-01-01T01:00:00Z", "tunnel_error" : "dial failed"}]`,
+		`[{"relay_protocol" : "OSSH", "client_failed_timestamp" : "yesterday", "tunnel_error" : "dial failed"}]`,
+		`[{"relay_protocol" : "OSSH", "client_failed_timestamp" : "2019-01-01T01:00:00Z"}]`,
+		`[{"relay_protocol" : "OSSH", "client_failed_timestamp" : "2019-01-01T01:00:00Z", "tunnel_error" : "dial failed", "establishment_telemetry_sample_rate" : "2.0"}]`,
+		`[` + validStat + `, "stat"]`,
+	}
+
+	for _, invalidStat := range invalidStats {
+		_, err := getFailedTunnelStatsLogFields(
+			&Config{}, GeoIPData{}, nil, params, makeStatusData(invalidStat))
+		if err == nil {
+			t.Fatalf("unexpected success: %s", invalidStat)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	TUNNEL_AUTH_HOOK_DEFAULT_TIMEOUT   = 1 * time.Second
+	TUNNEL_AUTH_HOOK_MAX_RESPONSE_SIZE = 65536
+)
+
+// TunnelAuthHook invokes a deployment-specific authorization service for
+// each new tunnel, after the client has passed SSH password authentication.
+// The service may allow or deny the tunnel and may specify a per-session
+// policy which customizes the tunnel's traffic rules.
+//
+// The service is an HTTP endpoint which receives a TunnelAuthRequest as a
+// JSON POST body and responds with a TunnelAuthResponse JSON body.
+//
+// The hook runs within the SSH handshake, so each invocation is bounded by
+// Config.TunnelAuthHookTimeoutMilliseconds. A slow or failed service delays
+// only the client being authorized, and only up to the timeout; the
+// tunnel is then allowed or denied according to
+// Config.TunnelAuthHookAllowOnError.
+type TunnelAuthHook struct {
+	url          string
+	timeout      time.Duration
+	allowOnError bool
+	httpClient   *http.Client
+}
+
+// TunnelAuthRequest is the client metadata sent to the authorization
+// service. Only privacy-safe metadata is included: the client IP address
+// is never sent; the client location is limited to the GeoIP data which is
+// also recorded in server logs.
+type TunnelAuthRequest struct {
+	SessionID              string
+	TunnelProtocol         string
+	ClientRegion           string
+	ClientCity             string
+	ClientISP              string
+	ClientCapabilities     []string
+	IsFirstTunnelInSession bool
+}
+
+// TunnelAuthResponse is the authorization service decision.
+//
+// When Allow is false, the tunnel is denied and Reason, when specified, is
+// logged.
+//
+// When Allow is true, RateLimits and Region specify an optional per-session
+// policy:
+//
+// - RateLimits fields override the corresponding traffic rules rate limits
+// for the tunnel. As in traffic rules, omitted fields are not overridden.
+// UnthrottleFirstTunnelOnly is ignored, as policy rate limits already apply
+// to a single tunnel.
+//
+// - Region overrides the client GeoIP region when selecting traffic rules
+// for the tunnel, which allows the service to apply the traffic rules
+// configured for a region to a particular session.
+type TunnelAuthResponse struct {
+	Allow      bool
+	Reason     string
+	RateLimits RateLimits
+	Region     string
+}
+
+// tunnelAuthPolicy is the per-session policy applied to an authorized
+// tunnel.
+type tunnelAuthPolicy struct {
+	rateLimits RateLimits
+	region     string
+}
+
+// NewTunnelAuthHook initializes a new TunnelAuthHook that invokes the
+// authorization service at Config.TunnelAuthHookURL.
+func NewTunnelAuthHook(config *Config) *TunnelAuthHook {
+
+	timeout := TUNNEL_AUTH_HOOK_DEFAULT_TIMEOUT
+	if config.TunnelAuthHookTimeoutMilliseconds > 0 {
+		timeout = time.Duration(config.TunnelAuthHookTimeoutMilliseconds) * time.Millisecond
+	}
+
+	return &TunnelAuthHook{
+		url:          config.TunnelAuthHookURL,
+		timeout:      timeout,
+		allowOnError: config.TunnelAuthHookAllowOnError,
+		httpClient:   &http.Client{},
+	}
+}
+
+// authorize invokes the authorization service for the tunnel described by
+// request. When the tunnel is allowed, authorize returns the per-session
+// policy, which is nil when the service specifies no policy. When the
+// tunnel is denied, authorize returns an error.
+//
+// When the hook is nil, as it is when no authorization service is
+// configured, all tunnels are allowed.
+func (hook *TunnelAuthHook) authorize(
+	ctx context.Context, request *TunnelAuthRequest) (*tunnelAuthPolicy, error) {
+
+	if hook == nil {
+		return nil, nil
+	}
+
+	response, err := hook.invoke(ctx, request)
+	if err != nil {
+		if hook.allowOnError {
+			log.WithContextFields(LogFields{"error": err}).Warning(
+				"tunnel auth hook failed; allowing tunnel")
+			return nil, nil
+		}
+		return nil, common.ContextError(fmt.Errorf("tunnel auth hook failed: %s", err))
+	}
+
+	if !response.Allow {
+		log.WithContextFields(
+			LogFields{
+				"session_id": request.SessionID,
+				"reason":     response.Reason,
+			}).Info("tunnel denied by auth hook")
+		return nil, common.ContextError(errors.New("tunnel denied by auth hook"))
+	}
+
+	policy := &tunnelAuthPolicy{
+		rateLimits: response.RateLimits,
+		region:     response.Region,
+	}
+
+	if policy.rateLimits == (RateLimits{}) && policy.region == "" {
+		return nil, nil
+	}
+
+	return policy, nil
+}
+
+func (hook *TunnelAuthHook) invoke(
+	ctx context.Context, request *TunnelAuthRequest) (*TunnelAuthResponse, error) {
+
+	ctx, cancelFunc := context.WithTimeout(ctx, hook.timeout)
+	defer cancelFunc()
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	httpRequest, err := http.NewRequest("POST", hook.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	httpResponse, err := hook.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", httpResponse.StatusCode))
+	}
+
+	responseBody, err := ioutil.ReadAll(
+		io.LimitReader(httpResponse.Body, TUNNEL_AUTH_HOOK_MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	var response TunnelAuthResponse
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if (response.RateLimits.ReadUnthrottledBytes != nil && *response.RateLimits.ReadUnthrottledBytes < 0) ||
+		(response.RateLimits.ReadBytesPerSecond != nil && *response.RateLimits.ReadBytesPerSecond < 0) ||
+		(response.RateLimits.WriteUnthrottledBytes != nil && *response.RateLimits.WriteUnthrottledBytes < 0) ||
+		(response.RateLimits.WriteBytesPerSecond != nil && *response.RateLimits.WriteBytesPerSecond < 0) {
+		return nil, common.ContextError(errors.New("RateLimits values must be >= 0"))
+	}
+
+	return &response, nil
+}
+
+// applyRateLimits overrides the specified traffic rules rate limits with any
+// rate limits specified in the policy.
+func (policy *tunnelAuthPolicy) applyRateLimits(rateLimits *RateLimits) {
+
+	if policy == nil {
+		return
+	}
+
+	if policy.rateLimits.ReadUnthrottledBytes != nil {
+		rateLimits.ReadUnthrottledBytes = policy.rateLimits.ReadUnthrottledBytes
+	}
+
+	if policy.rateLimits.ReadBytesPerSecond != nil {
+		rateLimits.ReadBytesPerSecond = policy.rateLimits.ReadBytesPerSecond
+	}
+
+	if policy.rateLimits.WriteUnthrottledBytes != nil {
+		rateLimits.WriteUnthrottledBytes = policy.rateLimits.WriteUnthrottledBytes
+	}
+
+	if policy.rateLimits.WriteBytesPerSecond != nil {
+		rateLimits.WriteBytesPerSecond = policy.rateLimits.WriteBytesPerSecond
+	}
+
+	if policy.rateLimits.CloseAfterExhausted != nil {
+		rateLimits.CloseAfterExhausted = policy.rateLimits.CloseAfterExhausted
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTunnelAuthHook(t *testing.T) {
+
+	service := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var request TunnelAuthRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			switch request.SessionID {
+			case "allow":
+				w.Write([]byte(`{"Allow": true}`))
+			case "policy":
+				w.Write([]byte(`{"Allow": true, "RateLimits": {"ReadBytesPerSecond": 1000}, "Region": "CA"}`))
+			case "deny":
+				w.Write([]byte(`{"Allow": false, "Reason": "subscription expired"}`))
+			case "slow":
+				time.Sleep(1 * time.Second)
+				w.Write([]byte(`{"Allow": true}`))
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+	defer service.Close()
+
+	for _, allowOnError := range []bool{false, true} {
+
+		hook := NewTunnelAuthHook(&Config{
+			TunnelAuthHookURL:                 service.URL,
+			TunnelAuthHookTimeoutMilliseconds: 100,
+			TunnelAuthHookAllowOnError:        allowOnError,
+		})
+
+		policy, err := hook.authorize(
+			context.Background(), &TunnelAuthRequest{SessionID: "allow"})
+		if err != nil || policy != nil {
+			t.Fatalf("unexpected allow result: %+v, %v", policy, err)
+		}
+
+		policy, err = hook.authorize(
+			context.Background(), &TunnelAuthRequest{SessionID: "policy"})
+		if err != nil || policy == nil ||
+			policy.region != "CA" ||
+			policy.rateLimits.ReadBytesPerSecond == nil ||
+			*policy.rateLimits.ReadBytesPerSecond != 1000 ||
+			policy.rateLimits.WriteBytesPerSecond != nil {
+			t.Fatalf("unexpected policy result: %+v, %v", policy, err)
+		}
+
+		var writeBytesPerSecond int64 = 2000
+		rateLimits := RateLimits{WriteBytesPerSecond: &writeBytesPerSecond}
+		policy.applyRateLimits(&rateLimits)
+		if *rateLimits.ReadBytesPerSecond != 1000 || *rateLimits.WriteBytesPerSecond != 2000 {
+			t.Fatalf("unexpected rate limits: %+v", rateLimits)
+		}
+
+		// Denial is the service's decision and is not subject to
+		// allowOnError.
+
+		_, err = hook.authorize(
+			context.Background(), &TunnelAuthRequest{SessionID: "deny"})
+		if err == nil {
+			t.Fatalf("unexpected deny result")
+		}
+
+		for _, sessionID := range []string{"slow", "error"} {
+			start := time.Now()
+			_, err = hook.authorize(
+				context.Background(), &TunnelAuthRequest{SessionID: sessionID})
+			if (err == nil) != allowOnError {
+				t.Fatalf("unexpected %s result: %v", sessionID, err)
+			}
+			if time.Since(start) > 500*time.Millisecond {
+				t.Fatalf("unexpected %s duration", sessionID)
+			}
+		}
+	}
+
+	var disabledHook *TunnelAuthHook
+	policy, err := disabledHook.authorize(
+		context.Background(), &TunnelAuthRequest{SessionID: "deny"})
+	if err != nil || policy != nil {
+		t.Fatalf("unexpected disabled result: %+v, %v", policy, err)
+	}
+}
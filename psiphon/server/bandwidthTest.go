@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	BANDWIDTH_TEST_DEFAULT_MAX_BYTES    = 10 * 1024 * 1024
+	BANDWIDTH_TEST_DEFAULT_MIN_INTERVAL = 1 * time.Minute
+	BANDWIDTH_TEST_TIMEOUT              = 1 * time.Minute
+	BANDWIDTH_TEST_BUFFER_SIZE          = 32 * 1024
+)
+
+// bandwidthTestMetrics records, for bandwidth tests, the number of tests and
+// the test bytes sent and received. Bandwidth test bytes are not port
+// forward traffic and are not included in the client's traffic state.
+type bandwidthTestMetrics struct {
+	testCount int64
+	bytesUp   int64
+	bytesDown int64
+}
+
+// handleBandwidthTestChannel runs a bandwidth test for a
+// BANDWIDTH_TEST_CHANNEL_TYPE channel: the server receives the requested
+// upstream bytes and then sends the requested downstream bytes. The client
+// measures the throughput.
+//
+// Bandwidth tests are limited: each client may run one test at a time, at
+// most once every Config.BandwidthTestMinIntervalSeconds, and each test
+// direction is limited to Config.BandwidthTestMaxBytes.
+func (sshClient *sshClient) handleBandwidthTestChannel(newChannel ssh.NewChannel) {
+
+	config := sshClient.sshServer.support.Config
+
+	if !config.EnableBandwidthTest {
+		sshClient.rejectNewChannel(newChannel, "unsupported bandwidth test channel type")
+		return
+	}
+
+	var request protocol.BandwidthTestRequest
+	err := ssh.Unmarshal(newChannel.ExtraData(), &request)
+	if err != nil {
+		sshClient.rejectNewChannel(newChannel, "invalid extra data")
+		return
+	}
+
+	maxBytes := uint64(BANDWIDTH_TEST_DEFAULT_MAX_BYTES)
+	if config.BandwidthTestMaxBytes > 0 {
+		maxBytes = uint64(config.BandwidthTestMaxBytes)
+	}
+
+	if request.UpstreamBytes > maxBytes || request.DownstreamBytes > maxBytes {
+		sshClient.rejectNewChannel(newChannel, "bandwidth test exceeds limit")
+		return
+	}
+
+	if !sshClient.startBandwidthTest() {
+		sshClient.rejectNewChannel(newChannel, "bandwidth test rate limited")
+		return
+	}
+	defer sshClient.stopBandwidthTest()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("accept new channel failed")
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	defer channel.Close()
+
+	// The channel is closed, interrupting any blocking read or write, when
+	// the test exceeds BANDWIDTH_TEST_TIMEOUT.
+	closeTimer := time.AfterFunc(BANDWIDTH_TEST_TIMEOUT, func() { channel.Close() })
+	defer closeTimer.Stop()
+
+	bytesUp, err := io.CopyN(ioutil.Discard, channel, int64(request.UpstreamBytes))
+
+	var bytesDown int64
+	if err == nil {
+		bytesDown, err = sendBandwidthTestBytes(channel, int64(request.DownstreamBytes))
+	}
+
+	if err == nil {
+		err = channel.CloseWrite()
+	}
+
+	sshClient.Lock()
+	sshClient.bandwidthTestMetrics.testCount += 1
+	sshClient.bandwidthTestMetrics.bytesUp += bytesUp
+	sshClient.bandwidthTestMetrics.bytesDown += bytesDown
+	sshClient.Unlock()
+
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Debug("bandwidth test failed")
+	}
+}
+
+// startBandwidthTest checks and updates the client's bandwidth test rate
+// limit state. When startBandwidthTest returns true, the caller must call
+// stopBandwidthTest when the test ends.
+func (sshClient *sshClient) startBandwidthTest() bool {
+
+	minInterval := BANDWIDTH_TEST_DEFAULT_MIN_INTERVAL
+	if sshClient.sshServer.support.Config.BandwidthTestMinIntervalSeconds > 0 {
+		minInterval = time.Duration(
+			sshClient.sshServer.support.Config.BandwidthTestMinIntervalSeconds) * time.Second
+	}
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	// Bandwidth tests are permitted only after the API handshake, as with
+	// port forwards.
+	if !sshClient.handshakeState.completed || sshClient.bandwidthTestInProgress {
+		return false
+	}
+
+	if sshClient.bandwidthTestMetrics.testCount > 0 &&
+		monotime.Since(sshClient.lastBandwidthTestTime) < minInterval {
+		return false
+	}
+
+	sshClient.bandwidthTestInProgress = true
+	sshClient.lastBandwidthTestTime = monotime.Now()
+
+	return true
+}
+
+func (sshClient *sshClient) stopBandwidthTest() {
+	sshClient.Lock()
+	sshClient.bandwidthTestInProgress = false
+	sshClient.Unlock()
+}
+
+// sendBandwidthTestBytes writes count random bytes to writer. The random
+// buffer is reused, as the content is not significant, but the content is
+// not compressible.
+func sendBandwidthTestBytes(writer io.Writer, count int64) (int64, error) {
+
+	size := int64(BANDWIDTH_TEST_BUFFER_SIZE)
+	if count < size {
+		size = count
+	}
+
+	buffer, err := common.MakeSecureRandomBytes(int(size))
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	var written int64
+	for written < count {
+		n := count - written
+		if n > size {
+			n = size
+		}
+		m, err := writer.Write(buffer[:n])
+		written += int64(m)
+		if err != nil {
+			return written, common.ContextError(err)
+		}
+	}
+
+	return written, nil
+}
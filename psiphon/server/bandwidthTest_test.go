@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestBandwidthTest(t *testing.T) {
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey failed: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	maxBytes := 1024 * 1024
+
+	sshClient := &sshClient{
+		sshServer: &sshServer{
+			support: &SupportServices{
+				Config: &Config{
+					EnableBandwidthTest:   true,
+					BandwidthTestMaxBytes: maxBytes,
+				},
+			},
+		},
+		handshakeState: handshakeState{completed: true},
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+		serverConfig.AddHostKey(signer)
+		_, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		for newChannel := range channels {
+			sshClient.handleBandwidthTestChannel(newChannel)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	clientConn, _, _, err := ssh.NewClientConn(
+		conn, "", &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("NewClientConn failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	runTest := func(upstreamBytes, downstreamBytes int) error {
+
+		request := &protocol.BandwidthTestRequest{
+			UpstreamBytes:   uint64(upstreamBytes),
+			DownstreamBytes: uint64(downstreamBytes),
+		}
+
+		channel, requests, err := clientConn.OpenChannel(
+			protocol.BANDWIDTH_TEST_CHANNEL_TYPE, ssh.Marshal(request))
+		if err != nil {
+			return err
+		}
+		go ssh.DiscardRequests(requests)
+		defer channel.Close()
+
+		_, err = channel.Write(make([]byte, upstreamBytes))
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		err = channel.CloseWrite()
+		if err != nil {
+			t.Fatalf("CloseWrite failed: %s", err)
+		}
+
+		n, err := io.Copy(ioutil.Discard, channel)
+		if err != nil {
+			t.Fatalf("Copy failed: %s", err)
+		}
+		if n != int64(downstreamBytes) {
+			t.Fatalf("unexpected downstream bytes: %d", n)
+		}
+		return nil
+	}
+
+	// Tests exceeding the limit are rejected.
+
+	err = runTest(maxBytes+1, 0)
+	if err == nil {
+		t.Fatalf("unexpected bandwidth test success")
+	}
+
+	err = runTest(100*1024, maxBytes)
+	if err != nil {
+		t.Fatalf("bandwidth test failed: %s", err)
+	}
+
+	// A second test within the minimum interval is rejected.
+
+	err = runTest(1024, 1024)
+	if err == nil {
+		t.Fatalf("unexpected bandwidth test success")
+	}
+
+	sshClient.Lock()
+	metrics := sshClient.bandwidthTestMetrics
+	sshClient.Unlock()
+
+	if metrics.testCount != 1 ||
+		metrics.bytesUp != 100*1024 ||
+		metrics.bytesDown != int64(maxBytes) {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// tunnelBufferPool provides the buffers used in the tunnel data path: the
+// TCP port forward relay copy buffers and the udpgw message buffers. The
+// pool holds no per-instance state and is shared by all Server instances in
+// the process.
+var tunnelBufferPool = NewBufferPool(
+	SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE,
+	udpgwProtocolMaxMessageSize)
+
+// BufferPool is a pool of reusable byte buffers, in fixed size buckets,
+// which reduces allocation and GC pressure for short-lived buffers, such
+// as the buffers used by each port forward. Each bucket is a sync.Pool, so
+// idle buffers are eventually released by the garbage collector.
+//
+// Buffers are zeroed when released back to the pool, so no data from one
+// client or port forward is exposed to the next user of a buffer.
+//
+// Buffers are handled as *[]byte, as storing a slice value in a sync.Pool
+// incurs an allocation on each Put.
+type BufferPool struct {
+	bucketSizes []int
+	buckets     []*sync.Pool
+}
+
+// NewBufferPool creates a new BufferPool with a bucket for each of the
+// specified buffer sizes.
+func NewBufferPool(bucketSizes ...int) *BufferPool {
+
+	sizes := append([]int(nil), bucketSizes...)
+	sort.Ints(sizes)
+
+	buckets := make([]*sync.Pool, len(sizes))
+	for i, size := range sizes {
+		bufferSize := size
+		buckets[i] = &sync.Pool{
+			New: func() interface{} {
+				buffer := make([]byte, bufferSize)
+				return &buffer
+			},
+		}
+	}
+
+	return &BufferPool{
+		bucketSizes: sizes,
+		buckets:     buckets,
+	}
+}
+
+// Get returns a buffer of the specified size, which is taken from the pool
+// when size fits in a bucket. The buffer capacity may exceed size. When size
+// exceeds the largest bucket, a new buffer is allocated. Call Put to release
+// the buffer back to the pool.
+func (pool *BufferPool) Get(size int) *[]byte {
+
+	index := pool.bucketIndex(size)
+	if index == -1 {
+		buffer := make([]byte, size)
+		return &buffer
+	}
+
+	buffer := pool.buckets[index].Get().(*[]byte)
+	*buffer = (*buffer)[:size]
+	return buffer
+}
+
+// Put zeroes the buffer and releases it back to the pool. The buffer must
+// have been obtained from Get and must not be used after Put. Buffers which
+// don't match a bucket size are discarded.
+func (pool *BufferPool) Put(buffer *[]byte) {
+
+	capacity := cap(*buffer)
+	index := pool.bucketIndex(capacity)
+	if index == -1 || pool.bucketSizes[index] != capacity {
+		return
+	}
+
+	*buffer = (*buffer)[:capacity]
+	b := *buffer
+	for i := range b {
+		b[i] = 0
+	}
+
+	pool.buckets[index].Put(buffer)
+}
+
+// bucketIndex returns the index of the smallest bucket which can hold a
+// buffer of the specified size, or -1 when no bucket is large enough.
+func (pool *BufferPool) bucketIndex(size int) int {
+	index := sort.SearchInts(pool.bucketSizes, size)
+	if index == len(pool.bucketSizes) {
+		return -1
+	}
+	return index
+}
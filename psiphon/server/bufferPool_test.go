@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+
+	pool := NewBufferPool(1024, 256)
+
+	for _, size := range []int{1, 256, 257, 1024} {
+
+		buffer := pool.Get(size)
+		if len(*buffer) != size {
+			t.Fatalf("unexpected buffer length: %d", len(*buffer))
+		}
+		if size <= 256 && cap(*buffer) != 256 ||
+			size > 256 && cap(*buffer) != 1024 {
+			t.Fatalf("unexpected buffer capacity: %d", cap(*buffer))
+		}
+
+		for i := range *buffer {
+			(*buffer)[i] = 0xff
+		}
+		pool.Put(buffer)
+	}
+
+	// Buffers must never expose data from previous use.
+
+	for i := 0; i < 100; i++ {
+		buffer := pool.Get(1024)
+		for _, b := range (*buffer)[:cap(*buffer)] {
+			if b != 0 {
+				t.Fatalf("buffer not zeroed")
+			}
+		}
+		pool.Put(buffer)
+	}
+
+	buffer := pool.Get(2048)
+	if len(*buffer) != 2048 {
+		t.Fatalf("unexpected buffer length: %d", len(*buffer))
+	}
+	pool.Put(buffer)
+}
+
+var benchmarkRelayData = make([]byte, 64*1024)
+
+// relayReader hides bytes.Reader.WriteTo, which io.CopyBuffer would
+// otherwise use in place of the copy buffer.
+type relayReader struct {
+	io.Reader
+}
+
+func benchmarkRelay(b *testing.B, get func() *[]byte, put func(*[]byte)) {
+
+	b.ReportAllocs()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	startPauseTotalNs := memStats.PauseTotalNs
+	startNumGC := memStats.NumGC
+
+	b.RunParallel(func(pb *testing.PB) {
+		reader := bytes.NewReader(benchmarkRelayData)
+		relayReader := &relayReader{reader}
+		for pb.Next() {
+			reader.Reset(benchmarkRelayData)
+			buffer := get()
+			_, err := io.CopyBuffer(ioutil.Discard, relayReader, *buffer)
+			if err != nil {
+				b.Fatalf("CopyBuffer failed: %s", err)
+			}
+			put(buffer)
+		}
+	})
+
+	runtime.ReadMemStats(&memStats)
+	b.ReportMetric(
+		float64(memStats.PauseTotalNs-startPauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+	b.ReportMetric(
+		float64(memStats.NumGC-startNumGC), "gc-cycles")
+}
+
+func BenchmarkRelayAllocatedBuffer(b *testing.B) {
+	benchmarkRelay(
+		b,
+		func() *[]byte {
+			buffer := make([]byte, SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE)
+			return &buffer
+		},
+		func(*[]byte) {})
+}
+
+func BenchmarkRelayPooledBuffer(b *testing.B) {
+	benchmarkRelay(
+		b,
+		func() *[]byte {
+			return tunnelBufferPool.Get(SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE)
+		},
+		tunnelBufferPool.Put)
+}
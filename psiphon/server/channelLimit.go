@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+// allocateSSHChannel checks and increments the client's count of open SSH
+// channels, returning a limitedNewChannel wrapping newChannel, which
+// releases the allocation when the channel is rejected or closed. nil is
+// returned when the ServerMaxSSHChannelsPerTunnel limit is exceeded, in
+// which case the caller must reject the channel.
+//
+// Open channels include channels which are queued or dialing and have not
+// yet been accepted or rejected.
+func (sshClient *sshClient) allocateSSHChannel(newChannel ssh.NewChannel) ssh.NewChannel {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	max := sshClient.maxSSHChannels
+	if max > 0 && sshClient.openSSHChannelCount >= int64(max) {
+		sshClient.qualityMetrics.sshChannelRejectedLimitCount += 1
+		sshClient.sshChannelRejectedLimitCount += 1
+		return nil
+	}
+
+	sshClient.openSSHChannelCount += 1
+
+	return &limitedNewChannel{
+		NewChannel: newChannel,
+		release:    sshClient.releaseSSHChannel,
+	}
+}
+
+func (sshClient *sshClient) releaseSSHChannel() {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	sshClient.openSSHChannelCount -= 1
+}
+
+// getMaxSSHChannelsPerTunnel returns the ServerMaxSSHChannelsPerTunnel
+// tactics parameter value for the client, or the parameter default when no
+// tactics apply.
+func getMaxSSHChannelsPerTunnel(
+	tacticsSnapshot *tactics.Snapshot, geoIPData GeoIPData) int {
+
+	p, err := tacticsSnapshot.GetServerSideParameters(common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for SSH channel limit")
+	}
+
+	if p == nil {
+		clientParameters, err := parameters.NewClientParameters(nil)
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning(
+				"NewClientParameters failed")
+			return 0
+		}
+		p = clientParameters.Get()
+	}
+
+	return p.Int(parameters.ServerMaxSSHChannelsPerTunnel)
+}
+
+// limitedNewChannel is an ssh.NewChannel which calls release exactly once,
+// when the new channel is rejected, fails to be accepted, or when the
+// accepted channel is closed.
+type limitedNewChannel struct {
+	ssh.NewChannel
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (newChannel *limitedNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	channel, requests, err := newChannel.NewChannel.Accept()
+	if err != nil {
+		newChannel.doRelease()
+		return nil, nil, err
+	}
+	return &limitedChannel{Channel: channel, newChannel: newChannel}, requests, nil
+}
+
+func (newChannel *limitedNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	newChannel.doRelease()
+	return newChannel.NewChannel.Reject(reason, message)
+}
+
+func (newChannel *limitedNewChannel) doRelease() {
+	newChannel.releaseOnce.Do(newChannel.release)
+}
+
+// limitedChannel is an accepted limitedNewChannel.
+type limitedChannel struct {
+	ssh.Channel
+	newChannel *limitedNewChannel
+}
+
+func (channel *limitedChannel) Close() error {
+	channel.newChannel.doRelease()
+	return channel.Channel.Close()
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+)
+
+type testNewChannel struct {
+	acceptErr error
+	rejected  bool
+}
+
+func (newChannel *testNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	if newChannel.acceptErr != nil {
+		return nil, nil, newChannel.acceptErr
+	}
+	return &testChannel{}, nil, nil
+}
+
+func (newChannel *testNewChannel) Reject(ssh.RejectionReason, string) error {
+	newChannel.rejected = true
+	return nil
+}
+
+func (newChannel *testNewChannel) ChannelType() string {
+	return "direct-tcpip"
+}
+
+func (newChannel *testNewChannel) ExtraData() []byte {
+	return nil
+}
+
+type testChannel struct {
+	ssh.Channel
+	closed bool
+}
+
+func (channel *testChannel) Close() error {
+	channel.closed = true
+	return nil
+}
+
+func TestSSHChannelLimit(t *testing.T) {
+
+	sshClient := &sshClient{maxSSHChannels: 2}
+
+	checkCount := func(expected int64) {
+		if sshClient.openSSHChannelCount != expected {
+			t.Fatalf(
+				"unexpected open channel count: %d != %d",
+				sshClient.openSSHChannelCount, expected)
+		}
+	}
+
+	first := sshClient.allocateSSHChannel(&testNewChannel{})
+	second := sshClient.allocateSSHChannel(&testNewChannel{})
+	if first == nil || second == nil {
+		t.Fatalf("unexpected allocation failure")
+	}
+	checkCount(2)
+
+	if sshClient.allocateSSHChannel(&testNewChannel{}) != nil {
+		t.Fatalf("unexpected allocation success")
+	}
+	if sshClient.sshChannelRejectedLimitCount != 1 ||
+		sshClient.qualityMetrics.sshChannelRejectedLimitCount != 1 {
+		t.Fatalf("unexpected rejected count")
+	}
+
+	// Rejecting releases the allocation.
+
+	first.Reject(ssh.Prohibited, "")
+	if !first.(*limitedNewChannel).NewChannel.(*testNewChannel).rejected {
+		t.Fatalf("channel not rejected")
+	}
+	checkCount(1)
+
+	// Closing an accepted channel releases the allocation, only once.
+
+	channel, _, err := second.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	checkCount(1)
+	channel.Close()
+	channel.Close()
+	if !channel.(*limitedChannel).Channel.(*testChannel).closed {
+		t.Fatalf("channel not closed")
+	}
+	checkCount(0)
+
+	// A failed accept releases the allocation.
+
+	third := sshClient.allocateSSHChannel(
+		&testNewChannel{acceptErr: errors.New("accept failed")})
+	if third == nil {
+		t.Fatalf("unexpected allocation failure")
+	}
+	checkCount(1)
+	_, _, err = third.Accept()
+	if err == nil {
+		t.Fatalf("unexpected Accept success")
+	}
+	checkCount(0)
+
+	// 0 is no limit.
+
+	sshClient.maxSSHChannels = 0
+	for i := 0; i < 10; i++ {
+		if sshClient.allocateSSHChannel(&testNewChannel{}) == nil {
+			t.Fatalf("unexpected allocation failure")
+		}
+	}
+	checkCount(10)
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// closeBehaviorListener wraps a TCP listener and applies the
+// ServerConnectionCloseBehaviors tactics parameter, for the client's region
+// and the listener's tunnel protocol, to each accepted connection.
+//
+// As the close behavior is set when the connection is accepted, it applies
+// no matter why the connection is closed: at the end of a tunnel, and also
+// on abnormal termination, such as a failed handshake. So abnormal
+// termination has no distinct close pattern; and, with RSTProbability and
+// MaxCloseDelayMilliseconds, neither RSTs nor close timing follow a fixed
+// pattern.
+type closeBehaviorListener struct {
+	net.Listener
+	support        *SupportServices
+	tunnelProtocol string
+}
+
+func newCloseBehaviorListener(
+	listener net.Listener,
+	support *SupportServices,
+	tunnelProtocol string) net.Listener {
+
+	return &closeBehaviorListener{
+		Listener:       listener,
+		support:        support,
+		tunnelProtocol: tunnelProtocol,
+	}
+}
+
+// Accept implements the net.Listener interface.
+func (listener *closeBehaviorListener) Accept() (net.Conn, error) {
+
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		// Don't modify error from net.Listener
+		return nil, err
+	}
+
+	if listener.support.TacticsServer == nil {
+		return conn, nil
+	}
+
+	geoIPData := listener.support.GeoIPService.Lookup(
+		common.IPAddressFromAddr(conn.RemoteAddr()))
+
+	p, err := listener.support.TacticsServer.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for connection")
+		return conn, nil
+	}
+
+	if p == nil {
+		return conn, nil
+	}
+
+	behavior := p.ConnectionCloseBehaviors(
+		parameters.ServerConnectionCloseBehaviors).Behavior(listener.tunnelProtocol)
+
+	return applyCloseBehavior(conn, behavior), nil
+}
+
+// applyCloseBehavior sets the SO_LINGER option of conn, which must be a
+// *net.TCPConn for the option to be set, according to behavior. When a
+// close delay is specified, the returned conn wraps conn and delays Close.
+//
+// Note that, on some operating systems including Linux, a LingerSeconds
+// timeout may cause Close to block until all data has been sent or the
+// timeout expires.
+func applyCloseBehavior(
+	conn net.Conn, behavior parameters.ConnectionCloseBehavior) net.Conn {
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn
+	}
+
+	var err error
+	if common.FlipWeightedCoin(behavior.RSTProbability) {
+		err = tcpConn.SetLinger(0)
+	} else if behavior.LingerSeconds > 0 {
+		err = tcpConn.SetLinger(behavior.LingerSeconds)
+	}
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("set linger failed")
+	}
+
+	if behavior.MaxCloseDelayMilliseconds > 0 {
+		return &delayedCloseConn{
+			Conn: conn,
+			maxCloseDelay: time.Duration(
+				behavior.MaxCloseDelayMilliseconds) * time.Millisecond,
+		}
+	}
+
+	return conn
+}
+
+// delayedCloseConn delays closing the underlying conn by a random duration,
+// up to maxCloseDelay. Close returns immediately, and the underlying conn
+// is closed in the background.
+type delayedCloseConn struct {
+	net.Conn
+	maxCloseDelay time.Duration
+	closeOnce     sync.Once
+}
+
+// Close implements the net.Conn interface.
+func (conn *delayedCloseConn) Close() error {
+	conn.closeOnce.Do(func() {
+		delay, err := common.MakeSecureRandomPeriod(0, conn.maxCloseDelay)
+		if err != nil {
+			conn.Conn.Close()
+			return
+		}
+		time.AfterFunc(delay, func() { conn.Conn.Close() })
+	})
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestCloseBehavior(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	testCases := []struct {
+		description string
+		behavior    parameters.ConnectionCloseBehavior
+		expectRST   bool
+	}{
+		{"default", parameters.ConnectionCloseBehavior{}, false},
+		{"RST", parameters.ConnectionCloseBehavior{RSTProbability: 1.0}, true},
+		{"linger", parameters.ConnectionCloseBehavior{LingerSeconds: 1}, false},
+		{"delayed RST", parameters.ConnectionCloseBehavior{
+			RSTProbability: 1.0, MaxCloseDelayMilliseconds: 100}, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			clientConn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial failed: %s", err)
+			}
+			defer clientConn.Close()
+
+			serverConn, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("Accept failed: %s", err)
+			}
+
+			serverConn = applyCloseBehavior(serverConn, testCase.behavior)
+
+			err = serverConn.Close()
+			if err != nil {
+				t.Fatalf("Close failed: %s", err)
+			}
+
+			clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = clientConn.Read(make([]byte, 1))
+
+			if testCase.expectRST {
+				if err == nil || !strings.Contains(err.Error(), "connection reset") {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if err != io.EOF {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+)
+
+// compressedChannel is an ssh.Channel for a
+// protocol.COMPRESSED_TCP_PORT_FORWARD_CHANNEL_TYPE port forward. Channel
+// data is compressed and decompressed by a common.CompressedConn.
+type compressedChannel struct {
+	ssh.Channel
+	conn *common.CompressedConn
+}
+
+func newCompressedChannel(channel ssh.Channel) *compressedChannel {
+	return &compressedChannel{
+		Channel: channel,
+		conn:    common.NewCompressedConn(&sshChannelConn{Channel: channel}),
+	}
+}
+
+func (channel *compressedChannel) Read(buffer []byte) (int, error) {
+	return channel.conn.Read(buffer)
+}
+
+func (channel *compressedChannel) Write(buffer []byte) (int, error) {
+	return channel.conn.Write(buffer)
+}
+
+// GetWriteMetrics returns the common.CompressedConn write metrics.
+func (channel *compressedChannel) GetWriteMetrics() (int64, int64) {
+	return channel.conn.GetWriteMetrics()
+}
+
+// sshChannelConn adapts an ssh.Channel to the net.Conn interface required
+// by common.CompressedConn. Only Read/Write/Close are implemented.
+type sshChannelConn struct {
+	ssh.Channel
+}
+
+func (conn *sshChannelConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (conn *sshChannelConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (conn *sshChannelConn) SetDeadline(_ time.Time) error {
+	return common.ContextError(errors.New("unsupported"))
+}
+
+func (conn *sshChannelConn) SetReadDeadline(_ time.Time) error {
+	return common.ContextError(errors.New("unsupported"))
+}
+
+func (conn *sshChannelConn) SetWriteDeadline(_ time.Time) error {
+	return common.ContextError(errors.New("unsupported"))
+}
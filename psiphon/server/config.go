@@ -28,17 +28,24 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/accesscontrol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/nacl/box"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+	tris "github.com/Psiphon-Labs/tls-tris"
 )
 
 const (
@@ -54,6 +61,14 @@ const (
 	SSH_PASSWORD_BYTE_LENGTH             = 32
 	SSH_RSA_HOST_KEY_BITS                = 2048
 	SSH_OBFUSCATED_KEY_BYTE_LENGTH       = 32
+
+	// The Linux TCP_MAXSEG bounds, TCP_MIN_MSS and MAX_TCP_WINDOW.
+	TCP_MIN_MAX_SEGMENT_SIZE = 88
+	TCP_MAX_MAX_SEGMENT_SIZE = 32767
+
+	// The broadest permitted SharedIPAddressRanges ranges.
+	SHARED_IP_ADDRESS_RANGE_MIN_PREFIX_LENGTH_IPV4 = 8
+	SHARED_IP_ADDRESS_RANGE_MIN_PREFIX_LENGTH_IPV6 = 32
 )
 
 // Config specifies the configuration and behavior of a Psiphon
@@ -72,6 +87,38 @@ type Config struct {
 	// unable to write any logs.
 	SkipPanickingLogWriter bool
 
+	// LogWriterRetryAttempts and LogWriterRetryBackoffMilliseconds specify
+	// how many times, in total, a failed log write is attempted, and the
+	// time to wait between attempts, before the PanickingLogWriter panics.
+	// This tolerates transient log file write failures. The default, 0, is
+	// to panic on the first failure.
+	LogWriterRetryAttempts            int
+	LogWriterRetryBackoffMilliseconds int
+
+	// ConnectionEventLogFilename specifies the path of a file to which
+	// structured connection events are written, one JSON object per line,
+	// separately from the diagnostic and metric logs. See
+	// ConnectionEventLogger. The default, "", disables connection event
+	// logging.
+	ConnectionEventLogFilename string
+
+	// AsyncLogQueueSize, when > 0, enables asynchronous logging. Log lines
+	// are queued, in a queue of the specified size, and written by a
+	// separate goroutine, so that slow log writes don't block the caller.
+	// Error and higher priority lines, which include all metric events, are
+	// never dropped; when the queue is full, logging these lines blocks.
+	// Warning and lower priority lines are sampled, per AsyncLogSampleRate,
+	// when the queue is more than half full, and dropped when the queue is
+	// full. The number of dropped lines is logged periodically. Log write
+	// failures still panic, per SkipPanickingLogWriter.
+	// The default, 0, is synchronous logging.
+	AsyncLogQueueSize int
+
+	// AsyncLogSampleRate specifies that 1 in AsyncLogSampleRate low priority
+	// log lines are retained when the asynchronous log queue is more than
+	// half full. The default, 0, drops all low priority lines in this case.
+	AsyncLogSampleRate int
+
 	// DiscoveryValueHMACKey is the network-wide secret value
 	// used to determine a unique discovery strategy.
 	DiscoveryValueHMACKey string
@@ -79,9 +126,11 @@ type Config struct {
 	// GeoIPDatabaseFilenames are paths of GeoIP2/GeoLite2
 	// MaxMind database files. When empty, no GeoIP lookups are
 	// performed. Each file is queried, in order, for the
-	// logged fields: country code, city, and ISP. Multiple
+	// logged fields: country code, city, ISP, and ASN. Multiple
 	// file support accommodates the MaxMind distribution where
-	// ISP data in a separate file.
+	// ISP and ASN data are in separate files. Any of the country,
+	// ISP, and ASN databases may be omitted, in which case the
+	// corresponding fields are GEOIP_UNKNOWN_VALUE.
 	GeoIPDatabaseFilenames []string
 
 	// PsinetDatabaseFilename is the path of the Psiphon automation
@@ -95,6 +144,13 @@ type Config struct {
 	// ServerIPAddress is the public IP address of the server.
 	ServerIPAddress string
 
+	// EgressIPAddress is the public IP address from which the server's
+	// outbound, port forwarded traffic originates. When blank, the egress IP
+	// address is detected from the host's default route. The egress IP
+	// address is returned to clients in the handshake only when enabled by
+	// the ServerReturnEgressIPAddress tactics parameter.
+	EgressIPAddress string
+
 	// WebServerPort is the listening port of the web server.
 	// When <= 0, no web server component is run.
 	WebServerPort int
@@ -146,6 +202,24 @@ type Config struct {
 	// protocols, run by this server instance, which use SSH.
 	SSHServerVersion string
 
+	// SSHMaxPacketSize, when > 0, is the maximum SSH packet length the
+	// server accepts from clients. A client sending a packet with a length
+	// field exceeding the limit is disconnected before any buffer is
+	// allocated for the packet. Valid values are 35000, the minimum packet
+	// length SSH implementations must support, to 262144, the default.
+	SSHMaxPacketSize int
+
+	// SSHPreferredAlgorithms specifies SSH key exchange, cipher, and MAC
+	// algorithms, or a preset, which the server offers ahead of the
+	// defaults. As the first algorithm offered by the client which the
+	// server also offers is selected, this is mainly useful with
+	// OmitDefaults set, to restrict the offered algorithms. The server
+	// defaults include ChaCha20-Poly1305, which clients may prefer. The
+	// same value is used for all protocols, run by this server instance,
+	// which use SSH; for obfuscated SSH protocols, Encrypt-then-MAC
+	// algorithms are never offered.
+	SSHPreferredAlgorithms parameters.SSHAlgorithms
+
 	// SSHUserName is the SSH user name to be presented by the
 	// the tunnel-core client. The same value is used for all
 	// protocols, run by this server instance, which use SSH.
@@ -158,9 +232,37 @@ type Config struct {
 
 	// ObfuscatedSSHKey is the secret key for use in the Obfuscated
 	// SSH protocol. The same secret key is used for all protocols,
-	// run by this server instance, which use Obfuscated SSH.
+	// run by this server instance, which use Obfuscated SSH, except
+	// for protocols with a distinct key in ObfuscatedSSHKeys.
 	ObfuscatedSSHKey string
 
+	// ObfuscatedSSHKeys is a map of tunnel protocols to distinct
+	// Obfuscated SSH secret keys. When a protocol has a key in
+	// ObfuscatedSSHKeys, that key is used instead of ObfuscatedSSHKey,
+	// so that revealing the key for one protocol doesn't reveal the
+	// key for other protocols. The corresponding server entry must
+	// include the same keys, in SshObfuscatedKeys.
+	ObfuscatedSSHKeys map[string]string
+
+	// ObfuscatedSSHSeedKeyDerivations lists the names of the
+	// obfuscator.SeedKeyDerivations accepted in Obfuscated SSH seed
+	// messages. Clients select a derivation with the
+	// ObfuscatedSSHSeedKeyDerivation tactics parameter. The default
+	// derivation, "", must be included to continue to accept clients
+	// using the default. When omitted, only the default is accepted.
+	// Each additional derivation adds a key derivation computation to the
+	// handshake of clients using later derivations in the list.
+	ObfuscatedSSHSeedKeyDerivations []string
+
+	// ObfuscatedSSHMinPadding, when > 0, is the minimum padding length
+	// accepted in Obfuscated SSH client seed messages. Connections with
+	// less padding, which may be probes or clients with malformed seed
+	// messages, are rejected as with any other invalid seed message. The
+	// minimum must not exceed the padding sent by clients, which is at
+	// least the ObfuscatedSSHMinPadding tactics parameter, 0 by default,
+	// or any server entry ObfuscatedSSHMinPadding override.
+	ObfuscatedSSHMinPadding int
+
 	// MeekCookieEncryptionPrivateKey is the NaCl private key used
 	// to decrypt meek cookie payload sent from clients. The same
 	// key is used for all meek protocols run by this server instance.
@@ -189,6 +291,42 @@ type Config struct {
 	// used as the client IP.
 	MeekProxyForwardedForHeaders []string
 
+	// MeekSessionTokenHeaders is a list of HTTP request headers which may
+	// carry the meek session token, for clients configured with the
+	// "Header" MeekSessionTokenLocation. The headers should match the
+	// MeekSessionTokenHeaderName tactics parameter values in use. When
+	// empty, only protocol.MEEK_SESSION_TOKEN_DEFAULT_HEADER_NAME is
+	// checked.
+	MeekSessionTokenHeaders []string
+
+	// MeekPathPrefix is a URL path prefix, such as "/api/v2/events", under
+	// which meek requests are accepted. This allows the meek server to be
+	// co-hosted, behind a reverse proxy, with another web application; the
+	// reverse proxy must forward request paths unmodified. When set, all
+	// requests for paths outside of the prefix receive a 404 Not Found
+	// response. The prefix must begin with, and not end with, "/". Clients
+	// are configured with the same prefix via the server entry.
+	MeekPathPrefix string
+
+	// SharedIPAddressRanges is a list of CIDR ranges, such as carrier-grade
+	// NAT ranges, in which each client IP address may be shared by many
+	// users. Clients with shared IP addresses are exempt from per-IP
+	// limits, currently the meek rate limiter. In tunnel logs, these clients
+	// are flagged with shared_ip_address, so that metrics may count users
+	// by session rather than by IP address; and load stats include a
+	// shared_ip_address_clients count. To prevent a misconfiguration from
+	// exempting all clients, ranges broader than
+	// SHARED_IP_ADDRESS_RANGE_MIN_PREFIX_LENGTH_IPV4/IPV6 are invalid.
+	SharedIPAddressRanges []string
+
+	// MeekMaxRequestBodyLength is the maximum permitted length, in bytes, of
+	// a meek request body. Requests with a larger body are rejected and the
+	// connection is terminated. The limit must allow for a maximum length
+	// request payload, MEEK_MAX_REQUEST_PAYLOAD_LENGTH. A default of
+	// MEEK_DEFAULT_MAX_REQUEST_BODY_LENGTH is used when
+	// MeekMaxRequestBodyLength is 0.
+	MeekMaxRequestBodyLength int
+
 	// MeekCachedResponseBufferSize is the size of a private,
 	// fixed-size buffer allocated for every meek client. The buffer
 	// is used to cache response payload, allowing the client to retry
@@ -219,6 +357,29 @@ type Config struct {
 	// is 0.
 	MeekCachedResponsePoolBufferCount int
 
+	// MeekServerCertificatePoolSize specifies the number of self-signed
+	// certificates the unfronted HTTPS meek server presents. Each
+	// certificate is independently generated, and a certificate is selected
+	// for each connection, by SNI server name when it matches a certificate
+	// or else by client IP address. The default, 0, is a single certificate.
+	MeekServerCertificatePoolSize int
+
+	// MeekServerCertificateRotationPeriodSeconds specifies how often one
+	// certificate in the unfronted HTTPS meek certificate pool is replaced
+	// with a newly generated certificate. The default, 0, is no rotation.
+	MeekServerCertificateRotationPeriodSeconds int
+
+	// MeekServerProtocolCertificates specifies, per meek HTTPS tunnel
+	// protocol, the certificates the server presents for that protocol,
+	// overriding MeekServerCertificatePoolSize and
+	// MeekServerCertificateRotationPeriodSeconds. Each protocol listener
+	// always has its own certificate pool, and generated certificates are
+	// never shared between protocols; MeekServerProtocolCertificates allows
+	// for distinct pool sizes and rotation periods, and for
+	// operator-provided certificates, per protocol, so that protocols run
+	// on the same host present unrelated TLS identities.
+	MeekServerProtocolCertificates map[string]MeekServerCertificatesConfig
+
 	// UDPInterceptUdpgwServerAddress specifies the network address of
 	// a udpgw server which clients may be port forwarding to. When
 	// specified, these TCP port forwards are intercepted and handled
@@ -244,6 +405,123 @@ type Config struct {
 	// The default, 0, disables load logging.
 	LoadMonitorPeriodSeconds int
 
+	// LoadMonitorPeriodJitter is the fraction of LoadMonitorPeriodSeconds,
+	// from 0.0 to 1.0, by which each server load log is randomly offset
+	// within its period. Jitter desynchronizes the load reports of servers
+	// which were started at the same time. Exactly one load log is emitted
+	// per period, so jitter does not change the reporting rate. The
+	// default, 0.0, emits load logs at fixed intervals.
+	LoadMonitorPeriodJitter float64
+
+	// TunnelAuthHookURL is the URL of an optional deployment-specific
+	// tunnel authorization service. When set, each client that passes SSH
+	// password authentication is authorized by the service, which may deny
+	// the tunnel or specify a per-session policy. See TunnelAuthHook. The
+	// default, "", disables the hook.
+	TunnelAuthHookURL string
+
+	// TunnelAuthHookTimeoutMilliseconds specifies the maximum time to wait
+	// for the tunnel authorization service. The default, 0, uses
+	// TUNNEL_AUTH_HOOK_DEFAULT_TIMEOUT.
+	TunnelAuthHookTimeoutMilliseconds int
+
+	// TunnelAuthHookAllowOnError specifies whether to allow tunnels when the
+	// tunnel authorization service fails or times out. The default, false,
+	// denies tunnels in this case.
+	TunnelAuthHookAllowOnError bool
+
+	// ProbeMirrorURL is the URL of an optional analyzer endpoint to which a
+	// sample of suspected active probes, connections which fail the
+	// obfuscated SSH seed message check, are mirrored for study. Probes are
+	// still denied. See ProbeMirror. The default, "", disables mirroring.
+	ProbeMirrorURL string
+
+	// ProbeMirrorSampleRate is the fraction, from 0.0 to 1.0, of suspected
+	// probes to mirror to ProbeMirrorURL. The default, 0.0, disables
+	// mirroring.
+	ProbeMirrorSampleRate float64
+
+	// PortForwardResolverProtocol specifies the protocol used to resolve the
+	// destination hostnames of client TCP port forwards: "dns", "dot" (DNS
+	// over TLS), or "doh" (DNS over HTTPS). See PortForwardResolver. The
+	// default, "", resolves destinations using the system resolver.
+	PortForwardResolverProtocol string
+
+	// PortForwardResolverAddresses specifies the resolvers to query. For
+	// "dns" and "dot", each address is a host:port network address; for
+	// "doh", each address is a resolver URL, such as
+	// "https://1.1.1.1/dns-query".
+	PortForwardResolverAddresses []string
+
+	// PortForwardResolverTLSServerName is the server name used to verify
+	// the "dot" and "doh" resolver certificates. Required for "dot".
+	PortForwardResolverTLSServerName string
+
+	// PortForwardResolverMaxCacheTTLSeconds caps the time resolved addresses
+	// are cached. The default, 0, uses PORT_FORWARD_RESOLVER_MAX_CACHE_TTL,
+	// and a negative value disables caching.
+	PortForwardResolverMaxCacheTTLSeconds int
+
+	// OTLPEndpoint is the base URL of an OpenTelemetry collector OTLP/HTTP
+	// receiver, such as "http://127.0.0.1:4318". When set, tunnel
+	// establishment traces and, when the load monitor is running, server
+	// load metrics are exported to the collector. The default, "", disables
+	// OTLP export.
+	OTLPEndpoint string
+
+	// ManagementServerAddress is the TCP address, "<host>:<port>", on which
+	// the management server, which serves the "/health" and "/metrics"
+	// operational endpoints, listens. The management server requires mutual
+	// TLS: ManagementServerCertificate, ManagementServerPrivateKey, and
+	// ManagementClientCACertificates are required when
+	// ManagementServerAddress is set. The default, "", disables the
+	// management server.
+	ManagementServerAddress string
+
+	// ManagementServerCertificate and ManagementServerPrivateKey are the
+	// PEM-encoded certificate and private key the management server uses to
+	// authenticate itself to management clients.
+	ManagementServerCertificate string
+	ManagementServerPrivateKey  string
+
+	// ManagementClientCACertificates are one or more PEM-encoded CA
+	// certificates. Management clients must present a client certificate
+	// issued by one of these CAs; connections from clients without a valid
+	// client certificate are rejected during the TLS handshake.
+	ManagementClientCACertificates string
+
+	// FlowCollectorAddress is the UDP address, "<host>:<port>", of an
+	// optional IPFIX collector to which flow records for completed port
+	// forwards are exported for abuse analysis. See FlowExporter. The
+	// default, "", disables flow export.
+	FlowCollectorAddress string
+
+	// FlowRecordSampleRate is the fraction, from 0.0 to 1.0, of completed
+	// port forwards for which flow records are exported. The default, 0.0,
+	// disables flow export.
+	FlowRecordSampleRate float64
+
+	// FlowRecordDestinationAnonymization specifies how port forward
+	// destinations are anonymized in flow records: "truncate" truncates
+	// destination IP addresses to /24 for IPv4 and /48 for IPv6; "omit"
+	// omits the destination IP address and port. The default, "", exports
+	// the full destination.
+	FlowRecordDestinationAnonymization string
+
+	// FlowRecordEnterpriseNumber is the IANA private enterprise number used
+	// for the enterprise-specific client GeoIP and tunnel protocol
+	// information elements in flow records. Required when
+	// FlowCollectorAddress is set.
+	FlowRecordEnterpriseNumber uint32
+
+	// MigrationHintDeadlineSeconds specifies the drain deadline sent, in a
+	// migration hint, to all connected clients when the server is signaled
+	// with SIGTSTP to stop establishing new tunnels. Clients that support
+	// server requests will establish a replacement tunnel, preferring the
+	// alternate servers included in the hint, before the deadline.
+	// The default, 0, disables migration hints.
+	MigrationHintDeadlineSeconds int
+
 	// ProcessProfileOutputDirectory is the path of a directory to which
 	// process profiles will be written when signaled with SIGUSR2. The
 	// files are overwritten on each invocation. When set to the default
@@ -267,6 +545,28 @@ type Config struct {
 	// OSL Config, the OSL schemes to apply to Psiphon client tunnels.
 	OSLConfigFilename string
 
+	// EnablePortForwardCompression specifies whether to accept compressed
+	// port forwards, which clients may open when this support is indicated
+	// in the handshake response. Port forward data is compressed using
+	// common.CompressedConn. Compression is off by default due to the
+	// security tradeoffs; see common.CompressedConn.
+	EnablePortForwardCompression bool
+
+	// EnableBandwidthTest specifies whether to accept bandwidth test
+	// channels, which clients may open when this support is indicated in
+	// the handshake response. Bandwidth tests are off by default.
+	EnableBandwidthTest bool
+
+	// BandwidthTestMaxBytes specifies the maximum number of bytes in each
+	// direction of a bandwidth test. The default, 0, uses
+	// BANDWIDTH_TEST_DEFAULT_MAX_BYTES.
+	BandwidthTestMaxBytes int
+
+	// BandwidthTestMinIntervalSeconds specifies the minimum time between
+	// the starts of bandwidth tests by a client. The default, 0, uses
+	// BANDWIDTH_TEST_DEFAULT_MIN_INTERVAL.
+	BandwidthTestMinIntervalSeconds int
+
 	// RunPacketTunnel specifies whether to run a packet tunnel.
 	RunPacketTunnel bool
 
@@ -295,6 +595,158 @@ type Config struct {
 	// The default, 0 is no limit.
 	MaxConcurrentSSHHandshakes int
 
+	// MaxConcurrentOutboundDials specifies a limit on the number of
+	// concurrent outbound TCP port forward dials, across all clients. This
+	// smooths bursts of port forwards which may otherwise open outbound
+	// connections faster than destinations or upstream NATs can handle.
+	// When the limit is reached, additional dials wait in a queue for up to
+	// OutboundDialQueueTimeoutMilliseconds, and then the port forward is
+	// rejected. The per-client limit is the MaxTCPDialingPortForwardCount
+	// traffic rule.
+	// The default, 0 is no limit.
+	MaxConcurrentOutboundDials int
+
+	// OutboundDialQueueTimeoutMilliseconds specifies the maximum time a dial
+	// waits for MaxConcurrentOutboundDials. The wait counts towards the port
+	// forward dial timeout. The default, 0, uses
+	// OUTBOUND_DIAL_DEFAULT_QUEUE_TIMEOUT.
+	OutboundDialQueueTimeoutMilliseconds int
+
+	// SlowOperationThresholdsMilliseconds specifies, for each operation in
+	// SupportedSlowOperations, a duration threshold above which a
+	// "slow operation" event is logged, with the operation and its
+	// duration. Operations without a threshold are not logged. The default,
+	// nil, logs no slow operations.
+	SlowOperationThresholdsMilliseconds map[string]int
+
+	// MaxEstablishedClients specifies a limit on the number of concurrently
+	// established clients. When the limit is reached, new client connections
+	// are handled according to OverloadSheddingPolicy. As the limit is
+	// checked before the SSH handshake, concurrent handshakes may briefly
+	// exceed the limit by up to MaxConcurrentSSHHandshakes.
+	// The default, 0 is no limit.
+	MaxEstablishedClients int
+
+	// MemoryHighWatermarkBytes and MemoryLowWatermarkBytes specify an optional
+	// memory limit, checked periodically against the Go runtime heap
+	// allocation. When the heap allocation exceeds the high watermark, the
+	// server is overloaded and new client connections are closed, before
+	// the SSH handshake, until the heap allocation drops below the low
+	// watermark.
+	// When OverloadSheddingPolicy is OVERLOAD_SHEDDING_POLICY_SHED_IDLE, idle
+	// clients are also disconnected while overloaded.
+	// When MemoryLowWatermarkBytes is 0, MemoryHighWatermarkBytes is used.
+	// The default, 0 is no memory limit.
+	MemoryHighWatermarkBytes uint64
+	MemoryLowWatermarkBytes  uint64
+
+	// SessionCacheMaxEntries specifies an optional limit on the number of
+	// entries in each of the GeoIP and OSL session caches, which retain
+	// per-session state. When the limit is reached, the least recently
+	// used entry is evicted. While memory overloaded, the session caches
+	// are shrunk before any idle clients are shed.
+	// The default, 0 is no limit.
+	SessionCacheMaxEntries int
+
+	// OverloadSheddingPolicy specifies how to handle new client connections
+	// when MaxEstablishedClients is reached. With the default,
+	// OVERLOAD_SHEDDING_POLICY_REJECT, new client connections are closed
+	// pre-handshake. With OVERLOAD_SHEDDING_POLICY_SHED_IDLE, the least
+	// recently active established client, if idle for at least
+	// OVERLOAD_SHED_MIN_IDLE_TIME, is disconnected to admit the new client;
+	// when no established client is idle, the new connection is closed.
+	OverloadSheddingPolicy string
+
+	// UnrecognizedConnectionBehavior specifies how to handle client
+	// connections which fail to send a recognized tunnel protocol: those
+	// which fail the obfuscated SSH seed message check, or which neither
+	// complete recognition nor disconnect within the recognition timeout.
+	// Such connections are typically port scanners, probes, or stuck
+	// clients. With the default, UNRECOGNIZED_CONNECTION_BEHAVIOR_CLOSE,
+	// the connection is closed. With UNRECOGNIZED_CONNECTION_BEHAVIOR_TARPIT,
+	// the connection is held open, without any response, for
+	// UnrecognizedConnectionTarpitSeconds and then closed, which slows
+	// scanners. With UNRECOGNIZED_CONNECTION_BEHAVIOR_DECOY,
+	// UnrecognizedConnectionDecoyResponse is sent and the connection is
+	// closed. Meek, QUIC, Marionette, and TapDance connections are always
+	// closed.
+	UnrecognizedConnectionBehavior string
+
+	// UnrecognizedConnectionTimeoutMilliseconds specifies the time allowed
+	// for a connection to be recognized, after which it's handled according
+	// to UnrecognizedConnectionBehavior. The default, 0, allows up to the
+	// SSH handshake timeout.
+	UnrecognizedConnectionTimeoutMilliseconds int
+
+	// UnrecognizedConnectionTarpitSeconds specifies how long tarpitted
+	// connections are held open. The default, 0, is
+	// UNRECOGNIZED_CONNECTION_DEFAULT_TARPIT_DURATION. The maximum is
+	// UNRECOGNIZED_CONNECTION_MAX_TARPIT_DURATION.
+	UnrecognizedConnectionTarpitSeconds int
+
+	// UnrecognizedConnectionMaxTarpitConnections specifies the maximum
+	// number of concurrently tarpitted connections. When the limit is
+	// reached, unrecognized connections are closed. The default, 0, is
+	// UNRECOGNIZED_CONNECTION_DEFAULT_MAX_TARPIT_CONNS.
+	UnrecognizedConnectionMaxTarpitConnections int
+
+	// UnrecognizedConnectionDecoyResponse is the response sent with
+	// UNRECOGNIZED_CONNECTION_BEHAVIOR_DECOY; for example, a plausible HTTP
+	// error response. The response is limited to
+	// UNRECOGNIZED_CONNECTION_MAX_DECOY_RESPONSE_SIZE bytes.
+	UnrecognizedConnectionDecoyResponse string
+
+	// WarmUpPeriodSeconds specifies an optional warm-up period for a newly
+	// started server, which prevents the server from being overwhelmed
+	// when it's first advertised. During the warm-up period, the
+	// MaxEstablishedClients limit is ramped linearly from
+	// WarmUpInitialCapacityPercent to the full limit; new client connections
+	// in excess of the ramped limit are closed pre-handshake, and idle
+	// clients are not shed. The server load reported to clients is at least
+	// SERVER_LOAD_MEDIUM while warming up, so that clients prefer other
+	// servers. WarmUpPeriodSeconds requires MaxEstablishedClients.
+	// The default, 0, is no warm-up period.
+	WarmUpPeriodSeconds int
+
+	// WarmUpInitialCapacityPercent specifies the percentage of
+	// MaxEstablishedClients admitted at the start of the warm-up period.
+	// At least one client is always admitted.
+	WarmUpInitialCapacityPercent int
+
+	// ListenBacklog specifies the kernel accept backlog for TCP tunnel
+	// protocol listeners, including meek listeners. Connections in excess
+	// of the backlog are refused or dropped by the kernel. ListenBacklog is
+	// supported only on Linux.
+	// The default, 0, is the system default, SOMAXCONN.
+	ListenBacklog int
+
+	// TCPFastOpenQueueLength, when > 0, enables TCP Fast Open on TCP tunnel
+	// protocol listeners, including meek listeners, with the specified
+	// maximum queue length of pending TCP Fast Open requests. TCP Fast Open
+	// is supported only on Linux, and server TCP Fast Open must also be
+	// enabled by the net.ipv4.tcp_fastopen sysctl. Clients attempt TCP Fast
+	// Open according to the TCPFastOpenProbability tactics parameter.
+	TCPFastOpenQueueLength int
+
+	// TunnelProtocolTCPMaxSegmentSizes specifies, per tunnel protocol, a
+	// TCP MSS clamp, TCP_MAXSEG, applied to the TCP tunnel protocol
+	// listener, including meek listeners. The clamp limits the MSS
+	// advertised to clients and the size of segments sent by the server,
+	// avoiding stalls on paths where oversized segments are dropped and
+	// path MTU discovery is broken. The MSS clamp is supported only on
+	// Linux; where the clamp cannot be applied, a warning is logged and the
+	// listener runs without it.
+	TunnelProtocolTCPMaxSegmentSizes map[string]int
+
+	// AcceptQueues specifies, per tunnel protocol, an application-level
+	// accept queue. A tunnel protocol accept queue limits the number of
+	// client connections that have been accepted but have not yet completed
+	// the SSH handshake. When the queue is full, new client connections are
+	// handled according to the queue's OverflowPolicy. Accept queue overflow
+	// counts are reported in the server load log.
+	// The default, for protocols not in AcceptQueues, is no limit.
+	AcceptQueues map[string]AcceptQueueConfig
+
 	// PeriodicGarbageCollectionSeconds turns on periodic calls to runtime.GC,
 	// every specified number of seconds, to force garbage collection.
 	// The default, 0 is off.
@@ -315,6 +767,114 @@ type Config struct {
 	// MARIONETTE-OSSH tunnel protocol. The format specifies the network
 	// protocol port to listen on.
 	MarionetteFormat string
+
+	egressIPAddress         string
+	sharedIPAddressNetworks []*net.IPNet
+}
+
+// detectEgressIPAddress returns the local address of the host's default
+// route, which is the source address of outbound traffic. A UDP "connection"
+// selects the route without sending any packets. Private, loopback, and
+// link-local addresses, as seen behind NAT, are not public egress IP
+// addresses and are not returned.
+func detectEgressIPAddress() string {
+
+	conn, err := net.Dial("udp", "8.8.8.8:53")
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return ""
+	}
+
+	IP := localAddr.IP
+	if !IP.IsGlobalUnicast() || IP.IsPrivate() {
+		return ""
+	}
+
+	return IP.String()
+}
+
+// parseSharedIPAddressRanges parses and checks SharedIPAddressRanges.
+func parseSharedIPAddressRanges(ranges []string) ([]*net.IPNet, error) {
+
+	networks := make([]*net.IPNet, 0, len(ranges))
+
+	for _, CIDR := range ranges {
+
+		_, network, err := net.ParseCIDR(CIDR)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		minPrefixLength := SHARED_IP_ADDRESS_RANGE_MIN_PREFIX_LENGTH_IPV6
+		if network.IP.To4() != nil {
+			minPrefixLength = SHARED_IP_ADDRESS_RANGE_MIN_PREFIX_LENGTH_IPV4
+		}
+		prefixLength, _ := network.Mask.Size()
+		if prefixLength < minPrefixLength {
+			return nil, common.ContextError(
+				fmt.Errorf("shared IP address range is too broad: %s", CIDR))
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// AcceptQueueConfig specifies an accept queue for a tunnel protocol.
+type AcceptQueueConfig struct {
+
+	// Depth is the maximum number of client connections in the queue.
+	Depth int
+
+	// OverflowPolicy specifies how to handle a new client connection when
+	// the queue is full. With the default, ACCEPT_QUEUE_OVERFLOW_POLICY_REJECT,
+	// the connection is closed immediately. With
+	// ACCEPT_QUEUE_OVERFLOW_POLICY_WAIT, the connection waits for up to
+	// OverflowWaitMilliseconds for room in the queue, and is closed if the
+	// queue remains full.
+	OverflowPolicy string
+
+	// OverflowWaitMilliseconds is the maximum wait time for the
+	// ACCEPT_QUEUE_OVERFLOW_POLICY_WAIT overflow policy.
+	OverflowWaitMilliseconds int
+}
+
+// MeekServerCertificatesConfig specifies the certificates presented by a
+// meek HTTPS tunnel protocol.
+type MeekServerCertificatesConfig struct {
+
+	// PoolSize is the number of generated certificates in the pool, as in
+	// MeekServerCertificatePoolSize. PoolSize may be 0 when Certificates
+	// are specified.
+	PoolSize int
+
+	// RotationPeriodSeconds specifies how often one generated certificate
+	// in the pool is replaced, as in
+	// MeekServerCertificateRotationPeriodSeconds. Provided Certificates are
+	// not rotated.
+	RotationPeriodSeconds int
+
+	// Certificates are operator-provided certificates, which are presented
+	// along with any generated certificates.
+	Certificates []MeekServerCertificateConfig
+}
+
+// MeekServerCertificateConfig specifies an operator-provided certificate.
+type MeekServerCertificateConfig struct {
+
+	// Certificate and PrivateKey are the PEM encoded certificate and key.
+	Certificate string
+	PrivateKey  string
+
+	// ALPNProtocols, when set, limits the certificate to clients which
+	// offer one of the specified ALPN protocols.
+	ALPNProtocols []string
 }
 
 // RunWebServer indicates whether to run a web server component.
@@ -327,11 +887,97 @@ func (config *Config) RunLoadMonitor() bool {
 	return config.LoadMonitorPeriodSeconds > 0
 }
 
+// GetEgressIPAddress returns the configured or detected server egress IP
+// address, or "" when no public egress IP address is known.
+func (config *Config) GetEgressIPAddress() string {
+	return config.egressIPAddress
+}
+
+// IsSharedIPAddress indicates whether the client IP address is in one of
+// the SharedIPAddressRanges. Invalid IP addresses are not shared.
+func (config *Config) IsSharedIPAddress(IPAddress string) bool {
+	if len(config.sharedIPAddressNetworks) == 0 {
+		return false
+	}
+	IP := net.ParseIP(IPAddress)
+	if IP == nil {
+		return false
+	}
+	for _, network := range config.sharedIPAddressNetworks {
+		if network.Contains(IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunTunnelAuthHook indicates whether to authorize tunnels with a tunnel
+// authorization service.
+func (config *Config) RunTunnelAuthHook() bool {
+	return config.TunnelAuthHookURL != ""
+}
+
+// RunProbeMirror indicates whether to mirror suspected active probes to an
+// analyzer endpoint.
+func (config *Config) RunProbeMirror() bool {
+	return config.ProbeMirrorURL != "" && config.ProbeMirrorSampleRate > 0.0
+}
+
+// RunPortForwardResolver indicates whether to resolve port forward
+// destinations using the configured resolver instead of the system
+// resolver.
+func (config *Config) RunPortForwardResolver() bool {
+	return config.PortForwardResolverProtocol != ""
+}
+
+// RunFlowExporter indicates whether to export port forward flow records to
+// an IPFIX collector.
+func (config *Config) RunFlowExporter() bool {
+	return config.FlowCollectorAddress != "" && config.FlowRecordSampleRate > 0.0
+}
+
+// RunConnectionEventLogger indicates whether to write structured
+// connection events to ConnectionEventLogFilename.
+func (config *Config) RunConnectionEventLogger() bool {
+	return config.ConnectionEventLogFilename != ""
+}
+
+// RunManagementServer indicates whether to run the management server.
+func (config *Config) RunManagementServer() bool {
+	return config.ManagementServerAddress != ""
+}
+
+// RunOTLPExporter indicates whether to export metrics and traces to an
+// OpenTelemetry collector.
+func (config *Config) RunOTLPExporter() bool {
+	return config.OTLPEndpoint != ""
+}
+
+// RunMemoryMonitor indicates whether to monitor memory usage for overload.
+func (config *Config) RunMemoryMonitor() bool {
+	return config.MemoryHighWatermarkBytes > 0
+}
+
+// SendMigrationHints indicates whether to send migration hints to clients
+// when the server stops establishing new tunnels.
+func (config *Config) SendMigrationHints() bool {
+	return config.MigrationHintDeadlineSeconds > 0
+}
+
 // RunPeriodicGarbageCollection indicates whether to run periodic garbage collection.
 func (config *Config) RunPeriodicGarbageCollection() bool {
 	return config.PeriodicGarbageCollectionSeconds > 0
 }
 
+// GetObfuscatedSSHKey returns the Obfuscated SSH secret key to use for the
+// specified tunnel protocol.
+func (config *Config) GetObfuscatedSSHKey(tunnelProtocol string) string {
+	if key, ok := config.ObfuscatedSSHKeys[tunnelProtocol]; ok {
+		return key
+	}
+	return config.ObfuscatedSSHKey
+}
+
 // LoadConfig loads and validates a JSON encoded server config.
 func LoadConfig(configJSON []byte) (*Config, error) {
 
@@ -341,91 +987,472 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		return nil, common.ContextError(err)
 	}
 
+	problems := validateConfig(&config)
+	if len(problems) > 0 {
+		return nil, problems[0]
+	}
+
+	if config.EgressIPAddress != "" {
+		config.egressIPAddress = config.EgressIPAddress
+	} else {
+		config.egressIPAddress = detectEgressIPAddress()
+	}
+
+	// SharedIPAddressRanges is checked in validateConfig.
+	config.sharedIPAddressNetworks, _ = parseSharedIPAddressRanges(
+		config.SharedIPAddressRanges)
+
+	return &config, nil
+}
+
+// ValidateConfig checks the server config in the specified file, along with
+// the traffic rules, OSL, and tactics config files it references, without
+// starting any server components. All problems found are returned, rather
+// than only the first. An empty result indicates a valid config.
+//
+// The checks are those made at startup, by LoadConfig and in loading the
+// referenced config files. No listeners are bound and the psinet database
+// and GeoIP databases are not loaded.
+func ValidateConfig(configFilename string) []error {
+
+	configJSON, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		return []error{common.ContextError(err)}
+	}
+
+	var config Config
+	err = json.Unmarshal(configJSON, &config)
+	if err != nil {
+		return []error{common.ContextError(err)}
+	}
+
+	problems := validateConfig(&config)
+
+	_, err = NewTrafficRulesSet(config.TrafficRulesFilename)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("TrafficRulesFilename is invalid: %s", err))
+	}
+
+	_, err = osl.NewConfig(config.OSLConfigFilename)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("OSLConfigFilename is invalid: %s", err))
+	}
+
+	_, err = tactics.NewServer(
+		CommonLogger(log),
+		getTacticsAPIParameterLogFieldFormatter(),
+		getTacticsAPIParameterValidator(&config),
+		config.TacticsConfigFilename)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("TacticsConfigFilename is invalid: %s", err))
+	}
+
+	return problems
+}
+
+// validateConfig checks config and returns all problems found. Checks
+// include parsing the keys and certificates used by the server components.
+func validateConfig(config *Config) []error {
+
+	var problems []error
+
 	if config.ServerIPAddress == "" {
-		return nil, errors.New("ServerIPAddress is required")
+		problems = append(problems, errors.New("ServerIPAddress is required"))
 	}
 
-	if config.WebServerPort > 0 && (config.WebServerSecret == "" || config.WebServerCertificate == "" ||
-		config.WebServerPrivateKey == "") {
+	if config.EgressIPAddress != "" && net.ParseIP(config.EgressIPAddress) == nil {
+		problems = append(problems, errors.New("invalid EgressIPAddress"))
+	}
+
+	if config.WebServerPort > 0 {
+		if config.WebServerSecret == "" || config.WebServerCertificate == "" ||
+			config.WebServerPrivateKey == "" {
+
+			problems = append(problems, errors.New(
+				"Web server requires WebServerSecret, WebServerCertificate, WebServerPrivateKey"))
 
-		return nil, errors.New(
-			"Web server requires WebServerSecret, WebServerCertificate, WebServerPrivateKey")
+		} else {
+
+			_, err := tris.X509KeyPair(
+				[]byte(config.WebServerCertificate),
+				[]byte(config.WebServerPrivateKey))
+			if err != nil {
+				problems = append(problems, fmt.Errorf(
+					"WebServerCertificate or WebServerPrivateKey is invalid: %s", err))
+			}
+		}
 	}
 
 	if config.WebServerPortForwardAddress != "" {
 		if err := validateNetworkAddress(config.WebServerPortForwardAddress, false); err != nil {
-			return nil, errors.New("WebServerPortForwardAddress is invalid")
+			problems = append(problems, errors.New("WebServerPortForwardAddress is invalid"))
 		}
 	}
 
 	if config.WebServerPortForwardRedirectAddress != "" {
 
 		if config.WebServerPortForwardAddress == "" {
-			return nil, errors.New(
-				"WebServerPortForwardRedirectAddress requires WebServerPortForwardAddress")
+			problems = append(problems, errors.New(
+				"WebServerPortForwardRedirectAddress requires WebServerPortForwardAddress"))
 		}
 
 		if err := validateNetworkAddress(config.WebServerPortForwardRedirectAddress, false); err != nil {
-			return nil, errors.New("WebServerPortForwardRedirectAddress is invalid")
+			problems = append(problems, errors.New("WebServerPortForwardRedirectAddress is invalid"))
+		}
+	}
+
+	if config.SSHPrivateKey != "" {
+		if _, err := ssh.ParseRawPrivateKey([]byte(config.SSHPrivateKey)); err != nil {
+			problems = append(problems, fmt.Errorf("SSHPrivateKey is invalid: %s", err))
 		}
 	}
 
-	for tunnelProtocol, port := range config.TunnelProtocolPorts {
+	if config.MeekCookieEncryptionPrivateKey != "" {
+		privateKey, err := base64.StdEncoding.DecodeString(config.MeekCookieEncryptionPrivateKey)
+		if err != nil || len(privateKey) != 32 {
+			problems = append(problems, errors.New("MeekCookieEncryptionPrivateKey is invalid"))
+		}
+	}
+
+	// Listening ports must not overlap. As in GenerateConfig, this includes
+	// QUIC ports.
+
+	usedPorts := make(map[int]string)
+
+	if config.WebServerPort > 0 {
+		usedPorts[config.WebServerPort] = "web server"
+	}
+
+	// Tunnel protocols are checked in sorted order, so that results are
+	// deterministic.
+	var tunnelProtocols []string
+	for tunnelProtocol := range config.TunnelProtocolPorts {
+		tunnelProtocols = append(tunnelProtocols, tunnelProtocol)
+	}
+	sort.Strings(tunnelProtocols)
+
+	for _, tunnelProtocol := range tunnelProtocols {
+		port := config.TunnelProtocolPorts[tunnelProtocol]
 		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
-			return nil, fmt.Errorf("Unsupported tunnel protocol: %s", tunnelProtocol)
+			problems = append(problems, fmt.Errorf("Unsupported tunnel protocol: %s", tunnelProtocol))
+			continue
 		}
 		if protocol.TunnelProtocolUsesSSH(tunnelProtocol) ||
 			protocol.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
 			if config.SSHPrivateKey == "" || config.SSHServerVersion == "" ||
 				config.SSHUserName == "" || config.SSHPassword == "" {
-				return nil, fmt.Errorf(
+				problems = append(problems, fmt.Errorf(
 					"Tunnel protocol %s requires SSHPrivateKey, SSHServerVersion, SSHUserName, SSHPassword",
-					tunnelProtocol)
+					tunnelProtocol))
 			}
 		}
 		if protocol.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
-			if config.ObfuscatedSSHKey == "" {
-				return nil, fmt.Errorf(
-					"Tunnel protocol %s requires ObfuscatedSSHKey",
-					tunnelProtocol)
+			if config.GetObfuscatedSSHKey(tunnelProtocol) == "" {
+				problems = append(problems, fmt.Errorf(
+					"Tunnel protocol %s requires ObfuscatedSSHKey or ObfuscatedSSHKeys",
+					tunnelProtocol))
 			}
 		}
 		if protocol.TunnelProtocolUsesMeekHTTP(tunnelProtocol) ||
 			protocol.TunnelProtocolUsesMeekHTTPS(tunnelProtocol) {
 			if config.MeekCookieEncryptionPrivateKey == "" || config.MeekObfuscatedKey == "" {
-				return nil, fmt.Errorf(
+				problems = append(problems, fmt.Errorf(
 					"Tunnel protocol %s requires MeekCookieEncryptionPrivateKey, MeekObfuscatedKey",
-					tunnelProtocol)
+					tunnelProtocol))
 			}
 		}
 		if protocol.TunnelProtocolUsesMarionette(tunnelProtocol) {
 			if port != 0 {
-				return nil, fmt.Errorf(
+				problems = append(problems, fmt.Errorf(
 					"Tunnel protocol %s port is specified in format, not TunnelProtocolPorts",
-					tunnelProtocol)
+					tunnelProtocol))
+			}
+			continue
+		}
+		if other, ok := usedPorts[port]; ok {
+			problems = append(problems, fmt.Errorf(
+				"Tunnel protocol %s port %d is also used by %s", tunnelProtocol, port, other))
+		} else {
+			usedPorts[port] = tunnelProtocol
+		}
+	}
+
+	for tunnelProtocol, maxSegmentSize := range config.TunnelProtocolTCPMaxSegmentSizes {
+		if _, ok := config.TunnelProtocolPorts[tunnelProtocol]; !ok ||
+			protocol.TunnelProtocolUsesQUIC(tunnelProtocol) ||
+			protocol.TunnelProtocolUsesMarionette(tunnelProtocol) ||
+			protocol.TunnelProtocolUsesTapdance(tunnelProtocol) {
+			problems = append(problems, fmt.Errorf(
+				"TunnelProtocolTCPMaxSegmentSizes protocol is invalid: %s", tunnelProtocol))
+		}
+		if maxSegmentSize < TCP_MIN_MAX_SEGMENT_SIZE || maxSegmentSize > TCP_MAX_MAX_SEGMENT_SIZE {
+			problems = append(problems, fmt.Errorf(
+				"TunnelProtocolTCPMaxSegmentSizes size is invalid: %d", maxSegmentSize))
+		}
+	}
+
+	if config.LoadMonitorPeriodJitter < 0.0 || config.LoadMonitorPeriodJitter > 1.0 {
+		problems = append(problems, errors.New("LoadMonitorPeriodJitter is invalid"))
+	}
+
+	if config.ProbeMirrorSampleRate < 0.0 || config.ProbeMirrorSampleRate > 1.0 {
+		problems = append(problems, errors.New("ProbeMirrorSampleRate is invalid"))
+	}
+
+	if config.RunPortForwardResolver() {
+
+		switch config.PortForwardResolverProtocol {
+		case PORT_FORWARD_RESOLVER_PROTOCOL_DNS, PORT_FORWARD_RESOLVER_PROTOCOL_DOT:
+			for _, address := range config.PortForwardResolverAddresses {
+				if err := validateNetworkAddress(address, false); err != nil {
+					problems = append(problems, errors.New("PortForwardResolverAddresses is invalid"))
+					break
+				}
+			}
+		case PORT_FORWARD_RESOLVER_PROTOCOL_DOH:
+			for _, address := range config.PortForwardResolverAddresses {
+				if URL, err := url.Parse(address); err != nil || URL.Scheme != "https" || URL.Host == "" {
+					problems = append(problems, errors.New("PortForwardResolverAddresses is invalid"))
+					break
+				}
+			}
+		default:
+			problems = append(problems, errors.New("PortForwardResolverProtocol is invalid"))
+		}
+
+		if len(config.PortForwardResolverAddresses) == 0 {
+			problems = append(problems, errors.New("PortForwardResolverAddresses is missing"))
+		}
+
+		if config.PortForwardResolverProtocol == PORT_FORWARD_RESOLVER_PROTOCOL_DOT &&
+			config.PortForwardResolverTLSServerName == "" {
+			problems = append(problems, errors.New("PortForwardResolverTLSServerName is missing"))
+		}
+	}
+
+	if config.FlowRecordSampleRate < 0.0 || config.FlowRecordSampleRate > 1.0 {
+		problems = append(problems, errors.New("FlowRecordSampleRate is invalid"))
+	}
+
+	switch config.FlowRecordDestinationAnonymization {
+	case FLOW_RECORD_ANONYMIZATION_NONE,
+		FLOW_RECORD_ANONYMIZATION_TRUNCATE,
+		FLOW_RECORD_ANONYMIZATION_OMIT:
+	default:
+		problems = append(problems, errors.New("FlowRecordDestinationAnonymization is invalid"))
+	}
+
+	if config.FlowCollectorAddress != "" && config.FlowRecordEnterpriseNumber == 0 {
+		problems = append(problems, errors.New("FlowRecordEnterpriseNumber is required"))
+	}
+
+	if config.ManagementServerAddress != "" {
+		if config.ManagementServerCertificate == "" ||
+			config.ManagementServerPrivateKey == "" ||
+			config.ManagementClientCACertificates == "" {
+
+			problems = append(problems, errors.New(
+				"ManagementServerCertificate, ManagementServerPrivateKey, and ManagementClientCACertificates are required"))
+
+		} else if !x509.NewCertPool().AppendCertsFromPEM(
+			[]byte(config.ManagementClientCACertificates)) {
+
+			problems = append(problems, errors.New("ManagementClientCACertificates is invalid"))
+		}
+	}
+
+	if config.LogWriterRetryAttempts < 0 || config.LogWriterRetryBackoffMilliseconds < 0 {
+		problems = append(problems, errors.New("invalid log writer retry policy"))
+	}
+
+	if config.BandwidthTestMaxBytes < 0 || config.BandwidthTestMinIntervalSeconds < 0 {
+		problems = append(problems, errors.New("invalid bandwidth test limit"))
+	}
+
+	for operation, threshold := range config.SlowOperationThresholdsMilliseconds {
+		if !common.Contains(SupportedSlowOperations, operation) || threshold < 0 {
+			problems = append(problems, fmt.Errorf(
+				"invalid SlowOperationThresholdsMilliseconds operation: %s", operation))
+		}
+	}
+
+	if config.MeekServerCertificatePoolSize < 0 ||
+		config.MeekServerCertificatePoolSize > MEEK_MAX_CERTIFICATE_POOL_SIZE ||
+		config.MeekServerCertificateRotationPeriodSeconds < 0 {
+
+		problems = append(problems, errors.New("invalid meek server certificate pool"))
+	}
+
+	if config.MeekMaxRequestBodyLength != 0 &&
+		config.MeekMaxRequestBodyLength < MEEK_MAX_REQUEST_PAYLOAD_LENGTH {
+
+		problems = append(problems, errors.New("MeekMaxRequestBodyLength is invalid"))
+	}
+
+	if _, err := parseSharedIPAddressRanges(config.SharedIPAddressRanges); err != nil {
+		problems = append(problems, fmt.Errorf(
+			"invalid SharedIPAddressRanges: %s", err))
+	}
+
+	if config.MeekPathPrefix != "" &&
+		(!strings.HasPrefix(config.MeekPathPrefix, "/") ||
+			strings.HasSuffix(config.MeekPathPrefix, "/")) {
+
+		problems = append(problems, errors.New("MeekPathPrefix is invalid"))
+	}
+
+	for tunnelProtocol, acceptQueue := range config.AcceptQueues {
+		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+			problems = append(problems, fmt.Errorf(
+				"Unsupported AcceptQueues tunnel protocol: %s", tunnelProtocol))
+		}
+		if acceptQueue.Depth <= 0 {
+			problems = append(problems, fmt.Errorf(
+				"AcceptQueues tunnel protocol %s requires Depth", tunnelProtocol))
+		}
+		switch acceptQueue.OverflowPolicy {
+		case "", ACCEPT_QUEUE_OVERFLOW_POLICY_REJECT:
+		case ACCEPT_QUEUE_OVERFLOW_POLICY_WAIT:
+			if acceptQueue.OverflowWaitMilliseconds <= 0 {
+				problems = append(problems, fmt.Errorf(
+					"AcceptQueues tunnel protocol %s requires OverflowWaitMilliseconds",
+					tunnelProtocol))
+			}
+		default:
+			problems = append(problems, fmt.Errorf(
+				"Unsupported AcceptQueues OverflowPolicy: %s", acceptQueue.OverflowPolicy))
+		}
+	}
+
+	for tunnelProtocol, certificates := range config.MeekServerProtocolCertificates {
+		if !protocol.TunnelProtocolUsesMeekHTTPS(tunnelProtocol) {
+			problems = append(problems, fmt.Errorf(
+				"Unsupported MeekServerProtocolCertificates tunnel protocol: %s", tunnelProtocol))
+		}
+		if certificates.PoolSize < 0 ||
+			certificates.PoolSize > MEEK_MAX_CERTIFICATE_POOL_SIZE ||
+			certificates.RotationPeriodSeconds < 0 ||
+			(certificates.PoolSize == 0 && len(certificates.Certificates) == 0) {
+			problems = append(problems, fmt.Errorf(
+				"invalid MeekServerProtocolCertificates pool for tunnel protocol: %s",
+				tunnelProtocol))
+		}
+		for _, certificate := range certificates.Certificates {
+			_, err := makeMeekConfiguredCertificate(certificate)
+			if err != nil {
+				problems = append(problems, fmt.Errorf(
+					"invalid MeekServerProtocolCertificates certificate for tunnel protocol %s: %s",
+					tunnelProtocol, err))
 			}
 		}
 	}
 
+	if config.ObfuscatedSSHMinPadding < 0 ||
+		config.ObfuscatedSSHMinPadding > obfuscator.OBFUSCATE_MAX_PADDING {
+		problems = append(problems, errors.New("invalid ObfuscatedSSHMinPadding"))
+	}
+
+	for _, name := range config.ObfuscatedSSHSeedKeyDerivations {
+		if !obfuscator.IsSeedKeyDerivationRegistered(name) {
+			problems = append(problems, fmt.Errorf(
+				"Unknown ObfuscatedSSHSeedKeyDerivations derivation: %s", name))
+		}
+	}
+
+	for tunnelProtocol := range config.ObfuscatedSSHKeys {
+		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) ||
+			!protocol.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
+			problems = append(problems, fmt.Errorf(
+				"ObfuscatedSSHKeys tunnel protocol %s does not use Obfuscated SSH",
+				tunnelProtocol))
+		}
+	}
+
+	if !common.Contains(
+		[]string{"", OVERLOAD_SHEDDING_POLICY_REJECT, OVERLOAD_SHEDDING_POLICY_SHED_IDLE},
+		config.OverloadSheddingPolicy) {
+
+		problems = append(problems, fmt.Errorf(
+			"Unsupported OverloadSheddingPolicy: %s", config.OverloadSheddingPolicy))
+	}
+
+	if !common.Contains(
+		[]string{
+			"",
+			UNRECOGNIZED_CONNECTION_BEHAVIOR_CLOSE,
+			UNRECOGNIZED_CONNECTION_BEHAVIOR_TARPIT,
+			UNRECOGNIZED_CONNECTION_BEHAVIOR_DECOY},
+		config.UnrecognizedConnectionBehavior) {
+
+		problems = append(problems, fmt.Errorf(
+			"Unsupported UnrecognizedConnectionBehavior: %s", config.UnrecognizedConnectionBehavior))
+	}
+
+	if config.UnrecognizedConnectionTimeoutMilliseconds < 0 ||
+		config.UnrecognizedConnectionTarpitSeconds < 0 ||
+		time.Duration(config.UnrecognizedConnectionTarpitSeconds)*time.Second >
+			UNRECOGNIZED_CONNECTION_MAX_TARPIT_DURATION ||
+		config.UnrecognizedConnectionMaxTarpitConnections < 0 {
+		problems = append(problems, errors.New("invalid unrecognized connection limit"))
+	}
+
+	if config.UnrecognizedConnectionBehavior == UNRECOGNIZED_CONNECTION_BEHAVIOR_DECOY &&
+		(config.UnrecognizedConnectionDecoyResponse == "" ||
+			len(config.UnrecognizedConnectionDecoyResponse) >
+				UNRECOGNIZED_CONNECTION_MAX_DECOY_RESPONSE_SIZE) {
+		problems = append(problems, errors.New("invalid UnrecognizedConnectionDecoyResponse"))
+	}
+
+	if config.MaxConcurrentOutboundDials < 0 ||
+		config.OutboundDialQueueTimeoutMilliseconds < 0 {
+		problems = append(problems, errors.New("invalid outbound dial limit"))
+	}
+
+	if config.WarmUpPeriodSeconds < 0 ||
+		(config.WarmUpPeriodSeconds > 0 && config.MaxEstablishedClients <= 0) {
+		problems = append(problems, errors.New("WarmUpPeriodSeconds requires MaxEstablishedClients"))
+	}
+
+	if config.SSHMaxPacketSize != 0 &&
+		(config.SSHMaxPacketSize < 35000 || config.SSHMaxPacketSize > 256*1024) {
+		problems = append(problems, errors.New("SSHMaxPacketSize is invalid"))
+	}
+
+	if err := config.SSHPreferredAlgorithms.Validate(); err != nil {
+		problems = append(problems, fmt.Errorf("SSHPreferredAlgorithms is invalid: %s", err))
+	}
+
+	if config.WarmUpInitialCapacityPercent < 0 || config.WarmUpInitialCapacityPercent > 100 {
+		problems = append(problems, errors.New("WarmUpInitialCapacityPercent is invalid"))
+	}
+
+	if config.MemoryLowWatermarkBytes > config.MemoryHighWatermarkBytes {
+		problems = append(problems, errors.New("MemoryLowWatermarkBytes exceeds MemoryHighWatermarkBytes"))
+	}
+
+	if config.SessionCacheMaxEntries < 0 {
+		problems = append(problems, errors.New("invalid SessionCacheMaxEntries"))
+	}
+
 	if config.UDPInterceptUdpgwServerAddress != "" {
 		if err := validateNetworkAddress(config.UDPInterceptUdpgwServerAddress, true); err != nil {
-			return nil, fmt.Errorf("UDPInterceptUdpgwServerAddress is invalid: %s", err)
+			problems = append(problems, fmt.Errorf("UDPInterceptUdpgwServerAddress is invalid: %s", err))
 		}
 	}
 
 	if config.DNSResolverIPAddress != "" {
 		if net.ParseIP(config.DNSResolverIPAddress) == nil {
-			return nil, fmt.Errorf("DNSResolverIPAddress is invalid")
+			problems = append(problems, fmt.Errorf("DNSResolverIPAddress is invalid"))
 		}
 	}
 
-	err = accesscontrol.ValidateVerificationKeyRing(&config.AccessControlVerificationKeyRing)
+	err := accesscontrol.ValidateVerificationKeyRing(&config.AccessControlVerificationKeyRing)
 	if err != nil {
-		return nil, fmt.Errorf(
-			"AccessControlVerificationKeyRing is invalid: %s", err)
+		problems = append(problems, fmt.Errorf(
+			"AccessControlVerificationKeyRing is invalid: %s", err))
 	}
 
-	return &config, nil
+	return problems
 }
 
 func validateNetworkAddress(address string, requireIPaddress bool) error {
@@ -462,6 +1489,7 @@ type GenerateConfigParams struct {
 	TacticsConfigFilename       string
 	TacticsRequestPublicKey     string
 	TacticsRequestObfuscatedKey string
+	MeekPathPrefix              string
 }
 
 // GenerateConfig creates a new Psiphon server config. It returns JSON encoded
@@ -577,11 +1605,28 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 
 	// Obfuscated SSH config
 
+	// A distinct key is generated for each protocol which uses Obfuscated
+	// SSH. The shared key is retained for clients which don't support
+	// per-protocol keys, and is used only by the protocols without a
+	// distinct key.
+
 	obfuscatedSSHKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
 	if err != nil {
 		return nil, nil, nil, nil, nil, common.ContextError(err)
 	}
 
+	obfuscatedSSHKeys := make(map[string]string)
+
+	for tunnelProtocol := range params.TunnelProtocolPorts {
+		if protocol.TunnelProtocolUsesObfuscatedSSH(tunnelProtocol) {
+			obfuscatedSSHKeys[tunnelProtocol], err =
+				common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+			if err != nil {
+				return nil, nil, nil, nil, nil, common.ContextError(err)
+			}
+		}
+	}
+
 	// Meek config
 
 	var meekCookieEncryptionPublicKey, meekCookieEncryptionPrivateKey, meekObfuscatedKey string
@@ -637,6 +1682,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		SSHUserName:                    sshUserName,
 		SSHPassword:                    sshPassword,
 		ObfuscatedSSHKey:               obfuscatedSSHKey,
+		ObfuscatedSSHKeys:              obfuscatedSSHKeys,
 		TunnelProtocolPorts:            params.TunnelProtocolPorts,
 		DNSResolverIPAddress:           "8.8.8.8",
 		UDPInterceptUdpgwServerAddress: "127.0.0.1:7300",
@@ -644,6 +1690,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		MeekObfuscatedKey:              meekObfuscatedKey,
 		MeekProhibitedHeaders:          nil,
 		MeekProxyForwardedForHeaders:   []string{"X-Forwarded-For"},
+		MeekPathPrefix:                 params.MeekPathPrefix,
 		LoadMonitorPeriodSeconds:       300,
 		TrafficRulesFilename:           params.TrafficRulesConfigFilename,
 		OSLConfigFilename:              params.OSLConfigFilename,
@@ -793,6 +1840,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		SshObfuscatedPort:             obfuscatedSSHPort,
 		SshObfuscatedQUICPort:         obfuscatedSSHQUICPort,
 		SshObfuscatedKey:              obfuscatedSSHKey,
+		SshObfuscatedKeys:             obfuscatedSSHKeys,
 		Capabilities:                  capabilities,
 		Region:                        "US",
 		MeekServerPort:                meekPort,
@@ -801,6 +1849,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		MeekFrontingHosts:             []string{params.ServerIPAddress},
 		MeekFrontingAddresses:         []string{params.ServerIPAddress},
 		MeekFrontingDisableSNI:        false,
+		MeekPathPrefix:                params.MeekPathPrefix,
 		TacticsRequestPublicKey:       tacticsRequestPublicKey,
 		TacticsRequestObfuscatedKey:   tacticsRequestObfuscatedKey,
 		MarionetteFormat:              params.MarionetteFormat,
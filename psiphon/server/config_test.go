@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-validate-config-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	serverConfigJSON, trafficRulesJSON, oslConfigJSON, _, _, err :=
+		GenerateConfig(&GenerateConfigParams{
+			ServerIPAddress: "127.0.0.1",
+			WebServerPort:   8000,
+			TunnelProtocolPorts: map[string]int{
+				"OSSH":                      4000,
+				"UNFRONTED-MEEK-OSSH":       4001,
+				"QUIC-OSSH":                 4003,
+				"UNFRONTED-MEEK-HTTPS-OSSH": 4002,
+			},
+		})
+	if err != nil {
+		t.Fatalf("GenerateConfig failed: %s", err)
+	}
+
+	var config map[string]interface{}
+	err = json.Unmarshal(serverConfigJSON, &config)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+	oslConfigFilename := filepath.Join(testDataDirName, "osl_config.json")
+	tacticsConfigFilename := filepath.Join(testDataDirName, "tactics_config.json")
+	configFilename := filepath.Join(testDataDirName, "psiphond.config")
+
+	config["TrafficRulesFilename"] = trafficRulesFilename
+	config["OSLConfigFilename"] = oslConfigFilename
+
+	writeFile := func(filename string, data []byte) {
+		err := ioutil.WriteFile(filename, data, 0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	writeConfig := func() {
+		configJSON, err := json.Marshal(config)
+		if err != nil {
+			t.Fatalf("Marshal failed: %s", err)
+		}
+		writeFile(configFilename, configJSON)
+	}
+
+	writeFile(trafficRulesFilename, trafficRulesJSON)
+	writeFile(oslConfigFilename, oslConfigJSON)
+	writeConfig()
+
+	// The generated config is valid.
+
+	problems := ValidateConfig(configFilename)
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	// All problems are reported, not only the first.
+
+	config["TunnelProtocolPorts"] = map[string]int{
+		"OSSH":                4000,
+		"UNFRONTED-MEEK-OSSH": 4000,
+	}
+	config["SSHPrivateKey"] = "invalid"
+	config["WebServerCertificate"] = "invalid"
+	config["TacticsConfigFilename"] = tacticsConfigFilename
+	writeFile(tacticsConfigFilename, []byte(`{"DefaultTactics": {"TTL": "invalid"}}`))
+	writeConfig()
+
+	problems = ValidateConfig(configFilename)
+	if len(problems) != 4 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	// LoadConfig fails with the first problem.
+
+	configJSON, err := ioutil.ReadFile(configFilename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+
+	_, err = LoadConfig(configJSON)
+	if err == nil || err.Error() != problems[0].Error() {
+		t.Fatalf("unexpected LoadConfig error: %v", err)
+	}
+
+	problems = ValidateConfig(filepath.Join(testDataDirName, "missing.config"))
+	if len(problems) != 1 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+}
+
+func TestSharedIPAddressRanges(t *testing.T) {
+
+	testCases := []struct {
+		ranges      []string
+		expectError bool
+	}{
+		{[]string{"100.64.0.0/10", "2001:db8::/48"}, false},
+		{[]string{"invalid"}, true},
+		{[]string{"0.0.0.0/0"}, true},
+		{[]string{"10.0.0.0/7"}, true},
+		{[]string{"::/0"}, true},
+	}
+
+	for _, testCase := range testCases {
+		_, err := parseSharedIPAddressRanges(testCase.ranges)
+		if (err != nil) != testCase.expectError {
+			t.Fatalf("unexpected result for %v: %v", testCase.ranges, err)
+		}
+	}
+
+	config := &Config{}
+	if config.IsSharedIPAddress("100.64.0.1") {
+		t.Fatalf("unexpected shared IP address")
+	}
+
+	config.sharedIPAddressNetworks, _ = parseSharedIPAddressRanges(
+		[]string{"100.64.0.0/10", "2001:db8::/48"})
+
+	for IPAddress, expectShared := range map[string]bool{
+		"100.64.0.1":    true,
+		"100.127.255.1": true,
+		"100.128.0.1":   false,
+		"192.0.2.1":     false,
+		"2001:db8::1":   true,
+		"2001:db9::1":   false,
+		"invalid":       false,
+		"":              false,
+	} {
+		if config.IsSharedIPAddress(IPAddress) != expectShared {
+			t.Fatalf("unexpected result for %s", IPAddress)
+		}
+	}
+}
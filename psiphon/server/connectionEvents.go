@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/Psiphon-Inc/rotate-safe-writer"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	// CONNECTION_EVENT_SCHEMA_VERSION is the version of the ConnectionEvent
+	// schema. The version is incremented whenever a field is removed or the
+	// name, type, or meaning of a field changes. Adding a field doesn't
+	// change the version.
+	CONNECTION_EVENT_SCHEMA_VERSION = 1
+
+	CONNECTION_EVENT_TYPE_TUNNEL = "tunnel"
+
+	CONNECTION_CLOSE_REASON_CLIENT_DISCONNECTED   = "client_disconnected"
+	CONNECTION_CLOSE_REASON_SERVER_SHUTDOWN       = "server_shutdown"
+	CONNECTION_CLOSE_REASON_DUPLICATE_SESSION     = "duplicate_session"
+	CONNECTION_CLOSE_REASON_IDLE_SHED             = "idle_shed"
+	CONNECTION_CLOSE_REASON_AUTHORIZATION_EXPIRED = "authorization_expired"
+	CONNECTION_CLOSE_REASON_UPGRADE_REQUIRED      = "upgrade_required"
+)
+
+// ConnectionEvent is a structured connection event, as written by
+// ConnectionEventLogger. Each event has a stable set of fields, with
+// stable names and types, for ingestion by analytics pipelines; see
+// CONNECTION_EVENT_SCHEMA_VERSION.
+//
+// One "tunnel" event is written for each established tunnel, when the
+// tunnel closes. As with OTLPExporter, no client IP, session ID, or other
+// client-identifying data is included; the client location is limited to
+// the GeoIP country.
+type ConnectionEvent struct {
+	SchemaVersion        int    `json:"schema_version"`
+	EventType            string `json:"event_type"`
+	Timestamp            string `json:"timestamp"`
+	HostID               string `json:"host_id"`
+	TunnelProtocol       string `json:"tunnel_protocol"`
+	ClientRegion         string `json:"client_region"`
+	HandshakeCompleted   bool   `json:"handshake_completed"`
+	StartTime            string `json:"start_time"`
+	DurationMilliseconds int64  `json:"duration_ms"`
+	BytesUp              int64  `json:"bytes_up"`
+	BytesDown            int64  `json:"bytes_down"`
+	CloseReason          string `json:"close_reason"`
+}
+
+// ConnectionEventLogger writes ConnectionEvents to
+// Config.ConnectionEventLogFilename, one JSON object per line. The file
+// may be rotated, as with the main log file.
+//
+// Unlike the main log, a failure to write a connection event is logged as
+// a warning and doesn't panic.
+type ConnectionEventLogger struct {
+	hostID string
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+// NewConnectionEventLogger initializes a new ConnectionEventLogger that
+// writes to Config.ConnectionEventLogFilename.
+func NewConnectionEventLogger(config *Config) (*ConnectionEventLogger, error) {
+
+	writer, err := rotate.NewRotatableFileWriter(config.ConnectionEventLogFilename, 0666)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return newConnectionEventLogger(config.HostID, writer), nil
+}
+
+func newConnectionEventLogger(hostID string, writer io.Writer) *ConnectionEventLogger {
+	return &ConnectionEventLogger{
+		hostID: hostID,
+		writer: writer,
+	}
+}
+
+// LogTunnel writes a "tunnel" event. The schema version, event type,
+// timestamp, and host ID fields are populated by LogTunnel.
+func (logger *ConnectionEventLogger) LogTunnel(event *ConnectionEvent) {
+
+	if logger == nil {
+		return
+	}
+
+	event.SchemaVersion = CONNECTION_EVENT_SCHEMA_VERSION
+	event.EventType = CONNECTION_EVENT_TYPE_TUNNEL
+	event.Timestamp = common.GetCurrentTimestamp()
+	event.HostID = logger.hostID
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("marshal connection event failed")
+		return
+	}
+	line = append(line, '\n')
+
+	logger.mutex.Lock()
+	_, err = logger.writer.Write(line)
+	logger.mutex.Unlock()
+
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("write connection event failed")
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestConnectionEventLogger(t *testing.T) {
+
+	var buffer bytes.Buffer
+
+	logger := newConnectionEventLogger("test-host-id", &buffer)
+
+	for i := 0; i < 2; i++ {
+		logger.LogTunnel(&ConnectionEvent{
+			TunnelProtocol:       "OSSH",
+			ClientRegion:         "CA",
+			HandshakeCompleted:   true,
+			StartTime:            "2018-01-01T00:00:00Z",
+			DurationMilliseconds: 1000,
+			BytesUp:              1,
+			BytesDown:            2,
+			CloseReason:          CONNECTION_CLOSE_REASON_CLIENT_DISCONNECTED,
+		})
+	}
+
+	// A nil logger, as when connection event logging is disabled, has no
+	// effect.
+
+	var nilLogger *ConnectionEventLogger
+	nilLogger.LogTunnel(&ConnectionEvent{})
+
+	lines := bytes.Split(bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("unexpected line count: %d", len(lines))
+	}
+
+	// The schema is stable: check the exact set of field names.
+
+	expectedFields := []string{
+		"bytes_down",
+		"bytes_up",
+		"client_region",
+		"close_reason",
+		"duration_ms",
+		"event_type",
+		"handshake_completed",
+		"host_id",
+		"schema_version",
+		"start_time",
+		"timestamp",
+		"tunnel_protocol",
+	}
+
+	for _, line := range lines {
+
+		var fields map[string]interface{}
+		err := json.Unmarshal(line, &fields)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, expectedFields) {
+			t.Fatalf("unexpected fields: %v", names)
+		}
+
+		var event ConnectionEvent
+		err = json.Unmarshal(line, &event)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+
+		if event.SchemaVersion != CONNECTION_EVENT_SCHEMA_VERSION ||
+			event.EventType != CONNECTION_EVENT_TYPE_TUNNEL ||
+			event.HostID != "test-host-id" ||
+			event.Timestamp == "" ||
+			event.BytesDown != 2 {
+
+			t.Fatalf("unexpected event: %+v", event)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// observedParametersSource is implemented by client conns which record
+// transport parameters observed by the server, for comparison with the
+// intended parameters reported by the client in its handshake. Keys are
+// handshake request param names.
+type observedParametersSource interface {
+	GetObservedParameters() map[string]string
+}
+
+// getDowngradeMismatches compares the intended parameters reported by the
+// client in its handshake, params, with the tunnel protocol determined by
+// the server and any observed transport parameters, and returns the names
+// of mismatched parameters, in sorted order.
+//
+// The handshake is sent within the authenticated SSH channel, so a
+// middlebox can't alter the reported parameters; a mismatch indicates that
+// the client's traffic was altered in transit, for example by redirecting
+// the connection to another protocol's port, or by rewriting the plaintext
+// meek Host header.
+//
+// Parameters not reported by the client, such as by legacy clients, aren't
+// checked. The meek Host header isn't checked for fronted protocols, as the
+// CDN may legitimately rewrite it. The TLS SNI and ALPN protocols aren't
+// checked as TLS, for meek, is terminated before requests are handled.
+func getDowngradeMismatches(
+	tunnelProtocol string,
+	observedParameters map[string]string,
+	params common.APIParameters) []string {
+
+	var mismatches []string
+
+	relayProtocol, err := getStringRequestParam(params, "relay_protocol")
+	if err == nil && relayProtocol != tunnelProtocol {
+		mismatches = append(mismatches, "relay_protocol")
+	}
+
+	for name, observedValue := range observedParameters {
+
+		if observedValue == "" ||
+			(name == "meek_host_header" &&
+				protocol.TunnelProtocolIsFronted(tunnelProtocol)) {
+			continue
+		}
+
+		intendedValue, err := getStringRequestParam(params, name)
+		if err != nil {
+			continue
+		}
+
+		if !strings.EqualFold(intendedValue, observedValue) {
+			mismatches = append(mismatches, name)
+		}
+	}
+
+	sort.Strings(mismatches)
+
+	return mismatches
+}
+
+// checkDowngrade logs a "protocol_downgrade_suspected" security event when
+// the client's handshake parameters don't match what the server observed.
+// See getDowngradeMismatches.
+func (sshClient *sshClient) checkDowngrade(params common.APIParameters) {
+
+	sshClient.Lock()
+	tunnelProtocol := sshClient.tunnelProtocol
+	geoIPData := sshClient.geoIPData
+	var observedParameters map[string]string
+	if sshClient.observedParameters != nil {
+		observedParameters = sshClient.observedParameters.GetObservedParameters()
+	}
+	sshClient.Unlock()
+
+	mismatches := getDowngradeMismatches(tunnelProtocol, observedParameters, params)
+	if len(mismatches) == 0 {
+		return
+	}
+
+	logFields := getRequestLogFields(
+		"protocol_downgrade_suspected",
+		geoIPData,
+		nil,
+		params,
+		baseRequestParams)
+
+	logFields["mismatched_parameters"] = mismatches
+	logFields["observed_relay_protocol"] = tunnelProtocol
+	for name, observedValue := range observedParameters {
+		logFields["observed_"+name] = observedValue
+	}
+
+	log.LogRawFieldsWithTimestamp(logFields)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestDowngradeMismatches(t *testing.T) {
+
+	testCases := []struct {
+		description        string
+		tunnelProtocol     string
+		observedParameters map[string]string
+		params             common.APIParameters
+		expectedMismatches []string
+	}{
+		{
+			"match",
+			protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+			map[string]string{"meek_host_header": "Example.org"},
+			common.APIParameters{
+				"relay_protocol":   protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+				"meek_host_header": "example.org",
+			},
+			nil,
+		},
+		{
+			"legacy client",
+			protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+			map[string]string{"meek_host_header": "example.org"},
+			common.APIParameters{},
+			nil,
+		},
+		{
+			"redirected port",
+			protocol.TUNNEL_PROTOCOL_SSH,
+			nil,
+			common.APIParameters{
+				"relay_protocol": protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			},
+			[]string{"relay_protocol"},
+		},
+		{
+			"rewritten host header",
+			protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+			map[string]string{"meek_host_header": "other.example.org"},
+			common.APIParameters{
+				"relay_protocol":   protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP,
+				"meek_host_header": "example.org",
+			},
+			[]string{"meek_host_header", "relay_protocol"},
+		},
+		{
+			"fronted host header",
+			protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+			map[string]string{"meek_host_header": "origin.example.org"},
+			common.APIParameters{
+				"relay_protocol":   protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+				"meek_host_header": "example.org",
+			},
+			nil,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			mismatches := getDowngradeMismatches(
+				testCase.tunnelProtocol,
+				testCase.observedParameters,
+				testCase.params)
+			if !reflect.DeepEqual(mismatches, testCase.expectedMismatches) {
+				t.Fatalf("unexpected mismatches: %v", mismatches)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	FIRST_WRITE_MAX_DELAY = 250 * time.Millisecond
+)
+
+// firstWriteDelayListener wraps a TCP listener and applies the
+// ServerFirstWriteDelay tactics parameters, for the client's region, to each
+// accepted connection: when selected, the server's first write to the
+// client, which carries the first handshake response bytes, is delayed by a
+// random duration. This varies the server response timing, which otherwise
+// is consistently prompt, as seen by observers measuring the time between
+// the client's first flight and the server's response.
+//
+// Only the first write is delayed, so the delay is incurred once per
+// connection. Regardless of the tactics values, the delay is capped at
+// FIRST_WRITE_MAX_DELAY.
+type firstWriteDelayListener struct {
+	net.Listener
+	support *SupportServices
+}
+
+func newFirstWriteDelayListener(
+	listener net.Listener, support *SupportServices) net.Listener {
+
+	return &firstWriteDelayListener{
+		Listener: listener,
+		support:  support,
+	}
+}
+
+// Accept implements the net.Listener interface.
+func (listener *firstWriteDelayListener) Accept() (net.Conn, error) {
+
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		// Don't modify error from net.Listener
+		return nil, err
+	}
+
+	if listener.support.TacticsServer == nil {
+		return conn, nil
+	}
+
+	geoIPData := listener.support.GeoIPService.Lookup(
+		common.IPAddressFromAddr(conn.RemoteAddr()))
+
+	p, err := listener.support.TacticsServer.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for connection")
+		return conn, nil
+	}
+
+	if p == nil ||
+		!p.WeightedCoinFlip(parameters.ServerFirstWriteDelayProbability) {
+		return conn, nil
+	}
+
+	delay, err := selectFirstWriteDelay(
+		p.Duration(parameters.ServerFirstWriteMinDelay),
+		p.Duration(parameters.ServerFirstWriteMaxDelay))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to select first write delay")
+		return conn, nil
+	}
+
+	if delay <= 0 {
+		return conn, nil
+	}
+
+	return &firstWriteDelayConn{Conn: conn, delay: delay}, nil
+}
+
+// selectFirstWriteDelay selects a random delay in the range [min, max],
+// capped at FIRST_WRITE_MAX_DELAY.
+func selectFirstWriteDelay(min, max time.Duration) (time.Duration, error) {
+
+	if max > FIRST_WRITE_MAX_DELAY {
+		max = FIRST_WRITE_MAX_DELAY
+	}
+	if min > max {
+		min = max
+	}
+
+	delay, err := common.MakeSecureRandomPeriod(min, max)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return delay, nil
+}
+
+// firstWriteDelayConn delays the first Write to the underlying conn by delay.
+// Concurrent writes block until the delayed first Write completes.
+type firstWriteDelayConn struct {
+	net.Conn
+	delay          time.Duration
+	firstWriteOnce sync.Once
+}
+
+// Write implements the net.Conn interface.
+func (conn *firstWriteDelayConn) Write(buffer []byte) (int, error) {
+	conn.firstWriteOnce.Do(func() {
+		time.Sleep(conn.delay)
+	})
+	return conn.Conn.Write(buffer)
+}
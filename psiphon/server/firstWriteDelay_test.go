@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFirstWriteDelay(t *testing.T) {
+
+	for i := 0; i < 100; i++ {
+		delay, err := selectFirstWriteDelay(10*time.Millisecond, time.Hour)
+		if err != nil {
+			t.Fatalf("selectFirstWriteDelay failed: %s", err)
+		}
+		if delay < 10*time.Millisecond || delay > FIRST_WRITE_MAX_DELAY {
+			t.Fatalf("unexpected delay: %s", delay)
+		}
+	}
+
+	delay, err := selectFirstWriteDelay(time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("selectFirstWriteDelay failed: %s", err)
+	}
+	if delay != FIRST_WRITE_MAX_DELAY {
+		t.Fatalf("unexpected delay: %s", delay)
+	}
+
+	// Only the first write is delayed.
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	testDelay := 100 * time.Millisecond
+
+	conn := &firstWriteDelayConn{Conn: serverConn, delay: testDelay}
+	defer conn.Close()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn.Write([]byte{0})
+		}
+	}()
+
+	buffer := make([]byte, 1)
+
+	startTime := time.Now()
+	_, err = clientConn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if time.Since(startTime) < testDelay {
+		t.Fatalf("first write not delayed")
+	}
+
+	startTime = time.Now()
+	_, err = clientConn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if time.Since(startTime) >= testDelay {
+		t.Fatalf("second write delayed")
+	}
+}
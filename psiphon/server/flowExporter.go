@@ -0,0 +1,420 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	FLOW_EXPORTER_EXPORT_PERIOD        = 1 * time.Second
+	FLOW_EXPORTER_MAX_BUFFERED         = 10000
+	FLOW_EXPORTER_MAX_MESSAGE_SIZE     = 1400
+	FLOW_EXPORTER_MAX_STRING_LENGTH    = 254
+	FLOW_RECORD_ANONYMIZATION_NONE     = ""
+	FLOW_RECORD_ANONYMIZATION_TRUNCATE = "truncate"
+	FLOW_RECORD_ANONYMIZATION_OMIT     = "omit"
+
+	ipfixVersion                 = 10
+	ipfixMessageHeaderSize       = 16
+	ipfixSetHeaderSize           = 4
+	ipfixTemplateSetID           = 2
+	ipfixTemplateIDIPv4          = 256
+	ipfixTemplateIDIPv6          = 257
+	ipfixEnterpriseBit           = 0x8000
+	ipfixVariableLength          = 65535
+	ipfixReverseEnterpriseNumber = 29305 // RFC 5103
+	ipfixProtocolTCP             = 6
+	ipfixProtocolUDP             = 17
+)
+
+// IPFIX information elements; see
+// https://www.iana.org/assignments/ipfix/ipfix.xhtml.
+const (
+	ipfixIEOctetDeltaCount          = 1
+	ipfixIEProtocolIdentifier       = 4
+	ipfixIEDestinationTransportPort = 11
+	ipfixIEDestinationIPv4Address   = 12
+	ipfixIEBGPSourceASNumber        = 16
+	ipfixIEDestinationIPv6Address   = 28
+	ipfixIEFlowStartMilliseconds    = 152
+	ipfixIEFlowEndMilliseconds      = 153
+	ipfixIESamplingProbability      = 311
+
+	// Enterprise-specific information elements, with the
+	// Config.FlowRecordEnterpriseNumber enterprise number.
+	flowRecordIEClientRegion   = 1
+	flowRecordIEClientCity     = 2
+	flowRecordIEClientISP      = 3
+	flowRecordIETunnelProtocol = 4
+)
+
+// FlowExporter exports flow records for completed port forwards, for abuse
+// analysis, to an IPFIX collector, as specified in RFC 7011, over UDP.
+//
+// Each record includes the port forward transport protocol, destination
+// address and port, start and end times, and the upstream and downstream
+// byte counts, exported as a bidirectional flow, as specified in RFC 5103;
+// along with the client GeoIP data and tunnel protocol, which are exported
+// as enterprise-specific information elements. As in server logs, the
+// client IP address is not exported.
+//
+// The destination address may be anonymized according to
+// Config.FlowRecordDestinationAnonymization: "truncate" zeros all but the
+// first 24 bits of IPv4 and 48 bits of IPv6 addresses, and "omit" zeros the
+// address and port.
+//
+// A fraction of port forwards, Config.FlowRecordSampleRate, are sampled and
+// each record includes the sampling probability. Records are buffered and
+// exported periodically; when the buffer is full, records are dropped.
+// Templates are sent in each message, as the collector may miss messages
+// or restart.
+type FlowExporter struct {
+	conn             net.Conn
+	sampleRate       float64
+	anonymization    string
+	enterpriseNumber uint32
+	templateSet      []byte
+
+	recordsMutex sync.Mutex
+	records      []*flowRecord
+
+	sequenceNumber uint32
+}
+
+// flowRecord is a completed port forward.
+type flowRecord struct {
+	protocolIdentifier byte
+	destinationIP      net.IP
+	destinationPort    int
+	startTime          time.Time
+	endTime            time.Time
+	bytesUp            int64
+	bytesDown          int64
+	geoIPData          GeoIPData
+	tunnelProtocol     string
+}
+
+// NewFlowExporter initializes a new FlowExporter that exports to
+// Config.FlowCollectorAddress.
+func NewFlowExporter(config *Config) (*FlowExporter, error) {
+
+	conn, err := net.Dial("udp", config.FlowCollectorAddress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	exporter := &FlowExporter{
+		conn:             conn,
+		sampleRate:       config.FlowRecordSampleRate,
+		anonymization:    config.FlowRecordDestinationAnonymization,
+		enterpriseNumber: config.FlowRecordEnterpriseNumber,
+	}
+
+	exporter.templateSet = exporter.makeTemplateSet()
+
+	return exporter, nil
+}
+
+// Run periodically exports buffered records until shutdownBroadcast is
+// signaled. Any remaining buffered records are exported before Run returns.
+func (exporter *FlowExporter) Run(shutdownBroadcast <-chan struct{}) {
+
+	defer exporter.conn.Close()
+
+	ticker := time.NewTicker(FLOW_EXPORTER_EXPORT_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-shutdownBroadcast:
+			exporter.exportRecords()
+			return
+		}
+		exporter.exportRecords()
+	}
+}
+
+// addRecord adds a record for a completed port forward, when the port
+// forward is sampled. addRecord is a no-op when the exporter is nil, as it
+// is when flow export is disabled.
+func (exporter *FlowExporter) addRecord(record *flowRecord) {
+
+	if exporter == nil || !common.FlipWeightedCoin(exporter.sampleRate) {
+		return
+	}
+
+	exporter.recordsMutex.Lock()
+	defer exporter.recordsMutex.Unlock()
+
+	// Drop records when the buffer is full, to bound memory usage.
+	if len(exporter.records) >= FLOW_EXPORTER_MAX_BUFFERED {
+		return
+	}
+	exporter.records = append(exporter.records, record)
+}
+
+func (exporter *FlowExporter) exportRecords() {
+
+	exporter.recordsMutex.Lock()
+	records := exporter.records
+	exporter.records = nil
+	exporter.recordsMutex.Unlock()
+
+	if len(records) == 0 {
+		return
+	}
+
+	for _, message := range exporter.makeMessages(records) {
+		_, err := exporter.conn.Write(message)
+		if err != nil {
+			// Debug since the collector may be unavailable for extended
+			// periods.
+			log.WithContextFields(LogFields{"error": err}).Debug("export flow records failed")
+		}
+	}
+}
+
+// makeMessages encodes records into IPFIX messages of up to
+// FLOW_EXPORTER_MAX_MESSAGE_SIZE bytes. Each message includes the template
+// set and one data set for each template used by its records.
+func (exporter *FlowExporter) makeMessages(records []*flowRecord) [][]byte {
+
+	var messages [][]byte
+	var IPv4Set, IPv6Set []byte
+	recordCount := 0
+
+	messageSize := func() int {
+		size := ipfixMessageHeaderSize + len(exporter.templateSet)
+		if len(IPv4Set) > 0 {
+			size += ipfixSetHeaderSize + len(IPv4Set)
+		}
+		if len(IPv6Set) > 0 {
+			size += ipfixSetHeaderSize + len(IPv6Set)
+		}
+		return size
+	}
+
+	flush := func() {
+		if recordCount == 0 {
+			return
+		}
+
+		message := make([]byte, ipfixMessageHeaderSize, messageSize())
+		binary.BigEndian.PutUint16(message[0:2], ipfixVersion)
+		binary.BigEndian.PutUint16(message[2:4], uint16(cap(message)))
+		binary.BigEndian.PutUint32(message[4:8], uint32(time.Now().Unix()))
+		binary.BigEndian.PutUint32(message[8:12], exporter.sequenceNumber)
+		// The observation domain ID, message[12:16], is 0.
+
+		message = append(message, exporter.templateSet...)
+		message = appendIPFIXSet(message, ipfixTemplateIDIPv4, IPv4Set)
+		message = appendIPFIXSet(message, ipfixTemplateIDIPv6, IPv6Set)
+
+		messages = append(messages, message)
+
+		// The sequence number is the total number of data records sent,
+		// modulo 2^32, prior to each message.
+		exporter.sequenceNumber += uint32(recordCount)
+
+		IPv4Set = nil
+		IPv6Set = nil
+		recordCount = 0
+	}
+
+	for _, record := range records {
+
+		dataRecord, isIPv4 := exporter.makeDataRecord(record)
+
+		setHeaderSize := 0
+		if (isIPv4 && len(IPv4Set) == 0) || (!isIPv4 && len(IPv6Set) == 0) {
+			setHeaderSize = ipfixSetHeaderSize
+		}
+		if messageSize()+setHeaderSize+len(dataRecord) > FLOW_EXPORTER_MAX_MESSAGE_SIZE {
+			flush()
+		}
+
+		if isIPv4 {
+			IPv4Set = append(IPv4Set, dataRecord...)
+		} else {
+			IPv6Set = append(IPv6Set, dataRecord...)
+		}
+		recordCount += 1
+	}
+
+	flush()
+
+	return messages
+}
+
+func appendIPFIXSet(message []byte, setID int, records []byte) []byte {
+	if len(records) == 0 {
+		return message
+	}
+	var header [ipfixSetHeaderSize]byte
+	binary.BigEndian.PutUint16(header[0:2], uint16(setID))
+	binary.BigEndian.PutUint16(header[2:4], uint16(ipfixSetHeaderSize+len(records)))
+	message = append(message, header[:]...)
+	return append(message, records...)
+}
+
+// makeTemplateSet encodes the IPv4 and IPv6 templates. The data record
+// fields, in makeDataRecord, must be in the same order.
+func (exporter *FlowExporter) makeTemplateSet() []byte {
+
+	type field struct {
+		ID               uint16
+		length           uint16
+		enterpriseNumber uint32
+	}
+
+	makeTemplate := func(templateID uint16, destinationAddressField field) []byte {
+
+		fields := []field{
+			{ipfixIEFlowStartMilliseconds, 8, 0},
+			{ipfixIEFlowEndMilliseconds, 8, 0},
+			{ipfixIEProtocolIdentifier, 1, 0},
+			destinationAddressField,
+			{ipfixIEDestinationTransportPort, 2, 0},
+			{ipfixIEOctetDeltaCount, 8, 0},
+			{ipfixIEOctetDeltaCount, 8, ipfixReverseEnterpriseNumber},
+			{ipfixIEBGPSourceASNumber, 4, 0},
+			{ipfixIESamplingProbability, 8, 0},
+			{flowRecordIEClientRegion, ipfixVariableLength, exporter.enterpriseNumber},
+			{flowRecordIEClientCity, ipfixVariableLength, exporter.enterpriseNumber},
+			{flowRecordIEClientISP, ipfixVariableLength, exporter.enterpriseNumber},
+			{flowRecordIETunnelProtocol, ipfixVariableLength, exporter.enterpriseNumber},
+		}
+
+		template := make([]byte, 4)
+		binary.BigEndian.PutUint16(template[0:2], templateID)
+		binary.BigEndian.PutUint16(template[2:4], uint16(len(fields)))
+
+		for _, field := range fields {
+			ID := field.ID
+			if field.enterpriseNumber != 0 {
+				ID |= ipfixEnterpriseBit
+			}
+			template = appendUint16(template, ID)
+			template = appendUint16(template, field.length)
+			if field.enterpriseNumber != 0 {
+				template = appendUint32(template, field.enterpriseNumber)
+			}
+		}
+
+		return template
+	}
+
+	templates := makeTemplate(
+		ipfixTemplateIDIPv4, field{ipfixIEDestinationIPv4Address, 4, 0})
+	templates = append(templates, makeTemplate(
+		ipfixTemplateIDIPv6, field{ipfixIEDestinationIPv6Address, 16, 0})...)
+
+	return appendIPFIXSet(nil, ipfixTemplateSetID, templates)
+}
+
+// makeDataRecord encodes a data record, applying destination anonymization,
+// and returns the record and whether it uses the IPv4 template.
+func (exporter *FlowExporter) makeDataRecord(record *flowRecord) ([]byte, bool) {
+
+	destinationIP := record.destinationIP.To4()
+	isIPv4 := destinationIP != nil
+	if !isIPv4 {
+		destinationIP = record.destinationIP.To16()
+		if destinationIP == nil {
+			destinationIP = net.IPv6zero
+		}
+	}
+
+	// Copy the IP, as anonymization modifies it.
+	destinationIP = append(net.IP(nil), destinationIP...)
+	destinationPort := record.destinationPort
+
+	switch exporter.anonymization {
+	case FLOW_RECORD_ANONYMIZATION_TRUNCATE:
+		if isIPv4 {
+			destinationIP = destinationIP.Mask(net.CIDRMask(24, 32))
+		} else {
+			destinationIP = destinationIP.Mask(net.CIDRMask(48, 128))
+		}
+	case FLOW_RECORD_ANONYMIZATION_OMIT:
+		for i := range destinationIP {
+			destinationIP[i] = 0
+		}
+		destinationPort = 0
+	}
+
+	// The GeoIP ASN is exported when numeric.
+	ASN, _ := strconv.ParseUint(record.geoIPData.ASN, 10, 32)
+
+	var dataRecord []byte
+	dataRecord = appendUint64(dataRecord, uint64(record.startTime.UnixNano()/int64(time.Millisecond)))
+	dataRecord = appendUint64(dataRecord, uint64(record.endTime.UnixNano()/int64(time.Millisecond)))
+	dataRecord = append(dataRecord, record.protocolIdentifier)
+	dataRecord = append(dataRecord, destinationIP...)
+	dataRecord = appendUint16(dataRecord, uint16(destinationPort))
+	dataRecord = appendUint64(dataRecord, uint64(record.bytesUp))
+	dataRecord = appendUint64(dataRecord, uint64(record.bytesDown))
+	dataRecord = appendUint32(dataRecord, uint32(ASN))
+	dataRecord = appendUint64(dataRecord, math.Float64bits(exporter.sampleRate))
+	dataRecord = appendIPFIXString(dataRecord, record.geoIPData.Country)
+	dataRecord = appendIPFIXString(dataRecord, record.geoIPData.City)
+	dataRecord = appendIPFIXString(dataRecord, record.geoIPData.ISP)
+	dataRecord = appendIPFIXString(dataRecord, record.tunnelProtocol)
+
+	return dataRecord, isIPv4
+}
+
+// appendIPFIXString appends a variable-length string field. Strings are
+// truncated to FLOW_EXPORTER_MAX_STRING_LENGTH, so the length is always
+// encoded in a single byte.
+func appendIPFIXString(buffer []byte, value string) []byte {
+	if len(value) > FLOW_EXPORTER_MAX_STRING_LENGTH {
+		value = value[:FLOW_EXPORTER_MAX_STRING_LENGTH]
+	}
+	buffer = append(buffer, byte(len(value)))
+	return append(buffer, value...)
+}
+
+func appendUint16(buffer []byte, value uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], value)
+	return append(buffer, b[:]...)
+}
+
+func appendUint32(buffer []byte, value uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], value)
+	return append(buffer, b[:]...)
+}
+
+func appendUint64(buffer []byte, value uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], value)
+	return append(buffer, b[:]...)
+}
@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowExporter(t *testing.T) {
+
+	for _, anonymization := range []string{
+		FLOW_RECORD_ANONYMIZATION_NONE,
+		FLOW_RECORD_ANONYMIZATION_TRUNCATE,
+		FLOW_RECORD_ANONYMIZATION_OMIT,
+	} {
+		t.Run("anonymization "+anonymization, func(t *testing.T) {
+			runTestFlowExporter(t, anonymization)
+		})
+	}
+}
+
+// testFlowField is a decoded data record field, keyed by enterprise number
+// and information element ID.
+type testFlowField struct {
+	enterpriseNumber uint32
+	ID               uint16
+}
+
+func runTestFlowExporter(t *testing.T, anonymization string) {
+
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer collector.Close()
+
+	enterpriseNumber := uint32(12345)
+
+	exporter, err := NewFlowExporter(&Config{
+		FlowCollectorAddress:               collector.LocalAddr().String(),
+		FlowRecordSampleRate:               1.0,
+		FlowRecordDestinationAnonymization: anonymization,
+		FlowRecordEnterpriseNumber:         enterpriseNumber,
+	})
+	if err != nil {
+		t.Fatalf("NewFlowExporter failed: %s", err)
+	}
+
+	startTime := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	endTime := time.Now().Truncate(time.Millisecond)
+	geoIPData := GeoIPData{Country: "CA", City: "Toronto", ISP: "ISP", ASN: "64496"}
+
+	// Enough records are exported to require multiple messages.
+
+	recordCount := 100
+	for i := 0; i < recordCount; i++ {
+		record := &flowRecord{
+			protocolIdentifier: ipfixProtocolTCP,
+			destinationIP:      net.ParseIP("192.0.2.1"),
+			destinationPort:    443,
+			startTime:          startTime,
+			endTime:            endTime,
+			bytesUp:            int64(i),
+			bytesDown:          int64(2 * i),
+			geoIPData:          geoIPData,
+			tunnelProtocol:     "OSSH",
+		}
+		if i%2 == 1 {
+			record.protocolIdentifier = ipfixProtocolUDP
+			record.destinationIP = net.ParseIP("2001:db8:1:2::1")
+			record.destinationPort = 53
+		}
+		exporter.addRecord(record)
+	}
+
+	shutdownBroadcast := make(chan struct{})
+	close(shutdownBroadcast)
+	exporter.Run(shutdownBroadcast)
+
+	var records []map[testFlowField][]byte
+	expectedSequenceNumber := uint32(0)
+	for len(records) < recordCount {
+
+		// Decoded fields reference the buffer, so each message is read into
+		// a new buffer.
+		buffer := make([]byte, 65536)
+
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := collector.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %s", err)
+		}
+		if n > FLOW_EXPORTER_MAX_MESSAGE_SIZE {
+			t.Fatalf("unexpected message size: %d", n)
+		}
+
+		sequenceNumber, messageRecords, err := parseTestIPFIXMessage(buffer[:n])
+		if err != nil {
+			t.Fatalf("parseTestIPFIXMessage failed: %s", err)
+		}
+		if sequenceNumber != expectedSequenceNumber {
+			t.Fatalf("unexpected sequence number: %d", sequenceNumber)
+		}
+		expectedSequenceNumber += uint32(len(messageRecords))
+
+		records = append(records, messageRecords...)
+	}
+
+	if len(records) != recordCount {
+		t.Fatalf("unexpected record count: %d", len(records))
+	}
+
+	var bytesUpTotal, bytesDownTotal uint64
+
+	for _, record := range records {
+
+		protocolIdentifier := record[testFlowField{0, ipfixIEProtocolIdentifier}][0]
+		destinationPort := binary.BigEndian.Uint16(record[testFlowField{0, ipfixIEDestinationTransportPort}])
+
+		var destinationIP, expectedIP net.IP
+		var expectedPort uint16
+
+		switch protocolIdentifier {
+		case ipfixProtocolTCP:
+			destinationIP = net.IP(record[testFlowField{0, ipfixIEDestinationIPv4Address}])
+			expectedIP = net.ParseIP("192.0.2.1")
+			expectedPort = 443
+			if anonymization == FLOW_RECORD_ANONYMIZATION_TRUNCATE {
+				expectedIP = net.ParseIP("192.0.2.0")
+			}
+		case ipfixProtocolUDP:
+			destinationIP = net.IP(record[testFlowField{0, ipfixIEDestinationIPv6Address}])
+			expectedIP = net.ParseIP("2001:db8:1:2::1")
+			expectedPort = 53
+			if anonymization == FLOW_RECORD_ANONYMIZATION_TRUNCATE {
+				expectedIP = net.ParseIP("2001:db8:1::")
+			}
+		default:
+			t.Fatalf("unexpected protocol identifier: %d", protocolIdentifier)
+		}
+
+		if anonymization == FLOW_RECORD_ANONYMIZATION_OMIT {
+			if !destinationIP.IsUnspecified() || destinationPort != 0 {
+				t.Fatalf("unexpected destination: %s:%d", destinationIP, destinationPort)
+			}
+		} else if !destinationIP.Equal(expectedIP) || destinationPort != expectedPort {
+			t.Fatalf("unexpected destination: %s:%d", destinationIP, destinationPort)
+		}
+
+		if binary.BigEndian.Uint64(record[testFlowField{0, ipfixIEFlowStartMilliseconds}]) !=
+			uint64(startTime.UnixNano()/int64(time.Millisecond)) ||
+			binary.BigEndian.Uint64(record[testFlowField{0, ipfixIEFlowEndMilliseconds}]) !=
+				uint64(endTime.UnixNano()/int64(time.Millisecond)) {
+			t.Fatalf("unexpected flow times")
+		}
+
+		bytesUp := binary.BigEndian.Uint64(record[testFlowField{0, ipfixIEOctetDeltaCount}])
+		bytesDown := binary.BigEndian.Uint64(
+			record[testFlowField{ipfixReverseEnterpriseNumber, ipfixIEOctetDeltaCount}])
+		if bytesDown != 2*bytesUp {
+			t.Fatalf("unexpected byte counts: %d, %d", bytesUp, bytesDown)
+		}
+		bytesUpTotal += bytesUp
+		bytesDownTotal += bytesDown
+
+		if binary.BigEndian.Uint32(record[testFlowField{0, ipfixIEBGPSourceASNumber}]) != 64496 {
+			t.Fatalf("unexpected ASN")
+		}
+
+		if math.Float64frombits(binary.BigEndian.Uint64(
+			record[testFlowField{0, ipfixIESamplingProbability}])) != 1.0 {
+			t.Fatalf("unexpected sampling probability")
+		}
+
+		if string(record[testFlowField{enterpriseNumber, flowRecordIEClientRegion}]) != geoIPData.Country ||
+			string(record[testFlowField{enterpriseNumber, flowRecordIEClientCity}]) != geoIPData.City ||
+			string(record[testFlowField{enterpriseNumber, flowRecordIEClientISP}]) != geoIPData.ISP ||
+			string(record[testFlowField{enterpriseNumber, flowRecordIETunnelProtocol}]) != "OSSH" {
+			t.Fatalf("unexpected client fields")
+		}
+	}
+
+	expectedBytesUpTotal := uint64(recordCount * (recordCount - 1) / 2)
+	if bytesUpTotal != expectedBytesUpTotal || bytesDownTotal != 2*expectedBytesUpTotal {
+		t.Fatalf("unexpected byte count totals: %d, %d", bytesUpTotal, bytesDownTotal)
+	}
+
+	// When the exporter is nil, as when flow export is disabled, addRecord
+	// is a no-op.
+
+	var nilExporter *FlowExporter
+	nilExporter.addRecord(&flowRecord{})
+}
+
+// parseTestIPFIXMessage decodes an IPFIX message, using the templates
+// included in the message to decode the data records.
+func parseTestIPFIXMessage(
+	message []byte) (uint32, []map[testFlowField][]byte, error) {
+
+	if len(message) < ipfixMessageHeaderSize ||
+		binary.BigEndian.Uint16(message[0:2]) != ipfixVersion ||
+		int(binary.BigEndian.Uint16(message[2:4])) != len(message) {
+		return 0, nil, errors.New("invalid message header")
+	}
+
+	sequenceNumber := binary.BigEndian.Uint32(message[8:12])
+
+	type templateField struct {
+		field  testFlowField
+		length uint16
+	}
+	templates := make(map[uint16][]templateField)
+
+	var records []map[testFlowField][]byte
+
+	sets := message[ipfixMessageHeaderSize:]
+	for len(sets) > 0 {
+
+		if len(sets) < ipfixSetHeaderSize {
+			return 0, nil, errors.New("invalid set header")
+		}
+		setID := binary.BigEndian.Uint16(sets[0:2])
+		setLength := int(binary.BigEndian.Uint16(sets[2:4]))
+		if setLength < ipfixSetHeaderSize || setLength > len(sets) {
+			return 0, nil, errors.New("invalid set length")
+		}
+		set := sets[ipfixSetHeaderSize:setLength]
+		sets = sets[setLength:]
+
+		if setID == ipfixTemplateSetID {
+			for len(set) > 0 {
+				templateID := binary.BigEndian.Uint16(set[0:2])
+				fieldCount := int(binary.BigEndian.Uint16(set[2:4]))
+				set = set[4:]
+				var fields []templateField
+				for i := 0; i < fieldCount; i++ {
+					ID := binary.BigEndian.Uint16(set[0:2])
+					length := binary.BigEndian.Uint16(set[2:4])
+					set = set[4:]
+					var enterpriseNumber uint32
+					if ID&ipfixEnterpriseBit != 0 {
+						ID &^= ipfixEnterpriseBit
+						enterpriseNumber = binary.BigEndian.Uint32(set[0:4])
+						set = set[4:]
+					}
+					fields = append(fields, templateField{testFlowField{enterpriseNumber, ID}, length})
+				}
+				templates[templateID] = fields
+			}
+			continue
+		}
+
+		fields, ok := templates[setID]
+		if !ok {
+			return 0, nil, errors.New("unknown template")
+		}
+
+		for len(set) > 0 {
+			record := make(map[testFlowField][]byte)
+			for _, field := range fields {
+				length := int(field.length)
+				if field.length == ipfixVariableLength {
+					length = int(set[0])
+					set = set[1:]
+				}
+				if length > len(set) {
+					return 0, nil, errors.New("invalid record length")
+				}
+				record[field.field] = set[:length]
+				set = set[length:]
+			}
+			records = append(records, record)
+		}
+	}
+
+	return sequenceNumber, records, nil
+}
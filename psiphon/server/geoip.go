@@ -23,11 +23,11 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	maxminddb "github.com/oschwald/maxminddb-golang"
-	cache "github.com/patrickmn/go-cache"
 )
 
 const (
@@ -37,14 +37,15 @@ const (
 
 // GeoIPData is GeoIP data for a client session. Individual client
 // IP addresses are neither logged nor explicitly referenced during a session.
-// The GeoIP country, city, and ISP corresponding to a client IP address are
-// resolved and then logged along with usage stats. The DiscoveryValue is
+// The GeoIP country, city, ISP, and ASN corresponding to a client IP address
+// are resolved and then logged along with usage stats. The DiscoveryValue is
 // a special value derived from the client IP that's used to compartmentalize
 // discoverable servers (see calculateDiscoveryValue for details).
 type GeoIPData struct {
 	Country        string
 	City           string
 	ISP            string
+	ASN            string
 	DiscoveryValue int
 }
 
@@ -55,6 +56,7 @@ func NewGeoIPData() GeoIPData {
 		Country: GEOIP_UNKNOWN_VALUE,
 		City:    GEOIP_UNKNOWN_VALUE,
 		ISP:     GEOIP_UNKNOWN_VALUE,
+		ASN:     GEOIP_UNKNOWN_VALUE,
 	}
 }
 
@@ -64,7 +66,7 @@ func NewGeoIPData() GeoIPData {
 // running.
 type GeoIPService struct {
 	databases             []*geoIPDatabase
-	sessionCache          *cache.Cache
+	sessionCache          *sessionCache
 	discoveryValueHMACKey string
 }
 
@@ -73,14 +75,17 @@ type geoIPDatabase struct {
 	maxMindReader *maxminddb.Reader
 }
 
-// NewGeoIPService initializes a new GeoIPService.
+// NewGeoIPService initializes a new GeoIPService. When
+// sessionCacheMaxEntries is not 0, the session cache is limited to that
+// number of entries.
 func NewGeoIPService(
 	databaseFilenames []string,
-	discoveryValueHMACKey string) (*GeoIPService, error) {
+	discoveryValueHMACKey string,
+	sessionCacheMaxEntries int) (*GeoIPService, error) {
 
 	geoIP := &GeoIPService{
 		databases:             make([]*geoIPDatabase, len(databaseFilenames)),
-		sessionCache:          cache.New(GEOIP_SESSION_CACHE_TTL, 1*time.Minute),
+		sessionCache:          newSessionCache(GEOIP_SESSION_CACHE_TTL, sessionCacheMaxEntries),
 		discoveryValueHMACKey: discoveryValueHMACKey,
 	}
 
@@ -142,11 +147,14 @@ func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
 			Names map[string]string `maxminddb:"names"`
 		} `maxminddb:"city"`
 		ISP string `maxminddb:"isp"`
+		ASN uint   `maxminddb:"autonomous_system_number"`
 	}
 
 	// Each database will populate geoIPFields with the values it contains. In the
 	// current MaxMind deployment, the City database populates Country and City and
-	// the separate ISP database populates ISP.
+	// the separate ISP database populates ISP and ASN. The ASN database may be
+	// used to populate ASN when the ISP database is not deployed. Any field not
+	// populated by any database retains the GEOIP_UNKNOWN_VALUE.
 	for _, database := range geoIP.databases {
 		database.ReloadableFile.RLock()
 		err := database.maxMindReader.Lookup(ip, &geoIPFields)
@@ -169,6 +177,10 @@ func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
 		result.ISP = geoIPFields.ISP
 	}
 
+	if geoIPFields.ASN != 0 {
+		result.ASN = strconv.FormatUint(uint64(geoIPFields.ASN), 10)
+	}
+
 	result.DiscoveryValue = calculateDiscoveryValue(
 		geoIP.discoveryValueHMACKey, ipAddress)
 
@@ -181,7 +193,7 @@ func (geoIP *GeoIPService) Lookup(ipAddress string) GeoIPData {
 // Calling SetSessionCache for an existing sessionID will
 // replace the previous value and reset any expiry.
 func (geoIP *GeoIPService) SetSessionCache(sessionID string, geoIPData GeoIPData) {
-	geoIP.sessionCache.Set(sessionID, geoIPData, cache.NoExpiration)
+	geoIP.sessionCache.Set(sessionID, geoIPData, SESSION_CACHE_NO_EXPIRATION)
 }
 
 // MarkSessionCacheToExpire initiates expiry for an existing
@@ -194,7 +206,7 @@ func (geoIP *GeoIPService) MarkSessionCacheToExpire(sessionID string) {
 	// the tunnel server won't clobber a SetSessionCache value by calling
 	// MarkSessionCacheToExpire concurrently.
 	if found {
-		geoIP.sessionCache.Set(sessionID, geoIPData, cache.DefaultExpiration)
+		geoIP.sessionCache.Set(sessionID, geoIPData, SESSION_CACHE_DEFAULT_EXPIRATION)
 	}
 }
 
@@ -216,6 +228,20 @@ func (geoIP *GeoIPService) InSessionCache(sessionID string) bool {
 	return found
 }
 
+// ShrinkSessionCache evicts the least recently used fraction of the
+// session cache entries, returning the number of evicted entries. An
+// evicted session, including a connected session, has no cached GeoIPData,
+// as if the entry had expired.
+func (geoIP *GeoIPService) ShrinkSessionCache(fraction float64) int {
+	return geoIP.sessionCache.Shrink(fraction)
+}
+
+// GetSessionCacheMetrics returns session cache size and hit, miss, and
+// eviction counts.
+func (geoIP *GeoIPService) GetSessionCacheMetrics() LogFields {
+	return geoIP.sessionCache.GetMetrics()
+}
+
 // calculateDiscoveryValue derives a value from the client IP address to be
 // used as input in the server discovery algorithm. Since we do not explicitly
 // store the client IP address, we must derive the value here and store it for
@@ -27,6 +27,7 @@ import (
 	go_log "log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Psiphon-Inc/rotate-safe-writer"
@@ -111,7 +112,7 @@ func (logger *ContextLogger) LogRawFieldsWithTimestamp(fields LogFields) {
 // LogPanicRecover calls LogRawFieldsWithTimestamp with standard fields
 // for logging recovered panics.
 func (logger *ContextLogger) LogPanicRecover(recoverValue interface{}, stack []byte) {
-	log.LogRawFieldsWithTimestamp(
+	logger.LogRawFieldsWithTimestamp(
 		LogFields{
 			"event_name":    "panic",
 			"recover_value": recoverValue,
@@ -248,7 +249,8 @@ func InitLogging(config *Config) (retErr error) {
 				// if this behavior is not desired.
 				//
 				// Note that NewRotatableFileWriter will first attempt
-				// a retry when a Write fails.
+				// a retry when a Write fails. Further retries may be
+				// configured with LogWriterRetryAttempts.
 				//
 				// It is assumed that continuing operation while unable
 				// to log is unacceptable; and that the psiphond service
@@ -264,25 +266,173 @@ func InitLogging(config *Config) (retErr error) {
 				// and then panic, or perform an orderly shutdown and
 				// simulate a panic message that will be reported.
 
-				logWriter = NewPanickingLogWriter(config.LogFilename, logWriter)
+				logWriter = NewPanickingLogWriterWithRetryPolicy(
+					config.LogFilename,
+					logWriter,
+					PanickingLogWriterRetryPolicy{
+						MaxAttempts: config.LogWriterRetryAttempts,
+						Backoff: time.Duration(
+							config.LogWriterRetryBackoffMilliseconds) * time.Millisecond,
+					})
 			}
 
 		} else {
 			logWriter = os.Stderr
 		}
 
+		var logFormatter logrus.Formatter = &CustomJSONFormatter{}
+
+		if config.AsyncLogQueueSize > 0 {
+
+			asyncLogFormatter := newAsyncLogFormatter(
+				logFormatter,
+				logWriter,
+				config.AsyncLogQueueSize,
+				config.AsyncLogSampleRate)
+
+			logFormatter = asyncLogFormatter
+			logWriter = ioutil.Discard
+
+			asyncLogs = asyncLogFormatter
+		}
+
 		log = &ContextLogger{
 			&logrus.Logger{
 				Out:       logWriter,
-				Formatter: &CustomJSONFormatter{},
+				Formatter: logFormatter,
 				Level:     level,
 			},
 		}
+
+		if asyncLogs != nil {
+			go asyncLogs.run()
+		}
 	})
 
 	return retErr
 }
 
+// FlushLogs waits, up to the specified timeout, for all queued log lines to
+// be written. FlushLogs has no effect when logging is synchronous.
+func FlushLogs(timeout time.Duration) {
+	if asyncLogs != nil {
+		asyncLogs.flush(timeout)
+	}
+}
+
+const (
+	ASYNC_LOG_DROPPED_COUNT_PERIOD = 1 * time.Minute
+	LOG_FLUSH_TIMEOUT              = 5 * time.Second
+)
+
+var asyncLogs *asyncLogFormatter
+
+// asyncLogFormatter implements asynchronous logging. asyncLogFormatter is a
+// logrus.Formatter which formats each entry using the wrapped formatter and
+// then queues the formatted line to be written to the log writer by a
+// separate goroutine. The entry priority, which the log writer cannot
+// determine, is used to decide which lines are dropped under backpressure.
+// Format returns an empty result, and the logrus Out is ioutil.Discard.
+type asyncLogFormatter struct {
+	droppedCount int64
+	formatter    logrus.Formatter
+	writer       io.Writer
+	queue        chan []byte
+	sampleRate   int64
+	sampleCount  int64
+	pending      sync.WaitGroup
+}
+
+func newAsyncLogFormatter(
+	formatter logrus.Formatter,
+	writer io.Writer,
+	queueSize int,
+	sampleRate int) *asyncLogFormatter {
+
+	return &asyncLogFormatter{
+		formatter:  formatter,
+		writer:     writer,
+		queue:      make(chan []byte, queueSize),
+		sampleRate: int64(sampleRate),
+	}
+}
+
+// Format implements logrus.Formatter.
+func (f *asyncLogFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+
+	line, err := f.formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Error and higher priority lines are never dropped. This includes
+	// all LogRawFieldsWithTimestamp lines.
+	if entry.Level <= logrus.ErrorLevel {
+		f.pending.Add(1)
+		f.queue <- line
+		return []byte{}, nil
+	}
+
+	if len(f.queue) > cap(f.queue)/2 {
+		if f.sampleRate <= 0 ||
+			atomic.AddInt64(&f.sampleCount, 1)%f.sampleRate != 0 {
+
+			atomic.AddInt64(&f.droppedCount, 1)
+			return []byte{}, nil
+		}
+	}
+
+	f.pending.Add(1)
+	select {
+	case f.queue <- line:
+	default:
+		f.pending.Done()
+		atomic.AddInt64(&f.droppedCount, 1)
+	}
+
+	return []byte{}, nil
+}
+
+// run writes queued log lines and periodically logs the dropped line count.
+// As the log writer may be a PanickingLogWriter, a write failure panics in
+// this goroutine and terminates the process, as with synchronous logging.
+func (f *asyncLogFormatter) run() {
+
+	go func() {
+		ticker := time.NewTicker(ASYNC_LOG_DROPPED_COUNT_PERIOD)
+		defer ticker.Stop()
+		for range ticker.C {
+			droppedCount := atomic.SwapInt64(&f.droppedCount, 0)
+			if droppedCount > 0 {
+				log.LogRawFieldsWithTimestamp(
+					LogFields{
+						"event_name":    "dropped_logs",
+						"dropped_count": droppedCount,
+					})
+			}
+		}
+	}()
+
+	for line := range f.queue {
+		f.writer.Write(line)
+		f.pending.Done()
+	}
+}
+
+func (f *asyncLogFormatter) flush(timeout time.Duration) {
+
+	flushed := make(chan struct{})
+	go func() {
+		f.pending.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+	}
+}
+
 func init() {
 
 	// Suppress standard "log" package logging performed by other packages.
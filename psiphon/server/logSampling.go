@@ -0,0 +1,75 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// getConnectionLogSampleRate returns the ServerConnectionLogSampleRates
+// tactics parameter value for the client's region and tunnel protocol. All
+// connection events are logged when no tactics apply.
+func getConnectionLogSampleRate(
+	support *SupportServices, geoIPData GeoIPData, tunnelProtocol string) float64 {
+
+	if support.TacticsServer == nil {
+		return 1.0
+	}
+
+	p, err := support.TacticsServer.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for connection log")
+		return 1.0
+	}
+
+	if p == nil {
+		return 1.0
+	}
+
+	return p.LogSampleRates(
+		parameters.ServerConnectionLogSampleRates).Rate(tunnelProtocol)
+}
+
+// isConnectionLogSampled indicates whether connection events for the
+// client session are logged, given the sample rate.
+//
+// The selection is derived from the session ID, rather than made randomly
+// for each event, so that all of a session's connection events, including
+// "server_tunnel" events for its reconnected tunnels and "connected"
+// events, are either logged or omitted together, and may still be joined
+// downstream.
+func isConnectionLogSampled(sessionID string, sampleRate float64) bool {
+
+	if sampleRate >= 1.0 {
+		return true
+	}
+
+	digest := sha256.Sum256([]byte(sessionID))
+	value := float64(binary.BigEndian.Uint64(digest[:8])) / math.MaxUint64
+
+	return value < sampleRate
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConnectionLogSampling(t *testing.T) {
+
+	sessionIDs := make([]string, 10000)
+	for i := 0; i < len(sessionIDs); i++ {
+		sessionIDs[i] = fmt.Sprintf("%032x", i)
+	}
+
+	for _, sessionID := range sessionIDs {
+		if !isConnectionLogSampled(sessionID, 1.0) {
+			t.Fatalf("unexpected unsampled session at rate 1.0")
+		}
+		if isConnectionLogSampled(sessionID, 0.0) {
+			t.Fatalf("unexpected sampled session at rate 0.0")
+		}
+	}
+
+	count := 0
+	for _, sessionID := range sessionIDs {
+		sampled := isConnectionLogSampled(sessionID, 0.1)
+		if sampled {
+			count++
+		}
+
+		// All events for a session are sampled together.
+		if isConnectionLogSampled(sessionID, 0.1) != sampled {
+			t.Fatalf("unexpected inconsistent sampling")
+		}
+
+		// Sessions sampled at a lower rate are also sampled at higher rates.
+		if sampled && !isConnectionLogSampled(sessionID, 0.5) {
+			t.Fatalf("unexpected unsampled session at higher rate")
+		}
+	}
+
+	if count < 800 || count > 1200 {
+		t.Fatalf("unexpected sample count: %d", count)
+	}
+}
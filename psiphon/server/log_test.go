@@ -0,0 +1,65 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAsyncLogFormatter(t *testing.T) {
+
+	var buffer bytes.Buffer
+
+	formatter := newAsyncLogFormatter(&CustomJSONFormatter{}, &buffer, 4, 0)
+
+	logger := &logrus.Logger{
+		Out:       &bytes.Buffer{},
+		Formatter: formatter,
+		Level:     logrus.DebugLevel,
+	}
+
+	// With no writer running, the queue fills. The first low priority lines
+	// are queued, low priority lines are dropped once the queue is more than
+	// half full, and error lines are always queued.
+
+	for i := 0; i < 5; i++ {
+		logger.Info("info")
+	}
+	logger.Error("error")
+
+	if atomic.LoadInt64(&formatter.droppedCount) != 2 {
+		t.Fatalf("unexpected dropped count: %d", formatter.droppedCount)
+	}
+
+	go formatter.run()
+
+	formatter.flush(1 * time.Second)
+
+	if strings.Count(buffer.String(), `"msg":"info"`) != 3 ||
+		strings.Count(buffer.String(), `"msg":"error"`) != 1 {
+		t.Fatalf("unexpected log output: %s", buffer.String())
+	}
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	golanglog "log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	tris "github.com/Psiphon-Labs/tls-tris"
+)
+
+const (
+	MANAGEMENT_SERVER_IO_TIMEOUT     = 10 * time.Second
+	MANAGEMENT_SERVER_METRICS_PREFIX = "psiphond_"
+)
+
+// managementServer serves operational endpoints for monitoring:
+//
+// "/health" responds with 200 OK and a JSON object reporting whether the
+// server is establishing tunnels and warming up.
+//
+// "/metrics" responds with the server load stats and runtime metrics, as
+// logged in "server_load" events, in the Prometheus text exposition format.
+//
+// The management server requires mutual TLS. Clients must present a client
+// certificate issued by one of the ManagementClientCACertificates CAs;
+// handshakes with clients which present no certificate, or an invalid
+// certificate, fail, and no request is served. The management server runs
+// on its own listener, ManagementServerAddress, which should not be exposed
+// to tunnel clients; tunnel protocol listeners never request or accept
+// client certificates.
+type managementServer struct {
+	tunnelServer *TunnelServer
+}
+
+// RunManagementServer runs the management server until shutdownBroadcast
+// is closed.
+func RunManagementServer(
+	support *SupportServices,
+	tunnelServer *TunnelServer,
+	shutdownBroadcast <-chan struct{}) error {
+
+	tlsConfig, err := makeManagementTLSConfig(support.Config)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	managementServer := &managementServer{
+		tunnelServer: tunnelServer,
+	}
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/health", managementServer.healthHandler)
+	serveMux.HandleFunc("/metrics", managementServer.metricsHandler)
+
+	logWriter := NewLogWriter()
+	defer logWriter.Close()
+
+	server := &HTTPSServer{
+		&http.Server{
+			Handler:      serveMux,
+			ReadTimeout:  MANAGEMENT_SERVER_IO_TIMEOUT,
+			WriteTimeout: MANAGEMENT_SERVER_IO_TIMEOUT,
+			ErrorLog:     golanglog.New(logWriter, "", 0),
+
+			// Disable auto HTTP/2 (https://golang.org/doc/go1.6)
+			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		},
+	}
+
+	localAddress := support.Config.ManagementServerAddress
+
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("starting management server")
+
+	errors := make(chan error, 1)
+	waitGroup := new(sync.WaitGroup)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		// Note: will be interrupted by listener.Close()
+		err := server.ServeTLS(listener, tlsConfig)
+
+		select {
+		case <-shutdownBroadcast:
+		default:
+			if err != nil {
+				errors <- common.ContextError(err)
+			}
+		}
+	}()
+
+	select {
+	case <-shutdownBroadcast:
+	case err = <-errors:
+	}
+
+	listener.Close()
+
+	waitGroup.Wait()
+
+	log.WithContextFields(
+		LogFields{"localAddress": localAddress}).Info("stopped management server")
+
+	return err
+}
+
+// makeManagementTLSConfig creates the management server TLS config, which
+// requires and verifies client certificates.
+func makeManagementTLSConfig(config *Config) (*tris.Config, error) {
+
+	certificate, err := tris.X509KeyPair(
+		[]byte(config.ManagementServerCertificate),
+		[]byte(config.ManagementServerPrivateKey))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM([]byte(config.ManagementClientCACertificates)) {
+		return nil, common.ContextError(errors.New("invalid client CA certificates"))
+	}
+
+	return &tris.Config{
+		Certificates: []tris.Certificate{certificate},
+		ClientAuth:   tris.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tris.VersionTLS12,
+	}, nil
+}
+
+func (server *managementServer) healthHandler(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	response, err := json.Marshal(map[string]bool{
+		"establish_tunnels": server.tunnelServer.GetEstablishTunnels(),
+		"warming_up":        server.tunnelServer.IsWarmingUp(),
+	})
+	if err != nil {
+		http.Error(responseWriter, "", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(response)
+}
+
+func (server *managementServer) metricsHandler(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	protocolStats, _, _ := server.tunnelServer.GetLoadStats()
+
+	var buffer bytes.Buffer
+	writePrometheusMetrics(
+		&buffer,
+		getRuntimeMetrics(),
+		server.tunnelServer.GetEstablishTunnels(),
+		protocolStats)
+
+	responseWriter.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	responseWriter.Write(buffer.Bytes())
+}
+
+var prometheusInvalidNameCharacters = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+func prometheusMetricName(name string) string {
+	return MANAGEMENT_SERVER_METRICS_PREFIX +
+		prometheusInvalidNameCharacters.ReplaceAllString(name, "_")
+}
+
+// writePrometheusMetrics writes the runtime metrics and load stats as
+// Prometheus gauges. Non-numeric runtime metrics are omitted. Load stats are
+// labeled by tunnel protocol. Output is sorted, for consistent scrapes.
+func writePrometheusMetrics(
+	buffer *bytes.Buffer,
+	runtimeMetrics LogFields,
+	establishTunnels bool,
+	protocolStats ProtocolStats) {
+
+	writeGauge := func(name string) {
+		fmt.Fprintf(buffer, "# TYPE %s gauge\n", name)
+	}
+
+	name := prometheusMetricName("establish_tunnels")
+	writeGauge(name)
+	value := 0
+	if establishTunnels {
+		value = 1
+	}
+	fmt.Fprintf(buffer, "%s %d\n", name, value)
+
+	var runtimeNames []string
+	for runtimeName := range runtimeMetrics {
+		runtimeNames = append(runtimeNames, runtimeName)
+	}
+	sort.Strings(runtimeNames)
+
+	for _, runtimeName := range runtimeNames {
+		var value string
+		switch v := runtimeMetrics[runtimeName].(type) {
+		case int, int32, int64, uint32, uint64:
+			value = fmt.Sprintf("%d", v)
+		default:
+			continue
+		}
+		name := prometheusMetricName(runtimeName)
+		writeGauge(name)
+		fmt.Fprintf(buffer, "%s %s\n", name, value)
+	}
+
+	var tunnelProtocols []string
+	statNames := make(map[string]bool)
+	for tunnelProtocol, stats := range protocolStats {
+		tunnelProtocols = append(tunnelProtocols, tunnelProtocol)
+		for statName := range stats {
+			statNames[statName] = true
+		}
+	}
+	sort.Strings(tunnelProtocols)
+
+	var sortedStatNames []string
+	for statName := range statNames {
+		sortedStatNames = append(sortedStatNames, statName)
+	}
+	sort.Strings(sortedStatNames)
+
+	for _, statName := range sortedStatNames {
+		name := prometheusMetricName(statName)
+		writeGauge(name)
+		for _, tunnelProtocol := range tunnelProtocols {
+			value, ok := protocolStats[tunnelProtocol][statName]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(buffer, "%s{tunnel_protocol=%q} %d\n", name, tunnelProtocol, value)
+		}
+	}
+}
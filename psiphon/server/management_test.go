@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	tris "github.com/Psiphon-Labs/tls-tris"
+)
+
+func TestManagementServerTLS(t *testing.T) {
+
+	serverCertificate, serverPrivateKey, err := common.GenerateWebServerCertificate("localhost")
+	if err != nil {
+		t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+	}
+
+	caCertificate, caKey, caPEM := generateTestCertificate(t, nil, nil, true)
+	clientCertificatePEM, clientKeyPEM := generateTestCertificatePEM(
+		t, caCertificate, caKey)
+
+	config := &Config{
+		ManagementServerAddress:        "127.0.0.1:0",
+		ManagementServerCertificate:    serverCertificate,
+		ManagementServerPrivateKey:     serverPrivateKey,
+		ManagementClientCACertificates: caPEM,
+	}
+
+	tlsConfig, err := makeManagementTLSConfig(config)
+	if err != nil {
+		t.Fatalf("makeManagementTLSConfig failed: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", config.ManagementServerAddress)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go http.Serve(
+		tris.NewListener(listener, tlsConfig),
+		http.HandlerFunc(func(responseWriter http.ResponseWriter, _ *http.Request) {
+			responseWriter.Write([]byte("ok"))
+		}))
+
+	url := "https://" + listener.Addr().String() + "/health"
+
+	get := func(certificates []tls.Certificate) error {
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					Certificates:       certificates,
+				},
+			},
+		}
+		response, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return err
+		}
+		if string(body) != "ok" {
+			t.Fatalf("unexpected response body: %s", body)
+		}
+		return nil
+	}
+
+	clientCertificate, err := tls.X509KeyPair(clientCertificatePEM, clientKeyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %s", err)
+	}
+
+	err = get([]tls.Certificate{clientCertificate})
+	if err != nil {
+		t.Fatalf("request with client certificate failed: %s", err)
+	}
+
+	err = get(nil)
+	if err == nil {
+		t.Fatalf("request without client certificate succeeded")
+	}
+
+	// A certificate not issued by a client CA is rejected.
+
+	otherCertificatePEM, otherKeyPEM := generateTestCertificatePEM(t, nil, nil)
+	otherCertificate, err := tls.X509KeyPair(otherCertificatePEM, otherKeyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %s", err)
+	}
+
+	err = get([]tls.Certificate{otherCertificate})
+	if err == nil {
+		t.Fatalf("request with untrusted client certificate succeeded")
+	}
+}
+
+func TestWritePrometheusMetrics(t *testing.T) {
+
+	var buffer bytes.Buffer
+	writePrometheusMetrics(
+		&buffer,
+		LogFields{"num_goroutine": 10, "last_gc": "2018-01-01T00:00:00Z"},
+		true,
+		ProtocolStats{
+			"OSSH": {"accepted_clients": 2},
+			"ALL":  {"accepted_clients": 3},
+		})
+
+	expected := strings.Join([]string{
+		"# TYPE psiphond_establish_tunnels gauge",
+		"psiphond_establish_tunnels 1",
+		"# TYPE psiphond_num_goroutine gauge",
+		"psiphond_num_goroutine 10",
+		"# TYPE psiphond_accepted_clients gauge",
+		`psiphond_accepted_clients{tunnel_protocol="ALL"} 3`,
+		`psiphond_accepted_clients{tunnel_protocol="OSSH"} 2`,
+		"",
+	}, "\n")
+
+	if buffer.String() != expected {
+		t.Fatalf("unexpected metrics:\n%s", buffer.String())
+	}
+}
+
+func generateTestCertificate(
+	t *testing.T,
+	issuer *x509.Certificate,
+	issuerKey *rsa.PrivateKey,
+	isCA bool) (*x509.Certificate, *rsa.PrivateKey, string) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+
+	if issuer == nil {
+		issuer = template
+		issuerKey = key
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err)
+	}
+
+	certificate, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %s", err)
+	}
+
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+
+	return certificate, key, string(certificatePEM)
+}
+
+func generateTestCertificatePEM(
+	t *testing.T,
+	issuer *x509.Certificate,
+	issuerKey *rsa.PrivateKey) ([]byte, []byte) {
+
+	_, key, certificatePEM := generateTestCertificate(t, issuer, issuerKey, false)
+
+	keyPEM := pem.EncodeToMemory(
+		&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	return []byte(certificatePEM), keyPEM
+}
@@ -80,6 +80,12 @@ const (
 	MEEK_DEFAULT_RESPONSE_BUFFER_LENGTH = 65536
 	MEEK_DEFAULT_POOL_BUFFER_LENGTH     = 65536
 	MEEK_DEFAULT_POOL_BUFFER_COUNT      = 2048
+	MEEK_MAX_BODY_SESSION_TOKEN_LENGTH  = 4096
+
+	// MEEK_DEFAULT_MAX_REQUEST_BODY_LENGTH allows for a maximum length
+	// request payload preceded by a maximum length body session token.
+	MEEK_DEFAULT_MAX_REQUEST_BODY_LENGTH = MEEK_MAX_REQUEST_PAYLOAD_LENGTH +
+		2 + MEEK_MAX_BODY_SESSION_TOKEN_LENGTH
 )
 
 // MeekServer implements the meek protocol, which tunnels TCP traffic (in the case of Psiphon,
@@ -97,6 +103,8 @@ type MeekServer struct {
 	support           *SupportServices
 	listener          net.Listener
 	tlsConfig         *tris.Config
+	certificatePool   *meekCertificatePool
+	useALPNListener   bool
 	clientHandler     func(clientTunnelProtocol string, clientConn net.Conn)
 	openConns         *common.Conns
 	stopBroadcast     <-chan struct{}
@@ -104,10 +112,12 @@ type MeekServer struct {
 	sessions          map[string]*meekSession
 	checksumTable     *crc64.Table
 	bufferPool        *CachedResponseBufferPool
+	maxBodyLength     int64
 	rateLimitLock     sync.Mutex
 	rateLimitHistory  map[string][]monotime.Time
 	rateLimitCount    int
 	rateLimitSignalGC chan struct{}
+	decoyConns        sync.Map
 }
 
 // NewMeekServer initializes a new meek server.
@@ -132,6 +142,11 @@ func NewMeekServer(
 
 	bufferPool := NewCachedResponseBufferPool(bufferLength, bufferCount)
 
+	maxBodyLength := int64(MEEK_DEFAULT_MAX_REQUEST_BODY_LENGTH)
+	if support.Config.MeekMaxRequestBodyLength != 0 {
+		maxBodyLength = int64(support.Config.MeekMaxRequestBodyLength)
+	}
+
 	meekServer := &MeekServer{
 		support:           support,
 		listener:          listener,
@@ -141,6 +156,7 @@ func NewMeekServer(
 		sessions:          make(map[string]*meekSession),
 		checksumTable:     checksumTable,
 		bufferPool:        bufferPool,
+		maxBodyLength:     maxBodyLength,
 		rateLimitHistory:  make(map[string][]monotime.Time),
 		rateLimitSignalGC: make(chan struct{}, 1),
 	}
@@ -152,6 +168,40 @@ func NewMeekServer(
 			return nil, common.ContextError(err)
 		}
 		meekServer.tlsConfig = tlsConfig
+
+		// For unfronted meek, the ALPN protocols are selected by tactics
+		// and HTTP/2 may be negotiated; see getTLSConfigForClient. Fronted
+		// meek always uses HTTP/1.1 between the CDN and the meek server.
+		if !isFronted {
+			tlsConfig.GetConfigForClient = meekServer.getTLSConfigForClient
+			meekServer.useALPNListener = true
+		}
+
+		// Certificates configured for the listener's tunnel protocol take
+		// precedence. Otherwise, unfronted meek may present a pool of
+		// certificates. Fronted meek certificates are seen only by the CDN.
+		var certificatePool *meekCertificatePool
+		protocolCertificates, ok := support.Config.MeekServerProtocolCertificates[meekTunnelProtocol(
+			isFronted, useObfuscatedSessionTickets)]
+		if ok {
+			certificatePool, err = newMeekProtocolCertificatePool(protocolCertificates)
+		} else if !isFronted && support.Config.MeekServerCertificatePoolSize > 1 {
+			certificatePool, err = newMeekCertificatePool(
+				support.Config.MeekServerCertificatePoolSize,
+				time.Duration(support.Config.MeekServerCertificateRotationPeriodSeconds)*time.Second)
+		}
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		if certificatePool != nil {
+			meekServer.certificatePool = certificatePool
+			tlsConfig.GetCertificate = certificatePool.getCertificate
+
+			// tris consults GetCertificate only when Certificates is empty
+			// or when the client sends SNI.
+			tlsConfig.Certificates = nil
+		}
 	}
 
 	return meekServer, nil
@@ -188,6 +238,14 @@ func (server *MeekServer) Run() error {
 		server.rateLimitWorker()
 	}()
 
+	if server.certificatePool != nil {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			server.certificatePool.run(server.stopBroadcast)
+		}()
+	}
+
 	// Serve HTTP or HTTPS
 	//
 	// - WriteTimeout may include time awaiting request, as per:
@@ -209,7 +267,12 @@ func (server *MeekServer) Run() error {
 
 	// Note: Serve() will be interrupted by listener.Close() call
 	var err error
-	if server.tlsConfig != nil {
+	if server.useALPNListener {
+		alpnListener := newMeekALPNListener(
+			server, server.listener, server.tlsConfig, httpServer)
+		defer alpnListener.Close()
+		err = httpServer.Serve(alpnListener)
+	} else if server.tlsConfig != nil {
 		httpsServer := HTTPSServer{Server: httpServer}
 		err = httpsServer.ServeTLS(server.listener, server.tlsConfig)
 	} else {
@@ -243,18 +306,68 @@ func (server *MeekServer) Run() error {
 // traffic.
 func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
 
+	// When a response header template is applied, the connection is
+	// hijacked and handleRequest returns the writer which continues to serve
+	// the connection.
+
+	templateResponseWriter := server.handleRequest(responseWriter, request)
+	if templateResponseWriter != nil {
+		server.serveTemplateConn(templateResponseWriter, request.Close)
+	}
+}
+
+// isMeekPath checks that the request path is within the configured
+// MeekPathPrefix, if any.
+func (server *MeekServer) isMeekPath(path string) bool {
+	prefix := server.support.Config.MeekPathPrefix
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func (server *MeekServer) handleRequest(
+	responseWriter http.ResponseWriter,
+	request *http.Request) (templateResponseWriter *meekTemplateResponseWriter) {
+
 	// Note: no longer requiring that the request method is POST
 
-	// Check for the expected meek/session ID cookie.
-	// Also check for prohibited HTTP headers.
+	// When the meek server is co-hosted with another web application,
+	// requests outside of the meek path prefix receive the same response as
+	// any other unknown path. The connection is not terminated, as a web
+	// server would keep the connection alive.
 
-	var meekCookie *http.Cookie
-	for _, c := range request.Cookies() {
-		meekCookie = c
-		break
+	if !server.isMeekPath(request.URL.Path) {
+		http.NotFound(responseWriter, request)
+		return
+	}
+
+	// Reject oversized request bodies before reading any of the body. A
+	// declared Content-Length is checked up front; bodies without a
+	// Content-Length, such as chunked bodies, are bounded by
+	// http.MaxBytesReader, which fails the read, and so the request, once
+	// the limit is exceeded. Request bodies are consumed by streaming reads,
+	// so this bounds the memory a client can cause to be allocated.
+
+	if request.ContentLength > server.maxBodyLength {
+		log.WithContextFields(LogFields{
+			"content_length": request.ContentLength,
+		}).Warning("oversized meek request body")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	if request.Body != nil {
+		request.Body = http.MaxBytesReader(
+			responseWriter, request.Body, server.maxBodyLength)
 	}
-	if meekCookie == nil || len(meekCookie.Value) == 0 {
-		log.WithContext().Warning("missing meek cookie")
+
+	// Check for the expected meek/session ID token.
+	// Also check for prohibited HTTP headers.
+
+	sessionToken, cookieName, err := server.getSessionToken(request)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("missing meek cookie")
 		common.TerminateHTTPConnection(responseWriter, request)
 		return
 	}
@@ -283,7 +396,7 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 	// 3. A request to an endpoint. This meek connection is not for relaying
 	// tunnel traffic. Instead, the request is handed off to a custom handler.
 
-	sessionID, session, endPoint, clientIP, err := server.getSessionOrEndpoint(request, meekCookie)
+	sessionID, session, endPoint, clientIP, err := server.getSessionOrEndpoint(request, sessionToken)
 	if err != nil {
 		// Debug since session cookie errors commonly occur during
 		// normal operation.
@@ -309,6 +422,18 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 
 	// Tunnel relay mode.
 
+	// Enforce the per-session request rate limit. Excess requests are
+	// rejected before waiting on the session lock, so a flood of requests
+	// doesn't queue. As with other request failures, the session is kept
+	// open and the client may retry.
+
+	if !session.requestRateLimiter.allow() {
+		atomic.AddInt64(&session.metricRateLimitedRequests, 1)
+		log.WithContext().Debug("meek session request rate limit exceeded")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
 	// Ensure that there's only one concurrent request handler per client
 	// session. Depending on the nature of a network disruption, it can
 	// happen that a client detects a failure and retries while the server
@@ -369,14 +494,49 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 		return
 	}
 
+	// Apply any response header template selected for this session. The
+	// request body has been fully consumed by pumpReads, so the connection
+	// may now be hijacked. Subsequent requests on a hijacked connection are
+	// handled with the existing meekTemplateResponseWriter.
+	//
+	// Templates are HTTP/1.1 response headers and HTTP/2 connections cannot
+	// be hijacked, so templates are not applied when HTTP/2 was negotiated.
+
+	if session.responseHeaderTemplate != nil && request.ProtoMajor < 2 {
+		if _, ok := responseWriter.(*meekTemplateResponseWriter); !ok {
+			writer, err := newMeekTemplateResponseWriter(
+				responseWriter, session.responseHeaderTemplate)
+			if err != nil {
+				log.WithContextFields(LogFields{"error": err}).Warning(
+					"apply response header template failed")
+				common.TerminateHTTPConnection(responseWriter, request)
+				return
+			}
+			responseWriter = writer
+			templateResponseWriter = writer
+		}
+	}
+
 	// Set cookie before writing the response.
 
-	if session.meekProtocolVersion >= MEEK_PROTOCOL_VERSION_2 && session.sessionIDSent == false {
+	sendSessionID, err := server.getSessionIDToSend(session, sessionID)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("rotate session ID failed")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	if sendSessionID != "" {
 		// Replace the meek cookie with the session ID.
-		// SetCookie for the the session ID cookie is only set once, to reduce overhead. This
-		// session ID value replaces the original meek cookie value.
-		http.SetCookie(responseWriter, &http.Cookie{Name: meekCookie.Name, Value: sessionID})
-		session.sessionIDSent = true
+		// SetCookie for the the session ID cookie is only set once, to reduce overhead,
+		// or until a rotated session ID is adopted. This session ID value replaces the
+		// original meek cookie value. Clients which don't carry the session token in a
+		// cookie specify a response header for the session ID.
+		if session.sessionIDHeader != "" {
+			responseWriter.Header().Set(session.sessionIDHeader, sendSessionID)
+		} else {
+			http.SetCookie(responseWriter, &http.Cookie{Name: cookieName, Value: sendSessionID})
+		}
 	}
 
 	// When streaming data into the response body, a copy is
@@ -404,6 +564,13 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 	position, isRetry := checkRangeHeader(request)
 	if isRetry {
 		atomic.AddInt64(&session.metricClientRetries, 1)
+
+		// A retry indicates that the previous round trip stalled or was
+		// reset, which may be caused by a middlebox which fails on larger
+		// payloads, so subsequent response payloads are reduced in size.
+		// The client similarly reduces its request payload size. Any
+		// cached response is resent as-is.
+		session.backOffResponseChunkSize()
 	}
 
 	hasCompleteCachedResponse := session.cachedResponse.HasPosition(0)
@@ -461,7 +628,8 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 		// pumpWrites causes a TunnelServer/SSH goroutine blocking on a Write to
 		// write its downstream traffic through to the response body.
 
-		responseSize, responseError = session.clientConn.pumpWrites(multiWriter)
+		responseSize, responseError = session.clientConn.pumpWrites(
+			multiWriter, int(atomic.LoadInt64(&session.responseChunkSize)))
 		greaterThanSwapInt64(&session.metricPeakResponseSize, int64(responseSize))
 		greaterThanSwapInt64(&session.metricPeakCachedResponseSize, int64(session.cachedResponse.Available()))
 	}
@@ -479,6 +647,8 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 
 		return
 	}
+
+	return
 }
 
 func checkRangeHeader(request *http.Request) (int, bool) {
@@ -507,18 +677,82 @@ func checkRangeHeader(request *http.Request) (int, bool) {
 	return position, true
 }
 
-// getSessionOrEndpoint checks if the cookie corresponds to an existing tunnel
-// relay session ID. If no session is found, the cookie must be an obfuscated
-// meek cookie. A new session is created when the meek cookie indicates relay
-// mode; or the endpoint is returned when the meek cookie indicates endpoint
-// mode.
+// getSessionToken returns the meek session token, which is either an
+// obfuscated meek cookie or a session ID, and, when the token is carried in
+// a cookie, the cookie name.
+//
+// The token may be carried in any of the protocol.MeekSessionTokenLocations,
+// which are checked in order: the first cookie; a MeekSessionTokenHeaders
+// header; the first URL query parameter; and finally the request body
+// prefix, which is consumed from the request body. As any location is
+// accepted, clients may change locations without breaking sessions.
+func (server *MeekServer) getSessionToken(request *http.Request) (string, string, error) {
+
+	for _, c := range request.Cookies() {
+		if len(c.Value) > 0 {
+			return c.Value, c.Name, nil
+		}
+		break
+	}
+
+	headers := server.support.Config.MeekSessionTokenHeaders
+	if len(headers) == 0 {
+		headers = []string{protocol.MEEK_SESSION_TOKEN_DEFAULT_HEADER_NAME}
+	}
+	for _, header := range headers {
+		value := request.Header.Get(header)
+		if len(value) > 0 {
+			return value, "", nil
+		}
+	}
+
+	// Query parameters added by meek URL signing, which are validated by
+	// the CDN, are ignored.
+
+	for name, values := range request.URL.Query() {
+		if common.Contains(protocol.MeekURLSigningQueryParameters, name) {
+			continue
+		}
+		if len(values) > 0 && len(values[0]) > 0 {
+			return values[0], "", nil
+		}
+		break
+	}
+
+	if request.Body == nil {
+		return "", "", common.ContextError(errors.New("missing session token"))
+	}
+
+	var prefix [2]byte
+	_, err := io.ReadFull(request.Body, prefix[:])
+	if err != nil {
+		return "", "", common.ContextError(err)
+	}
+	length := int(prefix[0])<<8 | int(prefix[1])
+	if length == 0 || length > MEEK_MAX_BODY_SESSION_TOKEN_LENGTH {
+		return "", "", common.ContextError(errors.New("invalid session token length"))
+	}
+	token := make([]byte, length)
+	_, err = io.ReadFull(request.Body, token)
+	if err != nil {
+		return "", "", common.ContextError(err)
+	}
+
+	return string(token), "", nil
+}
+
+// getSessionOrEndpoint checks if the session token corresponds to an
+// existing tunnel relay session ID. If no session is found, the token must
+// be an obfuscated meek cookie. A new session is created when the meek
+// cookie indicates relay mode; or the endpoint is returned when the meek
+// cookie indicates endpoint mode.
 func (server *MeekServer) getSessionOrEndpoint(
-	request *http.Request, meekCookie *http.Cookie) (string, *meekSession, string, string, error) {
+	request *http.Request, sessionToken string) (string, *meekSession, string, string, error) {
 
 	// Check for an existing session.
 
 	server.sessionsLock.RLock()
-	existingSessionID := meekCookie.Value
+	existingSessionID := sessionToken
 	session, ok := server.sessions[existingSessionID]
 	server.sessionsLock.RUnlock()
 	if ok {
@@ -560,7 +794,7 @@ func (server *MeekServer) getSessionOrEndpoint(
 	// The session is new (or expired). Treat the cookie value as a new meek
 	// cookie, extract the payload, and create a new session.
 
-	payloadJSON, err := getMeekCookiePayload(server.support, meekCookie.Value)
+	payloadJSON, err := getMeekCookiePayload(server.support, sessionToken)
 	if err != nil {
 		return "", nil, "", "", common.ContextError(err)
 	}
@@ -574,6 +808,13 @@ func (server *MeekServer) getSessionOrEndpoint(
 		return "", nil, "", "", common.ContextError(err)
 	}
 
+	// The session ID response header is restricted to a simple header name.
+	for _, c := range clientSessionData.SessionIDHeader {
+		if !(c == '-' || ('0' <= c && c <= '9') || ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z')) {
+			return "", nil, "", "", common.ContextError(errors.New("invalid session ID header"))
+		}
+	}
+
 	// Handle endpoints before enforcing the GetEstablishTunnels check.
 	// Currently, endpoints are tactics requests, and we allow these to be
 	// handled by servers which would otherwise reject new tunnels.
@@ -598,10 +839,29 @@ func (server *MeekServer) getSessionOrEndpoint(
 	}
 	cachedResponse := NewCachedResponse(bufferLength, server.bufferPool)
 
+	sessionIDRotationPeriod, sessionIDRotationJitter :=
+		server.getMeekSessionIDRotationPeriod(clientIP)
+
 	session = &meekSession{
-		meekProtocolVersion: clientSessionData.MeekProtocolVersion,
-		sessionIDSent:       false,
-		cachedResponse:      cachedResponse,
+		meekProtocolVersion:     clientSessionData.MeekProtocolVersion,
+		sessionIDSent:           false,
+		sessionIDHeader:         clientSessionData.SessionIDHeader,
+		sessionIDRotationPeriod: sessionIDRotationPeriod,
+		sessionIDRotationJitter: sessionIDRotationJitter,
+		cachedResponse:          cachedResponse,
+		responseHeaderTemplate:  server.getMeekResponseHeaderTemplate(clientIP),
+		requestRateLimiter:      server.getMeekRequestRateLimiter(clientIP),
+		observedHostHeader:      request.Host,
+	}
+
+	// Response payload sizes are bounded only when the client requests
+	// chunk size backoff; otherwise, as with legacy clients, responses are
+	// bounded only by the turn around timeouts.
+	if clientSessionData.MaxChunkSize != 0 {
+		maxChunkSize, minChunkSize := protocol.ClampMeekChunkSizes(
+			clientSessionData.MaxChunkSize, clientSessionData.MinChunkSize)
+		session.responseChunkSize = int64(maxChunkSize)
+		session.minResponseChunkSize = minChunkSize
 	}
 
 	session.touch()
@@ -632,7 +892,7 @@ func (server *MeekServer) getSessionOrEndpoint(
 	// to resume a meek session and the server can't differentiate
 	// between resuming a session and creating a new session. This
 	// causes the v1 client connection to hang/timeout.
-	sessionID := meekCookie.Value
+	sessionID := sessionToken
 	if clientSessionData.MeekProtocolVersion >= MEEK_PROTOCOL_VERSION_2 {
 		sessionID, err = makeMeekSessionID()
 		if err != nil {
@@ -640,6 +900,8 @@ func (server *MeekServer) getSessionOrEndpoint(
 		}
 	}
 
+	session.sessionID = sessionID
+
 	server.sessionsLock.Lock()
 	server.sessions[sessionID] = session
 	server.sessionsLock.Unlock()
@@ -660,6 +922,12 @@ func (server *MeekServer) rateLimit(clientIP string) bool {
 		return false
 	}
 
+	// Shared IP addresses, such as carrier-grade NAT addresses, may be used
+	// by many legitimate clients at once and are not rate limited.
+	if server.support.Config.IsSharedIPAddress(clientIP) {
+		return false
+	}
+
 	if len(regions) > 0 {
 		// TODO: avoid redundant GeoIP lookups?
 		if !common.Contains(regions, server.support.GeoIPService.Lookup(clientIP).Country) {
@@ -781,8 +1049,14 @@ func (server *MeekServer) deleteSession(sessionID string) {
 	if ok {
 		session.delete(false)
 
+		// While a session ID rotation is pending, the session is mapped by
+		// both its current and pending session IDs. Both are removed.
 		server.sessionsLock.Lock()
 		delete(server.sessions, sessionID)
+		delete(server.sessions, session.sessionID)
+		if session.pendingSessionID != "" {
+			delete(server.sessions, session.pendingSessionID)
+		}
 		server.sessionsLock.Unlock()
 	}
 }
@@ -803,7 +1077,9 @@ func (server *MeekServer) deleteExpiredSessions() {
 	server.sessionsLock.Lock()
 	expiredSessionIDs := make([]string, 0)
 	for sessionID, session := range server.sessions {
-		if session.expired() {
+		// Skip any pending session ID mapping; deleteSession removes all
+		// of a session's mappings.
+		if session.expired() && sessionID == session.sessionID {
 			expiredSessionIDs = append(expiredSessionIDs, sessionID)
 		}
 	}
@@ -847,18 +1123,46 @@ type meekSession struct {
 	metricPeakCachedResponseSize     int64
 	metricPeakCachedResponseHitSize  int64
 	metricCachedResponseMissPosition int64
+	metricSessionIDRotations         int64
+	metricRateLimitedRequests        int64
+	responseChunkSize                int64
 	lock                             sync.Mutex
 	deleted                          bool
 	clientConn                       *meekConn
 	meekProtocolVersion              int
+	sessionID                        string
+	pendingSessionID                 string
 	sessionIDSent                    bool
+	sessionIDHeader                  string
+	sessionIDRotationPeriod          time.Duration
+	sessionIDRotationJitter          float64
+	nextSessionIDRotation            monotime.Time
 	cachedResponse                   *CachedResponse
+	responseHeaderTemplate           meekResponseHeaderTemplate
+	minResponseChunkSize             int
+	requestRateLimiter               *meekRequestRateLimiter
+	observedHostHeader               string
 }
 
 func (session *meekSession) touch() {
 	atomic.StoreInt64(&session.lastActivity, int64(monotime.Now()))
 }
 
+// backOffResponseChunkSize halves the maximum response payload size, down to
+// the minimum chunk size, when response payload sizes are bounded. The
+// caller must hold session.lock.
+func (session *meekSession) backOffResponseChunkSize() {
+	chunkSize := int(atomic.LoadInt64(&session.responseChunkSize))
+	if chunkSize == 0 || chunkSize <= session.minResponseChunkSize {
+		return
+	}
+	chunkSize /= 2
+	if chunkSize < session.minResponseChunkSize {
+		chunkSize = session.minResponseChunkSize
+	}
+	atomic.StoreInt64(&session.responseChunkSize, int64(chunkSize))
+}
+
 func (session *meekSession) expired() bool {
 	lastActivity := monotime.Time(atomic.LoadInt64(&session.lastActivity))
 	return monotime.Since(lastActivity) > MEEK_MAX_SESSION_STALENESS
@@ -914,9 +1218,22 @@ func (session *meekSession) GetMetrics() LogFields {
 	logFields["meek_peak_cached_response_size"] = atomic.LoadInt64(&session.metricPeakCachedResponseSize)
 	logFields["meek_peak_cached_response_hit_size"] = atomic.LoadInt64(&session.metricPeakCachedResponseHitSize)
 	logFields["meek_cached_response_miss_position"] = atomic.LoadInt64(&session.metricCachedResponseMissPosition)
+	logFields["meek_session_id_rotations"] = atomic.LoadInt64(&session.metricSessionIDRotations)
+	logFields["meek_rate_limited_requests"] = atomic.LoadInt64(&session.metricRateLimitedRequests)
+	logFields["meek_response_chunk_size"] = atomic.LoadInt64(&session.responseChunkSize)
 	return logFields
 }
 
+// meekTunnelProtocol returns the tunnel protocol of a meek HTTPS listener.
+func meekTunnelProtocol(isFronted, useObfuscatedSessionTickets bool) string {
+	if isFronted {
+		return protocol.TUNNEL_PROTOCOL_FRONTED_MEEK
+	} else if useObfuscatedSessionTickets {
+		return protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET
+	}
+	return protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS
+}
+
 // makeMeekTLSConfig creates a TLS config for a meek HTTPS listener.
 // Currently, this config is optimized for fronted meek where the nature
 // of the connection is non-circumvention; it's optimized for performance
@@ -1233,8 +1550,13 @@ func (conn *meekConn) replaceReadBuffer(readBuffer *bytes.Buffer) {
 // to the specified writer. This function blocks until the meek response
 // body limits (size for protocol v1, turn around time for protocol v2+)
 // are met, or the meekConn is closed.
+//
+// When maxSize is not 0, the response body is also limited to maxSize
+// bytes. When a Write buffer doesn't fit within the limit, the remainder
+// of the buffer is written by the next pumpWrites call, and the Write
+// caller remains blocked until then.
 // Note: channel scheme assumes only one concurrent call to pumpWrites
-func (conn *meekConn) pumpWrites(writer io.Writer) (int, error) {
+func (conn *meekConn) pumpWrites(writer io.Writer, maxSize int) (int, error) {
 
 	startTime := monotime.Now()
 	timeout := time.NewTimer(MEEK_TURN_AROUND_TIMEOUT)
@@ -1244,8 +1566,24 @@ func (conn *meekConn) pumpWrites(writer io.Writer) (int, error) {
 	for {
 		select {
 		case buffer := <-conn.nextWriteBuffer:
+
+			var remainder []byte
+			if maxSize > 0 && n+len(buffer) > maxSize {
+				remainder = buffer[maxSize-n:]
+				buffer = buffer[:maxSize-n]
+			}
+
 			written, err := writer.Write(buffer)
 			n += written
+
+			if err == nil && remainder != nil {
+				// Assumes that nextWriteBuffer is empty and won't block,
+				// as the Write caller doesn't send another buffer until it
+				// receives a writeResult.
+				conn.nextWriteBuffer <- remainder
+				return n, nil
+			}
+
 			// Assumes that writeResult won't block.
 			// Note: always send the err to writeResult,
 			// as the Write() caller is blocking on this.
@@ -1255,6 +1593,10 @@ func (conn *meekConn) pumpWrites(writer io.Writer) (int, error) {
 				return n, err
 			}
 
+			if maxSize > 0 && n >= maxSize {
+				return n, nil
+			}
+
 			if conn.protocolVersion < MEEK_PROTOCOL_VERSION_1 {
 				// Pre-protocol version 1 clients expect at most
 				// MEEK_MAX_REQUEST_PAYLOAD_LENGTH response bodies
@@ -1381,3 +1723,9 @@ func (conn *meekConn) SetWriteDeadline(t time.Time) error {
 func (conn *meekConn) GetMetrics() LogFields {
 	return conn.meekSession.GetMetrics()
 }
+
+// GetObservedParameters implements the observedParametersSource interface.
+// The Host header is that of the request which created the session.
+func (conn *meekConn) GetObservedParameters() map[string]string {
+	return map[string]string{"meek_host_header": conn.meekSession.observedHostHeader}
+}
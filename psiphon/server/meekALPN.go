@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/net/http2"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	tris "github.com/Psiphon-Labs/tls-tris"
+)
+
+// getTLSConfigForClient is a tris.Config.GetConfigForClient callback which
+// applies the MeekServerALPNProtocols tactics parameter for the client's
+// region. nil, which selects the base config, is returned when the ALPN
+// protocols are unchanged.
+//
+// A client which offers none of the selected protocols proceeds with no
+// negotiated protocol, which is served as HTTP/1.1, as before.
+//
+// The MeekServerAllowedSNIServerNames tactics parameter is also applied
+// here; see checkSNIServerName.
+func (server *MeekServer) getTLSConfigForClient(
+	clientHello *tris.ClientHelloInfo) (*tris.Config, error) {
+
+	if server.support.TacticsServer == nil || clientHello.Conn == nil {
+		return nil, nil
+	}
+
+	clientIP := common.IPAddressFromAddr(clientHello.Conn.RemoteAddr())
+
+	geoIPData := server.support.GeoIPService.Lookup(clientIP)
+
+	p, err := server.support.TacticsServer.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for meek TLS handshake")
+		return nil, nil
+	}
+
+	if p == nil {
+		return nil, nil
+	}
+
+	if !server.checkSNIServerName(clientHello, p) {
+		return nil, common.ContextError(errors.New("unexpected SNI server name"))
+	}
+
+	// Tactics values have already been validated, so only supported ALPN
+	// protocols are negotiated.
+	nextProtos := []string(p.ALPNProtocols(parameters.MeekServerALPNProtocols))
+
+	if reflect.DeepEqual(nextProtos, server.tlsConfig.NextProtos) {
+		return nil, nil
+	}
+
+	config := server.tlsConfig.Clone()
+	config.GetConfigForClient = nil
+	config.NextProtos = nextProtos
+
+	return config, nil
+}
+
+// meekALPNListener is a TLS listener which completes the TLS handshake for
+// each accepted connection and dispatches the connection according to the
+// negotiated ALPN protocol: HTTP/2 connections are served directly by
+// MeekServer.serveHTTP2Conn and all other connections are returned by
+// Accept, to be served by the HTTP/1.1 http.Server.
+//
+// Handshakes are performed concurrently, so a slow client doesn't block
+// Accept.
+type meekALPNListener struct {
+	net.Listener
+	server         *MeekServer
+	tlsConfig      *tris.Config
+	httpServer     *http.Server
+	conns          chan net.Conn
+	acceptErr      chan error
+	closeOnce      sync.Once
+	closeBroadcast chan struct{}
+}
+
+func newMeekALPNListener(
+	server *MeekServer,
+	listener net.Listener,
+	tlsConfig *tris.Config,
+	httpServer *http.Server) *meekALPNListener {
+
+	alpnListener := &meekALPNListener{
+		Listener:       listener,
+		server:         server,
+		tlsConfig:      tlsConfig,
+		httpServer:     httpServer,
+		conns:          make(chan net.Conn),
+		acceptErr:      make(chan error, 1),
+		closeBroadcast: make(chan struct{}),
+	}
+
+	go alpnListener.acceptConns()
+
+	return alpnListener
+}
+
+func (listener *meekALPNListener) acceptConns() {
+
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				log.WithContextFields(LogFields{"error": err}).Debug("accept failed")
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			listener.acceptErr <- err
+			return
+		}
+
+		go listener.handshake(conn, tris.Server(conn, listener.tlsConfig))
+	}
+}
+
+func (listener *meekALPNListener) handshake(rawConn net.Conn, conn *tris.Conn) {
+
+	// As with the http.Server timeouts, the handshake must complete within
+	// MEEK_HTTP_CLIENT_IO_TIMEOUT.
+
+	conn.SetDeadline(time.Now().Add(MEEK_HTTP_CLIENT_IO_TIMEOUT))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	isDecoy := listener.server.isDecoyConn(rawConn)
+	if err != nil {
+		// Debug since errors such as "i/o timeout" occur during normal
+		// operation; also, golang network error messages may contain
+		// client IP.
+		log.WithContextFields(LogFields{"error": err}).Debug("TLS handshake failed")
+		conn.Close()
+		return
+	}
+
+	if isDecoy {
+		listener.server.openConns.Add(conn)
+		defer listener.server.openConns.Remove(conn)
+		serveMeekDecoyConn(conn, conn.ConnectionState().NegotiatedProtocol)
+		return
+	}
+
+	if conn.ConnectionState().NegotiatedProtocol == protocol.ALPN_PROTOCOL_HTTP2 {
+		listener.server.serveHTTP2Conn(conn, listener.httpServer)
+		return
+	}
+
+	select {
+	case listener.conns <- conn:
+	case <-listener.closeBroadcast:
+		conn.Close()
+	}
+}
+
+// Accept implements the net.Listener interface.
+func (listener *meekALPNListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case err := <-listener.acceptErr:
+		// Retain the error for any subsequent Accept call.
+		listener.acceptErr <- err
+		return nil, err
+	case <-listener.closeBroadcast:
+		return nil, common.ContextError(errors.New("listener closed"))
+	}
+}
+
+// Close implements the net.Listener interface.
+func (listener *meekALPNListener) Close() error {
+	var err error
+	listener.closeOnce.Do(func() {
+		close(listener.closeBroadcast)
+		err = listener.Listener.Close()
+	})
+	return err
+}
+
+// serveHTTP2Conn serves a meek HTTP/2 connection, blocking until the
+// connection is closed. HTTP/2 connections are tracked in openConns, as
+// HTTP/1.1 connections are tracked by httpConnStateCallback.
+func (server *MeekServer) serveHTTP2Conn(conn net.Conn, httpServer *http.Server) {
+
+	server.openConns.Add(conn)
+	defer server.openConns.Remove(conn)
+
+	http2Server := &http2.Server{
+		IdleTimeout: MEEK_HTTP_CLIENT_IO_TIMEOUT,
+	}
+
+	http2Server.ServeConn(
+		conn,
+		&http2.ServeConnOpts{
+			BaseConfig: httpServer,
+			Handler:    server,
+		})
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	tris "github.com/Psiphon-Labs/tls-tris"
+)
+
+const (
+	MEEK_MAX_CERTIFICATE_POOL_SIZE = 16
+)
+
+// meekCertificatePool is a pool of self-signed web server certificates for
+// unfronted HTTPS meek. Presenting a population of certificates, rather than
+// one certificate for the lifetime of the server, weakens certificate based
+// detection of servers.
+//
+// Each certificate is generated independently, with a distinct random host
+// name subject, or no subject, and a distinct random validity period. When a
+// rotation period is configured, one certificate in the pool is replaced
+// with a newly generated certificate each period.
+//
+// The pool may also include operator-provided certificates, configured per
+// tunnel protocol with MeekServerProtocolCertificates, which are never
+// rotated. A provided certificate may be limited to clients offering
+// specific ALPN protocols.
+//
+// A certificate is selected for each TLS handshake. When the client sends an
+// SNI server name which matches a certificate subject, that certificate is
+// selected. Otherwise, when the client offers an ALPN protocol to which
+// provided certificates are limited, one of those certificates is selected.
+// Otherwise, the certificate is selected using a keyed hash of the client IP
+// address, so that repeated connections from the same client see the same
+// certificate, until it is rotated out of the pool, while different clients
+// see different certificates.
+type meekCertificatePool struct {
+	selectionKey   []byte
+	rotationPeriod time.Duration
+	mutex          sync.Mutex
+	configured     []*meekPoolCertificate
+	certificates   []*meekPoolCertificate
+	nextRotation   int
+}
+
+type meekPoolCertificate struct {
+	commonName    string
+	serverNames   []string
+	alpnProtocols []string
+	certificate   *tris.Certificate
+}
+
+func newMeekCertificatePool(
+	size int, rotationPeriod time.Duration) (*meekCertificatePool, error) {
+
+	if size < 1 {
+		return nil, common.ContextError(errors.New("invalid certificate pool size"))
+	}
+
+	return makeMeekCertificatePool(size, rotationPeriod, nil)
+}
+
+// newMeekProtocolCertificatePool creates the certificate pool for a tunnel
+// protocol configured in MeekServerProtocolCertificates.
+func newMeekProtocolCertificatePool(
+	config MeekServerCertificatesConfig) (*meekCertificatePool, error) {
+
+	var configured []*meekPoolCertificate
+	for _, certificateConfig := range config.Certificates {
+		poolCertificate, err := makeMeekConfiguredCertificate(certificateConfig)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		configured = append(configured, poolCertificate)
+	}
+
+	if config.PoolSize < 1 && len(configured) == 0 {
+		return nil, common.ContextError(errors.New("invalid certificate pool size"))
+	}
+
+	return makeMeekCertificatePool(
+		config.PoolSize,
+		time.Duration(config.RotationPeriodSeconds)*time.Second,
+		configured)
+}
+
+func makeMeekCertificatePool(
+	size int,
+	rotationPeriod time.Duration,
+	configured []*meekPoolCertificate) (*meekCertificatePool, error) {
+
+	if size < 0 || size > MEEK_MAX_CERTIFICATE_POOL_SIZE {
+		return nil, common.ContextError(errors.New("invalid certificate pool size"))
+	}
+
+	selectionKey, err := common.MakeSecureRandomBytes(32)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	pool := &meekCertificatePool{
+		selectionKey:   selectionKey,
+		rotationPeriod: rotationPeriod,
+		configured:     configured,
+		certificates:   make([]*meekPoolCertificate, size),
+	}
+
+	for i := 0; i < size; i++ {
+		pool.certificates[i], err = generateMeekPoolCertificate()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	return pool, nil
+}
+
+func generateMeekPoolCertificate() (*meekPoolCertificate, error) {
+
+	// Some certificates are generated without a subject, as is the case for
+	// the certificates of some other services.
+
+	commonName := ""
+	if common.FlipCoin() {
+		commonName = common.GenerateHostName()
+	}
+
+	certificate, privateKey, err := common.GenerateWebServerCertificate(commonName)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	tlsCertificate, err := tris.X509KeyPair(
+		[]byte(certificate), []byte(privateKey))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &meekPoolCertificate{
+		commonName:  commonName,
+		certificate: &tlsCertificate,
+	}, nil
+}
+
+// makeMeekConfiguredCertificate loads an operator-provided certificate. The
+// certificate subject common name and DNS names are matched against SNI
+// server names.
+func makeMeekConfiguredCertificate(
+	config MeekServerCertificateConfig) (*meekPoolCertificate, error) {
+
+	tlsCertificate, err := tris.X509KeyPair(
+		[]byte(config.Certificate), []byte(config.PrivateKey))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	leaf, err := x509.ParseCertificate(tlsCertificate.Certificate[0])
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &meekPoolCertificate{
+		commonName:    leaf.Subject.CommonName,
+		serverNames:   leaf.DNSNames,
+		alpnProtocols: config.ALPNProtocols,
+		certificate:   &tlsCertificate,
+	}, nil
+}
+
+func (poolCertificate *meekPoolCertificate) matchesServerName(serverName string) bool {
+	return serverName != "" &&
+		(poolCertificate.commonName == serverName ||
+			common.Contains(poolCertificate.serverNames, serverName))
+}
+
+// getCertificate is a tris.Config.GetCertificate callback which selects a
+// certificate from the pool.
+func (pool *meekCertificatePool) getCertificate(
+	clientHello *tris.ClientHelloInfo) (*tris.Certificate, error) {
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	// Certificates limited to ALPN protocols the client doesn't offer are
+	// excluded. Certificates limited to ALPN protocols the client does
+	// offer are preferred.
+
+	var alpnCertificates, otherCertificates []*meekPoolCertificate
+	for _, poolCertificate := range pool.configured {
+		if len(poolCertificate.alpnProtocols) == 0 {
+			otherCertificates = append(otherCertificates, poolCertificate)
+		} else if common.ContainsAny(
+			poolCertificate.alpnProtocols, clientHello.SupportedProtos) {
+			alpnCertificates = append(alpnCertificates, poolCertificate)
+		}
+	}
+	otherCertificates = append(otherCertificates, pool.certificates...)
+
+	for _, candidates := range [][]*meekPoolCertificate{
+		alpnCertificates, otherCertificates} {
+
+		for _, poolCertificate := range candidates {
+			if poolCertificate.matchesServerName(clientHello.ServerName) {
+				return poolCertificate.certificate, nil
+			}
+		}
+	}
+
+	candidates := alpnCertificates
+	if len(candidates) == 0 {
+		candidates = otherCertificates
+	}
+	if len(candidates) == 0 {
+		// All certificates are limited to ALPN protocols the client
+		// doesn't offer.
+		candidates = pool.configured
+	}
+
+	index := 0
+	if clientHello.Conn != nil {
+		clientIP := common.IPAddressFromAddr(clientHello.Conn.RemoteAddr())
+		mac := hmac.New(sha256.New, pool.selectionKey)
+		mac.Write([]byte(clientIP))
+		index = int(binary.BigEndian.Uint64(mac.Sum(nil)) % uint64(len(candidates)))
+	}
+
+	return candidates[index].certificate, nil
+}
+
+// rotate replaces the next generated certificate in the pool.
+func (pool *meekCertificatePool) rotate() error {
+
+	if len(pool.certificates) == 0 {
+		return nil
+	}
+
+	// Generate the new certificate without holding the mutex, as key
+	// generation may take some time.
+
+	poolCertificate, err := generateMeekPoolCertificate()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	pool.mutex.Lock()
+	pool.certificates[pool.nextRotation] = poolCertificate
+	pool.nextRotation = (pool.nextRotation + 1) % len(pool.certificates)
+	pool.mutex.Unlock()
+
+	return nil
+}
+
+// run rotates certificates each rotation period until stopBroadcast is
+// signaled. run returns immediately when no rotation period is configured
+// or when the pool has no generated certificates.
+func (pool *meekCertificatePool) run(stopBroadcast <-chan struct{}) {
+
+	if pool.rotationPeriod <= 0 || len(pool.certificates) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(pool.rotationPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := pool.rotate()
+			if err != nil {
+				log.WithContextFields(LogFields{"error": err}).Warning(
+					"meek certificate rotation failed")
+			}
+		case <-stopBroadcast:
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// meekRequestRateLimiter is a token bucket which limits the rate of requests
+// in a single meek session. The bucket holds up to burst tokens, starts
+// full, and is refilled at rate tokens per second; each admitted request
+// consumes one token.
+type meekRequestRateLimiter struct {
+	mutex          sync.Mutex
+	rate           float64
+	burst          float64
+	tokens         float64
+	lastRefillTime monotime.Time
+}
+
+// newMeekRequestRateLimiter initializes a new meekRequestRateLimiter. nil,
+// which admits all requests, is returned when rate is 0.
+func newMeekRequestRateLimiter(rate, burst int) *meekRequestRateLimiter {
+
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &meekRequestRateLimiter{
+		rate:           float64(rate),
+		burst:          float64(burst),
+		tokens:         float64(burst),
+		lastRefillTime: monotime.Now(),
+	}
+}
+
+// allow indicates whether a request is admitted, consuming a token when
+// admitted.
+func (limiter *meekRequestRateLimiter) allow() bool {
+
+	if limiter == nil {
+		return true
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := monotime.Now()
+	elapsed := now.Sub(limiter.lastRefillTime)
+	limiter.lastRefillTime = now
+
+	limiter.tokens += limiter.rate * float64(elapsed) / float64(time.Second)
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+
+	if limiter.tokens < 1.0 {
+		return false
+	}
+
+	limiter.tokens -= 1.0
+	return true
+}
+
+// getMeekRequestRateLimiter returns a meekRequestRateLimiter configured by
+// the MeekServerSessionRequestRateLimit tactics parameters for the client's
+// region, or nil when requests are not limited.
+func (server *MeekServer) getMeekRequestRateLimiter(
+	clientIP string) *meekRequestRateLimiter {
+
+	if server.support.TacticsServer == nil {
+		return nil
+	}
+
+	geoIPData := server.support.GeoIPService.Lookup(clientIP)
+
+	p, err := server.support.TacticsServer.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for meek session")
+		return nil
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	return newMeekRequestRateLimiter(
+		p.Int(parameters.MeekServerSessionRequestRateLimit),
+		p.Int(parameters.MeekServerSessionRequestBurst))
+}
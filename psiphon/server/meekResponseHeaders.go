@@ -0,0 +1,371 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"sort"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// meekResponseHeader is a single response header field in a
+// meekResponseHeaderTemplate. The name is emitted with the exact casing
+// specified.
+type meekResponseHeader struct {
+	name  string
+	value string
+}
+
+// meekResponseHeaderTemplate is an ordered list of response header fields
+// which meek server responses emit, in order and with the specified casing,
+// in place of the stock Go net/http response headers. Go's net/http sorts
+// response headers by name, which differs from the ordering emitted by
+// common origin stacks and is detectable by a CDN-side inspector.
+//
+// Header values are determined as follows:
+//
+// - "Date" is always set to the current time.
+//
+// - "Transfer-Encoding" is always set to "chunked", which is the response
+// body framing used by meekTemplateResponseWriter.
+//
+// - For any other field, a value set by the handler has priority over the
+// template value. When both are empty, the field is omitted.
+//
+// Handler set header fields not named in the template, such as Set-Cookie in
+// templates which omit it, are emitted after the template fields.
+type meekResponseHeaderTemplate []meekResponseHeader
+
+// meekResponseHeaderTemplates are the named templates which may be selected
+// with the MeekServerResponseHeaderTemplate tactics parameter. The header
+// field order and values are those emitted by the corresponding origin
+// stacks.
+var meekResponseHeaderTemplates = map[string]meekResponseHeaderTemplate{
+	"nginx": {
+		{"Server", "nginx"},
+		{"Date", ""},
+		{"Content-Type", "application/octet-stream"},
+		{"Transfer-Encoding", ""},
+		{"Connection", "keep-alive"},
+		{"Set-Cookie", ""},
+		{"Cache-Control", "no-cache"},
+	},
+	"apache": {
+		{"Date", ""},
+		{"Server", "Apache"},
+		{"Set-Cookie", ""},
+		{"Cache-Control", "no-cache, private"},
+		{"Keep-Alive", "timeout=5, max=100"},
+		{"Connection", "Keep-Alive"},
+		{"Transfer-Encoding", ""},
+		{"Content-Type", "application/octet-stream"},
+	},
+	"iis": {
+		{"Cache-Control", "private"},
+		{"Transfer-Encoding", ""},
+		{"Content-Type", "application/octet-stream"},
+		{"Server", "Microsoft-IIS/10.0"},
+		{"Set-Cookie", ""},
+		{"X-AspNet-Version", "4.0.30319"},
+		{"X-Powered-By", "ASP.NET"},
+		{"Date", ""},
+	},
+}
+
+// getMeekResponseHeaderTemplate returns the response header template
+// selected by tactics for the specified client, or nil when the stock
+// response headers are to be used.
+func (server *MeekServer) getMeekResponseHeaderTemplate(clientIP string) meekResponseHeaderTemplate {
+
+	if server.support.TacticsServer == nil {
+		return nil
+	}
+
+	geoIPData := server.support.GeoIPService.Lookup(clientIP)
+
+	p, err := server.support.TacticsServer.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for meek session")
+		return nil
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	name := p.String(parameters.MeekServerResponseHeaderTemplate)
+	if name == "" {
+		return nil
+	}
+
+	template, ok := meekResponseHeaderTemplates[name]
+	if !ok {
+		log.WithContextFields(LogFields{"template": name}).Warning(
+			"unknown meek response header template")
+		return nil
+	}
+
+	return template
+}
+
+// meekTemplateResponseWriter is a http.ResponseWriter which writes HTTP/1.1
+// responses directly to a hijacked HTTP connection, emitting the response
+// headers as specified by a meekResponseHeaderTemplate. Response bodies are
+// always chunked.
+//
+// As the http.Server no longer serves a hijacked connection, subsequent
+// requests on the connection are read and dispatched by
+// MeekServer.serveTemplateConn, which retains HTTP keep-alive behavior.
+type meekTemplateResponseWriter struct {
+	conn          net.Conn
+	readWriter    *bufio.ReadWriter
+	template      meekResponseHeaderTemplate
+	header        http.Header
+	wroteHeader   bool
+	chunkedWriter io.WriteCloser
+	hijacked      bool
+}
+
+// newMeekTemplateResponseWriter hijacks the connection underlying the
+// specified http.ResponseWriter. The request body must already be fully
+// consumed, as it may not be read after a hijack.
+func newMeekTemplateResponseWriter(
+	responseWriter http.ResponseWriter,
+	template meekResponseHeaderTemplate) (*meekTemplateResponseWriter, error) {
+
+	hijacker, ok := responseWriter.(http.Hijacker)
+	if !ok {
+		return nil, common.ContextError(errors.New("response writer is not a hijacker"))
+	}
+
+	// Retain any header fields, such as Set-Cookie, set before the hijack.
+	header := make(http.Header)
+	for name, values := range responseWriter.Header() {
+		header[name] = values
+	}
+
+	conn, readWriter, err := hijacker.Hijack()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return &meekTemplateResponseWriter{
+		conn:       conn,
+		readWriter: readWriter,
+		template:   template,
+		header:     header,
+	}, nil
+}
+
+// Header implements the http.ResponseWriter interface.
+func (writer *meekTemplateResponseWriter) Header() http.Header {
+	return writer.header
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (writer *meekTemplateResponseWriter) WriteHeader(statusCode int) {
+
+	if writer.wroteHeader {
+		return
+	}
+	writer.wroteHeader = true
+
+	bufWriter := writer.readWriter.Writer
+
+	fmt.Fprintf(bufWriter, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+
+	emitted := make(map[string]bool)
+
+	for _, field := range writer.template {
+
+		canonicalName := textproto.CanonicalMIMEHeaderKey(field.name)
+		emitted[canonicalName] = true
+
+		switch canonicalName {
+		case "Date":
+			fmt.Fprintf(bufWriter, "%s: %s\r\n",
+				field.name, time.Now().UTC().Format(http.TimeFormat))
+		case "Transfer-Encoding":
+			fmt.Fprintf(bufWriter, "%s: chunked\r\n", field.name)
+		default:
+			values := writer.header[canonicalName]
+			if len(values) == 0 && field.value != "" {
+				values = []string{field.value}
+			}
+			for _, value := range values {
+				fmt.Fprintf(bufWriter, "%s: %s\r\n", field.name, value)
+			}
+		}
+	}
+
+	// Chunked framing is required, so a Transfer-Encoding field is emitted
+	// even when the template omits it.
+	if !emitted["Transfer-Encoding"] {
+		bufWriter.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+
+	var names []string
+	for name := range writer.header {
+		if !emitted[textproto.CanonicalMIMEHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range writer.header[name] {
+			fmt.Fprintf(bufWriter, "%s: %s\r\n", name, value)
+		}
+	}
+
+	bufWriter.WriteString("\r\n")
+
+	writer.chunkedWriter = httputil.NewChunkedWriter(bufWriter)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (writer *meekTemplateResponseWriter) Write(buffer []byte) (int, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	if len(buffer) == 0 {
+		// A zero length chunk would terminate the response body.
+		return 0, nil
+	}
+	return writer.chunkedWriter.Write(buffer)
+}
+
+// Hijack implements the http.Hijacker interface. After Hijack, the
+// connection is no longer served by MeekServer.serveTemplateConn.
+func (writer *meekTemplateResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	writer.hijacked = true
+	return writer.conn, writer.readWriter, nil
+}
+
+// finishResponse completes the current response, writing any outstanding
+// headers and the terminating chunk, and flushes it to the connection.
+func (writer *meekTemplateResponseWriter) finishResponse() error {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+	err := writer.chunkedWriter.Close()
+	if err != nil {
+		return common.ContextError(err)
+	}
+	_, err = writer.readWriter.Writer.WriteString("\r\n")
+	if err != nil {
+		return common.ContextError(err)
+	}
+	err = writer.readWriter.Writer.Flush()
+	if err != nil {
+		return common.ContextError(err)
+	}
+	return nil
+}
+
+// reset prepares the writer for the next response on the connection.
+func (writer *meekTemplateResponseWriter) reset() {
+	writer.header = make(http.Header)
+	writer.wroteHeader = false
+	writer.chunkedWriter = nil
+}
+
+// serveTemplateConn completes the response in progress and then serves
+// subsequent requests on the hijacked connection, until the client closes
+// the connection, a request or response fails, or the connection is idle
+// for MEEK_HTTP_CLIENT_IO_TIMEOUT. closeConn indicates that the connection
+// is to be closed after the response in progress.
+func (server *MeekServer) serveTemplateConn(
+	writer *meekTemplateResponseWriter, closeConn bool) {
+
+	// The http.Server stops tracking the connection once hijacked; track it
+	// here so that the connection is closed on shutdown.
+	server.openConns.Add(writer.conn)
+	defer func() {
+		server.openConns.Remove(writer.conn)
+		writer.conn.Close()
+	}()
+
+	for {
+
+		if writer.hijacked {
+			// The handler took over the connection, as in
+			// common.TerminateHTTPConnection.
+			return
+		}
+
+		err := writer.finishResponse()
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Debug("write response failed")
+			return
+		}
+
+		if closeConn {
+			return
+		}
+
+		// The deadline covers both awaiting and handling the request, as
+		// with the http.Server ReadTimeout and WriteTimeout.
+		writer.conn.SetDeadline(time.Now().Add(MEEK_HTTP_CLIENT_IO_TIMEOUT))
+
+		request, err := http.ReadRequest(writer.readWriter.Reader)
+		if err != nil {
+			// Debug since clients commonly close idle connections.
+			if err != io.EOF {
+				log.WithContextFields(LogFields{"error": err}).Debug("read request failed")
+			}
+			return
+		}
+
+		request.RemoteAddr = writer.conn.RemoteAddr().String()
+
+		writer.reset()
+
+		server.handleRequest(writer, request)
+
+		if writer.hijacked {
+			return
+		}
+
+		// Any unread request body must be consumed before the next request
+		// may be read. Limit this to the maximum meek request payload size.
+		n, err := io.Copy(
+			ioutil.Discard,
+			io.LimitReader(request.Body, MEEK_MAX_REQUEST_PAYLOAD_LENGTH+1))
+		request.Body.Close()
+		if err != nil || n > MEEK_MAX_REQUEST_PAYLOAD_LENGTH {
+			return
+		}
+
+		closeConn = request.Close
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Psiphon-Labs/net/http2"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	tris "github.com/Psiphon-Labs/tls-tris"
+)
+
+// checkSNIServerName applies the MeekServerAllowedSNIServerNames and
+// MeekServerUnexpectedSNIBehavior tactics parameters to an unfronted meek
+// TLS handshake. checkSNIServerName returns false when the handshake must
+// be aborted, in which case the client connection is already closed, so
+// that no TLS alert is sent. When the SNI server name is unexpected and the
+// behavior is MEEK_SERVER_UNEXPECTED_SNI_DECOY, the connection is recorded
+// as a decoy connection, to be served by serveMeekDecoyConn after the
+// handshake completes.
+func (server *MeekServer) checkSNIServerName(
+	clientHello *tris.ClientHelloInfo,
+	p *parameters.ClientParametersSnapshot) bool {
+
+	if isAllowedSNIServerName(
+		clientHello.ServerName, p.Strings(parameters.MeekServerAllowedSNIServerNames)) {
+		return true
+	}
+
+	behavior := p.String(parameters.MeekServerUnexpectedSNIBehavior)
+
+	// Debug since unexpected SNI server names are expected from scanners.
+	log.WithContextFields(LogFields{
+		"sni_server_name": clientHello.ServerName,
+		"behavior":        behavior,
+	}).Debug("unexpected meek SNI server name")
+
+	if behavior == parameters.MEEK_SERVER_UNEXPECTED_SNI_DECOY {
+		server.decoyConns.Store(clientHello.Conn, true)
+		return true
+	}
+
+	clientHello.Conn.Close()
+	return false
+}
+
+// isDecoyConn returns whether conn was recorded as a decoy connection by
+// checkSNIServerName, and clears the record.
+func (server *MeekServer) isDecoyConn(conn net.Conn) bool {
+	_, ok := server.decoyConns.Load(conn)
+	if ok {
+		server.decoyConns.Delete(conn)
+	}
+	return ok
+}
+
+// isAllowedSNIServerName returns true when serverName matches an entry in
+// allowedServerNames, or when allowedServerNames is empty. An entry
+// "*.<domain>" matches any subdomain of <domain>.
+func isAllowedSNIServerName(serverName string, allowedServerNames []string) bool {
+
+	if len(allowedServerNames) == 0 {
+		return true
+	}
+
+	serverName = strings.ToLower(serverName)
+
+	for _, allowedServerName := range allowedServerNames {
+		allowedServerName = strings.ToLower(allowedServerName)
+		if strings.HasPrefix(allowedServerName, "*.") {
+			if strings.HasSuffix(serverName, allowedServerName[1:]) &&
+				len(serverName) > len(allowedServerName)-1 {
+				return true
+			}
+		} else if serverName == allowedServerName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveMeekDecoyConn serves a decoy connection, blocking until the
+// connection is closed. Every request receives the same 404 response as
+// requests outside of the meek path, and no request is handled as a meek
+// request.
+func serveMeekDecoyConn(conn net.Conn, negotiatedProtocol string) {
+
+	defer conn.Close()
+
+	if negotiatedProtocol == protocol.ALPN_PROTOCOL_HTTP2 {
+		http2Server := &http2.Server{
+			IdleTimeout: MEEK_HTTP_CLIENT_IO_TIMEOUT,
+		}
+		http2Server.ServeConn(
+			conn,
+			&http2.ServeConnOpts{Handler: http.HandlerFunc(http.NotFound)})
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+
+	for {
+
+		conn.SetDeadline(time.Now().Add(MEEK_HTTP_CLIENT_IO_TIMEOUT))
+
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		_, err = io.Copy(
+			ioutil.Discard,
+			io.LimitReader(request.Body, MEEK_DEFAULT_MAX_REQUEST_BODY_LENGTH))
+		request.Body.Close()
+		if err != nil {
+			return
+		}
+
+		// The response matches the net/http http.NotFound response.
+
+		body := "404 page not found\n"
+		response := &http.Response{
+			StatusCode:    http.StatusNotFound,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Request:       request,
+			Header:        make(http.Header),
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Close:         request.Close,
+		}
+		response.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		response.Header.Set("X-Content-Type-Options", "nosniff")
+		response.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+		err = response.Write(conn)
+		if err != nil || request.Close {
+			return
+		}
+	}
+}
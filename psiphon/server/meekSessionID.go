@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// getMeekSessionIDRotationPeriod returns the session ID rotation period and
+// jitter selected by the MeekServerSessionIDRotationPeriod tactics
+// parameters for the client's region. A 0 period disables rotation.
+func (server *MeekServer) getMeekSessionIDRotationPeriod(
+	clientIP string) (time.Duration, float64) {
+
+	if server.support.TacticsServer == nil {
+		return 0, 0.0
+	}
+
+	geoIPData := server.support.GeoIPService.Lookup(clientIP)
+
+	p, err := server.support.TacticsServer.GetServerSideParameters(
+		common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for meek session")
+		return 0, 0.0
+	}
+
+	if p == nil {
+		return 0, 0.0
+	}
+
+	return p.Duration(parameters.MeekServerSessionIDRotationPeriod),
+		p.Float(parameters.MeekServerSessionIDRotationPeriodJitter)
+}
+
+// getSessionIDToSend returns the session ID to send to the client in the
+// response to the current request, or "" when no session ID is to be sent.
+// sessionToken is the session token sent by the client in the current
+// request. The caller must hold session.lock.
+//
+// The initial session ID is sent once, in the first response.
+//
+// When session ID rotation is enabled and the rotation period has elapsed,
+// a replacement session ID is issued. The session is mapped by both the
+// current and the replacement session ID until the client demonstrates,
+// by sending a request with the replacement session ID, that it has
+// adopted it; only then is the current session ID mapping removed. Until
+// then, the replacement session ID is sent in every response, so a
+// response lost in transit doesn't strand the client, and the client may
+// continue to retry requests using the current session ID. The session's
+// relay state and cached response are unaffected by rotation, so no tunnel
+// data is lost.
+//
+// MEEK_PROTOCOL_VERSION_1 sessions don't use session IDs and aren't
+// rotated.
+func (server *MeekServer) getSessionIDToSend(
+	session *meekSession, sessionToken string) (string, error) {
+
+	if session.meekProtocolVersion < MEEK_PROTOCOL_VERSION_2 {
+		return "", nil
+	}
+
+	if !session.sessionIDSent {
+		session.sessionIDSent = true
+		session.scheduleSessionIDRotation()
+		return session.sessionID, nil
+	}
+
+	if session.pendingSessionID != "" {
+
+		if sessionToken != session.pendingSessionID {
+			return session.pendingSessionID, nil
+		}
+
+		// The client has adopted the replacement session ID.
+
+		server.sessionsLock.Lock()
+		delete(server.sessions, session.sessionID)
+		session.sessionID = session.pendingSessionID
+		session.pendingSessionID = ""
+		server.sessionsLock.Unlock()
+
+		atomic.AddInt64(&session.metricSessionIDRotations, 1)
+
+		session.scheduleSessionIDRotation()
+		return "", nil
+	}
+
+	if session.sessionIDRotationPeriod <= 0 ||
+		monotime.Now().Before(session.nextSessionIDRotation) {
+		return "", nil
+	}
+
+	pendingSessionID, err := makeMeekSessionID()
+	if err != nil {
+		return "", common.ContextError(err)
+	}
+
+	server.sessionsLock.Lock()
+	server.sessions[pendingSessionID] = session
+	session.pendingSessionID = pendingSessionID
+	server.sessionsLock.Unlock()
+
+	return pendingSessionID, nil
+}
+
+// scheduleSessionIDRotation sets the time of the next session ID rotation.
+// The caller must hold session.lock.
+func (session *meekSession) scheduleSessionIDRotation() {
+	if session.sessionIDRotationPeriod <= 0 {
+		return
+	}
+	session.nextSessionIDRotation = monotime.Now().Add(
+		common.JitterDuration(
+			session.sessionIDRotationPeriod, session.sessionIDRotationJitter))
+}
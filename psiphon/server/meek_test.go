@@ -22,12 +22,23 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
 	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -36,6 +47,9 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/nacl/box"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+	tris "github.com/Psiphon-Labs/tls-tris"
 )
 
 var KB = 1024
@@ -537,3 +551,1902 @@ func TestMeekRateLimiter(t *testing.T) {
 	// This wait will hang if shutdown is broken, and the test will ultimately panic
 	serverWaitGroup.Wait()
 }
+
+func TestMeekResponseHeaderTemplate(t *testing.T) {
+
+	// Run meek server, with tactics selecting a response header template
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-meek-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	tacticsConfigJSON := `
+    {
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "MeekServerResponseHeaderTemplate" : "nginx"
+        }
+      }
+    }
+    `
+
+	tacticsConfigFilename := filepath.Join(testDataDirName, "tactics_config.json")
+	err = ioutil.WriteFile(tacticsConfigFilename, []byte(tacticsConfigJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	tacticsServer, err := tactics.NewServer(
+		CommonLogger(log), nil, nil, tacticsConfigFilename)
+	if err != nil {
+		t.Fatalf("tactics.NewServer failed: %s", err)
+	}
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+		GeoIPService:    &GeoIPService{},
+		TacticsServer:   tacticsServer,
+	}
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	listener := &recordingListener{Listener: tcpListener}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	stopBroadcast := make(chan struct{})
+
+	server, err := NewMeekServer(
+		mockSupport,
+		listener,
+		false,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		stopBroadcast)
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	serverWaitGroup := new(sync.WaitGroup)
+
+	serverWaitGroup.Add(1)
+	go func() {
+		defer serverWaitGroup.Done()
+		server.Run()
+	}()
+
+	// Run meek client and relay multiple round trips, which exercises
+	// serving additional requests on the hijacked connection
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters:              clientParameters,
+		DialAddress:                   serverAddress,
+		HostHeader:                    "example.com",
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		message := []byte(fmt.Sprintf("message %d", i))
+		_, err := clientConn.Write(message)
+		if err != nil {
+			t.Fatalf("conn.Write failed: %s", err)
+		}
+		response := make([]byte, len(message))
+		for received := 0; received < len(response); {
+			n, err := clientConn.Read(response[received:])
+			if err != nil {
+				t.Fatalf("conn.Read failed: %s", err)
+			}
+			received += n
+		}
+		if !bytes.Equal(message, response) {
+			t.Fatalf("unexpected response: %s", response)
+		}
+	}
+
+	clientConn.Close()
+	listener.Close()
+	close(stopBroadcast)
+	serverWaitGroup.Wait()
+
+	// Check that every response emitted the template header order
+
+	expectedNames := []string{
+		"Server", "Date", "Content-Type", "Transfer-Encoding",
+		"Connection", "Set-Cookie", "Cache-Control"}
+
+	responses := strings.Split(listener.written(), "HTTP/1.1 ")
+	if len(responses) < 3 {
+		t.Fatalf("unexpected response count: %d", len(responses)-1)
+	}
+
+	for i, response := range responses[1:] {
+
+		headerBlock := strings.SplitN(response, "\r\n\r\n", 2)[0]
+		lines := strings.Split(headerBlock, "\r\n")[1:]
+
+		var names []string
+		for _, line := range lines {
+			names = append(names, strings.SplitN(line, ":", 2)[0])
+		}
+
+		// The session ID Set-Cookie is sent only in the first response.
+		expected := expectedNames
+		if i > 0 {
+			expected = []string{
+				"Server", "Date", "Content-Type", "Transfer-Encoding",
+				"Connection", "Cache-Control"}
+		}
+
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Fatalf("unexpected headers in response %d: %v", i, names)
+		}
+	}
+}
+
+func TestMeekALPN(t *testing.T) {
+
+	// Run unfronted meek HTTPS server, with tactics selecting the ALPN
+	// protocols and a response header template, which is not applied to
+	// HTTP/2 connections
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-meek-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	tacticsConfigJSON := `
+    {
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "MeekServerALPNProtocols" : ["h2", "http/1.1"],
+          "MeekServerResponseHeaderTemplate" : "nginx"
+        }
+      }
+    }
+    `
+
+	tacticsConfigFilename := filepath.Join(testDataDirName, "tactics_config.json")
+	err = ioutil.WriteFile(tacticsConfigFilename, []byte(tacticsConfigJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	tacticsServer, err := tactics.NewServer(
+		CommonLogger(log), nil, nil, tacticsConfigFilename)
+	if err != nil {
+		t.Fatalf("tactics.NewServer failed: %s", err)
+	}
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+		GeoIPService:    &GeoIPService{},
+		TacticsServer:   tacticsServer,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	stopBroadcast := make(chan struct{})
+
+	server, err := NewMeekServer(
+		mockSupport,
+		listener,
+		true,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		stopBroadcast)
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	serverWaitGroup := new(sync.WaitGroup)
+
+	serverWaitGroup.Add(1)
+	go func() {
+		defer serverWaitGroup.Done()
+		server.Run()
+	}()
+
+	// Check the protocol negotiated with clients offering various ALPN
+	// protocols. A client offering no common protocol is served HTTP/1.1.
+
+	for _, testCase := range []struct {
+		nextProtos []string
+		expected   string
+	}{
+		{[]string{"h2", "http/1.1"}, "h2"},
+		{[]string{"http/1.1"}, "http/1.1"},
+		{[]string{"spdy/3"}, ""},
+		{nil, ""},
+	} {
+		conn, err := tls.Dial(
+			"tcp",
+			serverAddress,
+			&tls.Config{InsecureSkipVerify: true, NextProtos: testCase.nextProtos})
+		if err != nil {
+			t.Fatalf("tls.Dial failed: %s", err)
+		}
+		negotiatedProtocol := conn.ConnectionState().NegotiatedProtocol
+		conn.Close()
+		if negotiatedProtocol != testCase.expected {
+			t.Fatalf("unexpected negotiated protocol for %v: %s",
+				testCase.nextProtos, negotiatedProtocol)
+		}
+	}
+
+	// Run meek clients using HTTP/2 and HTTP/1.1 and relay multiple round
+	// trips
+
+	for _, clientALPNProtocols := range [][]string{{"h2"}, {"http/1.1"}} {
+
+		clientParameters, err := parameters.NewClientParameters(nil)
+		if err != nil {
+			t.Fatalf("NewClientParameters failed: %s", err)
+		}
+
+		_, err = clientParameters.Set("", false, map[string]interface{}{
+			"MeekClientALPNProtocols": clientALPNProtocols,
+		})
+		if err != nil {
+			t.Fatalf("ClientParameters.Set failed: %s", err)
+		}
+
+		meekConfig := &psiphon.MeekConfig{
+			ClientParameters:              clientParameters,
+			DialAddress:                   serverAddress,
+			UseHTTPS:                      true,
+			TLSProfile:                    protocol.TLS_PROFILE_TLS13_RANDOMIZED,
+			ClientTunnelProtocol:          protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+			HostHeader:                    "example.com",
+			MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+			MeekObfuscatedKey:             meekObfuscatedKey,
+		}
+
+		ctx, cancelFunc := context.WithTimeout(
+			context.Background(), time.Second*5)
+		defer cancelFunc()
+
+		clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+		if err != nil {
+			t.Fatalf("psiphon.DialMeek failed: %s", err)
+		}
+
+		for i := 0; i < 10; i++ {
+			message := []byte(fmt.Sprintf("message %d", i))
+			_, err := clientConn.Write(message)
+			if err != nil {
+				t.Fatalf("conn.Write failed: %s", err)
+			}
+			response := make([]byte, len(message))
+			for received := 0; received < len(response); {
+				n, err := clientConn.Read(response[received:])
+				if err != nil {
+					t.Fatalf("conn.Read failed: %s", err)
+				}
+				received += n
+			}
+			if !bytes.Equal(message, response) {
+				t.Fatalf("unexpected response: %s", response)
+			}
+		}
+
+		clientConn.Close()
+	}
+
+	listener.Close()
+	close(stopBroadcast)
+	serverWaitGroup.Wait()
+}
+
+func TestMeekPathPrefix(t *testing.T) {
+
+	// Run meek server, co-hosted under a path prefix
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	pathPrefix := "/api/v2/events"
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+			MeekPathPrefix:                 pathPrefix,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+		GeoIPService:    &GeoIPService{},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	stopBroadcast := make(chan struct{})
+
+	server, err := NewMeekServer(
+		mockSupport,
+		listener,
+		false,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		stopBroadcast)
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	serverWaitGroup := new(sync.WaitGroup)
+
+	serverWaitGroup.Add(1)
+	go func() {
+		defer serverWaitGroup.Done()
+		server.Run()
+	}()
+
+	// Requests outside of the prefix receive 404 Not Found
+
+	for _, path := range []string{"/", "/api/v2", "/api/v2/eventsX", "/index.html"} {
+		response, err := http.Get(fmt.Sprintf("http://%s%s", serverAddress, path))
+		if err != nil {
+			t.Fatalf("http.Get failed: %s", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNotFound {
+			t.Fatalf("unexpected status code for %s: %d", path, response.StatusCode)
+		}
+	}
+
+	// Run meek client with the prefix and relay multiple round trips
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters:              clientParameters,
+		DialAddress:                   serverAddress,
+		HostHeader:                    "example.com",
+		PathPrefix:                    pathPrefix,
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		message := []byte(fmt.Sprintf("message %d", i))
+		_, err := clientConn.Write(message)
+		if err != nil {
+			t.Fatalf("conn.Write failed: %s", err)
+		}
+		response := make([]byte, len(message))
+		for received := 0; received < len(response); {
+			n, err := clientConn.Read(response[received:])
+			if err != nil {
+				t.Fatalf("conn.Read failed: %s", err)
+			}
+			received += n
+		}
+		if !bytes.Equal(message, response) {
+			t.Fatalf("unexpected response: %s", response)
+		}
+	}
+
+	clientConn.Close()
+	listener.Close()
+	close(stopBroadcast)
+	serverWaitGroup.Wait()
+}
+
+func TestMeekMaxRequestBodyLength(t *testing.T) {
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	maxBodyLength := MEEK_MAX_REQUEST_PAYLOAD_LENGTH + 1024
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+			MeekMaxRequestBodyLength:       maxBodyLength,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+		GeoIPService:    &GeoIPService{},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	stopBroadcast := make(chan struct{})
+
+	server, err := NewMeekServer(
+		mockSupport,
+		listener,
+		false,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		stopBroadcast)
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	serverWaitGroup := new(sync.WaitGroup)
+
+	serverWaitGroup.Add(1)
+	go func() {
+		defer serverWaitGroup.Done()
+		server.Run()
+	}()
+
+	// An oversized request body is rejected, before the body is read, and
+	// the connection is terminated.
+
+	conn, err := net.Dial("tcp", serverAddress)
+	if err != nil {
+		t.Fatalf("net.Dial failed: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	bodyLength := 100 * maxBodyLength
+	_, err = fmt.Fprintf(
+		conn,
+		"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n",
+		bodyLength)
+	if err != nil {
+		t.Fatalf("conn.Write failed: %s", err)
+	}
+
+	// The connection may be reset, as the request body is unread.
+	response, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		t.Fatalf("connection not terminated: %s", err)
+	}
+	if len(response) > 0 && !bytes.HasPrefix(response, []byte("HTTP/1.1 404")) {
+		t.Fatalf("unexpected response: %s", response)
+	}
+
+	// The meek server continues to relay requests within the limit.
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters:              clientParameters,
+		DialAddress:                   serverAddress,
+		HostHeader:                    "example.com",
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+
+	message := bytes.Repeat([]byte("x"), MEEK_MAX_REQUEST_PAYLOAD_LENGTH)
+	_, err = clientConn.Write(message)
+	if err != nil {
+		t.Fatalf("conn.Write failed: %s", err)
+	}
+	received := make([]byte, len(message))
+	_, err = io.ReadFull(clientConn, received)
+	if err != nil {
+		t.Fatalf("conn.Read failed: %s", err)
+	}
+	if !bytes.Equal(message, received) {
+		t.Fatalf("unexpected response")
+	}
+
+	clientConn.Close()
+	listener.Close()
+	close(stopBroadcast)
+	serverWaitGroup.Wait()
+}
+
+func TestMeekChunkSizes(t *testing.T) {
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+		GeoIPService:    &GeoIPService{},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	stopBroadcast := make(chan struct{})
+
+	server, err := NewMeekServer(
+		mockSupport,
+		listener,
+		false,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 65536)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		stopBroadcast)
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	serverWaitGroup := new(sync.WaitGroup)
+
+	serverWaitGroup.Add(1)
+	go func() {
+		defer serverWaitGroup.Done()
+		server.Run()
+	}()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	chunkSize := 4096
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters:              clientParameters,
+		DialAddress:                   serverAddress,
+		HostHeader:                    "example.com",
+		MaxChunkSize:                  chunkSize,
+		MinChunkSize:                  1024,
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+
+	if clientConn.GetChunkSize() != chunkSize {
+		t.Fatalf("unexpected chunk size: %d", clientConn.GetChunkSize())
+	}
+
+	// The message spans many bounded request and response payloads.
+
+	message := bytes.Repeat([]byte("x"), MEEK_MAX_REQUEST_PAYLOAD_LENGTH)
+	_, err = clientConn.Write(message)
+	if err != nil {
+		t.Fatalf("conn.Write failed: %s", err)
+	}
+	received := make([]byte, len(message))
+	_, err = io.ReadFull(clientConn, received)
+	if err != nil {
+		t.Fatalf("conn.Read failed: %s", err)
+	}
+	if !bytes.Equal(message, received) {
+		t.Fatalf("unexpected response")
+	}
+
+	server.sessionsLock.Lock()
+	var session *meekSession
+	for _, s := range server.sessions {
+		session = s
+	}
+	server.sessionsLock.Unlock()
+
+	if session == nil {
+		t.Fatalf("missing session")
+	}
+
+	metrics := session.GetMetrics()
+	peakResponseSize := metrics["meek_peak_response_size"].(int64)
+	if peakResponseSize <= 0 || peakResponseSize > int64(chunkSize) {
+		t.Fatalf("unexpected peak response size: %d", peakResponseSize)
+	}
+
+	// Backoff halves the response chunk size, down to the minimum.
+
+	session.lock.Lock()
+	for i := 0; i < 3; i++ {
+		session.backOffResponseChunkSize()
+	}
+	session.lock.Unlock()
+
+	if session.GetMetrics()["meek_response_chunk_size"].(int64) != 1024 {
+		t.Fatalf("unexpected response chunk size")
+	}
+
+	clientConn.Close()
+	listener.Close()
+	close(stopBroadcast)
+	serverWaitGroup.Wait()
+}
+
+// recordingListener records all data written to accepted connections.
+type recordingListener struct {
+	net.Listener
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (listener *recordingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, listener: listener}, nil
+}
+
+func (listener *recordingListener) written() string {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	return listener.buffer.String()
+}
+
+type recordingConn struct {
+	net.Conn
+	listener *recordingListener
+}
+
+func (conn *recordingConn) Write(b []byte) (int, error) {
+	conn.listener.mutex.Lock()
+	conn.listener.buffer.Write(b)
+	conn.listener.mutex.Unlock()
+	return conn.Conn.Write(b)
+}
+
+func TestMeekSessionTokenLocations(t *testing.T) {
+
+	for _, location := range protocol.SupportedMeekSessionTokenLocations {
+		t.Run(location, func(t *testing.T) {
+			runMeekSessionTokenLocationTest(t, location)
+		})
+	}
+}
+
+func runMeekSessionTokenLocationTest(t *testing.T, location string) {
+
+	// Run meek server, recording requests to check the token location
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	tokenHeaderName := "X-Request-Tag"
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+			MeekSessionTokenHeaders:        []string{tokenHeaderName},
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+	}
+
+	var requestsMutex sync.Mutex
+	var requests []*http.Request
+
+	server, err := NewMeekServer(
+		mockSupport,
+		nil,
+		false,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		make(chan struct{}))
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(
+			func(responseWriter http.ResponseWriter, request *http.Request) {
+				requestsMutex.Lock()
+				requests = append(requests, request)
+				requestsMutex.Unlock()
+				server.ServeHTTP(responseWriter, request)
+			}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go httpServer.Serve(listener)
+
+	// Run meek client and relay multiple round trips, which requires the
+	// session ID to be returned and used
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"MeekSessionTokenLocation":   location,
+		"MeekSessionTokenHeaderName": tokenHeaderName,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters:              clientParameters,
+		DialAddress:                   listener.Addr().String(),
+		HostHeader:                    "example.com",
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	for i := 0; i < 10; i++ {
+		message := []byte(fmt.Sprintf("message %d", i))
+		_, err := clientConn.Write(message)
+		if err != nil {
+			t.Fatalf("conn.Write failed: %s", err)
+		}
+		response := make([]byte, len(message))
+		for received := 0; received < len(response); {
+			n, err := clientConn.Read(response[received:])
+			if err != nil {
+				t.Fatalf("conn.Read failed: %s", err)
+			}
+			received += n
+		}
+		if !bytes.Equal(message, response) {
+			t.Fatalf("unexpected response: %s", response)
+		}
+	}
+
+	// Check that the token was carried only in the configured location
+
+	requestsMutex.Lock()
+	defer requestsMutex.Unlock()
+
+	if len(requests) < 2 {
+		t.Fatalf("unexpected request count: %d", len(requests))
+	}
+
+	for _, request := range requests {
+		hasCookie := len(request.Cookies()) > 0
+		hasHeader := request.Header.Get(tokenHeaderName) != ""
+		hasQuery := request.URL.RawQuery != ""
+		if hasCookie != (location == protocol.MEEK_SESSION_TOKEN_LOCATION_COOKIE) ||
+			hasHeader != (location == protocol.MEEK_SESSION_TOKEN_LOCATION_HEADER) ||
+			hasQuery != (location == protocol.MEEK_SESSION_TOKEN_LOCATION_QUERY) {
+			t.Fatalf("unexpected token location in request: %+v", request)
+		}
+	}
+}
+
+func TestMeekSessionIDRotation(t *testing.T) {
+
+	// Run meek server, with tactics enabling session ID rotation, recording
+	// the session token sent in each request
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-meek-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	tacticsConfigJSON := `
+    {
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "MeekServerSessionIDRotationPeriod" : "1ms",
+          "MeekServerSessionIDRotationPeriodJitter" : 0.0
+        }
+      }
+    }
+    `
+
+	tacticsConfigFilename := filepath.Join(testDataDirName, "tactics_config.json")
+	err = ioutil.WriteFile(tacticsConfigFilename, []byte(tacticsConfigJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	tacticsServer, err := tactics.NewServer(
+		CommonLogger(log), nil, nil, tacticsConfigFilename)
+	if err != nil {
+		t.Fatalf("tactics.NewServer failed: %s", err)
+	}
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+		GeoIPService:    &GeoIPService{},
+		TacticsServer:   tacticsServer,
+	}
+
+	var sessionTokensMutex sync.Mutex
+	sessionTokens := make(map[string]bool)
+
+	server, err := NewMeekServer(
+		mockSupport,
+		nil,
+		false,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		make(chan struct{}))
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(
+			func(responseWriter http.ResponseWriter, request *http.Request) {
+				sessionToken, _, err := server.getSessionToken(request)
+				if err == nil {
+					sessionTokensMutex.Lock()
+					sessionTokens[sessionToken] = true
+					sessionTokensMutex.Unlock()
+				}
+				server.ServeHTTP(responseWriter, request)
+			}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go httpServer.Serve(listener)
+
+	// Run meek client and relay multiple round trips, with session ID
+	// rotations in between; every message must be relayed
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters:              clientParameters,
+		DialAddress:                   listener.Addr().String(),
+		HostHeader:                    "example.com",
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	for i := 0; i < 10; i++ {
+		message := []byte(fmt.Sprintf("message %d", i))
+		_, err := clientConn.Write(message)
+		if err != nil {
+			t.Fatalf("conn.Write failed: %s", err)
+		}
+		response := make([]byte, len(message))
+		for received := 0; received < len(response); {
+			n, err := clientConn.Read(response[received:])
+			if err != nil {
+				t.Fatalf("conn.Read failed: %s", err)
+			}
+			received += n
+		}
+		if !bytes.Equal(message, response) {
+			t.Fatalf("unexpected response: %s", response)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Check that the client used multiple session IDs, in addition to the
+	// initial meek cookie, for a single session, and that replaced session
+	// ID mappings were removed
+
+	sessionTokensMutex.Lock()
+	sessionTokenCount := len(sessionTokens)
+	sessionTokensMutex.Unlock()
+
+	if sessionTokenCount < 3 {
+		t.Fatalf("unexpected session token count: %d", sessionTokenCount)
+	}
+
+	server.sessionsLock.RLock()
+	sessionCount := len(server.sessions)
+	var session *meekSession
+	for _, s := range server.sessions {
+		if session != nil && s != session {
+			t.Fatalf("unexpected multiple sessions")
+		}
+		session = s
+	}
+	server.sessionsLock.RUnlock()
+
+	// A rotation may be pending, in which case the session is mapped by
+	// both its current and pending session IDs.
+	if sessionCount < 1 || sessionCount > 2 {
+		t.Fatalf("unexpected session mapping count: %d", sessionCount)
+	}
+
+	if atomic.LoadInt64(&session.metricSessionIDRotations) < 1 {
+		t.Fatalf("unexpected session ID rotation count")
+	}
+}
+
+func TestMeekRedirects(t *testing.T) {
+
+	t.Run("same origin", func(t *testing.T) {
+		runMeekRedirectTest(t, "/redirected", false)
+	})
+
+	t.Run("cross origin", func(t *testing.T) {
+		runMeekRedirectTest(t, "http://other.example.com/redirected", true)
+	})
+}
+
+func runMeekRedirectTest(t *testing.T, location string, expectFailure bool) {
+
+	// Run meek server, redirecting requests which are not to the redirect
+	// target path
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+	}
+
+	server, err := NewMeekServer(
+		mockSupport,
+		nil,
+		false,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		make(chan struct{}))
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	var redirectCount, relayCount int32
+
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(
+			func(responseWriter http.ResponseWriter, request *http.Request) {
+				if request.URL.Path != "/redirected" {
+					atomic.AddInt32(&redirectCount, 1)
+					http.Redirect(responseWriter, request, location, http.StatusFound)
+					return
+				}
+				atomic.AddInt32(&relayCount, 1)
+				server.ServeHTTP(responseWriter, request)
+			}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go httpServer.Serve(listener)
+
+	// Run meek client and relay multiple round trips
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"MeekMaxRedirects":           2,
+		"MeekRedirectSameOriginOnly": true,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	var interceptionDetected int32
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters: clientParameters,
+		DialAddress:      listener.Addr().String(),
+		HostHeader:       "example.com",
+		TLSInterceptionDetected: func(_ []string) {
+			atomic.StoreInt32(&interceptionDetected, 1)
+		},
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	for i := 0; i < 10; i++ {
+		message := []byte(fmt.Sprintf("message %d", i))
+		_, err := clientConn.Write(message)
+		if err == nil {
+			response := make([]byte, len(message))
+			for received := 0; received < len(response); {
+				var n int
+				n, err = clientConn.Read(response[received:])
+				if err != nil {
+					break
+				}
+				received += n
+			}
+			if err == nil && !bytes.Equal(message, response) {
+				t.Fatalf("unexpected response: %s", response)
+			}
+		}
+		if expectFailure {
+			if err == nil {
+				t.Fatalf("unexpected relay success")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("relay failed: %s", err)
+		}
+	}
+
+	// The redirect target is retained, so only the first request is
+	// redirected
+
+	if expectFailure {
+		if atomic.LoadInt32(&interceptionDetected) != 1 ||
+			atomic.LoadInt32(&relayCount) != 0 {
+			t.Fatalf("unexpected cross-origin redirect handling")
+		}
+	} else {
+		if atomic.LoadInt32(&interceptionDetected) != 0 ||
+			atomic.LoadInt32(&redirectCount) != 1 ||
+			atomic.LoadInt32(&relayCount) < 2 {
+			t.Fatalf("unexpected redirect handling: %d, %d",
+				atomic.LoadInt32(&redirectCount), atomic.LoadInt32(&relayCount))
+		}
+	}
+}
+
+func TestMeekURLSigning(t *testing.T) {
+
+	// Run meek server behind a front which, like a CDN requiring signed URLs,
+	// validates the HMAC token signature. The front rejects the first valid
+	// signature, as if it had expired, to exercise re-signing.
+
+	rawMeekCookieEncryptionPublicKey, rawMeekCookieEncryptionPrivateKey, err := box.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+	meekCookieEncryptionPublicKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPublicKey[:])
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(rawMeekCookieEncryptionPrivateKey[:])
+	meekObfuscatedKey, err := common.MakeSecureRandomStringHex(SSH_OBFUSCATED_KEY_BYTE_LENGTH)
+	if err != nil {
+		t.Fatalf("common.MakeSecureRandomStringHex failed: %s", err)
+	}
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              meekObfuscatedKey,
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+	}
+
+	server, err := NewMeekServer(
+		mockSupport,
+		nil,
+		false,
+		false,
+		false,
+		func(_ string, conn net.Conn) {
+			go func() {
+				buffer := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buffer)
+					if err == nil {
+						_, err = conn.Write(buffer[:n])
+					}
+					if err != nil {
+						conn.Close()
+						break
+					}
+				}
+			}()
+		},
+		make(chan struct{}))
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	signingKey := []byte("signing key")
+
+	var rejectedCount, invalidCount, relayCount int32
+
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(
+			func(responseWriter http.ResponseWriter, request *http.Request) {
+				token := strings.SplitN(request.URL.Query().Get("token"), "_", 2)
+				valid := false
+				if len(token) == 2 {
+					mac := hmac.New(sha256.New, signingKey)
+					mac.Write([]byte(request.URL.EscapedPath() + token[0]))
+					valid = token[1] == hex.EncodeToString(mac.Sum(nil))
+				}
+				if !valid {
+					atomic.AddInt32(&invalidCount, 1)
+					responseWriter.WriteHeader(http.StatusForbidden)
+					return
+				}
+				if atomic.CompareAndSwapInt32(&rejectedCount, 0, 1) {
+					responseWriter.WriteHeader(http.StatusForbidden)
+					return
+				}
+				atomic.AddInt32(&relayCount, 1)
+				server.ServeHTTP(responseWriter, request)
+			}),
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go httpServer.Serve(listener)
+
+	// Run meek client and relay multiple round trips
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	meekConfig := &psiphon.MeekConfig{
+		ClientParameters:              clientParameters,
+		DialAddress:                   listener.Addr().String(),
+		HostHeader:                    "example.com",
+		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
+		MeekObfuscatedKey:             meekObfuscatedKey,
+		URLSigningScheme:              protocol.MEEK_URL_SIGNING_SCHEME_HMAC_TOKEN,
+		URLSigningKey:                 base64.StdEncoding.EncodeToString(signingKey),
+	}
+
+	ctx, cancelFunc := context.WithTimeout(
+		context.Background(), time.Second*5)
+	defer cancelFunc()
+
+	clientConn, err := psiphon.DialMeek(ctx, meekConfig, &psiphon.DialConfig{})
+	if err != nil {
+		t.Fatalf("psiphon.DialMeek failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	for i := 0; i < 10; i++ {
+		message := []byte(fmt.Sprintf("message %d", i))
+		_, err := clientConn.Write(message)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		response := make([]byte, len(message))
+		for received := 0; received < len(response); {
+			n, err := clientConn.Read(response[received:])
+			if err != nil {
+				t.Fatalf("Read failed: %s", err)
+			}
+			received += n
+		}
+		if !bytes.Equal(message, response) {
+			t.Fatalf("unexpected response: %s", response)
+		}
+	}
+
+	if atomic.LoadInt32(&rejectedCount) != 1 ||
+		atomic.LoadInt32(&invalidCount) != 0 ||
+		atomic.LoadInt32(&relayCount) < 2 {
+		t.Fatalf("unexpected signing handling: %d, %d, %d",
+			atomic.LoadInt32(&rejectedCount),
+			atomic.LoadInt32(&invalidCount),
+			atomic.LoadInt32(&relayCount))
+	}
+}
+
+type testRemoteAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn *testRemoteAddrConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func TestMeekCertificatePool(t *testing.T) {
+
+	pool, err := newMeekCertificatePool(4, 0)
+	if err != nil {
+		t.Fatalf("newMeekCertificatePool failed: %s", err)
+	}
+
+	clientHello := func(serverName, clientIP string) *tris.ClientHelloInfo {
+		return &tris.ClientHelloInfo{
+			ServerName: serverName,
+			Conn: &testRemoteAddrConn{
+				remoteAddr: &net.TCPAddr{IP: net.ParseIP(clientIP), Port: 1}},
+		}
+	}
+
+	// SNI server names matching a certificate subject select that
+	// certificate.
+
+	for _, poolCertificate := range pool.certificates {
+		if poolCertificate.commonName == "" {
+			continue
+		}
+		certificate, err := pool.getCertificate(
+			clientHello(poolCertificate.commonName, "192.0.2.1"))
+		if err != nil {
+			t.Fatalf("getCertificate failed: %s", err)
+		}
+		matched := false
+		for _, otherCertificate := range pool.certificates {
+			if certificate == otherCertificate.certificate &&
+				otherCertificate.commonName == poolCertificate.commonName {
+				matched = true
+			}
+		}
+		if !matched {
+			t.Fatalf("unexpected certificate for SNI server name")
+		}
+	}
+
+	// Otherwise, a client sees the same certificate on each connection, and
+	// clients see a variety of certificates.
+
+	selected := make(map[*tris.Certificate]bool)
+	for i := 0; i < 100; i++ {
+		clientIP := fmt.Sprintf("192.0.2.%d", i)
+		certificate, err := pool.getCertificate(clientHello("", clientIP))
+		if err != nil {
+			t.Fatalf("getCertificate failed: %s", err)
+		}
+		repeatCertificate, err := pool.getCertificate(clientHello("", clientIP))
+		if err != nil {
+			t.Fatalf("getCertificate failed: %s", err)
+		}
+		if certificate != repeatCertificate {
+			t.Fatalf("unexpected certificate for repeat connection")
+		}
+		selected[certificate] = true
+	}
+
+	if len(selected) < 2 {
+		t.Fatalf("unexpected selected certificate count: %d", len(selected))
+	}
+
+	// Rotation replaces certificates.
+
+	certificate := pool.certificates[0].certificate
+
+	err = pool.rotate()
+	if err != nil {
+		t.Fatalf("rotate failed: %s", err)
+	}
+
+	if pool.certificates[0].certificate == certificate {
+		t.Fatalf("unexpected certificate after rotation")
+	}
+
+	_, err = newMeekCertificatePool(MEEK_MAX_CERTIFICATE_POOL_SIZE+1, 0)
+	if err == nil {
+		t.Fatalf("unexpected newMeekCertificatePool success")
+	}
+}
+
+func TestMeekProtocolCertificatePool(t *testing.T) {
+
+	makeCertificateConfig := func(
+		commonName string, alpnProtocols []string) MeekServerCertificateConfig {
+
+		certificate, privateKey, err := common.GenerateWebServerCertificate(commonName)
+		if err != nil {
+			t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+		}
+		return MeekServerCertificateConfig{
+			Certificate:   certificate,
+			PrivateKey:    privateKey,
+			ALPNProtocols: alpnProtocols,
+		}
+	}
+
+	pool, err := newMeekProtocolCertificatePool(
+		MeekServerCertificatesConfig{
+			Certificates: []MeekServerCertificateConfig{
+				makeCertificateConfig("h2.example.com", []string{protocol.ALPN_PROTOCOL_HTTP2}),
+				makeCertificateConfig("www.example.com", nil),
+			},
+		})
+	if err != nil {
+		t.Fatalf("newMeekProtocolCertificatePool failed: %s", err)
+	}
+
+	h2Certificate := pool.configured[0].certificate
+	defaultCertificate := pool.configured[1].certificate
+
+	clientHello := func(serverName string, alpnProtocols []string) *tris.ClientHelloInfo {
+		return &tris.ClientHelloInfo{
+			ServerName:      serverName,
+			SupportedProtos: alpnProtocols,
+			Conn: &testRemoteAddrConn{
+				remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}},
+		}
+	}
+
+	testCases := []struct {
+		description   string
+		serverName    string
+		alpnProtocols []string
+		expected      *tris.Certificate
+	}{
+		{"SNI match", "www.example.com", []string{protocol.ALPN_PROTOCOL_HTTP2}, defaultCertificate},
+		{"ALPN match", "", []string{protocol.ALPN_PROTOCOL_HTTP2}, h2Certificate},
+		{"no ALPN", "", nil, defaultCertificate},
+		{"SNI match excluded by ALPN", "h2.example.com", nil, defaultCertificate},
+	}
+
+	for _, testCase := range testCases {
+		certificate, err := pool.getCertificate(
+			clientHello(testCase.serverName, testCase.alpnProtocols))
+		if err != nil {
+			t.Fatalf("getCertificate failed: %s", err)
+		}
+		if certificate != testCase.expected {
+			t.Fatalf("unexpected certificate: %s", testCase.description)
+		}
+	}
+
+	// Provided certificates are not rotated.
+
+	err = pool.rotate()
+	if err != nil {
+		t.Fatalf("rotate failed: %s", err)
+	}
+
+	if pool.configured[0].certificate != h2Certificate {
+		t.Fatalf("unexpected certificate after rotation")
+	}
+
+	// Generated certificates are presented along with provided
+	// certificates, and are rotated.
+
+	pool, err = newMeekProtocolCertificatePool(
+		MeekServerCertificatesConfig{
+			PoolSize: 2,
+			Certificates: []MeekServerCertificateConfig{
+				makeCertificateConfig("h2.example.com", []string{protocol.ALPN_PROTOCOL_HTTP2}),
+			},
+		})
+	if err != nil {
+		t.Fatalf("newMeekProtocolCertificatePool failed: %s", err)
+	}
+
+	certificate, err := pool.getCertificate(clientHello("", nil))
+	if err != nil {
+		t.Fatalf("getCertificate failed: %s", err)
+	}
+	if certificate != pool.certificates[0].certificate &&
+		certificate != pool.certificates[1].certificate {
+		t.Fatalf("unexpected certificate without ALPN")
+	}
+
+	_, err = newMeekProtocolCertificatePool(MeekServerCertificatesConfig{})
+	if err == nil {
+		t.Fatalf("unexpected newMeekProtocolCertificatePool success")
+	}
+}
+
+func TestMeekSNIAllowlist(t *testing.T) {
+
+	for _, testCase := range []struct {
+		serverName string
+		allowed    bool
+	}{
+		{"", true},
+		{"allowed.example.com", true},
+		{"ALLOWED.example.com", true},
+		{"sub.example.org", true},
+		{"example.org", false},
+		{"other.example.com", false},
+		{"allowed.example.com.evil", false},
+	} {
+		allowed := isAllowedSNIServerName(
+			testCase.serverName, []string{"", "allowed.example.com", "*.example.org"})
+		if allowed != testCase.allowed {
+			t.Fatalf("unexpected allowed for %s: %v", testCase.serverName, allowed)
+		}
+	}
+
+	if !isAllowedSNIServerName("any.example.net", nil) {
+		t.Fatalf("unexpected not allowed with empty list")
+	}
+
+	for _, behavior := range []string{
+		parameters.MEEK_SERVER_UNEXPECTED_SNI_CLOSE,
+		parameters.MEEK_SERVER_UNEXPECTED_SNI_DECOY} {
+
+		t.Run(behavior, func(t *testing.T) {
+			runMeekSNIAllowlistTest(t, behavior)
+		})
+	}
+}
+
+func runMeekSNIAllowlistTest(t *testing.T, behavior string) {
+
+	meekCookieEncryptionPrivateKey := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-meek-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	tacticsConfigJSON := fmt.Sprintf(`
+    {
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "MeekServerALPNProtocols" : ["h2", "http/1.1"],
+          "MeekServerAllowedSNIServerNames" : ["allowed.example.com"],
+          "MeekServerUnexpectedSNIBehavior" : "%s"
+        }
+      }
+    }
+    `, behavior)
+
+	tacticsConfigFilename := filepath.Join(testDataDirName, "tactics_config.json")
+	err = ioutil.WriteFile(tacticsConfigFilename, []byte(tacticsConfigJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	tacticsServer, err := tactics.NewServer(
+		CommonLogger(log), nil, nil, tacticsConfigFilename)
+	if err != nil {
+		t.Fatalf("tactics.NewServer failed: %s", err)
+	}
+
+	mockSupport := &SupportServices{
+		Config: &Config{
+			MeekObfuscatedKey:              "key",
+			MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
+		},
+		TrafficRulesSet: &TrafficRulesSet{},
+		GeoIPService:    &GeoIPService{},
+		TacticsServer:   tacticsServer,
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	stopBroadcast := make(chan struct{})
+
+	server, err := NewMeekServer(
+		mockSupport,
+		listener,
+		true,
+		false,
+		false,
+		func(_ string, conn net.Conn) { conn.Close() },
+		stopBroadcast)
+	if err != nil {
+		t.Fatalf("NewMeekServer failed: %s", err)
+	}
+
+	serverWaitGroup := new(sync.WaitGroup)
+
+	serverWaitGroup.Add(1)
+	go func() {
+		defer serverWaitGroup.Done()
+		server.Run()
+	}()
+
+	dial := func(serverName string, nextProtos []string) (*tls.Conn, error) {
+		return tls.Dial(
+			"tcp",
+			serverAddress,
+			&tls.Config{
+				InsecureSkipVerify: true,
+				ServerName:         serverName,
+				NextProtos:         nextProtos,
+			})
+	}
+
+	// An expected SNI server name completes the TLS handshake.
+
+	conn, err := dial("allowed.example.com", nil)
+	if err != nil {
+		t.Fatalf("tls.Dial failed: %s", err)
+	}
+	conn.Close()
+
+	// An unexpected SNI server name is closed or served a decoy, for both
+	// HTTP/1.1 and HTTP/2.
+
+	for _, nextProtos := range [][]string{{"http/1.1"}, {"h2"}} {
+
+		conn, err = dial("scanner.example.com", nextProtos)
+
+		if behavior == parameters.MEEK_SERVER_UNEXPECTED_SNI_CLOSE {
+			if err == nil {
+				conn.Close()
+				t.Fatalf("unexpected tls.Dial success")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("tls.Dial failed: %s", err)
+		}
+
+		httpClient := &http.Client{
+			Transport: &http.Transport{
+				DialTLS: func(_, _ string) (net.Conn, error) {
+					return conn, nil
+				},
+				ForceAttemptHTTP2: len(nextProtos) > 0 && nextProtos[0] == "h2",
+			},
+		}
+
+		for i := 0; i < 2; i++ {
+			response, err := httpClient.Post(
+				"https://scanner.example.com/", "", bytes.NewReader([]byte("probe")))
+			if err != nil {
+				t.Fatalf("http.Post failed: %s", err)
+			}
+			body, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode != http.StatusNotFound ||
+				string(body) != "404 page not found\n" {
+				t.Fatalf("unexpected decoy response: %d %s", response.StatusCode, body)
+			}
+		}
+
+		httpClient.CloseIdleConnections()
+	}
+
+	listener.Close()
+	close(stopBroadcast)
+	serverWaitGroup.Wait()
+}
+
+func TestMeekRequestRateLimiter(t *testing.T) {
+
+	if !newMeekRequestRateLimiter(0, 10).allow() {
+		t.Fatalf("unexpected rate limit with no limit")
+	}
+
+	// The burst allowance admits an initial burst of requests, after which
+	// requests are admitted at the sustained rate.
+
+	limiter := newMeekRequestRateLimiter(20, 5)
+
+	for i := 0; i < 5; i++ {
+		if !limiter.allow() {
+			t.Fatalf("unexpected rate limit in burst: %d", i)
+		}
+	}
+
+	if limiter.allow() {
+		t.Fatalf("unexpected request admitted after burst")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if !limiter.allow() {
+		t.Fatalf("unexpected rate limit after refill")
+	}
+
+	// The refill doesn't exceed the burst allowance.
+
+	time.Sleep(500 * time.Millisecond)
+
+	count := 0
+	for limiter.allow() {
+		count++
+	}
+	if count < 5 || count > 6 {
+		t.Fatalf("unexpected admitted request count: %d", count)
+	}
+}
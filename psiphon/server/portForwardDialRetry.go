@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+// portForwardDialRetryPolicy specifies how TCP port forward resolves and
+// dials which fail with a transient error are retried.
+type portForwardDialRetryPolicy struct {
+	maxRetries int
+	backoff    time.Duration
+}
+
+// getPortForwardDialRetryPolicy returns the ServerPortForwardDialRetries and
+// ServerPortForwardDialRetryBackoff tactics parameter values for the client,
+// or no retries when no tactics apply.
+func getPortForwardDialRetryPolicy(
+	tacticsSnapshot *tactics.Snapshot, geoIPData GeoIPData) portForwardDialRetryPolicy {
+
+	p, err := tacticsSnapshot.GetServerSideParameters(common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for port forward dial retries")
+	}
+
+	if p == nil {
+		return portForwardDialRetryPolicy{}
+	}
+
+	return portForwardDialRetryPolicy{
+		maxRetries: p.Int(parameters.ServerPortForwardDialRetries),
+		backoff:    p.Duration(parameters.ServerPortForwardDialRetryBackoff),
+	}
+}
+
+// retry indicates whether a port forward resolve or dial which failed with
+// err, on the specified zero-based attempt, is to be retried. When the
+// attempt is to be retried, retry first waits for the backoff period. retry
+// returns false, without waiting, when the error is permanent or the retries
+// are exhausted, and returns false when ctx, which bounds all attempts, is
+// done before the backoff period elapses.
+func (policy portForwardDialRetryPolicy) retry(
+	ctx context.Context, attempt int, err error) bool {
+
+	if attempt >= policy.maxRetries || !isTransientPortForwardDialError(err) {
+		return false
+	}
+
+	backoff := policy.backoff << uint(attempt)
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// isTransientPortForwardDialError indicates whether a port forward resolve or
+// dial error is transient, in which case a retry may succeed.
+//
+// DNS timeouts and server failures, such as SERVFAIL, are transient, while
+// NXDOMAIN is permanent. Refused, reset, and unreachable dials are transient.
+// Timeouts and cancellations are not retried as they indicate that the port
+// forward dial timeout has elapsed or that the client is stopping.
+func isTransientPortForwardDialError(err error) bool {
+
+	if err == nil {
+		return false
+	}
+
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		if dnsErr.IsNotFound {
+			return false
+		}
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+
+	opErr, ok := err.(*net.OpError)
+	if !ok || opErr.Timeout() {
+		return false
+	}
+
+	err = opErr.Err
+	if syscallErr, ok := err.(*os.SyscallError); ok {
+		err = syscallErr.Err
+	}
+
+	switch err {
+	case syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.ENETUNREACH,
+		syscall.EHOSTUNREACH:
+		return true
+	}
+
+	return false
+}
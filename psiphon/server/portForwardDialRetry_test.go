@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPortForwardDialRetry(t *testing.T) {
+
+	// A dial to a closed port is refused, which is transient.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	closedAddress := listener.Addr().String()
+	listener.Close()
+
+	_, refusedErr := net.Dial("tcp", closedAddress)
+	if refusedErr == nil {
+		t.Fatalf("unexpected dial success")
+	}
+
+	testCases := []struct {
+		description string
+		err         error
+		transient   bool
+	}{
+		{"refused", refusedErr, true},
+		{"NXDOMAIN", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"SERVFAIL", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{"DNS timeout", &net.DNSError{Err: "i/o timeout", IsTimeout: true}, true},
+		{"other", errors.New("no IP address"), false},
+	}
+
+	for _, testCase := range testCases {
+		if isTransientPortForwardDialError(testCase.err) != testCase.transient {
+			t.Fatalf("unexpected transient result for %s: %v", testCase.description, testCase.err)
+		}
+	}
+
+	// Retries are bounded, and each retry doubles the backoff.
+
+	policy := portForwardDialRetryPolicy{maxRetries: 2, backoff: 10 * time.Millisecond}
+
+	startTime := time.Now()
+	if !policy.retry(context.Background(), 0, refusedErr) ||
+		!policy.retry(context.Background(), 1, refusedErr) {
+		t.Fatalf("unexpected retry failure")
+	}
+	if time.Since(startTime) < 30*time.Millisecond {
+		t.Fatalf("unexpected backoff: %s", time.Since(startTime))
+	}
+
+	if policy.retry(context.Background(), 2, refusedErr) {
+		t.Fatalf("unexpected retry after retries exhausted")
+	}
+
+	if policy.retry(context.Background(), 0, testCases[1].err) {
+		t.Fatalf("unexpected retry of permanent error")
+	}
+
+	if (portForwardDialRetryPolicy{}).retry(context.Background(), 0, refusedErr) {
+		t.Fatalf("unexpected retry with no retries")
+	}
+
+	// Backoff waits are interrupted when the dial timeout elapses.
+
+	policy = portForwardDialRetryPolicy{maxRetries: 1, backoff: 10 * time.Second}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelFunc()
+
+	startTime = time.Now()
+	if policy.retry(ctx, 0, refusedErr) {
+		t.Fatalf("unexpected retry after timeout")
+	}
+	if time.Since(startTime) > 5*time.Second {
+		t.Fatalf("unexpected backoff: %s", time.Since(startTime))
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	PORT_FORWARD_RESOLVER_PROTOCOL_DNS      = "dns"
+	PORT_FORWARD_RESOLVER_PROTOCOL_DOT      = "dot"
+	PORT_FORWARD_RESOLVER_PROTOCOL_DOH      = "doh"
+	PORT_FORWARD_RESOLVER_MAX_CACHE_TTL     = 5 * time.Minute
+	PORT_FORWARD_RESOLVER_CACHE_MAX_ENTRIES = 10000
+	PORT_FORWARD_RESOLVER_MAX_RESPONSE_SIZE = 65535
+)
+
+// PortForwardResolver resolves the destination hostnames of client TCP port
+// forwards using operator-configured DNS servers, instead of the system
+// resolver. Queries are sent to the Config.PortForwardResolverAddresses
+// servers using plain DNS, DNS over TLS (DoT), or DNS over HTTPS (DoH),
+// according to Config.PortForwardResolverProtocol.
+//
+// Servers are tried in random order until one responds. A name error
+// response is final and is not retried with other servers.
+//
+// Resolved addresses are cached, for the minimum TTL of the answer records
+// capped at Config.PortForwardResolverMaxCacheTTLSeconds. Failures are not
+// cached.
+//
+// As with the system resolver, only IPv4 addresses are resolved. Traffic
+// rules are applied by the caller to the resolved address, so a hostname
+// can't be used to bypass the destination policy.
+type PortForwardResolver struct {
+	protocol    string
+	addresses   []string
+	dnsClient   *dns.Client
+	httpClient  *http.Client
+	maxCacheTTL time.Duration
+	cache       *sessionCache
+}
+
+// NewPortForwardResolver initializes a new PortForwardResolver using the
+// resolver specified in config.
+func NewPortForwardResolver(config *Config) (*PortForwardResolver, error) {
+
+	resolver := &PortForwardResolver{
+		protocol:    config.PortForwardResolverProtocol,
+		addresses:   config.PortForwardResolverAddresses,
+		maxCacheTTL: PORT_FORWARD_RESOLVER_MAX_CACHE_TTL,
+	}
+
+	if config.PortForwardResolverMaxCacheTTLSeconds != 0 {
+		resolver.maxCacheTTL =
+			time.Duration(config.PortForwardResolverMaxCacheTTLSeconds) * time.Second
+	}
+
+	if resolver.maxCacheTTL > 0 {
+		resolver.cache = newSessionCache(
+			resolver.maxCacheTTL, PORT_FORWARD_RESOLVER_CACHE_MAX_ENTRIES)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: config.PortForwardResolverTLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch resolver.protocol {
+	case PORT_FORWARD_RESOLVER_PROTOCOL_DNS:
+		resolver.dnsClient = &dns.Client{Net: "udp"}
+	case PORT_FORWARD_RESOLVER_PROTOCOL_DOT:
+		resolver.dnsClient = &dns.Client{Net: "tcp-tls", TLSConfig: tlsConfig}
+	case PORT_FORWARD_RESOLVER_PROTOCOL_DOH:
+		resolver.httpClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     tlsConfig,
+				MaxIdleConnsPerHost: 10,
+			},
+		}
+	default:
+		return nil, common.ContextError(
+			fmt.Errorf("unsupported protocol: %s", resolver.protocol))
+	}
+
+	return resolver, nil
+}
+
+// LookupIPAddr resolves host, as net.Resolver.LookupIPAddr does. IP address
+// hosts are returned as-is.
+//
+// As with net.Resolver, resolver failures are returned as a *net.DNSError,
+// with IsNotFound set for NXDOMAIN responses and IsTemporary set for other
+// failures which may succeed when retried.
+func (resolver *PortForwardResolver) LookupIPAddr(
+	ctx context.Context, host string) ([]net.IPAddr, error) {
+
+	if IP := net.ParseIP(host); IP != nil {
+		return []net.IPAddr{{IP: IP}}, nil
+	}
+
+	name := dns.Fqdn(strings.ToLower(host))
+
+	if resolver.cache != nil {
+		if IPs, ok := resolver.cache.Get(name); ok {
+			return IPs.([]net.IPAddr), nil
+		}
+	}
+
+	request := new(dns.Msg)
+	request.SetQuestion(name, dns.TypeA)
+	request.RecursionDesired = true
+
+	var firstErr error
+	isNotFound := false
+	for _, index := range rand.Perm(len(resolver.addresses)) {
+
+		response, err := resolver.exchange(ctx, request, resolver.addresses[index])
+		if err == nil && response.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("response code: %s", dns.RcodeToString[response.Rcode])
+		}
+
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if response != nil && response.Rcode == dns.RcodeNameError {
+				isNotFound = true
+				break
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		var IPs []net.IPAddr
+		var TTL uint32
+		for _, answer := range response.Answer {
+			if a, ok := answer.(*dns.A); ok {
+				IPs = append(IPs, net.IPAddr{IP: a.A})
+				if TTL == 0 || a.Hdr.Ttl < TTL {
+					TTL = a.Hdr.Ttl
+				}
+			}
+		}
+
+		if len(IPs) == 0 {
+			return nil, common.ContextError(errors.New("no IP address"))
+		}
+
+		cacheTTL := time.Duration(TTL) * time.Second
+		if cacheTTL > resolver.maxCacheTTL {
+			cacheTTL = resolver.maxCacheTTL
+		}
+		if resolver.cache != nil && cacheTTL > 0 {
+			resolver.cache.Set(name, IPs, cacheTTL)
+		}
+
+		return IPs, nil
+	}
+
+	if firstErr == nil {
+		return nil, common.ContextError(errors.New("no resolver"))
+	}
+
+	return nil, &net.DNSError{
+		Err:         common.ContextError(firstErr).Error(),
+		Name:        host,
+		IsNotFound:  isNotFound,
+		IsTimeout:   ctx.Err() != nil,
+		IsTemporary: !isNotFound && ctx.Err() == nil,
+	}
+}
+
+func (resolver *PortForwardResolver) exchange(
+	ctx context.Context, request *dns.Msg, address string) (*dns.Msg, error) {
+
+	if resolver.protocol == PORT_FORWARD_RESOLVER_PROTOCOL_DOH {
+		return resolver.exchangeDoH(ctx, request, address)
+	}
+
+	response, _, err := resolver.dnsClient.ExchangeContext(ctx, request, address)
+	truncated := err == dns.ErrTruncated || (err == nil && response.Truncated)
+	if truncated && resolver.protocol == PORT_FORWARD_RESOLVER_PROTOCOL_DNS {
+
+		// Retry a truncated UDP response using TCP. ErrTruncated is returned
+		// along with a valid truncated response.
+		tcpClient := &dns.Client{Net: "tcp"}
+		response, _, err = tcpClient.ExchangeContext(ctx, request, address)
+	}
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return response, nil
+}
+
+// exchangeDoH performs an RFC 8484 DNS over HTTPS POST request.
+func (resolver *PortForwardResolver) exchangeDoH(
+	ctx context.Context, request *dns.Msg, URL string) (*dns.Msg, error) {
+
+	packedRequest, err := request.Pack()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	httpRequest, err := http.NewRequest("POST", URL, bytes.NewReader(packedRequest))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.Header.Set("Content-Type", "application/dns-message")
+	httpRequest.Header.Set("Accept", "application/dns-message")
+
+	httpResponse, err := resolver.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", httpResponse.StatusCode))
+	}
+
+	packedResponse, err := ioutil.ReadAll(
+		io.LimitReader(httpResponse.Body, PORT_FORWARD_RESOLVER_MAX_RESPONSE_SIZE+1))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	if len(packedResponse) > PORT_FORWARD_RESOLVER_MAX_RESPONSE_SIZE {
+		return nil, common.ContextError(errors.New("response exceeds size limit"))
+	}
+
+	response := new(dns.Msg)
+	err = response.Unpack(packedResponse)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if response.Id != request.Id {
+		return nil, common.ContextError(errors.New("unexpected response ID"))
+	}
+
+	return response, nil
+}
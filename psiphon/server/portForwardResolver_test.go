@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+)
+
+func TestPortForwardResolver(t *testing.T) {
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+
+	var queries int32
+
+	dnsServer := &dns.Server{
+		PacketConn: packetConn,
+		Handler: dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			response := new(dns.Msg)
+			response.SetReply(request)
+			question := request.Question[0]
+			if question.Name != "example.com." {
+				response.Rcode = dns.RcodeNameError
+			} else {
+				response.Answer = append(response.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A: net.ParseIP("192.0.2.1"),
+				})
+			}
+			writer.WriteMsg(response)
+		}),
+	}
+	go dnsServer.ActivateAndServe()
+	defer dnsServer.Shutdown()
+
+	resolver, err := NewPortForwardResolver(&Config{
+		PortForwardResolverProtocol:  PORT_FORWARD_RESOLVER_PROTOCOL_DNS,
+		PortForwardResolverAddresses: []string{packetConn.LocalAddr().String()},
+	})
+	if err != nil {
+		t.Fatalf("NewPortForwardResolver failed: %s", err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	for i := 0; i < 2; i++ {
+		IPs, err := resolver.LookupIPAddr(ctx, "EXAMPLE.com")
+		if err != nil {
+			t.Fatalf("LookupIPAddr failed: %s", err)
+		}
+		if len(IPs) != 1 || !IPs[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+			t.Fatalf("unexpected IPs: %v", IPs)
+		}
+	}
+
+	// The second lookup is answered from the cache.
+
+	if atomic.LoadInt32(&queries) != 1 {
+		t.Fatalf("unexpected query count: %d", queries)
+	}
+
+	// IP addresses are not resolved.
+
+	IPs, err := resolver.LookupIPAddr(ctx, "192.0.2.2")
+	if err != nil || len(IPs) != 1 || !IPs[0].IP.Equal(net.ParseIP("192.0.2.2")) {
+		t.Fatalf("unexpected IP address lookup: %v, %v", IPs, err)
+	}
+
+	// Failures are not cached.
+
+	for i := 0; i < 2; i++ {
+		_, err = resolver.LookupIPAddr(ctx, "unknown.example.com")
+		if err == nil {
+			t.Fatalf("unexpected LookupIPAddr success")
+		}
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Fatalf("unexpected LookupIPAddr error: %v", err)
+		}
+		if isTransientPortForwardDialError(err) {
+			t.Fatalf("unexpected transient error: %v", err)
+		}
+	}
+
+	if atomic.LoadInt32(&queries) != 3 {
+		t.Fatalf("unexpected query count: %d", queries)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	PROBE_MIRROR_MAX_BYTES      = 4096
+	PROBE_MIRROR_POST_TIMEOUT   = 5 * time.Second
+	PROBE_MIRROR_MAX_CONCURRENT = 10
+)
+
+// ProbeMirror forwards a sample of suspected active probes to an analyzer
+// endpoint, for the study of active probing campaigns.
+//
+// A suspected probe is a client connection which fails the obfuscated SSH
+// seed message check, the server's active probing resistance check. Probes
+// are still denied, exactly as when mirroring is disabled: mirroring
+// doesn't read from, write to, or close the probe connection, which
+// continues to be handled as an unrecognized connection with the same
+// timing as unsampled probes.
+//
+// Only the bytes read by a failed check are mirrored; any probe bytes sent
+// after the check are not. Legitimate tunnel data is never mirrored: a
+// connection which passes the
+// check cannot be mirrored, and recording stops as soon as the check
+// passes. Connections which fail due to an I/O error while reading the seed
+// message, as happens when legitimate clients abandon connections, are not
+// mirrored. As in server logs, the client IP address is not included; the
+// client location is limited to GeoIP data.
+//
+// Each mirrored probe is sent as a ProbeMirrorRecord JSON HTTP POST body to
+// Config.ProbeMirrorURL. Mirroring is best effort and concurrent posts are
+// limited; when the limit is reached, probes are not mirrored.
+type ProbeMirror struct {
+	url        string
+	sampleRate float64
+	hostID     string
+	httpClient *http.Client
+	semaphore  chan struct{}
+}
+
+// ProbeMirrorRecord is a mirrored probe.
+type ProbeMirrorRecord struct {
+	Timestamp      string `json:"timestamp"`
+	HostID         string `json:"host_id"`
+	TunnelProtocol string `json:"tunnel_protocol"`
+	ClientRegion   string `json:"client_region"`
+	ClientCity     string `json:"client_city"`
+	ClientISP      string `json:"client_isp"`
+	Data           []byte `json:"data"`
+}
+
+// NewProbeMirror initializes a new ProbeMirror that mirrors probes to
+// Config.ProbeMirrorURL.
+func NewProbeMirror(config *Config) *ProbeMirror {
+	return &ProbeMirror{
+		url:        config.ProbeMirrorURL,
+		sampleRate: config.ProbeMirrorSampleRate,
+		hostID:     config.HostID,
+		httpClient: &http.Client{Timeout: PROBE_MIRROR_POST_TIMEOUT},
+		semaphore:  make(chan struct{}, PROBE_MIRROR_MAX_CONCURRENT),
+	}
+}
+
+// sample returns a probeRecordingConn wrapping conn when conn is selected
+// for probe mirroring, according to the sampling rate, or conn when not
+// selected or when the mirror is nil.
+//
+// As it's not known whether a connection is a probe until the seed message
+// check fails, the sampling decision is made for each connection, which
+// samples probes at the same rate.
+func (mirror *ProbeMirror) sample(conn net.Conn) net.Conn {
+
+	if mirror == nil || !common.FlipWeightedCoin(mirror.sampleRate) {
+		return conn
+	}
+
+	return &probeRecordingConn{Conn: conn}
+}
+
+// mirrorProbe asynchronously sends the bytes of the probe read by the seed
+// message check to the analyzer. conn must have been returned by sample,
+// and must have failed the seed message check. mirrorProbe doesn't block on
+// or close the connection; the caller handles the connection exactly as it
+// would an unsampled probe.
+func (mirror *ProbeMirror) mirrorProbe(
+	conn net.Conn, tunnelProtocol string, geoIPData GeoIPData) {
+
+	recordingConn, ok := conn.(*probeRecordingConn)
+	if !ok {
+		return
+	}
+
+	data, ok := recordingConn.takeProbe()
+	if !ok {
+		return
+	}
+
+	select {
+	case mirror.semaphore <- struct{}{}:
+	default:
+		log.WithContext().Warning("probe mirror busy")
+		return
+	}
+
+	record := &ProbeMirrorRecord{
+		Timestamp:      common.GetCurrentTimestamp(),
+		HostID:         mirror.hostID,
+		TunnelProtocol: tunnelProtocol,
+		ClientRegion:   geoIPData.Country,
+		ClientCity:     geoIPData.City,
+		ClientISP:      geoIPData.ISP,
+		Data:           data,
+	}
+
+	go func() {
+		defer func() { <-mirror.semaphore }()
+		err := mirror.post(record)
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning("probe mirror failed")
+		}
+	}()
+}
+
+func (mirror *ProbeMirror) post(record *ProbeMirrorRecord) error {
+
+	body, err := json.Marshal(record)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), PROBE_MIRROR_POST_TIMEOUT)
+	defer cancelFunc()
+
+	request, err := http.NewRequest("POST", mirror.url, bytes.NewReader(body))
+	if err != nil {
+		return common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := mirror.httpClient.Do(request)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	return nil
+}
+
+// probeRecordingConn records the initial bytes read from a client
+// connection, up to PROBE_MIRROR_MAX_BYTES, until recording is stopped.
+type probeRecordingConn struct {
+	net.Conn
+	mutex      sync.Mutex
+	stopped    bool
+	readFailed bool
+	data       []byte
+}
+
+func (conn *probeRecordingConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+
+	conn.mutex.Lock()
+	if !conn.stopped {
+		if n > 0 && len(conn.data) < PROBE_MIRROR_MAX_BYTES {
+			end := n
+			if len(conn.data)+end > PROBE_MIRROR_MAX_BYTES {
+				end = PROBE_MIRROR_MAX_BYTES - len(conn.data)
+			}
+			conn.data = append(conn.data, buffer[:end]...)
+		}
+		if err != nil {
+			conn.readFailed = true
+		}
+	}
+	conn.mutex.Unlock()
+
+	return n, err
+}
+
+// stopProbeRecording stops recording, when conn is a probeRecordingConn,
+// and discards any recorded bytes. This must be called once the seed
+// message check passes.
+func stopProbeRecording(conn net.Conn) {
+	recordingConn, ok := conn.(*probeRecordingConn)
+	if !ok {
+		return
+	}
+	recordingConn.mutex.Lock()
+	recordingConn.stopped = true
+	recordingConn.data = nil
+	recordingConn.mutex.Unlock()
+}
+
+// takeProbe stops recording and returns the recorded bytes of a connection
+// which failed the seed message check. No further bytes are read. takeProbe
+// returns false when the check failed due to an I/O error, in which case
+// the connection may be a legitimate client and is not a suspected probe.
+func (conn *probeRecordingConn) takeProbe() ([]byte, bool) {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	data := conn.data
+	ok := !conn.readFailed && !conn.stopped && len(data) > 0
+
+	conn.stopped = true
+	conn.data = nil
+
+	if !ok {
+		return nil, false
+	}
+
+	return data, true
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
+)
+
+func TestProbeMirror(t *testing.T) {
+
+	records := make(chan *ProbeMirrorRecord, 10)
+
+	analyzer := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var record ProbeMirrorRecord
+			err := json.NewDecoder(r.Body).Decode(&record)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			records <- &record
+		}))
+	defer analyzer.Close()
+
+	mirror := NewProbeMirror(&Config{
+		ProbeMirrorURL:        analyzer.URL,
+		ProbeMirrorSampleRate: 1.0,
+		HostID:                "host",
+	})
+
+	keyword := "keyword"
+
+	runConn := func(clientData []byte, closeClient bool) (int, error) {
+
+		serverConn, clientConn := net.Pipe()
+		defer clientConn.Close()
+
+		go func() {
+			clientConn.Write(clientData)
+			if closeClient {
+				clientConn.Close()
+			}
+		}()
+
+		conn := mirror.sample(serverConn)
+		defer conn.Close()
+
+		_, err := obfuscator.NewObfuscatedSshConn(
+			obfuscator.OBFUSCATION_CONN_MODE_SERVER, conn, keyword, nil, nil, nil)
+		if err != nil {
+			mirror.mirrorProbe(conn, "OSSH", GeoIPData{Country: "CA"})
+		} else {
+			stopProbeRecording(conn)
+		}
+
+		return len(conn.(*probeRecordingConn).data), err
+	}
+
+	// A probe which fails the seed message check is mirrored, including only
+	// the probe bytes read by the check. Mirroring doesn't close the probe
+	// connection or read the remaining probe bytes.
+
+	probe := bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 4)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	go clientConn.Write(probe)
+
+	conn := mirror.sample(serverConn)
+	defer conn.Close()
+
+	_, err := obfuscator.NewObfuscatedSshConn(
+		obfuscator.OBFUSCATION_CONN_MODE_SERVER, conn, keyword, nil, nil, nil)
+	if err == nil {
+		t.Fatalf("unexpected seed message check success")
+	}
+
+	start := time.Now()
+	mirror.mirrorProbe(conn, "OSSH", GeoIPData{Country: "CA"})
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("unexpected mirrorProbe delay: %s", time.Since(start))
+	}
+
+	var checkBytes []byte
+
+	select {
+	case record := <-records:
+		if len(record.Data) == 0 ||
+			len(record.Data) >= len(probe) ||
+			!bytes.HasPrefix(probe, record.Data) ||
+			record.TunnelProtocol != "OSSH" ||
+			record.ClientRegion != "CA" ||
+			record.HostID != "host" {
+			t.Fatalf("unexpected probe record: %+v", record)
+		}
+		checkBytes = record.Data
+	case <-time.After(5 * time.Second):
+		t.Fatalf("missing probe record")
+	}
+
+	remainingBytes := make([]byte, len(probe)-len(checkBytes))
+	_, err = io.ReadFull(conn, remainingBytes)
+	if err != nil {
+		t.Fatalf("unexpected probe connection read failure: %s", err)
+	}
+	if !bytes.Equal(append(checkBytes, remainingBytes...), probe) {
+		t.Fatalf("unexpected remaining probe bytes")
+	}
+
+	if len(conn.(*probeRecordingConn).data) != 0 {
+		t.Fatalf("unexpected recorded bytes after mirroring")
+	}
+
+	// A legitimate seed message is not mirrored and the recorded bytes are
+	// discarded.
+
+	clientObfuscator, err := obfuscator.NewClientObfuscator(
+		&obfuscator.ObfuscatorConfig{Keyword: keyword})
+	if err != nil {
+		t.Fatalf("NewClientObfuscator failed: %s", err)
+	}
+
+	recordedBytes, err := runConn(clientObfuscator.SendSeedMessage(), false)
+	if err != nil {
+		t.Fatalf("unexpected seed message check failure: %s", err)
+	}
+	if recordedBytes != 0 {
+		t.Fatalf("unexpected recorded bytes: %d", recordedBytes)
+	}
+
+	// A truncated seed message, as when a client abandons the connection, is
+	// not mirrored.
+
+	clientObfuscator, err = obfuscator.NewClientObfuscator(
+		&obfuscator.ObfuscatorConfig{Keyword: keyword})
+	if err != nil {
+		t.Fatalf("NewClientObfuscator failed: %s", err)
+	}
+
+	_, err = runConn(clientObfuscator.SendSeedMessage()[:10], true)
+	if err == nil {
+		t.Fatalf("unexpected seed message check success")
+	}
+
+	select {
+	case record := <-records:
+		t.Fatalf("unexpected probe record: %+v", record)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
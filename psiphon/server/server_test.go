@@ -33,6 +33,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -147,6 +148,22 @@ func TestOSSH(t *testing.T) {
 		})
 }
 
+func TestOSSHDecoyFirstFlight(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: true,
+			doOSSHDecoy:          true,
+		})
+}
+
 func TestUnfrontedMeek(t *testing.T) {
 	runServer(t,
 		&runServerConfig{
@@ -259,6 +276,22 @@ func TestMarionetteOSSH(t *testing.T) {
 		})
 }
 
+func TestPortForwardCompression(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: true,
+			doCompression:        true,
+		})
+}
+
 func TestWebTransportAPIRequests(t *testing.T) {
 	runServer(t,
 		&runServerConfig{
@@ -405,6 +438,8 @@ type runServerConfig struct {
 	omitAuthorization    bool
 	doTunneledWebRequest bool
 	doTunneledNTPRequest bool
+	doCompression        bool
+	doOSSHDecoy          bool
 }
 
 func runServer(t *testing.T, runConfig *runServerConfig) {
@@ -531,6 +566,10 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	// Exercise this option.
 	serverConfig["PeriodicGarbageCollectionSeconds"] = 1
 
+	if runConfig.doCompression {
+		serverConfig["EnablePortForwardCompression"] = true
+	}
+
 	serverConfigJSON, _ = json.Marshal(serverConfig)
 
 	// run server
@@ -660,14 +699,32 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		t.Fatalf("error committing configuration file: %s", err)
 	}
 
+	applyParameters := make(map[string]interface{})
+
 	if doTactics {
 		// Configure nonfunctional values that must be overridden by tactics.
 
-		applyParameters := make(map[string]interface{})
-
 		applyParameters[parameters.TunnelConnectTimeout] = "1s"
 		applyParameters[parameters.TunnelRateLimits] = common.RateLimits{WriteBytesPerSecond: 1}
+	}
 
+	if runConfig.doOSSHDecoy {
+		applyParameters[parameters.OSSHDecoyFirstFlightProbability] = 1.0
+	}
+
+	if runConfig.doCompression {
+		applyParameters[parameters.PortForwardCompression] = true
+	}
+
+	// Exercise the SSH performance preset, which negotiates
+	// ChaCha20-Poly1305 as the server supports it by default.
+	if runConfig.tunnelProtocol == protocol.TUNNEL_PROTOCOL_SSH {
+		applyParameters[parameters.SSHPreferredAlgorithms] = parameters.SSHAlgorithms{
+			Preset: parameters.SSH_ALGORITHMS_PRESET_PERFORMANCE,
+		}
+	}
+
+	if len(applyParameters) > 0 {
 		err = clientConfig.SetClientParameters("", true, applyParameters)
 		if err != nil {
 			t.Fatalf("SetClientParameters failed: %s", err)
@@ -690,6 +747,7 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	tunnelsEstablished := make(chan struct{}, 1)
 	homepageReceived := make(chan struct{}, 1)
 	slokSeeded := make(chan struct{}, 1)
+	var connectedWithDecoy int32
 
 	psiphon.SetNoticeWriter(psiphon.NewNoticeReceiver(
 		func(notice []byte) {
@@ -716,6 +774,10 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 				sendNotificationReceived(homepageReceived)
 			case "SLOKSeeded":
 				sendNotificationReceived(slokSeeded)
+			case "ConnectedServer":
+				if decoy, ok := payload["OSSHDecoyFirstFlight"].(bool); ok && decoy {
+					atomic.StoreInt32(&connectedWithDecoy, 1)
+				}
 			}
 		}))
 
@@ -760,6 +822,13 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	waitOnNotification(t, tunnelsEstablished, timeoutSignal, "tunnel establish timeout exceeded")
 	waitOnNotification(t, homepageReceived, timeoutSignal, "homepage received timeout exceeded")
 
+	// Test: the tunnel was established following an acknowledged decoy first
+	// flight, and only when the decoy was enabled
+
+	if (atomic.LoadInt32(&connectedWithDecoy) == 1) != runConfig.doOSSHDecoy {
+		t.Fatalf("unexpected OSSH decoy first flight")
+	}
+
 	expectTrafficFailure := runConfig.denyTrafficRules || (runConfig.omitAuthorization && runConfig.requireAuthorization)
 
 	if runConfig.doTunneledWebRequest {
@@ -24,6 +24,8 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -31,6 +33,7 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -45,43 +48,113 @@ import (
 // and then starts the server components and runs them until os.Interrupt or
 // os.Kill signals are received. The config determines which components are run.
 func RunServices(configJSON []byte) error {
+	return runServices(configJSON, nil)
+}
+
+// runServices implements RunServices. When stopBroadcast is not nil, OS
+// signals are not handled and the services run until stopBroadcast is
+// closed.
+func runServices(configJSON []byte, stopBroadcast <-chan struct{}) error {
+
+	server, err := NewServer(configJSON, nil)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return server.Run(stopBroadcast)
+}
+
+// Server is a Psiphon server instance: the support services and the server
+// components, including the tunnel server and its listeners, specified by
+// one config. RunServices runs a single Server; multiple Server instances
+// may be run concurrently in one process.
+//
+// Each instance has its own listeners and metrics. Instances must be
+// configured with distinct listening ports, as an instance fails to run if
+// its listeners cannot be bound. Server load stats and OTLP metrics are
+// reported for the instance's own tunnel server only.
+//
+// Instances share the process logger, which is configured by the first
+// instance initialized, as InitLogging only has effect on the first call.
+// All log lines are stamped with that instance's host ID. Instances may
+// also share data components; see NewServer. At most one instance per
+// process may run the packet tunnel, which configures host networking.
+type Server struct {
+	config            *Config
+	support           *SupportServices
+	tunnelServer      *TunnelServer
+	shutdownBroadcast chan struct{}
+	runOnce           int32
+}
+
+// packetTunnelInstance is set while a Server instance in this process owns
+// the packet tunnel.
+var packetTunnelInstance int32
+
+// NewServer initializes a new Server with the specified config. When
+// sharedDataServer is not nil, the new instance shares the data components
+// of sharedDataServer -- the traffic rules, OSL config, psinet database,
+// GeoIP service, DNS resolver, and tactics server -- and the corresponding
+// config values of the new instance are ignored. Reloading shared data
+// components, via Reload on any of the instances sharing them, applies to
+// all of those instances.
+func NewServer(configJSON []byte, sharedDataServer *Server) (*Server, error) {
 
 	rand.Seed(int64(time.Now().Nanosecond()))
 
 	config, err := LoadConfig(configJSON)
 	if err != nil {
 		log.WithContextFields(LogFields{"error": err}).Error("load config failed")
-		return common.ContextError(err)
+		return nil, common.ContextError(err)
 	}
 
 	err = InitLogging(config)
 	if err != nil {
 		log.WithContextFields(LogFields{"error": err}).Error("init logging failed")
-		return common.ContextError(err)
+		return nil, common.ContextError(err)
 	}
 
-	supportServices, err := NewSupportServices(config)
-	if err != nil {
-		log.WithContextFields(LogFields{"error": err}).Error("init support services failed")
-		return common.ContextError(err)
+	if config.HostID != logHostID {
+		log.WithContextFields(
+			LogFields{"instance_host_id": config.HostID}).Warning(
+			"instance host ID differs from logging host ID")
+	}
+
+	var supportServices *SupportServices
+	if sharedDataServer == nil {
+		supportServices, err = NewSupportServices(config)
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Error("init support services failed")
+			return nil, common.ContextError(err)
+		}
+	} else {
+		supportServices, err = sharedDataServer.support.shareData(config)
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Error("init support services failed")
+			return nil, common.ContextError(err)
+		}
 	}
 
 	log.WithContextFields(*common.GetBuildInfo().ToMap()).Info("startup")
 
-	waitGroup := new(sync.WaitGroup)
 	shutdownBroadcast := make(chan struct{})
-	errors := make(chan error)
 
 	tunnelServer, err := NewTunnelServer(supportServices, shutdownBroadcast)
 	if err != nil {
 		log.WithContextFields(LogFields{"error": err}).Error("init tunnel server failed")
-		return common.ContextError(err)
+		return nil, common.ContextError(err)
 	}
 
 	supportServices.TunnelServer = tunnelServer
 
 	if config.RunPacketTunnel {
 
+		if !atomic.CompareAndSwapInt32(&packetTunnelInstance, 0, 1) {
+			err := errors.New("packet tunnel already run by another instance")
+			log.WithContextFields(LogFields{"error": err}).Error("init packet tunnel failed")
+			return nil, common.ContextError(err)
+		}
+
 		packetTunnelServer, err := tun.NewServer(&tun.ServerConfig{
 			Logger: CommonLogger(log),
 			SudoNetworkConfigCommands:   config.PacketTunnelSudoNetworkConfigCommands,
@@ -92,13 +165,60 @@ func RunServices(configJSON []byte) error {
 			SessionIdleExpirySeconds:    config.PacketTunnelSessionIdleExpirySeconds,
 		})
 		if err != nil {
+			atomic.StoreInt32(&packetTunnelInstance, 0)
 			log.WithContextFields(LogFields{"error": err}).Error("init packet tunnel failed")
-			return common.ContextError(err)
+			return nil, common.ContextError(err)
 		}
 
 		supportServices.PacketTunnelServer = packetTunnelServer
 	}
 
+	return &Server{
+		config:            config,
+		support:           supportServices,
+		tunnelServer:      tunnelServer,
+		shutdownBroadcast: shutdownBroadcast,
+	}, nil
+}
+
+// Reload reloads the instance's data components; see
+// SupportServices.Reload.
+func (server *Server) Reload() {
+	server.support.Reload()
+}
+
+// Run starts the server components and runs them until stopped. When
+// stopBroadcast is nil, OS signals are handled, as in RunServices, and the
+// instance runs until os.Interrupt or os.Kill signals are received. When
+// stopBroadcast is not nil, OS signals are not handled and the instance
+// runs until stopBroadcast is closed. Run may be called only once.
+func (server *Server) Run(stopBroadcast <-chan struct{}) error {
+
+	if !atomic.CompareAndSwapInt32(&server.runOnce, 0, 1) {
+		return common.ContextError(errors.New("server already run"))
+	}
+
+	config := server.config
+	supportServices := server.support
+	tunnelServer := server.tunnelServer
+	shutdownBroadcast := server.shutdownBroadcast
+
+	if config.RunPacketTunnel {
+		defer atomic.StoreInt32(&packetTunnelInstance, 0)
+	}
+
+	waitGroup := new(sync.WaitGroup)
+	errors := make(chan error)
+
+	// With a PanicHandler set, a panic in a server component invokes the
+	// handler and stops the server. See SetPanicHandler.
+	onComponentPanic := func() {
+		select {
+		case errors <- common.ContextError(fmt.Errorf("server component panic")):
+		default:
+		}
+	}
+
 	// After this point, errors should be delivered to the "errors" channel and
 	// orderly shutdown should flow through to the end of the function to ensure
 	// all workers are synchronously stopped.
@@ -117,19 +237,39 @@ func RunServices(configJSON []byte) error {
 		waitGroup.Add(1)
 		go func() {
 			waitGroup.Done()
-			ticker := time.NewTicker(time.Duration(config.LoadMonitorPeriodSeconds) * time.Second)
-			defer ticker.Stop()
+			schedule := newJitteredSchedule(
+				time.Duration(config.LoadMonitorPeriodSeconds)*time.Second,
+				config.LoadMonitorPeriodJitter)
+			timer := time.NewTimer(time.Until(schedule.next()))
+			defer timer.Stop()
 			for {
 				select {
 				case <-shutdownBroadcast:
 					return
-				case <-ticker.C:
-					logServerLoad(tunnelServer)
+				case <-timer.C:
+					logServerLoad(tunnelServer, supportServices.OTLPExporter)
+					timer.Reset(time.Until(schedule.next()))
 				}
 			}
 		}()
 	}
 
+	if config.RunOTLPExporter() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			supportServices.OTLPExporter.Run(shutdownBroadcast)
+		}()
+	}
+
+	if config.RunFlowExporter() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			supportServices.FlowExporter.Run(shutdownBroadcast)
+		}()
+	}
+
 	if config.RunPeriodicGarbageCollection() {
 		waitGroup.Add(1)
 		go func() {
@@ -147,10 +287,24 @@ func RunServices(configJSON []byte) error {
 		}()
 	}
 
+	if config.RunManagementServer() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer recoverPanic(onComponentPanic)
+			err := RunManagementServer(supportServices, tunnelServer, shutdownBroadcast)
+			select {
+			case errors <- err:
+			default:
+			}
+		}()
+	}
+
 	if config.RunWebServer() {
 		waitGroup.Add(1)
 		go func() {
 			defer waitGroup.Done()
+			defer recoverPanic(onComponentPanic)
 			err := RunWebServer(supportServices, shutdownBroadcast)
 			select {
 			case errors <- err:
@@ -164,6 +318,7 @@ func RunServices(configJSON []byte) error {
 	waitGroup.Add(1)
 	go func() {
 		defer waitGroup.Done()
+		defer recoverPanic(onComponentPanic)
 		err := tunnelServer.Run()
 		select {
 		case errors <- err:
@@ -194,25 +349,28 @@ func RunServices(configJSON []byte) error {
 
 	// An OS signal triggers an orderly shutdown
 	systemStopSignal := make(chan os.Signal, 1)
-	signal.Notify(systemStopSignal, os.Interrupt, os.Kill, syscall.SIGTERM)
 
 	// SIGUSR1 triggers a reload of support services
 	reloadSupportServicesSignal := make(chan os.Signal, 1)
-	signal.Notify(reloadSupportServicesSignal, syscall.SIGUSR1)
 
 	// SIGUSR2 triggers an immediate load log and optional process profile output
 	logServerLoadSignal := make(chan os.Signal, 1)
-	signal.Notify(logServerLoadSignal, syscall.SIGUSR2)
 
 	// SIGTSTP triggers tunnelServer to stop establishing new tunnels
 	stopEstablishingTunnelsSignal := make(chan os.Signal, 1)
-	signal.Notify(stopEstablishingTunnelsSignal, syscall.SIGTSTP)
 
 	// SIGCONT triggers tunnelServer to resume establishing new tunnels
 	resumeEstablishingTunnelsSignal := make(chan os.Signal, 1)
-	signal.Notify(resumeEstablishingTunnelsSignal, syscall.SIGCONT)
 
-	err = nil
+	if stopBroadcast == nil {
+		signal.Notify(systemStopSignal, os.Interrupt, os.Kill, syscall.SIGTERM)
+		signal.Notify(reloadSupportServicesSignal, syscall.SIGUSR1)
+		signal.Notify(logServerLoadSignal, syscall.SIGUSR2)
+		signal.Notify(stopEstablishingTunnelsSignal, syscall.SIGTSTP)
+		signal.Notify(resumeEstablishingTunnelsSignal, syscall.SIGCONT)
+	}
+
+	var err error
 
 loop:
 	for {
@@ -220,6 +378,11 @@ loop:
 		case <-stopEstablishingTunnelsSignal:
 			tunnelServer.SetEstablishTunnels(false)
 
+			if config.SendMigrationHints() {
+				tunnelServer.SendMigrationHints(
+					time.Duration(config.MigrationHintDeadlineSeconds) * time.Second)
+			}
+
 		case <-resumeEstablishingTunnelsSignal:
 			tunnelServer.SetEstablishTunnels(true)
 
@@ -234,12 +397,16 @@ loop:
 			case signalProcessProfiles <- *new(struct{}):
 			default:
 			}
-			logServerLoad(tunnelServer)
+			logServerLoad(tunnelServer, supportServices.OTLPExporter)
 
 		case <-systemStopSignal:
 			log.WithContext().Info("shutdown by system")
 			break loop
 
+		case <-stopBroadcast:
+			log.WithContext().Info("shutdown by caller")
+			break loop
+
 		case err = <-errors:
 			log.WithContextFields(LogFields{"error": err}).Error("service failed")
 			break loop
@@ -249,6 +416,8 @@ loop:
 	close(shutdownBroadcast)
 	waitGroup.Wait()
 
+	FlushLogs(LOG_FLUSH_TIMEOUT)
+
 	return err
 }
 
@@ -361,9 +530,46 @@ func outputProcessProfiles(config *Config) {
 	}
 }
 
-func logServerLoad(server *TunnelServer) {
+// jitteredSchedule generates the times of a periodic event, such as load
+// logging, with one event for each period following the schedule start
+// time. Each event is randomly offset, by up to half of period*jitter, from
+// the end of its period. With jitter of at most 1.0, the offset windows of
+// consecutive events don't overlap, so jitter cannot cause events to be
+// skipped, doubled, or reordered, and the long run event rate is unchanged.
+type jitteredSchedule struct {
+	start  time.Time
+	period time.Duration
+	jitter float64
+	count  int64
+}
+
+func newJitteredSchedule(period time.Duration, jitter float64) *jitteredSchedule {
+	return &jitteredSchedule{
+		start:  time.Now(),
+		period: period,
+		jitter: jitter,
+	}
+}
+
+// next returns the time of the next event. When the caller is late, the
+// returned time may be in the past; the event is then due immediately.
+func (schedule *jitteredSchedule) next() time.Time {
+	schedule.count++
+	eventTime := schedule.start.Add(time.Duration(schedule.count) * schedule.period)
+	if schedule.jitter > 0.0 {
+		eventTime = eventTime.Add(
+			common.JitterDuration(schedule.period, schedule.jitter/2) - schedule.period)
+	}
+	return eventTime
+}
 
-	protocolStats, regionStats := server.GetLoadStats()
+func logServerLoad(server *TunnelServer, exporter *OTLPExporter) {
+
+	protocolStats, regionStats, platformStats := server.GetLoadStats()
+
+	if exporter != nil {
+		exporter.exportLoadStats(protocolStats)
+	}
 
 	serverLoad := getRuntimeMetrics()
 
@@ -371,6 +577,12 @@ func logServerLoad(server *TunnelServer) {
 
 	serverLoad["establish_tunnels"] = server.GetEstablishTunnels()
 
+	serverLoad["warming_up"] = server.IsWarmingUp()
+
+	for name, metrics := range server.GetSessionCacheMetrics() {
+		serverLoad[name] = metrics
+	}
+
 	for protocol, stats := range protocolStats {
 		serverLoad[protocol] = stats
 	}
@@ -390,6 +602,20 @@ func logServerLoad(server *TunnelServer) {
 
 		log.LogRawFieldsWithTimestamp(serverLoad)
 	}
+
+	for platform, platformProtocolStats := range platformStats {
+
+		serverLoad := LogFields{
+			"event_name":      "server_load",
+			"client_platform": platform,
+		}
+
+		for protocol, stats := range platformProtocolStats {
+			serverLoad[protocol] = stats
+		}
+
+		log.LogRawFieldsWithTimestamp(serverLoad)
+	}
 }
 
 // SupportServices carries common and shared data components
@@ -398,15 +624,30 @@ func logServerLoad(server *TunnelServer) {
 // components, which allows these data components to be refreshed
 // without restarting the server process.
 type SupportServices struct {
-	Config             *Config
-	TrafficRulesSet    *TrafficRulesSet
-	OSLConfig          *osl.Config
-	PsinetDatabase     *psinet.Database
-	GeoIPService       *GeoIPService
-	DNSResolver        *DNSResolver
-	TunnelServer       *TunnelServer
-	PacketTunnelServer *tun.Server
-	TacticsServer      *tactics.Server
+	Config                *Config
+	TrafficRulesSet       *TrafficRulesSet
+	OSLConfig             *osl.Config
+	PsinetDatabase        *psinet.Database
+	GeoIPService          *GeoIPService
+	DNSResolver           *DNSResolver
+	TunnelServer          *TunnelServer
+	PacketTunnelServer    *tun.Server
+	TacticsServer         *tactics.Server
+	OTLPExporter          *OTLPExporter
+	TunnelAuthHook        *TunnelAuthHook
+	ProbeMirror           *ProbeMirror
+	PortForwardResolver   *PortForwardResolver
+	FlowExporter          *FlowExporter
+	ConnectionEventLogger *ConnectionEventLogger
+	dataUsers             *supportServicesDataUsers
+}
+
+// supportServicesDataUsers tracks the SupportServices that share data
+// components, so that reload post actions are applied to the tunnel
+// servers of all instances sharing the reloaded components.
+type supportServicesDataUsers struct {
+	mutex sync.Mutex
+	users []*SupportServices
 }
 
 // NewSupportServices initializes a new SupportServices.
@@ -428,7 +669,9 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 	}
 
 	geoIPService, err := NewGeoIPService(
-		config.GeoIPDatabaseFilenames, config.DiscoveryValueHMACKey)
+		config.GeoIPDatabaseFilenames,
+		config.DiscoveryValueHMACKey,
+		config.SessionCacheMaxEntries)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -447,15 +690,159 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		return nil, common.ContextError(err)
 	}
 
-	return &SupportServices{
-		Config:          config,
-		TrafficRulesSet: trafficRulesSet,
-		OSLConfig:       oslConfig,
-		PsinetDatabase:  psinetDatabase,
-		GeoIPService:    geoIPService,
-		DNSResolver:     dnsResolver,
-		TacticsServer:   tacticsServer,
-	}, nil
+	var otlpExporter *OTLPExporter
+	if config.RunOTLPExporter() {
+		otlpExporter = NewOTLPExporter(config)
+	}
+
+	var tunnelAuthHook *TunnelAuthHook
+	if config.RunTunnelAuthHook() {
+		tunnelAuthHook = NewTunnelAuthHook(config)
+	}
+
+	var probeMirror *ProbeMirror
+	if config.RunProbeMirror() {
+		probeMirror = NewProbeMirror(config)
+	}
+
+	var portForwardResolver *PortForwardResolver
+	if config.RunPortForwardResolver() {
+		portForwardResolver, err = NewPortForwardResolver(config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	var flowExporter *FlowExporter
+	if config.RunFlowExporter() {
+		flowExporter, err = NewFlowExporter(config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	var connectionEventLogger *ConnectionEventLogger
+	if config.RunConnectionEventLogger() {
+		connectionEventLogger, err = NewConnectionEventLogger(config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	support := &SupportServices{
+		Config:                config,
+		TrafficRulesSet:       trafficRulesSet,
+		OSLConfig:             oslConfig,
+		PsinetDatabase:        psinetDatabase,
+		GeoIPService:          geoIPService,
+		DNSResolver:           dnsResolver,
+		TacticsServer:         tacticsServer,
+		OTLPExporter:          otlpExporter,
+		TunnelAuthHook:        tunnelAuthHook,
+		ProbeMirror:           probeMirror,
+		PortForwardResolver:   portForwardResolver,
+		FlowExporter:          flowExporter,
+		ConnectionEventLogger: connectionEventLogger,
+	}
+
+	support.dataUsers = &supportServicesDataUsers{
+		users: []*SupportServices{support},
+	}
+
+	return support, nil
+}
+
+// shareData initializes a new SupportServices, for the specified config,
+// which shares the data components of support. The remaining components,
+// which are per-instance, are initialized from config.
+//
+// The shared tactics server validates tactics API parameters using the
+// config of the instance which created it.
+func (support *SupportServices) shareData(config *Config) (*SupportServices, error) {
+
+	var err error
+
+	var otlpExporter *OTLPExporter
+	if config.RunOTLPExporter() {
+		otlpExporter = NewOTLPExporter(config)
+	}
+
+	var tunnelAuthHook *TunnelAuthHook
+	if config.RunTunnelAuthHook() {
+		tunnelAuthHook = NewTunnelAuthHook(config)
+	}
+
+	var probeMirror *ProbeMirror
+	if config.RunProbeMirror() {
+		probeMirror = NewProbeMirror(config)
+	}
+
+	var portForwardResolver *PortForwardResolver
+	if config.RunPortForwardResolver() {
+		portForwardResolver, err = NewPortForwardResolver(config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	var flowExporter *FlowExporter
+	if config.RunFlowExporter() {
+		flowExporter, err = NewFlowExporter(config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	var connectionEventLogger *ConnectionEventLogger
+	if config.RunConnectionEventLogger() {
+		connectionEventLogger, err = NewConnectionEventLogger(config)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	shared := &SupportServices{
+		Config:                config,
+		TrafficRulesSet:       support.TrafficRulesSet,
+		OSLConfig:             support.OSLConfig,
+		PsinetDatabase:        support.PsinetDatabase,
+		GeoIPService:          support.GeoIPService,
+		DNSResolver:           support.DNSResolver,
+		TacticsServer:         support.TacticsServer,
+		OTLPExporter:          otlpExporter,
+		TunnelAuthHook:        tunnelAuthHook,
+		ProbeMirror:           probeMirror,
+		PortForwardResolver:   portForwardResolver,
+		FlowExporter:          flowExporter,
+		ConnectionEventLogger: connectionEventLogger,
+		dataUsers:             support.dataUsers,
+	}
+
+	support.dataUsers.mutex.Lock()
+	support.dataUsers.users = append(support.dataUsers.users, shared)
+	support.dataUsers.mutex.Unlock()
+
+	return shared, nil
+}
+
+// tunnelServers returns the tunnel servers of all instances sharing the
+// data components of support.
+func (support *SupportServices) tunnelServers() []*TunnelServer {
+
+	if support.dataUsers == nil {
+		return []*TunnelServer{support.TunnelServer}
+	}
+
+	support.dataUsers.mutex.Lock()
+	defer support.dataUsers.mutex.Unlock()
+
+	tunnelServers := make([]*TunnelServer, 0, len(support.dataUsers.users))
+	for _, user := range support.dataUsers.users {
+		if user.TunnelServer != nil {
+			tunnelServers = append(tunnelServers, user.TunnelServer)
+		}
+	}
+	return tunnelServers
 }
 
 // Reload reinitializes traffic rules, psinet database, and geo IP database
@@ -471,16 +858,32 @@ func (support *SupportServices) Reload() {
 			support.TacticsServer},
 		support.GeoIPService.Reloaders()...)
 
-	// Note: established clients aren't notified when tactics change after a
-	// reload; new tactics will be obtained on the next client handshake or
-	// tactics request.
+	// When the tactics configuration has a version, established clients are
+	// pushed any changed tactics after a reload. Otherwise, new tactics will
+	// be obtained on the next client handshake or tactics request.
 
 	// Take these actions only after the corresponding Reloader has reloaded.
 	// In both the traffic rules and OSL cases, there is some impact from state
 	// reset, so the reset should be avoided where possible.
+	//
+	// When data components are shared, the actions are taken for all
+	// instances sharing the components.
 	reloadPostActions := map[common.Reloader]func(){
-		support.TrafficRulesSet: func() { support.TunnelServer.ResetAllClientTrafficRules() },
-		support.OSLConfig:       func() { support.TunnelServer.ResetAllClientOSLConfigs() },
+		support.TrafficRulesSet: func() {
+			for _, tunnelServer := range support.tunnelServers() {
+				tunnelServer.ResetAllClientTrafficRules()
+			}
+		},
+		support.OSLConfig: func() {
+			for _, tunnelServer := range support.tunnelServers() {
+				tunnelServer.ResetAllClientOSLConfigs()
+			}
+		},
+		support.TacticsServer: func() {
+			for _, tunnelServer := range support.tunnelServers() {
+				tunnelServer.PushAllClientTactics()
+			}
+		},
 	}
 
 	for _, reloader := range reloaders {
@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJitteredSchedule(t *testing.T) {
+
+	period := 10 * time.Second
+
+	for _, jitter := range []float64{0.0, 0.5, 1.0} {
+
+		schedule := newJitteredSchedule(period, jitter)
+
+		maxOffset := time.Duration(float64(period)*jitter/2) + 1
+		jittered := false
+
+		previousEventTime := schedule.start
+		for i := 1; i <= 1000; i++ {
+			eventTime := schedule.next()
+
+			// Each event must fall within its own window about the end of
+			// period i, so no period is skipped or doubled.
+			slotTime := schedule.start.Add(time.Duration(i) * period)
+			offset := eventTime.Sub(slotTime)
+			if offset < -maxOffset || offset > maxOffset {
+				t.Fatalf("unexpected offset with jitter %f: %s", jitter, offset)
+			}
+			if offset != 0 {
+				jittered = true
+			}
+
+			if eventTime.Before(previousEventTime) {
+				t.Fatalf("unexpected event order with jitter %f", jitter)
+			}
+			previousEventTime = eventTime
+		}
+
+		if jittered != (jitter > 0.0) {
+			t.Fatalf("unexpected jitter %f result: %v", jitter, jittered)
+		}
+	}
+}
+
+func TestMultipleServerInstances(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-instances-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	usedPorts := make(map[int]bool)
+
+	makeConfig := func(name string) ([]byte, int) {
+
+		port, err := getEphemeralPort("OSSH", usedPorts)
+		if err != nil {
+			t.Fatalf("getEphemeralPort failed: %s", err)
+		}
+
+		serverConfigJSON, trafficRulesJSON, oslConfigJSON, _, _, err :=
+			GenerateConfig(&GenerateConfigParams{
+				LogFilename:            filepath.Join(testDataDirName, "psiphond.log"),
+				SkipPanickingLogWriter: true,
+				ServerIPAddress:        "127.0.0.1",
+				EnableSSHAPIRequests:   true,
+				TunnelProtocolPorts:    map[string]int{"OSSH": port},
+			})
+		if err != nil {
+			t.Fatalf("GenerateConfig failed: %s", err)
+		}
+
+		var config Config
+		err = json.Unmarshal(serverConfigJSON, &config)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+
+		config.TrafficRulesFilename = filepath.Join(testDataDirName, name+"_traffic_rules.json")
+		config.OSLConfigFilename = filepath.Join(testDataDirName, name+"_osl_config.json")
+
+		err = ioutil.WriteFile(config.TrafficRulesFilename, trafficRulesJSON, 0600)
+		if err == nil {
+			err = ioutil.WriteFile(config.OSLConfigFilename, oslConfigJSON, 0600)
+		}
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		serverConfigJSON, err = json.Marshal(&config)
+		if err != nil {
+			t.Fatalf("Marshal failed: %s", err)
+		}
+
+		return serverConfigJSON, port
+	}
+
+	configJSONA, portA := makeConfig("a")
+	configJSONB, portB := makeConfig("b")
+
+	serverA, err := NewServer(configJSONA, nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	serverB, err := NewServer(configJSONB, serverA)
+	if err != nil {
+		t.Fatalf("NewServer failed: %s", err)
+	}
+
+	// Data components are shared; tunnel servers and configs are not.
+
+	if serverB.support.PsinetDatabase != serverA.support.PsinetDatabase ||
+		serverB.support.TrafficRulesSet != serverA.support.TrafficRulesSet ||
+		serverB.support.TacticsServer != serverA.support.TacticsServer {
+		t.Fatalf("unexpected unshared data components")
+	}
+
+	if serverB.tunnelServer == serverA.tunnelServer ||
+		serverB.support.Config == serverA.support.Config {
+		t.Fatalf("unexpected shared instance components")
+	}
+
+	if len(serverA.support.tunnelServers()) != 2 ||
+		len(serverB.support.tunnelServers()) != 2 {
+		t.Fatalf("unexpected tunnel servers")
+	}
+
+	stopBroadcast := make(chan struct{})
+	runErrs := make(chan error, 2)
+
+	for _, server := range []*Server{serverA, serverB} {
+		server := server
+		go func() {
+			runErrs <- server.Run(stopBroadcast)
+		}()
+	}
+
+	for _, port := range []int{portA, portB} {
+		address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		deadline := time.Now().Add(TEST_SERVER_START_TIMEOUT)
+		for {
+			conn, err := net.DialTimeout("tcp", address, 100*time.Millisecond)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("instance listener not accepting connections: %s", address)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	serverB.Reload()
+
+	err = serverA.Run(stopBroadcast)
+	if err == nil {
+		t.Fatalf("unexpected second Run success")
+	}
+
+	close(stopBroadcast)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-runErrs:
+			if err != nil {
+				t.Fatalf("Run failed: %s", err)
+			}
+		case <-time.After(TEST_SERVER_STOP_TIMEOUT):
+			t.Fatalf("Run stop timed out")
+		}
+	}
+}
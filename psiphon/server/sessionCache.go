@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+const (
+	SESSION_CACHE_NO_EXPIRATION      = time.Duration(-1)
+	SESSION_CACHE_DEFAULT_EXPIRATION = time.Duration(0)
+	SESSION_CACHE_PRUNE_PERIOD       = 1 * time.Minute
+	SESSION_CACHE_SHRINK_FRACTION    = 0.5
+)
+
+// sessionCache is an expiring cache of per-session state, such as GeoIP
+// data and OSL seed state, with an optional limit on the number of entries.
+// When the limit is reached, the least recently used entry is evicted.
+//
+// Expired entries are pruned, at most once per SESSION_CACHE_PRUNE_PERIOD,
+// when entries are added; there is no background janitor.
+//
+// Hit, miss, and eviction counts are recorded for server load metrics.
+type sessionCache struct {
+	mutex             sync.Mutex
+	defaultExpiration time.Duration
+	maxEntries        int
+	entries           map[string]*list.Element
+	lru               *list.List
+	lastPrune         monotime.Time
+	hits              int64
+	misses            int64
+	evictions         int64
+}
+
+type sessionCacheEntry struct {
+	key    string
+	value  interface{}
+	expiry monotime.Time
+}
+
+// newSessionCache initializes a new sessionCache. Entries set with
+// SESSION_CACHE_DEFAULT_EXPIRATION expire after defaultExpiration. When
+// maxEntries is 0, the number of entries is not limited.
+func newSessionCache(defaultExpiration time.Duration, maxEntries int) *sessionCache {
+	return &sessionCache{
+		defaultExpiration: defaultExpiration,
+		maxEntries:        maxEntries,
+		entries:           make(map[string]*list.Element),
+		lru:               list.New(),
+		lastPrune:         monotime.Now(),
+	}
+}
+
+// Set adds or replaces the entry for key. expiration is a TTL,
+// SESSION_CACHE_DEFAULT_EXPIRATION, or SESSION_CACHE_NO_EXPIRATION.
+func (c *sessionCache) Set(key string, value interface{}, expiration time.Duration) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := monotime.Now()
+
+	if now.Sub(c.lastPrune) >= SESSION_CACHE_PRUNE_PERIOD {
+		c.pruneExpired(now)
+		c.lastPrune = now
+	}
+
+	if expiration == SESSION_CACHE_DEFAULT_EXPIRATION {
+		expiration = c.defaultExpiration
+	}
+	var expiry monotime.Time
+	if expiration > 0 {
+		expiry = now.Add(expiration)
+	}
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*sessionCacheEntry)
+		entry.value = value
+		entry.expiry = expiry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(
+		&sessionCacheEntry{key: key, value: value, expiry: expiry})
+
+	if c.maxEntries > 0 {
+		for c.lru.Len() > c.maxEntries {
+			c.removeElement(c.lru.Back())
+			c.evictions += 1
+		}
+	}
+}
+
+// Get returns the unexpired entry value for key, if found, and marks the
+// entry as recently used.
+func (c *sessionCache) Get(key string) (interface{}, bool) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if ok {
+		entry := element.Value.(*sessionCacheEntry)
+		if entry.expiry != 0 && monotime.Now() >= entry.expiry {
+			c.removeElement(element)
+			ok = false
+		}
+	}
+
+	if !ok {
+		c.misses += 1
+		return nil, false
+	}
+
+	c.hits += 1
+	c.lru.MoveToFront(element)
+	return element.Value.(*sessionCacheEntry).value, true
+}
+
+// Delete removes the entry for key, if any.
+func (c *sessionCache) Delete(key string) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+// Flush removes all entries.
+func (c *sessionCache) Flush() {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Shrink evicts the least recently used fraction of the entries, to free
+// memory when the server is under memory pressure. Shrink returns the
+// number of evicted entries.
+func (c *sessionCache) Shrink(fraction float64) int {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pruneExpired(monotime.Now())
+
+	count := int(float64(c.lru.Len()) * fraction)
+	if count == 0 && c.lru.Len() > 0 {
+		count = 1
+	}
+
+	for i := 0; i < count; i++ {
+		c.removeElement(c.lru.Back())
+	}
+	c.evictions += int64(count)
+
+	return count
+}
+
+// GetMetrics returns the current number of entries and the cumulative hit,
+// miss, and eviction counts. Evictions don't include expired entries.
+func (c *sessionCache) GetMetrics() LogFields {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return LogFields{
+		"entries":   c.lru.Len(),
+		"hits":      c.hits,
+		"misses":    c.misses,
+		"evictions": c.evictions,
+	}
+}
+
+func (c *sessionCache) pruneExpired(now monotime.Time) {
+	for key, element := range c.entries {
+		entry := element.Value.(*sessionCacheEntry)
+		if entry.expiry != 0 && now >= entry.expiry {
+			delete(c.entries, key)
+			c.lru.Remove(element)
+		}
+	}
+}
+
+func (c *sessionCache) removeElement(element *list.Element) {
+	entry := c.lru.Remove(element).(*sessionCacheEntry)
+	delete(c.entries, entry.key)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSessionCache(t *testing.T) {
+
+	maxEntries := 10
+
+	c := newSessionCache(100*time.Millisecond, maxEntries)
+
+	for i := 0; i < maxEntries; i++ {
+		c.Set(fmt.Sprintf("%d", i), i, SESSION_CACHE_NO_EXPIRATION)
+	}
+
+	// Use entry 0, so that entry 1 is the least recently used.
+
+	value, ok := c.Get("0")
+	if !ok || value.(int) != 0 {
+		t.Fatalf("unexpected entry: %v %v", value, ok)
+	}
+
+	c.Set("new", -1, SESSION_CACHE_NO_EXPIRATION)
+
+	if _, ok := c.Get("1"); ok {
+		t.Fatalf("least recently used entry not evicted")
+	}
+	if _, ok := c.Get("0"); !ok {
+		t.Fatalf("recently used entry evicted")
+	}
+
+	// Replacing an entry doesn't evict.
+
+	c.Set("new", -2, SESSION_CACHE_DEFAULT_EXPIRATION)
+
+	if _, ok := c.Get("2"); !ok {
+		t.Fatalf("unexpected eviction on replace")
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, ok := c.Get("new"); ok {
+		t.Fatalf("expired entry found")
+	}
+
+	metrics := c.GetMetrics()
+	if metrics["entries"].(int) != maxEntries-1 ||
+		metrics["hits"].(int64) != 3 ||
+		metrics["misses"].(int64) != 2 ||
+		metrics["evictions"].(int64) != 1 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+
+	evicted := c.Shrink(SESSION_CACHE_SHRINK_FRACTION)
+	if evicted != (maxEntries-1)/2 {
+		t.Fatalf("unexpected shrink count: %d", evicted)
+	}
+
+	// The most recently used entries remain.
+
+	if _, ok := c.Get("2"); !ok {
+		t.Fatalf("recently used entry evicted by shrink")
+	}
+	if _, ok := c.Get("3"); ok {
+		t.Fatalf("least recently used entry not evicted by shrink")
+	}
+
+	c.Flush()
+
+	if c.GetMetrics()["entries"].(int) != 0 {
+		t.Fatalf("unexpected entries after flush")
+	}
+
+	// With no limit, entries aren't evicted.
+
+	c = newSessionCache(time.Minute, 0)
+
+	for i := 0; i < 1000; i++ {
+		c.Set(fmt.Sprintf("%d", i), i, SESSION_CACHE_DEFAULT_EXPIRATION)
+	}
+
+	if c.GetMetrics()["entries"].(int) != 1000 {
+		t.Fatalf("unexpected eviction without limit")
+	}
+}
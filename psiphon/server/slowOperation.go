@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+const (
+	SLOW_OPERATION_SSH_HANDSHAKE            = "ssh_handshake"
+	SLOW_OPERATION_TCP_PORT_FORWARD_RESOLVE = "tcp_port_forward_resolve"
+	SLOW_OPERATION_TCP_PORT_FORWARD_DIAL    = "tcp_port_forward_dial"
+)
+
+// SupportedSlowOperations are the operations which may be specified in
+// Config.SlowOperationThresholdsMilliseconds.
+var SupportedSlowOperations = []string{
+	SLOW_OPERATION_SSH_HANDSHAKE,
+	SLOW_OPERATION_TCP_PORT_FORWARD_RESOLVE,
+	SLOW_OPERATION_TCP_PORT_FORWARD_DIAL,
+}
+
+// logSlowOperation logs a "slow operation" event when the operation, which
+// started at startTime, exceeds its threshold in
+// Config.SlowOperationThresholdsMilliseconds. Operations without a threshold
+// are not logged.
+func logSlowOperation(
+	config *Config,
+	operation string,
+	startTime monotime.Time,
+	tunnelProtocol string) {
+
+	threshold, ok := config.SlowOperationThresholdsMilliseconds[operation]
+	if !ok || threshold <= 0 {
+		return
+	}
+
+	duration := monotime.Since(startTime)
+	if duration < time.Duration(threshold)*time.Millisecond {
+		return
+	}
+
+	log.WithContextFields(
+		LogFields{
+			"operation":       operation,
+			"duration":        int64(duration / time.Millisecond),
+			"tunnel_protocol": tunnelProtocol,
+		}).Info("slow operation")
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+// setListenTCPMaxSegmentSize sets TCP_MAXSEG on a listening TCP socket.
+// Accepted sockets inherit the option, which limits both the MSS advertised
+// to clients in the SYN-ACK and the size of segments sent by the server.
+func setListenTCPMaxSegmentSize(listener net.Listener, maxSegmentSize int) error {
+
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return common.ContextError(errors.New("unsupported listener type"))
+	}
+
+	rawConn, err := tcpListener.SyscallConn()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	var setsockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		setsockoptErr = syscall.SetsockoptInt(
+			int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, maxSegmentSize)
+	})
+	if err == nil {
+		err = setsockoptErr
+	}
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
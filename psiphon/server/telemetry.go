@@ -0,0 +1,432 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+const (
+	OTLP_EXPORT_TIMEOUT        = 10 * time.Second
+	OTLP_SPAN_EXPORT_PERIOD    = 5 * time.Second
+	OTLP_MAX_BUFFERED_SPANS    = 10000
+	OTLP_SERVICE_NAME          = "psiphond"
+	OTLP_INSTRUMENTATION_SCOPE = "github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/server"
+
+	otlpSpanKindServer = 2
+	otlpStatusCodeOK   = 1
+	otlpStatusCodeErr  = 2
+)
+
+// OTLPExporter exports server metrics and traces to an OpenTelemetry
+// collector using OTLP/HTTP with the JSON encoding.
+//
+// Metrics are the server load stats, as logged in "server_load" events;
+// these are exported each time the load monitor runs, so metrics export
+// requires Config.LoadMonitorPeriodSeconds.
+//
+// Traces cover tunnel establishment: each accepted client connection has an
+// establishment span, from accept until the client is established, with a
+// child span for the SSH handshake. Spans are buffered and exported
+// periodically.
+//
+// Exported data includes only the tunnel protocol and outcome; no client
+// IP, geolocation, session ID, or other client-identifying data is
+// exported.
+type OTLPExporter struct {
+	endpoint   string
+	httpClient *http.Client
+	resource   otlpResource
+
+	spansMutex sync.Mutex
+	spans      []*otlpSpan
+}
+
+// NewOTLPExporter initializes a new OTLPExporter that exports to
+// Config.OTLPEndpoint.
+func NewOTLPExporter(config *Config) *OTLPExporter {
+
+	attributes := []otlpAttribute{
+		makeOTLPAttribute("service.name", OTLP_SERVICE_NAME),
+	}
+	if config.HostID != "" {
+		attributes = append(
+			attributes, makeOTLPAttribute("service.instance.id", config.HostID))
+	}
+
+	return &OTLPExporter{
+		endpoint:   strings.TrimSuffix(config.OTLPEndpoint, "/"),
+		httpClient: &http.Client{Timeout: OTLP_EXPORT_TIMEOUT},
+		resource:   otlpResource{Attributes: attributes},
+	}
+}
+
+// Run periodically exports buffered spans until shutdownBroadcast is
+// signaled. Any remaining buffered spans are exported before Run returns.
+func (exporter *OTLPExporter) Run(shutdownBroadcast <-chan struct{}) {
+
+	ticker := time.NewTicker(OTLP_SPAN_EXPORT_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-shutdownBroadcast:
+			exporter.exportSpans()
+			return
+		}
+		exporter.exportSpans()
+	}
+}
+
+// startEstablishmentTrace starts a tunnel establishment span for a newly
+// accepted client connection. When the exporter is nil, as it is when OTLP
+// export is disabled, the returned establishmentTrace is nil.
+func (exporter *OTLPExporter) startEstablishmentTrace(
+	tunnelProtocol string) *establishmentTrace {
+
+	if exporter == nil {
+		return nil
+	}
+
+	return &establishmentTrace{
+		exporter:       exporter,
+		tunnelProtocol: tunnelProtocol,
+		traceID:        makeOTLPID(16),
+		spanID:         makeOTLPID(8),
+		startTime:      time.Now(),
+	}
+}
+
+// exportLoadStats exports the per-protocol load stats as gauges. The stats
+// are the values returned by sshServer.getLoadStats, which also resets the
+// quality metrics counters; so load stats must be shared with, and not
+// fetched independently of, the load monitor.
+func (exporter *OTLPExporter) exportLoadStats(protocolStats ProtocolStats) {
+
+	timestamp := otlpTimestamp(time.Now())
+
+	var tunnelProtocols []string
+	for tunnelProtocol := range protocolStats {
+		tunnelProtocols = append(tunnelProtocols, tunnelProtocol)
+	}
+	sort.Strings(tunnelProtocols)
+
+	metrics := make(map[string]*otlpMetric)
+	var metricNames []string
+
+	for _, tunnelProtocol := range tunnelProtocols {
+		for statName, value := range protocolStats[tunnelProtocol] {
+
+			metricName := OTLP_SERVICE_NAME + "." + statName
+			metric, ok := metrics[metricName]
+			if !ok {
+				metric = &otlpMetric{Name: metricName, Gauge: &otlpGauge{}}
+				metrics[metricName] = metric
+				metricNames = append(metricNames, metricName)
+			}
+
+			metric.Gauge.DataPoints = append(
+				metric.Gauge.DataPoints,
+				otlpNumberDataPoint{
+					Attributes: []otlpAttribute{
+						makeOTLPAttribute("tunnel_protocol", tunnelProtocol)},
+					TimeUnixNano: timestamp,
+					AsInt:        strconv.FormatInt(value, 10),
+				})
+		}
+	}
+
+	sort.Strings(metricNames)
+
+	scopeMetrics := otlpScopeMetrics{Scope: otlpScope{Name: OTLP_INSTRUMENTATION_SCOPE}}
+	for _, metricName := range metricNames {
+		scopeMetrics.Metrics = append(scopeMetrics.Metrics, metrics[metricName])
+	}
+
+	request := &otlpMetricsRequest{
+		ResourceMetrics: []otlpResourceMetrics{
+			{
+				Resource:     exporter.resource,
+				ScopeMetrics: []otlpScopeMetrics{scopeMetrics},
+			},
+		},
+	}
+
+	err := exporter.post("/v1/metrics", request)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("export metrics failed")
+	}
+}
+
+func (exporter *OTLPExporter) addSpans(spans ...*otlpSpan) {
+	exporter.spansMutex.Lock()
+	defer exporter.spansMutex.Unlock()
+
+	// Drop spans when the collector is unavailable and the buffer is full,
+	// to bound memory usage.
+	if len(exporter.spans)+len(spans) > OTLP_MAX_BUFFERED_SPANS {
+		return
+	}
+	exporter.spans = append(exporter.spans, spans...)
+}
+
+func (exporter *OTLPExporter) exportSpans() {
+
+	exporter.spansMutex.Lock()
+	spans := exporter.spans
+	exporter.spans = nil
+	exporter.spansMutex.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	request := &otlpTraceRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: exporter.resource,
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: OTLP_INSTRUMENTATION_SCOPE},
+						Spans: spans,
+					},
+				},
+			},
+		},
+	}
+
+	err := exporter.post("/v1/traces", request)
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning("export spans failed")
+	}
+}
+
+func (exporter *OTLPExporter) post(path string, request interface{}) error {
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	response, err := exporter.httpClient.Post(
+		exporter.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	// Drain the response body so the connection may be reused.
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return common.ContextError(
+			fmt.Errorf("unexpected response status code: %d", response.StatusCode))
+	}
+
+	return nil
+}
+
+// establishmentTrace records the tunnel establishment span for a single
+// client connection. All establishmentTrace methods are no-ops when the
+// establishmentTrace is nil, which is the case when OTLP export is
+// disabled.
+type establishmentTrace struct {
+	exporter              *OTLPExporter
+	tunnelProtocol        string
+	traceID               string
+	spanID                string
+	startTime             time.Time
+	sshHandshakeEndTime   time.Time
+	sshHandshakeSucceeded bool
+	ended                 bool
+}
+
+// sshHandshakeCompleted records the end of a successful SSH handshake.
+func (trace *establishmentTrace) sshHandshakeCompleted() {
+	if trace == nil {
+		return
+	}
+	trace.sshHandshakeEndTime = time.Now()
+	trace.sshHandshakeSucceeded = true
+}
+
+// end ends the establishment span and submits the span for export. Only the
+// first call to end has any effect, so end may be deferred to record
+// failures and also called on success.
+func (trace *establishmentTrace) end(established bool) {
+	if trace == nil || trace.ended {
+		return
+	}
+	trace.ended = true
+
+	endTime := time.Now()
+
+	protocolAttribute := makeOTLPAttribute("tunnel_protocol", trace.tunnelProtocol)
+
+	sshHandshakeEndTime := trace.sshHandshakeEndTime
+	if !trace.sshHandshakeSucceeded {
+		sshHandshakeEndTime = endTime
+	}
+
+	sshHandshakeSpan := &otlpSpan{
+		TraceID:           trace.traceID,
+		SpanID:            makeOTLPID(8),
+		ParentSpanID:      trace.spanID,
+		Name:              "ssh_handshake",
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: otlpTimestamp(trace.startTime),
+		EndTimeUnixNano:   otlpTimestamp(sshHandshakeEndTime),
+		Attributes:        []otlpAttribute{protocolAttribute},
+		Status:            makeOTLPStatus(trace.sshHandshakeSucceeded),
+	}
+
+	establishmentSpan := &otlpSpan{
+		TraceID:           trace.traceID,
+		SpanID:            trace.spanID,
+		Name:              "tunnel_establishment",
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: otlpTimestamp(trace.startTime),
+		EndTimeUnixNano:   otlpTimestamp(endTime),
+		Attributes:        []otlpAttribute{protocolAttribute},
+		Status:            makeOTLPStatus(established),
+	}
+
+	trace.exporter.addSpans(establishmentSpan, sshHandshakeSpan)
+}
+
+func makeOTLPID(length int) string {
+	// On the unlikely failure of MakeSecureRandomBytes, the result is an
+	// invalid, all zero ID and the span is expected to be dropped by the
+	// collector.
+	ID, _ := common.MakeSecureRandomBytes(length)
+	if ID == nil {
+		ID = make([]byte, length)
+	}
+	return hex.EncodeToString(ID)
+}
+
+func otlpTimestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func makeOTLPAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+func makeOTLPStatus(ok bool) otlpStatus {
+	if ok {
+		return otlpStatus{Code: otlpStatusCodeOK}
+	}
+	return otlpStatus{Code: otlpStatusCodeErr}
+}
+
+// The following types are the subset of the OTLP JSON encoding used by
+// OTLPExporter. See:
+// https://github.com/open-telemetry/opentelemetry-proto/tree/main/opentelemetry/proto
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Gauge *otlpGauge `json:"gauge"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsInt        string          `json:"asInt"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
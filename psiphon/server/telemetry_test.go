@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestOTLPExporter(t *testing.T) {
+
+	var mutex sync.Mutex
+	var traceRequests []*otlpTraceRequest
+	var metricsRequests []*otlpMetricsRequest
+
+	collector := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			var err error
+			switch r.URL.Path {
+			case "/v1/traces":
+				var request otlpTraceRequest
+				err = json.NewDecoder(r.Body).Decode(&request)
+				traceRequests = append(traceRequests, &request)
+			case "/v1/metrics":
+				var request otlpMetricsRequest
+				err = json.NewDecoder(r.Body).Decode(&request)
+				metricsRequests = append(metricsRequests, &request)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(
+		&Config{OTLPEndpoint: collector.URL + "/", HostID: "test-host"})
+
+	established := exporter.startEstablishmentTrace("OSSH")
+	established.sshHandshakeCompleted()
+	established.end(true)
+	established.end(false)
+
+	failed := exporter.startEstablishmentTrace("SSH")
+	failed.end(false)
+
+	var disabledExporter *OTLPExporter
+	disabled := disabledExporter.startEstablishmentTrace("OSSH")
+	disabled.sshHandshakeCompleted()
+	disabled.end(true)
+
+	exporter.exportSpans()
+
+	exporter.exportLoadStats(ProtocolStats{
+		"ALL":  {"accepted_clients": 2, "established_clients": 1},
+		"OSSH": {"accepted_clients": 1, "established_clients": 1},
+		"SSH":  {"accepted_clients": 1, "established_clients": 0},
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(traceRequests) != 1 {
+		t.Fatalf("unexpected trace request count: %d", len(traceRequests))
+	}
+
+	spans := traceRequests[0].ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 4 {
+		t.Fatalf("unexpected span count: %d", len(spans))
+	}
+
+	expectedStatusCodes := []int{
+		otlpStatusCodeOK, otlpStatusCodeOK, otlpStatusCodeErr, otlpStatusCodeErr}
+
+	for i, span := range spans {
+		if len(span.TraceID) != 32 || len(span.SpanID) != 16 {
+			t.Fatalf("unexpected span IDs: %+v", span)
+		}
+		if span.Status.Code != expectedStatusCodes[i] {
+			t.Fatalf("unexpected span status: %+v", span)
+		}
+		if i%2 == 1 && span.ParentSpanID != spans[i-1].SpanID {
+			t.Fatalf("unexpected parent span: %+v", span)
+		}
+		for _, attribute := range span.Attributes {
+			if attribute.Key != "tunnel_protocol" {
+				t.Fatalf("unexpected span attribute: %+v", attribute)
+			}
+		}
+	}
+
+	if len(metricsRequests) != 1 {
+		t.Fatalf("unexpected metrics request count: %d", len(metricsRequests))
+	}
+
+	metrics := metricsRequests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 2 ||
+		metrics[0].Name != "psiphond.accepted_clients" ||
+		len(metrics[0].Gauge.DataPoints) != 3 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
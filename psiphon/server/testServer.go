@@ -0,0 +1,354 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+const (
+	TEST_SERVER_START_TIMEOUT = 10 * time.Second
+	TEST_SERVER_STOP_TIMEOUT  = 10 * time.Second
+)
+
+// TestServerConfig specifies the configuration for NewTestServer.
+type TestServerConfig struct {
+
+	// TunnelProtocols are the tunnel protocols to run. Each protocol listens
+	// on an ephemeral loopback port.
+	TunnelProtocols []string
+
+	// EnableSSHAPIRequests specifies whether the server entry includes the
+	// SSH API requests capability. When false, the web server is run.
+	EnableSSHAPIRequests bool
+
+	// Tactics, when not nil, is the tactics server configuration to apply.
+	// The request key fields are overwritten with generated values, which
+	// are also included in the server entry. Tactics capabilities are only
+	// added for meek protocols; see GenerateConfig.
+	Tactics *tactics.Server
+
+	// GeoIPDatabaseFilenames are GeoIP database fixtures to be used in place
+	// of Config.GeoIPDatabaseFilenames.
+	GeoIPDatabaseFilenames []string
+
+	// TrafficRules, when not nil, replaces the generated traffic rules.
+	TrafficRules *TrafficRulesSet
+
+	// LogLevel is the server log level. The default is "info".
+	LogLevel string
+}
+
+// TestServer is a running, fully-functional server, intended for
+// integration tests that drive in-process clients. TestServer listens on
+// loopback addresses only.
+type TestServer struct {
+
+	// EncodedServerEntry is the server entry for the test server, which
+	// may be used as a client TargetServerEntry or stored in the client
+	// datastore.
+	EncodedServerEntry string
+
+	// Config is the server config in use.
+	Config *Config
+
+	dataDirectory string
+	stopBroadcast chan struct{}
+	waitGroup     *sync.WaitGroup
+	runErr        error
+}
+
+// NewTestServer generates a server config, with all key material, using
+// GenerateConfig; starts the server; and waits until the server is
+// accepting connections.
+//
+// All config files, including generated traffic rules and tactics, and the
+// server log, are written to a temporary directory that is removed by Stop.
+//
+// As the server logger is a process-wide singleton initialized only once,
+// LogLevel applies only to the first server run in a process.
+func NewTestServer(config *TestServerConfig) (*TestServer, error) {
+
+	if len(config.TunnelProtocols) == 0 {
+		return nil, common.ContextError(errors.New("no tunnel protocols"))
+	}
+
+	dataDirectory, err := ioutil.TempDir("", "psiphon-test-server")
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	server, err := startTestServer(config, dataDirectory)
+	if err != nil {
+		os.RemoveAll(dataDirectory)
+		return nil, common.ContextError(err)
+	}
+
+	return server, nil
+}
+
+func startTestServer(config *TestServerConfig, dataDirectory string) (*TestServer, error) {
+
+	serverIPAddress := "127.0.0.1"
+
+	generateConfigParams := &GenerateConfigParams{
+		LogFilename:            filepath.Join(dataDirectory, "psiphond.log"),
+		SkipPanickingLogWriter: true,
+		LogLevel:               config.LogLevel,
+		ServerIPAddress:        serverIPAddress,
+		EnableSSHAPIRequests:   config.EnableSSHAPIRequests,
+		TunnelProtocolPorts:    make(map[string]int),
+	}
+
+	usedPorts := make(map[int]bool)
+
+	for _, tunnelProtocol := range config.TunnelProtocols {
+		port, err := getEphemeralPort(tunnelProtocol, usedPorts)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		generateConfigParams.TunnelProtocolPorts[tunnelProtocol] = port
+	}
+
+	if !config.EnableSSHAPIRequests {
+		port, err := getEphemeralPort("", usedPorts)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+		generateConfigParams.WebServerPort = port
+	}
+
+	var tacticsRequestPrivateKey string
+
+	if config.Tactics != nil {
+		var err error
+		generateConfigParams.TacticsRequestPublicKey,
+			tacticsRequestPrivateKey,
+			generateConfigParams.TacticsRequestObfuscatedKey,
+			err = tactics.GenerateKeys()
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	serverConfigJSON, trafficRulesJSON, oslConfigJSON, _, encodedServerEntry, err :=
+		GenerateConfig(generateConfigParams)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if config.TrafficRules != nil {
+		trafficRulesJSON, err = json.Marshal(config.TrafficRules)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	var serverConfig Config
+	err = json.Unmarshal(serverConfigJSON, &serverConfig)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	serverConfig.GeoIPDatabaseFilenames = config.GeoIPDatabaseFilenames
+	serverConfig.TrafficRulesFilename = filepath.Join(dataDirectory, "traffic_rules.json")
+	serverConfig.OSLConfigFilename = filepath.Join(dataDirectory, "osl_config.json")
+
+	err = ioutil.WriteFile(serverConfig.TrafficRulesFilename, trafficRulesJSON, 0600)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	err = ioutil.WriteFile(serverConfig.OSLConfigFilename, oslConfigJSON, 0600)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if config.Tactics != nil {
+
+		config.Tactics.RequestPublicKey, err = base64.StdEncoding.DecodeString(
+			generateConfigParams.TacticsRequestPublicKey)
+		if err == nil {
+			config.Tactics.RequestPrivateKey, err = base64.StdEncoding.DecodeString(
+				tacticsRequestPrivateKey)
+		}
+		if err == nil {
+			config.Tactics.RequestObfuscatedKey, err = base64.StdEncoding.DecodeString(
+				generateConfigParams.TacticsRequestObfuscatedKey)
+		}
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		tacticsConfigJSON, err := json.Marshal(config.Tactics)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
+		serverConfig.TacticsConfigFilename = filepath.Join(dataDirectory, "tactics_config.json")
+
+		err = ioutil.WriteFile(serverConfig.TacticsConfigFilename, tacticsConfigJSON, 0600)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+	}
+
+	serverConfigJSON, err = json.Marshal(&serverConfig)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	server := &TestServer{
+		EncodedServerEntry: string(encodedServerEntry),
+		Config:             &serverConfig,
+		dataDirectory:      dataDirectory,
+		stopBroadcast:      make(chan struct{}),
+		waitGroup:          new(sync.WaitGroup),
+	}
+
+	runErr := make(chan error, 1)
+
+	server.waitGroup.Add(1)
+	go func() {
+		defer server.waitGroup.Done()
+		err := runServices(serverConfigJSON, server.stopBroadcast)
+		server.runErr = err
+		runErr <- err
+	}()
+
+	// Wait until all TCP listeners are accepting connections. UDP
+	// listeners, for QUIC, cannot be probed.
+
+	var probeAddresses []string
+	for tunnelProtocol, port := range generateConfigParams.TunnelProtocolPorts {
+		if !protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
+			probeAddresses = append(
+				probeAddresses, net.JoinHostPort(serverIPAddress, strconv.Itoa(port)))
+		}
+	}
+
+	deadline := time.Now().Add(TEST_SERVER_START_TIMEOUT)
+
+	for _, address := range probeAddresses {
+		for {
+			conn, err := net.DialTimeout("tcp", address, 100*time.Millisecond)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			select {
+			case err := <-runErr:
+				if err == nil {
+					err = errors.New("server stopped")
+				}
+				return nil, common.ContextError(err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			if time.Now().After(deadline) {
+				server.stop()
+				return nil, common.ContextError(errors.New("server start timed out"))
+			}
+		}
+	}
+
+	return server, nil
+}
+
+// Stop stops the server and removes its temporary files. Stop returns any
+// error returned by the server run.
+func (server *TestServer) Stop() error {
+
+	err := server.stop()
+
+	os.RemoveAll(server.dataDirectory)
+
+	return err
+}
+
+func (server *TestServer) stop() error {
+
+	close(server.stopBroadcast)
+
+	stopped := make(chan struct{})
+	go func() {
+		server.waitGroup.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(TEST_SERVER_STOP_TIMEOUT):
+		return common.ContextError(errors.New("server stop timed out"))
+	}
+
+	if server.runErr != nil {
+		return common.ContextError(server.runErr)
+	}
+
+	return nil
+}
+
+// getEphemeralPort returns a free loopback port, suitable for the
+// specified tunnel protocol, that is not in usedPorts. As the port is
+// released before the server listens on it, there's a small chance that
+// the port will be taken by another process.
+func getEphemeralPort(tunnelProtocol string, usedPorts map[int]bool) (int, error) {
+
+	for i := 0; i < 10; i++ {
+
+		var port int
+
+		if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				return 0, common.ContextError(err)
+			}
+			port = conn.LocalAddr().(*net.UDPAddr).Port
+			conn.Close()
+		} else {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return 0, common.ContextError(err)
+			}
+			port = listener.Addr().(*net.TCPAddr).Port
+			listener.Close()
+		}
+
+		if !usedPorts[port] {
+			usedPorts[port] = true
+			return port, nil
+		}
+	}
+
+	return 0, common.ContextError(errors.New("no available port"))
+}
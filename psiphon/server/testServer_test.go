@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+)
+
+func TestTestServer(t *testing.T) {
+
+	tacticsServer := &tactics.Server{
+		DefaultTactics: tactics.Tactics{
+			TTL:         "60s",
+			Probability: 1.0,
+			Parameters: map[string]interface{}{
+				"ConnectionWorkerPoolSize": 1,
+			},
+		},
+	}
+
+	server, err := NewTestServer(
+		&TestServerConfig{
+			TunnelProtocols: []string{
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+				protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+			},
+			EnableSSHAPIRequests: true,
+			Tactics:              tacticsServer,
+		})
+	if err != nil {
+		t.Fatalf("NewTestServer failed: %s", err)
+	}
+
+	serverEntry, err := protocol.DecodeServerEntry(
+		server.EncodedServerEntry,
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_TARGET)
+	if err != nil {
+		t.Fatalf("DecodeServerEntry failed: %s", err)
+	}
+
+	if len(serverEntry.GetSupportedTacticsProtocols()) == 0 {
+		t.Fatalf("missing tactics capability")
+	}
+
+	conn, err := net.Dial(
+		"tcp", net.JoinHostPort(
+			serverEntry.IpAddress, strconv.Itoa(serverEntry.SshObfuscatedPort)))
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	conn.Close()
+
+	err = server.Stop()
+	if err != nil {
+		t.Fatalf("Stop failed: %s", err)
+	}
+}
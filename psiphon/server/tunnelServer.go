@@ -28,7 +28,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -41,19 +44,20 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
 	"github.com/marusama/semaphore"
-	cache "github.com/patrickmn/go-cache"
 )
 
 const (
 	SSH_AUTH_LOG_PERIOD                   = 30 * time.Minute
 	SSH_HANDSHAKE_TIMEOUT                 = 30 * time.Second
 	SSH_BEGIN_HANDSHAKE_TIMEOUT           = 1 * time.Second
+	OUTBOUND_DIAL_DEFAULT_QUEUE_TIMEOUT   = 1 * time.Second
 	SSH_CONNECTION_READ_DEADLINE          = 5 * time.Minute
 	SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE = 8192
 	SSH_TCP_PORT_FORWARD_QUEUE_SIZE       = 1024
@@ -63,6 +67,16 @@ const (
 	SSH_SEND_OSL_RETRY_FACTOR             = 2
 	OSL_SESSION_CACHE_TTL                 = 5 * time.Minute
 	MAX_AUTHORIZATIONS                    = 16
+	MEMORY_MONITOR_PERIOD                 = 5 * time.Second
+	OVERLOAD_SHED_MIN_IDLE_TIME           = 1 * time.Minute
+	OVERLOAD_SHED_MAX_CLIENTS             = 16
+	OVERLOAD_SHEDDING_POLICY_REJECT       = "reject"
+	OVERLOAD_SHEDDING_POLICY_SHED_IDLE    = "shed-idle"
+	SERVER_LOAD_MEDIUM_PERCENT            = 50
+	SERVER_LOAD_HIGH_PERCENT              = 80
+	ACCEPT_QUEUE_OVERFLOW_POLICY_REJECT   = "reject"
+	ACCEPT_QUEUE_OVERFLOW_POLICY_WAIT     = "wait"
+	UPGRADE_REQUIRED_DISCONNECT_DELAY     = 5 * time.Second
 )
 
 // TunnelServer is the main server that accepts Psiphon client
@@ -144,7 +158,8 @@ func (server *TunnelServer) Run() error {
 
 		if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
 
-			listener, err = quic.Listen(localAddress)
+			listener, err = quic.Listen(
+				localAddress, makeQUICPacingParameters(support))
 
 		} else if protocol.TunnelProtocolUsesMarionette(tunnelProtocol) {
 
@@ -159,6 +174,38 @@ func (server *TunnelServer) Run() error {
 		} else {
 
 			listener, err = net.Listen("tcp", localAddress)
+
+			if err == nil && support.Config.ListenBacklog > 0 {
+				err = setListenBacklog(listener, support.Config.ListenBacklog)
+				if err != nil {
+					listener.Close()
+				}
+			}
+
+			if err == nil && support.Config.TCPFastOpenQueueLength > 0 {
+				err = setListenTCPFastOpen(listener, support.Config.TCPFastOpenQueueLength)
+				if err != nil {
+					listener.Close()
+				}
+			}
+
+			maxSegmentSize := support.Config.TunnelProtocolTCPMaxSegmentSizes[tunnelProtocol]
+			if err == nil && maxSegmentSize > 0 {
+				// The MSS clamp is not required to run the listener.
+				clampErr := setListenTCPMaxSegmentSize(listener, maxSegmentSize)
+				if clampErr != nil {
+					log.WithContextFields(
+						LogFields{
+							"tunnelProtocol": tunnelProtocol,
+							"error":          clampErr,
+						}).Warning("TCP MSS clamp failed")
+				}
+			}
+
+			if err == nil {
+				listener = newCloseBehaviorListener(listener, support, tunnelProtocol)
+				listener = newFirstWriteDelayListener(listener, support)
+			}
 		}
 
 		if err != nil {
@@ -191,6 +238,14 @@ func (server *TunnelServer) Run() error {
 			})
 	}
 
+	if support.Config.RunMemoryMonitor() {
+		server.runWaitGroup.Add(1)
+		go func() {
+			defer server.runWaitGroup.Done()
+			server.sshServer.runMemoryMonitor()
+		}()
+	}
+
 	for _, listener := range listeners {
 		server.runWaitGroup.Add(1)
 		go func(listener *sshListener) {
@@ -233,11 +288,42 @@ func (server *TunnelServer) Run() error {
 	return err
 }
 
+// makeQUICPacingParameters returns a quic.PacingParameters which applies the
+// ServerQUICPacingRate and ServerQUICPacingBurstBytes tactics parameters for
+// the client's region. The parameters are selected once for each client
+// address, when the client's first packet is sent.
+func makeQUICPacingParameters(support *SupportServices) quic.PacingParameters {
+
+	return func(addr net.Addr) (int, int) {
+
+		if support.TacticsServer == nil {
+			return 0, 0
+		}
+
+		geoIPData := support.GeoIPService.Lookup(common.IPAddressFromAddr(addr))
+
+		p, err := support.TacticsServer.GetServerSideParameters(
+			common.GeoIPData(geoIPData))
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning(
+				"failed to get tactics for QUIC pacing")
+			return 0, 0
+		}
+
+		if p == nil {
+			return 0, 0
+		}
+
+		return p.Int(parameters.ServerQUICPacingRate),
+			p.Int(parameters.ServerQUICPacingBurstBytes)
+	}
+}
+
 // GetLoadStats returns load stats for the tunnel server. The stats are
 // broken down by protocol ("SSH", "OSSH", etc.) and type. Types of stats
 // include current connected client count, total number of current port
 // forwards.
-func (server *TunnelServer) GetLoadStats() (ProtocolStats, RegionStats) {
+func (server *TunnelServer) GetLoadStats() (ProtocolStats, RegionStats, PlatformStats) {
 	return server.sshServer.getLoadStats()
 }
 
@@ -255,6 +341,42 @@ func (server *TunnelServer) ResetAllClientOSLConfigs() {
 	server.sshServer.resetAllClientOSLConfigs()
 }
 
+// PushAllClientTactics pushes the latest tactics to all established clients
+// that support server requests, when the tactics configuration has a
+// version. Clients whose tactics are unchanged are skipped.
+func (server *TunnelServer) PushAllClientTactics() {
+	server.sshServer.pushAllClientTactics()
+}
+
+// GetServerLoad returns the coarse server load level reported to clients
+// in the handshake response.
+func (server *TunnelServer) GetServerLoad() string {
+	return server.sshServer.getServerLoad()
+}
+
+// IsWarmingUp indicates whether the server is in its WarmUpPeriodSeconds
+// warm-up period.
+func (server *TunnelServer) IsWarmingUp() bool {
+	_, warmingUp := server.sshServer.getMaxEstablishedClients()
+	return warmingUp
+}
+
+// GetSessionCacheMetrics returns size and hit, miss, and eviction metrics
+// for the GeoIP and OSL session caches, keyed by cache name.
+func (server *TunnelServer) GetSessionCacheMetrics() map[string]LogFields {
+
+	sshServer := server.sshServer
+
+	sshServer.oslSessionCacheMutex.Lock()
+	oslMetrics := sshServer.oslSessionCache.GetMetrics()
+	sshServer.oslSessionCacheMutex.Unlock()
+
+	return map[string]LogFields{
+		"geoip_session_cache": sshServer.support.GeoIPService.GetSessionCacheMetrics(),
+		"osl_session_cache":   oslMetrics,
+	}
+}
+
 // SetClientHandshakeState sets the handshake state -- that it completed and
 // what parameters were passed -- in sshClient. This state is used for allowing
 // port forwards and for future traffic rule selection. SetClientHandshakeState
@@ -282,6 +404,15 @@ func (server *TunnelServer) GetClientHandshaked(
 	return server.sshServer.getClientHandshaked(sessionID)
 }
 
+// GetClientTacticsSnapshot returns the tactics snapshot taken when the
+// client connection was accepted. All tactics for a client's handshake
+// must be obtained from this snapshot.
+func (server *TunnelServer) GetClientTacticsSnapshot(
+	sessionID string) (*tactics.Snapshot, error) {
+
+	return server.sshServer.getClientTacticsSnapshot(sessionID)
+}
+
 // ExpectClientDomainBytes indicates whether the client was configured to report
 // domain bytes in its handshake response.
 func (server *TunnelServer) ExpectClientDomainBytes(
@@ -290,6 +421,14 @@ func (server *TunnelServer) ExpectClientDomainBytes(
 	return server.sshServer.expectClientDomainBytes(sessionID)
 }
 
+// DisconnectUpgradeRequiredClient disconnects a client that was rejected by
+// the minimum client version check. The disconnect is delayed by
+// UPGRADE_REQUIRED_DISCONNECT_DELAY so that the client can first receive
+// the "upgrade required" handshake response.
+func (server *TunnelServer) DisconnectUpgradeRequiredClient(sessionID string) error {
+	return server.sshServer.disconnectUpgradeRequiredClient(sessionID)
+}
+
 // SetEstablishTunnels sets whether new tunnels may be established or not.
 // When not establishing, incoming connections are immediately closed.
 func (server *TunnelServer) SetEstablishTunnels(establish bool) {
@@ -301,25 +440,52 @@ func (server *TunnelServer) GetEstablishTunnels() bool {
 	return server.sshServer.getEstablishTunnels()
 }
 
+// SendMigrationHints sends a migration hint, with the specified drain
+// deadline, to all established clients that support server requests. Each
+// hint includes alternate server entries selected using the client's
+// discovery value. Hints are sent over the clients' established SSH
+// connections, which authenticates the hints.
+func (server *TunnelServer) SendMigrationHints(deadline time.Duration) {
+	server.sshServer.sendMigrationHints(deadline)
+}
+
 type sshServer struct {
 	// Note: 64-bit ints used with atomic operations are placed
 	// at the start of struct to ensure 64-bit alignment.
 	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
 	lastAuthLog                  int64
 	authFailedCount              int64
+	inProgressSSHHandshakes      int64
 	support                      *SupportServices
 	establishTunnels             int32
+	memoryOverloaded             int32
+	shedMinIdleTime              time.Duration
 	concurrentSSHHandshakes      semaphore.Semaphore
+	concurrentOutboundDials      semaphore.Semaphore
+	outboundDialQueueTimeout     time.Duration
+	outboundDialQueueCounts      map[string]*int64
+	outboundDialRejectedCounts   map[string]*int64
+	acceptQueues                 map[string]semaphore.Semaphore
+	acceptQueueOverflowCounts    map[string]*int64
+	sshHandshakeCounts           map[string]*int64
+	sshHandshakeRejectedCounts   map[string]*int64
 	shutdownBroadcast            <-chan struct{}
 	sshHostKey                   ssh.Signer
 	clientsMutex                 sync.Mutex
 	stoppingClients              bool
 	acceptedClientCounts         map[string]map[string]int64
 	clients                      map[string]*sshClient
+	sheddingClientCount          int
+	reservedClientSlots          int
 	oslSessionCacheMutex         sync.Mutex
-	oslSessionCache              *cache.Cache
+	oslSessionCache              *sessionCache
 	authorizationSessionIDsMutex sync.Mutex
 	authorizationSessionIDs      map[string]string
+	decoyHistory                 *obfuscator.DecoyHistory
+	unrecognizedConnHandler      *unrecognizedConnHandler
+	platformHandshakeCountsMutex sync.Mutex
+	platformHandshakeCounts      map[string]map[string]int64
+	startTime                    monotime.Time
 }
 
 func newSSHServer(
@@ -342,6 +508,37 @@ func newSSHServer(
 		concurrentSSHHandshakes = semaphore.New(support.Config.MaxConcurrentSSHHandshakes)
 	}
 
+	var concurrentOutboundDials semaphore.Semaphore
+	if support.Config.MaxConcurrentOutboundDials > 0 {
+		concurrentOutboundDials = semaphore.New(support.Config.MaxConcurrentOutboundDials)
+	}
+
+	outboundDialQueueTimeout := OUTBOUND_DIAL_DEFAULT_QUEUE_TIMEOUT
+	if support.Config.OutboundDialQueueTimeoutMilliseconds > 0 {
+		outboundDialQueueTimeout = time.Duration(
+			support.Config.OutboundDialQueueTimeoutMilliseconds) * time.Millisecond
+	}
+
+	// acceptQueues and the per tunnel protocol counts are not modified after
+	// initialization, and may be read concurrently without locking.
+
+	acceptQueues := make(map[string]semaphore.Semaphore)
+	acceptQueueOverflowCounts := make(map[string]*int64)
+	sshHandshakeCounts := make(map[string]*int64)
+	sshHandshakeRejectedCounts := make(map[string]*int64)
+	outboundDialQueueCounts := make(map[string]*int64)
+	outboundDialRejectedCounts := make(map[string]*int64)
+	for tunnelProtocol := range support.Config.TunnelProtocolPorts {
+		if acceptQueue, ok := support.Config.AcceptQueues[tunnelProtocol]; ok {
+			acceptQueues[tunnelProtocol] = semaphore.New(acceptQueue.Depth)
+		}
+		acceptQueueOverflowCounts[tunnelProtocol] = new(int64)
+		sshHandshakeCounts[tunnelProtocol] = new(int64)
+		sshHandshakeRejectedCounts[tunnelProtocol] = new(int64)
+		outboundDialQueueCounts[tunnelProtocol] = new(int64)
+		outboundDialRejectedCounts[tunnelProtocol] = new(int64)
+	}
+
 	// The OSL session cache temporarily retains OSL seed state
 	// progress for disconnected clients. This enables clients
 	// that disconnect and immediately reconnect to the same
@@ -353,18 +550,32 @@ func newSSHServer(
 	// rogue client could guess the session ID of another client,
 	// it could resume its OSL progress and, if the OSL config
 	// were known, infer some activity.
-	oslSessionCache := cache.New(OSL_SESSION_CACHE_TTL, 1*time.Minute)
+	oslSessionCache := newSessionCache(
+		OSL_SESSION_CACHE_TTL, support.Config.SessionCacheMaxEntries)
 
 	return &sshServer{
-		support:                 support,
-		establishTunnels:        1,
-		concurrentSSHHandshakes: concurrentSSHHandshakes,
-		shutdownBroadcast:       shutdownBroadcast,
-		sshHostKey:              signer,
-		acceptedClientCounts:    make(map[string]map[string]int64),
-		clients:                 make(map[string]*sshClient),
-		oslSessionCache:         oslSessionCache,
-		authorizationSessionIDs: make(map[string]string),
+		support:                    support,
+		establishTunnels:           1,
+		shedMinIdleTime:            OVERLOAD_SHED_MIN_IDLE_TIME,
+		concurrentSSHHandshakes:    concurrentSSHHandshakes,
+		concurrentOutboundDials:    concurrentOutboundDials,
+		outboundDialQueueTimeout:   outboundDialQueueTimeout,
+		outboundDialQueueCounts:    outboundDialQueueCounts,
+		outboundDialRejectedCounts: outboundDialRejectedCounts,
+		acceptQueues:               acceptQueues,
+		acceptQueueOverflowCounts:  acceptQueueOverflowCounts,
+		sshHandshakeCounts:         sshHandshakeCounts,
+		sshHandshakeRejectedCounts: sshHandshakeRejectedCounts,
+		shutdownBroadcast:          shutdownBroadcast,
+		sshHostKey:                 signer,
+		acceptedClientCounts:       make(map[string]map[string]int64),
+		clients:                    make(map[string]*sshClient),
+		oslSessionCache:            oslSessionCache,
+		authorizationSessionIDs:    make(map[string]string),
+		decoyHistory:               obfuscator.NewDecoyHistory(),
+		unrecognizedConnHandler:    newUnrecognizedConnHandler(support.Config, shutdownBroadcast),
+		platformHandshakeCounts:    make(map[string]map[string]int64),
+		startTime:                  monotime.Now(),
 	}, nil
 }
 
@@ -391,6 +602,344 @@ func (sshServer *sshServer) getEstablishTunnels() bool {
 	return atomic.LoadInt32(&sshServer.establishTunnels) == 1
 }
 
+// reservedClientSlot is an established client slot reserved by admitClient
+// for a new client connection which is admitted by shedding an idle client.
+// The reservation is held until the new client is registered as established
+// or exits. reservedClientSlot is guarded by sshServer.clientsMutex.
+type reservedClientSlot struct {
+	reserved bool
+}
+
+// admitClient checks whether the server is overloaded, as configured by
+// MaxEstablishedClients, as ramped during warm-up, and the memory
+// watermarks, and returns false when
+// a new client connection should be rejected. When the client limit is
+// reached and OverloadSheddingPolicy is OVERLOAD_SHEDDING_POLICY_SHED_IDLE,
+// admitClient disconnects an idle client to make room for the new client,
+// and returns a reservedClientSlot which the caller must release with
+// releaseReservedClientSlot.
+func (sshServer *sshServer) admitClient() (bool, *reservedClientSlot) {
+
+	if atomic.LoadInt32(&sshServer.memoryOverloaded) == 1 {
+		return false, nil
+	}
+
+	maxEstablishedClients, warmingUp := sshServer.getMaxEstablishedClients()
+	if maxEstablishedClients <= 0 {
+		return true, nil
+	}
+
+	// The limit check, the idle client selection, and the slot reservation
+	// are performed under one clientsMutex lock so that concurrent
+	// admissions can't each claim the same shed client's slot.
+
+	sshServer.clientsMutex.Lock()
+
+	if sshServer.getEstablishedClientCountLocked() < maxEstablishedClients {
+		sshServer.clientsMutex.Unlock()
+		return true, nil
+	}
+
+	// Idle clients aren't shed to admit new clients while warming up, as the
+	// ramped limit is below the configured capacity.
+	if warmingUp ||
+		sshServer.support.Config.OverloadSheddingPolicy != OVERLOAD_SHEDDING_POLICY_SHED_IDLE {
+		sshServer.clientsMutex.Unlock()
+		return false, nil
+	}
+
+	idleClients := sshServer.selectIdleClientsLocked(1)
+	if len(idleClients) == 0 {
+		sshServer.clientsMutex.Unlock()
+		return false, nil
+	}
+
+	reservedSlot := &reservedClientSlot{reserved: true}
+	sshServer.reservedClientSlots += 1
+
+	sshServer.clientsMutex.Unlock()
+
+	sshServer.stopIdleClients(idleClients)
+
+	return true, reservedSlot
+}
+
+// getEstablishedClientCountLocked returns the number of established clients
+// counted against MaxEstablishedClients. Clients which are being shed, and
+// are stopped asynchronously, are excluded, while the slots reserved for the
+// new clients admitted in their place are included, so that a shed client's
+// slot is claimed once, both before and after the shed client is
+// unregistered. The caller must hold clientsMutex.
+func (sshServer *sshServer) getEstablishedClientCountLocked() int {
+	return len(sshServer.clients) -
+		sshServer.sheddingClientCount +
+		sshServer.reservedClientSlots
+}
+
+// releaseReservedClientSlot releases a slot reserved by admitClient, if it's
+// not already released. reservedSlot may be nil.
+func (sshServer *sshServer) releaseReservedClientSlot(reservedSlot *reservedClientSlot) {
+	sshServer.clientsMutex.Lock()
+	sshServer.releaseReservedClientSlotLocked(reservedSlot)
+	sshServer.clientsMutex.Unlock()
+}
+
+func (sshServer *sshServer) releaseReservedClientSlotLocked(reservedSlot *reservedClientSlot) {
+	if reservedSlot != nil && reservedSlot.reserved {
+		reservedSlot.reserved = false
+		sshServer.reservedClientSlots -= 1
+	}
+}
+
+// getServerLoad returns the coarse server load level, one of
+// protocol.SERVER_LOAD_*, which is reported to clients in the handshake
+// response. "" is returned when the server has no configured capacity,
+// MaxEstablishedClients, and is not memory overloaded.
+func (sshServer *sshServer) getServerLoad() string {
+
+	memoryOverloaded := atomic.LoadInt32(&sshServer.memoryOverloaded) == 1
+
+	sshServer.clientsMutex.Lock()
+	establishedClientCount := len(sshServer.clients)
+	sshServer.clientsMutex.Unlock()
+
+	maxEstablishedClients, warmingUp := sshServer.getMaxEstablishedClients()
+
+	return getServerLoadLevel(
+		establishedClientCount,
+		maxEstablishedClients,
+		memoryOverloaded,
+		warmingUp)
+}
+
+// getServerLoadLevel buckets the established client count relative to
+// maxEstablishedClients. The buckets are deliberately coarse so that the
+// reported level doesn't reveal the number of connected clients. While
+// warming up, the level is at least SERVER_LOAD_MEDIUM.
+func getServerLoadLevel(
+	establishedClientCount, maxEstablishedClients int,
+	memoryOverloaded, warmingUp bool) string {
+
+	if memoryOverloaded {
+		return protocol.SERVER_LOAD_HIGH
+	}
+
+	if maxEstablishedClients <= 0 {
+		return ""
+	}
+
+	switch {
+	case warmingUp &&
+		establishedClientCount*100 < maxEstablishedClients*SERVER_LOAD_HIGH_PERCENT:
+		return protocol.SERVER_LOAD_MEDIUM
+	case establishedClientCount*100 < maxEstablishedClients*SERVER_LOAD_MEDIUM_PERCENT:
+		return protocol.SERVER_LOAD_LOW
+	case establishedClientCount*100 < maxEstablishedClients*SERVER_LOAD_HIGH_PERCENT:
+		return protocol.SERVER_LOAD_MEDIUM
+	}
+	return protocol.SERVER_LOAD_HIGH
+}
+
+// getMaxEstablishedClients returns the current established client limit,
+// which is ramped during the WarmUpPeriodSeconds warm-up period, and
+// whether the server is warming up.
+func (sshServer *sshServer) getMaxEstablishedClients() (int, bool) {
+	config := sshServer.support.Config
+	return getWarmUpMaxEstablishedClients(
+		config.MaxEstablishedClients,
+		config.WarmUpInitialCapacityPercent,
+		time.Duration(config.WarmUpPeriodSeconds)*time.Second,
+		monotime.Since(sshServer.startTime))
+}
+
+// getWarmUpMaxEstablishedClients linearly ramps maxEstablishedClients from
+// initialCapacityPercent to 100 percent over warmUpPeriod, and returns the
+// ramped limit for the elapsed time and whether warm-up is in progress.
+func getWarmUpMaxEstablishedClients(
+	maxEstablishedClients, initialCapacityPercent int,
+	warmUpPeriod, elapsed time.Duration) (int, bool) {
+
+	if maxEstablishedClients <= 0 || warmUpPeriod <= 0 || elapsed >= warmUpPeriod {
+		return maxEstablishedClients, false
+	}
+
+	percent := float64(initialCapacityPercent) +
+		float64(100-initialCapacityPercent)*float64(elapsed)/float64(warmUpPeriod)
+
+	limit := int(float64(maxEstablishedClients) * percent / 100)
+	if limit < 1 {
+		limit = 1
+	}
+
+	return limit, true
+}
+
+// shedIdleClients disconnects up to maxCount established clients that have
+// been idle for at least shedMinIdleTime, least recently active first, and
+// returns the number of clients disconnected.
+func (sshServer *sshServer) shedIdleClients(maxCount int) int {
+
+	sshServer.clientsMutex.Lock()
+	idleClients := sshServer.selectIdleClientsLocked(maxCount)
+	sshServer.clientsMutex.Unlock()
+
+	sshServer.stopIdleClients(idleClients)
+
+	return len(idleClients)
+}
+
+// selectIdleClientsLocked selects up to maxCount established clients to
+// shed, which have been idle for at least shedMinIdleTime, least recently
+// active first, and marks the selected clients as shedding. Clients already
+// being shed aren't selected again. The caller must hold clientsMutex and
+// must stop the selected clients with stopIdleClients.
+func (sshServer *sshServer) selectIdleClientsLocked(maxCount int) []*sshClient {
+
+	type idleClient struct {
+		client       *sshClient
+		lastActivity monotime.Time
+	}
+
+	var idleClients []idleClient
+
+	for _, client := range sshServer.clients {
+		if client.isShedding {
+			continue
+		}
+		client.Lock()
+		lastActivity := client.activityConn.GetLastActivityMonotime()
+		client.Unlock()
+		if monotime.Since(lastActivity) >= sshServer.shedMinIdleTime {
+			idleClients = append(idleClients, idleClient{client, lastActivity})
+		}
+	}
+
+	sort.Slice(idleClients, func(i, j int) bool {
+		return idleClients[i].lastActivity < idleClients[j].lastActivity
+	})
+
+	if len(idleClients) > maxCount {
+		idleClients = idleClients[:maxCount]
+	}
+
+	selectedClients := make([]*sshClient, len(idleClients))
+	for i, idleClient := range idleClients {
+		idleClient.client.isShedding = true
+		sshServer.sheddingClientCount += 1
+		selectedClients[i] = idleClient.client
+	}
+
+	return selectedClients
+}
+
+// stopIdleClients stops clients selected by selectIdleClientsLocked.
+func (sshServer *sshServer) stopIdleClients(idleClients []*sshClient) {
+
+	// Stop clients outside the mutex and without blocking. The stopped
+	// client's run goroutine will unregister the client.
+	for _, idleClient := range idleClients {
+		go idleClient.stopWithReason(CONNECTION_CLOSE_REASON_IDLE_SHED)
+	}
+
+	if len(idleClients) > 0 {
+		log.WithContextFields(
+			LogFields{"count": len(idleClients)}).Warning("shed idle clients")
+	}
+}
+
+// runMemoryMonitor periodically checks the heap allocation against the
+// configured memory watermarks and sets the memory overloaded state, which
+// is checked by admitClient. runMemoryMonitor blocks until shutdown.
+func (sshServer *sshServer) runMemoryMonitor() {
+
+	config := sshServer.support.Config
+
+	highWatermark := config.MemoryHighWatermarkBytes
+	lowWatermark := config.MemoryLowWatermarkBytes
+	if lowWatermark == 0 {
+		lowWatermark = highWatermark
+	}
+
+	ticker := time.NewTicker(MEMORY_MONITOR_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sshServer.shutdownBroadcast:
+			return
+		case <-ticker.C:
+		}
+
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+
+		wasOverloaded := atomic.LoadInt32(&sshServer.memoryOverloaded) == 1
+
+		overloaded := getMemoryOverloaded(
+			wasOverloaded, memStats.HeapAlloc, highWatermark, lowWatermark)
+
+		if overloaded && !wasOverloaded {
+
+			atomic.StoreInt32(&sshServer.memoryOverloaded, 1)
+			log.WithContextFields(
+				LogFields{"heap_alloc": memStats.HeapAlloc}).Warning(
+				"memory high watermark exceeded")
+
+		} else if !overloaded && wasOverloaded {
+
+			atomic.StoreInt32(&sshServer.memoryOverloaded, 0)
+			log.WithContextFields(
+				LogFields{"heap_alloc": memStats.HeapAlloc}).Info(
+				"memory below low watermark")
+		}
+
+		if !overloaded {
+			continue
+		}
+
+		// Shrink the session caches before shedding any clients. Idle
+		// clients are shed only once the caches are empty.
+
+		evicted := sshServer.shrinkSessionCaches(SESSION_CACHE_SHRINK_FRACTION)
+		if evicted > 0 {
+			log.WithContextFields(
+				LogFields{"count": evicted}).Warning("shrank session caches")
+			continue
+		}
+
+		if config.OverloadSheddingPolicy == OVERLOAD_SHEDDING_POLICY_SHED_IDLE {
+			sshServer.shedIdleClients(OVERLOAD_SHED_MAX_CLIENTS)
+		}
+	}
+}
+
+// getMemoryOverloaded returns the new memory overloaded state for the heap
+// allocation. The server becomes overloaded when heapAlloc exceeds
+// highWatermark, and remains overloaded until heapAlloc drops below
+// lowWatermark.
+func getMemoryOverloaded(
+	overloaded bool, heapAlloc, highWatermark, lowWatermark uint64) bool {
+
+	if !overloaded {
+		return heapAlloc > highWatermark
+	}
+	return heapAlloc >= lowWatermark
+}
+
+// shrinkSessionCaches evicts the least recently used fraction of the GeoIP
+// and OSL session cache entries, returning the total number of evicted
+// entries.
+func (sshServer *sshServer) shrinkSessionCaches(fraction float64) int {
+
+	evicted := sshServer.support.GeoIPService.ShrinkSessionCache(fraction)
+
+	sshServer.oslSessionCacheMutex.Lock()
+	evicted += sshServer.oslSessionCache.Shrink(fraction)
+	sshServer.oslSessionCacheMutex.Unlock()
+
+	return evicted
+}
+
 // runListener is intended to run an a goroutine; it blocks
 // running a particular listener. If an unrecoverable error
 // occurs, it will send the error to the listenerError channel.
@@ -416,6 +965,16 @@ func (sshServer *sshServer) runListener(
 			return
 		}
 
+		// Reject new clients when overloaded. The connection is closed
+		// before the SSH handshake to minimize the work performed.
+
+		admitted, reservedSlot := sshServer.admitClient()
+		if !admitted {
+			log.WithContext().Debug("overloaded")
+			clientConn.Close()
+			return
+		}
+
 		// The tunnelProtocol passed to handleClient is used for stats,
 		// throttling, etc. When the tunnel protocol can be determined
 		// unambiguously from the listening port, use that protocol and
@@ -430,7 +989,7 @@ func (sshServer *sshServer) runListener(
 		}
 
 		// process each client connection concurrently
-		go sshServer.handleClient(tunnelProtocol, clientConn)
+		go sshServer.handleClient(tunnelProtocol, clientConn, reservedSlot)
 	}
 
 	// Note: when exiting due to a unrecoverable error, be sure
@@ -541,11 +1100,21 @@ func (sshServer *sshServer) registerEstablishedClient(client *sshClient) bool {
 
 	sshServer.clients[client.sessionID] = client
 
+	// An existing client which is being shed is replaced, and is no longer
+	// counted in sheddingClientCount.
+	if existingClient != nil && existingClient.isShedding {
+		sshServer.sheddingClientCount -= 1
+	}
+
+	// Once the client is registered, it's counted in clients and any slot
+	// reserved for it is released.
+	sshServer.releaseReservedClientSlotLocked(client.reservedSlot)
+
 	sshServer.clientsMutex.Unlock()
 
 	// Call stop() outside the mutex to avoid deadlock.
 	if existingClient != nil {
-		existingClient.stop()
+		existingClient.stopWithReason(CONNECTION_CLOSE_REASON_DUPLICATE_SESSION)
 
 		// Since existingClient.run() isn't guaranteed to have terminated at
 		// this point, synchronously release authorizations for the previous
@@ -572,6 +1141,9 @@ func (sshServer *sshServer) unregisterEstablishedClient(client *sshClient) {
 	// the sshServer.clients entry should be retained.
 	if registeredClient == client {
 		delete(sshServer.clients, client.sessionID)
+		if client.isShedding {
+			sshServer.sheddingClientCount -= 1
+		}
 	}
 
 	sshServer.clientsMutex.Unlock()
@@ -582,8 +1154,14 @@ func (sshServer *sshServer) unregisterEstablishedClient(client *sshClient) {
 
 type ProtocolStats map[string]map[string]int64
 type RegionStats map[string]map[string]map[string]int64
+type PlatformStats map[string]map[string]map[string]int64
 
-func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
+// getLoadStats returns load stats partitioned by tunnel protocol; by client
+// region, then tunnel protocol; and by client platform, then tunnel
+// protocol. Client platform stats include only clients which have completed
+// the API handshake, and the client platform is bucketed using
+// getClientPlatformStatsBucket.
+func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats, PlatformStats) {
 
 	sshServer.clientsMutex.Lock()
 	defer sshServer.clientsMutex.Unlock()
@@ -593,6 +1171,7 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 		stats := make(map[string]int64)
 		stats["accepted_clients"] = 0
 		stats["established_clients"] = 0
+		stats["shared_ip_address_clients"] = 0
 		stats["dialing_tcp_port_forwards"] = 0
 		stats["tcp_port_forwards"] = 0
 		stats["total_tcp_port_forwards"] = 0
@@ -603,6 +1182,7 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 		stats["tcp_port_forward_failed_count"] = 0
 		stats["tcp_port_forward_failed_duration"] = 0
 		stats["tcp_port_forward_rejected_dialing_limit_count"] = 0
+		stats["ssh_channel_rejected_limit_count"] = 0
 		return stats
 	}
 
@@ -621,6 +1201,17 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 	// [<region][<protocol or ALL>][<stat name>] -> count
 	regionStats := make(RegionStats)
 
+	// [<platform>][<protocol or ALL>][<stat name>] -> count
+	platformStats := make(PlatformStats)
+
+	zeroPlatformStats := func() map[string]map[string]int64 {
+		stats := zeroProtocolStats()
+		for _, stat := range stats {
+			stat["completed_handshakes"] = 0
+		}
+		return stats
+	}
+
 	// Note: as currently tracked/counted, each established client is also an accepted client
 
 	for tunnelProtocol, regionAcceptedClientCounts := range sshServer.acceptedClientCounts {
@@ -657,9 +1248,24 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 			regionStats[region]["ALL"],
 			regionStats[region][tunnelProtocol]}
 
+		if client.handshakeState.completed {
+			clientPlatform, _ := getStringRequestParam(
+				client.handshakeState.apiParams, "client_platform")
+			platform := getClientPlatformStatsBucket(clientPlatform)
+			if platformStats[platform] == nil {
+				platformStats[platform] = zeroPlatformStats()
+			}
+			stats = append(stats,
+				platformStats[platform]["ALL"],
+				platformStats[platform][tunnelProtocol])
+		}
+
 		for _, stat := range stats {
 
 			stat["established_clients"] += 1
+			if client.isSharedIPAddress {
+				stat["shared_ip_address_clients"] += 1
+			}
 
 			// Note: can't sum trafficState.peakConcurrentPortForwardCount to get a global peak
 
@@ -678,6 +1284,8 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 				int64(client.qualityMetrics.tcpPortForwardFailedDuration / time.Millisecond)
 			stat["tcp_port_forward_rejected_dialing_limit_count"] +=
 				client.qualityMetrics.tcpPortForwardRejectedDialingLimitCount
+			stat["ssh_channel_rejected_limit_count"] +=
+				client.qualityMetrics.sshChannelRejectedLimitCount
 		}
 
 		client.qualityMetrics.tcpPortForwardDialedCount = 0
@@ -685,11 +1293,92 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 		client.qualityMetrics.tcpPortForwardFailedCount = 0
 		client.qualityMetrics.tcpPortForwardFailedDuration = 0
 		client.qualityMetrics.tcpPortForwardRejectedDialingLimitCount = 0
+		client.qualityMetrics.sshChannelRejectedLimitCount = 0
 
 		client.Unlock()
 	}
 
-	return protocolStats, regionStats
+	// Accept queue overflow counts are tracked per tunnel protocol and are
+	// not included in region stats.
+
+	for tunnelProtocol, overflowCount := range sshServer.acceptQueueOverflowCounts {
+		count := atomic.SwapInt64(overflowCount, 0)
+		protocolStats["ALL"]["accept_queue_overflow_count"] += count
+		protocolStats[tunnelProtocol]["accept_queue_overflow_count"] = count
+	}
+
+	// In-progress SSH handshake counts include clients waiting in accept
+	// queues and for the MaxConcurrentSSHHandshakes semaphore.
+
+	for tunnelProtocol, handshakeCount := range sshServer.sshHandshakeCounts {
+		count := atomic.LoadInt64(handshakeCount)
+		protocolStats["ALL"]["in_progress_ssh_handshakes"] += count
+		protocolStats[tunnelProtocol]["in_progress_ssh_handshakes"] = count
+	}
+
+	for tunnelProtocol, rejectedCount := range sshServer.sshHandshakeRejectedCounts {
+		count := atomic.SwapInt64(rejectedCount, 0)
+		protocolStats["ALL"]["ssh_handshake_limit_rejected_count"] += count
+		protocolStats[tunnelProtocol]["ssh_handshake_limit_rejected_count"] = count
+	}
+
+	// Outbound dial queue counts are the number of port forward dials
+	// currently waiting for MaxConcurrentOutboundDials, by client tunnel
+	// protocol. Dial failures are reported in tcp_port_forward_failed_count.
+
+	if sshServer.concurrentOutboundDials != nil {
+		protocolStats["ALL"]["outbound_dials"] =
+			int64(sshServer.concurrentOutboundDials.GetCount())
+	}
+
+	for tunnelProtocol, queueCount := range sshServer.outboundDialQueueCounts {
+		count := atomic.LoadInt64(queueCount)
+		protocolStats["ALL"]["outbound_dial_queue_depth"] += count
+		protocolStats[tunnelProtocol]["outbound_dial_queue_depth"] = count
+	}
+
+	for tunnelProtocol, rejectedCount := range sshServer.outboundDialRejectedCounts {
+		count := atomic.SwapInt64(rejectedCount, 0)
+		protocolStats["ALL"]["outbound_dial_queue_rejected_count"] += count
+		protocolStats[tunnelProtocol]["outbound_dial_queue_rejected_count"] = count
+	}
+
+	// Completed API handshake counts are tracked by client platform and
+	// tunnel protocol, and include clients which have since disconnected.
+
+	sshServer.platformHandshakeCountsMutex.Lock()
+	for platform, protocolCounts := range sshServer.platformHandshakeCounts {
+		if platformStats[platform] == nil {
+			platformStats[platform] = zeroPlatformStats()
+		}
+		for tunnelProtocol, count := range protocolCounts {
+			platformStats[platform]["ALL"]["completed_handshakes"] += count
+			if platformStats[platform][tunnelProtocol] != nil {
+				platformStats[platform][tunnelProtocol]["completed_handshakes"] = count
+			}
+		}
+	}
+	sshServer.platformHandshakeCounts = make(map[string]map[string]int64)
+	sshServer.platformHandshakeCountsMutex.Unlock()
+
+	return protocolStats, regionStats, platformStats
+}
+
+// recordCompletedHandshake increments the completed API handshake count for
+// the client platform and tunnel protocol, which is reported and reset by
+// getLoadStats.
+func (sshServer *sshServer) recordCompletedHandshake(
+	clientPlatform string, tunnelProtocol string) {
+
+	platform := getClientPlatformStatsBucket(clientPlatform)
+
+	sshServer.platformHandshakeCountsMutex.Lock()
+	defer sshServer.platformHandshakeCountsMutex.Unlock()
+
+	if sshServer.platformHandshakeCounts[platform] == nil {
+		sshServer.platformHandshakeCounts[platform] = make(map[string]int64)
+	}
+	sshServer.platformHandshakeCounts[platform][tunnelProtocol] += 1
 }
 
 func (sshServer *sshServer) resetAllClientTrafficRules() {
@@ -727,6 +1416,52 @@ func (sshServer *sshServer) resetAllClientOSLConfigs() {
 	}
 }
 
+func (sshServer *sshServer) sendMigrationHints(deadline time.Duration) {
+
+	sshServer.clientsMutex.Lock()
+	clients := make(map[string]*sshClient)
+	for sessionID, client := range sshServer.clients {
+		clients[sessionID] = client
+	}
+	sshServer.clientsMutex.Unlock()
+
+	log.WithContextFields(
+		LogFields{"clientCount": len(clients)}).Info("sending migration hints")
+
+	// Requests are sent concurrently, as each SendRequest blocks until the
+	// client replies.
+	for _, client := range clients {
+		go func(client *sshClient) {
+			err := client.sendMigrateRequest(deadline)
+			if err != nil {
+				log.WithContextFields(LogFields{"error": err}).Warning("sendMigrateRequest failed")
+			}
+		}(client)
+	}
+}
+
+func (sshServer *sshServer) pushAllClientTactics() {
+
+	tacticsSnapshot := sshServer.support.TacticsServer.GetSnapshot()
+
+	sshServer.clientsMutex.Lock()
+	clients := make(map[string]*sshClient)
+	for sessionID, client := range sshServer.clients {
+		clients[sessionID] = client
+	}
+	sshServer.clientsMutex.Unlock()
+
+	// As with migration hints, requests are sent concurrently.
+	for _, client := range clients {
+		go func(client *sshClient) {
+			err := client.sendTacticsRequest(tacticsSnapshot)
+			if err != nil {
+				log.WithContextFields(LogFields{"error": err}).Warning("sendTacticsRequest failed")
+			}
+		}(client)
+	}
+}
+
 func (sshServer *sshServer) setClientHandshakeState(
 	sessionID string,
 	state handshakeState,
@@ -790,6 +1525,20 @@ func (sshServer *sshServer) revokeClientAuthorizations(sessionID string) {
 	client.setTrafficRules()
 }
 
+func (sshServer *sshServer) getClientTacticsSnapshot(
+	sessionID string) (*tactics.Snapshot, error) {
+
+	sshServer.clientsMutex.Lock()
+	client := sshServer.clients[sessionID]
+	sshServer.clientsMutex.Unlock()
+
+	if client == nil {
+		return nil, common.ContextError(errors.New("unknown session ID"))
+	}
+
+	return client.tacticsSnapshot, nil
+}
+
 func (sshServer *sshServer) expectClientDomainBytes(
 	sessionID string) (bool, error) {
 
@@ -804,26 +1553,69 @@ func (sshServer *sshServer) expectClientDomainBytes(
 	return client.expectDomainBytes(), nil
 }
 
+func (sshServer *sshServer) disconnectUpgradeRequiredClient(sessionID string) error {
+
+	sshServer.clientsMutex.Lock()
+	client := sshServer.clients[sessionID]
+	sshServer.clientsMutex.Unlock()
+
+	if client == nil {
+		return common.ContextError(errors.New("unknown session ID"))
+	}
+
+	// The rejected client has not completed a handshake, so no
+	// authorization stopTimer is set. runTunnel will cancel the stopTimer
+	// if the client disconnects first.
+
+	client.Lock()
+	if client.stopTimer == nil {
+		client.stopTimer = time.AfterFunc(
+			UPGRADE_REQUIRED_DISCONNECT_DELAY,
+			func() {
+				client.stopWithReason(CONNECTION_CLOSE_REASON_UPGRADE_REQUIRED)
+			})
+	}
+	client.Unlock()
+
+	return nil
+}
+
 func (sshServer *sshServer) stopClients() {
 
 	sshServer.clientsMutex.Lock()
 	sshServer.stoppingClients = true
 	clients := sshServer.clients
 	sshServer.clients = make(map[string]*sshClient)
+	sshServer.sheddingClientCount = 0
 	sshServer.clientsMutex.Unlock()
 
 	for _, client := range clients {
-		client.stop()
+		client.stopWithReason(CONNECTION_CLOSE_REASON_SERVER_SHUTDOWN)
 	}
 }
 
-func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.Conn) {
+func (sshServer *sshServer) handleClient(
+	tunnelProtocol string, clientConn net.Conn, reservedSlot *reservedClientSlot) {
+
+	// With a PanicHandler set, a panic handling the client invokes the
+	// handler and disconnects only this client.
+	defer recoverPanic(func() { clientConn.Close() })
+
+	// Any slot reserved by admitClient is released when the client is
+	// registered as established or, failing that, when handleClient returns.
+	defer sshServer.releaseReservedClientSlot(reservedSlot)
+
+	// The establishment trace is ended, as failed, when the client exits
+	// without having been established.
+	establishmentTrace := sshServer.support.OTLPExporter.startEstablishmentTrace(tunnelProtocol)
+	defer establishmentTrace.end(false)
 
 	// Calling clientConn.RemoteAddr at this point, before any Read calls,
 	// satisfies the constraint documented in tapdance.Listen.
 
-	geoIPData := sshServer.support.GeoIPService.Lookup(
-		common.IPAddressFromAddr(clientConn.RemoteAddr()))
+	clientIP := common.IPAddressFromAddr(clientConn.RemoteAddr())
+
+	geoIPData := sshServer.support.GeoIPService.Lookup(clientIP)
 
 	sshServer.registerAcceptedClient(tunnelProtocol, geoIPData.Country)
 	defer sshServer.unregisterAcceptedClient(tunnelProtocol, geoIPData.Country)
@@ -851,7 +1643,39 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 	//   should use an sshServer parent context to ensure blocking acquires
 	//   interrupt immediately upon shutdown.
 
-	var onSSHHandshakeFinished func()
+	// When set, the ServerMaxConcurrentSSHHandshakes tactics parameter
+	// limits the number of in-progress SSH handshakes at which clients
+	// matching the tactics are admitted. Unlike MaxConcurrentSSHHandshakes,
+	// there is no wait: the client connection is closed immediately, before
+	// any obfuscation or SSH crypto work.
+
+	if !sshServer.enterSSHHandshake(tunnelProtocol, geoIPData) {
+		clientConn.Close()
+		log.WithContext().Debug("SSH handshake limit exceeded")
+		return
+	}
+	leaveSSHHandshake := func() {
+		atomic.AddInt64(&sshServer.inProgressSSHHandshakes, -1)
+		atomic.AddInt64(sshServer.sshHandshakeCounts[tunnelProtocol], -1)
+	}
+
+	// When configured, the tunnel protocol accept queue limits the number of
+	// client connections awaiting SSH handshake completion for this protocol.
+	// The queue entry is released at the same point as the concurrent SSH
+	// handshakes semaphore.
+
+	releaseAcceptQueue, ok := sshServer.enterAcceptQueue(tunnelProtocol)
+	if !ok {
+		leaveSSHHandshake()
+		clientConn.Close()
+		log.WithContext().Debug("accept queue overflow")
+		return
+	}
+
+	onSSHHandshakeFinished := func() {
+		releaseAcceptQueue()
+		leaveSSHHandshake()
+	}
 	if sshServer.support.Config.MaxConcurrentSSHHandshakes > 0 {
 
 		ctx, cancelFunc := context.WithTimeout(
@@ -860,6 +1684,8 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 
 		err := sshServer.concurrentSSHHandshakes.Acquire(ctx, 1)
 		if err != nil {
+			releaseAcceptQueue()
+			leaveSSHHandshake()
 			clientConn.Close()
 			// This is a debug log as the only possible error is context timeout.
 			log.WithContextFields(LogFields{"error": err}).Debug(
@@ -869,10 +1695,15 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 
 		onSSHHandshakeFinished = func() {
 			sshServer.concurrentSSHHandshakes.Release(1)
+			releaseAcceptQueue()
+			leaveSSHHandshake()
 		}
 	}
 
 	sshClient := newSshClient(sshServer, tunnelProtocol, geoIPData)
+	sshClient.establishmentTrace = establishmentTrace
+	sshClient.isSharedIPAddress = sshServer.support.Config.IsSharedIPAddress(clientIP)
+	sshClient.reservedSlot = reservedSlot
 
 	// sshClient.run _must_ call onSSHHandshakeFinished to release the semaphore:
 	// in any error case; or, as soon as the SSH handshake phase has successfully
@@ -881,6 +1712,117 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 	sshClient.run(clientConn, onSSHHandshakeFinished)
 }
 
+// enterSSHHandshake counts a new client connection as an in-progress SSH
+// handshake, unless the ServerMaxConcurrentSSHHandshakes limit for the
+// client is reached. When ok is true, the caller must decrement the counts
+// when the SSH handshake phase ends.
+func (sshServer *sshServer) enterSSHHandshake(
+	tunnelProtocol string, geoIPData GeoIPData) bool {
+
+	// The count is incremented before checking the limit, so that concurrent
+	// connections cannot all pass the check.
+
+	count := atomic.AddInt64(&sshServer.inProgressSSHHandshakes, 1)
+
+	limit := 0
+	if sshServer.support.TacticsServer != nil {
+		p, err := sshServer.support.TacticsServer.GetServerSideParameters(
+			common.GeoIPData(geoIPData))
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning(
+				"failed to get tactics for SSH handshake")
+		} else if p != nil {
+			limit = p.Int(parameters.ServerMaxConcurrentSSHHandshakes)
+		}
+	}
+
+	if limit > 0 && count > int64(limit) {
+		atomic.AddInt64(&sshServer.inProgressSSHHandshakes, -1)
+		atomic.AddInt64(sshServer.sshHandshakeRejectedCounts[tunnelProtocol], 1)
+		return false
+	}
+
+	atomic.AddInt64(sshServer.sshHandshakeCounts[tunnelProtocol], 1)
+	return true
+}
+
+// acquireOutboundDial reserves one of the MaxConcurrentOutboundDials
+// outbound dial slots, waiting in the queue for up to the smaller of
+// outboundDialQueueTimeout and timeout. When ok is true, the caller must call
+// releaseOutboundDial once the dial completes.
+func (sshServer *sshServer) acquireOutboundDial(
+	ctx context.Context, tunnelProtocol string, timeout time.Duration) bool {
+
+	if sshServer.concurrentOutboundDials == nil {
+		return true
+	}
+
+	if sshServer.concurrentOutboundDials.TryAcquire(1) {
+		return true
+	}
+
+	if timeout > sshServer.outboundDialQueueTimeout {
+		timeout = sshServer.outboundDialQueueTimeout
+	}
+
+	queueCount := sshServer.outboundDialQueueCounts[tunnelProtocol]
+	atomic.AddInt64(queueCount, 1)
+	defer atomic.AddInt64(queueCount, -1)
+
+	ctx, cancelFunc := context.WithTimeout(ctx, timeout)
+	defer cancelFunc()
+
+	err := sshServer.concurrentOutboundDials.Acquire(ctx, 1)
+	if err != nil {
+		atomic.AddInt64(sshServer.outboundDialRejectedCounts[tunnelProtocol], 1)
+		return false
+	}
+
+	return true
+}
+
+func (sshServer *sshServer) releaseOutboundDial() {
+	if sshServer.concurrentOutboundDials != nil {
+		sshServer.concurrentOutboundDials.Release(1)
+	}
+}
+
+// enterAcceptQueue adds a client connection to the tunnel protocol accept
+// queue, applying the configured overflow policy when the queue is full.
+// When ok is false, the queue overflowed and the client connection should
+// be closed. Otherwise, the caller must call release to leave the queue.
+func (sshServer *sshServer) enterAcceptQueue(
+	tunnelProtocol string) (release func(), ok bool) {
+
+	acceptQueue, ok := sshServer.acceptQueues[tunnelProtocol]
+	if !ok {
+		return func() {}, true
+	}
+
+	config := sshServer.support.Config.AcceptQueues[tunnelProtocol]
+
+	if config.OverflowPolicy == ACCEPT_QUEUE_OVERFLOW_POLICY_WAIT {
+
+		ctx, cancelFunc := context.WithTimeout(
+			context.Background(),
+			time.Duration(config.OverflowWaitMilliseconds)*time.Millisecond)
+		defer cancelFunc()
+
+		ok = acceptQueue.Acquire(ctx, 1) == nil
+
+	} else {
+
+		ok = acceptQueue.TryAcquire(1)
+	}
+
+	if !ok {
+		atomic.AddInt64(sshServer.acceptQueueOverflowCounts[tunnelProtocol], 1)
+		return nil, false
+	}
+
+	return func() { acceptQueue.Release(1) }, true
+}
+
 func (sshServer *sshServer) monitorPortForwardDialError(err error) {
 
 	// "err" is the error returned from a failed TCP or UDP port
@@ -916,17 +1858,34 @@ type sshClient struct {
 	activityConn                         *common.ActivityMonitoredConn
 	throttledConn                        *common.ThrottledConn
 	geoIPData                            GeoIPData
+	tacticsSnapshot                      *tactics.Snapshot
+	pushedTacticsTag                     string
 	sessionID                            string
 	isFirstTunnelInSession               bool
+	isSharedIPAddress                    bool
 	supportsServerRequests               bool
+	authPolicy                           *tunnelAuthPolicy
 	handshakeState                       handshakeState
+	establishmentTrace                   *establishmentTrace
 	udpChannel                           ssh.Channel
 	packetTunnelChannel                  ssh.Channel
 	trafficRules                         TrafficRules
 	tcpTrafficState                      trafficState
 	udpTrafficState                      trafficState
+	compressionMetrics                   compressionMetrics
+	bandwidthTestMetrics                 bandwidthTestMetrics
+	bandwidthTestInProgress              bool
+	lastBandwidthTestTime                monotime.Time
 	qualityMetrics                       qualityMetrics
 	tcpPortForwardLRU                    *common.LRUConns
+	maxTCPPortForwardsPerDestination     int
+	maxSSHChannels                       int
+	openSSHChannelCount                  int64
+	sshChannelRejectedLimitCount         int64
+	portForwardDialOptions               parameters.PortForwardDialOptions
+	portForwardDialRetryPolicy           portForwardDialRetryPolicy
+	observedParameters                   observedParametersSource
+	tcpPortForwardDestinationCounts      map[string]int
 	oslClientSeedState                   *osl.ClientSeedState
 	signalIssueSLOKs                     chan struct{}
 	runCtx                               context.Context
@@ -934,6 +1893,9 @@ type sshClient struct {
 	tcpPortForwardDialingAvailableSignal context.CancelFunc
 	releaseAuthorizations                func()
 	stopTimer                            *time.Timer
+	closeReason                          string
+	isShedding                           bool
+	reservedSlot                         *reservedClientSlot
 }
 
 type trafficState struct {
@@ -947,6 +1909,15 @@ type trafficState struct {
 	availablePortForwardCond              *sync.Cond
 }
 
+// compressionMetrics records, for compressed port forwards, the number of
+// compressed port forwards and the number of downstream bytes before and
+// after compression.
+type compressionMetrics struct {
+	portForwardCount int64
+	bytesDown        int64
+	frameBytesDown   int64
+}
+
 // qualityMetrics records upstream TCP dial attempts and
 // elapsed time. Elapsed time includes the full TCP handshake
 // and, in aggregate, is a measure of the quality of the
@@ -958,6 +1929,7 @@ type qualityMetrics struct {
 	tcpPortForwardFailedCount               int64
 	tcpPortForwardFailedDuration            time.Duration
 	tcpPortForwardRejectedDialingLimitCount int64
+	sshChannelRejectedLimitCount            int64
 }
 
 type handshakeState struct {
@@ -989,6 +1961,15 @@ func newSshClient(
 		stopRunning:            stopRunning,
 	}
 
+	// The tactics snapshot is taken once, when the client connection is
+	// accepted, and used for all subsequent tactics lookups for the client,
+	// including the handshake. This ensures that a concurrent tactics reload
+	// doesn't result in the client's tunnel seeing a mix of old and new
+	// tactics.
+	if sshServer.support.TacticsServer != nil {
+		client.tacticsSnapshot = sshServer.support.TacticsServer.GetSnapshot()
+	}
+
 	client.tcpTrafficState.availablePortForwardCond = sync.NewCond(new(sync.Mutex))
 	client.udpTrafficState.availablePortForwardCond = sync.NewCond(new(sync.Mutex))
 
@@ -1008,9 +1989,38 @@ func (sshClient *sshClient) run(
 	// Some conns report additional metrics
 	metricsSource, isMetricsSource := clientConn.(MetricsSource)
 
+	// Some conns report observed transport parameters, which are checked
+	// against the handshake parameters.
+	if observedParameters, ok := clientConn.(observedParametersSource); ok {
+		sshClient.Lock()
+		sshClient.observedParameters = observedParameters
+		sshClient.Unlock()
+	}
+
+	sshHandshakeStartTime := monotime.Now()
+
 	// Set initial traffic rules, pre-handshake, based on currently known info.
 	sshClient.setTrafficRules()
 
+	// When the client connection fails to send a recognized protocol, it's
+	// handled by unrecognizedConnHandler instead of being closed. A
+	// connection is recognized once it passes the obfuscated SSH seed
+	// message check or, for protocols without obfuscation, once the SSH
+	// handshake completes. recognized is also set when a suspected probe is
+	// mirrored, as the probe mirror closes the connection.
+
+	var monitoredConn *readFailureMonitoredConn
+	var recognized int32
+	if handlesUnrecognizedConns(sshClient.tunnelProtocol) {
+		monitoredConn = &readFailureMonitoredConn{Conn: clientConn}
+		clientConn = monitoredConn
+	}
+	isUnrecognized := func() bool {
+		return monitoredConn != nil &&
+			!monitoredConn.hasReadFailed() &&
+			atomic.LoadInt32(&recognized) == 0
+	}
+
 	// Wrap the base client connection with an ActivityMonitoredConn which will
 	// terminate the connection if no data is received before the deadline. This
 	// timeout is in effect for the entire duration of the SSH connection. Clients
@@ -1046,10 +2056,11 @@ func (sshClient *sshClient) run(
 		sshConn  *ssh.ServerConn
 		channels <-chan ssh.NewChannel
 		requests <-chan *ssh.Request
+		isDecoy  bool
 		err      error
 	}
 
-	resultChannel := make(chan *sshNewServerConnResult, 2)
+	resultChannel := make(chan *sshNewServerConnResult, 3)
 
 	var afterFunc *time.Timer
 	if SSH_HANDSHAKE_TIMEOUT > 0 {
@@ -1058,14 +2069,44 @@ func (sshClient *sshClient) run(
 		})
 	}
 
+	// The optional recognition timeout is typically shorter than the SSH
+	// handshake timeout, and releases the SSH handshake resources held by
+	// unrecognized connections sooner.
+
+	var recognitionTimer *time.Timer
+	recognitionTimeout := time.Duration(
+		sshClient.sshServer.support.Config.UnrecognizedConnectionTimeoutMilliseconds) * time.Millisecond
+	if monitoredConn != nil && recognitionTimeout > 0 {
+		recognitionTimer = time.AfterFunc(recognitionTimeout, func() {
+			if atomic.LoadInt32(&recognized) == 0 {
+				resultChannel <- &sshNewServerConnResult{err: errors.New("unrecognized connection timeout")}
+			}
+		})
+	}
+	setRecognized := func() {
+		atomic.StoreInt32(&recognized, 1)
+		if recognitionTimer != nil {
+			recognitionTimer.Stop()
+		}
+	}
+
 	go func(conn net.Conn) {
 		sshServerConfig := &ssh.ServerConfig{
 			PasswordCallback: sshClient.passwordCallback,
 			AuthLogCallback:  sshClient.authLogCallback,
 			ServerVersion:    sshClient.sshServer.support.Config.SSHServerVersion,
 		}
+		sshServerConfig.MaxPacketSize = uint32(sshClient.sshServer.support.Config.SSHMaxPacketSize)
 		sshServerConfig.AddHostKey(sshClient.sshServer.sshHostKey)
 
+		// ChaCha20-Poly1305 is supported, but not a default algorithm, since
+		// clients randomize the default algorithms they offer and servers
+		// which don't support it remain in use. Clients prefer it via the
+		// SSHPreferredAlgorithms tactics parameter.
+		defaults := ssh.DefaultAlgorithms()
+		defaults.Ciphers = append(defaults.Ciphers, "chacha20-poly1305@openssh.com")
+		omitEncryptThenMAC := false
+
 		if protocol.TunnelProtocolUsesObfuscatedSSH(sshClient.tunnelProtocol) {
 			// This is the list of supported non-Encrypt-then-MAC algorithms from
 			// https://github.com/Psiphon-Labs/psiphon-tunnel-core/blob/3ef11effe6acd92c3aefd140ee09c42a1f15630b/psiphon/common/crypto/ssh/common.go#L60
@@ -1077,30 +2118,88 @@ func (sshClient *sshClient) run(
 			//
 			// The exception is TUNNEL_PROTOCOL_SSH, which is intended to appear
 			// like SSH on the wire.
-			sshServerConfig.MACs = []string{"hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"}
+			defaults.MACs = []string{"hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"}
+			omitEncryptThenMAC = true
 		}
 
+		offered := sshClient.sshServer.support.Config.SSHPreferredAlgorithms.Offered(
+			defaults, omitEncryptThenMAC)
+
+		sshServerConfig.KeyExchanges = offered.KeyExchanges
+		sshServerConfig.Ciphers = offered.Ciphers
+		sshServerConfig.MACs = offered.MACs
+
 		result := &sshNewServerConnResult{}
 
 		// Wrap the connection in an SSH deobfuscator when required.
 
 		if protocol.TunnelProtocolUsesObfuscatedSSH(sshClient.tunnelProtocol) {
-			// Note: NewObfuscatedSshConn blocks on network I/O
+
+			// When probe mirroring is enabled, the bytes read by the seed
+			// message check are recorded for sampled connections, so that
+			// suspected probes which fail the check may be mirrored.
+			// Recording stops as soon as the check passes.
+			probeMirror := sshClient.sshServer.support.ProbeMirror
+			conn = probeMirror.sample(conn)
+
+			obfuscatedSSHKey := sshClient.sshServer.support.Config.GetObfuscatedSSHKey(
+				sshClient.tunnelProtocol)
+
+			// OSSH clients may make a decoy connection, which sends only a
+			// decoy first flight, before the OSSH connection. A decoy
+			// connection is acknowledged and then closed. When there's no
+			// valid decoy, seedConn replays the bytes read by the decoy check,
+			// which are then subject to the seed message check, so a prober
+			// can't distinguish a server that checks for decoys.
+			//
+			// Note: NewDecoyServerConn and NewObfuscatedSshConn block on
+			// network I/O
 			// TODO: ensure this won't block shutdown
-			conn, result.err = obfuscator.NewObfuscatedSshConn(
-				obfuscator.OBFUSCATION_CONN_MODE_SERVER,
-				conn,
-				sshClient.sshServer.support.Config.ObfuscatedSSHKey,
-				nil,
-				nil)
+			seedConn := conn
+			if sshClient.tunnelProtocol == protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+				seedConn, result.isDecoy, result.err = obfuscator.NewDecoyServerConn(
+					conn, obfuscatedSSHKey, sshClient.sshServer.decoyHistory)
+				if result.isDecoy {
+					setRecognized()
+					stopProbeRecording(conn)
+					resultChannel <- result
+					return
+				}
+			}
+
+			var minPadding *int
+			if sshClient.sshServer.support.Config.ObfuscatedSSHMinPadding > 0 {
+				minPadding = &sshClient.sshServer.support.Config.ObfuscatedSSHMinPadding
+			}
+
+			var obfuscatedConn net.Conn
+			if result.err == nil {
+				obfuscatedConn, result.err = obfuscator.NewObfuscatedSshConn(
+					obfuscator.OBFUSCATION_CONN_MODE_SERVER,
+					seedConn,
+					obfuscatedSSHKey,
+					sshClient.sshServer.support.Config.ObfuscatedSSHSeedKeyDerivations,
+					minPadding,
+					nil)
+			}
 			if result.err != nil {
+				// A mirrored probe isn't marked as recognized, and so is
+				// handled as an unrecognized connection exactly as an
+				// unsampled probe is.
+				probeMirror.mirrorProbe(
+					conn, sshClient.tunnelProtocol, sshClient.geoIPData)
 				result.err = common.ContextError(result.err)
+			} else {
+				setRecognized()
+				stopProbeRecording(conn)
+				conn = obfuscatedConn
 			}
 		}
 
 		if result.err == nil {
 			result.sshConn, result.channels, result.requests, result.err =
 				ssh.NewServerConn(conn, sshServerConfig)
+			setRecognized()
 		}
 
 		resultChannel <- result
@@ -1120,9 +2219,27 @@ func (sshClient *sshClient) run(
 	if afterFunc != nil {
 		afterFunc.Stop()
 	}
+	if recognitionTimer != nil {
+		recognitionTimer.Stop()
+	}
 
-	if result.err != nil {
+	logSlowOperation(
+		sshClient.sshServer.support.Config,
+		SLOW_OPERATION_SSH_HANDSHAKE,
+		sshHandshakeStartTime,
+		sshClient.tunnelProtocol)
+
+	if result.isDecoy {
 		clientConn.Close()
+		return
+	}
+
+	if result.err != nil {
+		if isUnrecognized() {
+			sshClient.sshServer.unrecognizedConnHandler.handle(monitoredConn)
+		} else {
+			clientConn.Close()
+		}
 		// This is a Debug log due to noise. The handshake often fails due to I/O
 		// errors as clients frequently interrupt connections in progress when
 		// client-side load balancing completes a connection to a different server.
@@ -1137,6 +2254,8 @@ func (sshClient *sshClient) run(
 	}
 	onSSHHandshakeFinished = nil
 
+	sshClient.establishmentTrace.sshHandshakeCompleted()
+
 	sshClient.Lock()
 	sshClient.sshConn = result.sshConn
 	sshClient.activityConn = activityConn
@@ -1149,6 +2268,8 @@ func (sshClient *sshClient) run(
 		return
 	}
 
+	sshClient.establishmentTrace.end(true)
+
 	sshClient.runTunnel(result.channels, result.requests)
 
 	// Note: sshServer.unregisterEstablishedClient calls sshClient.stop(),
@@ -1172,7 +2293,7 @@ func (sshClient *sshClient) run(
 		sshClient.sshServer.oslSessionCacheMutex.Lock()
 		sshClient.oslClientSeedState.Hibernate()
 		sshClient.sshServer.oslSessionCache.Set(
-			sshClient.sessionID, sshClient.oslClientSeedState, cache.DefaultExpiration)
+			sshClient.sessionID, sshClient.oslClientSeedState, SESSION_CACHE_DEFAULT_EXPIRATION)
 		sshClient.sshServer.oslSessionCacheMutex.Unlock()
 		sshClient.oslClientSeedState = nil
 	}
@@ -1232,6 +2353,27 @@ func (sshClient *sshClient) passwordCallback(conn ssh.ConnMetadata, password []b
 	supportsServerRequests := common.Contains(
 		sshPasswordPayload.ClientCapabilities, protocol.CLIENT_CAPABILITY_SERVER_REQUESTS)
 
+	// The tunnel auth hook is invoked only after the SSH password is
+	// verified. A denied tunnel fails SSH authentication, which the client
+	// handles as it does any other failed tunnel. The hook is time bounded,
+	// so a slow authorization service cannot stall the SSH handshake beyond
+	// Config.TunnelAuthHookTimeoutMilliseconds.
+
+	authPolicy, err := sshClient.sshServer.support.TunnelAuthHook.authorize(
+		sshClient.runCtx,
+		&TunnelAuthRequest{
+			SessionID:              sessionID,
+			TunnelProtocol:         sshClient.tunnelProtocol,
+			ClientRegion:           sshClient.geoIPData.Country,
+			ClientCity:             sshClient.geoIPData.City,
+			ClientISP:              sshClient.geoIPData.ISP,
+			ClientCapabilities:     sshPasswordPayload.ClientCapabilities,
+			IsFirstTunnelInSession: isFirstTunnelInSession,
+		})
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
 	sshClient.Lock()
 
 	// After this point, these values are read-only as they are read
@@ -1239,6 +2381,7 @@ func (sshClient *sshClient) passwordCallback(conn ssh.ConnMetadata, password []b
 	sshClient.sessionID = sessionID
 	sshClient.isFirstTunnelInSession = isFirstTunnelInSession
 	sshClient.supportsServerRequests = supportsServerRequests
+	sshClient.authPolicy = authPolicy
 
 	geoIPData := sshClient.geoIPData
 
@@ -1312,6 +2455,18 @@ func (sshClient *sshClient) stop() {
 	sshClient.sshConn.Wait()
 }
 
+// stopWithReason calls stop, first recording the reason the server is
+// closing the connection, as reported in connection events. Only the first
+// reason is recorded.
+func (sshClient *sshClient) stopWithReason(reason string) {
+	sshClient.Lock()
+	if sshClient.closeReason == "" {
+		sshClient.closeReason = reason
+	}
+	sshClient.Unlock()
+	sshClient.stop()
+}
+
 // runTunnel handles/dispatches new channels and new requests from the client.
 // When the SSH client connection closes, both the channels and requests channels
 // will close and runTunnel will exit.
@@ -1449,6 +2604,7 @@ func (sshClient *sshClient) runTunnel(
 		hostToConnect string
 		portToConnect int
 		newChannel    ssh.NewChannel
+		compressed    bool
 	}
 
 	// The queue size is set to the traffic rules (MaxTCPPortForwardCount +
@@ -1521,7 +2677,8 @@ func (sshClient *sshClient) runTunnel(
 					remainingDialTimeout,
 					newPortForward.hostToConnect,
 					newPortForward.portToConnect,
-					newPortForward.newChannel)
+					newPortForward.newChannel,
+					newPortForward.compressed)
 			}(remainingDialTimeout, newPortForward)
 		}
 	}()
@@ -1608,7 +2765,32 @@ func (sshClient *sshClient) runTunnel(
 			continue
 		}
 
-		if newChannel.ChannelType() != "direct-tcpip" {
+		// Enforce the per-tunnel SSH channel limit on all other channels,
+		// which are then released when rejected or closed. The packet
+		// tunnel channel is exempt, as at most one is retained.
+
+		limitedNewChannel := sshClient.allocateSSHChannel(newChannel)
+		if limitedNewChannel == nil {
+			sshClient.rejectNewChannel(newChannel, "SSH channel limit exceeded")
+			continue
+		}
+		newChannel = limitedNewChannel
+
+		if newChannel.ChannelType() == protocol.BANDWIDTH_TEST_CHANNEL_TYPE {
+
+			waitGroup.Add(1)
+			go func(channel ssh.NewChannel) {
+				defer waitGroup.Done()
+				sshClient.handleBandwidthTestChannel(channel)
+			}(newChannel)
+
+			continue
+		}
+
+		compressed := newChannel.ChannelType() == protocol.COMPRESSED_TCP_PORT_FORWARD_CHANNEL_TYPE &&
+			sshClient.sshServer.support.Config.EnablePortForwardCompression
+
+		if newChannel.ChannelType() != "direct-tcpip" && !compressed {
 			sshClient.rejectNewChannel(newChannel, "unknown or unsupported channel type")
 			continue
 		}
@@ -1641,7 +2823,7 @@ func (sshClient *sshClient) runTunnel(
 			waitGroup.Add(1)
 			go func(channel ssh.NewChannel) {
 				defer waitGroup.Done()
-				sshClient.handleUDPChannel(channel)
+				sshClient.handleUDPChannel(channel, compressed)
 			}(newChannel)
 
 		} else {
@@ -1654,6 +2836,7 @@ func (sshClient *sshClient) runTunnel(
 				hostToConnect: directTcpipExtraData.HostToConnect,
 				portToConnect: int(directTcpipExtraData.PortToConnect),
 				newChannel:    newChannel,
+				compressed:    compressed,
 			}
 
 			select {
@@ -1699,6 +2882,19 @@ func (sshClient *sshClient) cleanupAuthorizations() {
 	sshClient.Unlock()
 }
 
+// updateCompressionMetrics adds the downstream bytes of a closed compressed
+// port forward to the client's compression metrics.
+func (sshClient *sshClient) updateCompressionMetrics(channel *compressedChannel) {
+	bytesDown, frameBytesDown := channel.GetWriteMetrics()
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	sshClient.compressionMetrics.portForwardCount += 1
+	sshClient.compressionMetrics.bytesDown += bytesDown
+	sshClient.compressionMetrics.frameBytesDown += frameBytesDown
+}
+
 // setPacketTunnelChannel sets the single packet tunnel channel
 // for this sshClient. Any existing packet tunnel channel is
 // closed.
@@ -1746,6 +2942,7 @@ func (sshClient *sshClient) logTunnel(additionalMetrics LogFields) {
 
 	logFields["session_id"] = sshClient.sessionID
 	logFields["handshake_completed"] = sshClient.handshakeState.completed
+	logFields["shared_ip_address"] = sshClient.isSharedIPAddress
 	logFields["start_time"] = sshClient.activityConn.GetStartTime()
 	logFields["duration"] = sshClient.activityConn.GetActiveDuration() / time.Millisecond
 	logFields["bytes_up_tcp"] = sshClient.tcpTrafficState.bytesUp
@@ -1759,6 +2956,22 @@ func (sshClient *sshClient) logTunnel(additionalMetrics LogFields) {
 	logFields["peak_concurrent_port_forward_count_udp"] = sshClient.udpTrafficState.peakConcurrentPortForwardCount
 	logFields["total_port_forward_count_udp"] = sshClient.udpTrafficState.totalPortForwardCount
 
+	if sshClient.sshChannelRejectedLimitCount > 0 {
+		logFields["ssh_channel_rejected_limit_count"] = sshClient.sshChannelRejectedLimitCount
+	}
+
+	if sshClient.compressionMetrics.portForwardCount > 0 {
+		logFields["compressed_port_forward_count"] = sshClient.compressionMetrics.portForwardCount
+		logFields["compressed_bytes_down"] = sshClient.compressionMetrics.bytesDown
+		logFields["compressed_frame_bytes_down"] = sshClient.compressionMetrics.frameBytesDown
+	}
+
+	if sshClient.bandwidthTestMetrics.testCount > 0 {
+		logFields["bandwidth_test_count"] = sshClient.bandwidthTestMetrics.testCount
+		logFields["bandwidth_test_bytes_up"] = sshClient.bandwidthTestMetrics.bytesUp
+		logFields["bandwidth_test_bytes_down"] = sshClient.bandwidthTestMetrics.bytesDown
+	}
+
 	// Pre-calculate a total-tunneled-bytes field. This total is used
 	// extensively in analytics and is more performant when pre-calculated.
 	logFields["bytes"] = sshClient.tcpTrafficState.bytesUp +
@@ -1776,12 +2989,42 @@ func (sshClient *sshClient) logTunnel(additionalMetrics LogFields) {
 		}
 	}
 
+	geoIPData := sshClient.geoIPData
+
+	closeReason := sshClient.closeReason
+	if closeReason == "" {
+		closeReason = CONNECTION_CLOSE_REASON_CLIENT_DISCONNECTED
+	}
+
+	connectionEvent := &ConnectionEvent{
+		TunnelProtocol:       sshClient.tunnelProtocol,
+		ClientRegion:         sshClient.geoIPData.Country,
+		HandshakeCompleted:   sshClient.handshakeState.completed,
+		StartTime:            sshClient.activityConn.GetStartTime().Format(time.RFC3339),
+		DurationMilliseconds: int64(sshClient.activityConn.GetActiveDuration() / time.Millisecond),
+		BytesUp:              sshClient.tcpTrafficState.bytesUp + sshClient.udpTrafficState.bytesUp,
+		BytesDown:            sshClient.tcpTrafficState.bytesDown + sshClient.udpTrafficState.bytesDown,
+		CloseReason:          closeReason,
+	}
+
 	sshClient.Unlock()
 
 	// Note: unlock before use is only safe as long as referenced sshClient data,
 	// such as slices in handshakeState, is read-only after initially set.
 
-	log.LogRawFieldsWithTimestamp(logFields)
+	// High volume protocols may be sampled. The sample rate is logged so
+	// that aggregations may correct for sampling. Connection events, which
+	// are aggregate metrics, are not sampled.
+
+	sampleRate := getConnectionLogSampleRate(
+		sshClient.sshServer.support, geoIPData, sshClient.tunnelProtocol)
+
+	if isConnectionLogSampled(sshClient.sessionID, sampleRate) {
+		logFields["log_sample_rate"] = sampleRate
+		log.LogRawFieldsWithTimestamp(logFields)
+	}
+
+	sshClient.sshServer.support.ConnectionEventLogger.LogTunnel(connectionEvent)
 }
 
 func (sshClient *sshClient) runOSLSender() {
@@ -1856,6 +3099,120 @@ func (sshClient *sshClient) sendOSLRequest() error {
 	return nil
 }
 
+// sendMigrateRequest sends a migration hint to the client. Clients that do
+// not support server requests are skipped.
+func (sshClient *sshClient) sendMigrateRequest(deadline time.Duration) error {
+
+	if !sshClient.supportsServerRequests {
+		return nil
+	}
+
+	// Note: no guarantee that PsinetDatabase won't reload between database calls
+	db := sshClient.sshServer.support.PsinetDatabase
+
+	migrateRequest := protocol.MigrateRequest{
+		DeadlineSeconds:   int(deadline / time.Second),
+		EncodedServerList: db.DiscoverServers(sshClient.geoIPData.DiscoveryValue),
+	}
+	requestPayload, err := json.Marshal(migrateRequest)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	ok, _, err := sshClient.sshConn.SendRequest(
+		protocol.PSIPHON_API_MIGRATE_REQUEST_NAME,
+		true,
+		requestPayload)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if !ok {
+		return common.ContextError(errors.New("client rejected request"))
+	}
+
+	return nil
+}
+
+// sendTacticsRequest pushes the client's tactics, from tacticsSnapshot, to
+// the client. Clients that do not support server requests or that haven't
+// completed the handshake are skipped, as are clients whose tactics are
+// unchanged since the handshake or the last push.
+func (sshClient *sshClient) sendTacticsRequest(tacticsSnapshot *tactics.Snapshot) error {
+
+	if !sshClient.supportsServerRequests {
+		return nil
+	}
+
+	sshClient.Lock()
+	completed := sshClient.handshakeState.completed
+	apiParams := sshClient.handshakeState.apiParams
+	currentTag := sshClient.pushedTacticsTag
+	sshClient.Unlock()
+
+	if !completed {
+		return nil
+	}
+
+	geoIPData := common.GeoIPData(sshClient.geoIPData)
+
+	payload, err := tacticsSnapshot.GetPushedTacticsPayload(geoIPData, apiParams)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if payload == nil {
+		return nil
+	}
+
+	// When there's been no push, the client has the tactics obtained in the
+	// handshake, which were taken from the client's tactics snapshot.
+
+	if currentTag == "" {
+		handshakePayload, err := sshClient.tacticsSnapshot.GetTacticsPayload(geoIPData, apiParams)
+		if err != nil {
+			return common.ContextError(err)
+		}
+		if handshakePayload != nil {
+			currentTag = handshakePayload.Tag
+		}
+	}
+
+	if payload.Tag == currentTag {
+		return nil
+	}
+
+	marshaledPayload, err := json.Marshal(payload)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if len(marshaledPayload) > tactics.MAX_PUSHED_TACTICS_PAYLOAD_SIZE {
+		return common.ContextError(errors.New("pushed tactics exceeds size limit"))
+	}
+
+	requestPayload, err := json.Marshal(
+		protocol.TacticsRequest{TacticsPayload: marshaledPayload})
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	ok, _, err := sshClient.sshConn.SendRequest(
+		protocol.PSIPHON_API_TACTICS_REQUEST_NAME,
+		true,
+		requestPayload)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	if !ok {
+		return common.ContextError(errors.New("client rejected request"))
+	}
+
+	sshClient.Lock()
+	sshClient.pushedTacticsTag = payload.Tag
+	sshClient.Unlock()
+
+	return nil
+}
+
 func (sshClient *sshClient) rejectNewChannel(newChannel ssh.NewChannel, logMessage string) {
 
 	// We always return the reject reason "Prohibited":
@@ -1898,6 +3255,11 @@ func (sshClient *sshClient) setHandshakeState(
 		return nil, nil, common.ContextError(errors.New("handshake already completed"))
 	}
 
+	clientPlatform, _ := getStringRequestParam(state.apiParams, "client_platform")
+	sshClient.sshServer.recordCompletedHandshake(clientPlatform, sshClient.tunnelProtocol)
+
+	sshClient.checkDowngrade(state.apiParams)
+
 	// Verify the authorizations submitted by the client. Verified, active
 	// (non-expired) access types will be available for traffic rules
 	// filtering.
@@ -2014,7 +3376,7 @@ func (sshClient *sshClient) setHandshakeState(
 		sshClient.stopTimer = time.AfterFunc(
 			stopTime.Sub(time.Now()),
 			func() {
-				sshClient.stop()
+				sshClient.stopWithReason(CONNECTION_CLOSE_REASON_AUTHORIZATION_EXPIRED)
 			})
 
 		sshClient.Unlock()
@@ -2074,12 +3436,34 @@ func (sshClient *sshClient) setTrafficRules() {
 	sshClient.Lock()
 	defer sshClient.Unlock()
 
+	// The tunnel auth hook policy may override the region used to select
+	// traffic rules as well as the selected rate limits.
+
+	geoIPData := sshClient.geoIPData
+	if sshClient.authPolicy != nil && sshClient.authPolicy.region != "" {
+		geoIPData.Country = sshClient.authPolicy.region
+	}
+
 	sshClient.trafficRules = sshClient.sshServer.support.TrafficRulesSet.GetTrafficRules(
 		sshClient.isFirstTunnelInSession,
 		sshClient.tunnelProtocol,
-		sshClient.geoIPData,
+		geoIPData,
 		sshClient.handshakeState)
 
+	sshClient.authPolicy.applyRateLimits(&sshClient.trafficRules.RateLimits)
+
+	sshClient.maxTCPPortForwardsPerDestination =
+		getMaxTCPPortForwardsPerDestination(sshClient.tacticsSnapshot, geoIPData)
+
+	sshClient.maxSSHChannels =
+		getMaxSSHChannelsPerTunnel(sshClient.tacticsSnapshot, geoIPData)
+
+	sshClient.portForwardDialOptions =
+		getPortForwardDialOptions(sshClient.tacticsSnapshot, geoIPData)
+
+	sshClient.portForwardDialRetryPolicy =
+		getPortForwardDialRetryPolicy(sshClient.tacticsSnapshot, geoIPData)
+
 	if sshClient.throttledConn != nil {
 		// Any existing throttling state is reset.
 		sshClient.throttledConn.SetLimits(
@@ -2087,6 +3471,93 @@ func (sshClient *sshClient) setTrafficRules() {
 	}
 }
 
+// getMaxTCPPortForwardsPerDestination returns the
+// ServerMaxTCPPortForwardsPerDestination tactics parameter value for the
+// client, or the parameter default when no tactics apply.
+func getMaxTCPPortForwardsPerDestination(
+	tacticsSnapshot *tactics.Snapshot, geoIPData GeoIPData) int {
+
+	p, err := tacticsSnapshot.GetServerSideParameters(common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for port forward limit")
+	}
+
+	if p == nil {
+		clientParameters, err := parameters.NewClientParameters(nil)
+		if err != nil {
+			log.WithContextFields(LogFields{"error": err}).Warning(
+				"NewClientParameters failed")
+			return 0
+		}
+		p = clientParameters.Get()
+	}
+
+	return p.Int(parameters.ServerMaxTCPPortForwardsPerDestination)
+}
+
+// getPortForwardDialOptions returns the ServerPortForwardDialOptions tactics
+// parameter value for the client, or nil, the server defaults for all
+// ports, when no tactics apply.
+func getPortForwardDialOptions(
+	tacticsSnapshot *tactics.Snapshot, geoIPData GeoIPData) parameters.PortForwardDialOptions {
+
+	p, err := tacticsSnapshot.GetServerSideParameters(common.GeoIPData(geoIPData))
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to get tactics for port forward dial options")
+	}
+
+	if p == nil {
+		return nil
+	}
+
+	return p.PortForwardDialOptions(parameters.ServerPortForwardDialOptions)
+}
+
+// getPortForwardDialOption returns the dial options for TCP port forwards to
+// the specified destination port.
+func (sshClient *sshClient) getPortForwardDialOption(port int) parameters.PortForwardDialOption {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	return sshClient.portForwardDialOptions.Option(port)
+}
+
+func (sshClient *sshClient) getPortForwardDialRetryPolicy() portForwardDialRetryPolicy {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	return sshClient.portForwardDialRetryPolicy
+}
+
+// applyPortForwardDialOption sets the socket options specified by option on
+// a dialed TCP port forward conn. Failures are logged and are not fatal.
+func applyPortForwardDialOption(conn net.Conn, option parameters.PortForwardDialOption) {
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	var err error
+
+	if option.DisableNoDelay {
+		err = tcpConn.SetNoDelay(false)
+	}
+	if err == nil && option.ReadBufferBytes > 0 {
+		err = tcpConn.SetReadBuffer(option.ReadBufferBytes)
+	}
+	if err == nil && option.WriteBufferBytes > 0 {
+		err = tcpConn.SetWriteBuffer(option.WriteBufferBytes)
+	}
+
+	if err != nil {
+		log.WithContextFields(LogFields{"error": err}).Warning(
+			"failed to apply port forward dial option")
+	}
+}
+
 // setOSLConfig resets the client's OSL seed state based on the latest OSL config
 // As sshClient.oslClientSeedState may be reset by a concurrent goroutine,
 // oslClientSeedState must only be accessed within the sshClient mutex.
@@ -2313,6 +3784,53 @@ func (sshClient *sshClient) abortedTCPPortForward() {
 	sshClient.tcpTrafficState.concurrentDialingPortForwardCount -= 1
 }
 
+// allocateDestinationPortForward checks and increments the client's count of
+// concurrent TCP port forwards to the destination host. Each successful
+// allocation must be paired with a releaseDestinationPortForward call.
+func (sshClient *sshClient) allocateDestinationPortForward(hostToConnect string) bool {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	max := sshClient.maxTCPPortForwardsPerDestination
+	if max <= 0 {
+		return true
+	}
+
+	if sshClient.tcpPortForwardDestinationCounts == nil {
+		sshClient.tcpPortForwardDestinationCounts = make(map[string]int)
+	}
+
+	destination := strings.ToLower(hostToConnect)
+
+	if sshClient.tcpPortForwardDestinationCounts[destination] >= max {
+		return false
+	}
+
+	sshClient.tcpPortForwardDestinationCounts[destination] += 1
+
+	return true
+}
+
+func (sshClient *sshClient) releaseDestinationPortForward(hostToConnect string) {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	destination := strings.ToLower(hostToConnect)
+
+	count, ok := sshClient.tcpPortForwardDestinationCounts[destination]
+	if !ok {
+		return
+	}
+
+	if count <= 1 {
+		delete(sshClient.tcpPortForwardDestinationCounts, destination)
+	} else {
+		sshClient.tcpPortForwardDestinationCounts[destination] = count - 1
+	}
+}
+
 func (sshClient *sshClient) allocatePortForward(portForwardType int) bool {
 
 	sshClient.Lock()
@@ -2450,6 +3968,34 @@ func (sshClient *sshClient) closedPortForward(
 	state.availablePortForwardCond.Signal()
 }
 
+// exportFlowRecord exports a flow record for a completed port forward,
+// when flow export is enabled.
+func (sshClient *sshClient) exportFlowRecord(
+	portForwardType int,
+	IP net.IP,
+	port int,
+	startTime time.Time,
+	bytesUp, bytesDown int64) {
+
+	protocolIdentifier := byte(ipfixProtocolTCP)
+	if portForwardType == portForwardTypeUDP {
+		protocolIdentifier = ipfixProtocolUDP
+	}
+
+	sshClient.sshServer.support.FlowExporter.addRecord(
+		&flowRecord{
+			protocolIdentifier: protocolIdentifier,
+			destinationIP:      IP,
+			destinationPort:    port,
+			startTime:          startTime,
+			endTime:            time.Now(),
+			bytesUp:            bytesUp,
+			bytesDown:          bytesDown,
+			geoIPData:          sshClient.geoIPData,
+			tunnelProtocol:     sshClient.tunnelProtocol,
+		})
+}
+
 func (sshClient *sshClient) updateQualityMetricsWithDialResult(
 	tcpPortForwardDialSuccess bool, dialDuration time.Duration) {
 
@@ -2478,7 +4024,8 @@ func (sshClient *sshClient) handleTCPChannel(
 	remainingDialTimeout time.Duration,
 	hostToConnect string,
 	portToConnect int,
-	newChannel ssh.NewChannel) {
+	newChannel ssh.NewChannel,
+	compressed bool) {
 
 	// Assumptions:
 	// - sshClient.dialingTCPPortForward() has been called
@@ -2509,20 +4056,67 @@ func (sshClient *sshClient) handleTCPChannel(
 		}
 	}
 
+	// Transparently redirect DNS port forwards, made by the client local DNS
+	// proxy, to the server's DNS resolver.
+
+	isTransparentDNSForwarding := false
+	if hostToConnect == protocol.TRANSPARENT_DNS_RESOLVER_HOST &&
+		portToConnect == DNS_RESOLVER_PORT {
+
+		isTransparentDNSForwarding = true
+		hostToConnect = sshClient.sshServer.support.DNSResolver.Get().String()
+	}
+
+	// Enforce the per-destination limit, which applies to the destination
+	// host requested by the client. The server's own web server and DNS
+	// resolver destinations are exempt. Excess port forwards are rejected,
+	// as are port forwards exceeding other limits, rather than closing
+	// existing port forwards.
+
+	if !isWebServerPortForward && !isTransparentDNSForwarding {
+
+		if !sshClient.allocateDestinationPortForward(hostToConnect) {
+			sshClient.rejectNewChannel(
+				newChannel, "per-destination TCP port forward limit exceeded")
+			return
+		}
+		defer sshClient.releaseDestinationPortForward(hostToConnect)
+	}
+
 	// Dial the remote address.
 	//
 	// Hostname resolution is performed explicitly, as a separate step, as the target IP
 	// address is used for traffic rules (AllowSubnets) and OSL seed progress.
+	// When configured, the PortForwardResolver is used in place of the system
+	// resolver.
 	//
 	// Contexts are used for cancellation (via sshClient.runCtx, which is cancelled
 	// when the client is stopping) and timeouts.
+	//
+	// Resolves and dials which fail with a transient error are retried, as
+	// specified by tactics; all attempts, including backoff waits, count
+	// towards the dial timeout.
 
 	dialStartTime := monotime.Now()
 
+	retryPolicy := sshClient.getPortForwardDialRetryPolicy()
+
 	log.WithContextFields(LogFields{"hostToConnect": hostToConnect}).Debug("resolving")
 
 	ctx, cancelCtx := context.WithTimeout(sshClient.runCtx, remainingDialTimeout)
-	IPs, err := (&net.Resolver{}).LookupIPAddr(ctx, hostToConnect)
+	var IPs []net.IPAddr
+	var err error
+	for attempt := 0; ; attempt++ {
+		if resolver := sshClient.sshServer.support.PortForwardResolver; resolver != nil {
+			IPs, err = resolver.LookupIPAddr(ctx, hostToConnect)
+		} else {
+			IPs, err = (&net.Resolver{}).LookupIPAddr(ctx, hostToConnect)
+		}
+		if err == nil || !retryPolicy.retry(ctx, attempt, err) {
+			break
+		}
+		log.WithContextFields(LogFields{"error": err}).Debug("retrying resolve")
+	}
 	cancelCtx() // "must be called or the new context will remain live until its parent context is cancelled"
 
 	// TODO: shuffle list to try other IPs?
@@ -2540,6 +4134,12 @@ func (sshClient *sshClient) handleTCPChannel(
 
 	resolveElapsedTime := monotime.Since(dialStartTime)
 
+	logSlowOperation(
+		sshClient.sshServer.support.Config,
+		SLOW_OPERATION_TCP_PORT_FORWARD_RESOLVE,
+		dialStartTime,
+		sshClient.tunnelProtocol)
+
 	if err != nil {
 
 		// Record a port forward failure
@@ -2561,7 +4161,7 @@ func (sshClient *sshClient) handleTCPChannel(
 	if !isWebServerPortForward &&
 		!sshClient.isPortForwardPermitted(
 			portForwardTypeTCP,
-			false,
+			isTransparentDNSForwarding,
 			IP,
 			portToConnect) {
 
@@ -2575,12 +4175,64 @@ func (sshClient *sshClient) handleTCPChannel(
 
 	remoteAddr := net.JoinHostPort(IP.String(), strconv.Itoa(portToConnect))
 
+	// Wait for an outbound dial slot. The wait counts towards the dial
+	// timeout.
+
+	queueStartTime := monotime.Now()
+
+	if !sshClient.sshServer.acquireOutboundDial(
+		sshClient.runCtx, sshClient.tunnelProtocol, remainingDialTimeout) {
+
+		// Note: not recording a port forward failure in this case
+
+		sshClient.rejectNewChannel(newChannel, "outbound dial limit exceeded")
+		return
+	}
+
+	remainingDialTimeout -= monotime.Since(queueStartTime)
+
+	// Apply any socket options and timeouts configured, by tactics, for the
+	// destination port. Unlisted ports use the defaults.
+
+	dialOption := sshClient.getPortForwardDialOption(portToConnect)
+
+	if dialOption.DialTimeoutMilliseconds > 0 {
+		dialTimeout := time.Duration(dialOption.DialTimeoutMilliseconds) * time.Millisecond
+		if dialTimeout < remainingDialTimeout {
+			remainingDialTimeout = dialTimeout
+		}
+	}
+
+	dialer := &net.Dialer{}
+	if dialOption.KeepAlivePeriodMilliseconds > 0 {
+		dialer.KeepAlive = time.Duration(dialOption.KeepAlivePeriodMilliseconds) * time.Millisecond
+	} else if dialOption.KeepAlivePeriodMilliseconds < 0 {
+		dialer.KeepAlive = -1
+	}
+
 	log.WithContextFields(LogFields{"remoteAddr": remoteAddr}).Debug("dialing")
 
+	outboundDialStartTime := monotime.Now()
+
 	ctx, cancelCtx = context.WithTimeout(sshClient.runCtx, remainingDialTimeout)
-	fwdConn, err := (&net.Dialer{}).DialContext(ctx, "tcp", remoteAddr)
+	var fwdConn net.Conn
+	for attempt := 0; ; attempt++ {
+		fwdConn, err = dialer.DialContext(ctx, "tcp", remoteAddr)
+		if err == nil || !retryPolicy.retry(ctx, attempt, err) {
+			break
+		}
+		log.WithContextFields(LogFields{"error": err}).Debug("retrying dial")
+	}
 	cancelCtx() // "must be called or the new context will remain live until its parent context is cancelled"
 
+	sshClient.sshServer.releaseOutboundDial()
+
+	logSlowOperation(
+		sshClient.sshServer.support.Config,
+		SLOW_OPERATION_TCP_PORT_FORWARD_DIAL,
+		outboundDialStartTime,
+		sshClient.tunnelProtocol)
+
 	// Record port forward success or failure
 	sshClient.updateQualityMetricsWithDialResult(err == nil, monotime.Since(dialStartTime))
 
@@ -2598,14 +4250,30 @@ func (sshClient *sshClient) handleTCPChannel(
 
 	defer fwdConn.Close()
 
+	applyPortForwardDialOption(fwdConn, dialOption)
+
+	var fwdChannel ssh.Channel
 	fwdChannel, requests, err := newChannel.Accept()
 	if err != nil {
 		log.WithContextFields(LogFields{"error": err}).Warning("accept new channel failed")
 		return
 	}
-	go ssh.DiscardRequests(requests)
+	// The requests channel is closed when the SSH channel is closed, including
+	// when the SSH connection is closed. channelClosed is used to stop
+	// waiting on a half-closed port forward.
+	channelClosed := make(chan struct{})
+	go func() {
+		ssh.DiscardRequests(requests)
+		close(channelClosed)
+	}()
 	defer fwdChannel.Close()
 
+	if compressed {
+		compressedChannel := newCompressedChannel(fwdChannel)
+		defer sshClient.updateCompressionMetrics(compressedChannel)
+		fwdChannel = compressedChannel
+	}
+
 	// Release the dialing slot and acquire an established slot.
 	//
 	// establishedPortForward increments the concurrent TCP port
@@ -2624,14 +4292,24 @@ func (sshClient *sshClient) handleTCPChannel(
 
 	// TODO: 64-bit alignment? https://golang.org/pkg/sync/atomic/#pkg-note-BUG
 	var bytesUp, bytesDown int64
+	startTime := time.Now()
 	defer func() {
 		sshClient.closedPortForward(
 			portForwardTypeTCP, atomic.LoadInt64(&bytesUp), atomic.LoadInt64(&bytesDown))
+		sshClient.exportFlowRecord(
+			portForwardTypeTCP, IP, portToConnect, startTime,
+			atomic.LoadInt64(&bytesUp), atomic.LoadInt64(&bytesDown))
 	}()
 
 	lruEntry := sshClient.tcpPortForwardLRU.Add(fwdConn)
 	defer lruEntry.Remove()
 
+	// Retain the net.TCPConn CloseWrite, which is used to propagate a client
+	// half-close, before fwdConn is wrapped.
+	closeWriter, _ := fwdConn.(interface {
+		CloseWrite() error
+	})
+
 	// ActivityMonitoredConn monitors the TCP port forward I/O and updates
 	// its LRU status. ActivityMonitoredConn also times out I/O on the port
 	// forward if both reads and writes have been idle for the specified
@@ -2644,9 +4322,14 @@ func (sshClient *sshClient) handleTCPChannel(
 		updater = seedUpdater
 	}
 
+	idleTimeout := sshClient.idleTCPPortForwardTimeout()
+	if dialOption.IdleTimeoutMilliseconds > 0 {
+		idleTimeout = time.Duration(dialOption.IdleTimeoutMilliseconds) * time.Millisecond
+	}
+
 	fwdConn, err = common.NewActivityMonitoredConn(
 		fwdConn,
-		sshClient.idleTCPPortForwardTimeout(),
+		idleTimeout,
 		true,
 		updater,
 		lruEntry)
@@ -2662,13 +4345,17 @@ func (sshClient *sshClient) handleTCPChannel(
 	// TODO: relay errors to fwdChannel.Stderr()?
 	relayWaitGroup := new(sync.WaitGroup)
 	relayWaitGroup.Add(1)
+	downstreamDone := make(chan struct{})
 	go func() {
 		defer relayWaitGroup.Done()
+		defer close(downstreamDone)
 		// io.Copy allocates a 32K temporary buffer, and each port forward relay uses
 		// two of these buffers; using io.CopyBuffer with a smaller buffer reduces the
-		// overall memory footprint.
-		bytes, err := io.CopyBuffer(
-			fwdChannel, fwdConn, make([]byte, SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE))
+		// overall memory footprint. The buffers are taken from tunnelBufferPool to
+		// avoid allocating new buffers for each port forward.
+		buffer := tunnelBufferPool.Get(SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE)
+		bytes, err := io.CopyBuffer(fwdChannel, fwdConn, *buffer)
+		tunnelBufferPool.Put(buffer)
 		atomic.AddInt64(&bytesDown, bytes)
 		if err != nil && err != io.EOF {
 			// Debug since errors such as "connection reset by peer" occur during normal operation
@@ -2680,12 +4367,27 @@ func (sshClient *sshClient) handleTCPChannel(
 		// be flowing?
 		fwdChannel.Close()
 	}()
-	bytes, err := io.CopyBuffer(
-		fwdConn, fwdChannel, make([]byte, SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE))
+	buffer := tunnelBufferPool.Get(SSH_TCP_PORT_FORWARD_COPY_BUFFER_SIZE)
+	bytes, err := io.CopyBuffer(fwdConn, fwdChannel, *buffer)
+	tunnelBufferPool.Put(buffer)
 	atomic.AddInt64(&bytesUp, bytes)
 	if err != nil && err != io.EOF {
 		log.WithContextFields(LogFields{"error": err}).Debug("upstream TCP relay failed")
 	}
+	// When the client half-closes the port forward, sending channel EOF,
+	// half-close fwdConn and continue relaying downstream until the
+	// destination closes, fwdConn times out, or the SSH channel is closed.
+	// Some protocols, such as HTTP/1.0 without keep-alive, signal the end of
+	// a request with a half-close and then expect to receive the response.
+	if err == nil && closeWriter != nil {
+		err = closeWriter.CloseWrite()
+		if err == nil {
+			select {
+			case <-downstreamDone:
+			case <-channelClosed:
+			}
+		}
+	}
 	// Shutdown special case: fwdChannel will be closed and return EOF when
 	// the SSH connection is closed, but we need to explicitly close fwdConn
 	// to interrupt the downstream io.Copy, which may be blocked on a
@@ -0,0 +1,856 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/server/psinet"
+	"github.com/marusama/semaphore"
+)
+
+func TestDestinationPortForwardLimit(t *testing.T) {
+
+	sshClient := &sshClient{
+		maxTCPPortForwardsPerDestination: 2,
+	}
+
+	for i := 0; i < 2; i++ {
+		if !sshClient.allocateDestinationPortForward("example.com") {
+			t.Fatalf("unexpected allocation failure")
+		}
+	}
+
+	// The limit applies per destination host, case-insensitively.
+
+	if sshClient.allocateDestinationPortForward("EXAMPLE.COM") {
+		t.Fatalf("unexpected allocation success")
+	}
+
+	if !sshClient.allocateDestinationPortForward("example.org") {
+		t.Fatalf("unexpected allocation failure")
+	}
+
+	sshClient.releaseDestinationPortForward("example.com")
+
+	if !sshClient.allocateDestinationPortForward("example.com") {
+		t.Fatalf("unexpected allocation failure")
+	}
+
+	sshClient.releaseDestinationPortForward("example.com")
+	sshClient.releaseDestinationPortForward("example.com")
+	sshClient.releaseDestinationPortForward("example.org")
+
+	if len(sshClient.tcpPortForwardDestinationCounts) != 0 {
+		t.Fatalf("unexpected destination counts: %+v",
+			sshClient.tcpPortForwardDestinationCounts)
+	}
+
+	// 0 is no limit.
+
+	sshClient.maxTCPPortForwardsPerDestination = 0
+
+	for i := 0; i < 10; i++ {
+		if !sshClient.allocateDestinationPortForward("example.com") {
+			t.Fatalf("unexpected allocation failure")
+		}
+	}
+}
+
+func TestGetServerLoadLevel(t *testing.T) {
+
+	testCases := []struct {
+		establishedClientCount int
+		maxEstablishedClients  int
+		memoryOverloaded       bool
+		warmingUp              bool
+		expectedLevel          string
+	}{
+		{10, 0, false, false, ""},
+		{10, 0, true, false, protocol.SERVER_LOAD_HIGH},
+		{0, 100, false, false, protocol.SERVER_LOAD_LOW},
+		{49, 100, false, false, protocol.SERVER_LOAD_LOW},
+		{50, 100, false, false, protocol.SERVER_LOAD_MEDIUM},
+		{79, 100, false, false, protocol.SERVER_LOAD_MEDIUM},
+		{80, 100, false, false, protocol.SERVER_LOAD_HIGH},
+		{120, 100, false, false, protocol.SERVER_LOAD_HIGH},
+		{10, 100, true, false, protocol.SERVER_LOAD_HIGH},
+		{0, 100, false, true, protocol.SERVER_LOAD_MEDIUM},
+		{79, 100, false, true, protocol.SERVER_LOAD_MEDIUM},
+		{80, 100, false, true, protocol.SERVER_LOAD_HIGH},
+		{10, 0, false, true, ""},
+	}
+
+	for _, testCase := range testCases {
+		level := getServerLoadLevel(
+			testCase.establishedClientCount,
+			testCase.maxEstablishedClients,
+			testCase.memoryOverloaded,
+			testCase.warmingUp)
+		if level != testCase.expectedLevel {
+			t.Errorf("unexpected level for %+v: %s", testCase, level)
+		}
+	}
+}
+
+func TestGetWarmUpMaxEstablishedClients(t *testing.T) {
+
+	testCases := []struct {
+		maxEstablishedClients  int
+		initialCapacityPercent int
+		warmUpPeriod           time.Duration
+		elapsed                time.Duration
+		expectedLimit          int
+		expectedWarmingUp      bool
+	}{
+		{100, 10, 0, 0, 100, false},
+		{0, 10, time.Minute, 0, 0, false},
+		{100, 10, time.Minute, 0, 10, true},
+		{100, 10, time.Minute, 30 * time.Second, 55, true},
+		{100, 10, time.Minute, time.Minute, 100, false},
+		{100, 0, time.Minute, 0, 1, true},
+		{100, 0, time.Minute, 45 * time.Second, 75, true},
+	}
+
+	for _, testCase := range testCases {
+		limit, warmingUp := getWarmUpMaxEstablishedClients(
+			testCase.maxEstablishedClients,
+			testCase.initialCapacityPercent,
+			testCase.warmUpPeriod,
+			testCase.elapsed)
+		if limit != testCase.expectedLimit || warmingUp != testCase.expectedWarmingUp {
+			t.Errorf("unexpected limit for %+v: %d, %v", testCase, limit, warmingUp)
+		}
+	}
+}
+
+func TestGetMemoryOverloaded(t *testing.T) {
+
+	testCases := []struct {
+		overloaded         bool
+		heapAlloc          uint64
+		expectedOverloaded bool
+	}{
+		{false, 50, false},
+		{false, 100, false},
+		{false, 101, true},
+		{true, 101, true},
+		{true, 100, true},
+		{true, 80, true},
+		{true, 79, false},
+		{false, 90, false},
+	}
+
+	highWatermark := uint64(100)
+	lowWatermark := uint64(80)
+
+	for _, testCase := range testCases {
+		overloaded := getMemoryOverloaded(
+			testCase.overloaded, testCase.heapAlloc, highWatermark, lowWatermark)
+		if overloaded != testCase.expectedOverloaded {
+			t.Errorf("unexpected overloaded for %+v: %v", testCase, overloaded)
+		}
+	}
+
+	// Simulate heap allocation rising above the high watermark and falling
+	// back below the low watermark. The server remains overloaded while the
+	// heap allocation is between the watermarks.
+
+	overloaded := false
+	for _, step := range []struct {
+		heapAlloc          uint64
+		expectedOverloaded bool
+	}{
+		{90, false},
+		{110, true},
+		{90, true},
+		{85, true},
+		{70, false},
+		{90, false},
+		{110, true},
+	} {
+		overloaded = getMemoryOverloaded(
+			overloaded, step.heapAlloc, highWatermark, lowWatermark)
+		if overloaded != step.expectedOverloaded {
+			t.Fatalf("unexpected overloaded for %+v: %v", step, overloaded)
+		}
+	}
+}
+
+func TestAdmitClient(t *testing.T) {
+
+	config := &Config{
+		MaxEstablishedClients:  2,
+		OverloadSheddingPolicy: OVERLOAD_SHEDDING_POLICY_REJECT,
+	}
+
+	sshServer := &sshServer{
+		support: &SupportServices{Config: config},
+		clients: make(map[string]*sshClient),
+	}
+
+	admitClient := func(expectAdmitted, expectReservedSlot bool) *reservedClientSlot {
+		t.Helper()
+		admitted, reservedSlot := sshServer.admitClient()
+		if admitted != expectAdmitted || (reservedSlot != nil) != expectReservedSlot {
+			t.Fatalf(
+				"unexpected admitClient result: %v, %v", admitted, reservedSlot != nil)
+		}
+		return reservedSlot
+	}
+
+	checkEstablishedClientCount := func(expectedCount int) {
+		t.Helper()
+		sshServer.clientsMutex.Lock()
+		count := sshServer.getEstablishedClientCountLocked()
+		sshServer.clientsMutex.Unlock()
+		if count != expectedCount {
+			t.Fatalf("unexpected established client count: %d", count)
+		}
+	}
+
+	// Under the limit, clients are admitted.
+
+	clientA := makeTestEstablishedClient(t, sshServer, "A", nil)
+	admitClient(true, false)
+
+	// At the limit, with the reject policy, clients are rejected.
+
+	clientB := makeTestEstablishedClient(t, sshServer, "B", nil)
+	admitClient(false, false)
+
+	// When memory overloaded, clients are rejected.
+
+	config.MaxEstablishedClients = 0
+	admitClient(true, false)
+	atomic.StoreInt32(&sshServer.memoryOverloaded, 1)
+	admitClient(false, false)
+	atomic.StoreInt32(&sshServer.memoryOverloaded, 0)
+	config.MaxEstablishedClients = 2
+
+	// With the shed idle policy, clients are rejected when no established
+	// client is idle.
+
+	config.OverloadSheddingPolicy = OVERLOAD_SHEDDING_POLICY_SHED_IDLE
+	sshServer.shedMinIdleTime = time.Hour
+	admitClient(false, false)
+
+	// With idle established clients, the least recently active client is
+	// shed to admit a new client, and the shed client's slot is reserved.
+	// Concurrent admissions don't shed the same client, and the limit isn't
+	// exceeded while shed clients are stopping.
+
+	sshServer.shedMinIdleTime = 0
+
+	reservedSlotC := admitClient(true, true)
+	clientA.awaitStopped(t, CONNECTION_CLOSE_REASON_IDLE_SHED)
+	checkEstablishedClientCount(2)
+
+	reservedSlotD := admitClient(true, true)
+	clientB.awaitStopped(t, CONNECTION_CLOSE_REASON_IDLE_SHED)
+	checkEstablishedClientCount(2)
+
+	admitClient(false, false)
+
+	// The reserved slots remain counted after the shed clients are
+	// unregistered.
+
+	sshServer.unregisterEstablishedClient(clientA.sshClient)
+	sshServer.unregisterEstablishedClient(clientB.sshClient)
+	checkEstablishedClientCount(2)
+	admitClient(false, false)
+
+	// A reserved slot is released when the admitted client is registered,
+	// as the client is then counted as established, and when the admitted
+	// client exits without being registered.
+
+	makeTestEstablishedClient(t, sshServer, "C", reservedSlotC)
+	checkEstablishedClientCount(2)
+	if reservedSlotC.reserved {
+		t.Fatalf("unexpected reserved slot")
+	}
+
+	sshServer.releaseReservedClientSlot(reservedSlotD)
+	sshServer.releaseReservedClientSlot(reservedSlotD)
+	checkEstablishedClientCount(1)
+	admitClient(true, false)
+
+	// While warming up, idle clients aren't shed.
+
+	makeTestEstablishedClient(t, sshServer, "D", nil)
+	config.WarmUpPeriodSeconds = 3600
+	config.WarmUpInitialCapacityPercent = 100
+	sshServer.startTime = monotime.Now()
+	admitClient(false, false)
+	config.WarmUpPeriodSeconds = 0
+	admitClient(true, true)
+}
+
+func TestShedIdleClients(t *testing.T) {
+
+	sshServer := &sshServer{
+		support: &SupportServices{Config: &Config{}},
+		clients: make(map[string]*sshClient),
+	}
+
+	var clients []*testEstablishedClient
+	for i := 0; i < 4; i++ {
+		clients = append(
+			clients,
+			makeTestEstablishedClient(t, sshServer, strconv.Itoa(i), nil))
+	}
+
+	// No clients are shed when none are idle.
+
+	sshServer.shedMinIdleTime = time.Hour
+	if count := sshServer.shedIdleClients(2); count != 0 {
+		t.Fatalf("unexpected shed count: %d", count)
+	}
+
+	// Idle clients are shed least recently active first, and clients which
+	// are already being shed aren't selected again.
+
+	sshServer.shedMinIdleTime = 0
+
+	if count := sshServer.shedIdleClients(2); count != 2 {
+		t.Fatalf("unexpected shed count: %d", count)
+	}
+	clients[0].awaitStopped(t, CONNECTION_CLOSE_REASON_IDLE_SHED)
+	clients[1].awaitStopped(t, CONNECTION_CLOSE_REASON_IDLE_SHED)
+
+	if count := sshServer.shedIdleClients(4); count != 2 {
+		t.Fatalf("unexpected shed count: %d", count)
+	}
+	clients[2].awaitStopped(t, CONNECTION_CLOSE_REASON_IDLE_SHED)
+	clients[3].awaitStopped(t, CONNECTION_CLOSE_REASON_IDLE_SHED)
+
+	if count := sshServer.shedIdleClients(4); count != 0 {
+		t.Fatalf("unexpected shed count: %d", count)
+	}
+
+	sshServer.clientsMutex.Lock()
+	sheddingClientCount := sshServer.sheddingClientCount
+	sshServer.clientsMutex.Unlock()
+	if sheddingClientCount != 4 {
+		t.Fatalf("unexpected shedding client count: %d", sheddingClientCount)
+	}
+
+	for _, client := range clients {
+		sshServer.unregisterEstablishedClient(client.sshClient)
+	}
+
+	sshServer.clientsMutex.Lock()
+	clientCount := len(sshServer.clients)
+	sheddingClientCount = sshServer.sheddingClientCount
+	sshServer.clientsMutex.Unlock()
+	if clientCount != 0 || sheddingClientCount != 0 {
+		t.Fatalf("unexpected client counts: %d, %d", clientCount, sheddingClientCount)
+	}
+}
+
+func TestSendMigrationHints(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-migration-hints-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	// The psinet database has one discoverable server.
+
+	dateFormat := "2006-01-02T15:04:05"
+	psinetDatabaseJSON := fmt.Sprintf(`
+    {
+        "hosts" : {"1" : {"id" : "1", "region" : "CA"}},
+        "servers" : [
+            {
+                "id" : "1",
+                "host_id" : "1",
+                "ip_address" : "192.0.2.2",
+                "web_server_port" : "8000",
+                "web_server_secret" : "secret",
+                "web_server_certificate" : "certificate",
+                "discovery_date_range" : ["%s", "%s"]
+            }
+        ]
+    }`,
+		time.Now().UTC().Add(-time.Hour).Format(dateFormat),
+		time.Now().UTC().Add(time.Hour).Format(dateFormat))
+
+	psinetDatabaseFilename := filepath.Join(testDataDirName, "psinet.json")
+	err = ioutil.WriteFile(psinetDatabaseFilename, []byte(psinetDatabaseJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	psinetDatabase, err := psinet.NewDatabase(psinetDatabaseFilename)
+	if err != nil {
+		t.Fatalf("NewDatabase failed: %s", err)
+	}
+
+	sshServer := &sshServer{
+		support: &SupportServices{
+			Config:         &Config{},
+			PsinetDatabase: psinetDatabase,
+		},
+		clients: make(map[string]*sshClient),
+	}
+
+	client := makeTestEstablishedClient(t, sshServer, "0", nil)
+	client.supportsServerRequests = true
+
+	legacyClient := makeTestEstablishedClient(t, sshServer, "1", nil)
+
+	// The deadline is sent in whole seconds.
+
+	sshServer.sendMigrationHints(90*time.Second + 500*time.Millisecond)
+
+	var request *ssh.Request
+	select {
+	case request = <-client.stubConn.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("migration hint not sent")
+	}
+
+	if request.Type != protocol.PSIPHON_API_MIGRATE_REQUEST_NAME || !request.WantReply {
+		t.Fatalf("unexpected request: %s", request.Type)
+	}
+
+	var migrateRequest protocol.MigrateRequest
+	err = json.Unmarshal(request.Payload, &migrateRequest)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	if migrateRequest.DeadlineSeconds != 90 {
+		t.Fatalf("unexpected deadline: %d", migrateRequest.DeadlineSeconds)
+	}
+
+	if len(migrateRequest.EncodedServerList) != 1 {
+		t.Fatalf("unexpected server list length: %d", len(migrateRequest.EncodedServerList))
+	}
+
+	serverEntry, err := protocol.DecodeServerEntry(
+		migrateRequest.EncodedServerList[0], "", protocol.SERVER_ENTRY_SOURCE_DISCOVERY)
+	if err != nil {
+		t.Fatalf("DecodeServerEntry failed: %s", err)
+	}
+
+	if serverEntry.IpAddress != "192.0.2.2" {
+		t.Fatalf("unexpected server entry: %s", serverEntry.IpAddress)
+	}
+
+	// Clients which don't support server requests are skipped.
+
+	select {
+	case <-legacyClient.stubConn.requests:
+		t.Fatalf("unexpected migration hint sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type testEstablishedClient struct {
+	*sshClient
+	stubConn *testSSHConn
+}
+
+// makeTestEstablishedClient registers an established client, with a stub
+// SSH conn, with sshServer. Clients are made in order of last activity.
+func makeTestEstablishedClient(
+	t *testing.T,
+	sshServer *sshServer,
+	sessionID string,
+	reservedSlot *reservedClientSlot) *testEstablishedClient {
+
+	conn, peerConn := net.Pipe()
+	peerConn.Close()
+
+	activityConn, err := common.NewActivityMonitoredConn(conn, 0, false, nil, nil)
+	if err != nil {
+		t.Fatalf("NewActivityMonitoredConn failed: %s", err)
+	}
+
+	// Ensure distinct last activity times.
+	time.Sleep(time.Millisecond)
+
+	stubConn := &testSSHConn{
+		closed:   make(chan struct{}),
+		requests: make(chan *ssh.Request, 1),
+	}
+
+	sshClient := newSshClient(
+		sshServer, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, GeoIPData{})
+	sshClient.sessionID = sessionID
+	sshClient.sshConn = stubConn
+	sshClient.activityConn = activityConn
+	sshClient.reservedSlot = reservedSlot
+
+	if !sshServer.registerEstablishedClient(sshClient) {
+		t.Fatalf("registerEstablishedClient failed")
+	}
+
+	return &testEstablishedClient{sshClient: sshClient, stubConn: stubConn}
+}
+
+func (client *testEstablishedClient) awaitStopped(t *testing.T, expectedReason string) {
+	t.Helper()
+	select {
+	case <-client.stubConn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client %s not stopped", client.sessionID)
+	}
+	client.Lock()
+	reason := client.closeReason
+	client.Unlock()
+	if reason != expectedReason {
+		t.Fatalf("unexpected close reason: %s", reason)
+	}
+}
+
+// testSSHConn is a stub ssh.Conn which supports only Close, Wait, and
+// SendRequest. Sent requests are delivered to requests and accepted.
+type testSSHConn struct {
+	ssh.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+	requests  chan *ssh.Request
+}
+
+func (conn *testSSHConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	return nil
+}
+
+func (conn *testSSHConn) Wait() error {
+	<-conn.closed
+	return nil
+}
+
+func (conn *testSSHConn) SendRequest(
+	name string, wantReply bool, payload []byte) (bool, []byte, error) {
+
+	conn.requests <- &ssh.Request{Type: name, WantReply: wantReply, Payload: payload}
+	return true, nil, nil
+}
+
+func TestSSHHandshakeLimit(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-handshake-limit-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	tacticsConfigJSON := `
+    {
+      "DefaultTactics" : {
+        "TTL" : "60s",
+        "Probability" : 1.0,
+        "Parameters" : {
+          "ServerMaxConcurrentSSHHandshakes" : 3
+        }
+      },
+      "FilteredTactics" : [
+        {
+          "Filter" : {
+            "Regions": ["CA"]
+          },
+          "Tactics" : {
+            "Parameters" : {
+              "ServerMaxConcurrentSSHHandshakes" : 2
+            }
+          }
+        }
+      ]
+    }
+    `
+
+	tacticsConfigFilename := filepath.Join(testDataDirName, "tactics_config.json")
+	err = ioutil.WriteFile(tacticsConfigFilename, []byte(tacticsConfigJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	tacticsServer, err := tactics.NewServer(
+		CommonLogger(log), nil, nil, tacticsConfigFilename)
+	if err != nil {
+		t.Fatalf("tactics.NewServer failed: %s", err)
+	}
+
+	tunnelProtocol := protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH
+
+	sshServer := &sshServer{
+		support: &SupportServices{
+			Config: &Config{
+				TunnelProtocolPorts: map[string]int{tunnelProtocol: 4000},
+			},
+			TacticsServer: tacticsServer,
+		},
+		sshHandshakeCounts:         map[string]*int64{tunnelProtocol: new(int64)},
+		sshHandshakeRejectedCounts: map[string]*int64{tunnelProtocol: new(int64)},
+		acceptedClientCounts:       make(map[string]map[string]int64),
+		clients:                    make(map[string]*sshClient),
+	}
+
+	// The filtered tactics limit applies to clients in "CA", while other
+	// clients are admitted up to the default tactics limit.
+
+	for i := 0; i < 2; i++ {
+		if !sshServer.enterSSHHandshake(tunnelProtocol, GeoIPData{Country: "CA"}) {
+			t.Fatalf("unexpected SSH handshake rejection")
+		}
+	}
+
+	if sshServer.enterSSHHandshake(tunnelProtocol, GeoIPData{Country: "CA"}) {
+		t.Fatalf("unexpected SSH handshake admission")
+	}
+
+	if !sshServer.enterSSHHandshake(tunnelProtocol, GeoIPData{Country: "US"}) {
+		t.Fatalf("unexpected SSH handshake rejection")
+	}
+
+	if sshServer.enterSSHHandshake(tunnelProtocol, GeoIPData{Country: "US"}) {
+		t.Fatalf("unexpected SSH handshake admission")
+	}
+
+	protocolStats, _, _ := sshServer.getLoadStats()
+
+	for _, stats := range []map[string]int64{
+		protocolStats["ALL"], protocolStats[tunnelProtocol]} {
+
+		if stats["in_progress_ssh_handshakes"] != 3 ||
+			stats["ssh_handshake_limit_rejected_count"] != 2 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+	}
+}
+
+func TestOutboundDialLimit(t *testing.T) {
+
+	tunnelProtocol := protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH
+
+	sshServer := &sshServer{
+		support: &SupportServices{
+			Config: &Config{
+				TunnelProtocolPorts: map[string]int{tunnelProtocol: 4000},
+			},
+		},
+		concurrentOutboundDials:    semaphore.New(1),
+		outboundDialQueueTimeout:   10 * time.Second,
+		outboundDialQueueCounts:    map[string]*int64{tunnelProtocol: new(int64)},
+		outboundDialRejectedCounts: map[string]*int64{tunnelProtocol: new(int64)},
+		acceptedClientCounts:       make(map[string]map[string]int64),
+		clients:                    make(map[string]*sshClient),
+	}
+
+	ctx := context.Background()
+
+	if !sshServer.acquireOutboundDial(ctx, tunnelProtocol, time.Second) {
+		t.Fatalf("unexpected outbound dial rejection")
+	}
+
+	// A queued dial proceeds once the first dial releases its slot.
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- sshServer.acquireOutboundDial(ctx, tunnelProtocol, 10*time.Second)
+	}()
+
+	for atomic.LoadInt64(sshServer.outboundDialQueueCounts[tunnelProtocol]) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	protocolStats, _, _ := sshServer.getLoadStats()
+	if protocolStats[tunnelProtocol]["outbound_dial_queue_depth"] != 1 ||
+		protocolStats["ALL"]["outbound_dials"] != 1 {
+		t.Fatalf("unexpected stats: %+v", protocolStats[tunnelProtocol])
+	}
+
+	sshServer.releaseOutboundDial()
+
+	if !<-acquired {
+		t.Fatalf("unexpected outbound dial rejection")
+	}
+
+	// A queued dial is rejected when the dial timeout expires.
+
+	if sshServer.acquireOutboundDial(ctx, tunnelProtocol, 10*time.Millisecond) {
+		t.Fatalf("unexpected outbound dial admission")
+	}
+
+	protocolStats, _, _ = sshServer.getLoadStats()
+	if protocolStats[tunnelProtocol]["outbound_dial_queue_depth"] != 0 ||
+		protocolStats[tunnelProtocol]["outbound_dial_queue_rejected_count"] != 1 {
+		t.Fatalf("unexpected stats: %+v", protocolStats[tunnelProtocol])
+	}
+
+	sshServer.releaseOutboundDial()
+}
+
+func TestTCPPortForwardHalfClose(t *testing.T) {
+
+	// Run a destination server which, like an HTTP/1.0 server, reads the
+	// request until the client half-closes and then sends the response.
+
+	request := []byte("GET / HTTP/1.0\r\n\r\n")
+	response := []byte("HTTP/1.0 200 OK\r\n\r\nresponse")
+
+	destinationListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer destinationListener.Close()
+
+	go func() {
+		conn, err := destinationListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		received, err := ioutil.ReadAll(conn)
+		if err != nil || !bytes.Equal(received, request) {
+			return
+		}
+		conn.Write(response)
+	}()
+
+	// The port forward destination is the server web server port forward
+	// address, which is exempt from the loopback traffic rule.
+
+	sshServer := &sshServer{
+		support: &SupportServices{
+			Config: &Config{
+				WebServerPortForwardAddress: destinationListener.Addr().String(),
+			},
+		},
+	}
+
+	sshClient := newSshClient(
+		sshServer, protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, GeoIPData{})
+	sshClient.handshakeState.completed = true
+	sshClient.trafficRules = (&TrafficRulesSet{}).GetTrafficRules(
+		true, sshClient.tunnelProtocol, sshClient.geoIPData, sshClient.handshakeState)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatalf("NewSignerFromKey failed: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+		serverConfig.AddHostKey(signer)
+		_, channels, requests, err := ssh.NewServerConn(conn, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		host, portStr, _ := net.SplitHostPort(destinationListener.Addr().String())
+		port, _ := strconv.Atoi(portStr)
+		for newChannel := range channels {
+			sshClient.dialingTCPPortForward()
+			go sshClient.handleTCPChannel(10*time.Second, host, port, newChannel, false)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	clientConn, _, _, err := ssh.NewClientConn(
+		conn, "", &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatalf("NewClientConn failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	client := ssh.NewClient(clientConn, nil, nil)
+
+	fwdConn, err := client.Dial("tcp", destinationListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer fwdConn.Close()
+
+	_, err = fwdConn.Write(request)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	// The half-close is propagated to the destination, and the response is
+	// relayed back to the client.
+
+	err = fwdConn.(interface {
+		CloseWrite() error
+	}).CloseWrite()
+	if err != nil {
+		t.Fatalf("CloseWrite failed: %s", err)
+	}
+
+	result := make(chan []byte, 1)
+	go func() {
+		received, _ := ioutil.ReadAll(fwdConn)
+		result <- received
+	}()
+
+	select {
+	case received := <-result:
+		if !bytes.Equal(received, response) {
+			t.Fatalf("unexpected response: %s", received)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout waiting for response")
+	}
+}
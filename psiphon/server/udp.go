@@ -29,6 +29,7 @@ import (
 	"runtime/debug"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
@@ -42,11 +43,12 @@ import (
 // Copyright (c) 2009, Ambroz Bizjak <ambrop7@gmail.com>
 // https://github.com/ambrop72/badvpn
 //
-func (sshClient *sshClient) handleUDPChannel(newChannel ssh.NewChannel) {
+func (sshClient *sshClient) handleUDPChannel(newChannel ssh.NewChannel, compressed bool) {
 
 	// Accept this channel immediately. This channel will replace any
 	// previously existing UDP channel for this client.
 
+	var sshChannel ssh.Channel
 	sshChannel, requests, err := newChannel.Accept()
 	if err != nil {
 		log.WithContextFields(LogFields{"error": err}).Warning("accept new channel failed")
@@ -55,6 +57,15 @@ func (sshClient *sshClient) handleUDPChannel(newChannel ssh.NewChannel) {
 	go ssh.DiscardRequests(requests)
 	defer sshChannel.Close()
 
+	// udpgw messages are relayed through compressed channels just as they
+	// are through TCP port forward channels; see handleTCPChannel.
+
+	if compressed {
+		compressedChannel := newCompressedChannel(sshChannel)
+		defer sshClient.updateCompressionMetrics(compressedChannel)
+		sshChannel = compressedChannel
+	}
+
 	sshClient.setUDPChannel(sshChannel)
 
 	multiplexer := &udpPortForwardMultiplexer{
@@ -100,7 +111,9 @@ func (mux *udpPortForwardMultiplexer) run() {
 		}
 	}()
 
-	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	pooledBuffer := tunnelBufferPool.Get(udpgwProtocolMaxMessageSize)
+	defer tunnelBufferPool.Put(pooledBuffer)
+	buffer := *pooledBuffer
 	for {
 		// Note: message.packet points to the reusable memory in "buffer".
 		// Each readUdpgwMessage call will overwrite the last message.packet.
@@ -224,6 +237,7 @@ func (mux *udpPortForwardMultiplexer) run() {
 				bytesUp:      0,
 				bytesDown:    0,
 				mux:          mux,
+				startTime:    time.Now(),
 			}
 			mux.portForwardsMutex.Lock()
 			mux.portForwards[portForward.connID] = portForward
@@ -278,6 +292,7 @@ type udpPortForward struct {
 	conn         net.Conn
 	lruEntry     *common.LRUConnsEntry
 	mux          *udpPortForwardMultiplexer
+	startTime    time.Time
 }
 
 func (portForward *udpPortForward) relayDownstream() {
@@ -292,7 +307,9 @@ func (portForward *udpPortForward) relayDownstream() {
 	// Note: there is one downstream buffer per UDP port forward,
 	// while for upstream there is one buffer per client.
 	// TODO: is the buffer size larger than necessary?
-	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	pooledBuffer := tunnelBufferPool.Get(udpgwProtocolMaxMessageSize)
+	defer tunnelBufferPool.Put(pooledBuffer)
+	buffer := *pooledBuffer
 	packetBuffer := buffer[portForward.preambleSize:udpgwProtocolMaxMessageSize]
 	for {
 		// TODO: if read buffer is too small, excess bytes are discarded?
@@ -346,6 +363,9 @@ func (portForward *udpPortForward) relayDownstream() {
 	bytesUp := atomic.LoadInt64(&portForward.bytesUp)
 	bytesDown := atomic.LoadInt64(&portForward.bytesDown)
 	portForward.mux.sshClient.closedPortForward(portForwardTypeUDP, bytesUp, bytesDown)
+	portForward.mux.sshClient.exportFlowRecord(
+		portForwardTypeUDP, portForward.remoteIP, int(portForward.remotePort),
+		portForward.startTime, bytesUp, bytesDown)
 
 	log.WithContextFields(
 		LogFields{
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	UNRECOGNIZED_CONNECTION_BEHAVIOR_CLOSE             = "close"
+	UNRECOGNIZED_CONNECTION_BEHAVIOR_TARPIT            = "tarpit"
+	UNRECOGNIZED_CONNECTION_BEHAVIOR_DECOY             = "decoy"
+	UNRECOGNIZED_CONNECTION_DEFAULT_TARPIT_DURATION    = 1 * time.Minute
+	UNRECOGNIZED_CONNECTION_MAX_TARPIT_DURATION        = 10 * time.Minute
+	UNRECOGNIZED_CONNECTION_DEFAULT_MAX_TARPIT_CONNS   = 1000
+	UNRECOGNIZED_CONNECTION_MAX_DECOY_RESPONSE_SIZE    = 65536
+	UNRECOGNIZED_CONNECTION_DECOY_RESPONSE_WRITE_LIMIT = 5 * time.Second
+)
+
+// unrecognizedConnHandler disposes of client connections which fail to send
+// a recognized tunnel protocol, according to
+// Config.UnrecognizedConnectionBehavior.
+//
+// A connection is unrecognized when it fails the obfuscated SSH seed message
+// check, or when it's neither recognized nor closed by the client before
+// the recognition timeout or the SSH handshake timeout. Connections which
+// fail due to a read error, as when the client disconnects, are closed as
+// usual.
+//
+// Tarpitted connections hold only a socket and a timer, and the number of
+// concurrently tarpitted connections is capped, so the tarpit can't be used
+// to exhaust server resources; when the cap is reached, unrecognized
+// connections are closed immediately.
+type unrecognizedConnHandler struct {
+	behavior          string
+	tarpitDuration    time.Duration
+	decoyResponse     []byte
+	tarpitSemaphore   chan struct{}
+	shutdownBroadcast <-chan struct{}
+}
+
+func newUnrecognizedConnHandler(
+	config *Config, shutdownBroadcast <-chan struct{}) *unrecognizedConnHandler {
+
+	tarpitDuration := UNRECOGNIZED_CONNECTION_DEFAULT_TARPIT_DURATION
+	if config.UnrecognizedConnectionTarpitSeconds > 0 {
+		tarpitDuration = time.Duration(
+			config.UnrecognizedConnectionTarpitSeconds) * time.Second
+	}
+
+	maxTarpitConns := UNRECOGNIZED_CONNECTION_DEFAULT_MAX_TARPIT_CONNS
+	if config.UnrecognizedConnectionMaxTarpitConnections > 0 {
+		maxTarpitConns = config.UnrecognizedConnectionMaxTarpitConnections
+	}
+
+	return &unrecognizedConnHandler{
+		behavior:          config.UnrecognizedConnectionBehavior,
+		tarpitDuration:    tarpitDuration,
+		decoyResponse:     []byte(config.UnrecognizedConnectionDecoyResponse),
+		tarpitSemaphore:   make(chan struct{}, maxTarpitConns),
+		shutdownBroadcast: shutdownBroadcast,
+	}
+}
+
+// handlesUnrecognizedConns indicates whether unrecognized connection
+// handling applies to the tunnel protocol. Meek, QUIC, Marionette, and
+// TapDance connections are virtual connections over another transport, and
+// are always closed.
+func handlesUnrecognizedConns(tunnelProtocol string) bool {
+	return !protocol.TunnelProtocolUsesMeek(tunnelProtocol) &&
+		!protocol.TunnelProtocolUsesQUIC(tunnelProtocol) &&
+		!protocol.TunnelProtocolUsesMarionette(tunnelProtocol) &&
+		!protocol.TunnelProtocolUsesTapdance(tunnelProtocol)
+}
+
+// handle disposes of the unrecognized conn, which is eventually closed.
+// handle doesn't block.
+func (handler *unrecognizedConnHandler) handle(conn net.Conn) {
+
+	switch handler.behavior {
+
+	case UNRECOGNIZED_CONNECTION_BEHAVIOR_TARPIT:
+
+		select {
+		case handler.tarpitSemaphore <- struct{}{}:
+		default:
+			log.WithContext().Debug("unrecognized connection tarpit full")
+			conn.Close()
+			return
+		}
+
+		// The tarpitted connection is held open, without reading or
+		// writing, until the tarpit duration elapses or the server shuts
+		// down.
+
+		go func() {
+			defer func() { <-handler.tarpitSemaphore }()
+			timer := time.NewTimer(handler.tarpitDuration)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-handler.shutdownBroadcast:
+			}
+			conn.Close()
+		}()
+
+	case UNRECOGNIZED_CONNECTION_BEHAVIOR_DECOY:
+
+		go func() {
+			conn.SetWriteDeadline(
+				time.Now().Add(UNRECOGNIZED_CONNECTION_DECOY_RESPONSE_WRITE_LIMIT))
+			_, err := conn.Write(handler.decoyResponse)
+			if err != nil {
+				log.WithContextFields(LogFields{"error": err}).Debug(
+					"unrecognized connection decoy response failed")
+			}
+			conn.Close()
+		}()
+
+	default:
+		conn.Close()
+	}
+}
+
+// readFailureMonitoredConn records whether any Read has failed, which
+// indicates that the client closed or reset the connection, or that the
+// connection was closed by the server.
+type readFailureMonitoredConn struct {
+	net.Conn
+	readFailed int32
+}
+
+func (conn *readFailureMonitoredConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if err != nil {
+		atomic.StoreInt32(&conn.readFailed, 1)
+	}
+	return n, err
+}
+
+func (conn *readFailureMonitoredConn) hasReadFailed() bool {
+	return atomic.LoadInt32(&conn.readFailed) == 1
+}
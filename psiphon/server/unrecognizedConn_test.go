@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUnrecognizedConnHandler(t *testing.T) {
+
+	shutdownBroadcast := make(chan struct{})
+
+	// Decoy: the response is sent and the connection is closed.
+
+	decoyResponse := "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"
+
+	handler := newUnrecognizedConnHandler(
+		&Config{
+			UnrecognizedConnectionBehavior:      UNRECOGNIZED_CONNECTION_BEHAVIOR_DECOY,
+			UnrecognizedConnectionDecoyResponse: decoyResponse,
+		},
+		shutdownBroadcast)
+
+	serverConn, clientConn := net.Pipe()
+	handler.handle(serverConn)
+
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+	if string(response) != decoyResponse {
+		t.Fatalf("unexpected decoy response: %s", string(response))
+	}
+
+	// Tarpit: connections are held open for the tarpit duration, up to the
+	// concurrent limit, and closed by shutdown.
+
+	handler = newUnrecognizedConnHandler(
+		&Config{
+			UnrecognizedConnectionBehavior:             UNRECOGNIZED_CONNECTION_BEHAVIOR_TARPIT,
+			UnrecognizedConnectionTarpitSeconds:        60,
+			UnrecognizedConnectionMaxTarpitConnections: 1,
+		},
+		shutdownBroadcast)
+
+	tarpitServerConn, tarpitClientConn := net.Pipe()
+	handler.handle(tarpitServerConn)
+
+	overflowServerConn, overflowClientConn := net.Pipe()
+	handler.handle(overflowServerConn)
+
+	isClosed := func(conn net.Conn, timeout time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, err := conn.Read(make([]byte, 1))
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return false
+		}
+		return true
+	}
+
+	if !isClosed(overflowClientConn, 1*time.Second) {
+		t.Fatalf("overflow connection not closed")
+	}
+
+	if isClosed(tarpitClientConn, 100*time.Millisecond) {
+		t.Fatalf("tarpitted connection closed")
+	}
+
+	close(shutdownBroadcast)
+
+	if !isClosed(tarpitClientConn, 1*time.Second) {
+		t.Fatalf("tarpitted connection not closed on shutdown")
+	}
+}
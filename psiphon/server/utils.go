@@ -22,7 +22,9 @@ package server
 import (
 	"fmt"
 	"io"
+	"runtime/debug"
 	"sync/atomic"
+	"time"
 )
 
 // IntentionalPanicError is an error type that is used
@@ -30,6 +32,7 @@ import (
 // should propagate the panic.
 type IntentionalPanicError struct {
 	message string
+	stack   []byte
 }
 
 // NewIntentionalPanicError creates a new IntentionalPanicError.
@@ -38,39 +41,220 @@ func NewIntentionalPanicError(errorMessage string) error {
 		message: fmt.Sprintf("intentional panic error: %s", errorMessage)}
 }
 
-// Error implements the error interface.
+// Error implements the error interface. When a stack has been added, the
+// stack trace of the original panic is included, so that it's reported when
+// the panic terminates the process.
 func (err IntentionalPanicError) Error() string {
-	return err.message
+	if err.stack == nil {
+		return err.message
+	}
+	return fmt.Sprintf("%s\nstack: %s", err.message, string(err.stack))
+}
+
+// AddStack returns a copy of the IntentionalPanicError which records the
+// given stack, the debug.Stack() at the point of recovery. Panicking with
+// the result preserves the stack trace of the original panic. Only the
+// first stack is recorded: when the error already has a stack, which is the
+// case when it's recovered and re-panicked more than once, it's returned
+// unchanged.
+func (err IntentionalPanicError) AddStack(debugStack []byte) IntentionalPanicError {
+	if err.stack != nil {
+		return err
+	}
+	err.stack = append([]byte(nil), debugStack...)
+	return err
+}
+
+// IsIntentionalPanic indicates whether a recovered panic value is an
+// IntentionalPanicError, a deliberate panic on a fatal condition, as
+// opposed to an accidental panic caused by a bug.
+func IsIntentionalPanic(panicValue interface{}) bool {
+	_, ok := panicValue.(IntentionalPanicError)
+	return ok
+}
+
+// RecoverAndRepanic must be deferred, as in "defer RecoverAndRepanic()".
+// When the recovered panic value is an IntentionalPanicError,
+// RecoverAndRepanic adds the stack trace of the panic and panics with the
+// result. Any other panic value is re-panicked unchanged, and, on a normal
+// return, RecoverAndRepanic does nothing.
+//
+// Use RecoverAndRepanic in place of an ad hoc recover in code which must
+// not suppress intentional panics.
+func RecoverAndRepanic() {
+	e := recover()
+	if e == nil {
+		return
+	}
+	if panicErr, ok := e.(IntentionalPanicError); ok {
+		panic(panicErr.AddStack(debug.Stack()))
+	}
+	panic(e)
+}
+
+// HandleRecover logs a recovered panic value, for top-level goroutines
+// which log and terminate rather than propagate panics. HandleRecover must
+// be called from the deferred function which called recover, as in:
+//
+//	defer func() {
+//	    HandleRecover(recover(), log)
+//	}()
+//
+// HandleRecover returns true when the panic was intentional, and does
+// nothing and returns false when recovered is nil.
+func HandleRecover(recovered interface{}, logger *ContextLogger) bool {
+	if recovered == nil {
+		return false
+	}
+	panicErr, ok := recovered.(IntentionalPanicError)
+	if !ok {
+		logger.LogPanicRecover(recovered, debug.Stack())
+		return false
+	}
+	panicErr = panicErr.AddStack(debug.Stack())
+	logger.LogPanicRecover(panicErr.message, panicErr.stack)
+	return true
+}
+
+// PanicHandler is invoked, in place of crashing the process, on a server
+// panic. panicValue is the recovered panic value, which may be checked with
+// IsIntentionalPanic, and stack is the stack trace of the panic.
+type PanicHandler func(panicValue interface{}, stack []byte)
+
+var panicHandler atomic.Value
+
+// SetPanicHandler sets a process-wide PanicHandler, for embedders which run
+// the server in-process with other services. The default, nil, is to crash
+// the process, which is the correct behavior for a standalone server.
+//
+// With a handler set, the intentional panics of PanickingLogWriter and the
+// API request handlers, and any panic in the tunnel server, web server, or
+// management server goroutines run by Server.Run, or in a client handler
+// goroutine, invoke the handler instead. A panic in a server component stops
+// the Server, and Run returns an error; the embedder may then initialize and
+// run a new Server. A panicking client handler disconnects only that client.
+//
+// For log write failures, the handler is invoked while the server logger is
+// locked, so the handler must not log using the server logger.
+func SetPanicHandler(handler PanicHandler) {
+	panicHandler.Store(handler)
+}
+
+// invokePanicHandler invokes the PanicHandler, if set, and returns false
+// when no handler is set.
+func invokePanicHandler(panicValue interface{}, stack []byte) bool {
+	handler, _ := panicHandler.Load().(PanicHandler)
+	if handler == nil {
+		return false
+	}
+	handler(panicValue, stack)
+	return true
+}
+
+// recoverPanic must be deferred. When a PanicHandler is set, recoverPanic
+// recovers a panic, invokes the handler, and then calls onRecovered, when
+// not nil. Otherwise, the panic is not recovered and crashes the process.
+func recoverPanic(onRecovered func()) {
+	handler, _ := panicHandler.Load().(PanicHandler)
+	if handler == nil {
+		return
+	}
+	if e := recover(); e != nil {
+		handler(e, debug.Stack())
+		if onRecovered != nil {
+			onRecovered()
+		}
+	}
 }
 
 // PanickingLogWriter wraps an io.Writer and intentionally
-// panics when a Write() fails.
+// panics when a Write() fails. When a PanicHandler is set,
+// the handler is invoked instead and Write returns the error.
 type PanickingLogWriter struct {
-	name   string
-	writer io.Writer
+	name        string
+	writer      io.Writer
+	retryPolicy PanickingLogWriterRetryPolicy
+}
+
+// PanickingLogWriterRetryPolicy specifies how a PanickingLogWriter retries
+// failed writes before panicking. MaxAttempts is the total number of write
+// attempts, and Backoff is the time to wait between attempts. A MaxAttempts
+// of 0 or 1 specifies no retries.
+type PanickingLogWriterRetryPolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
 }
 
 // NewPanickingLogWriter creates a new PanickingLogWriter.
 func NewPanickingLogWriter(
 	name string, writer io.Writer) *PanickingLogWriter {
 
+	return NewPanickingLogWriterWithRetryPolicy(
+		name, writer, PanickingLogWriterRetryPolicy{})
+}
+
+// NewPanickingLogWriterWithRetryPolicy creates a new PanickingLogWriter
+// which retries failed writes, as specified by retryPolicy, and panics only
+// once all attempts fail. This tolerates transient failures of the
+// underlying writer.
+func NewPanickingLogWriterWithRetryPolicy(
+	name string,
+	writer io.Writer,
+	retryPolicy PanickingLogWriterRetryPolicy) *PanickingLogWriter {
+
 	return &PanickingLogWriter{
-		name:   name,
-		writer: writer,
+		name:        name,
+		writer:      writer,
+		retryPolicy: retryPolicy,
 	}
 }
 
 // Write implements the io.Writer interface.
+//
+// With a retry policy, a short write, with or without an error, is also a
+// failure, and each retry writes only the remainder of p which was not yet
+// written, so no bytes are duplicated in the log. Write blocks, and, for the
+// server logger, holds the logger lock, during the retry backoff.
 func (w *PanickingLogWriter) Write(p []byte) (n int, err error) {
-	n, err = w.writer.Write(p)
-	if err != nil {
-		panic(
-			NewIntentionalPanicError(
-				fmt.Sprintf("fatal write to %s failed: %s", w.name, err)))
+
+	if w.retryPolicy.MaxAttempts <= 1 {
+		n, err = w.writer.Write(p)
+		if err != nil {
+			w.fail(err)
+		}
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+
+		var written int
+		written, err = w.writer.Write(p[n:])
+		n += written
+		if n >= len(p) {
+			return len(p), nil
+		}
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+
+		if attempt >= w.retryPolicy.MaxAttempts {
+			break
+		}
+		time.Sleep(w.retryPolicy.Backoff)
 	}
+
+	w.fail(err)
 	return
 }
 
+func (w *PanickingLogWriter) fail(err error) {
+	panicErr := NewIntentionalPanicError(
+		fmt.Sprintf("fatal write to %s failed: %s", w.name, err))
+	if !invokePanicHandler(panicErr, debug.Stack()) {
+		panic(panicErr)
+	}
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,303 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestPanicHandler(t *testing.T) {
+
+	writer := NewPanickingLogWriter("test", failingWriter{})
+
+	// Without a handler, a failed write panics.
+
+	func() {
+		defer func() {
+			if !IsIntentionalPanic(recover()) {
+				t.Fatalf("missing intentional panic")
+			}
+		}()
+		writer.Write([]byte("test"))
+	}()
+
+	var panicValues []interface{}
+	SetPanicHandler(func(panicValue interface{}, stack []byte) {
+		panicValues = append(panicValues, panicValue)
+	})
+	defer SetPanicHandler(nil)
+
+	// With a handler, a failed write invokes the handler and returns an
+	// error.
+
+	_, err := writer.Write([]byte("test"))
+	if err == nil {
+		t.Fatalf("unexpected write success")
+	}
+	if len(panicValues) != 1 || !IsIntentionalPanic(panicValues[0]) {
+		t.Fatalf("unexpected panic values: %v", panicValues)
+	}
+
+	// recoverPanic recovers accidental panics.
+
+	recovered := false
+	func() {
+		defer recoverPanic(func() { recovered = true })
+		var m map[string]int
+		m["panic"] = 1
+	}()
+	if !recovered || len(panicValues) != 2 || IsIntentionalPanic(panicValues[1]) {
+		t.Fatalf("unexpected panic values: %v", panicValues)
+	}
+}
+
+// recoverGoroutine runs f in a goroutine and returns the value recovered at
+// the top of the goroutine.
+func recoverGoroutine(f func()) interface{} {
+	recovered := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			recovered <- recover()
+		}()
+		f()
+	}()
+	return <-recovered
+}
+
+func TestRecoverAndRepanic(t *testing.T) {
+
+	// A normal return is a no-op.
+
+	returned := false
+	e := recoverGoroutine(func() {
+		defer RecoverAndRepanic()
+		returned = true
+	})
+	if !returned || e != nil {
+		t.Fatalf("unexpected recovered value: %v", e)
+	}
+
+	// Other panic values are re-panicked unchanged.
+
+	e = recoverGoroutine(func() {
+		defer RecoverAndRepanic()
+		panic("test")
+	})
+	if s, ok := e.(string); !ok || s != "test" {
+		t.Fatalf("unexpected recovered value: %v", e)
+	}
+
+	e = recoverGoroutine(func() {
+		defer RecoverAndRepanic()
+		var m map[string]int
+		m["panic"] = 1
+	})
+	if _, ok := e.(runtime.Error); !ok || IsIntentionalPanic(e) {
+		t.Fatalf("unexpected recovered value: %v", e)
+	}
+
+	// An intentional panic is re-panicked with the stack of the original
+	// panic, which is recorded only once when re-panicked more than once.
+
+	e = recoverGoroutine(func() {
+		defer RecoverAndRepanic()
+		func() {
+			defer RecoverAndRepanic()
+			panic(NewIntentionalPanicError("test"))
+		}()
+	})
+	if !IsIntentionalPanic(e) {
+		t.Fatalf("unexpected recovered value: %v", e)
+	}
+	panicErr := e.(IntentionalPanicError)
+	if !strings.Contains(panicErr.Error(), "intentional panic error: test") ||
+		!strings.Contains(panicErr.Error(), "TestRecoverAndRepanic") {
+		t.Fatalf("unexpected error: %s", panicErr)
+	}
+	if strings.Count(panicErr.Error(), "stack: ") != 1 {
+		t.Fatalf("unexpected stack count: %s", panicErr)
+	}
+
+	stack := panicErr.stack
+	if !bytes.Equal(panicErr.AddStack([]byte("stack")).stack, stack) {
+		t.Fatalf("unexpected stack")
+	}
+}
+
+func TestHandleRecover(t *testing.T) {
+
+	var buffer bytes.Buffer
+	logger := &ContextLogger{
+		&logrus.Logger{
+			Out:       &buffer,
+			Formatter: &CustomJSONFormatter{},
+			Hooks:     make(logrus.LevelHooks),
+			Level:     logrus.DebugLevel,
+		},
+	}
+
+	handleRecover := func(f func()) (bool, bool) {
+		result := make(chan [2]bool, 1)
+		go func() {
+			returned := false
+			defer func() {
+				result <- [2]bool{HandleRecover(recover(), logger), returned}
+			}()
+			f()
+			returned = true
+		}()
+		r := <-result
+		return r[0], r[1]
+	}
+
+	// A normal return is a no-op.
+
+	intentional, returned := handleRecover(func() {})
+	if intentional || !returned || buffer.Len() != 0 {
+		t.Fatalf("unexpected result: %v, %v, %s", intentional, returned, buffer.String())
+	}
+
+	intentional, returned = handleRecover(func() { panic("test") })
+	if intentional || returned ||
+		!strings.Contains(buffer.String(), `"recover_value":"test"`) {
+		t.Fatalf("unexpected result: %v, %v, %s", intentional, returned, buffer.String())
+	}
+	buffer.Reset()
+
+	intentional, returned = handleRecover(func() {
+		defer RecoverAndRepanic()
+		panic(NewIntentionalPanicError("test"))
+	})
+	if !intentional || returned ||
+		!strings.Contains(buffer.String(), `"recover_value":"intentional panic error: test"`) ||
+		!strings.Contains(buffer.String(), "TestHandleRecover") {
+		t.Fatalf("unexpected result: %v, %v, %s", intentional, returned, buffer.String())
+	}
+}
+
+// flakyWriter fails its first failures writes, writing partialBytes of each
+// failed write, and then succeeds.
+type flakyWriter struct {
+	failures     int
+	partialBytes int
+	shortWrites  bool
+	attempts     int
+	buffer       bytes.Buffer
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.attempts++
+	if w.attempts > w.failures {
+		return w.buffer.Write(p)
+	}
+	n := min(w.partialBytes, len(p))
+	w.buffer.Write(p[:n])
+	if w.shortWrites {
+		return n, nil
+	}
+	return n, errors.New("write failed")
+}
+
+func TestPanickingLogWriterRetries(t *testing.T) {
+
+	line := []byte("0123456789\n")
+
+	retryPolicy := PanickingLogWriterRetryPolicy{
+		MaxAttempts: 4,
+		Backoff:     time.Millisecond,
+	}
+
+	testCases := []struct {
+		description  string
+		failures     int
+		partialBytes int
+		shortWrites  bool
+		retryPolicy  PanickingLogWriterRetryPolicy
+		expectPanic  bool
+	}{
+		{"no failures", 0, 0, false, retryPolicy, false},
+		{"retried errors", 3, 0, false, retryPolicy, false},
+		{"retried partial errors", 3, 2, false, retryPolicy, false},
+		{"retried short writes", 3, 2, true, retryPolicy, false},
+		{"exhausted retries", 4, 2, false, retryPolicy, true},
+		{"no retry policy", 1, 0, false, PanickingLogWriterRetryPolicy{}, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			sink := &flakyWriter{
+				failures:     testCase.failures,
+				partialBytes: testCase.partialBytes,
+				shortWrites:  testCase.shortWrites,
+			}
+
+			writer := NewPanickingLogWriterWithRetryPolicy(
+				"test", sink, testCase.retryPolicy)
+
+			var n int
+			var err error
+			panicked := func() (panicked bool) {
+				defer func() {
+					e := recover()
+					if e != nil && !IsIntentionalPanic(e) {
+						t.Fatalf("unexpected panic: %v", e)
+					}
+					panicked = e != nil
+				}()
+				n, err = writer.Write(line)
+				return false
+			}()
+
+			if panicked != testCase.expectPanic {
+				t.Fatalf("unexpected panic result: %v", panicked)
+			}
+
+			if testCase.expectPanic {
+				return
+			}
+
+			if err != nil || n != len(line) {
+				t.Fatalf("unexpected write result: %d, %v", n, err)
+			}
+
+			if !bytes.Equal(sink.buffer.Bytes(), line) {
+				t.Fatalf("unexpected sink contents: %q", sink.buffer.Bytes())
+			}
+
+			if sink.attempts != testCase.failures+1 {
+				t.Fatalf("unexpected attempts: %d", sink.attempts)
+			}
+		})
+	}
+}
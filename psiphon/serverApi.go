@@ -34,7 +34,9 @@ import (
 	"net/url"
 	"strconv"
 	"sync/atomic"
+	"time"
 
+	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
@@ -59,6 +61,13 @@ type ServerContext struct {
 	clientRegion             string
 	clientUpgradeVersion     string
 	serverHandshakeTimestamp string
+	features                 protocol.Features
+
+	// establishmentTelemetrySampleRate is the rate at which successful
+	// connection telemetry was sampled for this tunnel, and
+	// sampleEstablishmentTelemetry is that sampling decision.
+	establishmentTelemetrySampleRate float64
+	sampleEstablishmentTelemetry     bool
 }
 
 // nextTunnelNumber is a monotonically increasing number assigned to each
@@ -85,7 +94,9 @@ func MakeSessionId() (sessionId string, err error) {
 // NewServerContext makes the tunneled handshake request to the Psiphon server
 // and returns a ServerContext struct for use with subsequent Psiphon server API
 // requests (e.g., periodic connected and status requests).
-func NewServerContext(tunnel *Tunnel) (*ServerContext, error) {
+//
+// ctx is used to interrupt handshake request retry delays.
+func NewServerContext(ctx context.Context, tunnel *Tunnel) (*ServerContext, error) {
 
 	// For legacy servers, set up psiphonHttpsClient for
 	// accessing the Psiphon API via the web service.
@@ -100,16 +111,25 @@ func NewServerContext(tunnel *Tunnel) (*ServerContext, error) {
 		}
 	}
 
+	// The establishment telemetry sampling decision is made once per
+	// tunnel, before any API request parameters are composed, so that the
+	// dial parameters are consistently included in, or omitted from, all
+	// API requests for the tunnel.
+	sampleRate := tunnel.config.clientParameters.Get().Float(
+		parameters.EstablishmentTelemetrySuccessSampleRate)
+
 	serverContext := &ServerContext{
-		sessionId:          tunnel.sessionId,
-		tunnelNumber:       atomic.AddInt64(&nextTunnelNumber, 1),
-		tunnel:             tunnel,
-		psiphonHttpsClient: psiphonHttpsClient,
+		sessionId:                        tunnel.sessionId,
+		tunnelNumber:                     atomic.AddInt64(&nextTunnelNumber, 1),
+		tunnel:                           tunnel,
+		psiphonHttpsClient:               psiphonHttpsClient,
+		establishmentTelemetrySampleRate: sampleRate,
+		sampleEstablishmentTelemetry:     common.FlipWeightedCoin(sampleRate),
 	}
 
 	ignoreRegexps := tunnel.config.clientParameters.Get().Bool(parameters.IgnoreHandshakeStatsRegexps)
 
-	err := serverContext.doHandshakeRequest(ignoreRegexps)
+	err := serverContext.doHandshakeRequest(ctx, ignoreRegexps)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -117,14 +137,101 @@ func NewServerContext(tunnel *Tunnel) (*ServerContext, error) {
 	return serverContext, nil
 }
 
+// sendHandshakeRequest sends the SSH API handshake request. API-level
+// failures, where the server rejects the request, are retried over the
+// same tunnel, with backoff, up to TunnelHandshakeAPIRetryCount times.
+// Tunnel-level failures, where the SSH request fails, are not retried, as
+// the tunnel must be reestablished.
+func (serverContext *ServerContext) sendHandshakeRequest(
+	ctx context.Context, request []byte) ([]byte, error) {
+
+	p := serverContext.tunnel.config.clientParameters.Get()
+	retryCount := p.Int(parameters.TunnelHandshakeAPIRetryCount)
+	retryDelay := p.Duration(parameters.TunnelHandshakeAPIRetryMinDelay)
+	retryMaxDelay := p.Duration(parameters.TunnelHandshakeAPIRetryMaxDelay)
+	retryMultiplier := p.Float(parameters.TunnelHandshakeAPIRetryMultiplier)
+	p = nil
+
+	for retries := 0; ; retries++ {
+
+		response, isAPIFailure, err := serverContext.tunnel.sendAPIRequest(
+			protocol.PSIPHON_API_HANDSHAKE_REQUEST_NAME, request)
+		if err == nil {
+			return response, nil
+		}
+
+		if !isAPIFailure || retries >= retryCount {
+			return nil, common.ContextError(err)
+		}
+
+		NoticeAlert("retry handshake request: %s", err)
+
+		delayTimer := time.NewTimer(retryDelay)
+
+		select {
+		case <-delayTimer.C:
+		case <-ctx.Done():
+			delayTimer.Stop()
+			return nil, common.ContextError(err)
+		}
+
+		retryDelay = time.Duration(
+			float64(retryDelay) * retryMultiplier)
+		if retryDelay >= retryMaxDelay {
+			retryDelay = retryMaxDelay
+		}
+	}
+}
+
+// getClientFeatures returns the protocol features supported by the client
+// and enabled by the current parameters.
+func getClientFeatures(config *Config) protocol.Features {
+
+	// Bandwidth tests are run only on demand; see
+	// Controller.RunBandwidthTest.
+
+	features := protocol.FEATURE_BANDWIDTH_TEST
+	if config.GetClientParameters().Bool(parameters.PortForwardCompression) {
+		features |= protocol.FEATURE_PORT_FORWARD_COMPRESSION
+	}
+	return features
+}
+
+// negotiateHandshakeFeatures returns the features negotiated with the
+// server. Servers which predate feature negotiation don't respond with
+// features; for these servers, the legacy PortForwardCompression response
+// field is used.
+func negotiateHandshakeFeatures(
+	clientFeatures protocol.Features,
+	handshakeResponse *protocol.HandshakeResponse) (protocol.Features, error) {
+
+	if handshakeResponse.Features == "" {
+		serverFeatures := protocol.Features(0)
+		if handshakeResponse.PortForwardCompression {
+			serverFeatures |= protocol.FEATURE_PORT_FORWARD_COMPRESSION
+		}
+		return clientFeatures.Negotiate(serverFeatures), nil
+	}
+
+	serverFeatures, err := protocol.DecodeFeatures(handshakeResponse.Features)
+	if err != nil {
+		return 0, common.ContextError(err)
+	}
+
+	return clientFeatures.Negotiate(serverFeatures), nil
+}
+
 // doHandshakeRequest performs the "handshake" API request. The handshake
 // returns upgrade info, newly discovered server entries -- which are
 // stored -- and sponsor info (home pages, stat regexes).
 func (serverContext *ServerContext) doHandshakeRequest(
-	ignoreStatsRegexps bool) error {
+	ctx context.Context, ignoreStatsRegexps bool) error {
 
 	params := serverContext.getBaseAPIParameters()
 
+	clientFeatures := getClientFeatures(serverContext.tunnel.config)
+	params[protocol.PSIPHON_API_HANDSHAKE_CLIENT_FEATURES] = clientFeatures.Encode()
+
 	doTactics := !serverContext.tunnel.config.DisableTactics &&
 		serverContext.tunnel.config.networkIDGetter != nil
 
@@ -151,6 +258,8 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		}
 	}
 
+	requestStartTime := monotime.Now()
+
 	var response []byte
 	if serverContext.psiphonHttpsClient == nil {
 
@@ -162,8 +271,19 @@ func (serverContext *ServerContext) doHandshakeRequest(
 			return common.ContextError(err)
 		}
 
-		response, err = serverContext.tunnel.SendAPIRequest(
-			protocol.PSIPHON_API_HANDSHAKE_REQUEST_NAME, request)
+		targetLength, err := serverContext.tunnel.config.clientParameters.Get().LengthDistributions(
+			parameters.PsiphonAPIHandshakeRequestTargetLengths).SelectLength(
+			serverContext.tunnel.protocol)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		request, err = padSSHAPIRequestPayload(params, request, targetLength)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		response, err = serverContext.sendHandshakeRequest(ctx, request)
 		if err != nil {
 			return common.ContextError(err)
 		}
@@ -190,6 +310,12 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		}
 	}
 
+	noticeSlowOperation(
+		serverContext.tunnel.config.clientParameters,
+		parameters.SlowHandshakeAPIThreshold,
+		"handshake_api",
+		requestStartTime)
+
 	// Legacy fields:
 	// - 'preemptive_reconnect_lifetime_milliseconds' is unused and ignored
 	// - 'ssh_session_id' is ignored; client session ID is used instead
@@ -200,8 +326,16 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return common.ContextError(err)
 	}
 
+	// The server disconnects clients that are below its minimum client
+	// version, so the tunnel fails.
+	if handshakeResponse.UpgradeRequired {
+		NoticeClientUpgradeRequired(handshakeResponse.UpgradeClientVersion)
+		return common.ContextError(errors.New("client upgrade required"))
+	}
+
 	serverContext.clientRegion = handshakeResponse.ClientRegion
 	NoticeClientRegion(serverContext.clientRegion)
+	serverContext.tunnel.config.recordLastKnownRegion(serverContext.clientRegion)
 
 	var serverEntries []protocol.ServerEntryFields
 
@@ -263,6 +397,23 @@ func (serverContext *ServerContext) doHandshakeRequest(
 	serverContext.serverHandshakeTimestamp = handshakeResponse.ServerTimestamp
 	NoticeServerTimestamp(serverContext.serverHandshakeTimestamp)
 
+	checkClockSkew(
+		serverContext.tunnel.config.clientParameters,
+		handshakeResponse.ServerTimestamp)
+
+	if handshakeResponse.EgressIPAddress != "" {
+		NoticeEgressIPAddress(handshakeResponse.EgressIPAddress)
+	}
+
+	serverContext.tunnel.config.setServerLoad(
+		serverContext.tunnel.serverEntry.IpAddress, handshakeResponse.ServerLoad)
+
+	serverContext.features, err = negotiateHandshakeFeatures(
+		clientFeatures, &handshakeResponse)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
 	NoticeActiveAuthorizationIDs(handshakeResponse.ActiveAuthorizationIDs)
 
 	if doTactics && handshakeResponse.TacticsPayload != nil &&
@@ -305,6 +456,28 @@ func (serverContext *ServerContext) doHandshakeRequest(
 	return nil
 }
 
+// checkClockSkew compares the local clock with the server timestamp
+// received in the handshake and emits a ClockSkew notice when the
+// difference exceeds ClockSkewTolerance. Beyond the tolerance, certificate
+// validity period checks may fail, so apps may use the notice to prompt
+// the user to correct the device clock.
+func checkClockSkew(
+	clientParameters *parameters.ClientParameters, serverTimestamp string) {
+
+	serverTime, err := time.Parse(time.RFC3339, serverTimestamp)
+	if err != nil {
+		// Older servers may not send a timestamp.
+		return
+	}
+
+	skew := time.Since(serverTime)
+
+	tolerance := clientParameters.Get().Duration(parameters.ClockSkewTolerance)
+	if skew > tolerance || skew < -tolerance {
+		NoticeClockSkew(skew)
+	}
+}
+
 // DoConnectedRequest performs the "connected" API request. This request is
 // used for statistics. The server returns a last_connected token for
 // the client to store and send next time it connects. This token is
@@ -360,8 +533,12 @@ func (serverContext *ServerContext) DoConnectedRequest() error {
 		return common.ContextError(err)
 	}
 
-	err = SetKeyValue(
-		datastoreLastConnectedKey, connectedResponse.ConnectedTimestamp)
+	// The last connected timestamp is reported in the next connected
+	// request, and isn't required to complete this request.
+	err = setNonCriticalBucketValue(
+		datastoreKeyValueBucket,
+		[]byte(datastoreLastConnectedKey),
+		[]byte(connectedResponse.ConnectedTimestamp))
 	if err != nil {
 		return common.ContextError(err)
 	}
@@ -516,6 +693,7 @@ func makeStatusRequestPayload(
 
 	persistentStatPayloadNames := make(map[string]string)
 	persistentStatPayloadNames[datastorePersistentStatTypeRemoteServerList] = "remote_server_list_stats"
+	persistentStatPayloadNames[datastorePersistentStatTypeFailedTunnel] = "failed_tunnel_stats"
 
 	for statType, stats := range persistentStats {
 
@@ -610,6 +788,57 @@ func RecordRemoteServerListStat(
 		datastorePersistentStatTypeRemoteServerList, remoteServerListStatJson)
 }
 
+// recordFailedTunnelStat records a failed tunnel connection attempt, for
+// connection establishment telemetry. As with remote server list stats,
+// failed tunnel stats are stored in the persistent datastore and reported
+// via subsequent status requests sent to any Psiphon server.
+//
+// Failed tunnel stats are sampled at EstablishmentTelemetryFailureSampleRate.
+// The sampling decision is made before the stat is composed, and the sample
+// rate is recorded in the stat for unbiased aggregation. As each failed dial
+// may be recorded, and the stored stats are reported only once a tunnel is
+// established, the number of stored stats is capped at
+// EstablishmentTelemetryFailureMaxCount.
+func recordFailedTunnelStat(
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	tunnelProtocol string,
+	dialStats *DialStats,
+	tunnelErr error) error {
+
+	p := config.clientParameters.Get()
+	sampleRate := p.Float(parameters.EstablishmentTelemetryFailureSampleRate)
+	maxCount := p.Int(parameters.EstablishmentTelemetryFailureMaxCount)
+	p = nil
+
+	if !common.FlipWeightedCoin(sampleRate) {
+		return nil
+	}
+
+	params := make(common.APIParameters)
+
+	params["relay_protocol"] = tunnelProtocol
+	addDialAPIParameters(params, dialStats)
+	addServerEntryAPIParameters(params, serverEntry)
+	params["client_failed_timestamp"] =
+		common.TruncateTimestampToHour(common.GetCurrentTimestamp())
+	// Trim this error since it may include long URLs
+	params["tunnel_error"] = TrimError(tunnelErr).Error()
+	params["establishment_telemetry_sample_rate"] = formatSampleRate(sampleRate)
+
+	failedTunnelStatJson, err := json.Marshal(params)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return storePersistentStat(
+		datastorePersistentStatTypeFailedTunnel, failedTunnelStatJson, maxCount)
+}
+
+func formatSampleRate(sampleRate float64) string {
+	return strconv.FormatFloat(sampleRate, 'f', -1, 64)
+}
+
 // doGetRequest makes a tunneled HTTPS request and returns the response body.
 func (serverContext *ServerContext) doGetRequest(
 	requestUrl string) (responseBody []byte, err error) {
@@ -668,17 +897,34 @@ func (serverContext *ServerContext) doPostRequest(
 }
 
 func (serverContext *ServerContext) getBaseAPIParameters() common.APIParameters {
-	return getBaseAPIParameters(
+
+	// When the tunnel is not sampled for establishment telemetry, the
+	// dial parameters are omitted. When sampled, the sample rate is
+	// recorded, which allows for unbiased aggregation of sampled metrics.
+	var dialStats *DialStats
+	if serverContext.sampleEstablishmentTelemetry {
+		dialStats = serverContext.tunnel.dialStats
+	}
+
+	params := getBaseAPIParameters(
 		serverContext.tunnel.config,
 		serverContext.sessionId,
 		serverContext.tunnel.serverEntry,
 		serverContext.tunnel.protocol,
-		serverContext.tunnel.dialStats)
+		dialStats)
+
+	if dialStats != nil {
+		params["establishment_telemetry_sample_rate"] =
+			formatSampleRate(serverContext.establishmentTelemetrySampleRate)
+	}
+
+	return params
 }
 
 // getBaseAPIParameters returns all the common API parameters that are
 // included with each Psiphon API request. These common parameters are used
-// for metrics.
+// for metrics. When dialStats is nil, the dial parameter metrics are
+// omitted.
 func getBaseAPIParameters(
 	config *Config,
 	sessionID string,
@@ -706,6 +952,21 @@ func getBaseAPIParameters(
 		params["device_region"] = config.DeviceRegion
 	}
 
+	if dialStats != nil {
+		addDialAPIParameters(params, dialStats)
+	}
+
+	addServerEntryAPIParameters(params, serverEntry)
+
+	params[tactics.APPLIED_TACTICS_TAG_PARAMETER_NAME] = config.clientParameters.Get().Tag()
+
+	return params
+}
+
+// addDialAPIParameters adds the dial parameter metrics from dialStats
+// to params. These parameters may be blank and are omitted when blank.
+func addDialAPIParameters(params common.APIParameters, dialStats *DialStats) {
+
 	if dialStats.SelectedSSHClientVersion {
 		params["ssh_client_version"] = dialStats.SSHClientVersion
 	}
@@ -745,13 +1006,52 @@ func getBaseAPIParameters(
 	}
 
 	if dialStats.SelectedUserAgent {
-		params["user_agent"] = dialStats.UserAgent
+		if dialStats.UserAgentFamily != "" {
+			params["user_agent_family"] = dialStats.UserAgentFamily
+		} else {
+			params["user_agent"] = dialStats.UserAgent
+		}
 	}
 
 	if dialStats.SelectedTLSProfile {
 		params["tls_profile"] = dialStats.TLSProfile
 	}
 
+	if atomic.LoadInt32(&dialStats.TCPFastOpenAttempted) == 1 {
+		params["tcp_fast_open"] = "1"
+		tcpFastOpenSucceeded := "0"
+		if atomic.LoadInt32(&dialStats.TCPFastOpenSucceeded) == 1 {
+			tcpFastOpenSucceeded = "1"
+		}
+		params["tcp_fast_open_succeeded"] = tcpFastOpenSucceeded
+	}
+
+	if dialStats.OSSHDecoyFirstFlight {
+		params["ossh_decoy_first_flight"] = "1"
+	}
+
+	if dialStats.OSSHSeedKeyDerivation != "" {
+		params["ossh_seed_key_derivation"] = dialStats.OSSHSeedKeyDerivation
+	}
+
+	resetRetries := atomic.LoadInt32(&dialStats.IPAddressFamilyResetRetries)
+	if resetRetries > 0 {
+		params["ip_address_family_reset_retries"] = strconv.Itoa(int(resetRetries))
+	}
+
+	if dialStats.SourcePortPolicy != "" {
+		params["source_port_policy"] = dialStats.SourcePortPolicy
+		sourcePortReused := "0"
+		if atomic.LoadInt32(&dialStats.SourcePortReused) == 1 {
+			sourcePortReused = "1"
+		}
+		params["source_port_reused"] = sourcePortReused
+	}
+}
+
+// addServerEntryAPIParameters adds the server entry metrics to params.
+func addServerEntryAPIParameters(params common.APIParameters, serverEntry *protocol.ServerEntry) {
+
 	if serverEntry.Region != "" {
 		params["server_entry_region"] = serverEntry.Region
 	}
@@ -768,10 +1068,6 @@ func getBaseAPIParameters(
 	if localServerEntryTimestamp != "" {
 		params["server_entry_timestamp"] = localServerEntryTimestamp
 	}
-
-	params[tactics.APPLIED_TACTICS_TAG_PARAMETER_NAME] = config.clientParameters.Get().Tag()
-
-	return params
 }
 
 // makeSSHAPIRequestPayload makes a JSON payload for an SSH API request.
@@ -783,6 +1079,34 @@ func makeSSHAPIRequestPayload(params common.APIParameters) ([]byte, error) {
 	return jsonPayload, nil
 }
 
+// padSSHAPIRequestPayload adds a padding parameter to params so that the
+// encoded request, request, is exactly targetLength bytes. The padding is
+// random base64 characters, which are not escaped in the JSON encoding.
+// When request plus the padding parameter overhead already exceeds
+// targetLength, request is returned unmodified.
+func padSSHAPIRequestPayload(
+	params common.APIParameters, request []byte, targetLength int) ([]byte, error) {
+
+	// The padding parameter adds `,"padding":""` plus the padding value.
+	overhead := len(`,"":""`) + len(protocol.PSIPHON_API_HANDSHAKE_PADDING)
+
+	paddingLength := targetLength - len(request) - overhead
+	if paddingLength < 0 || len(params) == 0 {
+		return request, nil
+	}
+
+	randomBytes, err := common.MakeSecureRandomBytes(paddingLength)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	params[protocol.PSIPHON_API_HANDSHAKE_PADDING] =
+		base64.RawStdEncoding.EncodeToString(randomBytes)[:paddingLength]
+	defer delete(params, protocol.PSIPHON_API_HANDSHAKE_PADDING)
+
+	return makeSSHAPIRequestPayload(params)
+}
+
 // makeRequestUrl makes a URL for a web service API request.
 func makeRequestUrl(tunnel *Tunnel, port, path string, params common.APIParameters) string {
 	var requestUrl bytes.Buffer
@@ -850,8 +1174,8 @@ func makePsiphonHttpsClient(tunnel *Tunnel) (httpsClient *http.Client, err error
 
 	dialer := NewCustomTLSDialer(
 		&CustomTLSConfig{
-			ClientParameters: tunnel.config.clientParameters,
-			Dial:             tunneledDialer,
+			ClientParameters:        tunnel.config.clientParameters,
+			Dial:                    tunneledDialer,
 			VerifyLegacyCertificate: certificate,
 		})
 
@@ -875,6 +1199,10 @@ func HandleServerRequest(
 	switch name {
 	case protocol.PSIPHON_API_OSL_REQUEST_NAME:
 		return HandleOSLRequest(tunnelOwner, tunnel, payload)
+	case protocol.PSIPHON_API_MIGRATE_REQUEST_NAME:
+		return HandleMigrateRequest(tunnelOwner, tunnel, payload)
+	case protocol.PSIPHON_API_TACTICS_REQUEST_NAME:
+		return HandleTacticsRequest(tunnel, payload)
 	}
 
 	return common.ContextError(fmt.Errorf("invalid request name: %s", name))
@@ -915,3 +1243,124 @@ func HandleOSLRequest(
 
 	return nil
 }
+
+// HandleMigrateRequest handles a migration hint sent by a server that is
+// about to drain. The alternate server entries included in the hint are
+// stored and the first alternate is promoted, so that it's the first
+// candidate when establishing the replacement tunnel. The tunnel owner is
+// then signaled to migrate the tunnel before the drain deadline.
+//
+// Server requests are received over the established SSH connection, so the
+// hint is authenticated as coming from the tunnel's server.
+func HandleMigrateRequest(
+	tunnelOwner TunnelOwner, tunnel *Tunnel, payload []byte) error {
+
+	var migrateRequest protocol.MigrateRequest
+	err := json.Unmarshal(payload, &migrateRequest)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	var serverEntries []protocol.ServerEntryFields
+
+	for _, encodedServerEntry := range migrateRequest.EncodedServerList {
+
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			encodedServerEntry,
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_DISCOVERY)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		err = protocol.ValidateServerEntryFields(serverEntryFields)
+		if err != nil {
+			// Skip this entry and continue with the next one
+			NoticeAlert("invalid migrate server entry: %s", err)
+			continue
+		}
+
+		// Skip the draining server.
+		if serverEntryFields.GetIPAddress() == tunnel.serverEntry.IpAddress {
+			continue
+		}
+
+		serverEntries = append(serverEntries, serverEntryFields)
+	}
+
+	if len(serverEntries) > 0 {
+
+		err = StoreServerEntries(tunnel.config, serverEntries, true)
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		// When TargetServerEntry is configured, it's the only candidate.
+		if tunnel.config.TargetServerEntry == "" {
+			err = PromoteServerEntry(tunnel.config, serverEntries[0].GetIPAddress())
+			if err != nil {
+				return common.ContextError(err)
+			}
+		}
+	}
+
+	tunnelOwner.SignalTunnelMigration(
+		tunnel, time.Duration(migrateRequest.DeadlineSeconds)*time.Second)
+
+	return nil
+}
+
+// HandleTacticsRequest handles updated tactics pushed by the tunnel's server
+// after the server's tactics configuration is reloaded. The tactics are
+// stored for the current network ID and applied, as handshake tactics are,
+// to subsequent connection decisions; the current tunnel isn't reconnected.
+//
+// Server requests are received over the established SSH connection, so the
+// tactics are authenticated as coming from the tunnel's server. The pushed
+// payload is size limited and is rejected when its version is lower than
+// that of the last signed or pushed tactics applied. See
+// tactics.HandlePushedTacticsPayload.
+func HandleTacticsRequest(tunnel *Tunnel, payload []byte) error {
+
+	config := tunnel.config
+
+	if config.DisableTactics || config.networkIDGetter == nil ||
+		!config.clientParameters.Get().Bool(parameters.AcceptPushedTactics) {
+
+		return common.ContextError(errors.New("pushed tactics not accepted"))
+	}
+
+	if len(payload) > tactics.MAX_PUSHED_TACTICS_PAYLOAD_SIZE {
+		return common.ContextError(errors.New("pushed tactics exceeds size limit"))
+	}
+
+	var tacticsRequest protocol.TacticsRequest
+	err := json.Unmarshal(payload, &tacticsRequest)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	tacticsRecord, err := tactics.HandlePushedTacticsPayload(
+		GetTacticsStorer(),
+		config.networkIDGetter.GetNetworkID(),
+		tacticsRequest.TacticsPayload)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if tacticsRecord != nil &&
+		common.FlipWeightedCoin(tacticsRecord.Tactics.Probability) {
+
+		err := config.SetClientParameters(
+			tacticsRecord.Tag, true, tacticsRecord.Tactics.Parameters)
+		if err != nil {
+			// As with handshake tactics, all previous tactics values are
+			// left in place.
+			return common.ContextError(err)
+		}
+
+		NoticeInfo("applied pushed tactics: %s", tacticsRecord.Tag)
+	}
+
+	return nil
+}
@@ -0,0 +1,465 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestNegotiateHandshakeFeatures(t *testing.T) {
+
+	compression := protocol.FEATURE_PORT_FORWARD_COMPRESSION
+
+	testCases := []struct {
+		description    string
+		clientFeatures protocol.Features
+		response       protocol.HandshakeResponse
+		expected       protocol.Features
+	}{
+		{
+			"legacy server without compression",
+			compression,
+			protocol.HandshakeResponse{},
+			0,
+		},
+		{
+			"legacy server with compression",
+			compression,
+			protocol.HandshakeResponse{PortForwardCompression: true},
+			compression,
+		},
+		{
+			"server with compression",
+			compression,
+			protocol.HandshakeResponse{Features: compression.Encode()},
+			compression,
+		},
+		{
+			"server without compression",
+			compression,
+			protocol.HandshakeResponse{PortForwardCompression: true, Features: "0"},
+			0,
+		},
+		{
+			"client without compression",
+			0,
+			protocol.HandshakeResponse{PortForwardCompression: true, Features: compression.Encode()},
+			0,
+		},
+		{
+			"newer server with unknown features",
+			compression,
+			protocol.HandshakeResponse{Features: "ffffffffffffffffffff"},
+			compression,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			features, err := negotiateHandshakeFeatures(
+				testCase.clientFeatures, &testCase.response)
+			if err != nil {
+				t.Fatalf("negotiateHandshakeFeatures failed: %s", err)
+			}
+			if features != testCase.expected {
+				t.Fatalf("unexpected features: %x", features)
+			}
+		})
+	}
+}
+
+func TestPadSSHAPIRequestPayload(t *testing.T) {
+
+	params := common.APIParameters{
+		"client_session_id":      "0123456789abcdef",
+		"propagation_channel_id": "ABCDEFGH",
+	}
+
+	request, err := makeSSHAPIRequestPayload(params)
+	if err != nil {
+		t.Fatalf("makeSSHAPIRequestPayload failed: %s", err)
+	}
+
+	for _, targetLength := range []int{0, len(request), len(request) + 1, 500, 4096} {
+
+		padded, err := padSSHAPIRequestPayload(params, request, targetLength)
+		if err != nil {
+			t.Fatalf("padSSHAPIRequestPayload failed: %s", err)
+		}
+
+		if _, ok := params[protocol.PSIPHON_API_HANDSHAKE_PADDING]; ok {
+			t.Fatalf("unexpected padding parameter")
+		}
+
+		var decoded map[string]interface{}
+		err = json.Unmarshal(padded, &decoded)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+
+		_, hasPadding := decoded[protocol.PSIPHON_API_HANDSHAKE_PADDING]
+
+		if targetLength < len(request)+len(`,"padding":""`) {
+			if hasPadding || len(padded) != len(request) {
+				t.Fatalf("unexpected padding for target length %d", targetLength)
+			}
+		} else if !hasPadding || len(padded) != targetLength {
+			t.Fatalf(
+				"unexpected padded length for target length %d: %d",
+				targetLength, len(padded))
+		}
+	}
+}
+
+func TestRecordFailedTunnelStat(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-failed-tunnel-stat-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	config, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataStoreDirectory = testDataDirName
+
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	serverEntry := &protocol.ServerEntry{Region: "CA"}
+
+	nextError := 0
+
+	recordStats := func(sampleRate float64, maxCount, attempts int) int {
+
+		err := config.SetClientParameters("", true, map[string]interface{}{
+			parameters.EstablishmentTelemetryFailureSampleRate: sampleRate,
+			parameters.EstablishmentTelemetryFailureMaxCount:   maxCount,
+		})
+		if err != nil {
+			t.Fatalf("SetClientParameters failed: %s", err)
+		}
+
+		for i := 0; i < attempts; i++ {
+			dialStats := &DialStats{}
+			dialStats.MeekResolvedIPAddress.Store("")
+			err := recordFailedTunnelStat(
+				config,
+				serverEntry,
+				protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+				dialStats,
+				fmt.Errorf("dial failed: %d", nextError))
+			if err != nil {
+				t.Fatalf("recordFailedTunnelStat failed: %s", err)
+			}
+			nextError++
+		}
+
+		return countBucketKeys(t, datastoreFailedTunnelStatsBucket)
+	}
+
+	clearStats := func() {
+		stats, err := TakeOutUnreportedPersistentStats(1000)
+		if err != nil {
+			t.Fatalf("TakeOutUnreportedPersistentStats failed: %s", err)
+		}
+		err = ClearReportedPersistentStats(stats)
+		if err != nil {
+			t.Fatalf("ClearReportedPersistentStats failed: %s", err)
+		}
+	}
+
+	// A sample rate of 0 records no stats.
+
+	count := recordStats(0.0, 0, 100)
+	if count != 0 {
+		t.Fatalf("unexpected failed tunnel stat count: %d", count)
+	}
+
+	// A sample rate of 1 records every stat, which includes the sample rate.
+
+	count = recordStats(1.0, 0, 10)
+	if count != 10 {
+		t.Fatalf("unexpected failed tunnel stat count: %d", count)
+	}
+
+	stats, err := TakeOutUnreportedPersistentStats(1000)
+	if err != nil {
+		t.Fatalf("TakeOutUnreportedPersistentStats failed: %s", err)
+	}
+	for _, stat := range stats[datastorePersistentStatTypeFailedTunnel] {
+		var params common.APIParameters
+		err := json.Unmarshal(stat, &params)
+		if err != nil {
+			t.Fatalf("Unmarshal failed: %s", err)
+		}
+		if params["establishment_telemetry_sample_rate"] != "1" ||
+			params["relay_protocol"] != protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH ||
+			params["server_entry_region"] != "CA" {
+			t.Fatalf("unexpected failed tunnel stat: %s", string(stat))
+		}
+	}
+	err = ClearReportedPersistentStats(stats)
+	if err != nil {
+		t.Fatalf("ClearReportedPersistentStats failed: %s", err)
+	}
+
+	// A partial sample rate records some, but not all, stats.
+
+	count = recordStats(0.5, 0, 200)
+	if count == 0 || count == 200 {
+		t.Fatalf("unexpected failed tunnel stat count: %d", count)
+	}
+	clearStats()
+
+	// Stored stats are capped, including stats which are being reported,
+	// and new stats may be stored once stats are reported.
+
+	count = recordStats(1.0, 5, 10)
+	if count != 5 {
+		t.Fatalf("unexpected failed tunnel stat count: %d", count)
+	}
+
+	stats, err = TakeOutUnreportedPersistentStats(1000)
+	if err != nil {
+		t.Fatalf("TakeOutUnreportedPersistentStats failed: %s", err)
+	}
+	count = recordStats(1.0, 5, 10)
+	if count != 5 {
+		t.Fatalf("unexpected failed tunnel stat count: %d", count)
+	}
+
+	err = ClearReportedPersistentStats(stats)
+	if err != nil {
+		t.Fatalf("ClearReportedPersistentStats failed: %s", err)
+	}
+	count = recordStats(1.0, 5, 10)
+	if count != 5 {
+		t.Fatalf("unexpected failed tunnel stat count: %d", count)
+	}
+	clearStats()
+	if countBucketKeys(t, datastoreFailedTunnelStatsBucket) != 0 {
+		t.Fatalf("unexpected failed tunnel stats")
+	}
+}
+
+func TestHandleMigrateRequest(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-migrate-request-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	config, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataStoreDirectory = testDataDirName
+
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	drainingIPAddress := "192.0.2.1"
+
+	tunnel := &Tunnel{
+		config:      config,
+		serverEntry: &protocol.ServerEntry{IpAddress: drainingIPAddress},
+	}
+
+	tunnelOwner := &testMigrationTunnelOwner{}
+
+	encodeServerEntry := func(ipAddress string) string {
+		encodedServerEntry, err := protocol.EncodeServerEntry(
+			&protocol.ServerEntry{
+				IpAddress:    ipAddress,
+				SshPort:      22,
+				Capabilities: []string{"SSH"},
+			})
+		if err != nil {
+			t.Fatalf("EncodeServerEntry failed: %s", err)
+		}
+		return encodedServerEntry
+	}
+
+	makePayload := func(deadlineSeconds int, encodedServerList []string) []byte {
+		payload, err := json.Marshal(&protocol.MigrateRequest{
+			DeadlineSeconds:   deadlineSeconds,
+			EncodedServerList: encodedServerList,
+		})
+		if err != nil {
+			t.Fatalf("Marshal failed: %s", err)
+		}
+		return payload
+	}
+
+	checkStored := func(ipAddress string, expectStored bool) {
+		serverEntry, err := getServerEntry(ipAddress)
+		if err != nil {
+			t.Fatalf("getServerEntry failed: %s", err)
+		}
+		if (serverEntry != nil) != expectStored {
+			t.Fatalf("unexpected stored state for %s: %v", ipAddress, serverEntry != nil)
+		}
+	}
+
+	// Malformed payloads and undecodable server entries fail the request,
+	// and the tunnel isn't migrated.
+
+	for _, payload := range [][]byte{
+		[]byte("{"),
+		[]byte(`{"deadline_seconds" : "60"}`),
+		makePayload(60, []string{"invalid"}),
+	} {
+		err = HandleMigrateRequest(tunnelOwner, tunnel, payload)
+		if err == nil {
+			t.Fatalf("unexpected HandleMigrateRequest success: %s", string(payload))
+		}
+	}
+
+	if len(tunnelOwner.migrations) != 0 {
+		t.Fatalf("unexpected migrations: %d", len(tunnelOwner.migrations))
+	}
+
+	// The draining server and invalid server entries are skipped. The
+	// remaining alternates are stored, and the first is promoted.
+
+	err = HandleMigrateRequest(
+		tunnelOwner,
+		tunnel,
+		makePayload(60, []string{
+			encodeServerEntry(drainingIPAddress),
+			encodeServerEntry("invalid"),
+			encodeServerEntry("192.0.2.2"),
+			encodeServerEntry("192.0.2.3"),
+		}))
+	if err != nil {
+		t.Fatalf("HandleMigrateRequest failed: %s", err)
+	}
+
+	checkStored(drainingIPAddress, false)
+	checkStored("192.0.2.2", true)
+	checkStored("192.0.2.3", true)
+
+	affinityServerEntryID, _, err := getServerAffinityState()
+	if err != nil {
+		t.Fatalf("getServerAffinityState failed: %s", err)
+	}
+	if affinityServerEntryID != "192.0.2.2" {
+		t.Fatalf("unexpected server affinity: %s", affinityServerEntryID)
+	}
+
+	if len(tunnelOwner.migrations) != 1 ||
+		tunnelOwner.migrations[0].tunnel != tunnel ||
+		tunnelOwner.migrations[0].deadline != 60*time.Second {
+		t.Fatalf("unexpected migrations: %+v", tunnelOwner.migrations)
+	}
+
+	// A hint with no alternates, or only the draining server, still migrates
+	// the tunnel, and server affinity is unchanged. A zero deadline is passed
+	// through; the controller then uses NetworkChangeHandoffTimeout.
+
+	err = HandleMigrateRequest(
+		tunnelOwner,
+		tunnel,
+		makePayload(0, []string{encodeServerEntry(drainingIPAddress)}))
+	if err != nil {
+		t.Fatalf("HandleMigrateRequest failed: %s", err)
+	}
+
+	checkStored(drainingIPAddress, false)
+
+	affinityServerEntryID, _, err = getServerAffinityState()
+	if err != nil {
+		t.Fatalf("getServerAffinityState failed: %s", err)
+	}
+	if affinityServerEntryID != "192.0.2.2" {
+		t.Fatalf("unexpected server affinity: %s", affinityServerEntryID)
+	}
+
+	if len(tunnelOwner.migrations) != 2 ||
+		tunnelOwner.migrations[1].deadline != 0 {
+		t.Fatalf("unexpected migrations: %+v", tunnelOwner.migrations)
+	}
+}
+
+// testMigrationTunnelOwner is a TunnelOwner which records migration
+// signals.
+type testMigrationTunnelOwner struct {
+	migrations []tunnelMigration
+}
+
+func (owner *testMigrationTunnelOwner) SignalSeededNewSLOK() {
+}
+
+func (owner *testMigrationTunnelOwner) SignalTunnelFailure(tunnel *Tunnel) {
+}
+
+func (owner *testMigrationTunnelOwner) SignalTunnelMigration(
+	tunnel *Tunnel, deadline time.Duration) {
+
+	owner.migrations = append(
+		owner.migrations, tunnelMigration{tunnel: tunnel, deadline: deadline})
+}
@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ServerEntrySource is a pluggable source of server entries, such as a
+// custom server list distribution channel, which embedders register with
+// Controller.RegisterServerEntrySource.
+type ServerEntrySource interface {
+
+	// Name identifies the source. Name is recorded as the local source of
+	// each server entry stored from the source, and so is subject to the
+	// ServerEntryMaxStoredCountPerSource limit. Name must be unique and must
+	// not be one of the built-in protocol.SupportedServerEntrySources.
+	Name() string
+
+	// Priority is used as a tiebreaker when a server entry is provided by
+	// more than one source. A server entry from a higher priority source
+	// replaces a stored entry with the same configuration version from a
+	// lower priority source; otherwise, only newer configuration versions
+	// replace stored entries. The built-in sources have priority 0.
+	Priority() int
+
+	// RefreshPeriod is the period between successful fetches. When 0, the
+	// source is fetched once per Controller run.
+	RefreshPeriod() time.Duration
+
+	// Fetch retrieves the source's current server entries. Fetch should
+	// return promptly when ctx is done.
+	Fetch(ctx context.Context) ([]protocol.ServerEntryFields, error)
+
+	// Verify checks a fetched server entry, for example by checking a
+	// signature, before it's stored. Server entries which fail verification
+	// are skipped.
+	Verify(serverEntryFields protocol.ServerEntryFields) error
+}
+
+// serverEntrySourceManager runs the registered ServerEntrySources, each on
+// its own refresh schedule, and merges the fetched server entries into the
+// data store.
+type serverEntrySourceManager struct {
+	mutex   sync.Mutex
+	sources []ServerEntrySource
+}
+
+func newServerEntrySourceManager() *serverEntrySourceManager {
+	return &serverEntrySourceManager{}
+}
+
+func (manager *serverEntrySourceManager) register(source ServerEntrySource) error {
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	name := source.Name()
+	if name == "" || common.Contains(protocol.SupportedServerEntrySources, name) {
+		return common.ContextError(
+			fmt.Errorf("invalid server entry source name: %s", name))
+	}
+	for _, registeredSource := range manager.sources {
+		if registeredSource.Name() == name {
+			return common.ContextError(
+				fmt.Errorf("duplicate server entry source name: %s", name))
+		}
+	}
+
+	manager.sources = append(manager.sources, source)
+
+	return nil
+}
+
+// getSources returns the registered sources in descending priority order,
+// so that, in each round of fetches, higher priority sources are merged
+// first.
+func (manager *serverEntrySourceManager) getSources() []ServerEntrySource {
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	sources := append([]ServerEntrySource(nil), manager.sources...)
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].Priority() > sources[j].Priority()
+	})
+	return sources
+}
+
+// getPriority returns the priority of the named source. Sources which are
+// not registered, including the built-in sources, have priority 0.
+func (manager *serverEntrySourceManager) getPriority(name string) int {
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for _, source := range manager.sources {
+		if source.Name() == name {
+			return source.Priority()
+		}
+	}
+	return 0
+}
+
+// fetch fetches, verifies, and stores the server entries from source.
+func (manager *serverEntrySourceManager) fetch(
+	ctx context.Context, config *Config, source ServerEntrySource) error {
+
+	serverEntries, err := source.Fetch(ctx)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	name := source.Name()
+	priority := source.Priority()
+	timestamp := common.GetCurrentTimestamp()
+
+	var newServerEntries, replaceServerEntries []protocol.ServerEntryFields
+	rejectedCount := 0
+
+	for _, serverEntryFields := range serverEntries {
+
+		if serverEntryFields == nil ||
+			source.Verify(serverEntryFields) != nil ||
+			protocol.ValidateServerEntryFields(serverEntryFields) != nil {
+
+			rejectedCount += 1
+			continue
+		}
+
+		serverEntryFields.SetLocalSource(name)
+		serverEntryFields.SetLocalTimestamp(timestamp)
+
+		existingServerEntry, err := getServerEntry(serverEntryFields.GetIPAddress())
+		if err != nil {
+			return common.ContextError(err)
+		}
+
+		if existingServerEntry != nil &&
+			existingServerEntry.ConfigurationVersion == serverEntryFields.GetConfigurationVersion() &&
+			manager.getPriority(existingServerEntry.LocalSource) < priority {
+
+			replaceServerEntries = append(replaceServerEntries, serverEntryFields)
+		} else {
+			newServerEntries = append(newServerEntries, serverEntryFields)
+		}
+	}
+
+	if rejectedCount > 0 {
+		NoticeAlert("server entry source %s: rejected %d server entries", name, rejectedCount)
+	}
+
+	err = StoreServerEntries(config, newServerEntries, false)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = StoreServerEntries(config, replaceServerEntries, true)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// RegisterServerEntrySource registers a ServerEntrySource, which is fetched
+// on its own refresh schedule while the Controller runs. Sources must be
+// registered before calling Run; sources registered while the Controller is
+// running are not fetched until the next Run.
+func (controller *Controller) RegisterServerEntrySource(source ServerEntrySource) error {
+
+	err := controller.serverEntrySourceManager.register(source)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
+// serverEntrySourceFetcher fetches source immediately and then once every
+// RefreshPeriod. Failed fetches are retried after
+// FetchRemoteServerListRetryPeriod.
+func (controller *Controller) serverEntrySourceFetcher(source ServerEntrySource) {
+
+	defer controller.runWaitGroup.Done()
+
+	name := source.Name()
+
+fetcherLoop:
+	for {
+		// Don't attempt to fetch while there is no network connectivity,
+		// to avoid alert notice noise.
+		if !WaitForNetworkConnectivity(
+			controller.runCtx,
+			controller.config.NetworkConnectivityChecker) {
+			break fetcherLoop
+		}
+
+		var waitPeriod time.Duration
+
+		err := controller.serverEntrySourceManager.fetch(
+			controller.runCtx, controller.config, source)
+		if err == nil {
+			waitPeriod = source.RefreshPeriod()
+			if waitPeriod <= 0 {
+				break fetcherLoop
+			}
+		} else {
+			NoticeAlert("failed to fetch server entry source %s: %s", name, err)
+			waitPeriod = controller.config.GetClientParameters().Duration(
+				parameters.FetchRemoteServerListRetryPeriod)
+		}
+
+		timer := time.NewTimer(waitPeriod)
+		select {
+		case <-timer.C:
+		case <-controller.runCtx.Done():
+			timer.Stop()
+			break fetcherLoop
+		}
+	}
+
+	NoticeInfo("exiting server entry source %s fetcher", name)
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+type testServerEntrySource struct {
+	name          string
+	priority      int
+	serverEntries []protocol.ServerEntryFields
+}
+
+func (source *testServerEntrySource) Name() string {
+	return source.name
+}
+
+func (source *testServerEntrySource) Priority() int {
+	return source.priority
+}
+
+func (source *testServerEntrySource) RefreshPeriod() time.Duration {
+	return 0
+}
+
+func (source *testServerEntrySource) Fetch(
+	_ context.Context) ([]protocol.ServerEntryFields, error) {
+
+	// Return copies, as stored server entries are modified.
+	serverEntries := make([]protocol.ServerEntryFields, len(source.serverEntries))
+	for i, serverEntryFields := range source.serverEntries {
+		serverEntries[i] = make(protocol.ServerEntryFields)
+		for name, value := range serverEntryFields {
+			serverEntries[i][name] = value
+		}
+	}
+	return serverEntries, nil
+}
+
+func (source *testServerEntrySource) Verify(
+	serverEntryFields protocol.ServerEntryFields) error {
+
+	if serverEntryFields["region"] == "XX" {
+		return errors.New("unverified")
+	}
+	return nil
+}
+
+func TestServerEntrySources(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-entry-source-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	config, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	config.DataStoreDirectory = testDataDirName
+
+	err = config.Commit()
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	makeServerEntry := func(i int, region string) protocol.ServerEntryFields {
+		return protocol.ServerEntryFields{
+			"ipAddress":    testServerEntryIPAddress(i),
+			"sshPort":      22.0,
+			"capabilities": []interface{}{"SSH"},
+			"region":       region,
+		}
+	}
+
+	lowSource := &testServerEntrySource{
+		name:     "low",
+		priority: 1,
+		serverEntries: []protocol.ServerEntryFields{
+			makeServerEntry(0, "CA"),
+			makeServerEntry(1, "CA"),
+			makeServerEntry(2, "XX"),
+		},
+	}
+
+	highSource := &testServerEntrySource{
+		name:     "high",
+		priority: 2,
+		serverEntries: []protocol.ServerEntryFields{
+			makeServerEntry(1, "US"),
+		},
+	}
+
+	manager := newServerEntrySourceManager()
+
+	for _, source := range []ServerEntrySource{
+		lowSource,
+		highSource,
+		&testServerEntrySource{name: ""},
+		&testServerEntrySource{name: protocol.SERVER_ENTRY_SOURCE_REMOTE},
+		&testServerEntrySource{name: "low"},
+	} {
+		err := manager.register(source)
+		expectError := source != lowSource && source != highSource
+		if (err != nil) != expectError {
+			t.Fatalf("unexpected register result for %s: %v", source.Name(), err)
+		}
+	}
+
+	sources := manager.getSources()
+	if len(sources) != 2 || sources[0] != highSource || sources[1] != lowSource {
+		t.Fatalf("unexpected sources order")
+	}
+
+	checkServerEntry := func(i int, expectedSource, expectedRegion string) {
+		serverEntry, err := getServerEntry(testServerEntryIPAddress(i))
+		if err != nil {
+			t.Fatalf("getServerEntry failed: %s", err)
+		}
+		if expectedSource == "" {
+			if serverEntry != nil {
+				t.Fatalf("unexpected server entry %d", i)
+			}
+			return
+		}
+		if serverEntry == nil ||
+			serverEntry.LocalSource != expectedSource ||
+			serverEntry.Region != expectedRegion {
+
+			t.Fatalf("unexpected server entry %d: %+v", i, serverEntry)
+		}
+	}
+
+	// Unverified server entries are skipped.
+
+	err = manager.fetch(context.Background(), config, lowSource)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkServerEntry(0, "low", "CA")
+	checkServerEntry(1, "low", "CA")
+	checkServerEntry(2, "", "")
+
+	// The higher priority source replaces the same server entry version.
+
+	err = manager.fetch(context.Background(), config, highSource)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkServerEntry(1, "high", "US")
+
+	// The lower priority source doesn't replace the same server entry
+	// version.
+
+	err = manager.fetch(context.Background(), config, lowSource)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkServerEntry(0, "low", "CA")
+	checkServerEntry(1, "high", "US")
+
+	// A newer server entry version replaces the stored entry, regardless of
+	// priority.
+
+	lowSource.serverEntries[1]["configurationVersion"] = 1.0
+	err = manager.fetch(context.Background(), config, lowSource)
+	if err != nil {
+		t.Fatalf("fetch failed: %s", err)
+	}
+	checkServerEntry(1, "low", "CA")
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// ApplyServerListDiff updates the server list stored in serverListFilename,
+// typically the embedded server list, by applying signedDiff, a signed
+// binary diff created with common.WriteServerListDiff and downloaded
+// out-of-band. This allows an app to update its server list without
+// shipping the full list.
+//
+// The diff is verified using RemoteServerListSignaturePublicKey, and the
+// resulting server list is verified against the signed result digest and
+// must decode as a valid server entry list. The existing server list file
+// is replaced only when all checks pass; the replacement is atomic, so a
+// corrupt or mis-applied diff leaves the existing server list intact.
+//
+// The updated server list is imported into the datastore as usual, the next
+// time the embedded server list is stored.
+func ApplyServerListDiff(config *Config, serverListFilename string, signedDiff []byte) error {
+
+	if config.RemoteServerListSignaturePublicKey == "" {
+		return common.ContextError(errors.New("missing RemoteServerListSignaturePublicKey"))
+	}
+
+	baseServerList, err := ioutil.ReadFile(serverListFilename)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	serverList, err := common.ApplyServerListDiff(
+		baseServerList, signedDiff, config.RemoteServerListSignaturePublicKey)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	_, err = protocol.DecodeServerEntryList(
+		string(serverList),
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	// Write to a temporary file in the same directory, so the final rename
+	// is atomic.
+
+	file, err := ioutil.TempFile(
+		filepath.Dir(serverListFilename), filepath.Base(serverListFilename)+".diff")
+	if err != nil {
+		return common.ContextError(err)
+	}
+	tempFilename := file.Name()
+
+	_, err = file.Write(serverList)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFilename, serverListFilename)
+	}
+	if err != nil {
+		os.Remove(tempFilename)
+		return common.ContextError(err)
+	}
+
+	NoticeInfo("applied server list diff to %s", serverListFilename)
+
+	return nil
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	SERVER_SCORE_NEUTRAL_SUCCESS_RATE = 0.5
+	SERVER_SCORE_PRUNE_DECAY          = 0.01
+)
+
+// serverScores weights server selection toward servers which have
+// historically connected reliably and quickly.
+//
+// Each server's score combines exponential moving averages of its tunnel
+// connection success rate and its connection latency, the time taken to
+// dial and complete the tunnel handshakes. Each new outcome is weighted by
+// ServerScoreSmoothingFactor. The score is the success rate multiplied by a
+// latency factor which is 1 at ServerScoreTargetLatency, greater for lower
+// latencies, and smaller for higher latencies.
+//
+// Scores are persisted in the datastore, so they apply across restarts.
+// Over time, a score decays toward the neutral score of a server with no
+// recorded outcomes, halving its distance from neutral every
+// ServerScoreDecayHalfLife, so that stale scores don't dominate. Fully
+// decayed scores are pruned.
+//
+// Scores are applied by ServerEntryIterator, which orders server entries
+// with a weighted random shuffle instead of a uniform shuffle. Each server's
+// weight is ServerScoreExplorationWeight plus its score, so servers with
+// low scores, and servers which have never been tried, continue to be
+// selected, with reduced or neutral probability.
+type serverScores struct {
+	smoothingFactor   float64
+	decayHalfLife     time.Duration
+	targetLatency     time.Duration
+	explorationWeight float64
+}
+
+// serverScoreState is the persisted score state for a single server. A wall
+// clock time is used as the state is persisted across restarts.
+type serverScoreState struct {
+	SuccessRate float64       `json:"successRate"`
+	Latency     time.Duration `json:"latency"`
+	UpdateTime  time.Time     `json:"updateTime"`
+}
+
+// newServerScores initializes server scoring with the current client
+// parameters. nil is returned when server scoring is disabled.
+func newServerScores(config *Config) *serverScores {
+
+	p := config.clientParameters.Get()
+
+	scores := &serverScores{
+		smoothingFactor:   p.Float(parameters.ServerScoreSmoothingFactor),
+		decayHalfLife:     p.Duration(parameters.ServerScoreDecayHalfLife),
+		targetLatency:     p.Duration(parameters.ServerScoreTargetLatency),
+		explorationWeight: p.Float(parameters.ServerScoreExplorationWeight),
+	}
+
+	if scores.smoothingFactor <= 0.0 {
+		return nil
+	}
+	if scores.smoothingFactor > 1.0 {
+		scores.smoothingFactor = 1.0
+	}
+
+	return scores
+}
+
+// neutralState returns the state of a server with no recorded outcomes.
+func (scores *serverScores) neutralState() *serverScoreState {
+	return &serverScoreState{
+		SuccessRate: SERVER_SCORE_NEUTRAL_SUCCESS_RATE,
+		Latency:     scores.targetLatency,
+	}
+}
+
+// decay returns the fraction, from 1 to 0, of the state's distance from the
+// neutral state which remains at the specified time.
+func (scores *serverScores) decay(state *serverScoreState, now time.Time) float64 {
+	if scores.decayHalfLife <= 0 {
+		return 1.0
+	}
+	age := now.Sub(state.UpdateTime)
+	if age <= 0 {
+		return 1.0
+	}
+	return math.Exp2(-float64(age) / float64(scores.decayHalfLife))
+}
+
+// decayedState returns the state as decayed at the specified time.
+func (scores *serverScores) decayedState(
+	state *serverScoreState, now time.Time) *serverScoreState {
+
+	decay := scores.decay(state, now)
+	neutral := scores.neutralState()
+
+	return &serverScoreState{
+		SuccessRate: neutral.SuccessRate +
+			(state.SuccessRate-neutral.SuccessRate)*decay,
+		Latency: neutral.Latency +
+			time.Duration(float64(state.Latency-neutral.Latency)*decay),
+		UpdateTime: now,
+	}
+}
+
+// score returns the score for the specified state.
+func (scores *serverScores) score(state *serverScoreState) float64 {
+	latency := state.Latency
+	if latency < 0 {
+		latency = 0
+	}
+	latencyFactor := 2 * float64(scores.targetLatency) /
+		float64(scores.targetLatency+latency)
+	return state.SuccessRate * latencyFactor
+}
+
+// weight returns the selection weight for a server with the specified
+// score.
+func (scores *serverScores) weight(score float64) float64 {
+	return scores.explorationWeight + score
+}
+
+// recordOutcome updates the score of the specified server with the outcome
+// of a tunnel connection. latency is ignored for failed connections.
+func (scores *serverScores) recordOutcome(
+	serverEntryID string, success bool, latency time.Duration) {
+
+	if scores == nil {
+		return
+	}
+
+	now := time.Now()
+
+	state := scores.neutralState()
+
+	record, err := getServerScoreRecord(serverEntryID)
+	if err != nil {
+		NoticeAlert("getServerScoreRecord failed: %s", err)
+	} else if record != nil {
+		var storedState *serverScoreState
+		err = json.Unmarshal(record, &storedState)
+		if err != nil {
+			NoticeAlert("invalid server score record: %s", common.ContextError(err))
+		} else {
+			state = scores.decayedState(storedState, now)
+		}
+	}
+
+	outcome := 0.0
+	if success {
+		outcome = 1.0
+		state.Latency = time.Duration(
+			scores.smoothingFactor*float64(latency) +
+				(1.0-scores.smoothingFactor)*float64(state.Latency))
+	}
+	state.SuccessRate =
+		scores.smoothingFactor*outcome +
+			(1.0-scores.smoothingFactor)*state.SuccessRate
+	state.UpdateTime = now
+
+	record, err = json.Marshal(state)
+	if err != nil {
+		NoticeAlert("marshal server score record failed: %s", common.ContextError(err))
+		return
+	}
+
+	err = setServerScoreRecord(serverEntryID, record)
+	if err != nil {
+		NoticeAlert("setServerScoreRecord failed: %s", err)
+	}
+}
+
+// loadWeights returns the current selection weights of all servers with
+// recorded scores, keyed by server entry ID. Fully decayed scores are
+// pruned from the datastore.
+func (scores *serverScores) loadWeights() (map[string]float64, error) {
+
+	records, err := getServerScoreRecords()
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	now := time.Now()
+
+	weights := make(map[string]float64)
+	var prunedServerEntryIDs []string
+
+	for serverEntryID, record := range records {
+
+		var state *serverScoreState
+		err := json.Unmarshal(record, &state)
+		if err != nil || scores.decay(state, now) < SERVER_SCORE_PRUNE_DECAY {
+			prunedServerEntryIDs = append(prunedServerEntryIDs, serverEntryID)
+			continue
+		}
+
+		weights[serverEntryID] = scores.weight(
+			scores.score(scores.decayedState(state, now)))
+	}
+
+	if len(prunedServerEntryIDs) > 0 {
+		err = deleteServerScoreRecords(prunedServerEntryIDs)
+		if err != nil {
+			NoticeAlert("deleteServerScoreRecords failed: %s", err)
+		}
+	}
+
+	return weights, nil
+}
+
+// weightedShuffle orders the server entry IDs with a weighted random
+// shuffle, in which each server entry precedes the remaining server entries
+// with a probability proportional to its weight. Server entries without
+// weights receive the weight of a server with the neutral score.
+func (scores *serverScores) weightedShuffle(
+	serverEntryIDs [][]byte, weights map[string]float64) {
+
+	neutralWeight := scores.weight(scores.score(scores.neutralState()))
+
+	// Each server entry is assigned a random key, exponentially distributed
+	// with a rate equal to its weight, and the server entries are sorted by
+	// ascending key. This is equivalent to repeatedly selecting the next
+	// server entry with probability proportional to weight.
+
+	keys := make([]float64, len(serverEntryIDs))
+	for i, serverEntryID := range serverEntryIDs {
+		weight, ok := weights[string(serverEntryID)]
+		if !ok {
+			weight = neutralWeight
+		}
+		if weight <= 0.0 {
+			keys[i] = math.Inf(1)
+			continue
+		}
+		keys[i] = rand.ExpFloat64() / weight
+	}
+
+	sort.Sort(&weightedServerEntryIDs{ids: serverEntryIDs, keys: keys})
+}
+
+type weightedServerEntryIDs struct {
+	ids  [][]byte
+	keys []float64
+}
+
+func (w *weightedServerEntryIDs) Len() int {
+	return len(w.ids)
+}
+
+func (w *weightedServerEntryIDs) Less(i, j int) bool {
+	return w.keys[i] < w.keys[j]
+}
+
+func (w *weightedServerEntryIDs) Swap(i, j int) {
+	w.ids[i], w.ids[j] = w.ids[j], w.ids[i]
+	w.keys[i], w.keys[j] = w.keys[j], w.keys[i]
+}
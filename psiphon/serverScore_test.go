@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestServerScores(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-server-scores-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataStoreDirectory = testDataDirName
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	// Scoring is disabled by default.
+
+	if newServerScores(clientConfig) != nil {
+		t.Fatalf("unexpected server scores")
+	}
+
+	applyParameters := make(map[string]interface{})
+	applyParameters[parameters.ServerScoreSmoothingFactor] = 0.5
+	applyParameters[parameters.ServerScoreDecayHalfLife] = "1h"
+	applyParameters[parameters.ServerScoreTargetLatency] = "1s"
+	applyParameters[parameters.ServerScoreExplorationWeight] = 0.1
+
+	err = clientConfig.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		t.Fatalf("error setting client parameters: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	scores := newServerScores(clientConfig)
+	if scores == nil {
+		t.Fatalf("missing server scores")
+	}
+
+	neutralWeight := scores.weight(scores.score(scores.neutralState()))
+
+	// Fast successes raise a server's weight above neutral; failures lower a
+	// server's weight below neutral, but not below the exploration weight.
+
+	goodServer := "192.168.0.1"
+	badServer := "192.168.0.2"
+	staleServer := "192.168.0.3"
+
+	for i := 0; i < 5; i++ {
+		scores.recordOutcome(goodServer, true, 100*time.Millisecond)
+		scores.recordOutcome(badServer, false, 0)
+	}
+
+	// Scores persist in the datastore; a score last updated 20 half lives
+	// ago is fully decayed and pruned.
+
+	record, err := json.Marshal(&serverScoreState{
+		SuccessRate: 0.0,
+		Latency:     time.Minute,
+		UpdateTime:  time.Now().Add(-20 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	err = setServerScoreRecord(staleServer, record)
+	if err != nil {
+		t.Fatalf("setServerScoreRecord failed: %s", err)
+	}
+
+	weights, err := newServerScores(clientConfig).loadWeights()
+	if err != nil {
+		t.Fatalf("loadWeights failed: %s", err)
+	}
+
+	if len(weights) != 2 {
+		t.Fatalf("unexpected weights: %+v", weights)
+	}
+	if weights[goodServer] <= neutralWeight {
+		t.Fatalf("unexpected good server weight: %f", weights[goodServer])
+	}
+	if weights[badServer] >= neutralWeight || weights[badServer] < 0.1 {
+		t.Fatalf("unexpected bad server weight: %f", weights[badServer])
+	}
+
+	record, err = getServerScoreRecord(staleServer)
+	if err != nil || record != nil {
+		t.Fatalf("unexpected stale server record: %v", err)
+	}
+
+	// Decay moves scores toward neutral.
+
+	state := &serverScoreState{
+		SuccessRate: 1.0,
+		Latency:     0,
+		UpdateTime:  time.Now().Add(-1 * time.Hour),
+	}
+	decayedState := scores.decayedState(state, time.Now())
+	if decayedState.SuccessRate < 0.74 || decayedState.SuccessRate > 0.76 {
+		t.Fatalf("unexpected decayed success rate: %f", decayedState.SuccessRate)
+	}
+
+	// The weighted shuffle favors higher weights while still selecting
+	// lower weights first some of the time.
+
+	serverEntryIDs := [][]byte{[]byte(badServer), []byte(goodServer)}
+	goodFirst := 0
+	trials := 1000
+	for i := 0; i < trials; i++ {
+		scores.weightedShuffle(serverEntryIDs, weights)
+		if string(serverEntryIDs[0]) == goodServer {
+			goodFirst += 1
+		}
+	}
+	if goodFirst < trials/2 || goodFirst == trials {
+		t.Fatalf("unexpected good server first count: %d", goodFirst)
+	}
+}
@@ -20,7 +20,8 @@
 package psiphon
 
 import (
-	"fmt"
+	"crypto/subtle"
+	"errors"
 	"net"
 	"strings"
 	"sync"
@@ -51,14 +52,26 @@ func NewSocksProxy(
 	tunneler Tunneler,
 	listenIP string) (proxy *SocksProxy, err error) {
 
-	listener, err := socks.ListenSocks(
-		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalSocksProxyPort))
+	netListener, err := listenLocalProxy(
+		listenIP, config.LocalSocksProxyPort, config.LocalSocksProxyUnixSocketPath)
 	if err != nil {
-		if IsAddressInUseError(err) {
-			NoticeSocksProxyPortInUse(config.LocalSocksProxyPort)
+		if isLocalProxyAddressInUse(err) {
+			if config.LocalSocksProxyUnixSocketPath != "" {
+				NoticeSocksProxyUnixSocketInUse(config.LocalSocksProxyUnixSocketPath)
+			} else {
+				NoticeSocksProxyPortInUse(config.LocalSocksProxyPort)
+			}
 		}
 		return nil, common.ContextError(err)
 	}
+
+	listener := socks.NewSocksListener(netListener)
+
+	if config.LocalSocksProxyUsername != "" {
+		listener.ValidateCredentials = makeSocksCredentialsValidator(
+			config.LocalSocksProxyUsername, config.LocalSocksProxyPassword)
+	}
+
 	proxy = &SocksProxy{
 		tunneler:               tunneler,
 		listener:               listener,
@@ -68,10 +81,29 @@ func NewSocksProxy(
 	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
-	NoticeListeningSocksProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
+	if config.LocalSocksProxyUnixSocketPath != "" {
+		NoticeListeningSocksProxyUnixSocket(config.LocalSocksProxyUnixSocketPath)
+	} else {
+		NoticeListeningSocksProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
+	}
 	return proxy, nil
 }
 
+// makeSocksCredentialsValidator returns a function which checks SOCKS
+// client credentials against the specified username and password. The
+// comparisons are constant time.
+func makeSocksCredentialsValidator(
+	username, password string) func(string, string) bool {
+
+	return func(clientUsername, clientPassword string) bool {
+		usernameOK := subtle.ConstantTimeCompare(
+			[]byte(clientUsername), []byte(username)) == 1
+		passwordOK := subtle.ConstantTimeCompare(
+			[]byte(clientPassword), []byte(password)) == 1
+		return usernameOK && passwordOK
+	}
+}
+
 // Close terminates the listener and waits for the accept loop
 // goroutine to complete.
 func (proxy *SocksProxy) Close() {
@@ -87,6 +119,12 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 
 	proxy.openConns.Add(localConn)
 
+	err = checkSocksTarget(localConn.Req.Target)
+	if err != nil {
+		_ = localConn.RejectReason(byte(socks.SocksRepAddressNotSupported))
+		return common.ContextError(err)
+	}
+
 	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
@@ -117,6 +155,23 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 	return nil
 }
 
+// checkSocksTarget checks that a SOCKS request target is tunnelable. IPv6
+// literals, which are bracketed in the target, may not specify a zone, as
+// zones are local to the client host and meaningless to the server.
+func checkSocksTarget(target string) error {
+
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	if strings.Contains(host, "%") {
+		return common.ContextError(errors.New("IPv6 zone is not supported"))
+	}
+
+	return nil
+}
+
 func (proxy *SocksProxy) serve() {
 	defer proxy.listener.Close()
 	defer proxy.serveWaitGroup.Done()
@@ -0,0 +1,340 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+type testDirectTunneler struct {
+}
+
+func (tunneler *testDirectTunneler) Dial(
+	remoteAddr string, _ bool, _ net.Conn) (net.Conn, error) {
+	return net.Dial("tcp", remoteAddr)
+}
+
+func (tunneler *testDirectTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return net.Dial("tcp", remoteAddr)
+}
+
+func (tunneler *testDirectTunneler) SignalComponentFailure() {
+}
+
+func TestSocksProxyAuthentication(t *testing.T) {
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer echoListener.Close()
+
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	config := &Config{
+		LocalSocksProxyUsername: "username",
+		LocalSocksProxyPassword: "password",
+	}
+
+	socksProxy, err := NewSocksProxy(config, &testDirectTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer socksProxy.Close()
+
+	socksProxyAddress := fmt.Sprintf(
+		"127.0.0.1:%d", socksProxy.listener.Addr().(*net.TCPAddr).Port)
+
+	testCases := []struct {
+		description   string
+		auth          *proxy.Auth
+		expectSuccess bool
+	}{
+		{"valid credentials", &proxy.Auth{User: "username", Password: "password"}, true},
+		{"invalid password", &proxy.Auth{User: "username", Password: "invalid"}, false},
+		{"invalid username", &proxy.Auth{User: "invalid", Password: "password"}, false},
+		{"no credentials", nil, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			dialer, err := proxy.SOCKS5("tcp", socksProxyAddress, testCase.auth, proxy.Direct)
+			if err != nil {
+				t.Fatalf("SOCKS5 failed: %s", err)
+			}
+
+			conn, err := dialer.Dial("tcp", echoListener.Addr().String())
+			if err != nil {
+				if testCase.expectSuccess {
+					t.Fatalf("Dial failed: %s", err)
+				}
+				return
+			}
+			defer conn.Close()
+
+			if !testCase.expectSuccess {
+				t.Fatalf("Dial unexpectedly succeeded")
+			}
+
+			message := []byte("test")
+			_, err = conn.Write(message)
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+			response := make([]byte, len(message))
+			_, err = io.ReadFull(conn, response)
+			if err != nil {
+				t.Fatalf("ReadFull failed: %s", err)
+			}
+			if string(response) != string(message) {
+				t.Fatalf("unexpected response: %s", response)
+			}
+		})
+	}
+}
+
+func TestSocksProxyUnixSocket(t *testing.T) {
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer echoListener.Close()
+
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	testDirectory, err := ioutil.TempDir("", "psiphon-socks-proxy-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDirectory)
+
+	config := &Config{
+		LocalSocksProxyUnixSocketPath: filepath.Join(testDirectory, "socks.sock"),
+	}
+
+	// Create a stale socket file, which is replaced.
+
+	staleListener, err := net.Listen("unix", config.LocalSocksProxyUnixSocketPath)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	staleListener.(*net.UnixListener).SetUnlinkOnClose(false)
+	staleListener.Close()
+
+	socksProxy, err := NewSocksProxy(config, &testDirectTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+
+	fileInfo, err := os.Stat(config.LocalSocksProxyUnixSocketPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if fileInfo.Mode().Perm() != LOCAL_PROXY_UNIX_SOCKET_PERMISSIONS {
+		t.Fatalf("unexpected socket permissions: %s", fileInfo.Mode())
+	}
+
+	// A socket in use is not replaced.
+
+	_, err = NewSocksProxy(config, &testDirectTunneler{}, "127.0.0.1")
+	if err == nil {
+		t.Fatalf("NewSocksProxy unexpectedly succeeded")
+	}
+
+	dialer, err := proxy.SOCKS5("unix", config.LocalSocksProxyUnixSocketPath, nil, proxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5 failed: %s", err)
+	}
+
+	conn, err := dialer.Dial("tcp", echoListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	message := []byte("test")
+	_, err = conn.Write(message)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	response := make([]byte, len(message))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+	if string(response) != string(message) {
+		t.Fatalf("unexpected response: %s", response)
+	}
+	conn.Close()
+
+	socksProxy.Close()
+
+	_, err = os.Stat(config.LocalSocksProxyUnixSocketPath)
+	if !os.IsNotExist(err) {
+		t.Fatalf("unexpected socket file after Close: %v", err)
+	}
+}
+
+type testRecordingTunneler struct {
+	mutex   sync.Mutex
+	targets []string
+}
+
+func (tunneler *testRecordingTunneler) Dial(
+	remoteAddr string, _ bool, _ net.Conn) (net.Conn, error) {
+
+	tunneler.mutex.Lock()
+	tunneler.targets = append(tunneler.targets, remoteAddr)
+	tunneler.mutex.Unlock()
+	return nil, errors.New("ssh: rejected")
+}
+
+func (tunneler *testRecordingTunneler) DirectDial(string) (net.Conn, error) {
+	return nil, errors.New("unexpected direct dial")
+}
+
+func (tunneler *testRecordingTunneler) SignalComponentFailure() {
+}
+
+func TestSocksProxyIPv6Literals(t *testing.T) {
+
+	tunneler := &testRecordingTunneler{}
+
+	socksProxy, err := NewSocksProxy(&Config{}, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer socksProxy.Close()
+
+	socksProxyAddress := fmt.Sprintf(
+		"127.0.0.1:%d", socksProxy.listener.Addr().(*net.TCPAddr).Port)
+
+	ipv6Address := net.ParseIP("2001:db8::1")
+
+	domainName := func(name string) []byte {
+		return append([]byte{0x03, byte(len(name))}, []byte(name)...)
+	}
+
+	testCases := []struct {
+		description    string
+		address        []byte
+		expectedTarget string
+		expectedReply  byte
+	}{
+		{"IPv6 address", append([]byte{0x04}, ipv6Address...), "[2001:db8::1]:443", 0x05},
+		{"IPv6 literal domain", domainName("2001:db8::1"), "[2001:db8::1]:443", 0x05},
+		{"bracketed IPv6 literal domain", domainName("[2001:db8::1]"), "[2001:db8::1]:443", 0x05},
+		{"IPv4 address", []byte{0x01, 192, 0, 2, 1}, "192.0.2.1:443", 0x05},
+		{"domain", domainName("example.com"), "example.com:443", 0x05},
+		{"IPv6 literal domain with zone", domainName("fe80::1%eth0"), "", 0x08},
+		{"bracketed IPv6 literal domain with zone", domainName("[fe80::1%eth0]"), "", 0x08},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			tunneler.mutex.Lock()
+			tunneler.targets = nil
+			tunneler.mutex.Unlock()
+
+			conn, err := net.Dial("tcp", socksProxyAddress)
+			if err != nil {
+				t.Fatalf("Dial failed: %s", err)
+			}
+			defer conn.Close()
+
+			// SOCKS5 method negotiation, with no authentication.
+
+			_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+			methodReply := make([]byte, 2)
+			_, err = io.ReadFull(conn, methodReply)
+			if err != nil {
+				t.Fatalf("ReadFull failed: %s", err)
+			}
+			if !bytes.Equal(methodReply, []byte{0x05, 0x00}) {
+				t.Fatalf("unexpected method reply: %x", methodReply)
+			}
+
+			request := append([]byte{0x05, 0x01, 0x00}, testCase.address...)
+			request = append(request, 0x01, 0xbb)
+			_, err = conn.Write(request)
+			if err != nil {
+				t.Fatalf("Write failed: %s", err)
+			}
+			reply := make([]byte, 2)
+			_, err = io.ReadFull(conn, reply)
+			if err != nil {
+				t.Fatalf("ReadFull failed: %s", err)
+			}
+			if reply[1] != testCase.expectedReply {
+				t.Fatalf("unexpected reply: %x", reply)
+			}
+
+			tunneler.mutex.Lock()
+			targets := tunneler.targets
+			tunneler.mutex.Unlock()
+
+			if testCase.expectedTarget == "" {
+				if len(targets) != 0 {
+					t.Fatalf("unexpected dial: %+v", targets)
+				}
+			} else if len(targets) != 1 || targets[0] != testCase.expectedTarget {
+				t.Fatalf("unexpected targets: %+v", targets)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+const (
+	SOURCE_PORT_POLICY_OS_DEFAULT          = "OSDefault"
+	SOURCE_PORT_POLICY_FRESH               = "Fresh"
+	SOURCE_PORT_POLICY_REUSE_WITHIN_WINDOW = "ReuseWithinWindow"
+
+	// SOURCE_PORT_FRESH_MIN and SOURCE_PORT_FRESH_MAX are the IANA dynamic
+	// port range, from which SOURCE_PORT_POLICY_FRESH selects ports when no
+	// source port range is configured.
+	SOURCE_PORT_FRESH_MIN = 49152
+	SOURCE_PORT_FRESH_MAX = 65535
+
+	// SOURCE_PORT_HISTORY_MAX_ENTRIES bounds the recorded source ports, and
+	// so the number of ports SOURCE_PORT_POLICY_FRESH may exclude.
+	SOURCE_PORT_HISTORY_MAX_ENTRIES = 1024
+)
+
+// sourcePortHistory records the local source ports of recent TCP dials, for
+// the DialConfig.SourcePortPolicy source port reuse policies:
+//
+// SOURCE_PORT_POLICY_OS_DEFAULT, the default, leaves source port selection
+// to the platform, or to the random DialConfig.SourcePortMin/Max selection,
+// and records nothing.
+//
+// SOURCE_PORT_POLICY_FRESH never reuses, for any destination, a source port
+// used within the window. This prevents a reconnection from being
+// correlated with a previous connection by source port. Excluded ports are
+// bounded by SOURCE_PORT_HISTORY_MAX_ENTRIES, and when no fresh port can be
+// bound the dial falls back to an ephemeral port, so that the policy can't
+// exhaust the port range on high-churn networks.
+//
+// SOURCE_PORT_POLICY_REUSE_WITHIN_WINDOW reuses the source port of the
+// previous connection to the same destination, when made within the
+// window. This limits port consumption on high-churn networks, at the cost
+// of making reconnections easier to correlate.
+type sourcePortHistory struct {
+	mutex        sync.Mutex
+	destinations map[string]sourcePortUse
+	ports        map[int]monotime.Time
+}
+
+type sourcePortUse struct {
+	port int
+	time monotime.Time
+}
+
+func newSourcePortHistory() *sourcePortHistory {
+	return &sourcePortHistory{
+		destinations: make(map[string]sourcePortUse),
+		ports:        make(map[int]monotime.Time),
+	}
+}
+
+// getReusablePort returns the source port used for the most recent
+// connection to remoteAddr, when made within the window.
+func (history *sourcePortHistory) getReusablePort(
+	remoteAddr string, window time.Duration) (int, bool) {
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	use, ok := history.destinations[remoteAddr]
+	if !ok || monotime.Since(use.time) > window {
+		return 0, false
+	}
+	return use.port, true
+}
+
+// isRecentlyUsed indicates whether port was used, for any destination,
+// within the window.
+func (history *sourcePortHistory) isRecentlyUsed(port int, window time.Duration) bool {
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	lastUsed, ok := history.ports[port]
+	return ok && monotime.Since(lastUsed) <= window
+}
+
+// record records that port was used for a connection to remoteAddr.
+// Entries older than the window are discarded when the history is full.
+func (history *sourcePortHistory) record(
+	remoteAddr string, port int, window time.Duration) {
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if len(history.destinations) >= SOURCE_PORT_HISTORY_MAX_ENTRIES ||
+		len(history.ports) >= SOURCE_PORT_HISTORY_MAX_ENTRIES {
+
+		history.prune(window)
+	}
+
+	now := monotime.Now()
+	history.destinations[remoteAddr] = sourcePortUse{port: port, time: now}
+	history.ports[port] = now
+}
+
+// forget discards the source port recorded for remoteAddr, so that it's
+// not reused.
+func (history *sourcePortHistory) forget(remoteAddr string) {
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	delete(history.destinations, remoteAddr)
+}
+
+// prune discards entries older than the window. When all entries are
+// within the window, all entries are discarded, bounding the history. The
+// caller must lock the mutex.
+func (history *sourcePortHistory) prune(window time.Duration) {
+
+	for remoteAddr, use := range history.destinations {
+		if monotime.Since(use.time) > window {
+			delete(history.destinations, remoteAddr)
+		}
+	}
+	for port, lastUsed := range history.ports {
+		if monotime.Since(lastUsed) > window {
+			delete(history.ports, port)
+		}
+	}
+
+	if len(history.destinations) >= SOURCE_PORT_HISTORY_MAX_ENTRIES ||
+		len(history.ports) >= SOURCE_PORT_HISTORY_MAX_ENTRIES {
+
+		history.destinations = make(map[string]sourcePortUse)
+		history.ports = make(map[int]monotime.Time)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// suspectedBlocking detects establishment failure patterns which suggest
+// active blocking, as opposed to local network loss, and selects an
+// extended pause before the next establishment round. Repeatedly
+// reconnecting while actively blocked wastes resources and may attract
+// further blocking.
+//
+// Blocking is suspected when many connection attempts, across several
+// tunnel protocols, fail quickly with errors indicating the connection was
+// interfered with: connection resets and refusals and TLS, SSH, and
+// handshake failures. Failures indicating network loss, such as DNS
+// failures, unreachable networks, and timeouts, aren't counted and clear
+// any recorded failures, as does a success.
+//
+// As with protocolHealth, the parameters are set once per establishment,
+// and the pause escalation is reset on each establishment.
+type suspectedBlocking struct {
+	failureThreshold   int
+	minProtocols       int
+	maxFailureDuration time.Duration
+	window             time.Duration
+	pausePeriod        time.Duration
+	maxPausePeriod     time.Duration
+
+	mutex      sync.Mutex
+	failures   []suspectedBlockingFailure
+	detected   bool
+	detections int
+}
+
+type suspectedBlockingFailure struct {
+	time           monotime.Time
+	tunnelProtocol string
+}
+
+func newSuspectedBlocking(config *Config) *suspectedBlocking {
+
+	p := config.clientParameters.Get()
+
+	return &suspectedBlocking{
+		failureThreshold:   p.Int(parameters.SuspectedBlockingFailureThreshold),
+		minProtocols:       p.Int(parameters.SuspectedBlockingMinProtocols),
+		maxFailureDuration: p.Duration(parameters.SuspectedBlockingMaxFailureDuration),
+		window:             p.Duration(parameters.SuspectedBlockingWindow),
+		pausePeriod:        p.Duration(parameters.SuspectedBlockingPausePeriod),
+		maxPausePeriod:     p.Duration(parameters.SuspectedBlockingMaxPausePeriod),
+	}
+}
+
+func (blocking *suspectedBlocking) isEnabled() bool {
+	return blocking != nil && blocking.failureThreshold > 0
+}
+
+// isBlockingFailure indicates whether a connection error is consistent with
+// active interference. Only the error category is considered; see
+// classifyConnectionError.
+func isBlockingFailure(err error) bool {
+	switch classifyConnectionError(err) {
+	case DIAGNOSTIC_FAILURE_CONNECTION_RESET,
+		DIAGNOSTIC_FAILURE_CONNECTION_REFUSED,
+		DIAGNOSTIC_FAILURE_TLS,
+		DIAGNOSTIC_FAILURE_SSH,
+		DIAGNOSTIC_FAILURE_HANDSHAKE:
+		return true
+	}
+	return false
+}
+
+// recordFailure records a failed connection attempt, which took
+// connectDuration, and checks for the suspected blocking pattern.
+func (blocking *suspectedBlocking) recordFailure(
+	tunnelProtocol string, connectDuration time.Duration, err error) {
+
+	if !blocking.isEnabled() {
+		return
+	}
+
+	blocking.mutex.Lock()
+	defer blocking.mutex.Unlock()
+
+	// Canceled attempts, as when establishment stops, say nothing about the
+	// network.
+	if classifyConnectionError(err) == DIAGNOSTIC_FAILURE_CANCELED {
+		return
+	}
+
+	if !isBlockingFailure(err) {
+		blocking.failures = nil
+		return
+	}
+
+	if connectDuration > blocking.maxFailureDuration {
+		return
+	}
+
+	now := monotime.Now()
+
+	// Discard failures outside the window.
+	i := 0
+	for ; i < len(blocking.failures); i++ {
+		if now.Sub(blocking.failures[i].time) <= blocking.window {
+			break
+		}
+	}
+	blocking.failures = append(
+		blocking.failures[i:],
+		suspectedBlockingFailure{time: now, tunnelProtocol: tunnelProtocol})
+
+	if len(blocking.failures) < blocking.failureThreshold {
+		return
+	}
+
+	var protocols []string
+	for _, failure := range blocking.failures {
+		if !common.Contains(protocols, failure.tunnelProtocol) {
+			protocols = append(protocols, failure.tunnelProtocol)
+		}
+	}
+
+	if len(protocols) >= blocking.minProtocols {
+		blocking.detected = true
+	}
+}
+
+// recordSuccess records a successful connection, which clears any recorded
+// failures and resets the pause escalation.
+func (blocking *suspectedBlocking) recordSuccess() {
+
+	if !blocking.isEnabled() {
+		return
+	}
+
+	blocking.mutex.Lock()
+	defer blocking.mutex.Unlock()
+
+	blocking.failures = nil
+	blocking.detected = false
+	blocking.detections = 0
+}
+
+// isDetected indicates whether blocking is currently suspected.
+func (blocking *suspectedBlocking) isDetected() bool {
+
+	if !blocking.isEnabled() {
+		return false
+	}
+
+	blocking.mutex.Lock()
+	defer blocking.mutex.Unlock()
+
+	return blocking.detected
+}
+
+// takePausePeriod returns the extended pause period, and true, when
+// blocking is suspected; and then clears the detection and the recorded
+// failures, so the next round starts fresh. The pause period doubles with
+// each consecutive detection.
+func (blocking *suspectedBlocking) takePausePeriod() (time.Duration, bool) {
+
+	if !blocking.isEnabled() {
+		return 0, false
+	}
+
+	blocking.mutex.Lock()
+	defer blocking.mutex.Unlock()
+
+	if !blocking.detected {
+		return 0, false
+	}
+
+	pausePeriod := blocking.pausePeriod
+	for i := 0; i < blocking.detections && pausePeriod < blocking.maxPausePeriod; i++ {
+		pausePeriod *= 2
+	}
+	if pausePeriod > blocking.maxPausePeriod {
+		pausePeriod = blocking.maxPausePeriod
+	}
+
+	blocking.failures = nil
+	blocking.detected = false
+	blocking.detections++
+
+	return pausePeriod, true
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestSuspectedBlocking(t *testing.T) {
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	err = clientConfig.Commit()
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	// Suspected blocking detection is disabled by default.
+
+	blocking := newSuspectedBlocking(clientConfig)
+
+	resetErr := errors.New("read: connection reset by peer")
+
+	for i := 0; i < 10; i++ {
+		blocking.recordFailure(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, time.Second, resetErr)
+	}
+
+	if blocking.isDetected() {
+		t.Fatalf("unexpected detection while disabled")
+	}
+
+	applyParameters := make(map[string]interface{})
+	applyParameters[parameters.SuspectedBlockingFailureThreshold] = 4
+	applyParameters[parameters.SuspectedBlockingMinProtocols] = 2
+	applyParameters[parameters.SuspectedBlockingMaxFailureDuration] = "5s"
+	applyParameters[parameters.SuspectedBlockingWindow] = "1h"
+	applyParameters[parameters.SuspectedBlockingPausePeriod] = "10m"
+	applyParameters[parameters.SuspectedBlockingMaxPausePeriod] = "30m"
+
+	err = clientConfig.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		t.Fatalf("error setting client parameters: %s", err)
+	}
+
+	blocking = newSuspectedBlocking(clientConfig)
+
+	// Failures with a single protocol, slow failures, and failures
+	// interrupted by network loss errors don't indicate blocking.
+
+	for i := 0; i < 4; i++ {
+		blocking.recordFailure(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, time.Second, resetErr)
+	}
+
+	if blocking.isDetected() {
+		t.Fatalf("unexpected detection with a single protocol")
+	}
+
+	blocking.recordFailure(
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, time.Minute, resetErr)
+
+	if blocking.isDetected() {
+		t.Fatalf("unexpected detection with slow failure")
+	}
+
+	blocking.recordFailure(
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, time.Second, errors.New("lookup example.com: no such host"))
+
+	blocking.recordFailure(
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, time.Second, resetErr)
+
+	if blocking.isDetected() {
+		t.Fatalf("unexpected detection after network loss failure")
+	}
+
+	// Quick interference failures across protocols indicate blocking.
+
+	blocking.recordFailure(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, time.Second, resetErr)
+	blocking.recordFailure(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, time.Second, errors.New("tls: handshake failure"))
+	blocking.recordFailure(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, time.Second, resetErr)
+
+	if !blocking.isDetected() {
+		t.Fatalf("expected detection")
+	}
+
+	// The pause period escalates with each consecutive detection, up to the
+	// maximum.
+
+	for _, expectedPausePeriod := range []time.Duration{
+		10 * time.Minute, 20 * time.Minute, 30 * time.Minute, 30 * time.Minute} {
+
+		if !blocking.isDetected() {
+			for i := 0; i < 2; i++ {
+				blocking.recordFailure(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, time.Second, resetErr)
+				blocking.recordFailure(protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, time.Second, resetErr)
+			}
+		}
+
+		pausePeriod, ok := blocking.takePausePeriod()
+		if !ok || pausePeriod != expectedPausePeriod {
+			t.Fatalf("unexpected pause period: %s", pausePeriod)
+		}
+
+		if blocking.isDetected() {
+			t.Fatalf("unexpected detection after pause")
+		}
+
+		_, ok = blocking.takePausePeriod()
+		if ok {
+			t.Fatalf("unexpected pause period")
+		}
+	}
+
+	// A success resets the escalation.
+
+	blocking.recordSuccess()
+
+	for i := 0; i < 2; i++ {
+		blocking.recordFailure(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, time.Second, resetErr)
+		blocking.recordFailure(protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK, time.Second, resetErr)
+	}
+
+	pausePeriod, ok := blocking.takePausePeriod()
+	if !ok || pausePeriod != 10*time.Minute {
+		t.Fatalf("unexpected pause period after success: %s", pausePeriod)
+	}
+}
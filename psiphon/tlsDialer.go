@@ -55,10 +55,15 @@ package psiphon
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -104,6 +109,18 @@ type CustomTLSConfig struct {
 	// specified certificate. SNI is disbled when this is set.
 	VerifyLegacyCertificate *x509.Certificate
 
+	// VerifyPins, when set, replaces certificate chain and hostname
+	// verification with a check that the server's leaf certificate public
+	// key matches one of the pins. Each pin is the base64-encoded SHA-256
+	// digest of a certificate SubjectPublicKeyInfo. VerifyPins is ignored
+	// when SkipVerify is set.
+	VerifyPins []string
+
+	// VerifySkipHostname, when set, verifies the server certificate chain
+	// but not that the certificate matches the server hostname.
+	// VerifySkipHostname is ignored when SkipVerify is set.
+	VerifySkipHostname bool
+
 	// TLSProfile specifies a particular indistinguishable TLS profile to use
 	// for the TLS dial. When TLSProfile is "", a profile is selected at
 	// random. Setting TLSProfile allows the caller to pin the selection so
@@ -121,6 +138,34 @@ type CustomTLSConfig struct {
 	// using the specified key.
 	ObfuscatedSessionTicketKey string
 
+	// RecordFragmentMinBytes and RecordFragmentMaxBytes, when
+	// RecordFragmentMaxBytes is > 0, enable fragmentation of application
+	// data into TLS records of random sizes in the specified range. Each
+	// fragment is passed to the TLS stack in a separate Write, so record
+	// framing and encryption are performed by the TLS stack as usual.
+	// Records sent during the TLS handshake are not affected.
+	RecordFragmentMinBytes int
+	RecordFragmentMaxBytes int
+
+	// HandshakeTimeout, when > 0, limits the TLS handshake, not including
+	// the underlying dial, within any deadline of the dial context.
+	HandshakeTimeout time.Duration
+
+	// TLSInterceptionDetected, when set, enables TLS interception detection.
+	// After the handshake, the server certificate is checked for indicators
+	// of interception, as configured by the TLSInterception client
+	// parameters. When the number of indicators meets the threshold,
+	// TLSInterceptionDetected is called with the indicators and the dial
+	// fails. Detection is independent of certificate verification and
+	// applies when SkipVerify is set.
+	TLSInterceptionDetected func(indicators []string)
+
+	// NextProtos specifies the ALPN protocols to offer. NextProtos applies
+	// only to TLS profiles which don't parrot a fixed ALPN extension: the
+	// TLS 1.3, randomized, and stock Go profiles. When blank, the TLS
+	// profile default is used.
+	NextProtos []string
+
 	utlsClientSessionCache utls.ClientSessionCache
 	trisClientSessionCache tris.ClientSessionCache
 }
@@ -129,6 +174,9 @@ type CustomTLSConfig struct {
 // tickets, enabling TLS session resumability across multiple
 // CustomTLSDial calls or dialers using the same CustomTLSConfig.
 //
+// The cache is isolated to this CustomTLSConfig. To share a cache with
+// other CustomTLSConfigs, use SetClientSessionCache.
+//
 // TLSProfile must be set or will be auto-set via SelectTLSProfile.
 func (config *CustomTLSConfig) EnableClientSessionCache(
 	clientParameters *parameters.ClientParameters) {
@@ -144,6 +192,69 @@ func (config *CustomTLSConfig) EnableClientSessionCache(
 	}
 }
 
+// SetClientSessionCache sets the cache to use to persist session tickets to
+// a TLSClientSessionCache shared with other CustomTLSConfigs, enabling TLS
+// session resumability across all dialers using the shared cache. This
+// replaces any cache initialized by EnableClientSessionCache.
+//
+// TLSProfile must be set or will be auto-set via SelectTLSProfile.
+func (config *CustomTLSConfig) SetClientSessionCache(cache *TLSClientSessionCache) {
+
+	if config.TLSProfile == "" {
+		config.TLSProfile = SelectTLSProfile(config.ClientParameters)
+	}
+
+	if useUTLS(config.TLSProfile) {
+		config.utlsClientSessionCache = cache.getUTLSCache(config.TLSProfile)
+		config.trisClientSessionCache = nil
+	} else {
+		config.utlsClientSessionCache = nil
+		config.trisClientSessionCache = cache.getTrisCache(config.TLSProfile)
+	}
+}
+
+// TLSClientSessionCache is a TLS session cache which may be shared by
+// multiple CustomTLSConfigs; see CustomTLSConfig.SetClientSessionCache.
+//
+// Sessions are cached separately for each TLS profile, so that a session
+// established with one TLS profile isn't resumed with a different
+// ClientHello.
+type TLSClientSessionCache struct {
+	mutex      sync.Mutex
+	utlsCaches map[string]utls.ClientSessionCache
+	trisCaches map[string]tris.ClientSessionCache
+}
+
+// NewTLSClientSessionCache initializes a new TLSClientSessionCache.
+func NewTLSClientSessionCache() *TLSClientSessionCache {
+	return &TLSClientSessionCache{
+		utlsCaches: make(map[string]utls.ClientSessionCache),
+		trisCaches: make(map[string]tris.ClientSessionCache),
+	}
+}
+
+func (cache *TLSClientSessionCache) getUTLSCache(tlsProfile string) utls.ClientSessionCache {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	profileCache, ok := cache.utlsCaches[tlsProfile]
+	if !ok {
+		profileCache = utls.NewLRUClientSessionCache(0)
+		cache.utlsCaches[tlsProfile] = profileCache
+	}
+	return profileCache
+}
+
+func (cache *TLSClientSessionCache) getTrisCache(tlsProfile string) tris.ClientSessionCache {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	profileCache, ok := cache.trisCaches[tlsProfile]
+	if !ok {
+		profileCache = tris.NewLRUClientSessionCache(0)
+		cache.trisCaches[tlsProfile] = profileCache
+	}
+	return profileCache
+}
+
 // SelectTLSProfile picks a random TLS profile from the available candidates.
 func SelectTLSProfile(
 	clientParameters *parameters.ClientParameters) string {
@@ -175,6 +286,64 @@ func useUTLS(tlsProfile string) bool {
 	return tlsProfile != protocol.TLS_PROFILE_TLS13_RANDOMIZED
 }
 
+// tlsGroupCurveIDs maps protocol.SupportedTLSGroups, excluding GREASE, to
+// TLS curve IDs, which are the same values in utls and tris.
+var tlsGroupCurveIDs = map[string]uint16{
+	protocol.TLS_GROUP_X25519: uint16(utls.X25519),
+	protocol.TLS_GROUP_P256:   uint16(utls.CurveP256),
+	protocol.TLS_GROUP_P384:   uint16(utls.CurveP384),
+	protocol.TLS_GROUP_P521:   uint16(utls.CurveP521),
+}
+
+// utlsGREASEGroupIndex is the utls ssl_grease_group index, which selects the
+// client random byte from which the GREASE group value is derived, as in the
+// utls Chrome parrot.
+const utlsGREASEGroupIndex = 1
+
+// setUTLSGroups replaces the groups in the utls ClientHello supported groups
+// extension. The ClientHello is built first, so any GREASE value is derived
+// from the client random.
+func setUTLSGroups(uconn *utls.UConn, groups []string) error {
+
+	err := uconn.BuildHandshakeState()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	curves := make([]utls.CurveID, len(groups))
+	for i, group := range groups {
+		if group == protocol.TLS_GROUP_GREASE {
+			curves[i] = utls.CurveID(utls.GetBoringGREASEValue(
+				uconn.HandshakeState.Hello.Random, utlsGREASEGroupIndex))
+		} else {
+			curves[i] = utls.CurveID(tlsGroupCurveIDs[group])
+		}
+	}
+
+	found := false
+	for _, extension := range uconn.Extensions {
+		if curvesExtension, ok := extension.(*utls.SupportedCurvesExtension); ok {
+			curvesExtension.Curves = curves
+			found = true
+		}
+	}
+	if !found {
+		return common.ContextError(errors.New("missing supported groups extension"))
+	}
+
+	err = uconn.ApplyConfig()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	err = uconn.MarshalClientHello()
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 func getUTLSClientHelloID(tlsProfile string) utls.ClientHelloID {
 	switch tlsProfile {
 	case protocol.TLS_PROFILE_IOS_1131:
@@ -234,6 +403,63 @@ func (conn *trisConn) IsHTTP2() bool {
 		state.NegotiatedProtocol == "h2"
 }
 
+// recordFragmentingConn wraps a tlsConn and splits each Write into
+// randomly sized Writes, resulting in TLS records of varying sizes.
+type recordFragmentingConn struct {
+	tlsConn
+	minRecordBytes int
+	maxRecordBytes int
+}
+
+func newRecordFragmentingConn(
+	conn tlsConn, minRecordBytes, maxRecordBytes int) *recordFragmentingConn {
+
+	// The TLS maximum plaintext record size is 16384 bytes; larger
+	// fragments would be split by the TLS stack.
+	if maxRecordBytes > 16384 {
+		maxRecordBytes = 16384
+	}
+	if minRecordBytes < 1 {
+		minRecordBytes = 1
+	}
+	if minRecordBytes > maxRecordBytes {
+		minRecordBytes = maxRecordBytes
+	}
+
+	return &recordFragmentingConn{
+		tlsConn:        conn,
+		minRecordBytes: minRecordBytes,
+		maxRecordBytes: maxRecordBytes,
+	}
+}
+
+func (conn *recordFragmentingConn) Write(buffer []byte) (int, error) {
+
+	totalWritten := 0
+
+	for len(buffer) > 0 {
+
+		recordBytes, err := common.MakeSecureRandomRange(
+			conn.minRecordBytes, conn.maxRecordBytes)
+		if err != nil {
+			return totalWritten, common.ContextError(err)
+		}
+		if recordBytes > len(buffer) {
+			recordBytes = len(buffer)
+		}
+
+		n, err := conn.tlsConn.Write(buffer[:recordBytes])
+		totalWritten += n
+		if err != nil {
+			return totalWritten, err
+		}
+
+		buffer = buffer[recordBytes:]
+	}
+
+	return totalWritten, nil
+}
+
 func IsTLSConnUsingHTTP2(conn net.Conn) bool {
 	if c, ok := conn.(tlsConn); ok {
 		return c.IsHTTP2()
@@ -265,6 +491,7 @@ func CustomTLSDial(
 
 	if !config.SkipVerify &&
 		config.VerifyLegacyCertificate == nil &&
+		len(config.VerifyPins) == 0 &&
 		config.TrustedCACertificatesFilename != "" {
 		return nil, common.ContextError(
 			errors.New("TrustedCACertificatesFilename not supported"))
@@ -292,10 +519,15 @@ func CustomTLSDial(
 		selectedTLSProfile = SelectTLSProfile(config.ClientParameters)
 	}
 
+	tlsGroups := config.ClientParameters.Get().TLSProfileGroups(
+		parameters.TLSProfileKeyShareGroups)[selectedTLSProfile]
+
 	tlsConfigInsecureSkipVerify := false
 	tlsConfigServerName := ""
 
-	if config.SkipVerify {
+	if config.SkipVerify || len(config.VerifyPins) > 0 || config.VerifySkipHostname {
+		// Pin and chain-only verification are performed manually after
+		// handshaking.
 		tlsConfigInsecureSkipVerify = true
 	}
 
@@ -346,6 +578,7 @@ func CustomTLSDial(
 			InsecureSkipVerify: tlsConfigInsecureSkipVerify,
 			ServerName:         tlsConfigServerName,
 			ClientSessionCache: clientSessionCache,
+			NextProtos:         config.NextProtos,
 		}
 
 		uconn := utls.UClient(rawConn, tlsConfig, getUTLSClientHelloID(selectedTLSProfile))
@@ -359,6 +592,14 @@ func CustomTLSDial(
 			uconn.SetSessionState(sessionState)
 		}
 
+		if len(tlsGroups) > 0 {
+			err := setUTLSGroups(uconn, tlsGroups)
+			if err != nil {
+				rawConn.Close()
+				return nil, common.ContextError(err)
+			}
+		}
+
 		conn = &utlsConn{
 			UConn: uconn,
 		}
@@ -380,6 +621,14 @@ func CustomTLSDial(
 			InsecureSkipVerify: tlsConfigInsecureSkipVerify,
 			ServerName:         tlsConfigServerName,
 			ClientSessionCache: clientSessionCache,
+			NextProtos:         config.NextProtos,
+		}
+
+		// tris sends a key share for the first group. GREASE values are
+		// rejected by TLSProfileGroups.Validate.
+		for _, group := range tlsGroups {
+			tlsConfig.CurvePreferences = append(
+				tlsConfig.CurvePreferences, tris.CurveID(tlsGroupCurveIDs[group]))
 		}
 
 		conn = &trisConn{
@@ -394,10 +643,17 @@ func CustomTLSDial(
 		resultChannel <- conn.Handshake()
 	}()
 
+	handshakeCtx := ctx
+	if config.HandshakeTimeout > 0 {
+		var cancelFunc context.CancelFunc
+		handshakeCtx, cancelFunc = context.WithTimeout(ctx, config.HandshakeTimeout)
+		defer cancelFunc()
+	}
+
 	select {
 	case err = <-resultChannel:
-	case <-ctx.Done():
-		err = ctx.Err()
+	case <-handshakeCtx.Done():
+		err = handshakeCtx.Err()
 		// Interrupt the goroutine
 		rawConn.Close()
 		<-resultChannel
@@ -407,20 +663,112 @@ func CustomTLSDial(
 
 		if config.VerifyLegacyCertificate != nil {
 			err = verifyLegacyCertificate(conn, config.VerifyLegacyCertificate)
+		} else if len(config.VerifyPins) > 0 {
+			err = verifyServerCertPins(conn, config.VerifyPins)
 		} else {
-			// Manually verify certificates
-			err = verifyServerCerts(conn, hostname)
+			// Manually verify certificates. An empty hostname skips the
+			// hostname check.
+			verifyHostname := hostname
+			if config.VerifySkipHostname {
+				verifyHostname = ""
+			}
+			err = verifyServerCerts(
+				conn,
+				verifyHostname,
+				config.ClientParameters.Get().Duration(parameters.ClockSkewTolerance))
 		}
 	}
 
+	if err == nil && config.TLSInterceptionDetected != nil {
+
+		p := config.ClientParameters.Get()
+		threshold := p.Int(parameters.TLSInterceptionIndicatorThreshold)
+		if threshold > 0 {
+			indicators := getTLSInterceptionIndicators(
+				p, conn.GetPeerCertificates(), time.Now())
+			if len(indicators) >= threshold {
+				config.TLSInterceptionDetected(indicators)
+				err = errors.New("TLS interception detected")
+			}
+		}
+		p = nil
+	}
+
 	if err != nil {
 		rawConn.Close()
 		return nil, common.ContextError(err)
 	}
 
+	if config.RecordFragmentMaxBytes > 0 {
+		conn = newRecordFragmentingConn(
+			conn, config.RecordFragmentMinBytes, config.RecordFragmentMaxBytes)
+	}
+
 	return conn, nil
 }
 
+// oidSignedCertificateTimestampList is the X.509 extension OID for embedded
+// Certificate Transparency SCTs; see RFC 6962, section 3.3.
+var oidSignedCertificateTimestampList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// getTLSInterceptionIndicators checks the leaf server certificate for signs
+// of a TLS interception proxy, which typically issues server certificates
+// on the fly, from its own CA, without embedded SCTs. The checks performed
+// are configured by the TLSInterception client parameters.
+func getTLSInterceptionIndicators(
+	p *parameters.ClientParametersSnapshot,
+	certs []*x509.Certificate,
+	now time.Time) []string {
+
+	if len(certs) < 1 {
+		return []string{"no certificate"}
+	}
+	leaf := certs[0]
+
+	var indicators []string
+
+	expectedIssuers := p.Strings(parameters.TLSInterceptionExpectedIssuers)
+	if len(expectedIssuers) > 0 {
+		issuerNames := append(
+			[]string{leaf.Issuer.CommonName}, leaf.Issuer.Organization...)
+		expected := false
+		for _, expectedIssuer := range expectedIssuers {
+			for _, issuerName := range issuerNames {
+				if expectedIssuer != "" && strings.Contains(issuerName, expectedIssuer) {
+					expected = true
+				}
+			}
+		}
+		if !expected {
+			indicators = append(indicators, "unexpected issuer")
+		}
+	}
+
+	// A local clock that is behind makes certificates appear newer, so the
+	// certificate age check allows for ClockSkewTolerance.
+	minCertificateAge := p.Duration(parameters.TLSInterceptionMinCertificateAge)
+	clockSkewTolerance := p.Duration(parameters.ClockSkewTolerance)
+	if minCertificateAge > 0 &&
+		now.Add(clockSkewTolerance).Sub(leaf.NotBefore) < minCertificateAge {
+		indicators = append(indicators, "new certificate")
+	}
+
+	if p.Bool(parameters.TLSInterceptionRequireSCTs) {
+		hasSCTs := false
+		for _, extension := range leaf.Extensions {
+			if extension.Id.Equal(oidSignedCertificateTimestampList) {
+				hasSCTs = true
+				break
+			}
+		}
+		if !hasSCTs {
+			indicators = append(indicators, "missing SCTs")
+		}
+	}
+
+	return indicators
+}
+
 func verifyLegacyCertificate(conn tlsConn, expectedCertificate *x509.Certificate) error {
 	certs := conn.GetPeerCertificates()
 	if len(certs) < 1 {
@@ -432,8 +780,31 @@ func verifyLegacyCertificate(conn tlsConn, expectedCertificate *x509.Certificate
 	return nil
 }
 
-func verifyServerCerts(conn tlsConn, hostname string) error {
+// verifyServerCertPins checks that the public key of the server's leaf
+// certificate matches one of the pins. Only the leaf certificate is
+// checked: as the certificate chain is not verified, any other certificate
+// presented by the server, including a copy of a pinned CA certificate, is
+// not proof of possession of the pinned key.
+func verifyServerCertPins(conn tlsConn, pins []string) error {
+	certs := conn.GetPeerCertificates()
+	if len(certs) < 1 {
+		return common.ContextError(errors.New("no certificate to verify"))
+	}
+	digest := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+	if !common.Contains(pins, pin) {
+		return common.ContextError(errors.New("unexpected certificate public key"))
+	}
+	return nil
+}
+
+func verifyServerCerts(
+	conn tlsConn, hostname string, clockSkewTolerance time.Duration) error {
+
 	certs := conn.GetPeerCertificates()
+	if len(certs) < 1 {
+		return common.ContextError(errors.New("no certificate to verify"))
+	}
 
 	opts := x509.VerifyOptions{
 		Roots:         nil, // Use host's root CAs
@@ -449,9 +820,43 @@ func verifyServerCerts(conn tlsConn, hostname string) error {
 		opts.Intermediates.AddCert(cert)
 	}
 
-	_, err := certs[0].Verify(opts)
+	err := verifyCertificateWithClockSkewTolerance(certs[0], opts, clockSkewTolerance)
 	if err != nil {
 		return common.ContextError(err)
 	}
 	return nil
 }
+
+// verifyCertificateWithClockSkewTolerance verifies the certificate using
+// opts. When verification fails only due to a certificate validity period
+// check, verification is retried with opts.CurrentTime adjusted, earlier
+// and later, by clockSkewTolerance. This allows for local clocks which are
+// modestly ahead or behind.
+func verifyCertificateWithClockSkewTolerance(
+	cert *x509.Certificate,
+	opts x509.VerifyOptions,
+	clockSkewTolerance time.Duration) error {
+
+	_, err := cert.Verify(opts)
+	if err == nil {
+		return nil
+	}
+
+	invalidErr, ok := err.(x509.CertificateInvalidError)
+	if !ok || invalidErr.Reason != x509.Expired || clockSkewTolerance <= 0 {
+		return common.ContextError(err)
+	}
+
+	now := opts.CurrentTime
+	for _, adjustedTime := range []time.Time{
+		now.Add(-clockSkewTolerance), now.Add(clockSkewTolerance)} {
+
+		opts.CurrentTime = adjustedTime
+		_, retryErr := cert.Verify(opts)
+		if retryErr == nil {
+			return nil
+		}
+	}
+
+	return common.ContextError(err)
+}
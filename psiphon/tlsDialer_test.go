@@ -0,0 +1,601 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	tris "github.com/Psiphon-Labs/tls-tris"
+)
+
+type testWriteRecordingConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (conn *testWriteRecordingConn) Write(b []byte) (int, error) {
+	conn.writes = append(conn.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (conn *testWriteRecordingConn) Handshake() error {
+	return nil
+}
+
+func (conn *testWriteRecordingConn) GetPeerCertificates() []*x509.Certificate {
+	return nil
+}
+
+func (conn *testWriteRecordingConn) IsHTTP2() bool {
+	return false
+}
+
+func TestRecordFragmentingConn(t *testing.T) {
+
+	minRecordBytes := 100
+	maxRecordBytes := 1000
+
+	recordingConn := &testWriteRecordingConn{}
+	conn := newRecordFragmentingConn(recordingConn, minRecordBytes, maxRecordBytes)
+
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+
+	n, err := conn.Write(payload)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if n != len(payload) {
+		t.Fatalf("unexpected write count: %d", n)
+	}
+
+	sizes := make(map[int]bool)
+
+	for i, write := range recordingConn.writes {
+		isLast := i == len(recordingConn.writes)-1
+		if len(write) > maxRecordBytes || (!isLast && len(write) < minRecordBytes) {
+			t.Fatalf("unexpected record size: %d", len(write))
+		}
+		sizes[len(write)] = true
+	}
+
+	if len(sizes) < 2 {
+		t.Fatalf("record sizes did not vary")
+	}
+
+	if !bytes.Equal(bytes.Join(recordingConn.writes, nil), payload) {
+		t.Fatalf("unexpected written data")
+	}
+}
+
+func TestTLSInterceptionIndicators(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"TLSInterceptionIndicatorThreshold": 2,
+		"TLSInterceptionExpectedIssuers":    []string{"Expected CA"},
+		"TLSInterceptionMinCertificateAge":  "24h",
+		"TLSInterceptionRequireSCTs":        true,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	now := time.Now()
+
+	interceptedCert := &x509.Certificate{
+		Issuer:    pkix.Name{CommonName: "Middlebox CA"},
+		NotBefore: now.Add(-1 * time.Minute),
+	}
+
+	legitimateCert := &x509.Certificate{
+		Issuer:    pkix.Name{Organization: []string{"Expected CA Inc."}},
+		NotBefore: now.Add(-30 * 24 * time.Hour),
+		Extensions: []pkix.Extension{
+			{Id: oidSignedCertificateTimestampList},
+		},
+	}
+
+	testCases := []struct {
+		description        string
+		certs              []*x509.Certificate
+		expectedIndicators []string
+	}{
+		{
+			"intercepted",
+			[]*x509.Certificate{interceptedCert},
+			[]string{"unexpected issuer", "new certificate", "missing SCTs"},
+		},
+		{
+			"legitimate",
+			[]*x509.Certificate{legitimateCert},
+			nil,
+		},
+		{
+			"no certificate",
+			nil,
+			[]string{"no certificate"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			indicators := getTLSInterceptionIndicators(
+				clientParameters.Get(), testCase.certs, now)
+			if !reflect.DeepEqual(indicators, testCase.expectedIndicators) {
+				t.Fatalf("unexpected indicators: %+v", indicators)
+			}
+		})
+	}
+}
+
+func TestVerifyCertificateWithClockSkewTolerance(t *testing.T) {
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+
+	now := time.Now()
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-24 * time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(
+		rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %s", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	makeLeaf := func(notBefore, notAfter time.Time) *x509.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "www.example.com"},
+			DNSNames:     []string{"www.example.com"},
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		DER, err := x509.CreateCertificate(
+			rand.Reader, template, caCert, &caKey.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("CreateCertificate failed: %s", err)
+		}
+		cert, err := x509.ParseCertificate(DER)
+		if err != nil {
+			t.Fatalf("ParseCertificate failed: %s", err)
+		}
+		return cert
+	}
+
+	testCases := []struct {
+		description string
+		cert        *x509.Certificate
+		tolerance   time.Duration
+		expectValid bool
+	}{
+		{"valid", makeLeaf(now.Add(-time.Hour), now.Add(time.Hour)), 0, true},
+		{"not yet valid", makeLeaf(now.Add(5*time.Minute), now.Add(time.Hour)), 0, false},
+		{"not yet valid within tolerance", makeLeaf(now.Add(5*time.Minute), now.Add(time.Hour)), 10 * time.Minute, true},
+		{"expired within tolerance", makeLeaf(now.Add(-time.Hour), now.Add(-5*time.Minute)), 10 * time.Minute, true},
+		{"expired beyond tolerance", makeLeaf(now.Add(-time.Hour), now.Add(-20*time.Minute)), 10 * time.Minute, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			opts := x509.VerifyOptions{
+				Roots:       roots,
+				CurrentTime: now,
+				DNSName:     "www.example.com",
+			}
+			err := verifyCertificateWithClockSkewTolerance(
+				testCase.cert, opts, testCase.tolerance)
+			if (err == nil) != testCase.expectValid {
+				t.Fatalf("unexpected result: %v", err)
+			}
+		})
+	}
+}
+
+func TestCustomTLSDialHandshakeTimeout(t *testing.T) {
+
+	// The listener accepts TCP connections but never responds, stalling
+	// the TLS handshake.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFunc()
+
+	handshakeTimeout := 100 * time.Millisecond
+
+	start := time.Now()
+
+	_, err = CustomTLSDial(
+		ctx,
+		"tcp",
+		listener.Addr().String(),
+		&CustomTLSConfig{
+			ClientParameters: clientParameters,
+			Dial:             NewTCPDialer(&DialConfig{}),
+			SkipVerify:       true,
+			HandshakeTimeout: handshakeTimeout,
+		})
+
+	if err == nil {
+		t.Fatalf("unexpected CustomTLSDial success")
+	}
+
+	// The dial fails after the handshake timeout, well within the
+	// context deadline.
+
+	if elapsed := time.Since(start); elapsed > 10*handshakeTimeout || ctx.Err() != nil {
+		t.Fatalf("unexpected elapsed time: %s", elapsed)
+	}
+}
+
+func TestCustomTLSDialWithoutSNI(t *testing.T) {
+
+	certificate, privateKey, err := common.GenerateWebServerCertificate("example.com")
+	if err != nil {
+		t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+	}
+
+	tlsCertificate, err := tris.X509KeyPair([]byte(certificate), []byte(privateKey))
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %s", err)
+	}
+
+	serverNames := make(chan string, 1)
+
+	tlsConfig := &tris.Config{
+		Certificates: []tris.Certificate{tlsCertificate},
+		GetConfigForClient: func(clientHello *tris.ClientHelloInfo) (*tris.Config, error) {
+			serverNames <- clientHello.ServerName
+			return nil, nil
+		},
+	}
+
+	listener, err := tris.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tris.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	// Every TLS profile must complete a handshake while omitting SNI.
+
+	for _, tlsProfile := range protocol.SupportedTLSProfiles {
+		for _, SNIServerName := range []string{"", "example.com"} {
+
+			conn, err := CustomTLSDial(
+				context.Background(),
+				"tcp",
+				listener.Addr().String(),
+				&CustomTLSConfig{
+					ClientParameters: clientParameters,
+					Dial:             NewTCPDialer(&DialConfig{}),
+					SNIServerName:    SNIServerName,
+					SkipVerify:       true,
+					TLSProfile:       tlsProfile,
+				})
+			if err != nil {
+				t.Fatalf("CustomTLSDial failed: %s: %s", tlsProfile, err)
+			}
+			conn.Close()
+
+			if serverName := <-serverNames; serverName != SNIServerName {
+				t.Fatalf("unexpected server name: %s: %s", tlsProfile, serverName)
+			}
+		}
+	}
+}
+
+func TestCustomTLSDialKeyShareGroups(t *testing.T) {
+
+	certificate, privateKey, err := common.GenerateWebServerCertificate("example.com")
+	if err != nil {
+		t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+	}
+
+	tlsCertificate, err := tris.X509KeyPair([]byte(certificate), []byte(privateKey))
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %s", err)
+	}
+
+	clientCurves := make(chan []tris.CurveID, 1)
+
+	tlsConfig := &tris.Config{
+		Certificates: []tris.Certificate{tlsCertificate},
+		GetConfigForClient: func(clientHello *tris.ClientHelloInfo) (*tris.Config, error) {
+			clientCurves <- clientHello.SupportedCurves
+			return nil, nil
+		},
+	}
+
+	listener, err := tris.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tris.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	profileGroups := make(map[string]interface{})
+	for _, tlsProfile := range protocol.SupportedTLSProfiles {
+		groups := []interface{}{"GREASE", "P-256", "X25519"}
+		if !useUTLS(tlsProfile) {
+			groups = groups[1:]
+		}
+		profileGroups[tlsProfile] = groups
+	}
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		"TLSProfileKeyShareGroups": profileGroups})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	// Every TLS profile must offer the configured groups, in order, and
+	// complete a handshake.
+
+	for _, tlsProfile := range protocol.SupportedTLSProfiles {
+
+		conn, err := CustomTLSDial(
+			context.Background(),
+			"tcp",
+			listener.Addr().String(),
+			&CustomTLSConfig{
+				ClientParameters: clientParameters,
+				Dial:             NewTCPDialer(&DialConfig{}),
+				SkipVerify:       true,
+				TLSProfile:       tlsProfile,
+			})
+		if err != nil {
+			t.Fatalf("CustomTLSDial failed: %s: %s", tlsProfile, err)
+		}
+		conn.Close()
+
+		curves := <-clientCurves
+
+		if useUTLS(tlsProfile) {
+			if len(curves) == 0 || curves[0]&0x0f0f != 0x0a0a {
+				t.Fatalf("missing GREASE group: %s: %+v", tlsProfile, curves)
+			}
+			curves = curves[1:]
+		}
+
+		if !reflect.DeepEqual(curves, []tris.CurveID{tris.CurveP256, tris.X25519}) {
+			t.Fatalf("unexpected groups: %s: %+v", tlsProfile, curves)
+		}
+	}
+}
+
+func TestTLSClientSessionCache(t *testing.T) {
+
+	newConfig := func(tlsProfile string) *CustomTLSConfig {
+		return &CustomTLSConfig{TLSProfile: tlsProfile}
+	}
+
+	// By default, each config has an isolated cache.
+
+	config1 := newConfig(protocol.TLS_PROFILE_CHROME_58)
+	config1.EnableClientSessionCache(nil)
+	config2 := newConfig(protocol.TLS_PROFILE_CHROME_58)
+	config2.EnableClientSessionCache(nil)
+
+	if config1.utlsClientSessionCache == nil ||
+		config1.utlsClientSessionCache == config2.utlsClientSessionCache {
+		t.Fatalf("unexpected shared cache")
+	}
+
+	// A shared cache is shared by configs with the same TLS profile only.
+
+	sharedCache := NewTLSClientSessionCache()
+
+	config1.SetClientSessionCache(sharedCache)
+	config2.SetClientSessionCache(sharedCache)
+
+	if config1.utlsClientSessionCache == nil ||
+		config1.utlsClientSessionCache != config2.utlsClientSessionCache {
+		t.Fatalf("unexpected isolated cache")
+	}
+
+	config3 := newConfig(protocol.TLS_PROFILE_FIREFOX_56)
+	config3.SetClientSessionCache(sharedCache)
+
+	if config3.utlsClientSessionCache == config1.utlsClientSessionCache {
+		t.Fatalf("unexpected cache shared across TLS profiles")
+	}
+
+	config4 := newConfig(protocol.TLS_PROFILE_TLS13_RANDOMIZED)
+	config4.SetClientSessionCache(sharedCache)
+	config5 := newConfig(protocol.TLS_PROFILE_TLS13_RANDOMIZED)
+	config5.SetClientSessionCache(sharedCache)
+
+	if config4.utlsClientSessionCache != nil ||
+		config4.trisClientSessionCache == nil ||
+		config4.trisClientSessionCache != config5.trisClientSessionCache {
+		t.Fatalf("unexpected tris cache")
+	}
+}
+
+func TestCustomTLSDialVerifyPins(t *testing.T) {
+
+	certificate, privateKey, err := common.GenerateWebServerCertificate("example.com")
+	if err != nil {
+		t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+	}
+
+	tlsCertificate, err := tris.X509KeyPair([]byte(certificate), []byte(privateKey))
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(tlsCertificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %s", err)
+	}
+	digest := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(digest[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	listener, err := tris.Listen(
+		"tcp", "127.0.0.1:0", &tris.Config{Certificates: []tris.Certificate{tlsCertificate}})
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tris.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	// The self-signed certificate passes only pin verification with a
+	// matching pin; chain verification, with or without the hostname
+	// check, fails.
+
+	for _, testCase := range []struct {
+		pins           []string
+		skipHostname   bool
+		expectedResult bool
+	}{
+		{[]string{otherPin, pin}, false, true},
+		{[]string{otherPin}, false, false},
+		{nil, true, false},
+		{nil, false, false},
+	} {
+		conn, err := CustomTLSDial(
+			context.Background(),
+			"tcp",
+			listener.Addr().String(),
+			&CustomTLSConfig{
+				ClientParameters:   clientParameters,
+				Dial:               NewTCPDialer(&DialConfig{}),
+				SNIServerName:      "example.com",
+				VerifyPins:         testCase.pins,
+				VerifySkipHostname: testCase.skipHostname,
+			})
+		if testCase.expectedResult != (err == nil) {
+			t.Fatalf("unexpected result for %+v: %v", testCase, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
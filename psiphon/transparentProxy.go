@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// transparentProxyHeaders are response headers commonly added by
+// intercepting HTTP proxies.
+var transparentProxyHeaders = []string{
+	"Via",
+	"X-Cache",
+	"X-Cache-Lookup",
+	"X-Squid-Error",
+	"Proxy-Connection",
+}
+
+// runTransparentProxyDetection makes an untunneled, plaintext HTTP canary
+// request to TransparentProxyCanaryURL and, when the response indicates
+// interference by a transparent HTTP proxy, records that plaintext HTTP
+// transports are to be avoided for the remainder of the establishment. The
+// protocols avoided are specified by TransparentProxyAvoidProtocols.
+//
+// The canary resource is a benign, static resource with a known response,
+// TransparentProxyCanaryExpectedResponse. A failed canary request is
+// inconclusive and doesn't trigger adaptation, as it's not distinguishable
+// from a canary site outage.
+//
+// Detection is skipped when an upstream proxy is configured, as plaintext
+// transports are then knowingly relayed by a proxy.
+func (controller *Controller) runTransparentProxyDetection() {
+
+	defer controller.establishWaitGroup.Done()
+
+	p := controller.config.GetClientParameters()
+	canaryURL := p.String(parameters.TransparentProxyCanaryURL)
+	expectedResponse := p.String(parameters.TransparentProxyCanaryExpectedResponse)
+	timeout := p.Duration(parameters.TransparentProxyCanaryTimeout)
+	avoidProtocols := p.TunnelProtocols(parameters.TransparentProxyAvoidProtocols)
+	p = nil
+
+	if canaryURL == "" || len(avoidProtocols) == 0 ||
+		controller.config.UseUpstreamProxy() {
+		return
+	}
+
+	ctx, cancelFunc := context.WithTimeout(controller.establishCtx, timeout)
+	defer cancelFunc()
+
+	indicators, err := getTransparentProxyIndicators(
+		ctx,
+		controller.config,
+		controller.untunneledDialConfig,
+		canaryURL,
+		expectedResponse)
+	if err != nil {
+		NoticeInfo("transparent proxy detection failed: %s", err)
+		return
+	}
+
+	if len(indicators) == 0 {
+		return
+	}
+
+	NoticeTransparentProxyDetected(indicators, avoidProtocols)
+	controller.diagnostics.traceEvent("transparent proxy detected")
+
+	controller.config.setTransparentProxyAvoidProtocols(avoidProtocols)
+}
+
+// getTransparentProxyIndicators makes the canary request and returns a list
+// of indicators of transparent proxy interference, which is empty when the
+// response is exactly as expected.
+func getTransparentProxyIndicators(
+	ctx context.Context,
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	canaryURL string,
+	expectedResponse string) ([]string, error) {
+
+	httpClient, err := MakeUntunneledHTTPClient(
+		ctx, config, untunneledDialConfig, nil, false)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	// Redirects, as injected by captive portals and some proxies, are not
+	// followed; a redirect is an indicator.
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	request, err := http.NewRequest("GET", canaryURL, nil)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	request = request.WithContext(ctx)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	defer response.Body.Close()
+
+	var indicators []string
+
+	if response.StatusCode != http.StatusOK {
+		indicators = append(indicators, "status")
+	}
+
+	for _, header := range transparentProxyHeaders {
+		if response.Header.Get(header) != "" {
+			indicators = append(indicators, "header:"+header)
+		}
+	}
+
+	// Read at most one byte more than the expected response, so that an
+	// injected, longer response is detected without reading all of it.
+
+	body, err := ioutil.ReadAll(
+		io.LimitReader(response.Body, int64(len(expectedResponse)+1)))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	if string(body) != expectedResponse {
+		indicators = append(indicators, "body")
+	}
+
+	return indicators, nil
+}
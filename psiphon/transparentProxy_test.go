@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestTransparentProxyIndicators(t *testing.T) {
+
+	expectedResponse := "canary"
+
+	testCases := []struct {
+		description        string
+		handler            http.HandlerFunc
+		expectedIndicators []string
+	}{
+		{
+			"not proxied",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(expectedResponse))
+			},
+			nil,
+		},
+		{
+			"proxy header",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Via", "1.1 proxy")
+				w.Write([]byte(expectedResponse))
+			},
+			[]string{"header:Via"},
+		},
+		{
+			"modified body",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(expectedResponse + "<script>injected</script>"))
+			},
+			[]string{"body"},
+		},
+		{
+			"redirected",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Squid-Error", "ERR_ACCESS_DENIED")
+				http.Redirect(w, r, "http://portal.example.com/", http.StatusFound)
+			},
+			[]string{"status", "header:X-Squid-Error", "body"},
+		},
+	}
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+	config := &Config{clientParameters: clientParameters}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			server := httptest.NewServer(testCase.handler)
+			defer server.Close()
+
+			indicators, err := getTransparentProxyIndicators(
+				context.Background(),
+				config,
+				&DialConfig{},
+				server.URL,
+				expectedResponse)
+			if err != nil {
+				t.Fatalf("getTransparentProxyIndicators failed: %s", err)
+			}
+
+			if !reflect.DeepEqual(indicators, testCase.expectedIndicators) {
+				t.Fatalf("unexpected indicators: %v", indicators)
+			}
+		})
+	}
+
+	// A failed canary request is inconclusive.
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	_, err = getTransparentProxyIndicators(
+		context.Background(), config, &DialConfig{}, server.URL, expectedResponse)
+	if err == nil {
+		t.Fatalf("unexpected getTransparentProxyIndicators success")
+	}
+}
@@ -28,7 +28,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -70,12 +73,28 @@ type Tunneler interface {
 	SignalComponentFailure()
 }
 
+// Tunnel disconnect reasons, reported in the TunnelDisconnected notice.
+const (
+	TUNNEL_DISCONNECT_REASON_FAILED            = "failed"
+	TUNNEL_DISCONNECT_REASON_CONNECTION_CLOSED = "connection_closed"
+	TUNNEL_DISCONNECT_REASON_SERVER_CLOSED     = "server_closed"
+	TUNNEL_DISCONNECT_REASON_KEEPALIVE_TIMEOUT = "keepalive_timeout"
+	TUNNEL_DISCONNECT_REASON_COMPONENT_FAILURE = "component_failure"
+	TUNNEL_DISCONNECT_REASON_NETWORK_CHANGED   = "network_changed"
+	TUNNEL_DISCONNECT_REASON_MIGRATION         = "migration"
+	TUNNEL_DISCONNECT_REASON_RECONNECT         = "reconnect"
+	TUNNEL_DISCONNECT_REASON_STOPPED           = "stopped"
+	TUNNEL_DISCONNECT_REASON_POOL_RESIZED      = "pool_resized"
+	TUNNEL_DISCONNECT_REASON_PAUSED            = "paused"
+)
+
 // TunnelOwner specifies the interface required by Tunnel to notify its
 // owner when it has failed. The owner may, as in the case of the Controller,
 // remove the tunnel from its list of active tunnels.
 type TunnelOwner interface {
 	SignalSeededNewSLOK()
 	SignalTunnelFailure(tunnel *Tunnel)
+	SignalTunnelMigration(tunnel *Tunnel, deadline time.Duration)
 }
 
 // Tunnel is a connection to a Psiphon server. An established
@@ -87,6 +106,7 @@ type Tunnel struct {
 	isActivated                bool
 	isDiscarded                bool
 	isClosed                   bool
+	disconnectReason           string
 	sessionId                  string
 	serverEntry                *protocol.ServerEntry
 	serverContext              *ServerContext
@@ -103,6 +123,11 @@ type Tunnel struct {
 	establishDuration          time.Duration
 	establishedTime            monotime.Time
 	dialStats                  *DialStats
+	dialParams                 *DialParameters
+	qoe                        *tunnelQoE
+
+	// isDNSTunnel is set and read by the Controller, under its tunnelMutex.
+	isDNSTunnel bool
 }
 
 // DialStats records additional dial config that is sent to the server for
@@ -129,8 +154,16 @@ type DialStats struct {
 	MeekTransformedHostName        bool
 	SelectedUserAgent              bool
 	UserAgent                      string
+	UserAgentFamily                string
 	SelectedTLSProfile             bool
 	TLSProfile                     string
+	TCPFastOpenAttempted           int32
+	TCPFastOpenSucceeded           int32
+	OSSHDecoyFirstFlight           bool
+	OSSHSeedKeyDerivation          string
+	IPAddressFamilyResetRetries    int32
+	SourcePortPolicy               string
+	SourcePortReused               int32
 }
 
 // ConnectTunnel first makes a network transport connection to the
@@ -166,10 +199,38 @@ func ConnectTunnel(
 			fmt.Errorf("server does not support tunnel protocol: %s", selectedProtocol))
 	}
 
+	dialParams, err := MakeDialParameters(config, serverEntry, selectedProtocol)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	return ConnectTunnelWithDialParameters(
+		ctx, config, sessionId, serverEntry, dialParams, adjustedEstablishStartTime)
+}
+
+// ConnectTunnelWithDialParameters is ConnectTunnel with the specified dial
+// parameters, which may be loaded from a test fixture with
+// UnmarshalDialParameters to reproduce a dial. The dial parameters are
+// updated with any selections made during the dial.
+func ConnectTunnelWithDialParameters(
+	ctx context.Context,
+	config *Config,
+	sessionId string,
+	serverEntry *protocol.ServerEntry,
+	dialParams *DialParameters,
+	adjustedEstablishStartTime monotime.Time) (*Tunnel, error) {
+
+	selectedProtocol := dialParams.TunnelProtocol
+
+	if !serverEntry.SupportsProtocol(selectedProtocol) {
+		return nil, common.ContextError(
+			fmt.Errorf("server does not support tunnel protocol: %s", selectedProtocol))
+	}
+
 	// Build transport layers and establish SSH connection. Note that
 	// dialConn and monitoredConn are the same network connection.
 	dialResult, err := dialSsh(
-		ctx, config, serverEntry, selectedProtocol, sessionId)
+		ctx, config, serverEntry, dialParams, sessionId)
 	if err != nil {
 		return nil, common.ContextError(err)
 	}
@@ -189,6 +250,8 @@ func ConnectTunnel(
 		signalPortForwardFailure:   make(chan struct{}, 1),
 		adjustedEstablishStartTime: adjustedEstablishStartTime,
 		dialStats:                  dialResult.dialStats,
+		dialParams:                 dialParams,
+		qoe:                        dialResult.qoe,
 	}, nil
 }
 
@@ -216,8 +279,15 @@ func (tunnel *Tunnel) Activate(
 		// request. At this point, there is no operateTunnel monitor that will detect
 		// this condition with SSH keep alives.
 
-		timeout := tunnel.config.clientParameters.Get().Duration(
-			parameters.PsiphonAPIRequestTimeout)
+		// TunnelHandshakeAPITimeout, when set, overrides
+		// PsiphonAPIRequestTimeout for this handshake request.
+
+		p := tunnel.config.clientParameters.Get()
+		timeout := p.Duration(parameters.TunnelHandshakeAPITimeout)
+		if timeout == 0 {
+			timeout = p.Duration(parameters.PsiphonAPIRequestTimeout)
+		}
+		p = nil
 
 		if timeout > 0 {
 			var cancelFunc context.CancelFunc
@@ -233,7 +303,7 @@ func (tunnel *Tunnel) Activate(
 		resultChannel := make(chan newServerContextResult)
 
 		go func() {
-			serverContext, err := NewServerContext(tunnel)
+			serverContext, err := NewServerContext(ctx, tunnel)
 			resultChannel <- newServerContextResult{
 				serverContext: serverContext,
 				err:           err,
@@ -309,6 +379,7 @@ func (tunnel *Tunnel) Close(isDiscarded bool) {
 	isActivated := tunnel.isActivated
 	isClosed := tunnel.isClosed
 	tunnel.isClosed = true
+	disconnectReason := tunnel.disconnectReason
 	tunnel.mutex.Unlock()
 
 	if !isClosed {
@@ -338,6 +409,31 @@ func (tunnel *Tunnel) Close(isDiscarded bool) {
 		if err != nil {
 			NoticeAlert("close tunnel ssh error: %s", err)
 		}
+
+		// Discarded tunnels were never used for port forwarding and are not
+		// reported as disconnected. In all cases except when stopping, the
+		// controller establishes a replacement tunnel.
+		if isActivated && !isDiscarded {
+			if disconnectReason == "" {
+				disconnectReason = TUNNEL_DISCONNECT_REASON_FAILED
+			}
+			NoticeTunnelDisconnected(
+				disconnectReason,
+				disconnectReason != TUNNEL_DISCONNECT_REASON_STOPPED &&
+					disconnectReason != TUNNEL_DISCONNECT_REASON_PAUSED)
+		}
+	}
+}
+
+// setDisconnectReason records the reason the tunnel is disconnecting,
+// which is reported when the tunnel is closed. Only the first reason is
+// recorded, so that the underlying cause of a failure is not replaced by
+// the reason for the subsequent close.
+func (tunnel *Tunnel) setDisconnectReason(reason string) {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if tunnel.disconnectReason == "" {
+		tunnel.disconnectReason = reason
 	}
 }
 
@@ -355,6 +451,12 @@ func (tunnel *Tunnel) IsDiscarded() bool {
 	return tunnel.isDiscarded
 }
 
+// DialParameters returns the dial parameters used to connect the tunnel,
+// which may be serialized with MarshalDialParameters to reproduce the dial.
+func (tunnel *Tunnel) DialParameters() *DialParameters {
+	return tunnel.dialParams
+}
+
 // SendAPIRequest sends an API request as an SSH request through the tunnel.
 // This function blocks awaiting a response. Only one request may be in-flight
 // at once; a concurrent SendAPIRequest will block until an active request
@@ -362,18 +464,28 @@ func (tunnel *Tunnel) IsDiscarded() bool {
 func (tunnel *Tunnel) SendAPIRequest(
 	name string, requestPayload []byte) ([]byte, error) {
 
+	responsePayload, _, err := tunnel.sendAPIRequest(name, requestPayload)
+	return responsePayload, err
+}
+
+// sendAPIRequest is SendAPIRequest, and additionally reports whether a
+// failure is an API-level failure, where the server rejected the request,
+// rather than a tunnel-level failure, where the SSH request failed.
+func (tunnel *Tunnel) sendAPIRequest(
+	name string, requestPayload []byte) ([]byte, bool, error) {
+
 	ok, responsePayload, err := tunnel.sshClient.Conn.SendRequest(
 		name, true, requestPayload)
 
 	if err != nil {
-		return nil, common.ContextError(err)
+		return nil, false, common.ContextError(err)
 	}
 
 	if !ok {
-		return nil, common.ContextError(errors.New("API request rejected"))
+		return nil, true, common.ContextError(errors.New("API request rejected"))
 	}
 
-	return responsePayload, nil
+	return responsePayload, false, nil
 }
 
 // Dial establishes a port forward connection through the tunnel
@@ -410,7 +522,7 @@ func (tunnel *Tunnel) Dial(
 	defer afterFunc.Stop()
 
 	go func() {
-		sshPortForwardConn, err := tunnel.sshClient.Dial("tcp", remoteAddr)
+		sshPortForwardConn, err := tunnel.dialPortForward(remoteAddr)
 		resultChannel <- &tunnelDialResult{sshPortForwardConn, err}
 	}()
 
@@ -433,6 +545,48 @@ func (tunnel *Tunnel) Dial(
 	return tunnel.wrapWithTransferStats(conn), nil
 }
 
+// dialPortForward opens an SSH TCP port forward channel. When the
+// PortForwardCompression parameter is set and port forward compression was
+// negotiated in the handshake, a compressed port forward channel is opened.
+func (tunnel *Tunnel) dialPortForward(remoteAddr string) (net.Conn, error) {
+
+	if tunnel.serverContext == nil ||
+		!tunnel.serverContext.features.Has(protocol.FEATURE_PORT_FORWARD_COMPRESSION) ||
+		!tunnel.config.GetClientParameters().Bool(parameters.PortForwardCompression) {
+
+		return tunnel.sshClient.Dial("tcp", remoteAddr)
+	}
+
+	host, portStr, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, common.ContextError(errors.New("invalid port"))
+	}
+
+	// The extra data is the "direct-tcpip" extra data, with the same zero
+	// originator address sent by ssh.Client.Dial.
+	// http://tools.ietf.org/html/rfc4254#section-7.2
+	directTcpipExtraData := struct {
+		HostToConnect       string
+		PortToConnect       uint32
+		OriginatorIPAddress string
+		OriginatorPort      uint32
+	}{host, uint32(port), net.IPv4zero.String(), 0}
+
+	channel, requests, err := tunnel.sshClient.OpenChannel(
+		protocol.COMPRESSED_TCP_PORT_FORWARD_CHANNEL_TYPE,
+		ssh.Marshal(&directTcpipExtraData))
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+	go ssh.DiscardRequests(requests)
+
+	return common.NewCompressedConn(newChannelConn(channel)), nil
+}
+
 func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
 
 	if !tunnel.IsActivated() {
@@ -482,6 +636,7 @@ func (tunnel *Tunnel) wrapWithTransferStats(conn net.Conn) net.Conn {
 // This will terminate the tunnel.
 func (tunnel *Tunnel) SignalComponentFailure() {
 	NoticeAlert("tunnel received component failure signal")
+	tunnel.setDisconnectReason(TUNNEL_DISCONNECT_REASON_COMPONENT_FAILURE)
 	tunnel.Close(false)
 }
 
@@ -571,90 +726,235 @@ func selectFrontingParameters(
 	return
 }
 
-// initMeekConfig is a helper that creates a MeekConfig suitable for the
-// selected meek tunnel protocol.
-func initMeekConfig(
-	config *Config,
+// isMeekFrontingSNIDisabled indicates whether the TLS SNI extension is to
+// be omitted when fronting through frontingAddress. SNI is omitted for all
+// fronts when the server entry specifies meekFrontingDisableSNI, and for
+// individual fronts listed in the server entry
+// meekFrontingDisableSNIAddresses or the MeekFrontingDisableSNIAddresses
+// tactics parameter.
+func isMeekFrontingSNIDisabled(
+	config *Config, serverEntry *protocol.ServerEntry, frontingAddress string) bool {
+
+	return serverEntry.MeekFrontingDisableSNI ||
+		common.Contains(serverEntry.MeekFrontingDisableSNIAddresses, frontingAddress) ||
+		common.Contains(
+			config.GetClientParameters().Strings(parameters.MeekFrontingDisableSNIAddresses),
+			frontingAddress)
+}
+
+// selectAlternateFrontingAddresses selects up to count fronting addresses,
+// distinct from excludeAddress, for racing fronts. As with
+// selectFrontingParameters, addresses are selected uniformly at random from
+// MeekFrontingAddresses, or generated from MeekFrontingAddressesRegex.
+func selectAlternateFrontingAddresses(
 	serverEntry *protocol.ServerEntry,
-	selectedProtocol,
-	sessionId string) (*MeekConfig, error) {
+	excludeAddress string,
+	count int) ([]string, error) {
 
-	doMeekTransformHostName := func() bool {
-		return config.clientParameters.Get().WeightedCoinFlip(
-			parameters.TransformHostNameProbability)
-	}
+	selected := []string{excludeAddress}
 
-	var dialAddress string
-	useHTTPS := false
-	useObfuscatedSessionTickets := false
-	var SNIServerName, hostHeader string
-	transformedHostName := false
+	if len(serverEntry.MeekFrontingAddressesRegex) > 0 {
 
-	switch selectedProtocol {
-	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:
+		// The regex may generate only a few distinct addresses, so the
+		// number of attempts is bounded.
 
-		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
-		if err != nil {
-			return nil, common.ContextError(err)
-		}
-		dialAddress = fmt.Sprintf("%s:443", frontingAddress)
-		useHTTPS = true
-		if !serverEntry.MeekFrontingDisableSNI {
-			SNIServerName = frontingAddress
-			if doMeekTransformHostName() {
-				SNIServerName = common.GenerateHostName()
-				transformedHostName = true
+		for i := 0; i < count*4 && len(selected) < count+1; i++ {
+			frontingAddress, err := regen.Generate(serverEntry.MeekFrontingAddressesRegex)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+			if !common.Contains(selected, frontingAddress) {
+				selected = append(selected, frontingAddress)
 			}
 		}
-		hostHeader = frontingHost
 
-	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
+	} else {
 
-		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
+		perm, err := common.MakeSecureRandomPerm(len(serverEntry.MeekFrontingAddresses))
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
-		dialAddress = fmt.Sprintf("%s:80", frontingAddress)
-		hostHeader = frontingHost
+		for _, index := range perm {
+			if len(selected) >= count+1 {
+				break
+			}
+			frontingAddress := serverEntry.MeekFrontingAddresses[index]
+			if !common.Contains(selected, frontingAddress) {
+				selected = append(selected, frontingAddress)
+			}
+		}
+	}
+
+	return selected[1:], nil
+}
+
+// dialFrontedMeek dials a meek connection. For fronted meek HTTPS, when
+// MeekFrontingRaceCount is greater than 1, the dial races the selected front
+// against alternate fronts, uses the first front to complete its TLS
+// pre-dial, and cancels the remaining dials. dialParams and dialStats are
+// updated to record the winning front.
+func dialFrontedMeek(
+	ctx context.Context,
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	dialParams *DialParameters,
+	meekConfig *MeekConfig,
+	dialConfig *DialConfig,
+	dialStats *DialStats) (*MeekConn, error) {
+
+	p := config.clientParameters.Get()
+	raceCount := p.Int(parameters.MeekFrontingRaceCount)
+	dialDomainsOnly := p.Bool(parameters.MeekDialDomainsOnly)
+	p = nil
+
+	if dialParams.TunnelProtocol != protocol.TUNNEL_PROTOCOL_FRONTED_MEEK || raceCount <= 1 {
+		return DialMeek(ctx, meekConfig, dialConfig)
+	}
+
+	primaryAddress, port, err := net.SplitHostPort(meekConfig.DialAddress)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
+
+	alternateAddresses, err := selectAlternateFrontingAddresses(
+		serverEntry, primaryAddress, raceCount-1)
+	if err != nil {
+		return nil, common.ContextError(err)
+	}
 
-	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK:
+	meekConfigs := []*MeekConfig{meekConfig}
+	for _, frontingAddress := range alternateAddresses {
 
-		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
-		hostname := serverEntry.IpAddress
-		if doMeekTransformHostName() {
-			hostname = common.GenerateHostName()
-			transformedHostName = true
+		if dialDomainsOnly && net.ParseIP(frontingAddress) != nil {
+			continue
 		}
-		if serverEntry.MeekServerPort == 80 {
-			hostHeader = hostname
-		} else {
-			hostHeader = fmt.Sprintf("%s:%d", hostname, serverEntry.MeekServerPort)
+
+		alternateMeekConfig := new(MeekConfig)
+		*alternateMeekConfig = *meekConfig
+		alternateMeekConfig.DialAddress = net.JoinHostPort(frontingAddress, port)
+
+		// SNI is omitted when disabled for the alternate front. A transformed
+		// SNI is retained; otherwise, the SNI is the fronting address, as in
+		// selectMeekDialParameters.
+		if isMeekFrontingSNIDisabled(config, serverEntry, frontingAddress) {
+			alternateMeekConfig.SNIServerName = ""
+		} else if meekConfig.SNIServerName == primaryAddress ||
+			meekConfig.SNIServerName == "" {
+			alternateMeekConfig.SNIServerName = frontingAddress
+			if net.ParseIP(frontingAddress) != nil {
+				alternateMeekConfig.SNIServerName = ""
+			}
 		}
 
-	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
-		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET:
+		meekConfigs = append(meekConfigs, alternateMeekConfig)
+	}
+
+	if len(meekConfigs) == 1 {
+		return DialMeek(ctx, meekConfig, dialConfig)
+	}
+
+	// Each racing dial records its resolved IP address, which is reported
+	// only for the winning dial. The winning dial's DialConfig continues to
+	// be used for subsequent meek dials, so its callback continues to
+	// report to dialStats.
 
-		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
-		useHTTPS = true
-		if selectedProtocol == protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET {
-			useObfuscatedSessionTickets = true
+	var winnerIndex int32 = -1
+	resolvedIPAddresses := make([]atomic.Value, len(meekConfigs))
+
+	type raceResult struct {
+		index int
+		conn  *MeekConn
+		err   error
+	}
+
+	raceCtx, cancelRace := context.WithCancel(ctx)
+	results := make(chan raceResult, len(meekConfigs))
+
+	for i, raceMeekConfig := range meekConfigs {
+
+		index := i
+		raceDialConfig := new(DialConfig)
+		*raceDialConfig = *dialConfig
+		raceDialConfig.ResolvedIPCallback = func(IPAddress string) {
+			resolvedIPAddresses[index].Store(IPAddress)
+			if atomic.LoadInt32(&winnerIndex) == int32(index) {
+				dialStats.MeekResolvedIPAddress.Store(IPAddress)
+			}
 		}
-		SNIServerName = serverEntry.IpAddress
-		if doMeekTransformHostName() {
-			SNIServerName = common.GenerateHostName()
-			transformedHostName = true
+
+		go func(raceMeekConfig *MeekConfig) {
+			conn, err := DialMeek(raceCtx, raceMeekConfig, raceDialConfig)
+			results <- raceResult{index: index, conn: conn, err: err}
+		}(raceMeekConfig)
+	}
+
+	var firstErr error
+	for i := 0; i < len(meekConfigs); i++ {
+
+		result := <-results
+
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
 		}
-		if serverEntry.MeekServerPort == 443 {
-			hostHeader = serverEntry.IpAddress
-		} else {
-			hostHeader = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+
+		atomic.StoreInt32(&winnerIndex, int32(result.index))
+		if IPAddress, ok := resolvedIPAddresses[result.index].Load().(string); ok {
+			dialStats.MeekResolvedIPAddress.Store(IPAddress)
 		}
 
-	default:
+		// Interrupt the remaining dials and close any that complete.
+
+		cancelRace()
+		go func(remaining int) {
+			for j := 0; j < remaining; j++ {
+				result := <-results
+				if result.conn != nil {
+					result.conn.Close()
+				}
+			}
+		}(len(meekConfigs) - i - 1)
+
+		winnerMeekConfig := meekConfigs[result.index]
+		dialParams.MeekDialAddress = winnerMeekConfig.DialAddress
+		dialParams.MeekSNIServerName = winnerMeekConfig.SNIServerName
+		dialStats.MeekDialAddress = winnerMeekConfig.DialAddress
+		dialStats.MeekSNIServerName = winnerMeekConfig.SNIServerName
+
+		NoticeInfo("selected front %s of %d raced fronts",
+			winnerMeekConfig.DialAddress, len(meekConfigs))
+
+		return result.conn, nil
+	}
+
+	cancelRace()
+
+	return nil, common.ContextError(firstErr)
+}
+
+// initMeekConfig is a helper that creates a MeekConfig suitable for the
+// selected meek tunnel protocol, using the meek dial parameters selected by
+// MakeDialParameters.
+func initMeekConfig(
+	config *Config,
+	serverEntry *protocol.ServerEntry,
+	dialParams *DialParameters,
+	sessionId string) (*MeekConfig, error) {
+
+	selectedProtocol := dialParams.TunnelProtocol
+
+	if !protocol.TunnelProtocolUsesMeek(selectedProtocol) {
 		return nil, common.ContextError(
 			fmt.Errorf("unknown tunnel protocol: %s", selectedProtocol))
 	}
 
+	dialAddress := dialParams.MeekDialAddress
+	useHTTPS := protocol.TunnelProtocolUsesMeekHTTPS(selectedProtocol)
+	useObfuscatedSessionTickets :=
+		protocol.TunnelProtocolUsesObfuscatedSessionTickets(selectedProtocol)
+
 	if config.clientParameters.Get().Bool(parameters.MeekDialDomainsOnly) {
 		host, _, _ := net.SplitHostPort(dialAddress)
 		if net.ParseIP(host) != nil {
@@ -662,36 +962,55 @@ func initMeekConfig(
 		}
 	}
 
-	// The underlying TLS will automatically disable SNI for IP address server name
-	// values; we have this explicit check here so we record the correct value for stats.
-	if net.ParseIP(SNIServerName) != nil {
-		SNIServerName = ""
+	// TLS interception detection applies to fronted meek, where the TLS
+	// connection is to a CDN and the server certificate is not verified.
+	// On detection, subsequent protocol selection excludes meek HTTPS
+	// protocols for the remainder of the establishment.
+	var tlsInterceptionDetected func([]string)
+	if selectedProtocol == protocol.TUNNEL_PROTOCOL_FRONTED_MEEK {
+		tlsInterceptionDetected = func(indicators []string) {
+			NoticeAlert("TLS interception detected for %s: %s",
+				dialAddress, strings.Join(indicators, ", "))
+			config.setTLSInterceptionDetected(true)
+		}
 	}
 
-	// Pin the TLS profile for the entire meek connection.
-	selectedTLSProfile := ""
-	if protocol.TunnelProtocolUsesMeekHTTPS(selectedProtocol) {
-		selectedTLSProfile = SelectTLSProfile(config.clientParameters)
+	frontingTLSVerification, err := serverEntry.GetMeekFrontingTLSVerification(selectedProtocol)
+	if err != nil {
+		return nil, common.ContextError(err)
 	}
 
 	return &MeekConfig{
 		ClientParameters:              config.clientParameters,
 		DialAddress:                   dialAddress,
 		UseHTTPS:                      useHTTPS,
-		TLSProfile:                    selectedTLSProfile,
+		TLSProfile:                    dialParams.TLSProfile,
 		UseObfuscatedSessionTickets:   useObfuscatedSessionTickets,
-		SNIServerName:                 SNIServerName,
-		HostHeader:                    hostHeader,
-		TransformedHostName:           transformedHostName,
+		SNIServerName:                 dialParams.MeekSNIServerName,
+		HostHeader:                    dialParams.MeekHostHeader,
+		PathPrefix:                    serverEntry.MeekPathPrefix,
+		TransformedHostName:           dialParams.MeekTransformedHostName,
+		MaxChunkSize:                  dialParams.MeekMaxChunkSize,
+		MinChunkSize:                  dialParams.MeekMinChunkSize,
 		ClientTunnelProtocol:          selectedProtocol,
+		TLSInterceptionDetected:       tlsInterceptionDetected,
+		TLSClientSessionCache:         config.sharedTLSClientSessionCache,
+		FrontingTLSVerification:       frontingTLSVerification,
 		MeekCookieEncryptionPublicKey: serverEntry.MeekCookieEncryptionPublicKey,
 		MeekObfuscatedKey:             serverEntry.MeekObfuscatedKey,
+		URLSigningScheme:              serverEntry.MeekURLSigningScheme,
+		URLSigningKeyID:               serverEntry.MeekURLSigningKeyID,
+		URLSigningKey:                 serverEntry.MeekURLSigningKey,
 	}, nil
 }
 
-// initDialConfig is a helper that creates a DialConfig for the tunnel.
+// initDialConfig is a helper that creates a DialConfig for the tunnel. The
+// User-Agent selection is recorded in dialParams or, when dialParams
+// specifies a selected User-Agent, reused.
 func initDialConfig(
-	config *Config, meekConfig *MeekConfig) (*DialConfig, *DialStats) {
+	config *Config,
+	meekConfig *MeekConfig,
+	dialParams *DialParameters) (*DialConfig, *DialStats) {
 
 	var upstreamProxyType string
 
@@ -724,8 +1043,19 @@ func initDialConfig(
 	// Set User-Agent when using meek or an upstream HTTP proxy
 
 	var selectedUserAgent bool
-	if meekConfig != nil || upstreamProxyType == "http" {
-		selectedUserAgent = UserAgentIfUnset(config.clientParameters, dialCustomHeaders)
+	var userAgentFamily string
+	if dialParams.SelectedUserAgent {
+		dialCustomHeaders["User-Agent"] = []string{dialParams.UserAgent}
+		selectedUserAgent = true
+		userAgentFamily = dialParams.UserAgentFamily
+	} else if meekConfig != nil || upstreamProxyType == "http" {
+		selectedUserAgent, userAgentFamily = UserAgentIfUnset(
+			config.clientParameters, dialCustomHeaders, meekConfig != nil)
+		if selectedUserAgent {
+			dialParams.SelectedUserAgent = true
+			dialParams.UserAgent = http.Header(dialCustomHeaders).Get("User-Agent")
+			dialParams.UserAgentFamily = userAgentFamily
+		}
 	}
 
 	dialConfig := &DialConfig{
@@ -735,13 +1065,43 @@ func initDialConfig(
 		DnsServerGetter:               config.DnsServerGetter,
 		IPv6Synthesizer:               config.IPv6Synthesizer,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
+		DSCP:                          config.clientParameters.Get().Int(parameters.TunnelDSCP),
+		FragmentorSeed:                dialParams.FragmentorSeed,
+		IPAddressFamilyFallbackDelay:  config.clientParameters.Get().Duration(parameters.IPAddressFamilyFallbackDelay),
+		IPAddressFamilyResetRetries:   dialParams.IPAddressFamilyResetRetries,
+		ipAddressFamilyPreference:     config.ipAddressFamilyPreference,
+		connectionAttempts:            config.connectionAttempts,
+	}
+
+	p := config.clientParameters.Get()
+	sourcePortMin := p.Int(parameters.TunnelSourcePortMin)
+	sourcePortMax := p.Int(parameters.TunnelSourcePortMax)
+	if sourcePortMin > 0 && sourcePortMin <= sourcePortMax && sourcePortMax <= 65535 {
+		dialConfig.SourcePortMin = sourcePortMin
+		dialConfig.SourcePortMax = sourcePortMax
+	}
+
+	sourcePortPolicy := p.String(parameters.TunnelSourcePortPolicy)
+	if sourcePortPolicy == SOURCE_PORT_POLICY_FRESH ||
+		sourcePortPolicy == SOURCE_PORT_POLICY_REUSE_WITHIN_WINDOW {
+
+		dialConfig.SourcePortPolicy = sourcePortPolicy
+		dialConfig.SourcePortWindow = p.Duration(parameters.TunnelSourcePortWindow)
+		dialConfig.sourcePortHistory = config.sourcePortHistory
 	}
 
 	dialStats := &DialStats{}
 
+	// For User-Agents drawn from the MeekUserAgents pool, only the family
+	// is recorded.
+
 	if selectedUserAgent {
 		dialStats.SelectedUserAgent = true
-		dialStats.UserAgent = dialConfig.CustomHeaders.Get("User-Agent")
+		if userAgentFamily != "" {
+			dialStats.UserAgentFamily = userAgentFamily
+		} else {
+			dialStats.UserAgent = dialConfig.CustomHeaders.Get("User-Agent")
+		}
 	}
 
 	if upstreamProxyType != "" {
@@ -758,6 +1118,21 @@ func initDialConfig(
 		}
 	}
 
+	// The number of IP address family reset retries made by the dial is
+	// recorded for stats.
+	dialConfig.IPAddressFamilyResetRetryCallback = func() {
+		atomic.AddInt32(&dialStats.IPAddressFamilyResetRetries, 1)
+	}
+
+	// The source port policy, and whether a source port was reused, are
+	// recorded for stats.
+	if dialConfig.SourcePortPolicy != "" {
+		dialStats.SourcePortPolicy = dialConfig.SourcePortPolicy
+		dialConfig.SourcePortReusedCallback = func() {
+			atomic.StoreInt32(&dialStats.SourcePortReused, 1)
+		}
+	}
+
 	// Unconditionally initialize MeekResolvedIPAddress, so a valid string can
 	// always be read.
 	dialStats.MeekResolvedIPAddress.Store("")
@@ -779,17 +1154,80 @@ func initDialConfig(
 			dialStats.MeekResolvedIPAddress.Store(IPAddress)
 		}
 
+		if protocol.TunnelProtocolIsFronted(meekConfig.ClientTunnelProtocol) {
+			dialConfig.dnsCache = config.frontingDNSCache
+		}
+
 	}
 
 	return dialConfig, dialStats
 }
 
+// getPluggableTransportServerAddress returns the configured PT server
+// address, substituting the server entry IP address when no host is
+// specified.
+func getPluggableTransportServerAddress(
+	config *Config, serverEntry *protocol.ServerEntry) string {
+
+	host, port, _ := net.SplitHostPort(config.PluggableTransportServerAddress)
+	if host == "" {
+		host = serverEntry.IpAddress
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// sendOSSHDecoyFirstFlight dials a decoy connection to the OSSH server,
+// sends the decoy first flight, and awaits the server's acknowledgement. The
+// decoy connection is then closed, as a client would abandon a connection
+// after a TLS handshake failure. See obfuscator.SendDecoyFirstFlight.
+//
+// The decoy connection isn't a tunnel connection, so it's not subject to
+// TCP Fast Open or sampled for the tunnel QoE score.
+func sendOSSHDecoyFirstFlight(
+	ctx context.Context,
+	address string,
+	dialConfig *DialConfig,
+	keyword string,
+	serverName string) error {
+
+	decoyDialConfig := new(DialConfig)
+	*decoyDialConfig = *dialConfig
+	decoyDialConfig.TCPFastOpen = false
+	decoyDialConfig.TCPFastOpenCallback = nil
+	decoyDialConfig.tcpConnCallback = nil
+
+	conn, err := DialTCP(ctx, address, decoyDialConfig)
+	if err != nil {
+		return common.ContextError(err)
+	}
+	defer conn.Close()
+
+	// Interrupt the decoy exchange when ctx is done.
+	exchangeDone := make(chan struct{})
+	defer close(exchangeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-exchangeDone:
+		}
+	}()
+
+	err = obfuscator.SendDecoyFirstFlight(conn, keyword, serverName)
+	if err != nil {
+		return common.ContextError(err)
+	}
+
+	return nil
+}
+
 type dialResult struct {
 	dialConn      net.Conn
 	monitoredConn *common.ActivityMonitoredConn
 	sshClient     *ssh.Client
 	sshRequests   <-chan *ssh.Request
 	dialStats     *DialStats
+	qoe           *tunnelQoE
 }
 
 // dialSsh is a helper that builds the transport layers and establishes the SSH connection.
@@ -803,16 +1241,48 @@ func dialSsh(
 	ctx context.Context,
 	config *Config,
 	serverEntry *protocol.ServerEntry,
-	selectedProtocol,
-	sessionId string) (*dialResult, error) {
+	dialParams *DialParameters,
+	sessionId string) (_ *dialResult, dialErr error) {
+
+	selectedProtocol := dialParams.TunnelProtocol
 
 	p := config.clientParameters.Get()
+	adjustments := config.getNetworkConditionAdjustments()
 	timeout := p.Duration(parameters.TunnelConnectTimeout)
+	if config.isBootstrapping() {
+		if bootstrapTimeout := p.Duration(parameters.BootstrapTunnelConnectTimeout); bootstrapTimeout > 0 {
+			timeout = bootstrapTimeout
+		}
+	}
+	timeout = adjustments.scaleTimeout(timeout)
+	tcpConnectTimeout := adjustments.scaleTimeout(p.Duration(parameters.TunnelTCPConnectTimeout))
+	sshHandshakeTimeout := adjustments.scaleTimeout(p.Duration(parameters.TunnelSSHHandshakeTimeout))
 	rateLimits := p.RateLimits(parameters.TunnelRateLimits)
-	obfuscatedSSHMinPadding := p.Int(parameters.ObfuscatedSSHMinPadding)
-	obfuscatedSSHMaxPadding := p.Int(parameters.ObfuscatedSSHMaxPadding)
+	writeCoalescingWindow := p.Duration(parameters.TunnelWriteCoalescingWindow)
+	writeCoalescingMaxBytes := p.Int(parameters.TunnelWriteCoalescingMaxBytes)
+	osshSeedKeyDerivation := p.String(parameters.ObfuscatedSSHSeedKeyDerivation)
+	quicPacingRate := p.Int(parameters.QUICPacingRate)
+	quicPacingBurstBytes := p.Int(parameters.QUICPacingBurstBytes)
+	sshPreferredAlgorithms := p.SSHAlgorithms(parameters.SSHPreferredAlgorithms)
 	p = nil
 
+	// The obfuscated SSH padding length, with any server entry overrides
+	// applied, is selected by MakeDialParameters.
+	obfuscatedSSHMinPadding := dialParams.ObfuscatedSSHPaddingLength
+	obfuscatedSSHMaxPadding := dialParams.ObfuscatedSSHPaddingLength
+	tcpFastOpen := dialParams.TCPFastOpen
+	// The decoy first flight applies only to direct OSSH TCP dials.
+	osshDecoyFirstFlight := dialParams.OSSHDecoyFirstFlight &&
+		!config.UsePluggableTransport()
+
+	if dialParams.MeekConnectTimeout > 0 {
+		timeout = dialParams.MeekConnectTimeout
+	}
+
+	// establishCtx is canceled when establishment stops, in which case a
+	// dial failure is not a connection failure.
+	establishCtx := ctx
+
 	var cancelFunc context.CancelFunc
 	ctx, cancelFunc = context.WithTimeout(ctx, timeout)
 	defer cancelFunc()
@@ -838,7 +1308,7 @@ func dialSsh(
 	case protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH:
 		useObfuscatedSsh = true
 		directDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedQUICPort)
-		quicDialSNIAddress = fmt.Sprintf("%s:%d", common.GenerateHostName(), serverEntry.SshObfuscatedQUICPort)
+		quicDialSNIAddress = dialParams.QUICDialSNIAddress
 
 	case protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH:
 		useObfuscatedSsh = true
@@ -846,18 +1316,50 @@ func dialSsh(
 
 	case protocol.TUNNEL_PROTOCOL_SSH:
 		selectedSSHClientVersion = true
-		SSHClientVersion = pickSSHClientVersion()
+		SSHClientVersion = dialParams.SSHClientVersion
 		directDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshPort)
 
 	default:
 		useObfuscatedSsh = true
-		meekConfig, err = initMeekConfig(config, serverEntry, selectedProtocol, sessionId)
+		meekConfig, err = initMeekConfig(config, serverEntry, dialParams, sessionId)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
 	}
 
-	dialConfig, dialStats := initDialConfig(config, meekConfig)
+	dialConfig, dialStats := initDialConfig(config, meekConfig, dialParams)
+
+	dialConfig.TCPConnectTimeout = tcpConnectTimeout
+
+	// The tunnel's TCP conns, including any subsequent meek conns, are
+	// sampled for the tunnel QoE score.
+	qoe := newTunnelQoE()
+	dialConfig.tcpConnCallback = qoe.addTCPConn
+
+	// Apply any server-specific obfuscation parameter overrides. Invalid
+	// overrides are ignored and the client parameters are used as-is. The
+	// fragmentor overrides are applied by DialTCPFragmentor.
+
+	obfuscationParameters, err := serverEntry.GetObfuscationParameters()
+	if err != nil {
+		NoticeAlert("invalid server entry obfuscation parameters: %s", err)
+	} else if obfuscationParameters != nil {
+		dialConfig.ObfuscationParameters = obfuscationParameters
+	}
+
+	// TCP Fast Open is attempted for TCP dials only; the callback records
+	// whether a TCP Fast Open dial was made and whether the SYN data was
+	// accepted, for diagnostics and stats.
+
+	if tcpFastOpen {
+		dialConfig.TCPFastOpen = true
+		dialConfig.TCPFastOpenCallback = func(synDataAcked bool) {
+			atomic.StoreInt32(&dialStats.TCPFastOpenAttempted, 1)
+			if synDataAcked {
+				atomic.StoreInt32(&dialStats.TCPFastOpenSucceeded, 1)
+			}
+		}
+	}
 
 	// Add dial stats specific to SSH dialing
 
@@ -866,6 +1368,19 @@ func dialSsh(
 		dialStats.SSHClientVersion = SSHClientVersion
 	}
 
+	dialStats.OSSHDecoyFirstFlight = osshDecoyFirstFlight
+	dialStats.OSSHSeedKeyDerivation = osshSeedKeyDerivation
+
+	defer func() {
+		if dialErr != nil && establishCtx.Err() == nil {
+			err := recordFailedTunnelStat(
+				config, serverEntry, selectedProtocol, dialStats, dialErr)
+			if err != nil {
+				NoticeAlert("recordFailedTunnelStat failed: %s", common.ContextError(err))
+			}
+		}
+	}()
+
 	// Note: dialStats.MeekResolvedIPAddress isn't set until the dial begins,
 	// so it will always be blank in NoticeConnectingServer.
 
@@ -877,13 +1392,19 @@ func dialSsh(
 
 	// Create the base transport: meek or direct connection
 
+	dialStartTime := monotime.Now()
+
 	var dialConn net.Conn
 	if meekConfig != nil {
 
-		dialConn, err = DialMeek(
+		dialConn, err = dialFrontedMeek(
 			ctx,
+			config,
+			serverEntry,
+			dialParams,
 			meekConfig,
-			dialConfig)
+			dialConfig,
+			dialStats)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -898,12 +1419,15 @@ func dialSsh(
 			return nil, common.ContextError(err)
 		}
 
+		packetConn = quic.NewPacedPacketConn(
+			packetConn, quicPacingRate, quicPacingBurstBytes)
+
 		dialConn, err = quic.Dial(
 			ctx,
 			packetConn,
 			remoteAddr,
 			quicDialSNIAddress,
-			selectQUICVersion(config.clientParameters))
+			dialParams.QUICVersion)
 		if err != nil {
 			return nil, common.ContextError(err)
 		}
@@ -930,8 +1454,34 @@ func dialSsh(
 			return nil, common.ContextError(err)
 		}
 
+	} else if selectedProtocol == protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH &&
+		config.UsePluggableTransport() {
+
+		dialConn, err = config.pluggableTransportClient.Dial(
+			ctx,
+			getPluggableTransportServerAddress(config, serverEntry),
+			config.PluggableTransportOptions)
+		if err != nil {
+			return nil, common.ContextError(err)
+		}
+
 	} else {
 
+		// The decoy first flight is sent on a separate, abandoned decoy
+		// connection; the OSSH connection is dialed only once the server
+		// has acknowledged the decoy.
+		if osshDecoyFirstFlight {
+			err = sendOSSHDecoyFirstFlight(
+				ctx,
+				directDialAddress,
+				dialConfig,
+				serverEntry.GetObfuscatedSSHKey(selectedProtocol),
+				dialParams.OSSHDecoyServerName)
+			if err != nil {
+				return nil, common.ContextError(err)
+			}
+		}
+
 		dialConn, err = DialTCPFragmentor(
 			ctx,
 			directDialAddress,
@@ -944,6 +1494,9 @@ func dialSsh(
 		}
 	}
 
+	noticeSlowOperation(
+		config.clientParameters, parameters.SlowTunnelDialThreshold, "tunnel_dial", dialStartTime)
+
 	// If dialConn is not a Closer, tunnel failure detection may be slower
 	_, ok := dialConn.(common.Closer)
 	if !ok {
@@ -969,13 +1522,24 @@ func dialSsh(
 		monitoredConn,
 		rateLimits)
 
+	// Apply write coalescing (if configured). Meek already batches writes
+	// into HTTP requests.
+	var transportConn net.Conn = throttledConn
+	if writeCoalescingWindow > 0 && !protocol.TunnelProtocolUsesMeek(selectedProtocol) {
+		transportConn = common.NewCoalescingConn(
+			throttledConn,
+			writeCoalescingWindow,
+			writeCoalescingMaxBytes)
+	}
+
 	// Add obfuscated SSH layer
-	var sshConn net.Conn = throttledConn
+	var sshConn net.Conn = transportConn
 	if useObfuscatedSsh {
 		sshConn, err = obfuscator.NewObfuscatedSshConn(
 			obfuscator.OBFUSCATION_CONN_MODE_CLIENT,
-			throttledConn,
-			serverEntry.SshObfuscatedKey,
+			transportConn,
+			serverEntry.GetObfuscatedSSHKey(selectedProtocol),
+			[]string{osshSeedKeyDerivation},
 			&obfuscatedSSHMinPadding,
 			&obfuscatedSSHMaxPadding)
 		if err != nil {
@@ -1017,13 +1581,20 @@ func dialSsh(
 		ClientVersion:   SSHClientVersion,
 	}
 
-	if protocol.TunnelProtocolUsesObfuscatedSSH(selectedProtocol) {
-		if config.ObfuscatedSSHAlgorithms != nil {
-			sshClientConfig.KeyExchanges = []string{config.ObfuscatedSSHAlgorithms[0]}
-			sshClientConfig.Ciphers = []string{config.ObfuscatedSSHAlgorithms[1]}
-			sshClientConfig.MACs = []string{config.ObfuscatedSSHAlgorithms[2]}
-			sshClientConfig.HostKeyAlgorithms = []string{config.ObfuscatedSSHAlgorithms[3]}
-		} else {
+	if protocol.TunnelProtocolUsesObfuscatedSSH(selectedProtocol) &&
+		config.ObfuscatedSSHAlgorithms != nil {
+
+		sshClientConfig.KeyExchanges = []string{config.ObfuscatedSSHAlgorithms[0]}
+		sshClientConfig.Ciphers = []string{config.ObfuscatedSSHAlgorithms[1]}
+		sshClientConfig.MACs = []string{config.ObfuscatedSSHAlgorithms[2]}
+		sshClientConfig.HostKeyAlgorithms = []string{config.ObfuscatedSSHAlgorithms[3]}
+
+	} else {
+
+		defaults := ssh.DefaultAlgorithms()
+		omitEncryptThenMAC := false
+
+		if protocol.TunnelProtocolUsesObfuscatedSSH(selectedProtocol) {
 			// This is the list of supported non-Encrypt-then-MAC algorithms from
 			// https://github.com/Psiphon-Labs/psiphon-tunnel-core/blob/3ef11effe6acd92c3aefd140ee09c42a1f15630b/psiphon/common/crypto/ssh/common.go#L60
 			//
@@ -1032,8 +1603,21 @@ func dialSsh(
 			//
 			// TUNNEL_PROTOCOL_SSH is excepted since its KEX appears in plaintext,
 			// and the protocol is intended to look like SSH on the wire.
-			sshClientConfig.MACs = []string{"hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"}
+			defaults.MACs = []string{"hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"}
+			omitEncryptThenMAC = true
 		}
+
+		// Any SSHPreferredAlgorithms are offered, in order, ahead of the
+		// randomized defaults. The first offered algorithm which the server
+		// supports is selected, so servers which don't support a preferred
+		// algorithm, such as ChaCha20-Poly1305, negotiate a default
+		// algorithm.
+		offered := sshPreferredAlgorithms.Offered(defaults, omitEncryptThenMAC)
+
+		sshClientConfig.KeyExchanges = offered.KeyExchanges
+		sshClientConfig.Ciphers = offered.Ciphers
+		sshClientConfig.MACs = offered.MACs
+		sshClientConfig.PreferredAlgorithms = sshPreferredAlgorithms.Preferred(omitEncryptThenMAC)
 	}
 
 	// The ssh session establishment (via ssh.NewClientConn) is wrapped
@@ -1045,6 +1629,19 @@ func dialSsh(
 	// Note: TCP handshake timeouts are provided by TCPConn, and session
 	// timeouts *after* ssh establishment are provided by the ssh keep alive
 	// in operate tunnel.
+	//
+	// The optional TunnelSSHHandshakeTimeout limits the SSH handshake
+	// phase, including the obfuscated SSH seed message exchange, within the
+	// overall TunnelConnectTimeout.
+
+	sshHandshakeStartTime := monotime.Now()
+
+	sshHandshakeCtx := ctx
+	if sshHandshakeTimeout > 0 {
+		var cancelFunc context.CancelFunc
+		sshHandshakeCtx, cancelFunc = context.WithTimeout(ctx, sshHandshakeTimeout)
+		defer cancelFunc()
+	}
 
 	type sshNewClientResult struct {
 		sshClient   *ssh.Client
@@ -1086,13 +1683,16 @@ func dialSsh(
 
 	select {
 	case result = <-resultChannel:
-	case <-ctx.Done():
-		result.err = ctx.Err()
+	case <-sshHandshakeCtx.Done():
+		result.err = sshHandshakeCtx.Err()
 		// Interrupt the goroutine
 		sshConn.Close()
 		<-resultChannel
 	}
 
+	noticeSlowOperation(
+		config.clientParameters, parameters.SlowSSHHandshakeThreshold, "ssh_handshake", sshHandshakeStartTime)
+
 	if result.err != nil {
 		return nil, common.ContextError(result.err)
 	}
@@ -1114,7 +1714,8 @@ func dialSsh(
 			monitoredConn: monitoredConn,
 			sshClient:     result.sshClient,
 			sshRequests:   result.sshRequests,
-			dialStats:     dialStats},
+			dialStats:     dialStats,
+			qoe:           qoe},
 		nil
 }
 
@@ -1214,14 +1815,38 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	noticeBytesTransferredTicker := time.NewTicker(1 * time.Second)
 	defer noticeBytesTransferredTicker.Stop()
 
+	// The tunnel QoE score is updated on noticeBytesTransferredTicker ticks,
+	// once each TunnelQoEScoreUpdatePeriod, from the bytes transferred since
+	// the previous update.
+	lastQoEUpdateTime := monotime.Now()
+	qoeSent := int64(0)
+	qoeReceived := int64(0)
+
 	// The next status request and ssh keep alive times are picked at random,
 	// from a range, to make the resulting traffic less fingerprintable,
 	// Note: not using Tickers since these are not fixed time periods.
+	//
+	// Status request periods are additionally jittered, which spreads out
+	// the status requests of clients with identical period parameters. The
+	// jitter is capped so that a status request is never scheduled
+	// immediately after the previous one. As the timer is reset only after
+	// it fires, each period yields exactly one status request.
+	jitterStatusRequestPeriod := func(
+		p *parameters.ClientParametersSnapshot, period time.Duration) time.Duration {
+		jitter := p.Float(parameters.PsiphonAPIStatusRequestPeriodJitter)
+		if jitter > 0.5 {
+			jitter = 0.5
+		}
+		return common.JitterDuration(period, jitter)
+	}
+
 	nextStatusRequestPeriod := func() time.Duration {
 		p := clientParameters.Get()
-		return makeRandomPeriod(
-			p.Duration(parameters.PsiphonAPIStatusRequestPeriodMin),
-			p.Duration(parameters.PsiphonAPIStatusRequestPeriodMax))
+		return jitterStatusRequestPeriod(
+			p,
+			makeRandomPeriod(
+				p.Duration(parameters.PsiphonAPIStatusRequestPeriodMin),
+				p.Duration(parameters.PsiphonAPIStatusRequestPeriodMax)))
 	}
 
 	statsTimer := time.NewTimer(nextStatusRequestPeriod())
@@ -1234,16 +1859,19 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		NoticeInfo("Unreported persistent stats: %d", unreported)
 		p := clientParameters.Get()
 		statsTimer.Reset(
-			makeRandomPeriod(
-				p.Duration(parameters.PsiphonAPIStatusRequestShortPeriodMin),
-				p.Duration(parameters.PsiphonAPIStatusRequestShortPeriodMax)))
+			jitterStatusRequestPeriod(
+				p,
+				makeRandomPeriod(
+					p.Duration(parameters.PsiphonAPIStatusRequestShortPeriodMin),
+					p.Duration(parameters.PsiphonAPIStatusRequestShortPeriodMax))))
 	}
 
 	nextSshKeepAlivePeriod := func() time.Duration {
 		p := clientParameters.Get()
+		adjustments := tunnel.config.getNetworkConditionAdjustments()
 		return makeRandomPeriod(
-			p.Duration(parameters.SSHKeepAlivePeriodMin),
-			p.Duration(parameters.SSHKeepAlivePeriodMax))
+			adjustments.scalePeriod(p.Duration(parameters.SSHKeepAlivePeriodMin)),
+			adjustments.scalePeriod(p.Duration(parameters.SSHKeepAlivePeriodMax)))
 	}
 
 	// TODO: don't initialize timer when config.DisablePeriodicSshKeepAlive is set
@@ -1254,6 +1882,27 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		defer sshKeepAliveTimer.Stop()
 	}
 
+	// Re-randomization applies only to tunnel conns which support it; see
+	// MeekConn.Rerandomize. The period is read from the current parameters
+	// after each re-randomization, so it may be changed by tactics; once
+	// disabled, re-randomization remains disabled for the tunnel.
+	meekConn, _ := tunnel.conn.Conn.(*MeekConn)
+
+	nextRerandomizePeriod := func() time.Duration {
+		p := clientParameters.Get()
+		return common.JitterDuration(
+			p.Duration(parameters.TunnelRerandomizePeriod),
+			p.Float(parameters.TunnelRerandomizePeriodJitter))
+	}
+
+	rerandomizePeriod := nextRerandomizePeriod()
+	rerandomizeTimer := time.NewTimer(rerandomizePeriod)
+	if meekConn == nil || rerandomizePeriod <= 0 {
+		rerandomizeTimer.Stop()
+	} else {
+		defer rerandomizeTimer.Stop()
+	}
+
 	// Perform network requests in separate goroutines so as not to block
 	// other operations.
 	requestsWaitGroup := new(sync.WaitGroup)
@@ -1285,6 +1934,25 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		}
 	}()
 
+	requestsWaitGroup.Add(1)
+	signalRerandomize := make(chan struct{})
+	go func() {
+		defer requestsWaitGroup.Done()
+		for range signalRerandomize {
+			ctx, cancelFunc := context.WithTimeout(
+				tunnel.operateCtx,
+				clientParameters.Get().Duration(parameters.TunnelConnectTimeout))
+			err := meekConn.Rerandomize(ctx)
+			cancelFunc()
+			if err != nil {
+				NoticeAlert("rerandomize tunnel for %s failed: %s",
+					tunnel.serverEntry.IpAddress, common.ContextError(err))
+			} else {
+				NoticeInfo("rerandomized tunnel for %s", tunnel.serverEntry.IpAddress)
+			}
+		}
+	}()
+
 	shutdown := false
 	var err error
 	for !shutdown && err == nil {
@@ -1300,6 +1968,18 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			totalSent += sent
 			totalReceived += received
 
+			qoeSent += sent
+			qoeReceived += received
+			qoePeriod := monotime.Since(lastQoEUpdateTime)
+			p := clientParameters.Get()
+			if tunnel.qoe != nil && qoePeriod >= p.Duration(parameters.TunnelQoEScoreUpdatePeriod) {
+				tunnel.qoe.update(p, qoeSent, qoeReceived, qoePeriod)
+				lastQoEUpdateTime = monotime.Now()
+				qoeSent = 0
+				qoeReceived = 0
+			}
+			p = nil
+
 			noticePeriod := clientParameters.Get().Duration(parameters.TotalBytesTransferredNoticePeriod)
 
 			if lastTotalBytesTransferedTime.Add(noticePeriod).Before(monotime.Now()) {
@@ -1322,7 +2002,8 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		case <-sshKeepAliveTimer.C:
 			inactivePeriod := clientParameters.Get().Duration(parameters.SSHKeepAlivePeriodicInactivePeriod)
 			if lastBytesReceivedTime.Add(inactivePeriod).Before(monotime.Now()) {
-				timeout := clientParameters.Get().Duration(parameters.SSHKeepAlivePeriodicTimeout)
+				timeout := tunnel.config.getNetworkConditionAdjustments().scaleTimeout(
+					clientParameters.Get().Duration(parameters.SSHKeepAlivePeriodicTimeout))
 				select {
 				case signalSshKeepAlive <- timeout:
 				default:
@@ -1330,6 +2011,16 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			}
 			sshKeepAliveTimer.Reset(nextSshKeepAlivePeriod())
 
+		case <-rerandomizeTimer.C:
+			select {
+			case signalRerandomize <- *new(struct{}):
+			default:
+			}
+			rerandomizePeriod = nextRerandomizePeriod()
+			if rerandomizePeriod > 0 {
+				rerandomizeTimer.Reset(rerandomizePeriod)
+			}
+
 		case <-tunnel.signalPortForwardFailure:
 			// Note: no mutex on portForwardFailureTotal; only referenced here
 			tunnel.totalPortForwardFailures++
@@ -1341,11 +2032,13 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			// Otherwise, probe with an SSH keep alive.
 
 			if tunnel.conn.IsClosed() {
+				tunnel.setDisconnectReason(TUNNEL_DISCONNECT_REASON_CONNECTION_CLOSED)
 				err = errors.New("underlying conn is closed")
 			} else {
 				inactivePeriod := clientParameters.Get().Duration(parameters.SSHKeepAliveProbeInactivePeriod)
 				if lastBytesReceivedTime.Add(inactivePeriod).Before(monotime.Now()) {
-					timeout := clientParameters.Get().Duration(parameters.SSHKeepAliveProbeTimeout)
+					timeout := tunnel.config.getNetworkConditionAdjustments().scaleTimeout(
+						clientParameters.Get().Duration(parameters.SSHKeepAliveProbeTimeout))
 					select {
 					case signalSshKeepAlive <- timeout:
 					default:
@@ -1378,6 +2071,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 	close(signalSshKeepAlive)
 	close(signalStatusRequest)
+	close(signalRerandomize)
 	requestsWaitGroup.Wait()
 
 	// Capture bytes transferred since the last noticeBytesTransferredTicker tick
@@ -1419,8 +2113,10 @@ func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Durat
 
 	errChannel := make(chan error, 1)
 
+	errTimedOut := errors.New("timed out")
+
 	afterFunc := time.AfterFunc(timeout, func() {
-		errChannel <- errors.New("timed out")
+		errChannel <- errTimedOut
 	})
 	defer afterFunc.Stop()
 
@@ -1448,6 +2144,10 @@ func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Durat
 
 		errChannel <- err
 
+		if err == nil && requestOk && tunnel.qoe != nil {
+			tunnel.qoe.recordKeepAliveRTT(elapsedTime)
+		}
+
 		// Record the keep alive round trip as a speed test sample. The first
 		// keep alive is always recorded, as many tunnels are short-lived and
 		// we want to ensure that some data is gathered. Subsequent keep
@@ -1477,6 +2177,13 @@ func (tunnel *Tunnel) sendSshKeepAlive(isFirstKeepAlive bool, timeout time.Durat
 
 	err := <-errChannel
 	if err != nil {
+		// A keep alive which fails before the timeout indicates that the SSH
+		// connection was closed, typically by the server.
+		if err == errTimedOut {
+			tunnel.setDisconnectReason(TUNNEL_DISCONNECT_REASON_KEEPALIVE_TIMEOUT)
+		} else {
+			tunnel.setDisconnectReason(TUNNEL_DISCONNECT_REASON_SERVER_CLOSED)
+		}
 		tunnel.sshClient.Close()
 		tunnel.conn.Close()
 	}
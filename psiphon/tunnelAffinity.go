@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+// tunnelAffinity maps destination hosts to the active tunnel selected for
+// port forwards to that host, so that, when multiple tunnels are active, the
+// connections of a logical session, such as the many connections made to a
+// web site, use the same tunnel and egress IP address. Without affinity, the
+// round-robin tunnel selection splits a session across egress IP addresses,
+// which breaks sessions bound to the client IP address.
+//
+// Each entry expires when no port forward to its host is made within the
+// TTL. The number of entries is bounded and the least recently used entry
+// is evicted when full.
+//
+// tunnelAffinity is not safe for concurrent use; the Controller calls it
+// with the tunnel mutex locked.
+type tunnelAffinity struct {
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type tunnelAffinityEntry struct {
+	host   string
+	tunnel *Tunnel
+	expiry monotime.Time
+}
+
+func newTunnelAffinity() *tunnelAffinity {
+	return &tunnelAffinity{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the tunnel selected for host, or nil when there is no
+// unexpired entry for the host.
+func (affinity *tunnelAffinity) get(host string, now monotime.Time) *Tunnel {
+	element, ok := affinity.entries[host]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*tunnelAffinityEntry)
+	if !now.Before(entry.expiry) {
+		affinity.remove(element)
+		return nil
+	}
+	return entry.tunnel
+}
+
+// set selects tunnel for host, for ttl from now, evicting the least recently
+// used entries to stay within maxEntries.
+func (affinity *tunnelAffinity) set(
+	host string, tunnel *Tunnel, now monotime.Time, ttl time.Duration, maxEntries int) {
+
+	if element, ok := affinity.entries[host]; ok {
+		entry := element.Value.(*tunnelAffinityEntry)
+		entry.tunnel = tunnel
+		entry.expiry = now.Add(ttl)
+		affinity.lru.MoveToFront(element)
+		return
+	}
+
+	for affinity.lru.Len() > 0 && affinity.lru.Len() >= maxEntries {
+		affinity.remove(affinity.lru.Back())
+	}
+
+	affinity.entries[host] = affinity.lru.PushFront(
+		&tunnelAffinityEntry{
+			host:   host,
+			tunnel: tunnel,
+			expiry: now.Add(ttl),
+		})
+}
+
+// removeTunnel removes all entries selecting tunnel, which is no longer an
+// active tunnel.
+func (affinity *tunnelAffinity) removeTunnel(tunnel *Tunnel) {
+	for element := affinity.lru.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*tunnelAffinityEntry).tunnel == tunnel {
+			affinity.remove(element)
+		}
+		element = next
+	}
+}
+
+// clear removes all entries.
+func (affinity *tunnelAffinity) clear() {
+	affinity.entries = make(map[string]*list.Element)
+	affinity.lru.Init()
+}
+
+func (affinity *tunnelAffinity) remove(element *list.Element) {
+	delete(affinity.entries, element.Value.(*tunnelAffinityEntry).host)
+	affinity.lru.Remove(element)
+}
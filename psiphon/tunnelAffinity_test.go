@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+func TestTunnelAffinity(t *testing.T) {
+
+	affinity := newTunnelAffinity()
+
+	tunnel1 := &Tunnel{}
+	tunnel2 := &Tunnel{}
+
+	ttl := 1 * time.Minute
+	maxEntries := 3
+	now := monotime.Now()
+
+	affinity.set("a.example.com", tunnel1, now, ttl, maxEntries)
+	affinity.set("b.example.com", tunnel2, now, ttl, maxEntries)
+
+	if affinity.get("a.example.com", now) != tunnel1 ||
+		affinity.get("b.example.com", now) != tunnel2 {
+		t.Fatalf("unexpected tunnel")
+	}
+
+	// Entries expire after the TTL, which is extended by each set.
+
+	later := now.Add(ttl / 2)
+	affinity.set("a.example.com", tunnel1, later, ttl, maxEntries)
+
+	expired := now.Add(ttl)
+	if affinity.get("a.example.com", expired) != tunnel1 {
+		t.Fatalf("unexpected expiry")
+	}
+	if affinity.get("b.example.com", expired) != nil {
+		t.Fatalf("unexpected unexpired entry")
+	}
+
+	// The number of entries is bounded, evicting the least recently used
+	// entry.
+
+	affinity.clear()
+	for i := 0; i < maxEntries+1; i++ {
+		affinity.set(fmt.Sprintf("%d.example.com", i), tunnel1, now, ttl, maxEntries)
+	}
+	if len(affinity.entries) != maxEntries || affinity.lru.Len() != maxEntries {
+		t.Fatalf("unexpected entry count: %d", len(affinity.entries))
+	}
+	if affinity.get("0.example.com", now) != nil {
+		t.Fatalf("unexpected unevicted entry")
+	}
+
+	// Removing a tunnel removes its entries.
+
+	affinity.set("1.example.com", tunnel2, now, ttl, maxEntries)
+	affinity.removeTunnel(tunnel1)
+	if len(affinity.entries) != 1 || affinity.get("1.example.com", now) != tunnel2 {
+		t.Fatalf("unexpected entries after removeTunnel: %d", len(affinity.entries))
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+const (
+	TUNNEL_POOL_SIZE_CHECK_PERIOD = 1 * time.Minute
+)
+
+// tunnelPoolSizer sets the target tunnel pool size used by the Controller.
+//
+// With adaptive sizing enabled, when Config.MaxTunnelPoolSize is greater
+// than Config.TunnelPoolSize, the pool size ranges from TunnelPoolSize to
+// MaxTunnelPoolSize. The pool grows when tunnel failures are frequent, so
+// that, with more tunnels established in parallel, port forwards fail over
+// to an already established tunnel; and the pool shrinks when tunnels are
+// stable, to limit the server load and battery cost of extra tunnels.
+//
+// Otherwise, the pool size is fixed at TunnelPoolSize.
+type tunnelPoolSizer struct {
+	config         *Config
+	minSize        int
+	maxSize        int
+	mutex          sync.Mutex
+	size           int
+	failureTimes   []monotime.Time
+	lastChangeTime monotime.Time
+}
+
+func newTunnelPoolSizer(config *Config) *tunnelPoolSizer {
+
+	maxSize := config.TunnelPoolSize
+	if config.MaxTunnelPoolSize > maxSize {
+		maxSize = config.MaxTunnelPoolSize
+	}
+
+	return &tunnelPoolSizer{
+		config:         config,
+		minSize:        config.TunnelPoolSize,
+		maxSize:        maxSize,
+		size:           config.TunnelPoolSize,
+		lastChangeTime: monotime.Now(),
+	}
+}
+
+// isAdaptive indicates whether adaptive sizing is enabled.
+func (sizer *tunnelPoolSizer) isAdaptive() bool {
+	return sizer.maxSize > sizer.minSize
+}
+
+// getMaxSize returns the largest pool size that may be set.
+func (sizer *tunnelPoolSizer) getMaxSize() int {
+	return sizer.maxSize
+}
+
+// getSize returns the current target pool size.
+func (sizer *tunnelPoolSizer) getSize() int {
+	sizer.mutex.Lock()
+	defer sizer.mutex.Unlock()
+	return sizer.size
+}
+
+// recordFailure records a tunnel failure and grows the pool when there have
+// been TunnelPoolGrowFailureCount failures within
+// TunnelPoolGrowFailurePeriod. recordFailure returns the pool size and
+// whether the size changed.
+func (sizer *tunnelPoolSizer) recordFailure() (int, bool) {
+
+	if !sizer.isAdaptive() {
+		return sizer.minSize, false
+	}
+
+	p := sizer.config.GetClientParameters()
+	failureCount := p.Int(parameters.TunnelPoolGrowFailureCount)
+	failurePeriod := p.Duration(parameters.TunnelPoolGrowFailurePeriod)
+	p = nil
+
+	sizer.mutex.Lock()
+	defer sizer.mutex.Unlock()
+
+	now := monotime.Now()
+
+	// Discard failures outside of the failure period.
+	index := 0
+	for ; index < len(sizer.failureTimes); index++ {
+		if now.Sub(sizer.failureTimes[index]) < failurePeriod {
+			break
+		}
+	}
+	sizer.failureTimes = append(sizer.failureTimes[index:], now)
+
+	// The most recent failure resets the stable period, whether or not the
+	// pool grows.
+	sizer.lastChangeTime = now
+
+	if len(sizer.failureTimes) < failureCount || sizer.size >= sizer.maxSize {
+		return sizer.size, false
+	}
+
+	// Failures which grew the pool aren't counted again.
+	sizer.failureTimes = nil
+	sizer.size += 1
+
+	return sizer.size, true
+}
+
+// checkStable shrinks the pool when there have been no tunnel failures or
+// pool size changes within TunnelPoolShrinkStablePeriod. checkStable returns
+// the pool size and whether the size changed.
+func (sizer *tunnelPoolSizer) checkStable() (int, bool) {
+
+	if !sizer.isAdaptive() {
+		return sizer.minSize, false
+	}
+
+	stablePeriod := sizer.config.GetClientParameters().Duration(
+		parameters.TunnelPoolShrinkStablePeriod)
+
+	sizer.mutex.Lock()
+	defer sizer.mutex.Unlock()
+
+	if sizer.size <= sizer.minSize ||
+		monotime.Since(sizer.lastChangeTime) < stablePeriod {
+		return sizer.size, false
+	}
+
+	sizer.lastChangeTime = monotime.Now()
+	sizer.size -= 1
+
+	return sizer.size, true
+}
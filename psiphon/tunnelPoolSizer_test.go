@@ -0,0 +1,101 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestTunnelPoolSizer(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.TunnelPoolGrowFailureCount:   2,
+		parameters.TunnelPoolGrowFailurePeriod:  "1m",
+		parameters.TunnelPoolShrinkStablePeriod: "10m",
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	// Adaptive sizing is disabled when MaxTunnelPoolSize isn't set.
+
+	sizer := newTunnelPoolSizer(&Config{
+		TunnelPoolSize:   1,
+		clientParameters: clientParameters,
+	})
+
+	for i := 0; i < 3; i++ {
+		if size, changed := sizer.recordFailure(); changed || size != 1 {
+			t.Fatalf("unexpected non-adaptive pool size: %d", size)
+		}
+	}
+
+	sizer = newTunnelPoolSizer(&Config{
+		TunnelPoolSize:    1,
+		MaxTunnelPoolSize: 3,
+		clientParameters:  clientParameters,
+	})
+
+	if sizer.getMaxSize() != 3 {
+		t.Fatalf("unexpected max pool size: %d", sizer.getMaxSize())
+	}
+
+	// Failures outside of the failure period don't grow the pool.
+
+	sizer.recordFailure()
+	sizer.failureTimes[0] = sizer.failureTimes[0].Add(-2 * time.Minute)
+	if size, changed := sizer.recordFailure(); changed || size != 1 {
+		t.Fatalf("unexpected pool size after infrequent failures: %d", size)
+	}
+
+	// Frequent failures grow the pool, up to the maximum pool size.
+
+	expectedSizes := []int{2, 2, 3, 3, 3}
+	for i, expectedSize := range expectedSizes {
+		size, _ := sizer.recordFailure()
+		if size != expectedSize || sizer.getSize() != expectedSize {
+			t.Fatalf("unexpected pool size after failure %d: %d", i, size)
+		}
+	}
+
+	// The pool shrinks, down to the minimum pool size, after each stable
+	// period.
+
+	if _, changed := sizer.checkStable(); changed {
+		t.Fatalf("unexpected shrink before stable period")
+	}
+
+	expectedSizes = []int{2, 1, 1}
+	for i, expectedSize := range expectedSizes {
+		sizer.lastChangeTime = sizer.lastChangeTime.Add(-11 * time.Minute)
+		size, _ := sizer.checkStable()
+		if size != expectedSize || sizer.getSize() != expectedSize {
+			t.Fatalf("unexpected pool size after stable period %d: %d", i, size)
+		}
+	}
+}
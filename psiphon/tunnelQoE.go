@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// The tunnel QoE score component ranges. Each component scores 1 at or
+// better than its "good" value, 0 at or worse than its "poor" value, and
+// is interpolated between; throughput is interpolated on a log scale.
+const (
+	tunnelQoEGoodRTT                  = 100 * time.Millisecond
+	tunnelQoEPoorRTT                  = 1500 * time.Millisecond
+	tunnelQoEPoorLossRate             = 0.05
+	tunnelQoEGoodThroughput           = 1024 * 1024
+	tunnelQoEPoorThroughput           = 10 * 1024
+	tunnelQoEActiveThroughputBytes    = 64 * 1024
+	tunnelQoERTTSmoothingFactor       = 0.25
+	tunnelQoEEstimatedTCPSegmentBytes = 1460
+)
+
+// tunnelQoE tracks the connection quality of a tunnel and computes a QoE
+// score, from 0 (poor) to 100 (good), for display in client UIs.
+//
+// The score is a weighted average of three components, with weights set by
+// the TunnelQoEScore tactics parameters:
+//
+// - The smoothed round trip time of successful SSH keep alives.
+//
+// - The TCP retransmission rate of the tunnel's TCP conns, which estimates
+// packet loss. Retransmission counts are available only for TCP-based
+// protocols on Linux and Android.
+//
+// - The recent tunnel throughput. As throughput is limited by demand as well
+// as by network capacity, only active periods, with at least
+// tunnelQoEActiveThroughputBytes transferred, are scored.
+//
+// Components without samples are omitted and the remaining weights are
+// renormalized. There's no score until at least one component has a sample.
+type tunnelQoE struct {
+	mutex         sync.Mutex
+	tcpConns      []*tunnelQoETCPConn
+	rtt           time.Duration
+	lossRate      float64
+	hasLossRate   bool
+	throughput    float64
+	hasThroughput bool
+	score         int
+	hasScore      bool
+}
+
+type tunnelQoETCPConn struct {
+	conn        net.Conn
+	retransmits uint32
+}
+
+func newTunnelQoE() *tunnelQoE {
+	return &tunnelQoE{}
+}
+
+// addTCPConn registers a tunnel TCP conn for retransmission sampling. A
+// single tunnel may have many TCP conns, as with meek. Closed conns are
+// released on the next update.
+func (qoe *tunnelQoE) addTCPConn(conn net.Conn) {
+
+	retransmits, ok := getTCPRetransmits(conn)
+	if !ok {
+		return
+	}
+
+	qoe.mutex.Lock()
+	defer qoe.mutex.Unlock()
+
+	qoe.tcpConns = append(
+		qoe.tcpConns, &tunnelQoETCPConn{conn: conn, retransmits: retransmits})
+}
+
+// recordKeepAliveRTT records the round trip time of a successful SSH keep
+// alive.
+func (qoe *tunnelQoE) recordKeepAliveRTT(rtt time.Duration) {
+
+	qoe.mutex.Lock()
+	defer qoe.mutex.Unlock()
+
+	if qoe.rtt == 0 {
+		qoe.rtt = rtt
+	} else {
+		qoe.rtt = time.Duration(
+			tunnelQoERTTSmoothingFactor*float64(rtt) +
+				(1-tunnelQoERTTSmoothingFactor)*float64(qoe.rtt))
+	}
+}
+
+// update samples TCP retransmissions and throughput for the period since
+// the previous update, during which bytesSent and bytesReceived were
+// transferred, and recomputes the score.
+func (qoe *tunnelQoE) update(
+	p *parameters.ClientParametersSnapshot,
+	bytesSent, bytesReceived int64,
+	period time.Duration) {
+
+	qoe.mutex.Lock()
+	defer qoe.mutex.Unlock()
+
+	var retransmits uint32
+	hasRetransmits := false
+	tcpConns := qoe.tcpConns[:0]
+	for _, tcpConn := range qoe.tcpConns {
+		if closer, ok := tcpConn.conn.(common.Closer); ok && closer.IsClosed() {
+			continue
+		}
+		total, ok := getTCPRetransmits(tcpConn.conn)
+		if !ok {
+			continue
+		}
+		retransmits += total - tcpConn.retransmits
+		tcpConn.retransmits = total
+		hasRetransmits = true
+		tcpConns = append(tcpConns, tcpConn)
+	}
+	for i := len(tcpConns); i < len(qoe.tcpConns); i++ {
+		qoe.tcpConns[i] = nil
+	}
+	qoe.tcpConns = tcpConns
+
+	// The number of segments sent is estimated from the tunnel bytes sent,
+	// as TCP_INFO segment counts aren't available on all kernels.
+
+	segments := float64(bytesSent)/tunnelQoEEstimatedTCPSegmentBytes + float64(retransmits)
+	if hasRetransmits && segments >= 1 {
+		qoe.lossRate = float64(retransmits) / segments
+		qoe.hasLossRate = true
+	}
+
+	if bytesSent+bytesReceived >= tunnelQoEActiveThroughputBytes && period > 0 {
+		qoe.throughput = float64(bytesSent+bytesReceived) / period.Seconds()
+		qoe.hasThroughput = true
+	}
+
+	var weightedScore, totalWeight float64
+
+	if qoe.rtt > 0 {
+		weight := p.Float(parameters.TunnelQoEScoreRTTWeight)
+		weightedScore += weight * interpolateQoEScore(
+			float64(qoe.rtt), float64(tunnelQoEPoorRTT), float64(tunnelQoEGoodRTT))
+		totalWeight += weight
+	}
+
+	if qoe.hasLossRate {
+		weight := p.Float(parameters.TunnelQoEScoreLossWeight)
+		weightedScore += weight * interpolateQoEScore(
+			qoe.lossRate, tunnelQoEPoorLossRate, 0.0)
+		totalWeight += weight
+	}
+
+	if qoe.hasThroughput {
+		weight := p.Float(parameters.TunnelQoEScoreThroughputWeight)
+		weightedScore += weight * interpolateQoEScore(
+			math.Log(qoe.throughput),
+			math.Log(tunnelQoEPoorThroughput),
+			math.Log(tunnelQoEGoodThroughput))
+		totalWeight += weight
+	}
+
+	if totalWeight <= 0 {
+		qoe.hasScore = false
+		return
+	}
+
+	qoe.score = int(math.Round(100 * weightedScore / totalWeight))
+	qoe.hasScore = true
+}
+
+// getScore returns the current QoE score, or false when there is no score.
+func (qoe *tunnelQoE) getScore() (int, bool) {
+
+	qoe.mutex.Lock()
+	defer qoe.mutex.Unlock()
+
+	return qoe.score, qoe.hasScore
+}
+
+// interpolateQoEScore maps value to [0, 1], where poor maps to 0 and good
+// maps to 1. poor may be greater than good.
+func interpolateQoEScore(value, poor, good float64) float64 {
+	score := (value - poor) / (good - poor)
+	if score < 0 {
+		return 0
+	}
+	if score > 1 {
+		return 1
+	}
+	return score
+}
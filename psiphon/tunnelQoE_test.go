@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+func TestTunnelQoE(t *testing.T) {
+
+	clientParameters, err := parameters.NewClientParameters(nil)
+	if err != nil {
+		t.Fatalf("NewClientParameters failed: %s", err)
+	}
+
+	qoe := newTunnelQoE()
+
+	// There's no score before any component is sampled. Idle periods don't
+	// sample throughput.
+
+	qoe.update(clientParameters.Get(), 100, 100, time.Second)
+	if _, ok := qoe.getScore(); ok {
+		t.Fatalf("unexpected score")
+	}
+
+	qoe.recordKeepAliveRTT(800 * time.Millisecond)
+	qoe.update(clientParameters.Get(), 0, 0, time.Second)
+	if score, ok := qoe.getScore(); !ok || score != 50 {
+		t.Fatalf("unexpected RTT score: %d", score)
+	}
+
+	// An active period samples throughput. With the default weights, RTT
+	// scoring 0.5 and throughput scoring 1 yields (0.4*0.5 + 0.3*1)/0.7.
+
+	qoe.update(clientParameters.Get(), 1024*1024, 1024*1024, time.Second)
+	if score, ok := qoe.getScore(); !ok || score != 71 {
+		t.Fatalf("unexpected RTT and throughput score: %d", score)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.TunnelQoEScoreRTTWeight: 0.0,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	qoe.update(clientParameters.Get(), 0, 0, time.Second)
+	if score, ok := qoe.getScore(); !ok || score != 100 {
+		t.Fatalf("unexpected weighted score: %d", score)
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.TunnelQoEScoreRTTWeight:        0.0,
+		parameters.TunnelQoEScoreThroughputWeight: 0.0,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	qoe.update(clientParameters.Get(), 0, 0, time.Second)
+	if _, ok := qoe.getScore(); ok {
+		t.Fatalf("unexpected score with zero weights")
+	}
+
+	// Where TCP retransmission counts are available, a TCP conn without
+	// retransmissions scores no loss.
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	if _, ok := getTCPRetransmits(conn); !ok {
+		return
+	}
+
+	_, err = clientParameters.Set("", false, map[string]interface{}{
+		parameters.TunnelQoEScoreRTTWeight:        0.0,
+		parameters.TunnelQoEScoreThroughputWeight: 0.0,
+		parameters.TunnelQoEScoreLossWeight:       1.0,
+	})
+	if err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	qoe.addTCPConn(conn)
+	qoe.update(clientParameters.Get(), 1024*1024, 0, time.Second)
+	if score, ok := qoe.getScore(); !ok || score != 100 {
+		t.Fatalf("unexpected loss score: %d", score)
+	}
+
+	// Closed conns are released.
+
+	closedConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+
+	tcpConn := &TCPConn{Conn: closedConn}
+	qoe.addTCPConn(tcpConn)
+	if len(qoe.tcpConns) != 2 {
+		t.Fatalf("unexpected TCP conn count: %d", len(qoe.tcpConns))
+	}
+	tcpConn.Close()
+	qoe.update(clientParameters.Get(), 0, 0, time.Second)
+	if len(qoe.tcpConns) != 1 {
+		t.Fatalf("unexpected TCP conn count: %d", len(qoe.tcpConns))
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2018, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestSelectAlternateFrontingAddresses(t *testing.T) {
+
+	serverEntry := &protocol.ServerEntry{
+		MeekFrontingAddresses: []string{
+			"a.example.com", "b.example.com", "c.example.com", "b.example.com"},
+	}
+
+	for i := 0; i < 10; i++ {
+
+		addresses, err := selectAlternateFrontingAddresses(
+			serverEntry, "a.example.com", 3)
+		if err != nil {
+			t.Fatalf("selectAlternateFrontingAddresses failed: %s", err)
+		}
+
+		// Only the distinct alternates, "b" and "c", may be selected.
+
+		if len(addresses) != 2 ||
+			addresses[0] == addresses[1] ||
+			common.Contains(addresses, "a.example.com") {
+			t.Fatalf("unexpected addresses: %+v", addresses)
+		}
+	}
+
+	serverEntry = &protocol.ServerEntry{
+		MeekFrontingAddressesRegex: "[ab]\\.example\\.com",
+	}
+
+	addresses, err := selectAlternateFrontingAddresses(
+		serverEntry, "a.example.com", 2)
+	if err != nil {
+		t.Fatalf("selectAlternateFrontingAddresses failed: %s", err)
+	}
+
+	// The regex generates at most one alternate.
+
+	if len(addresses) > 1 || (len(addresses) == 1 && addresses[0] != "b.example.com") {
+		t.Fatalf("unexpected regex addresses: %+v", addresses)
+	}
+}
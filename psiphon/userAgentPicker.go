@@ -41,19 +41,39 @@ func pickUserAgent() string {
 }
 
 // UserAgentIfUnset selects and sets a User-Agent header if one is not set.
+//
+// When useMeekUserAgents is set and the MeekUserAgents pool is not empty,
+// the selected User-Agent is drawn from the pool, and its family is
+// returned.
 func UserAgentIfUnset(
-	clientParameters *parameters.ClientParameters, headers http.Header) bool {
+	clientParameters *parameters.ClientParameters,
+	headers http.Header,
+	useMeekUserAgents bool) (bool, string) {
 
 	if _, ok := headers["User-Agent"]; !ok {
 
-		if clientParameters.Get().WeightedCoinFlip(parameters.PickUserAgentProbability) {
-			headers.Set("User-Agent", pickUserAgent())
-		} else {
-			headers.Set("User-Agent", "")
+		p := clientParameters.Get()
+
+		userAgent := ""
+		family := ""
+
+		if p.WeightedCoinFlip(parameters.PickUserAgentProbability) {
+			var selected *parameters.UserAgent
+			if useMeekUserAgents {
+				selected = p.UserAgents(parameters.MeekUserAgents).Select()
+			}
+			if selected != nil {
+				userAgent = selected.UserAgent
+				family = selected.Family
+			} else {
+				userAgent = pickUserAgent()
+			}
 		}
 
-		return true
+		headers.Set("User-Agent", userAgent)
+
+		return true, family
 	}
 
-	return false
+	return false, ""
 }
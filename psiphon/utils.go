@@ -32,8 +32,10 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 )
 
 // MakePsiphonUserAgent constructs a User-Agent value to use for web service
@@ -218,3 +220,28 @@ func DoGarbageCollection() {
 	debug.SetGCPercent(5)
 	debug.FreeOSMemory()
 }
+
+// noticeSlowOperation emits a SlowOperation notice when the operation, which
+// started at startTime, exceeds the duration specified by the
+// thresholdParameter client parameter. A threshold of 0 disables the
+// notice, as does a nil clientParameters.
+func noticeSlowOperation(
+	clientParameters *parameters.ClientParameters,
+	thresholdParameter string,
+	operation string,
+	startTime monotime.Time) {
+
+	if clientParameters == nil {
+		return
+	}
+
+	threshold := clientParameters.Get().Duration(thresholdParameter)
+	if threshold <= 0 {
+		return
+	}
+
+	duration := monotime.Since(startTime)
+	if duration >= threshold {
+		NoticeSlowOperation(operation, duration)
+	}
+}